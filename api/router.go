@@ -1,7 +1,10 @@
 package api
 
 import (
+	"net/http"
+
 	"github.com/gin-gonic/gin"
+	"github.com/tgdrive/teldrive/internal/auth"
 	"github.com/tgdrive/teldrive/internal/cache"
 	"github.com/tgdrive/teldrive/internal/config"
 	"github.com/tgdrive/teldrive/internal/middleware"
@@ -10,47 +13,112 @@ import (
 	"gorm.io/gorm"
 )
 
-func InitRouter(r *gin.Engine, c *controller.Controller, cnf *config.Config, db *gorm.DB, cache cache.Cacher) *gin.Engine {
-	authmiddleware := middleware.Authmiddleware(cnf.JWT.Secret, db, cache)
+func InitRouter(r *gin.Engine, c *controller.Controller, cnf *config.Config, db *gorm.DB, cache cache.Cacher,
+	drainer *middleware.Drainer, maintenance *middleware.Maintenance) *gin.Engine {
+	authmiddleware := middleware.Authmiddleware(&cnf.JWT, db, cache)
+	ticketmiddleware := middleware.UploadTicketAuth(&cnf.JWT, auth.TicketSecret(cnf.JWT.Secret, cnf.TG.Uploads.TicketSalt),
+		db, cache, authmiddleware)
+	adminmiddleware := middleware.AdminMiddleware(cnf.JWT.AdminUsers)
+	dcoverride := middleware.DCOverride(cnf.JWT.AdminUsers)
+	publiclimit := middleware.PublicLimit(&cnf.Share)
+	rootcheck := c.CheckRoot
 	api := r.Group("/api")
+	api.Use(middleware.BodyLimit(cnf.Server.MaxBodySize, "/api/uploads", "/api/account/import"))
+	api.Use(middleware.Compress(&cnf.Server.Compression, "/stream/", "/download/", "/extract", "/parts/"))
+	api.Use(maintenance.Guard("/api/auth/", "/api/admin/", "/api/files/compare", "/unlock"))
 	{
+		api.GET("/health", func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		})
+		api.GET("/ready", drainer.Ready)
+		api.GET("/status", maintenance.Status)
 		auth := api.Group("/auth")
 		{
 			auth.GET("/session", c.GetSession)
 			auth.POST("/login", c.LogIn)
+			auth.POST("/validate-session", publiclimit, c.ValidateSession)
 			auth.POST("/logout", authmiddleware, c.Logout)
+			auth.GET("/gate", c.GetLoginGate)
 			auth.GET("/ws", c.HandleMultipleLogin)
 
 		}
 		files := api.Group("/files")
 		{
-			files.GET("", authmiddleware, c.ListFiles)
-			files.POST("", authmiddleware, c.CreateFile)
-			files.GET(":fileID", authmiddleware, c.GetFileByID)
-			files.PATCH(":fileID", authmiddleware, c.UpdateFile)
+			files.GET("", authmiddleware, rootcheck, c.ListFiles)
+			files.POST("", authmiddleware, rootcheck, c.CreateFile)
+			files.GET("/export", authmiddleware, rootcheck, c.ExportReport)
+			files.GET(":fileID", authmiddleware, rootcheck, c.GetFileByID)
+			files.PATCH(":fileID", authmiddleware, rootcheck, c.UpdateFile)
 			files.HEAD(":fileID/stream/:fileName", c.GetFileStream)
 			files.GET(":fileID/stream/:fileName", c.GetFileStream)
 			files.HEAD(":fileID/download/:fileName", c.GetFileDownload)
 			files.GET(":fileID/download/:fileName", c.GetFileDownload)
-			files.PUT(":fileID/parts", authmiddleware, c.UpdateParts)
-			files.POST(":fileID/share", authmiddleware, c.CreateShare)
-			files.GET(":fileID/share", authmiddleware, c.GetShareByFileId)
-			files.PATCH(":fileID/share", authmiddleware, c.EditShare)
-			files.DELETE(":fileID/share", authmiddleware, c.DeleteShare)
-			files.GET("/category/stats", authmiddleware, c.GetCategoryStats)
-			files.POST("/move", authmiddleware, c.MoveFiles)
-			files.POST("/directories", authmiddleware, c.MakeDirectory)
-			files.POST("/delete", authmiddleware, c.DeleteFiles)
-			files.POST("/copy", authmiddleware, c.CopyFile)
-			files.POST("/directories/move", authmiddleware, c.MoveDirectory)
+			files.GET(":fileID/extract", c.ExtractFile)
+			files.GET(":fileID/preview", c.PreviewText)
+			files.GET(":fileID/manifest", c.GetFileManifest)
+			files.GET(":fileID/checksum", c.GetFileChecksum)
+			files.POST(":fileID/compute-hash", authmiddleware, rootcheck, c.ComputeFileHash)
+			files.GET(":fileID/stats", authmiddleware, rootcheck, c.GetFileStats)
+			files.HEAD(":fileID/parts/:index", c.GetFilePart)
+			files.GET(":fileID/parts/:index", c.GetFilePart)
+			files.PUT(":fileID/parts", authmiddleware, rootcheck, c.UpdateParts)
+			files.POST(":fileID/append", authmiddleware, rootcheck, c.AppendFile)
+			files.POST(":fileID/truncate", authmiddleware, rootcheck, c.TruncateFile)
+			files.PUT(":fileID/expiry", authmiddleware, rootcheck, c.SetFileExpiry)
+			files.POST(":fileID/share", authmiddleware, rootcheck, c.CreateShare)
+			files.GET(":fileID/share", authmiddleware, rootcheck, c.GetShareByFileId)
+			files.PATCH(":fileID/share", authmiddleware, rootcheck, c.EditShare)
+			files.DELETE(":fileID/share", authmiddleware, rootcheck, c.DeleteShare)
+			files.GET(":fileID/shares", authmiddleware, rootcheck, c.ListFileShares)
+			files.DELETE(":fileID/shares", authmiddleware, rootcheck, c.RevokeFileShares)
+			files.GET("/category/stats", authmiddleware, rootcheck, c.GetCategoryStats)
+			files.GET("/recent", authmiddleware, rootcheck, c.ListRecent)
+			files.GET("/expiring", authmiddleware, rootcheck, c.ListExpiring)
+			files.GET("/changes", authmiddleware, rootcheck, c.ListChanges)
+			files.POST("/move", authmiddleware, rootcheck, c.MoveFiles)
+			files.POST("/reorganize", authmiddleware, rootcheck, c.Reorganize)
+			files.POST("/movetochannel", authmiddleware, rootcheck, c.MoveToChannel)
+			files.POST("/transfer", authmiddleware, rootcheck, c.TransferFiles)
+			files.POST("/directories", authmiddleware, rootcheck, c.MakeDirectory)
+			files.POST("/delete", authmiddleware, rootcheck, c.DeleteFiles)
+			files.POST("/copy", authmiddleware, rootcheck, c.CopyFile)
+			files.POST("/compare", authmiddleware, rootcheck, c.CompareFile)
+			files.POST("/compare/folders", authmiddleware, rootcheck, c.CompareFolders)
+			files.POST("/import/telegram", authmiddleware, rootcheck, c.ImportFromTelegram)
+			files.POST("/directories/move", authmiddleware, rootcheck, c.MoveDirectory)
+			files.POST("/clone-structure", authmiddleware, rootcheck, c.CloneStructure)
+			files.POST("/compute-hash", authmiddleware, rootcheck, c.QueueHashJob)
+			files.GET("/compute-hash/:jobID", authmiddleware, rootcheck, c.GetHashJob)
+			files.DELETE("/compute-hash/:jobID", authmiddleware, rootcheck, c.CancelHashJob)
+		}
+		channels := api.Group("/channels")
+		{
+			channels.Use(authmiddleware)
+			channels.GET("/:channelId/files", c.ListChannelFiles)
+		}
+		templates := api.Group("/templates")
+		{
+			templates.Use(authmiddleware)
+			templates.GET("", c.ListTemplates)
+			templates.POST("", c.CreateTemplate)
+			templates.DELETE("/:templateID", c.DeleteTemplate)
+			templates.POST("/:templateID/instantiate", c.InstantiateTemplate)
 		}
 		uploads := api.Group("/uploads")
 		{
-			uploads.Use(authmiddleware)
-			uploads.GET("/stats", c.UploadStats)
-			uploads.GET("/:id", c.GetUploadFileById)
-			uploads.POST("/:id", c.UploadFile)
-			uploads.DELETE("/:id", c.DeleteUploadFile)
+			uploads.GET("/stats", authmiddleware, c.UploadStats)
+			uploads.POST("", authmiddleware, c.CreateUpload)
+			uploads.POST("/ticket", authmiddleware, c.IssueUploadTicket)
+			uploads.POST("/archive", authmiddleware, rootcheck, c.ImportArchive)
+			uploads.GET("/archive", authmiddleware, c.ListArchiveImports)
+			uploads.GET("/archive/:jobID", authmiddleware, c.GetArchiveImport)
+			uploads.GET("/archive/:jobID/entries", authmiddleware, c.ListArchiveEntries)
+			uploads.GET("/:id", authmiddleware, c.GetUploadFileById)
+			uploads.GET("/:id/progress", authmiddleware, c.WatchUploadProgress)
+			uploads.GET("/:id/retention", authmiddleware, c.GetUploadRetention)
+			uploads.POST("/:id/retention", authmiddleware, c.SetUploadRetention)
+			uploads.POST("/:id", ticketmiddleware, c.UploadFile)
+			uploads.DELETE("/:id", authmiddleware, c.DeleteUploadFile)
 		}
 		users := api.Group("/users")
 		{
@@ -60,18 +128,75 @@ func InitRouter(r *gin.Engine, c *controller.Controller, cnf *config.Config, db
 			users.GET("/channels", c.ListChannels)
 			users.GET("/sessions", c.ListSessions)
 			users.PATCH("/channels", c.UpdateChannel)
+			users.PATCH("/ratelimit", c.UpdateRateLimit)
+			users.GET("/settings", c.GetSettings)
+			users.PATCH("/settings", c.UpdateSettings)
 			users.POST("/bots", c.AddBots)
 			users.DELETE("/bots", c.RemoveBots)
 			users.DELETE("/sessions/:id", c.RemoveSession)
+			users.POST("/keys", c.RotateKey)
+			users.POST("/keys/migrate", c.MigrateKeys)
+		}
+		bots := api.Group("/bots")
+		{
+			bots.Use(authmiddleware)
+			bots.GET("", c.ListBots)
+			bots.POST("", c.CreateBots)
+			bots.POST("/validate", c.ValidateBots)
+			bots.DELETE("/:botID", c.DeleteBot)
+			bots.GET("/pools", c.ListBotPools)
+			bots.PUT("/pools", c.UpdateBotPool)
+		}
+		account := api.Group("/account")
+		{
+			account.Use(authmiddleware)
+			account.GET("/telegram-status", c.GetTelegramStatus)
+			account.GET("/export", c.ExportFiles)
+			account.POST("/import", middleware.BodyLimit(cnf.Server.MaxImportSize), c.ImportFiles)
+			account.POST("/repair-root", c.RepairRoot)
+		}
+		cnf := api.Group("/config")
+		{
+			cnf.Use(authmiddleware)
+			cnf.GET("/limits", c.GetUploadLimits)
+		}
+		// Orphan cleanup is open to every user, scoped to their own data
+		// unless they are an admin.
+		api.GET("/admin/orphans", authmiddleware, dcoverride, c.ListOrphans)
+		api.POST("/admin/orphans", authmiddleware, dcoverride, c.RepairOrphans)
+		admin := api.Group("/admin")
+		{
+			admin.Use(authmiddleware, adminmiddleware, dcoverride)
+			admin.GET("/loglevel", c.GetLogLevel)
+			admin.PUT("/loglevel", c.SetLogLevel)
+			admin.GET("/maintenance", maintenance.Status)
+			admin.POST("/maintenance", maintenance.Update)
+			admin.GET("/scheduler", c.GetSchedulerQueues)
+			admin.GET("/retry-policies", c.GetRetryPolicies)
+			admin.GET("/telegram", c.CheckTelegram)
+			admin.GET("/users/:userId/filetypes", c.GetUserFileTypes)
+			admin.PUT("/users/:userId/filetypes", c.SetUserFileTypes)
+			admin.DELETE("/users/:userId/filetypes", c.ResetUserFileTypes)
+			admin.GET("/users/:userId/limits", c.GetUserEntryLimits)
+			admin.PUT("/users/:userId/limits", c.SetUserEntryLimits)
+			admin.DELETE("/users/:userId/limits", c.ResetUserEntryLimits)
 		}
 		share := api.Group("/share")
 		{
+			share.Use(publiclimit)
 			share.GET("/:shareID", c.GetShareById)
 			share.GET("/:shareID/files", c.ListShareFiles)
 			share.GET("/:shareID/files/:fileID/stream/:fileName", c.StreamSharedFile)
 			share.GET("/:shareID/files/:fileID/download/:fileName", c.StreamSharedFile)
+			share.GET("/:shareID/files/:fileID/thumbnail", c.ShareThumbnail)
 			share.POST("/:shareID/unlock", c.ShareUnlock)
 		}
+		browse := api.Group("/browse")
+		{
+			browse.Use(publiclimit)
+			browse.GET("/:slug", c.BrowseShare)
+			browse.GET("/:slug/*path", c.BrowseShare)
+		}
 	}
 
 	ui.AddRoutes(r)
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/middleware"
+	"github.com/tgdrive/teldrive/pkg/httputil"
+)
+
+func TestRouterUnderBasePath(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cnf := &config.Config{}
+	r := InitRouter(gin.New(), nil, cnf, nil, nil, middleware.NewDrainer(), middleware.NewMaintenance(cnf))
+	h := httputil.Mount("/teldrive", r)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/teldrive/api/health", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/health", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/teldrive/api/files", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "routes keep their middlewares under the prefix")
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/pkg/check"
+	"go.uber.org/zap/zapcore"
+)
+
+func NewCheck() *cobra.Command {
+	var (
+		config = config.Config{}
+		opts   check.Options
+	)
+	checkCmd := &cobra.Command{
+		Use:   "check",
+		Short: "Check the database and Telegram for inconsistencies",
+		Long: `Check reports entries that cannot be reached from their root folder, upload
+parts kept past the retention and files whose parts are gone from Telegram.
+Paths are derived from parent links, so repairing the links repairs paths.
+
+With --repair, orphaned entries are moved to ` + check.LostAndFound + `, expired upload rows
+are dropped and files with missing parts are marked unavailable. Telegram
+messages are only deleted with --delete-messages.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runCheck(cmd, &config, opts)
+		},
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return initViperConfig(cmd)
+		},
+	}
+
+	addConfigFlags(checkCmd.Flags(), &config)
+	checkCmd.Flags().BoolVar(&opts.Repair, "repair", false, "Fix the problems that can be undone")
+	checkCmd.Flags().BoolVar(&opts.DeleteMessages, "delete-messages", false, "With --repair, also delete the Telegram messages of expired uploads")
+	checkCmd.Flags().BoolVar(&opts.SkipTelegram, "skip-telegram", false, "Skip checking file parts against Telegram")
+	checkCmd.MarkFlagRequired("tg-app-id")
+	checkCmd.MarkFlagRequired("tg-app-hash")
+	checkCmd.MarkFlagRequired("db-data-source")
+
+	return checkCmd
+}
+
+func runCheck(cmd *cobra.Command, conf *config.Config, opts check.Options) error {
+	cmd.SilenceUsage = true
+
+	logging.SetConfig(&logging.Config{
+		Level:       zapcore.Level(conf.Log.Level),
+		Development: conf.Log.Development,
+		FilePath:    conf.Log.File,
+	})
+	defer logging.DefaultLogger().Sync()
+
+	if opts.DeleteMessages && !opts.Repair {
+		return fmt.Errorf("--delete-messages requires --repair")
+	}
+
+	db, err := database.NewDatabase(conf)
+	if err != nil {
+		return err
+	}
+
+	findings, err := check.New(db, conf, opts, logging.DefaultLogger()).Run(context.Background())
+
+	unresolved := 0
+	for _, finding := range findings {
+		state := "found"
+		if finding.Repaired {
+			state = "repaired"
+		} else {
+			unresolved++
+		}
+		cmd.Printf("%-8s %-14s user=%d %s %s\n", state, finding.Kind, finding.UserId, finding.FileId, finding.Detail)
+	}
+	if err != nil {
+		return err
+	}
+	cmd.Printf("%d problems found, %d repaired\n", len(findings), len(findings)-unresolved)
+	if unresolved > 0 {
+		return fmt.Errorf("%d problems left", unresolved)
+	}
+	return nil
+}
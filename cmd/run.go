@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"slices"
 	"strings"
 	"time"
 	"unicode"
@@ -21,19 +22,24 @@ import (
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"github.com/tgdrive/teldrive/api"
+	"github.com/tgdrive/teldrive/internal/auth"
 	"github.com/tgdrive/teldrive/internal/cache"
 	"github.com/tgdrive/teldrive/internal/config"
 	"github.com/tgdrive/teldrive/internal/database"
 	"github.com/tgdrive/teldrive/internal/duration"
+	"github.com/tgdrive/teldrive/internal/events"
 	"github.com/tgdrive/teldrive/internal/kv"
 	"github.com/tgdrive/teldrive/internal/logging"
 	"github.com/tgdrive/teldrive/internal/middleware"
+	"github.com/tgdrive/teldrive/internal/policy"
 	"github.com/tgdrive/teldrive/internal/tgc"
 	"github.com/tgdrive/teldrive/internal/utils"
 	"github.com/tgdrive/teldrive/pkg/controller"
 	"github.com/tgdrive/teldrive/pkg/cron"
+	"github.com/tgdrive/teldrive/pkg/httputil"
 	"github.com/tgdrive/teldrive/pkg/services"
 	"go.uber.org/fx"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"gorm.io/gorm"
 )
@@ -52,64 +58,7 @@ func NewRun() *cobra.Command {
 		},
 	}
 
-	runCmd.Flags().StringP("config", "c", "", "Config file path (default $HOME/.teldrive/config.toml)")
-	runCmd.Flags().IntVarP(&config.Server.Port, "server-port", "p", 8080, "Server port")
-	duration.DurationVar(runCmd.Flags(), &config.Server.GracefulShutdown, "server-graceful-shutdown", 15*time.Second, "Server graceful shutdown timeout")
-	runCmd.Flags().BoolVar(&config.Server.EnablePprof, "server-enable-pprof", false, "Enable Pprof Profiling")
-	duration.DurationVar(runCmd.Flags(), &config.Server.ReadTimeout, "server-read-timeout", 1*time.Hour, "Server read timeout")
-	duration.DurationVar(runCmd.Flags(), &config.Server.WriteTimeout, "server-write-timeout", 1*time.Hour, "Server write timeout")
-
-	runCmd.Flags().BoolVar(&config.CronJobs.Enable, "cronjobs-enable", true, "Run cron jobs")
-	duration.DurationVar(runCmd.Flags(), &config.CronJobs.CleanFilesInterval, "cronjobs-clean-files-interval", 1*time.Hour, "Clean files interval")
-	duration.DurationVar(runCmd.Flags(), &config.CronJobs.CleanUploadsInterval, "cronjobs-clean-uploads-interval", 12*time.Hour, "Clean uploads interval")
-	duration.DurationVar(runCmd.Flags(), &config.CronJobs.FolderSizeInterval, "cronjobs-folder-size-interval", 2*time.Hour, "Folder size update  interval")
-
-	runCmd.Flags().IntVar(&config.Cache.MaxSize, "cache-max-size", 10*1024*1024, "Max Cache max size (memory)")
-	runCmd.Flags().StringVar(&config.Cache.RedisAddr, "cache-redis-addr", "", "Redis address")
-	runCmd.Flags().StringVar(&config.Cache.RedisPass, "cache-redis-pass", "", "Redis password")
-
-	runCmd.Flags().IntVarP(&config.Log.Level, "log-level", "", -1, "Logging level")
-	runCmd.Flags().StringVar(&config.Log.File, "log-file", "", "Logging file path")
-	runCmd.Flags().BoolVar(&config.Log.Development, "log-development", false, "Enable development mode")
-
-	runCmd.Flags().StringVar(&config.JWT.Secret, "jwt-secret", "", "JWT secret key")
-	duration.DurationVar(runCmd.Flags(), &config.JWT.SessionTime, "jwt-session-time", (30*24)*time.Hour, "JWT session duration")
-	runCmd.Flags().StringSliceVar(&config.JWT.AllowedUsers, "jwt-allowed-users", []string{}, "Allowed users")
-
-	runCmd.Flags().StringVar(&config.DB.DataSource, "db-data-source", "", "Database connection string")
-	runCmd.Flags().IntVar(&config.DB.LogLevel, "db-log-level", 1, "Database log level")
-	runCmd.Flags().BoolVar(&config.DB.PrepareStmt, "db-prepare-stmt", true, "Enable prepared statements")
-	runCmd.Flags().BoolVar(&config.DB.Pool.Enable, "db-pool-enable", true, "Enable database pool")
-	runCmd.Flags().IntVar(&config.DB.Pool.MaxIdleConnections, "db-pool-max-open-connections", 25, "Database max open connections")
-	runCmd.Flags().IntVar(&config.DB.Pool.MaxIdleConnections, "db-pool-max-idle-connections", 25, "Database max idle connections")
-	duration.DurationVar(runCmd.Flags(), &config.DB.Pool.MaxLifetime, "db-pool-max-lifetime", 10*time.Minute, "Database max connection lifetime")
-
-	runCmd.Flags().IntVar(&config.TG.AppId, "tg-app-id", 0, "Telegram app ID")
-	runCmd.Flags().StringVar(&config.TG.AppHash, "tg-app-hash", "", "Telegram app hash")
-	runCmd.Flags().StringVar(&config.TG.SessionFile, "tg-session-file", "", "Bot session file path")
-	runCmd.Flags().BoolVar(&config.TG.RateLimit, "tg-rate-limit", true, "Enable rate limiting for telegram client")
-	runCmd.Flags().IntVar(&config.TG.RateBurst, "tg-rate-burst", 5, "Limiting burst for telegram client")
-	runCmd.Flags().IntVar(&config.TG.Rate, "tg-rate", 100, "Limiting rate for telegram client")
-	runCmd.Flags().StringVar(&config.TG.DeviceModel, "tg-device-model",
-		"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/116.0", "Device model")
-	runCmd.Flags().StringVar(&config.TG.SystemVersion, "tg-system-version", "Win32", "System version")
-	runCmd.Flags().StringVar(&config.TG.AppVersion, "tg-app-version", "4.6.3 K", "App version")
-	runCmd.Flags().StringVar(&config.TG.LangCode, "tg-lang-code", "en", "Language code")
-	runCmd.Flags().StringVar(&config.TG.SystemLangCode, "tg-system-lang-code", "en-US", "System language code")
-	runCmd.Flags().StringVar(&config.TG.LangPack, "tg-lang-pack", "webk", "Language pack")
-	runCmd.Flags().StringVar(&config.TG.Proxy, "tg-proxy", "", "HTTP OR SOCKS5 proxy URL")
-	runCmd.Flags().BoolVar(&config.TG.DisableStreamBots, "tg-disable-stream-bots", false, "Disable Stream bots")
-	runCmd.Flags().BoolVar(&config.TG.EnableLogging, "tg-enable-logging", false, "Enable telegram client logging")
-	runCmd.Flags().StringVar(&config.TG.Uploads.EncryptionKey, "tg-uploads-encryption-key", "", "Uploads encryption key")
-	runCmd.Flags().IntVar(&config.TG.Uploads.Threads, "tg-uploads-threads", 8, "Uploads threads")
-	runCmd.Flags().IntVar(&config.TG.Uploads.MaxRetries, "tg-uploads-max-retries", 10, "Uploads Retries")
-	runCmd.Flags().Int64Var(&config.TG.PoolSize, "tg-pool-size", 8, "Telegram Session pool size")
-	duration.DurationVar(runCmd.Flags(), &config.TG.ReconnectTimeout, "tg-reconnect-timeout", 5*time.Minute, "Reconnect Timeout")
-	duration.DurationVar(runCmd.Flags(), &config.TG.Uploads.Retention, "tg-uploads-retention", (24*7)*time.Hour, "Uploads retention duration")
-	duration.DurationVar(runCmd.Flags(), &config.TG.BgBotsCheckInterval, "tg-bg-bots-check-interval", 4*time.Hour, "Interval for checking Idle background bots")
-	runCmd.Flags().IntVar(&config.TG.Stream.MultiThreads, "tg-stream-multi-threads", 0, "Stream multi-threads")
-	runCmd.Flags().IntVar(&config.TG.Stream.Buffers, "tg-stream-buffers", 8, "No of Stream buffers")
-	duration.DurationVar(runCmd.Flags(), &config.TG.Stream.ChunkTimeout, "tg-stream-chunk-timeout", 20*time.Second, "Chunk Fetch Timeout")
+	addConfigFlags(runCmd.Flags(), &config)
 	runCmd.MarkFlagRequired("tg-app-id")
 	runCmd.MarkFlagRequired("tg-app-hash")
 	runCmd.MarkFlagRequired("db-data-source")
@@ -118,6 +67,212 @@ func NewRun() *cobra.Command {
 	return runCmd
 }
 
+// addConfigFlags registers the flags of every config setting, shared by the
+// commands that load the config.
+func addConfigFlags(flags *pflag.FlagSet, config *config.Config) {
+	flags.StringP("config", "c", "", "Config file path (default $HOME/.teldrive/config.toml)")
+	flags.IntVarP(&config.Server.Port, "server-port", "p", 8080, "Server port")
+	flags.StringVar(&config.Server.BasePath, "server-base-path", "", "Path prefix the app is served under, e.g. /teldrive")
+	duration.DurationVar(flags, &config.Server.GracefulShutdown, "server-graceful-shutdown", 15*time.Second, "Grace period for in-flight uploads and streams on shutdown")
+	duration.DurationVar(flags, &config.Server.DrainDelay, "server-drain-delay", 5*time.Second, "Time the readiness probe reports draining before the server stops accepting requests")
+	flags.BoolVar(&config.Server.EnablePprof, "server-enable-pprof", false, "Enable Pprof Profiling")
+	duration.DurationVar(flags, &config.Server.ReadHeaderTimeout, "server-read-header-timeout", 10*time.Second, "Time allowed to read request headers")
+	duration.DurationVar(flags, &config.Server.ReadTimeout, "server-read-timeout", 1*time.Minute, "Server read timeout")
+	duration.DurationVar(flags, &config.Server.WriteTimeout, "server-write-timeout", 1*time.Minute, "Server write timeout")
+	duration.DurationVar(flags, &config.Server.IdleTimeout, "server-idle-timeout", 1*time.Minute, "Keep-alive idle timeout")
+	duration.DurationVar(flags, &config.Server.LongTimeout, "server-long-timeout", 0,
+		"Read and write timeout for uploads, streams and websockets (0 for none)")
+	flags.Int64Var(&config.Server.MaxBodySize, "server-max-body-size", 10*1024*1024, "Max request body size in bytes for non-upload routes (0 for no limit)")
+	flags.Int64Var(&config.Server.MaxImportSize, "server-max-import-size", 512*1024*1024, "Max request body size in bytes for account imports (0 for no limit)")
+	flags.BoolVar(&config.Server.Maintenance, "server-maintenance", false, "Start in maintenance mode with writes disabled")
+	flags.StringVar(&config.Server.MaintenanceMessage, "server-maintenance-message", "", "Message shown to users while in maintenance mode")
+	flags.Int64Var(&config.Server.MaxWsMessageSize, "server-max-ws-message-size", 64*1024, "Max websocket message size in bytes")
+	flags.BoolVar(&config.Server.Compression.Enabled, "server-compression-enabled", true, "Compress JSON and text API responses")
+	flags.Int64Var(&config.Server.Compression.MinSize, "server-compression-min-size", 1024, "Min API response size in bytes to compress")
+	flags.StringSliceVar(&config.Server.Compression.Algorithms, "server-compression-algorithms", []string{"zstd", "gzip"}, "Content encodings to offer, in order of preference (zstd, gzip, deflate)")
+	flags.StringVar(&config.Server.TLS.CertFile, "server-tls-cert-file", "", "TLS certificate file to serve HTTPS with")
+	flags.StringVar(&config.Server.TLS.KeyFile, "server-tls-key-file", "", "TLS private key file of the certificate")
+	flags.StringSliceVar(&config.Server.TLS.Domains, "server-tls-domains", []string{}, "Domains to obtain certificates for from Let's Encrypt")
+	flags.StringVar(&config.Server.TLS.Email, "server-tls-email", "", "Contact email for Let's Encrypt")
+	flags.StringVar(&config.Server.TLS.CacheDir, "server-tls-cache-dir", "", "Directory Let's Encrypt certificates are kept in (default ~/.teldrive/certs)")
+	flags.IntVar(&config.Server.TLS.RedirectPort, "server-tls-redirect-port", 0, "Port redirecting plain HTTP to HTTPS, 0 to disable")
+	flags.StringVar(&config.Server.TLS.MinVersion, "server-tls-min-version", "1.2", "Oldest TLS version accepted (1.0, 1.1, 1.2, 1.3)")
+	flags.BoolVar(&config.Server.Headers.Enabled, "server-headers-enabled", false, "Send security headers with every response")
+	duration.DurationVar(flags, &config.Server.Headers.HstsMaxAge, "server-headers-hsts-max-age", 0, "Strict-Transport-Security max age sent over HTTPS (0 to disable)")
+	flags.BoolVar(&config.Server.Headers.HstsIncludeSubdomains, "server-headers-hsts-include-subdomains", false, "Extend HSTS to every subdomain")
+	flags.BoolVar(&config.Server.Headers.HstsPreload, "server-headers-hsts-preload", false, "Mark HSTS for browser preload lists")
+	flags.BoolVar(&config.Server.Headers.ContentTypeOptions, "server-headers-content-type-options", true, "Send X-Content-Type-Options: nosniff")
+	flags.StringVar(&config.Server.Headers.FrameOptions, "server-headers-frame-options", "sameorigin", "Who may frame the app: deny, sameorigin or empty for anyone")
+	flags.StringSliceVar(&config.Server.Headers.FrameExempt, "server-headers-frame-exempt", []string{"/share/", "/api/share/"}, "Paths that may be framed by any site, e.g. public shares")
+	flags.StringVar(&config.Server.Headers.ReferrerPolicy, "server-headers-referrer-policy", "strict-origin-when-cross-origin", "Referrer-Policy to send, empty to leave it out")
+
+	flags.BoolVar(&config.CronJobs.Enable, "cronjobs-enable", true, "Run cron jobs")
+	duration.DurationVar(flags, &config.CronJobs.CleanFilesInterval, "cronjobs-clean-files-interval", 1*time.Hour, "Clean files interval")
+	duration.DurationVar(flags, &config.CronJobs.CleanUploadsInterval, "cronjobs-clean-uploads-interval", 12*time.Hour, "Clean uploads interval")
+	duration.DurationVar(flags, &config.CronJobs.FolderSizeInterval, "cronjobs-folder-size-interval", 2*time.Hour, "Folder size update  interval")
+	duration.DurationVar(flags, &config.CronJobs.CleanBotSessionsInterval, "cronjobs-clean-bot-sessions-interval", 24*time.Hour, "Clean orphaned bot sessions interval")
+	duration.DurationVar(flags, &config.CronJobs.HashJobsInterval, "cronjobs-hash-jobs-interval", time.Minute, "Interval background hash jobs are picked up at")
+	duration.DurationVar(flags, &config.CronJobs.ChangeLogRetention, "cronjobs-change-log-retention", 30*24*time.Hour,
+		"Age past which file changes are pruned from the change log, 0 keeps them")
+
+	flags.IntVar(&config.Cache.MaxSize, "cache-max-size", 10*1024*1024, "Max Cache max size (memory)")
+	flags.StringVar(&config.Cache.RedisAddr, "cache-redis-addr", "", "Redis address")
+	flags.StringVar(&config.Cache.RedisPass, "cache-redis-pass", "", "Redis password")
+
+	flags.IntVarP(&config.Log.Level, "log-level", "", -1, "Logging level")
+	flags.StringVar(&config.Log.File, "log-file", "", "Logging file path")
+	flags.BoolVar(&config.Log.Development, "log-development", false, "Enable development mode")
+
+	flags.StringVar(&config.JWT.Secret, "jwt-secret", "", "JWT secret key")
+	duration.DurationVar(flags, &config.JWT.SessionTime, "jwt-session-time", (30*24)*time.Hour, "JWT session duration")
+	duration.DurationVar(flags, &config.JWT.MaxAge, "jwt-max-age", 0, "Log out sessions this long after login regardless of activity (0 for no limit)")
+	duration.DurationVar(flags, &config.JWT.IdleTimeout, "jwt-idle-timeout", 0, "Log out sessions without a request for this long (0 for no limit)")
+	flags.StringSliceVar(&config.JWT.AllowedUsers, "jwt-allowed-users", []string{}, "Allowed users by user id or username glob")
+	flags.StringSliceVar(&config.JWT.DeniedUsers, "jwt-denied-users", []string{}, "Denied users by user id or username glob")
+	flags.StringSliceVar(&config.JWT.AdminUsers, "jwt-admin-users", []string{}, "Admin users by user id or username glob")
+
+	flags.IntVar(&config.Files.MaxDepth, "files-max-depth", 128, "Max number of nested folders below the root (0 for no limit)")
+	flags.Int64Var(&config.Files.MaxFiles, "files-max-files", 0, "Max number of files per user (0 for no limit)")
+	flags.Int64Var(&config.Files.MaxFolders, "files-max-folders", 0, "Max number of folders per user (0 for no limit)")
+
+	flags.StringSliceVar(&config.Links.Apps, "links-apps", []string{"vlc", "potplayer"}, "Players to build open-with links for (vlc, potplayer, iina, infuse, mpv, mxplayer)")
+	duration.DurationVar(flags, &config.Links.PresignExpiry, "links-presign-expiry", 6*time.Hour, "Lifetime of presigned file links")
+	flags.BoolVar(&config.Stats.Enabled, "stats-enabled", true, "Count views and bandwidth of file streams and downloads")
+	duration.DurationVar(flags, &config.Stats.FlushInterval, "stats-flush-interval", time.Minute, "Interval at which file access counters are written")
+
+	flags.StringVar(&config.Events.Broker, "events-broker", "", "Broker to publish events to: redis, or empty to disable")
+	flags.StringVar(&config.Events.Topic, "events-topic", "teldrive:events", "Stream events are published to")
+	flags.StringVar(&config.Events.RedisAddr, "events-redis-addr", "", "Redis address of the redis broker, defaults to the cache one")
+	flags.StringVar(&config.Events.RedisPass, "events-redis-pass", "", "Redis password of the redis broker")
+	flags.Int64Var(&config.Events.MaxLen, "events-max-len", 100000, "Approximate number of events kept in the stream (0 for no limit)")
+	flags.IntVar(&config.Events.BufferSize, "events-buffer-size", 1024, "Events waiting to be published before new ones are dropped")
+	duration.DurationVar(flags, &config.Events.Timeout, "events-timeout", 5*time.Second, "Timeout for publishing a single event")
+
+	flags.StringVar(&config.Login.Gate, "login-gate", "none", "Gate before the login socket: none, captcha or invite")
+	flags.StringVar(&config.Login.Captcha.Provider, "login-captcha-provider", "turnstile", "CAPTCHA provider of the captcha gate: hcaptcha or turnstile")
+	flags.StringVar(&config.Login.Captcha.SiteKey, "login-captcha-site-key", "", "CAPTCHA site key shown to the login page")
+	flags.StringVar(&config.Login.Captcha.Secret, "login-captcha-secret", "", "CAPTCHA secret used to verify tokens")
+	flags.StringSliceVar(&config.Login.InviteCodes, "login-invite-codes", []string{}, "Invite codes accepted by the invite gate")
+
+	flags.IntVar(&config.Share.IpRate, "share-ip-rate", 120, "Public share requests per minute per client IP (0 for no limit)")
+	flags.IntVar(&config.Share.IpBurst, "share-ip-burst", 30, "Public share request burst per client IP")
+	flags.IntVar(&config.Share.LinkRate, "share-link-rate", 600, "Public share requests per minute per share link (0 for no limit)")
+	flags.IntVar(&config.Share.LinkBurst, "share-link-burst", 100, "Public share request burst per share link")
+	flags.Int64Var(&config.Share.IpBandwidth, "share-ip-bandwidth", 0, "Public share bytes per window per client IP (0 for no limit)")
+	flags.Int64Var(&config.Share.LinkBandwidth, "share-link-bandwidth", 0, "Public share bytes per window per share link (0 for no limit)")
+	duration.DurationVar(flags, &config.Share.BandwidthWindow, "share-bandwidth-window", time.Hour, "Window the share bandwidth limits apply to")
+	flags.Int64Var(&config.Share.ThumbnailSize, "share-thumbnail-size", 10*1024*1024, "Largest image in bytes public shares offer a preview link for")
+
+	flags.StringVar(&config.DB.DataSource, "db-data-source", "", "Database connection string")
+	flags.IntVar(&config.DB.LogLevel, "db-log-level", 1, "Database log level")
+	flags.BoolVar(&config.DB.PrepareStmt, "db-prepare-stmt", true, "Enable prepared statements")
+	flags.BoolVar(&config.DB.Pool.Enable, "db-pool-enable", true, "Enable database pool")
+	flags.IntVar(&config.DB.Pool.MaxIdleConnections, "db-pool-max-open-connections", 25, "Database max open connections")
+	flags.IntVar(&config.DB.Pool.MaxIdleConnections, "db-pool-max-idle-connections", 25, "Database max idle connections")
+	duration.DurationVar(flags, &config.DB.Pool.MaxLifetime, "db-pool-max-lifetime", 10*time.Minute, "Database max connection lifetime")
+
+	flags.IntVar(&config.TG.AppId, "tg-app-id", 0, "Telegram app ID")
+	flags.StringVar(&config.TG.AppHash, "tg-app-hash", "", "Telegram app hash")
+	flags.StringVar(&config.TG.SessionFile, "tg-session-file", "", "Bot session file path")
+	flags.BoolVar(&config.TG.RateLimit, "tg-rate-limit", true, "Enable rate limiting for telegram client")
+	flags.IntVar(&config.TG.RateBurst, "tg-rate-burst", 5, "Limiting burst for telegram client")
+	flags.IntVar(&config.TG.Rate, "tg-rate", 100, "Limiting rate for telegram client")
+	flags.StringVar(&config.TG.DeviceModel, "tg-device-model",
+		"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/116.0", "Device model")
+	flags.StringVar(&config.TG.SystemVersion, "tg-system-version", "Win32", "System version")
+	flags.StringVar(&config.TG.AppVersion, "tg-app-version", "4.6.3 K", "App version")
+	flags.StringVar(&config.TG.LangCode, "tg-lang-code", "en", "Language code")
+	flags.StringVar(&config.TG.SystemLangCode, "tg-system-lang-code", "en-US", "System language code")
+	flags.StringVar(&config.TG.LangPack, "tg-lang-pack", "webk", "Language pack")
+	flags.StringVar(&config.TG.Proxy, "tg-proxy", "", "HTTP OR SOCKS5 proxy URL")
+	flags.BoolVar(&config.TG.DisableStreamBots, "tg-disable-stream-bots", false, "Disable Stream bots")
+	flags.BoolVar(&config.TG.ValidateBots, "tg-validate-bots", true, "Check that bots may post and delete messages in their channel when they are added")
+	flags.BoolVar(&config.TG.EnableLogging, "tg-enable-logging", false, "Enable telegram client logging")
+	flags.StringVar(&config.TG.Uploads.EncryptionKey, "tg-uploads-encryption-key", "", "Uploads encryption key")
+	flags.StringVar(&config.TG.Uploads.MissingKey, "tg-uploads-missing-key", "warn",
+		"Startup behavior when encrypted files exist without an encryption key, warn or fail")
+	flags.StringSliceVar(&config.TG.Uploads.EncryptionRules, "tg-uploads-encryption-rules", []string{},
+		"Ordered [name:|mime:|path:]glob=encrypt|plain rules overriding upload encryption, first match wins")
+	flags.StringSliceVar(&config.TG.Uploads.MimeTypes, "tg-uploads-mime-types", []string{},
+		"ext=mime/type entries overriding the mime type of files by extension")
+	flags.BoolVar(&config.TG.Uploads.MimeSniff, "tg-uploads-mime-sniff", true,
+		"Detect the mime type of files without a specific one from their content")
+	flags.BoolVar(&config.TG.Uploads.UserKeys, "tg-uploads-user-keys", false,
+		"Encrypt uploads with per user keys derived from the encryption key")
+	flags.IntVar(&config.TG.Uploads.Threads, "tg-uploads-threads", 8, "Uploads threads")
+	flags.IntVar(&config.TG.Uploads.MaxRetries, "tg-uploads-max-retries", 0, "Deprecated, use tg-retry-upload-max-retries")
+	flags.Int64Var(&config.TG.Uploads.MaxPartSize, "tg-uploads-max-part-size", 2000*1024*1024, "Max size of a single uploaded part in bytes")
+	flags.Int64Var(&config.TG.Uploads.MaxFileSize, "tg-uploads-max-file-size", 0, "Max total file size in bytes (0 for no limit)")
+	flags.IntVar(&config.TG.Uploads.MaxParts, "tg-uploads-max-parts", 1000, "Max number of parts per file")
+	flags.StringVar(&config.TG.Uploads.TicketSalt, "tg-uploads-ticket-salt", "", "Upload ticket signing salt, rotate to revoke issued tickets")
+	duration.DurationVar(flags, &config.TG.Uploads.TicketMaxExpiry, "tg-uploads-ticket-max-expiry", 24*time.Hour, "Max lifetime of upload tickets")
+	flags.Int64Var(&config.TG.Uploads.InlineThreshold, "tg-uploads-inline-threshold", 0,
+		fmt.Sprintf("Store files up to this many bytes in the database instead of Telegram (0 disables, max %d)", services.MaxInlineSize))
+	flags.StringVar(&config.TG.Uploads.ChannelStrategy, "tg-uploads-channel-strategy", services.PlacementDefault,
+		"Channel of uploads naming none: default, round-robin or least-full")
+	flags.StringSliceVar(&config.TG.Uploads.FileTypes.AllowedExtensions, "tg-uploads-filetypes-allowed-extensions", []string{},
+		"Only accept files with these extensions (empty allows all)")
+	flags.StringSliceVar(&config.TG.Uploads.FileTypes.DeniedExtensions, "tg-uploads-filetypes-denied-extensions", []string{},
+		"Reject files with any of these extensions, e.g. exe,bat,sh")
+	flags.StringSliceVar(&config.TG.Uploads.FileTypes.AllowedMimeTypes, "tg-uploads-filetypes-allowed-mime-types", []string{},
+		"Only accept files with these mime types, globs like image/* allowed (empty allows all)")
+	flags.StringSliceVar(&config.TG.Uploads.FileTypes.DeniedMimeTypes, "tg-uploads-filetypes-denied-mime-types", []string{},
+		"Reject files with these mime types, globs like application/x-* allowed")
+	flags.BoolVar(&config.TG.Uploads.Index.Enabled, "tg-uploads-index-enabled", false, "Index the content of small text files for search")
+	flags.Int64Var(&config.TG.Uploads.Index.MaxSize, "tg-uploads-index-max-size", 1024*1024, "Max size in bytes of files whose content is indexed")
+	flags.StringSliceVar(&config.TG.Uploads.Index.MimeTypes, "tg-uploads-index-mime-types",
+		[]string{"text/*", "application/json", "application/xml", "application/x-yaml", "application/yaml", "application/javascript"},
+		"Mime types whose content is indexed, globs like text/* allowed")
+	flags.Int64Var(&config.TG.PoolSize, "tg-pool-size", 8, "Telegram Session pool size")
+	flags.IntVar(&config.TG.Clients.Max, "tg-clients-max", 200, "Max pooled telegram clients across all sessions (0 for no limit)")
+	flags.IntVar(&config.TG.Clients.PerKey, "tg-clients-per-key", 16, "Max concurrent requests sharing one pooled client")
+	duration.DurationVar(flags, &config.TG.Clients.IdleTimeout, "tg-clients-idle-timeout", 10*time.Minute, "Disconnect pooled clients idle for this long")
+	duration.DurationVar(flags, &config.TG.Clients.HealthCheckInterval, "tg-clients-health-check-interval", time.Minute, "Ping pooled clients unused for this long before lending them")
+	flags.IntVar(&config.TG.Scheduler.PremiumWeight, "tg-scheduler-premium-weight", 2, "Share of a rate limited account given to premium users relative to others")
+	addRetryFlags(flags, &config.TG.Retry.Upload, "upload", 10, 500*time.Millisecond, 10*time.Second, 0)
+	addRetryFlags(flags, &config.TG.Retry.Download, "download", 5, 200*time.Millisecond, 5*time.Second, 0)
+	addRetryFlags(flags, &config.TG.Retry.Control, "control", 5, 500*time.Millisecond, 10*time.Second, 30*time.Second)
+	flags.BoolVar(&config.TG.AutoChannel.Enabled, "tg-autochannel-enabled", false, "Create a private storage channel on first login")
+	flags.StringVar(&config.TG.AutoChannel.Name, "tg-autochannel-name", "Teldrive", "Title of the channel created on first login")
+	duration.DurationVar(flags, &config.TG.ReconnectTimeout, "tg-reconnect-timeout", 5*time.Minute, "Reconnect Timeout")
+	duration.DurationVar(flags, &config.TG.Reconnect.InitialInterval, "tg-reconnect-initial-interval", 500*time.Millisecond, "Wait before the first reconnection attempt")
+	flags.Float64Var(&config.TG.Reconnect.Multiplier, "tg-reconnect-multiplier", 1.1, "Growth of the wait after every reconnection attempt")
+	duration.DurationVar(flags, &config.TG.Reconnect.MaxInterval, "tg-reconnect-max-interval", 10*time.Second, "Max wait between reconnection attempts")
+	flags.Float64Var(&config.TG.Reconnect.Jitter, "tg-reconnect-jitter", 0.5, "Share of every reconnection wait randomized, between 0 and 1")
+	duration.DurationVar(flags, &config.TG.FloodMaxWait, "tg-flood-max-wait", 30*time.Second,
+		"Longest FLOOD_WAIT waited out before the request fails with 429, 0 waits without limit")
+	duration.DurationVar(flags, &config.TG.Uploads.Retention, "tg-uploads-retention", (24*7)*time.Hour, "Uploads retention duration")
+	duration.DurationVar(flags, &config.TG.Uploads.MaxRetention, "tg-uploads-max-retention", (24*30)*time.Hour,
+		"Longest an upload's retention can be extended from now, 0 for no limit")
+	duration.DurationVar(flags, &config.TG.BgBotsCheckInterval, "tg-bg-bots-check-interval", 4*time.Hour, "Interval for checking Idle background bots")
+	flags.IntVar(&config.TG.Stream.MultiThreads, "tg-stream-multi-threads", 0, "Stream multi-threads")
+	flags.IntVar(&config.TG.Stream.Buffers, "tg-stream-buffers", 8, "No of Stream buffers")
+	duration.DurationVar(flags, &config.TG.Stream.ChunkTimeout, "tg-stream-chunk-timeout", 20*time.Second, "Chunk Fetch Timeout")
+	flags.IntVar(&config.TG.Stream.ReconnectRetries, "tg-stream-reconnect-retries", 5, "Times a broken stream is resumed on a new connection, 0 disables")
+	duration.DurationVar(flags, &config.TG.Stream.ReconnectTimeout, "tg-stream-reconnect-timeout", 2*time.Minute, "Total time a stream may spend reconnecting")
+	flags.IntVar(&config.TG.Stream.ReadAhead, "tg-stream-read-ahead", 1, "Parts opened ahead of the one being streamed, 0 disables")
+	flags.Int64Var(&config.TG.Stream.ReadAheadSize, "tg-stream-read-ahead-size", 4*1024*1024, "Bytes buffered of every part read ahead")
+	flags.IntVar(&config.TG.Stream.PreloadParts, "tg-stream-preload-parts", 2,
+		"Upcoming parts hinted with Link preload headers by the manifest and part endpoints, 0 disables")
+	flags.BoolVar(&config.TG.Stream.PreloadPush, "tg-stream-preload-push", false, "Also push the hinted parts over HTTP/2")
+	flags.IntVar(&config.TG.Delete.Concurrency, "tg-delete-concurrency", 4, "Message deletion requests sent at a time")
+	flags.IntVar(&config.TG.Delete.BatchSize, "tg-delete-batch-size", 100, "Messages deleted per request, at most 100")
+	flags.IntVar(&config.TG.Delete.Retries, "tg-delete-retries", 3, "Times a deletion refused with a flood wait or transient error is retried")
+	flags.StringVar(&config.TG.Hashing.Algorithm, "tg-hashing-algorithm", "sha256", "Default algorithm of server computed file hashes")
+	flags.Int64Var(&config.TG.Hashing.MaxRate, "tg-hashing-max-rate", 0, "Max bytes per second read while hashing files, 0 for no limit")
+	flags.Int64Var(&config.TG.Hashing.CheckpointSize, "tg-hashing-checkpoint-size", 64*1024*1024,
+		"Bytes hashed between saved checkpoints a failed hash resumes from")
+}
+
+func addRetryFlags(flags *pflag.FlagSet, policy *config.RetryPolicy, operation string, retries int,
+	backoff, maxBackoff, timeout time.Duration) {
+	prefix := "tg-retry-" + operation
+	flags.IntVar(&policy.MaxRetries, prefix+"-max-retries", retries, fmt.Sprintf("Max attempts of %s requests failing with transient errors", operation))
+	duration.DurationVar(flags, &policy.Backoff, prefix+"-backoff", backoff, fmt.Sprintf("Wait before retrying %s requests, doubled after every attempt (0 retries at once)", operation))
+	duration.DurationVar(flags, &policy.MaxBackoff, prefix+"-max-backoff", maxBackoff, fmt.Sprintf("Max wait between attempts of %s requests", operation))
+	duration.DurationVar(flags, &policy.Timeout, prefix+"-timeout", timeout, fmt.Sprintf("Timeout of a single attempt of %s requests (0 for none)", operation))
+}
+
 func runApplication(conf *config.Config) {
 	logging.SetConfig(&logging.Config{
 		Level:       zapcore.Level(conf.Log.Level),
@@ -132,6 +287,103 @@ func runApplication(conf *config.Config) {
 		cancel()
 	}()
 
+	conf.JWT.AllowedUsers = dropBlank(conf.JWT.AllowedUsers)
+	conf.JWT.DeniedUsers = dropBlank(conf.JWT.DeniedUsers)
+	conf.JWT.AdminUsers = dropBlank(conf.JWT.AdminUsers)
+
+	if _, err := policy.ParseEncryption(conf.TG.Uploads.EncryptionRules); err != nil {
+		logging.DefaultLogger().Fatalf("config: %v", err)
+	}
+	if _, err := policy.ParseMimeTypes(conf.TG.Uploads.MimeTypes); err != nil {
+		logging.DefaultLogger().Fatalf("config: %v", err)
+	}
+	if err := policy.FileTypes(conf.TG.Uploads.FileTypes).Validate(); err != nil {
+		logging.DefaultLogger().Fatalf("config: %v", err)
+	}
+	if err := (policy.FileTypes{AllowedMimeTypes: conf.TG.Uploads.Index.MimeTypes}).Validate(); err != nil {
+		logging.DefaultLogger().Fatalf("config: index %v", err)
+	}
+	if t := conf.TG.Uploads.InlineThreshold; t < 0 || t > services.MaxInlineSize {
+		logging.DefaultLogger().Fatalf("config: inline threshold must be between 0 and %d bytes", services.MaxInlineSize)
+	}
+	if !slices.Contains([]string{"warn", "fail"}, conf.TG.Uploads.MissingKey) {
+		logging.DefaultLogger().Fatalf("config: missing key must be warn or fail")
+	}
+	if !slices.Contains(services.PlacementStrategies, conf.TG.Uploads.ChannelStrategy) {
+		logging.DefaultLogger().Fatalf("config: channel strategy must be one of %v", services.PlacementStrategies)
+	}
+	if conf.TG.Uploads.UserKeys && conf.TG.Uploads.EncryptionKey == "" {
+		logging.DefaultLogger().Fatalf("config: user keys are derived from the uploads encryption key, set one")
+	}
+	if conf.TG.Uploads.MaxRetention < 0 {
+		logging.DefaultLogger().Fatalf("config: max retention must not be negative")
+	}
+	for _, algorithm := range conf.Server.Compression.Algorithms {
+		if !slices.Contains(middleware.CompressionAlgorithms, algorithm) {
+			logging.DefaultLogger().Fatalf("config: unknown compression algorithm %q", algorithm)
+		}
+	}
+	if err := auth.ValidateLoginGate(&conf.Login); err != nil {
+		logging.DefaultLogger().Fatalf("config: %v", err)
+	}
+	if _, ok := services.HashAlgorithms[conf.TG.Hashing.Algorithm]; !ok {
+		logging.DefaultLogger().Fatalf("config: unknown hashing algorithm %q", conf.TG.Hashing.Algorithm)
+	}
+	if conf.TG.Stream.ReadAhead < 0 || conf.TG.Stream.ReadAheadSize < 0 {
+		logging.DefaultLogger().Fatalf("config: stream read ahead must not be negative")
+	}
+	if p := conf.TG.Stream.PreloadParts; p < 0 || p > services.MaxPreloadParts {
+		logging.DefaultLogger().Fatalf("config: stream preload parts must be between 0 and %d", services.MaxPreloadParts)
+	}
+	if !slices.Contains(middleware.FrameOptions, conf.Server.Headers.FrameOptions) {
+		logging.DefaultLogger().Fatalf("config: frame options must be one of deny, sameorigin or empty")
+	}
+	if _, err := httputil.NewTLS(&conf.Server.TLS); err != nil {
+		logging.DefaultLogger().Fatalf("config: tls: %v", err)
+	}
+	if p := conf.Server.TLS.RedirectPort; p < 0 || p > 65535 || p == conf.Server.Port {
+		logging.DefaultLogger().Fatalf("config: tls redirect port must be between 0 and 65535 and differ from the server port")
+	}
+	if err := tgc.DeleteOptionsFor(&conf.TG).Validate(); err != nil {
+		logging.DefaultLogger().Fatalf("config: delete: %v", err)
+	}
+	if err := tgc.ReconnectOptionsFor(&conf.TG).Validate(); err != nil {
+		logging.DefaultLogger().Fatalf("config: reconnect: %v", err)
+	}
+	if conf.TG.Scheduler.PremiumWeight < 1 {
+		logging.DefaultLogger().Fatalf("config: scheduler premium weight must be at least 1")
+	}
+	if conf.Files.MaxDepth < 0 {
+		logging.DefaultLogger().Fatalf("config: files max depth must not be negative")
+	}
+	if conf.Files.MaxFiles < 0 || conf.Files.MaxFolders < 0 {
+		logging.DefaultLogger().Fatalf("config: files max files and folders must not be negative")
+	}
+	switch conf.Events.Broker {
+	case "":
+	case "redis":
+		if conf.Events.RedisAddr == "" {
+			conf.Events.RedisAddr, conf.Events.RedisPass = conf.Cache.RedisAddr, conf.Cache.RedisPass
+		}
+		if conf.Events.RedisAddr == "" {
+			logging.DefaultLogger().Fatalf("config: events redis broker needs a redis address")
+		}
+	default:
+		logging.DefaultLogger().Fatalf("config: unknown events broker %q", conf.Events.Broker)
+	}
+	if conf.Events.Topic == "" || conf.Events.BufferSize < 1 || conf.Events.MaxLen < 0 {
+		logging.DefaultLogger().Fatalf("config: events topic and buffer size must be set and max len not negative")
+	}
+	if conf.TG.Uploads.MaxRetries > 0 {
+		logging.DefaultLogger().Warn("config: tg-uploads-max-retries is deprecated, use tg-retry-upload-max-retries")
+		conf.TG.Retry.Upload.MaxRetries = conf.TG.Uploads.MaxRetries
+	}
+	for _, op := range tgc.Operations {
+		if err := tgc.ValidateRetryPolicy(tgc.RetryPolicyFor(&conf.TG, op)); err != nil {
+			logging.DefaultLogger().Fatalf("config: %s retry policy: %v", op, err)
+		}
+	}
+
 	scheduler := gocron.NewScheduler(time.UTC)
 
 	cacher := cache.NewCache(ctx, conf)
@@ -145,20 +397,27 @@ func runApplication(conf *config.Config) {
 		fx.Supply(logging.DefaultLogger().Desugar()),
 		fx.Supply(logging.DefaultLogger()),
 		fx.NopLogger,
-		fx.StopTimeout(conf.Server.GracefulShutdown+time.Second),
+		fx.StopTimeout(conf.Server.DrainDelay+conf.Server.GracefulShutdown+5*time.Second),
 		fx.Provide(
 			database.NewDatabase,
 			kv.NewBoltKV,
+			events.NewFromConfig,
 			tgc.NewBotWorker,
 			tgc.NewStreamWorker,
+			tgc.NewManager,
+			services.NewAppCredentialStore,
 			services.NewAuthService,
 			services.NewFileService,
 			services.NewUploadService,
 			services.NewUserService,
 			services.NewShareService,
+			services.NewAdminService,
 			controller.NewController,
+			middleware.NewDrainer,
+			middleware.NewMaintenance,
 		),
 		fx.Invoke(
+			services.CheckEncryptionKey,
 			initApp,
 			cron.StartCronJobs,
 		),
@@ -167,6 +426,11 @@ func runApplication(conf *config.Config) {
 	app.Run()
 }
 
+// dropBlank removes the empty entries config files use as list placeholders.
+func dropBlank(entries []string) []string {
+	return slices.DeleteFunc(entries, func(entry string) bool { return strings.TrimSpace(entry) == "" })
+}
+
 func initViperConfig(cmd *cobra.Command) error {
 
 	viper.SetConfigType("toml")
@@ -236,7 +500,9 @@ func modifyFlag(s string) string {
 	return string(result)
 }
 
-func initApp(lc fx.Lifecycle, cfg *config.Config, c *controller.Controller, db *gorm.DB, cache cache.Cacher) *gin.Engine {
+func initApp(lc fx.Lifecycle, cfg *config.Config, c *controller.Controller, db *gorm.DB, cache cache.Cacher,
+	drainer *middleware.Drainer, maintenance *middleware.Maintenance, worker *tgc.StreamWorker, clients *tgc.Manager, scheduler *gocron.Scheduler,
+	emitter *events.Emitter) *gin.Engine {
 
 	gin.SetMode(gin.ReleaseMode)
 
@@ -246,7 +512,11 @@ func initApp(lc fx.Lifecycle, cfg *config.Config, c *controller.Controller, db *
 		pprof.Register(r)
 	}
 
-	r.Use(gin.Recovery())
+	r.Use(gin.CustomRecovery(func(c *gin.Context, recovered any) {
+		httputil.NewError(c, http.StatusInternalServerError, fmt.Errorf("panic: %v", recovered))
+	}))
+
+	r.Use(middleware.RequestID())
 
 	skipPathRegexps := []*regexp.Regexp{
 		regexp.MustCompile(`^/assets/.*`),
@@ -257,10 +527,23 @@ func initApp(lc fx.Lifecycle, cfg *config.Config, c *controller.Controller, db *
 		TimeFormat:      time.RFC3339,
 		UTC:             true,
 		SkipPathRegexps: skipPathRegexps,
+		Context: func(c *gin.Context) []zapcore.Field {
+			return []zapcore.Field{zap.String("requestId", c.GetString(middleware.RequestIDKey))}
+		},
 	}))
 
 	r.Use(middleware.Cors())
 
+	r.Use(middleware.SecureHeaders(&cfg.Server.Headers))
+
+	longRunning := []string{"/api/uploads", "/stream/", "/download/", "/extract", "/parts/"}
+
+	r.Use(drainer.Track(longRunning...))
+
+	r.Use(middleware.ExtendDeadlines(cfg.Server.LongTimeout,
+		append(longRunning, "/api/auth/ws", "/api/account/export", "/api/account/import", "/api/files/export",
+			"/api/files/movetochannel", "/api/files/transfer", "/api/files/import/telegram")...))
+
 	r.Use(func(c *gin.Context) {
 		pattern := `/(assets|images|fonts)/.*\.(js|css|svg|jpeg|jpg|png|woff|woff2|ttf|json|webp|png|ico|txt)$`
 		re, _ := regexp.Compile(pattern)
@@ -271,30 +554,100 @@ func initApp(lc fx.Lifecycle, cfg *config.Config, c *controller.Controller, db *
 		c.Next()
 	})
 
-	r = api.InitRouter(r, c, cfg, db, cache)
+	r = api.InitRouter(r, c, cfg, db, cache, drainer, maintenance)
 	srv := &http.Server{
 		Addr:              fmt.Sprintf(":%d", cfg.Server.Port),
-		Handler:           r,
+		Handler:           httputil.Mount(cfg.Server.BasePath, r),
 		ReadTimeout:       cfg.Server.ReadTimeout,
 		WriteTimeout:      cfg.Server.WriteTimeout,
-		ReadHeaderTimeout: 10 * time.Second,
-		IdleTimeout:       60 * time.Second,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+
+	// validated at startup
+	serverTLS, _ := httputil.NewTLS(&cfg.Server.TLS)
+
+	var redirect *http.Server
+	if serverTLS != nil {
+		srv.TLSConfig = serverTLS.Config
+		if cfg.Server.TLS.RedirectPort > 0 {
+			redirect = &http.Server{
+				Addr:              fmt.Sprintf(":%d", cfg.Server.TLS.RedirectPort),
+				Handler:           serverTLS.RedirectHandler(cfg.Server.Port),
+				ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+			}
+		}
 	}
+
 	lc.Append(fx.Hook{
 		OnStart: func(ctx context.Context) error {
-			logging.FromContext(ctx).Infof("Started server http://localhost:%d", cfg.Server.Port)
+			scheme := "http"
+			if serverTLS != nil {
+				scheme = "https"
+			}
+			logging.FromContext(ctx).Infof("Started server %s://localhost:%d%s", scheme, cfg.Server.Port,
+				httputil.NormalizeBasePath(cfg.Server.BasePath))
 
 			go func() {
-
-				if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				var err error
+				if serverTLS != nil {
+					err = srv.ListenAndServeTLS("", "")
+				} else {
+					err = srv.ListenAndServe()
+				}
+				if err != nil && err != http.ErrServerClosed {
 					logging.DefaultLogger().Errorw("failed to close http server", "err", err)
 				}
 			}()
+
+			if redirect != nil {
+				go func() {
+					if err := redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+						logging.DefaultLogger().Errorw("failed to close redirect server", "err", err)
+					}
+				}()
+			}
 			return nil
 		},
 		OnStop: func(ctx context.Context) error {
-			logging.FromContext(ctx).Info("Stopped server")
-			return srv.Shutdown(ctx)
+			logger := logging.FromContext(ctx)
+			drainer.StartDraining()
+			logger.Infow("draining server", "inflight", len(drainer.InFlight()), "delay", cfg.Server.DrainDelay,
+				"grace", cfg.Server.GracefulShutdown)
+
+			// Load balancers only stop routing here once they have seen the
+			// readiness probe fail, keep serving until then.
+			select {
+			case <-time.After(cfg.Server.DrainDelay):
+			case <-ctx.Done():
+			}
+
+			shutdownCtx, cancel := context.WithTimeout(ctx, cfg.Server.GracefulShutdown)
+			defer cancel()
+
+			if redirect != nil {
+				redirect.Close()
+			}
+
+			err := srv.Shutdown(shutdownCtx)
+			if err != nil {
+				for _, req := range drainer.InFlight() {
+					logger.Warnw("terminating in-flight request", "requestId", req.RequestID,
+						"method", req.Method, "path", req.Path, "elapsed", time.Since(req.Started).Round(time.Millisecond))
+				}
+				srv.Close()
+			}
+
+			scheduler.Stop()
+			worker.Close()
+			clients.Close()
+			c.FileService.FlushAccess()
+			emitter.Close(ctx)
+			if sqlDB, dbErr := db.DB(); dbErr == nil {
+				sqlDB.Close()
+			}
+			logger.Info("Stopped server")
+			return err
 		},
 	})
 	return r
@@ -1,18 +1,63 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
+	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/config"
 	"github.com/tgdrive/teldrive/pkg/models"
 	"github.com/tgdrive/teldrive/pkg/types"
 	"gorm.io/gorm"
 )
 
+// ErrSessionExpired is returned for sessions older than the configured max
+// age or idle for longer than the idle timeout.
+var ErrSessionExpired = errors.New("session expired")
+
+// Reasons a request is refused as unauthenticated, so clients can tell a
+// login that is needed from one that has to be renewed.
+const (
+	ReasonMissing = "missing"
+	ReasonExpired = "expired"
+	ReasonInvalid = "invalid"
+)
+
+// AuthError refuses a request that carries no usable session or signature.
+type AuthError struct {
+	Reason string
+	Err    error
+}
+
+type AuthDetails struct {
+	Reason string `json:"reason"`
+}
+
+func (e *AuthError) Error() string { return e.Err.Error() }
+
+func (e *AuthError) Unwrap() error { return e.Err }
+
+func (e *AuthError) Details() any { return AuthDetails{Reason: e.Reason} }
+
+// Unauthenticated wraps a failed session, token or signature check, telling
+// expired credentials from tampered or unknown ones.
+func Unauthenticated(err error) *AuthError {
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		return authErr
+	}
+	if errors.Is(err, ErrSessionExpired) || errors.Is(err, ErrSignatureExpired) || errors.Is(err, jwt.ErrTokenExpired) {
+		return &AuthError{Reason: ReasonExpired, Err: err}
+	}
+	return &AuthError{Reason: ReasonInvalid, Err: err}
+}
+
 func Encode(secret string, claims *types.JWTClaims) (string, error) {
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
@@ -43,7 +88,42 @@ func GetUser(c *gin.Context) (int64, string) {
 	return userId, jwtUser.TgSession
 }
 
-func VerifyUser(c *gin.Context, db *gorm.DB, cache cache.Cacher, secret string) (*types.JWTClaims, error) {
+// MatchUser reports whether a user matches one of entries, which are numeric
+// user ids or username globs such as "team_*". Blank entries are skipped and
+// username entries never match accounts without one.
+func MatchUser(entries []string, userId int64, userName string) bool {
+	userName = strings.ToLower(userName)
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(entry), "@"))
+		if entry == "" {
+			continue
+		}
+		if id, err := strconv.ParseInt(entry, 10, 64); err == nil {
+			if userId != 0 && id == userId {
+				return true
+			}
+			continue
+		}
+		if userName == "" {
+			continue
+		}
+		if ok, _ := path.Match(entry, userName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdmin reports whether the authenticated user is listed in adminUsers.
+func IsAdmin(adminUsers []string, claims *types.JWTClaims) bool {
+	if claims == nil {
+		return false
+	}
+	userId, _ := strconv.ParseInt(claims.Subject, 10, 64)
+	return MatchUser(adminUsers, userId, claims.UserName)
+}
+
+func VerifyUser(c *gin.Context, db *gorm.DB, cache cache.Cacher, cnf *config.JWTConfig) (*types.JWTClaims, error) {
 	var token string
 	cookie, err := c.Request.Cookie("user-session")
 
@@ -51,17 +131,17 @@ func VerifyUser(c *gin.Context, db *gorm.DB, cache cache.Cacher, secret string)
 		authHeader := c.GetHeader("Authorization")
 		bearerToken := strings.Split(authHeader, "Bearer ")
 		if len(bearerToken) != 2 {
-			return nil, fmt.Errorf("missing auth token")
+			return nil, &AuthError{Reason: ReasonMissing, Err: errors.New("missing auth token")}
 		}
 		token = bearerToken[1]
 	} else {
 		token = cookie.Value
 	}
 
-	claims, err := Decode(secret, token)
+	claims, err := Decode(cnf.Secret, token)
 
 	if err != nil {
-		return nil, err
+		return nil, Unauthenticated(err)
 	}
 
 	var session *models.Session
@@ -69,7 +149,11 @@ func VerifyUser(c *gin.Context, db *gorm.DB, cache cache.Cacher, secret string)
 	session, err = GetSessionByHash(db, cache, claims.Hash)
 
 	if err != nil {
-		return nil, fmt.Errorf("invalid session")
+		return nil, Unauthenticated(errors.New("invalid session"))
+	}
+
+	if err := CheckSession(db, cache, cnf, session, time.Now().UTC()); err != nil {
+		return nil, Unauthenticated(err)
 	}
 
 	claims.TgSession = session.Session
@@ -80,7 +164,7 @@ func VerifyUser(c *gin.Context, db *gorm.DB, cache cache.Cacher, secret string)
 func GetSessionByHash(db *gorm.DB, cache cache.Cacher, hash string) (*models.Session, error) {
 	var session models.Session
 
-	key := fmt.Sprintf("sessions:%s", hash)
+	key := sessionKey(hash)
 
 	err := cache.Get(key, &session)
 
@@ -94,3 +178,48 @@ func GetSessionByHash(db *gorm.DB, cache cache.Cacher, hash string) (*models.Ses
 	return &session, nil
 
 }
+
+func sessionKey(hash string) string {
+	return fmt.Sprintf("sessions:%s", hash)
+}
+
+// sessionState reports whether a session has expired under the limits of cnf
+// at now, and otherwise whether its last activity is stale enough to be
+// recorded again.
+func sessionState(cnf *config.JWTConfig, session *models.Session, now time.Time) (expired, touch bool) {
+	if cnf.MaxAge > 0 && now.Sub(session.CreatedAt) > cnf.MaxAge {
+		return true, false
+	}
+	if cnf.IdleTimeout <= 0 {
+		return false, false
+	}
+	lastSeen := session.CreatedAt
+	if session.LastSeenAt != nil {
+		lastSeen = *session.LastSeenAt
+	}
+	idle := now.Sub(lastSeen)
+	if idle > cnf.IdleTimeout {
+		return true, false
+	}
+	return false, idle > min(cnf.IdleTimeout/10, time.Minute)
+}
+
+// CheckSession enforces the session lifetimes of cnf. Expired sessions are
+// removed, active ones have their last activity recorded.
+func CheckSession(db *gorm.DB, cache cache.Cacher, cnf *config.JWTConfig, session *models.Session, now time.Time) error {
+	expired, touch := sessionState(cnf, session, now)
+	if expired {
+		db.Where("hash = ?", session.Hash).Delete(&models.Session{})
+		cache.Delete(sessionKey(session.Hash))
+		return ErrSessionExpired
+	}
+	if touch {
+		if err := db.Model(&models.Session{}).Where("hash = ?", session.Hash).
+			Update("last_seen_at", now).Error; err != nil {
+			return err
+		}
+		session.LastSeenAt = &now
+		cache.Set(sessionKey(session.Hash), session, 0)
+	}
+	return nil
+}
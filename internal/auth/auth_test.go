@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/pkg/models"
+)
+
+func TestSessionState(t *testing.T) {
+	now := time.Now().UTC()
+	session := &models.Session{CreatedAt: now.Add(-2 * time.Hour)}
+
+	expired, touch := sessionState(&config.JWTConfig{}, session, now)
+	assert.False(t, expired)
+	assert.False(t, touch)
+
+	expired, _ = sessionState(&config.JWTConfig{MaxAge: time.Hour}, session, now)
+	assert.True(t, expired)
+
+	cnf := &config.JWTConfig{IdleTimeout: time.Hour}
+	expired, _ = sessionState(cnf, session, now)
+	assert.True(t, expired)
+
+	lastSeen := now.Add(-30 * time.Minute)
+	session.LastSeenAt = &lastSeen
+	expired, touch = sessionState(cnf, session, now)
+	assert.False(t, expired)
+	assert.True(t, touch)
+
+	lastSeen = now.Add(-10 * time.Second)
+	expired, touch = sessionState(cnf, session, now)
+	assert.False(t, expired)
+	assert.False(t, touch)
+}
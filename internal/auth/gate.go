@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tgdrive/teldrive/internal/config"
+)
+
+const (
+	GateNone    = "none"
+	GateCaptcha = "captcha"
+	GateInvite  = "invite"
+)
+
+var (
+	ErrGateRequired = errors.New("login gate not passed")
+	ErrGateRejected = errors.New("login gate rejected")
+)
+
+// CaptchaVerifyURLs are the server side verification endpoints of the
+// supported CAPTCHA providers.
+var CaptchaVerifyURLs = map[string]string{
+	"hcaptcha":  "https://api.hcaptcha.com/siteverify",
+	"turnstile": "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+}
+
+// LoginGate admits login attempts that solved a CAPTCHA or carry an invite
+// code, depending on the configured gate.
+type LoginGate struct {
+	cnf       *config.LoginConfig
+	client    *http.Client
+	verifyURL string
+}
+
+func NewLoginGate(cnf *config.LoginConfig) *LoginGate {
+	return &LoginGate{cnf: cnf, client: &http.Client{Timeout: 10 * time.Second},
+		verifyURL: CaptchaVerifyURLs[cnf.Captcha.Provider]}
+}
+
+// ValidateLoginGate checks the gate settings at startup.
+func ValidateLoginGate(cnf *config.LoginConfig) error {
+	switch cnf.Gate {
+	case "", GateNone:
+	case GateCaptcha:
+		if _, ok := CaptchaVerifyURLs[cnf.Captcha.Provider]; !ok {
+			return fmt.Errorf("unknown captcha provider %q", cnf.Captcha.Provider)
+		}
+		if cnf.Captcha.Secret == "" {
+			return errors.New("captcha gate requires a secret")
+		}
+	case GateInvite:
+		for _, code := range cnf.InviteCodes {
+			if code != "" {
+				return nil
+			}
+		}
+		return errors.New("invite gate requires at least one invite code")
+	default:
+		return fmt.Errorf("unknown login gate %q", cnf.Gate)
+	}
+	return nil
+}
+
+// Mode returns the gate in effect.
+func (g *LoginGate) Mode() string {
+	if g.cnf.Gate == "" {
+		return GateNone
+	}
+	return g.cnf.Gate
+}
+
+// Check admits a login attempt presenting token, the CAPTCHA response or the
+// invite code, from remoteIP.
+func (g *LoginGate) Check(ctx context.Context, token, remoteIP string) error {
+	switch g.Mode() {
+	case GateNone:
+		return nil
+	case GateInvite:
+		if token == "" {
+			return ErrGateRequired
+		}
+		for _, code := range g.cnf.InviteCodes {
+			if code != "" && subtle.ConstantTimeCompare([]byte(code), []byte(token)) == 1 {
+				return nil
+			}
+		}
+		return ErrGateRejected
+	case GateCaptcha:
+		if token == "" {
+			return ErrGateRequired
+		}
+		return g.verifyCaptcha(ctx, token, remoteIP)
+	}
+	return ErrGateRejected
+}
+
+func (g *LoginGate) verifyCaptcha(ctx context.Context, token, remoteIP string) error {
+	form := url.Values{"secret": {g.cnf.Captcha.Secret}, "response": {token}}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := g.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("captcha verification: %w", err)
+	}
+	defer res.Body.Close()
+
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return fmt.Errorf("captcha verification: %w", err)
+	}
+	if !result.Success {
+		if len(result.ErrorCodes) > 0 {
+			return fmt.Errorf("%w: %s", ErrGateRejected, strings.Join(result.ErrorCodes, ", "))
+		}
+		return ErrGateRejected
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/internal/config"
+)
+
+func TestLoginGateInvite(t *testing.T) {
+	cnf := &config.LoginConfig{Gate: GateInvite, InviteCodes: []string{"", "friends"}}
+	assert.NoError(t, ValidateLoginGate(cnf))
+
+	gate := NewLoginGate(cnf)
+	assert.NoError(t, gate.Check(context.Background(), "friends", ""))
+	assert.ErrorIs(t, gate.Check(context.Background(), "", ""), ErrGateRequired)
+	assert.ErrorIs(t, gate.Check(context.Background(), "strangers", ""), ErrGateRejected)
+
+	assert.Error(t, ValidateLoginGate(&config.LoginConfig{Gate: GateInvite, InviteCodes: []string{""}}))
+}
+
+func TestLoginGateCaptcha(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		ok := r.Form.Get("secret") == "s3cret" && r.Form.Get("response") == "solved"
+		json.NewEncoder(w).Encode(map[string]any{"success": ok, "error-codes": []string{}})
+	}))
+	defer server.Close()
+
+	cnf := &config.LoginConfig{Gate: GateCaptcha}
+	cnf.Captcha.Provider = "turnstile"
+	cnf.Captcha.Secret = "s3cret"
+	assert.NoError(t, ValidateLoginGate(cnf))
+
+	gate := NewLoginGate(cnf)
+	gate.verifyURL = server.URL
+	assert.NoError(t, gate.Check(context.Background(), "solved", "127.0.0.1"))
+	assert.ErrorIs(t, gate.Check(context.Background(), "guessed", "127.0.0.1"), ErrGateRejected)
+	assert.ErrorIs(t, gate.Check(context.Background(), "", ""), ErrGateRequired)
+
+	cnf.Captcha.Provider = "recaptcha"
+	assert.Error(t, ValidateLoginGate(cnf))
+}
+
+func TestLoginGateNone(t *testing.T) {
+	gate := NewLoginGate(&config.LoginConfig{})
+	assert.Equal(t, GateNone, gate.Mode())
+	assert.NoError(t, gate.Check(context.Background(), "", ""))
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrSignatureExpired = errors.New("signature expired")
+)
+
+func fileSignature(secret, fileId string, userId int64, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%d\n%d", fileId, userId, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignFile returns the query values that let anyone holding them read fileId
+// on behalf of userId until expires.
+func SignFile(secret, fileId string, userId int64, expires time.Time) url.Values {
+	exp := expires.Unix()
+	return url.Values{
+		"uid": {strconv.FormatInt(userId, 10)},
+		"exp": {strconv.FormatInt(exp, 10)},
+		"sig": {fileSignature(secret, fileId, userId, exp)},
+	}
+}
+
+// VerifyFile checks values produced by SignFile for fileId and returns the
+// user the link was signed for.
+func VerifyFile(secret, fileId string, values url.Values, now time.Time) (int64, error) {
+	userId, err := strconv.ParseInt(values.Get("uid"), 10, 64)
+	if err != nil {
+		return 0, ErrInvalidSignature
+	}
+	exp, err := strconv.ParseInt(values.Get("exp"), 10, 64)
+	if err != nil {
+		return 0, ErrInvalidSignature
+	}
+	expected := fileSignature(secret, fileId, userId, exp)
+	if !hmac.Equal([]byte(expected), []byte(values.Get("sig"))) {
+		return 0, ErrInvalidSignature
+	}
+	if now.Unix() > exp {
+		return 0, ErrSignatureExpired
+	}
+	return userId, nil
+}
+
+func shareSignature(secret, shareId, fileId string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "share\n%s\n%s\n%d", shareId, fileId, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignShareFile returns the query values that let anyone holding them preview
+// fileId through shareId until expires. The share is still checked on every
+// request, so revoking it invalidates the link.
+func SignShareFile(secret, shareId, fileId string, expires time.Time) url.Values {
+	exp := expires.Unix()
+	return url.Values{
+		"exp": {strconv.FormatInt(exp, 10)},
+		"sig": {shareSignature(secret, shareId, fileId, exp)},
+	}
+}
+
+// VerifyShareFile checks values produced by SignShareFile for fileId in shareId.
+func VerifyShareFile(secret, shareId, fileId string, values url.Values, now time.Time) error {
+	exp, err := strconv.ParseInt(values.Get("exp"), 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	expected := shareSignature(secret, shareId, fileId, exp)
+	if !hmac.Equal([]byte(expected), []byte(values.Get("sig"))) {
+		return ErrInvalidSignature
+	}
+	if now.Unix() > exp {
+		return ErrSignatureExpired
+	}
+	return nil
+}
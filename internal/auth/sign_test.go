@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignFile(t *testing.T) {
+	now := time.Now()
+	values := SignFile("secret", "file", 42, now.Add(time.Hour))
+
+	userId, err := VerifyFile("secret", "file", values, now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), userId)
+
+	_, err = VerifyFile("secret", "other", values, now)
+	assert.Equal(t, ErrInvalidSignature, err)
+
+	_, err = VerifyFile("other", "file", values, now)
+	assert.Equal(t, ErrInvalidSignature, err)
+
+	tampered := SignFile("secret", "file", 42, now.Add(time.Hour))
+	tampered.Set("uid", "43")
+	_, err = VerifyFile("secret", "file", tampered, now)
+	assert.Equal(t, ErrInvalidSignature, err)
+
+	_, err = VerifyFile("secret", "file", values, now.Add(2*time.Hour))
+	assert.Equal(t, ErrSignatureExpired, err)
+}
+
+func TestSignShareFile(t *testing.T) {
+	now := time.Now()
+	values := SignShareFile("secret", "share", "file", now.Add(time.Hour))
+
+	assert.NoError(t, VerifyShareFile("secret", "share", "file", values, now))
+	assert.Equal(t, ErrInvalidSignature, VerifyShareFile("secret", "other", "file", values, now))
+	assert.Equal(t, ErrInvalidSignature, VerifyShareFile("secret", "share", "other", values, now))
+	assert.Equal(t, ErrSignatureExpired, VerifyShareFile("secret", "share", "file", values, now.Add(2*time.Hour)))
+
+	// A share link must not pass as a file link of the owner.
+	values.Set("uid", "0")
+	_, err := VerifyFile("secret", "file", values, now)
+	assert.Equal(t, ErrInvalidSignature, err)
+}
+
+func TestUploadTicket(t *testing.T) {
+	now := time.Now()
+	secret := TicketSecret("secret", "salt")
+	token, err := SignTicket(secret, &UploadTicket{UserId: 42, UploadId: "up", Path: "/drop",
+		MaxSize: 1024, ExpiresAt: now.Add(time.Hour).Unix()})
+	assert.NoError(t, err)
+
+	ticket, err := VerifyTicket(secret, token, now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), ticket.UserId)
+	assert.Equal(t, "/drop", ticket.Path)
+	assert.Equal(t, int64(1024), ticket.MaxSize)
+
+	_, err = VerifyTicket(TicketSecret("secret", "rotated"), token, now)
+	assert.Equal(t, ErrInvalidSignature, err)
+
+	forged, _ := SignTicket("other", &UploadTicket{UserId: 42, MaxSize: 1 << 40, ExpiresAt: now.Add(time.Hour).Unix()})
+	_, sig, _ := strings.Cut(token, ".")
+	head, _, _ := strings.Cut(forged, ".")
+	_, err = VerifyTicket(secret, head+"."+sig, now)
+	assert.Equal(t, ErrInvalidSignature, err)
+
+	_, err = VerifyTicket(secret, token, now.Add(2*time.Hour))
+	assert.Equal(t, ErrSignatureExpired, err)
+}
@@ -0,0 +1,71 @@
+package compress
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"math"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// SampleSize is the number of leading bytes inspected to decide whether a
+// stream is worth compressing.
+const SampleSize = 64 * 1024
+
+// maxEntropy is the Shannon entropy (bits per byte) above which data is
+// considered already compressed or encrypted.
+const maxEntropy = 7.5
+
+var ErrUnknownCodec = errors.New("unknown compression codec")
+
+// IsCompressible estimates the entropy of sample and reports whether
+// compressing the stream it was taken from is likely to save space.
+func IsCompressible(sample []byte) bool {
+	if len(sample) == 0 {
+		return false
+	}
+	var counts [256]int
+	for _, b := range sample {
+		counts[b]++
+	}
+	var entropy float64
+	total := float64(len(sample))
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+		p := float64(c) / total
+		entropy -= p * math.Log2(p)
+	}
+	return entropy < maxEntropy
+}
+
+func NewWriter(codec string, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, ErrUnknownCodec
+}
+
+func NewReader(codec string, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, ErrUnknownCodec
+}
@@ -0,0 +1,43 @@
+package compress
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("teldrive,log,line\n"), 4096)
+	for _, codec := range []string{Gzip, Zstd} {
+		var buf bytes.Buffer
+		w, err := NewWriter(codec, &buf)
+		assert.NoError(t, err)
+		_, err = w.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+		assert.Less(t, buf.Len(), len(data))
+
+		r, err := NewReader(codec, &buf)
+		assert.NoError(t, err)
+		out, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, data, out)
+		assert.NoError(t, r.Close())
+	}
+}
+
+func TestIsCompressible(t *testing.T) {
+	random := make([]byte, SampleSize)
+	rand.Read(random)
+	assert.False(t, IsCompressible(random))
+	assert.True(t, IsCompressible(bytes.Repeat([]byte("a,b,c\n"), 1000)))
+	assert.False(t, IsCompressible(nil))
+}
+
+func TestUnknownCodec(t *testing.T) {
+	_, err := NewWriter("lz4", io.Discard)
+	assert.Equal(t, ErrUnknownCodec, err)
+}
@@ -11,6 +11,12 @@ type Config struct {
 	DB       DBConfig
 	TG       TGConfig
 	CronJobs CronJobConfig
+	Files    FilesConfig
+	Links    LinksConfig
+	Share    ShareConfig
+	Stats    StatsConfig
+	Login    LoginConfig
+	Events   EventsConfig
 	Cache    struct {
 		MaxSize   int
 		RedisAddr string
@@ -19,18 +25,136 @@ type Config struct {
 }
 
 type ServerConfig struct {
-	Port             int
-	GracefulShutdown time.Duration
-	EnablePprof      bool
-	ReadTimeout      time.Duration
-	WriteTimeout     time.Duration
+	Port               int
+	BasePath           string
+	GracefulShutdown   time.Duration
+	DrainDelay         time.Duration
+	EnablePprof        bool
+	ReadHeaderTimeout  time.Duration
+	ReadTimeout        time.Duration
+	WriteTimeout       time.Duration
+	IdleTimeout        time.Duration
+	LongTimeout        time.Duration
+	MaxBodySize        int64
+	MaxImportSize      int64
+	MaxWsMessageSize   int64
+	Maintenance        bool
+	MaintenanceMessage string
+	Compression        CompressionConfig
+	TLS                TLSConfig
+	Headers            HeadersConfig
+}
+
+// TLSConfig serves HTTPS directly, from a certificate and key or with
+// certificates obtained from Let's Encrypt for Domains. A RedirectPort
+// listener sends plain HTTP requests over to HTTPS.
+type TLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	Domains      []string
+	Email        string
+	CacheDir     string
+	RedirectPort int
+	MinVersion   string
+}
+
+// HeadersConfig sets the security headers sent with every response. HSTS is
+// only sent over HTTPS and only with a max age, browsers remember it for that
+// long. Paths containing one of FrameExempt may be embedded in frames.
+type HeadersConfig struct {
+	Enabled               bool
+	HstsMaxAge            time.Duration
+	HstsIncludeSubdomains bool
+	HstsPreload           bool
+	ContentTypeOptions    bool
+	FrameOptions          string
+	FrameExempt           []string
+	ReferrerPolicy        string
+}
+
+type CompressionConfig struct {
+	Enabled    bool
+	MinSize    int64
+	Algorithms []string
+}
+
+// FilesConfig limits the shape of folder trees. MaxDepth counts the folders
+// from the root down to the deepest one, MaxFiles and MaxFolders the entries
+// of a user. Zero disables a limit.
+type FilesConfig struct {
+	MaxDepth   int
+	MaxFiles   int64
+	MaxFolders int64
+}
+
+type LinksConfig struct {
+	Apps          []string
+	PresignExpiry time.Duration
+}
+
+// ShareConfig limits the unauthenticated share endpoints. Rates are requests
+// per minute, bandwidths are bytes per BandwidthWindow; zero disables a limit.
+type ShareConfig struct {
+	IpRate          int
+	IpBurst         int
+	LinkRate        int
+	LinkBurst       int
+	IpBandwidth     int64
+	LinkBandwidth   int64
+	BandwidthWindow time.Duration
+	ThumbnailSize   int64
+}
+
+// StatsConfig controls the access statistics of files. Counters are held in
+// memory and written every FlushInterval.
+type StatsConfig struct {
+	Enabled       bool
+	FlushInterval time.Duration
+}
+
+// EventsConfig publishes upload, delete and share events to a broker. Broker
+// is "redis" or empty to disable events, Topic names the stream. Events are
+// buffered in memory and dropped once BufferSize are waiting.
+type EventsConfig struct {
+	Broker     string
+	Topic      string
+	RedisAddr  string
+	RedisPass  string
+	MaxLen     int64
+	BufferSize int
+	Timeout    time.Duration
+}
+
+// LoginConfig gates the login websocket before any Telegram request is made.
+// Gate is "none", "captcha" or "invite".
+type LoginConfig struct {
+	Gate    string
+	Captcha struct {
+		Provider string
+		SiteKey  string
+		Secret   string
+	}
+	InviteCodes []string
+}
+
+// RetryPolicy controls how a Telegram request that failed with a transient
+// error is retried. Backoff doubles after every attempt up to MaxBackoff and
+// Timeout bounds each attempt, zero disables either.
+type RetryPolicy struct {
+	MaxRetries int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Timeout    time.Duration
 }
 
 type CronJobConfig struct {
-	Enable               bool
-	CleanFilesInterval   time.Duration
-	CleanUploadsInterval time.Duration
-	FolderSizeInterval   time.Duration
+	Enable                   bool
+	CleanFilesInterval       time.Duration
+	CleanUploadsInterval     time.Duration
+	FolderSizeInterval       time.Duration
+	CleanBotSessionsInterval time.Duration
+	HashJobsInterval         time.Duration
+	ChangeLogRetention       time.Duration
 }
 
 type TGConfig struct {
@@ -47,21 +171,87 @@ type TGConfig struct {
 	LangPack            string
 	SessionFile         string
 	DisableStreamBots   bool
+	ValidateBots        bool
 	BgBotsCheckInterval time.Duration
 	Proxy               string
 	ReconnectTimeout    time.Duration
+	FloodMaxWait        time.Duration
 	PoolSize            int64
 	EnableLogging       bool
 	Uploads             struct {
-		EncryptionKey string
-		Threads       int
-		MaxRetries    int
-		Retention     time.Duration
+		EncryptionKey   string
+		MissingKey      string
+		EncryptionRules []string
+		MimeTypes       []string
+		MimeSniff       bool
+		UserKeys        bool
+		Threads         int
+		MaxRetries      int
+		Retention       time.Duration
+		MaxRetention    time.Duration
+		MaxPartSize     int64
+		MaxFileSize     int64
+		MaxParts        int
+		TicketSalt      string
+		TicketMaxExpiry time.Duration
+		InlineThreshold int64
+		ChannelStrategy string
+		FileTypes       struct {
+			AllowedExtensions []string
+			DeniedExtensions  []string
+			AllowedMimeTypes  []string
+			DeniedMimeTypes   []string
+		}
+		Index struct {
+			Enabled   bool
+			MaxSize   int64
+			MimeTypes []string
+		}
+	}
+	Clients struct {
+		Max                 int
+		PerKey              int
+		IdleTimeout         time.Duration
+		HealthCheckInterval time.Duration
+	}
+	Scheduler struct {
+		PremiumWeight int
+	}
+	Retry struct {
+		Upload   RetryPolicy
+		Download RetryPolicy
+		Control  RetryPolicy
+	}
+	AutoChannel struct {
+		Enabled bool
+		Name    string
 	}
 	Stream struct {
-		MultiThreads int
-		Buffers      int
-		ChunkTimeout time.Duration
+		MultiThreads     int
+		Buffers          int
+		ChunkTimeout     time.Duration
+		ReconnectRetries int
+		ReconnectTimeout time.Duration
+		ReadAhead        int
+		ReadAheadSize    int64
+		PreloadParts     int
+		PreloadPush      bool
+	}
+	Hashing struct {
+		Algorithm      string
+		MaxRate        int64
+		CheckpointSize int64
+	}
+	Delete struct {
+		Concurrency int
+		BatchSize   int
+		Retries     int
+	}
+	Reconnect struct {
+		InitialInterval time.Duration
+		Multiplier      float64
+		MaxInterval     time.Duration
+		Jitter          float64
 	}
 }
 
@@ -74,7 +264,11 @@ type LoggingConfig struct {
 type JWTConfig struct {
 	Secret       string
 	SessionTime  time.Duration
+	MaxAge       time.Duration
+	IdleTimeout  time.Duration
 	AllowedUsers []string
+	DeniedUsers  []string
+	AdminUsers   []string
 }
 
 type DBConfig struct {
@@ -0,0 +1,51 @@
+package crypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecryptDataSeek(t *testing.T) {
+	plain := make([]byte, 3*blockDataSize+1234)
+	_, err := rand.Read(plain)
+	require.NoError(t, err)
+
+	cipher, err := NewCipher("password", "salt")
+	require.NoError(t, err)
+
+	enc, err := cipher.EncryptData(bytes.NewReader(plain))
+	require.NoError(t, err)
+	encrypted, err := io.ReadAll(enc)
+	require.NoError(t, err)
+	assert.Equal(t, EncryptedSize(int64(len(plain))), int64(len(encrypted)))
+
+	open := func(ctx context.Context, offset, limit int64) (io.ReadCloser, error) {
+		end := int64(len(encrypted))
+		if limit >= 0 {
+			end = min(end, offset+limit)
+		}
+		return io.NopCloser(bytes.NewReader(encrypted[offset:end])), nil
+	}
+
+	ranges := []struct{ offset, limit int64 }{
+		{0, int64(len(plain))},
+		{0, 10},
+		{blockDataSize - 5, 10},
+		{blockDataSize + 100, 2 * blockDataSize},
+		{int64(len(plain)) - 1, 1},
+	}
+	for _, r := range ranges {
+		dec, err := cipher.DecryptDataSeek(context.Background(), open, r.offset, r.limit)
+		require.NoError(t, err)
+		got, err := io.ReadAll(dec)
+		require.NoError(t, err)
+		assert.Equal(t, plain[r.offset:r.offset+r.limit], got, "offset %d limit %d", r.offset, r.limit)
+		dec.Close()
+	}
+}
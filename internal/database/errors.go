@@ -8,8 +8,9 @@ import (
 )
 
 var (
-	ErrNotFound    = errors.New("record not found")
-	ErrKeyConflict = errors.New("key conflict")
+	ErrNotFound     = errors.New("record not found")
+	ErrKeyConflict  = errors.New("key conflict")
+	ErrStaleVersion = errors.New("file was modified, refetch and retry")
 )
 
 func IsRecordNotFoundErr(err error) bool {
@@ -0,0 +1,5 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.uploads ADD COLUMN IF NOT EXISTS compression text NULL;
+ALTER TABLE teldrive.uploads ADD COLUMN IF NOT EXISTS original_size bigint NULL;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.files ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 1;
+
+CREATE OR REPLACE FUNCTION teldrive.bump_file_version() RETURNS trigger
+LANGUAGE plpgsql
+AS $$
+BEGIN
+    NEW.version := OLD.version + 1;
+    RETURN NEW;
+END;
+$$;
+
+DROP TRIGGER IF EXISTS files_bump_version ON teldrive.files;
+
+CREATE TRIGGER files_bump_version BEFORE UPDATE ON teldrive.files
+FOR EACH ROW EXECUTE FUNCTION teldrive.bump_file_version();
+-- +goose StatementEnd
+
@@ -0,0 +1,7 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.bots ADD COLUMN IF NOT EXISTS rate integer NULL;
+ALTER TABLE teldrive.bots ADD COLUMN IF NOT EXISTS rate_burst integer NULL;
+ALTER TABLE teldrive.users ADD COLUMN IF NOT EXISTS rate integer NULL;
+ALTER TABLE teldrive.users ADD COLUMN IF NOT EXISTS rate_burst integer NULL;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.files ADD COLUMN IF NOT EXISTS last_accessed_at timestamp NULL;
+
+CREATE INDEX IF NOT EXISTS idx_files_user_last_accessed ON teldrive.files USING btree (user_id, last_accessed_at DESC)
+WHERE last_accessed_at IS NOT NULL AND type = 'file' AND status = 'active';
+
+CREATE OR REPLACE FUNCTION teldrive.bump_file_version() RETURNS trigger
+LANGUAGE plpgsql
+AS $$
+BEGIN
+    IF to_jsonb(NEW) - 'last_accessed_at' - 'version' = to_jsonb(OLD) - 'last_accessed_at' - 'version' THEN
+        RETURN NEW;
+    END IF;
+    NEW.version := OLD.version + 1;
+    RETURN NEW;
+END;
+$$;
+-- +goose StatementEnd
@@ -0,0 +1,5 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.files ADD COLUMN IF NOT EXISTS default_channel_id bigint NULL;
+ALTER TABLE teldrive.files ADD COLUMN IF NOT EXISTS default_encrypted boolean NULL;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS idx_files_user_active_name ON teldrive.files USING btree (user_id, name)
+WHERE status = 'active';
+
+CREATE INDEX IF NOT EXISTS idx_files_user_active_updated_at ON teldrive.files USING btree (user_id, updated_at DESC)
+WHERE status = 'active';
+
+CREATE INDEX IF NOT EXISTS idx_files_user_active_size ON teldrive.files USING btree (user_id, size)
+WHERE status = 'active';
+-- +goose StatementEnd
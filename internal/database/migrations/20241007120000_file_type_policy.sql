@@ -0,0 +1,4 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.users ADD COLUMN IF NOT EXISTS file_types jsonb NULL;
+-- +goose StatementEnd
@@ -0,0 +1,4 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.file_shares ADD COLUMN IF NOT EXISTS follows_file boolean NOT NULL DEFAULT true;
+-- +goose StatementEnd
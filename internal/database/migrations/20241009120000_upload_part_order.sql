@@ -0,0 +1,4 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS idx_uploads_upload_id_part_no ON teldrive.uploads USING btree (upload_id, part_no);
+-- +goose StatementEnd
@@ -0,0 +1,7 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.files ADD COLUMN IF NOT EXISTS hash text NULL;
+
+CREATE INDEX IF NOT EXISTS idx_files_user_hash ON teldrive.files USING btree (user_id, hash, size)
+WHERE hash IS NOT NULL AND type = 'file' AND status = 'active';
+-- +goose StatementEnd
@@ -0,0 +1,4 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.users ADD COLUMN IF NOT EXISTS settings jsonb NULL;
+-- +goose StatementEnd
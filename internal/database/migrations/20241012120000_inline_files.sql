@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.files ADD COLUMN IF NOT EXISTS inline_data bytea NULL;
+ALTER TABLE teldrive.uploads ADD COLUMN IF NOT EXISTS inline_data bytea NULL;
+
+-- Backstop for the application limit, leaving room for encryption overhead.
+ALTER TABLE teldrive.files ADD CONSTRAINT files_inline_data_size CHECK (octet_length(inline_data) <= 131072);
+ALTER TABLE teldrive.uploads ADD CONSTRAINT uploads_inline_data_size CHECK (octet_length(inline_data) <= 131072);
+-- +goose StatementEnd
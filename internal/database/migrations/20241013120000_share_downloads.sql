@@ -0,0 +1,5 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.file_shares ADD COLUMN IF NOT EXISTS max_downloads bigint NULL;
+ALTER TABLE teldrive.file_shares ADD COLUMN IF NOT EXISTS downloads bigint NOT NULL DEFAULT 0;
+-- +goose StatementEnd
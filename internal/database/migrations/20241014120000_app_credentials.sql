@@ -0,0 +1,7 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.sessions ADD COLUMN IF NOT EXISTS app_id integer NULL;
+ALTER TABLE teldrive.sessions ADD COLUMN IF NOT EXISTS app_hash text NULL;
+ALTER TABLE teldrive.bots ADD COLUMN IF NOT EXISTS app_id integer NULL;
+ALTER TABLE teldrive.bots ADD COLUMN IF NOT EXISTS app_hash text NULL;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.files ADD COLUMN IF NOT EXISTS hash_algorithm text NULL;
+UPDATE teldrive.files SET hash_algorithm = CASE length(hash)
+    WHEN 32 THEN 'md5'
+    WHEN 40 THEN 'sha1'
+    WHEN 64 THEN 'sha256'
+    WHEN 128 THEN 'sha512'
+END
+WHERE hash IS NOT NULL AND hash ~ '^[0-9a-f]+$';
+-- +goose StatementEnd
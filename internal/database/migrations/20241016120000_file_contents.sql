@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.file_contents (
+    file_id uuid PRIMARY KEY REFERENCES teldrive.files(id) ON DELETE CASCADE,
+    content text NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_contents_search ON teldrive.file_contents USING pgroonga (content);
+
+ALTER TABLE teldrive.uploads ADD COLUMN IF NOT EXISTS content text NULL;
+
+CREATE OR REPLACE FUNCTION teldrive.drop_file_content() RETURNS trigger
+LANGUAGE plpgsql
+AS $$
+BEGIN
+    DELETE FROM teldrive.file_contents WHERE file_id = NEW.id;
+    RETURN NULL;
+END;
+$$;
+
+DROP TRIGGER IF EXISTS files_drop_content ON teldrive.files;
+
+CREATE TRIGGER files_drop_content AFTER UPDATE ON teldrive.files
+FOR EACH ROW WHEN (NEW.status <> 'active' OR NEW.parts IS DISTINCT FROM OLD.parts OR NEW.inline_data IS DISTINCT FROM OLD.inline_data)
+EXECUTE FUNCTION teldrive.drop_file_content();
+-- +goose StatementEnd
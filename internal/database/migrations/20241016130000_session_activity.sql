@@ -0,0 +1,4 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.sessions ADD COLUMN IF NOT EXISTS last_seen_at timestamp NULL;
+-- +goose StatementEnd
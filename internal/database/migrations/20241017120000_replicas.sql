@@ -0,0 +1,5 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.files ADD COLUMN IF NOT EXISTS default_replica_channels jsonb NULL;
+ALTER TABLE teldrive.uploads ADD COLUMN IF NOT EXISTS replicas jsonb NULL;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.folder_templates (
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id bigint NOT NULL REFERENCES teldrive.users(user_id) ON DELETE CASCADE,
+    name text NOT NULL,
+    folders jsonb NOT NULL,
+    created_at timestamp NOT NULL DEFAULT current_timestamp,
+    CONSTRAINT folder_templates_user_name_un UNIQUE (user_id, name)
+);
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.file_accesses (
+    file_id uuid NOT NULL REFERENCES teldrive.files(id) ON DELETE CASCADE,
+    day date NOT NULL,
+    views bigint NOT NULL DEFAULT 0,
+    bytes bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (file_id, day)
+);
+CREATE TABLE IF NOT EXISTS teldrive.file_viewers (
+    file_id uuid NOT NULL REFERENCES teldrive.files(id) ON DELETE CASCADE,
+    viewer text NOT NULL,
+    views bigint NOT NULL DEFAULT 0,
+    bytes bigint NOT NULL DEFAULT 0,
+    first_seen timestamp NOT NULL,
+    last_seen timestamp NOT NULL,
+    PRIMARY KEY (file_id, viewer)
+);
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.bots ADD COLUMN IF NOT EXISTS pool text NOT NULL DEFAULT 'default';
+CREATE TABLE IF NOT EXISTS teldrive.bot_pools (
+    user_id bigint NOT NULL REFERENCES teldrive.users(user_id) ON DELETE CASCADE,
+    channel_id bigint NOT NULL,
+    name text NOT NULL,
+    role text NOT NULL DEFAULT 'default',
+    PRIMARY KEY (user_id, channel_id, name)
+);
+-- +goose StatementEnd
@@ -0,0 +1,6 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.files ADD COLUMN IF NOT EXISTS encryption text NOT NULL DEFAULT 'none'
+	CHECK (encryption IN ('none', 'server', 'client'));
+UPDATE teldrive.files SET encryption = 'server' WHERE encrypted;
+-- +goose StatementEnd
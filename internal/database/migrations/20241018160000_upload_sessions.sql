@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.upload_sessions (
+    upload_id text PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES teldrive.users(user_id) ON DELETE CASCADE,
+    name text NOT NULL,
+    path text NOT NULL DEFAULT '',
+    parent_id text NOT NULL DEFAULT '',
+    channel_id bigint NOT NULL,
+    encryption text NOT NULL DEFAULT 'none' CHECK (encryption IN ('none', 'server', 'client')),
+    total_size bigint,
+    total_parts integer,
+    created_at timestamp NOT NULL DEFAULT timezone('utc'::text, now()),
+    expires_at timestamp NOT NULL
+);
+CREATE INDEX IF NOT EXISTS upload_sessions_expires_at_idx ON teldrive.upload_sessions (expires_at);
+-- +goose StatementEnd
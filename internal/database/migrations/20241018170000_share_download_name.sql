@@ -0,0 +1,4 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.file_shares ADD COLUMN IF NOT EXISTS download_name text NULL;
+-- +goose StatementEnd
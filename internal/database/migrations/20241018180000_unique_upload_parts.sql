@@ -0,0 +1,8 @@
+-- +goose Up
+-- +goose StatementBegin
+DELETE FROM teldrive.uploads u USING teldrive.uploads d
+WHERE u.user_id = d.user_id AND u.upload_id = d.upload_id AND u.part_no = d.part_no
+AND (u.created_at, u.part_id) < (d.created_at, d.part_id);
+DROP INDEX IF EXISTS teldrive.idx_uploads_upload_id_part_no;
+CREATE UNIQUE INDEX IF NOT EXISTS uploads_user_id_upload_id_part_no_key ON teldrive.uploads USING btree (user_id, upload_id, part_no);
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.user_keys (
+    user_id bigint NOT NULL REFERENCES teldrive.users(user_id) ON DELETE CASCADE,
+    version integer NOT NULL CHECK (version > 0),
+    secret text NOT NULL,
+    created_at timestamp NOT NULL DEFAULT timezone('utc'::text, now()),
+    PRIMARY KEY (user_id, version)
+);
+-- Version 0 is the global uploads key every part was encrypted with so far.
+ALTER TABLE teldrive.uploads ADD COLUMN IF NOT EXISTS key_version integer NOT NULL DEFAULT 0;
+ALTER TABLE teldrive.files ADD COLUMN IF NOT EXISTS key_version integer NOT NULL DEFAULT 0;
+-- +goose StatementEnd
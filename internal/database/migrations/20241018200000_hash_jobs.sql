@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.hash_jobs (
+    id uuid PRIMARY KEY DEFAULT uuid7(),
+    user_id bigint NOT NULL REFERENCES teldrive.users(user_id) ON DELETE CASCADE,
+    algorithm text NOT NULL,
+    status text NOT NULL DEFAULT 'queued' CHECK (status IN ('queued', 'running', 'completed', 'cancelled')),
+    last_file_id uuid,
+    total integer NOT NULL DEFAULT 0,
+    hashed integer NOT NULL DEFAULT 0,
+    failed integer NOT NULL DEFAULT 0,
+    error text,
+    created_at timestamp NOT NULL DEFAULT timezone('utc'::text, now()),
+    updated_at timestamp NOT NULL DEFAULT timezone('utc'::text, now())
+);
+CREATE UNIQUE INDEX IF NOT EXISTS hash_jobs_active_user_idx ON teldrive.hash_jobs (user_id)
+    WHERE status IN ('queued', 'running');
+
+CREATE TABLE IF NOT EXISTS teldrive.hash_checkpoints (
+    file_id uuid PRIMARY KEY REFERENCES teldrive.files(id) ON DELETE CASCADE,
+    algorithm text NOT NULL,
+    hashed_bytes bigint NOT NULL,
+    state bytea NOT NULL,
+    updated_at timestamp NOT NULL DEFAULT timezone('utc'::text, now())
+);
+-- +goose StatementEnd
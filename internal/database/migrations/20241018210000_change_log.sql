@@ -0,0 +1,99 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.change_log (
+    seq bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    file_id uuid NOT NULL,
+    event text NOT NULL CHECK (event IN ('created', 'updated', 'moved', 'deleted')),
+    type text NOT NULL,
+    name text NOT NULL,
+    parent_id uuid NULL,
+    path text NULL,
+    old_path text NULL,
+    size bigint NULL,
+    hash text NULL,
+    hash_algorithm text NULL,
+    created_at timestamp NOT NULL DEFAULT timezone('utc'::text, now())
+);
+
+CREATE INDEX IF NOT EXISTS idx_change_log_user_seq ON teldrive.change_log USING btree (user_id, seq);
+CREATE INDEX IF NOT EXISTS idx_change_log_created_at ON teldrive.change_log USING btree (created_at);
+
+-- entry_path is the path of an entry named name below parent, NULL when the
+-- parent no longer exists.
+CREATE OR REPLACE FUNCTION teldrive.entry_path(parent uuid, name text) RETURNS text
+LANGUAGE plpgsql
+AS $$
+DECLARE
+    grandparent uuid;
+BEGIN
+    SELECT parent_id INTO grandparent FROM teldrive.files WHERE id = parent;
+    IF NOT FOUND THEN
+        RETURN NULL;
+    END IF;
+    IF grandparent IS NULL THEN
+        RETURN '/' || name;
+    END IF;
+    RETURN teldrive.get_path_from_file_id(parent) || '/' || name;
+END;
+$$;
+
+-- log_file_change records every change to an active entry. Leaving or
+-- re-entering the active status counts as deletion or creation, renames are
+-- moves and only content changes of files are updates, so folder size
+-- refreshes and access times stay out of the log.
+CREATE OR REPLACE FUNCTION teldrive.log_file_change() RETURNS trigger
+LANGUAGE plpgsql
+AS $$
+DECLARE
+    change_event text;
+    moved_from text;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        IF OLD.status <> 'active' OR OLD.parent_id IS NULL THEN
+            RETURN NULL;
+        END IF;
+        INSERT INTO teldrive.change_log (user_id, file_id, event, type, name, parent_id, path, size, hash, hash_algorithm)
+        VALUES (OLD.user_id, OLD.id, 'deleted', OLD.type, OLD.name, OLD.parent_id,
+            teldrive.entry_path(OLD.parent_id, OLD.name), OLD.size, OLD.hash, OLD.hash_algorithm);
+        RETURN NULL;
+    END IF;
+
+    IF NEW.parent_id IS NULL THEN
+        RETURN NULL;
+    END IF;
+
+    IF TG_OP = 'INSERT' THEN
+        IF NEW.status <> 'active' THEN
+            RETURN NULL;
+        END IF;
+        change_event := 'created';
+    ELSIF OLD.status = 'active' AND NEW.status <> 'active' THEN
+        change_event := 'deleted';
+    ELSIF OLD.status <> 'active' AND NEW.status = 'active' THEN
+        change_event := 'created';
+    ELSIF NEW.status <> 'active' THEN
+        RETURN NULL;
+    ELSIF NEW.parent_id IS DISTINCT FROM OLD.parent_id OR NEW.name <> OLD.name THEN
+        change_event := 'moved';
+        moved_from := teldrive.entry_path(OLD.parent_id, OLD.name);
+    ELSIF NEW.type = 'file' AND (NEW.size IS DISTINCT FROM OLD.size OR NEW.hash IS DISTINCT FROM OLD.hash
+        OR NEW.parts IS DISTINCT FROM OLD.parts OR NEW.inline_data IS DISTINCT FROM OLD.inline_data
+        OR NEW.mime_type IS DISTINCT FROM OLD.mime_type OR NEW.encrypted IS DISTINCT FROM OLD.encrypted) THEN
+        change_event := 'updated';
+    ELSE
+        RETURN NULL;
+    END IF;
+
+    INSERT INTO teldrive.change_log (user_id, file_id, event, type, name, parent_id, path, old_path, size, hash, hash_algorithm)
+    VALUES (NEW.user_id, NEW.id, change_event, NEW.type, NEW.name, NEW.parent_id,
+        teldrive.entry_path(NEW.parent_id, NEW.name), moved_from, NEW.size, NEW.hash, NEW.hash_algorithm);
+    RETURN NULL;
+END;
+$$;
+
+DROP TRIGGER IF EXISTS files_log_change ON teldrive.files;
+
+CREATE TRIGGER files_log_change AFTER INSERT OR UPDATE OR DELETE ON teldrive.files
+FOR EACH ROW EXECUTE FUNCTION teldrive.log_file_change();
+-- +goose StatementEnd
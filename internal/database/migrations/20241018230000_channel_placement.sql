@@ -0,0 +1,5 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.channels ADD COLUMN IF NOT EXISTS messages bigint NOT NULL DEFAULT 0;
+ALTER TABLE teldrive.channels ADD COLUMN IF NOT EXISTS picked_at timestamp NULL;
+-- +goose StatementEnd
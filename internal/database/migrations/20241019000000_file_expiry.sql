@@ -0,0 +1,6 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.files ADD COLUMN IF NOT EXISTS expires_at timestamp NULL;
+CREATE INDEX IF NOT EXISTS idx_files_expires_at ON teldrive.files USING btree (expires_at)
+    WHERE expires_at IS NOT NULL AND status = 'active';
+-- +goose StatementEnd
@@ -0,0 +1,31 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.archive_imports (
+    id uuid PRIMARY KEY DEFAULT uuid7(),
+    user_id bigint NOT NULL REFERENCES teldrive.users(user_id) ON DELETE CASCADE,
+    path text NOT NULL,
+    format text NOT NULL,
+    status text NOT NULL DEFAULT 'running' CHECK (status IN ('running', 'completed', 'failed')),
+    entries integer NOT NULL DEFAULT 0,
+    imported integer NOT NULL DEFAULT 0,
+    skipped integer NOT NULL DEFAULT 0,
+    failed integer NOT NULL DEFAULT 0,
+    bytes bigint NOT NULL DEFAULT 0,
+    error text,
+    created_at timestamp NOT NULL DEFAULT timezone('utc'::text, now()),
+    updated_at timestamp NOT NULL DEFAULT timezone('utc'::text, now())
+);
+CREATE INDEX IF NOT EXISTS archive_imports_user_idx ON teldrive.archive_imports (user_id, created_at DESC);
+
+CREATE TABLE IF NOT EXISTS teldrive.archive_entries (
+    import_id uuid NOT NULL REFERENCES teldrive.archive_imports(id) ON DELETE CASCADE,
+    seq integer NOT NULL,
+    path text NOT NULL,
+    type text NOT NULL,
+    status text NOT NULL CHECK (status IN ('imported', 'skipped', 'failed')),
+    file_id uuid,
+    size bigint NOT NULL DEFAULT 0,
+    error text,
+    PRIMARY KEY (import_id, seq)
+);
+-- +goose StatementEnd
@@ -0,0 +1,80 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.file_transfers (
+    id uuid PRIMARY KEY DEFAULT uuid7(),
+    from_user_id bigint NOT NULL,
+    to_user_id bigint NOT NULL,
+    files jsonb NOT NULL,
+    destination text NOT NULL,
+    entries integer NOT NULL DEFAULT 0,
+    parts integer NOT NULL DEFAULT 0,
+    bytes bigint NOT NULL DEFAULT 0,
+    created_at timestamp NOT NULL DEFAULT timezone('utc'::text, now())
+);
+CREATE INDEX IF NOT EXISTS file_transfers_from_idx ON teldrive.file_transfers (from_user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS file_transfers_to_idx ON teldrive.file_transfers (to_user_id, created_at DESC);
+
+-- log_file_change additionally treats a change of owner as a deletion for the
+-- previous owner and a creation for the new one. The previous owner only sees
+-- the top of a transferred tree go, entries below it leave with their parent.
+CREATE OR REPLACE FUNCTION teldrive.log_file_change() RETURNS trigger
+LANGUAGE plpgsql
+AS $$
+DECLARE
+    change_event text;
+    moved_from text;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        IF OLD.status <> 'active' OR OLD.parent_id IS NULL THEN
+            RETURN NULL;
+        END IF;
+        INSERT INTO teldrive.change_log (user_id, file_id, event, type, name, parent_id, path, size, hash, hash_algorithm)
+        VALUES (OLD.user_id, OLD.id, 'deleted', OLD.type, OLD.name, OLD.parent_id,
+            teldrive.entry_path(OLD.parent_id, OLD.name), OLD.size, OLD.hash, OLD.hash_algorithm);
+        RETURN NULL;
+    END IF;
+
+    IF NEW.parent_id IS NULL THEN
+        RETURN NULL;
+    END IF;
+
+    IF TG_OP = 'UPDATE' AND OLD.user_id <> NEW.user_id THEN
+        IF OLD.status = 'active' AND NOT EXISTS (SELECT 1 FROM teldrive.files
+            WHERE id = OLD.parent_id AND user_id = NEW.user_id) THEN
+            INSERT INTO teldrive.change_log (user_id, file_id, event, type, name, parent_id, path, size, hash, hash_algorithm)
+            VALUES (OLD.user_id, OLD.id, 'deleted', OLD.type, OLD.name, OLD.parent_id,
+                teldrive.entry_path(OLD.parent_id, OLD.name), OLD.size, OLD.hash, OLD.hash_algorithm);
+        END IF;
+        IF NEW.status <> 'active' THEN
+            RETURN NULL;
+        END IF;
+        change_event := 'created';
+    ELSIF TG_OP = 'INSERT' THEN
+        IF NEW.status <> 'active' THEN
+            RETURN NULL;
+        END IF;
+        change_event := 'created';
+    ELSIF OLD.status = 'active' AND NEW.status <> 'active' THEN
+        change_event := 'deleted';
+    ELSIF OLD.status <> 'active' AND NEW.status = 'active' THEN
+        change_event := 'created';
+    ELSIF NEW.status <> 'active' THEN
+        RETURN NULL;
+    ELSIF NEW.parent_id IS DISTINCT FROM OLD.parent_id OR NEW.name <> OLD.name THEN
+        change_event := 'moved';
+        moved_from := teldrive.entry_path(OLD.parent_id, OLD.name);
+    ELSIF NEW.type = 'file' AND (NEW.size IS DISTINCT FROM OLD.size OR NEW.hash IS DISTINCT FROM OLD.hash
+        OR NEW.parts IS DISTINCT FROM OLD.parts OR NEW.inline_data IS DISTINCT FROM OLD.inline_data
+        OR NEW.mime_type IS DISTINCT FROM OLD.mime_type OR NEW.encrypted IS DISTINCT FROM OLD.encrypted) THEN
+        change_event := 'updated';
+    ELSE
+        RETURN NULL;
+    END IF;
+
+    INSERT INTO teldrive.change_log (user_id, file_id, event, type, name, parent_id, path, old_path, size, hash, hash_algorithm)
+    VALUES (NEW.user_id, NEW.id, change_event, NEW.type, NEW.name, NEW.parent_id,
+        teldrive.entry_path(NEW.parent_id, NEW.name), moved_from, NEW.size, NEW.hash, NEW.hash_algorithm);
+    RETURN NULL;
+END;
+$$;
+-- +goose StatementEnd
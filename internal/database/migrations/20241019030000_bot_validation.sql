@@ -0,0 +1,5 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.bots ADD COLUMN IF NOT EXISTS validated_at timestamp NULL;
+ALTER TABLE teldrive.bots ADD COLUMN IF NOT EXISTS validation_error text NULL;
+-- +goose StatementEnd
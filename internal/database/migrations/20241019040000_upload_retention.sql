@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.upload_retentions (
+    upload_id text PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES teldrive.users(user_id) ON DELETE CASCADE,
+    expires_at timestamp NOT NULL,
+    created_at timestamp NOT NULL DEFAULT timezone('utc'::text, now())
+);
+CREATE INDEX IF NOT EXISTS upload_retentions_expires_at_idx ON teldrive.upload_retentions (expires_at);
+-- +goose StatementEnd
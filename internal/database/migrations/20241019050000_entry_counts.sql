@@ -0,0 +1,66 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE teldrive.users ADD COLUMN IF NOT EXISTS max_files bigint NULL;
+ALTER TABLE teldrive.users ADD COLUMN IF NOT EXISTS max_folders bigint NULL;
+
+CREATE TABLE IF NOT EXISTS teldrive.entry_counts (
+    user_id bigint PRIMARY KEY,
+    files bigint NOT NULL DEFAULT 0,
+    folders bigint NOT NULL DEFAULT 0
+);
+
+-- count_entry adds delta to the file or folder count of a user.
+CREATE OR REPLACE FUNCTION teldrive.count_entry(owner bigint, entry_type text, delta bigint) RETURNS void
+LANGUAGE plpgsql
+AS $$
+BEGIN
+    IF entry_type = 'folder' THEN
+        INSERT INTO teldrive.entry_counts AS c (user_id, folders) VALUES (owner, delta)
+        ON CONFLICT (user_id) DO UPDATE SET folders = c.folders + delta;
+    ELSE
+        INSERT INTO teldrive.entry_counts AS c (user_id, files) VALUES (owner, delta)
+        ON CONFLICT (user_id) DO UPDATE SET files = c.files + delta;
+    END IF;
+END;
+$$;
+
+-- count_file_change keeps entry_counts in step with the active entries below
+-- the root of every user, so limits are checked without counting them.
+CREATE OR REPLACE FUNCTION teldrive.count_file_change() RETURNS trigger
+LANGUAGE plpgsql
+AS $$
+DECLARE
+    was_counted boolean := false;
+    is_counted boolean := false;
+BEGIN
+    IF TG_OP <> 'INSERT' THEN
+        was_counted := OLD.status = 'active' AND OLD.parent_id IS NOT NULL;
+    END IF;
+    IF TG_OP <> 'DELETE' THEN
+        is_counted := NEW.status = 'active' AND NEW.parent_id IS NOT NULL;
+    END IF;
+
+    IF TG_OP = 'UPDATE' AND was_counted AND is_counted
+        AND OLD.user_id = NEW.user_id AND OLD.type = NEW.type THEN
+        RETURN NULL;
+    END IF;
+    IF was_counted THEN
+        PERFORM teldrive.count_entry(OLD.user_id, OLD.type, -1);
+    END IF;
+    IF is_counted THEN
+        PERFORM teldrive.count_entry(NEW.user_id, NEW.type, 1);
+    END IF;
+    RETURN NULL;
+END;
+$$;
+
+DROP TRIGGER IF EXISTS files_count_change ON teldrive.files;
+
+CREATE TRIGGER files_count_change AFTER INSERT OR UPDATE OF status, parent_id, type, user_id OR DELETE ON teldrive.files
+FOR EACH ROW EXECUTE FUNCTION teldrive.count_file_change();
+
+INSERT INTO teldrive.entry_counts (user_id, files, folders)
+SELECT user_id, count(*) FILTER (WHERE type <> 'folder'), count(*) FILTER (WHERE type = 'folder')
+FROM teldrive.files WHERE status = 'active' AND parent_id IS NOT NULL GROUP BY user_id
+ON CONFLICT (user_id) DO UPDATE SET files = excluded.files, folders = excluded.folders;
+-- +goose StatementEnd
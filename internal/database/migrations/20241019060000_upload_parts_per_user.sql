@@ -0,0 +1,6 @@
+-- +goose Up
+-- +goose StatementBegin
+DROP INDEX IF EXISTS teldrive.uploads_upload_id_part_no_key;
+CREATE UNIQUE INDEX IF NOT EXISTS uploads_user_id_upload_id_part_no_key ON teldrive.uploads USING btree (user_id, upload_id, part_no);
+-- +goose StatementEnd
+
@@ -0,0 +1,30 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS teldrive.upload_part_numbers (
+    user_id bigint NOT NULL,
+    upload_id text NOT NULL,
+    part_no integer NOT NULL,
+    updated_at timestamp NOT NULL DEFAULT timezone('utc'::text, now()),
+    PRIMARY KEY (user_id, upload_id)
+);
+
+-- drop_part_numbers forgets the numbers handed out for an upload once its
+-- last part is gone, so an upload id sent again starts over at 1.
+CREATE OR REPLACE FUNCTION teldrive.drop_part_numbers() RETURNS trigger
+LANGUAGE plpgsql
+AS $$
+BEGIN
+    DELETE FROM teldrive.upload_part_numbers n
+    USING (SELECT DISTINCT user_id, upload_id FROM old_uploads) o
+    WHERE n.user_id = o.user_id AND n.upload_id = o.upload_id
+    AND NOT EXISTS (SELECT 1 FROM teldrive.uploads u WHERE u.user_id = o.user_id AND u.upload_id = o.upload_id);
+    RETURN NULL;
+END;
+$$;
+
+DROP TRIGGER IF EXISTS uploads_drop_part_numbers ON teldrive.uploads;
+
+CREATE TRIGGER uploads_drop_part_numbers AFTER DELETE ON teldrive.uploads
+REFERENCING OLD TABLE AS old_uploads
+FOR EACH STATEMENT EXECUTE FUNCTION teldrive.drop_part_numbers();
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION teldrive.bump_file_version() RETURNS trigger
+LANGUAGE plpgsql
+AS $$
+BEGIN
+    NEW.version := OLD.version + 1;
+    RETURN NEW;
+END;
+$$;
+
+DROP TRIGGER IF EXISTS files_bump_version ON teldrive.files;
+
+CREATE TRIGGER files_bump_version BEFORE UPDATE ON teldrive.files
+FOR EACH ROW
+WHEN (to_jsonb(NEW) - ARRAY['version', 'last_accessed_at', 'hash', 'hash_algorithm', 'size']
+    IS DISTINCT FROM to_jsonb(OLD) - ARRAY['version', 'last_accessed_at', 'hash', 'hash_algorithm', 'size'])
+EXECUTE FUNCTION teldrive.bump_file_version();
+-- +goose StatementEnd
@@ -0,0 +1,151 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tgdrive/teldrive/internal/config"
+	"go.uber.org/zap"
+)
+
+const (
+	UploadCompleted = "upload.completed"
+	FileDeleted     = "file.deleted"
+	ShareAccessed   = "share.accessed"
+)
+
+// Event is the payload published for everything teldrive reports. Data holds
+// the type specific fields.
+type Event struct {
+	ID     string    `json:"id"`
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	UserID int64     `json:"userId,omitempty"`
+	Data   any       `json:"data"`
+}
+
+// New returns an event of type for userId stamped with a fresh id and the
+// current time.
+func New(typ string, userId int64, data any) Event {
+	return Event{ID: uuid.NewString(), Type: typ, Time: time.Now().UTC(), UserID: userId, Data: data}
+}
+
+// Publisher delivers events to a broker.
+type Publisher interface {
+	Publish(ctx context.Context, event Event) error
+	Close() error
+}
+
+// Emitter hands events to a Publisher from a single goroutine, so a slow or
+// unreachable broker never holds up a request. Events that do not fit in the
+// buffer are dropped. A nil Emitter drops everything.
+type Emitter struct {
+	publisher Publisher
+	timeout   time.Duration
+	logger    *zap.SugaredLogger
+	queue     chan Event
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+	dropped   atomic.Int64
+}
+
+func NewEmitter(publisher Publisher, buffer int, timeout time.Duration, logger *zap.SugaredLogger) *Emitter {
+	e := &Emitter{
+		publisher: publisher,
+		timeout:   timeout,
+		logger:    logger,
+		queue:     make(chan Event, buffer),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// NewFromConfig returns the emitter of the configured broker, or nil when
+// events are disabled.
+func NewFromConfig(cnf *config.Config, logger *zap.SugaredLogger) (*Emitter, error) {
+	var publisher Publisher
+	switch cnf.Events.Broker {
+	case "":
+		return nil, nil
+	case "redis":
+		publisher = NewRedisPublisher(&cnf.Events)
+	default:
+		return nil, fmt.Errorf("unknown events broker %q", cnf.Events.Broker)
+	}
+	return NewEmitter(publisher, cnf.Events.BufferSize, cnf.Events.Timeout, logger), nil
+}
+
+// Emit queues an event without blocking.
+func (e *Emitter) Emit(event Event) {
+	if e == nil {
+		return
+	}
+	select {
+	case <-e.done:
+		return
+	default:
+	}
+	select {
+	case e.queue <- event:
+	default:
+		if e.dropped.Add(1) == 1 {
+			e.logger.Warnw("events buffer full, dropping events", "type", event.Type)
+		}
+	}
+}
+
+// Dropped returns the number of events dropped so far.
+func (e *Emitter) Dropped() int64 {
+	if e == nil {
+		return 0
+	}
+	return e.dropped.Load()
+}
+
+func (e *Emitter) run() {
+	defer close(e.stopped)
+	for {
+		select {
+		case event := <-e.queue:
+			e.publish(event)
+		case <-e.done:
+			return
+		}
+	}
+}
+
+func (e *Emitter) publish(event Event) {
+	ctx := context.Background()
+	if e.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+	}
+	if err := e.publisher.Publish(ctx, event); err != nil {
+		e.logger.Warnw("failed to publish event", "id", event.ID, "type", event.Type, "err", err)
+	}
+}
+
+// Close publishes the events still queued, giving up when ctx is done, and
+// closes the publisher.
+func (e *Emitter) Close(ctx context.Context) error {
+	if e == nil {
+		return nil
+	}
+	e.closeOnce.Do(func() { close(e.done) })
+	<-e.stopped
+	for ctx.Err() == nil && len(e.queue) > 0 {
+		e.publish(<-e.queue)
+	}
+	if n := e.dropped.Load(); n > 0 {
+		e.logger.Warnw("events dropped", "count", n)
+	}
+	return e.publisher.Close()
+}
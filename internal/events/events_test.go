@@ -0,0 +1,82 @@
+package events
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type fakePublisher struct {
+	mu     sync.Mutex
+	block  chan struct{}
+	events []Event
+	closed bool
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, event Event) error {
+	if p.block != nil {
+		select {
+		case <-p.block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, event)
+	return nil
+}
+
+func (p *fakePublisher) Close() error {
+	p.closed = true
+	return nil
+}
+
+func TestEmitterDrainsOnClose(t *testing.T) {
+	p := &fakePublisher{}
+	e := NewEmitter(p, 8, time.Second, zap.NewNop().Sugar())
+	for range 5 {
+		e.Emit(New(FileDeleted, 1, nil))
+	}
+	assert.NoError(t, e.Close(context.Background()))
+	assert.Len(t, p.events, 5)
+	assert.True(t, p.closed)
+	assert.Zero(t, e.Dropped())
+
+	e.Emit(New(FileDeleted, 1, nil))
+	assert.Len(t, p.events, 5)
+}
+
+func TestEmitterDropsWhenFull(t *testing.T) {
+	p := &fakePublisher{block: make(chan struct{})}
+	e := NewEmitter(p, 2, time.Second, zap.NewNop().Sugar())
+
+	done := make(chan struct{})
+	go func() {
+		for range 10 {
+			e.Emit(New(UploadCompleted, 1, nil))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Emit blocked on a stalled publisher")
+	}
+	assert.GreaterOrEqual(t, e.Dropped(), int64(7))
+
+	close(p.block)
+	assert.NoError(t, e.Close(context.Background()))
+	assert.Equal(t, int64(10), e.Dropped()+int64(len(p.events)))
+}
+
+func TestNilEmitter(t *testing.T) {
+	var e *Emitter
+	e.Emit(New(ShareAccessed, 1, nil))
+	assert.Zero(t, e.Dropped())
+	assert.NoError(t, e.Close(context.Background()))
+}
@@ -0,0 +1,42 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/tgdrive/teldrive/internal/config"
+)
+
+// RedisPublisher appends events to a Redis stream, where consumer groups can
+// read them at their own pace. The stream is trimmed to about MaxLen entries.
+type RedisPublisher struct {
+	client *redis.Client
+	stream string
+	maxLen int64
+}
+
+func NewRedisPublisher(cnf *config.EventsConfig) *RedisPublisher {
+	return &RedisPublisher{
+		client: redis.NewClient(&redis.Options{Addr: cnf.RedisAddr, Password: cnf.RedisPass}),
+		stream: cnf.Topic,
+		maxLen: cnf.MaxLen,
+	}
+}
+
+func (p *RedisPublisher) Publish(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return p.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: p.stream,
+		MaxLen: p.maxLen,
+		Approx: p.maxLen > 0,
+		Values: map[string]any{"type": event.Type, "event": payload},
+	}).Err()
+}
+
+func (p *RedisPublisher) Close() error {
+	return p.client.Close()
+}
@@ -1,6 +1,7 @@
 package kv
 
 import (
+	"bytes"
 	"os"
 	"path/filepath"
 	"time"
@@ -44,6 +45,19 @@ func (b *Bolt) Delete(key string) error {
 	})
 }
 
+func (b *Bolt) Keys(prefix string) ([]string, error) {
+	var keys []string
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(b.bucket).Cursor()
+		p := []byte(prefix)
+		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	return keys, err
+}
+
 func NewBoltKV(cnf *config.Config) KV {
 
 	sessionFile := cnf.TG.SessionFile
@@ -12,6 +12,7 @@ type KV interface {
 	Get(key string) ([]byte, error)
 	Set(key string, value []byte) error
 	Delete(key string) error
+	Keys(prefix string) ([]string, error)
 }
 
 type Options struct {
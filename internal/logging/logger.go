@@ -19,6 +19,7 @@ const loggerKey = contextKey("logger")
 var (
 	defaultLogger     *zap.SugaredLogger
 	defaultLoggerOnce sync.Once
+	atomicLevel       = zap.NewAtomicLevelAt(zapcore.InfoLevel)
 )
 
 var conf = &Config{
@@ -38,10 +39,22 @@ func SetConfig(c *Config) {
 		Development: c.Development,
 		FilePath:    c.FilePath,
 	}
+	atomicLevel.SetLevel(c.Level)
 }
 
+// SetLevel changes the level of all loggers created by this package at runtime.
 func SetLevel(l zapcore.Level) {
 	conf.Level = l
+	atomicLevel.SetLevel(l)
+}
+
+// Development reports whether the logger runs in development mode.
+func Development() bool {
+	return conf.Development
+}
+
+func Level() zapcore.Level {
+	return atomicLevel.Level()
 }
 
 func NewLogger(conf *Config) *zap.SugaredLogger {
@@ -57,7 +70,7 @@ func NewLogger(conf *Config) *zap.SugaredLogger {
 	var cores []zapcore.Core
 
 	cores = append(cores, zapcore.NewCore(zapcore.NewConsoleEncoder(ec),
-		zapcore.AddSync(os.Stdout), zap.NewAtomicLevelAt(conf.Level)))
+		zapcore.AddSync(os.Stdout), atomicLevel))
 
 	if conf.FilePath != "" {
 		lumberjackLogger := &lumberjack.Logger{
@@ -68,7 +81,7 @@ func NewLogger(conf *Config) *zap.SugaredLogger {
 			Compress:   true,
 		}
 		cores = append(cores, zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
-			zapcore.AddSync(lumberjackLogger), zap.NewAtomicLevelAt(conf.Level)))
+			zapcore.AddSync(lumberjackLogger), atomicLevel))
 	}
 
 	options := []zap.Option{}
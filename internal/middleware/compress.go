@@ -0,0 +1,262 @@
+package middleware
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/tgdrive/teldrive/internal/config"
+)
+
+// CompressionAlgorithms lists the supported content encodings.
+var CompressionAlgorithms = []string{"zstd", "gzip", "deflate"}
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var encoders = map[string]*sync.Pool{
+	"gzip": {New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}},
+	"deflate": {New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}},
+	"zstd": {New: func() any {
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithLowerEncoderMem(true))
+		return w
+	}},
+}
+
+// Compress encodes JSON and text responses of at least the configured size
+// with the preferred algorithm the client accepts. Requests whose path
+// contains one of skip, range requests and responses that already carry an
+// encoding or a range are sent as they are, so file streams keep working
+// with Range and are not compressed twice.
+func Compress(cnf *config.CompressionConfig, skip ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !cnf.Enabled || c.Request.Method == http.MethodHead || c.GetHeader("Range") != "" ||
+			c.GetHeader("Upgrade") != "" {
+			c.Next()
+			return
+		}
+		for _, segment := range skip {
+			if strings.Contains(c.Request.URL.Path, segment) {
+				c.Next()
+				return
+			}
+		}
+		encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"), cnf.Algorithms)
+		if encoding == "" {
+			c.Next()
+			return
+		}
+
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		w := &compressWriter{ResponseWriter: c.Writer, encoding: encoding, minSize: cnf.MinSize,
+			status: http.StatusOK}
+		c.Writer = w
+		c.Next()
+		w.finish()
+	}
+}
+
+// negotiateEncoding picks the algorithm with the highest quality in the
+// Accept-Encoding header, preferring the earlier one in algorithms on ties.
+func negotiateEncoding(header string, algorithms []string) string {
+	if header == "" {
+		return ""
+	}
+	quality := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		quality[strings.ToLower(strings.TrimSpace(name))] = q
+	}
+	best, bestQ := "", 0.0
+	for _, algorithm := range algorithms {
+		q, ok := quality[algorithm]
+		if !ok {
+			q = quality["*"]
+		}
+		if q > bestQ {
+			best, bestQ = algorithm, q
+		}
+	}
+	return best
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"), strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/x-ndjson", "application/javascript", "application/xml":
+		return true
+	}
+	return false
+}
+
+// compressWriter holds back the response until it either reaches minSize,
+// when it starts compressing, or ends or is flushed below it, when it is
+// sent unchanged.
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	minSize  int64
+	status   int
+	buf      []byte
+	enc      encoder
+	decided  bool
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if !w.decided {
+		w.status = code
+	}
+}
+
+func (w *compressWriter) WriteHeaderNow() {
+	if !w.decided {
+		w.passthrough(false)
+	}
+}
+
+func (w *compressWriter) Written() bool {
+	return w.decided || len(w.buf) > 0
+}
+
+func (w *compressWriter) Status() int {
+	if !w.decided {
+		return w.status
+	}
+	return w.ResponseWriter.Status()
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		if !w.eligible() {
+			w.passthrough(false)
+		} else {
+			w.buf = append(w.buf, b...)
+			if int64(len(w.buf)) >= w.minSize {
+				if err := w.compress(); err != nil {
+					return 0, err
+				}
+			}
+			return len(b), nil
+		}
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.passthrough(false)
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.decided = true
+	return w.ResponseWriter.Hijack()
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressWriter) eligible() bool {
+	header := w.Header()
+	return header.Get("Content-Encoding") == "" && header.Get("Content-Range") == "" &&
+		compressible(header.Get("Content-Type"))
+}
+
+// compress sends the headers of the encoded response and the buffered body.
+func (w *compressWriter) compress() error {
+	w.decided = true
+	header := w.Header()
+	header.Set("Content-Encoding", w.encoding)
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	// The encoded body is a different representation, so it can only be
+	// weakly equal to the one the tag was computed for.
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.enc = encoders[w.encoding].Get().(encoder)
+	w.enc.Reset(w.ResponseWriter)
+	_, err := w.enc.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+// passthrough sends the headers and the buffered body unchanged. When the
+// response is complete its length is known.
+func (w *compressWriter) passthrough(complete bool) {
+	w.decided = true
+	if w.status == http.StatusNotModified {
+		if etag := w.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			w.Header().Set("ETag", "W/"+etag)
+		}
+	}
+	if complete && len(w.buf) > 0 && w.Header().Get("Content-Length") == "" {
+		w.Header().Set("Content-Length", strconv.Itoa(len(w.buf)))
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buf) > 0 {
+		w.ResponseWriter.Write(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *compressWriter) finish() {
+	if !w.decided {
+		// A handler that wrote nothing may still have set a status, gin
+		// only sends it when the writer is asked to.
+		w.passthrough(true)
+		w.ResponseWriter.WriteHeaderNow()
+		return
+	}
+	if w.enc != nil {
+		w.enc.Close()
+		encoders[w.encoding].Put(w.enc)
+		w.enc = nil
+	}
+}
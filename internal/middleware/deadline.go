@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MIMENDJSON is the content type of listings streamed as newline-delimited
+// JSON.
+const MIMENDJSON = "application/x-ndjson"
+
+// listingPath is the only route that streams newline-delimited JSON.
+const listingPath = "/api/files"
+
+// ExtendDeadlines replaces the server wide read and write timeouts for
+// requests whose path contains one of segments, and for file listings asking
+// for a newline-delimited JSON stream. Uploads, streams and websockets
+// legitimately outlive the tight defaults that protect every other route from
+// slow clients. A zero timeout removes the deadlines.
+func ExtendDeadlines(timeout time.Duration, segments ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if longRunning(c, segments) {
+			var deadline time.Time
+			if timeout > 0 {
+				deadline = time.Now().Add(timeout)
+			}
+			rc := http.NewResponseController(c.Writer)
+			rc.SetReadDeadline(deadline)
+			rc.SetWriteDeadline(deadline)
+		}
+		c.Next()
+	}
+}
+
+func longRunning(c *gin.Context, segments []string) bool {
+	if c.Request.Method == http.MethodGet && c.Request.URL.Path == listingPath &&
+		c.NegotiateFormat(gin.MIMEJSON, MIMENDJSON) == MIMENDJSON {
+		return true
+	}
+	for _, segment := range segments {
+		if strings.Contains(c.Request.URL.Path, segment) {
+			return true
+		}
+	}
+	return false
+}
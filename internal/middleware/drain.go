@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tgdrive/teldrive/pkg/httputil"
+)
+
+var ErrShuttingDown = errors.New("server is shutting down")
+
+type InFlight struct {
+	RequestID string
+	Method    string
+	Path      string
+	Started   time.Time
+}
+
+// Drainer tracks long running requests such as uploads and streams so that
+// shutdown can wait for them and report the ones that did not finish.
+type Drainer struct {
+	draining atomic.Bool
+	mu       sync.Mutex
+	seq      uint64
+	inflight map[uint64]InFlight
+}
+
+func NewDrainer() *Drainer {
+	return &Drainer{inflight: make(map[uint64]InFlight)}
+}
+
+// StartDraining flips readiness and makes Track reject new requests.
+func (d *Drainer) StartDraining() {
+	d.draining.Store(true)
+}
+
+func (d *Drainer) Draining() bool {
+	return d.draining.Load()
+}
+
+// InFlight returns the tracked requests that are still running.
+func (d *Drainer) InFlight() []InFlight {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]InFlight, 0, len(d.inflight))
+	for _, req := range d.inflight {
+		out = append(out, req)
+	}
+	return out
+}
+
+// Track registers requests whose path contains one of segments for the
+// duration of the handler. Once draining has started such requests are
+// refused with 503 so clients retry against another instance.
+func (d *Drainer) Track(segments ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		tracked := false
+		for _, segment := range segments {
+			if strings.Contains(path, segment) {
+				tracked = true
+				break
+			}
+		}
+		if !tracked {
+			c.Next()
+			return
+		}
+		if d.Draining() {
+			c.Header("Retry-After", "5")
+			httputil.NewError(c, http.StatusServiceUnavailable, ErrShuttingDown)
+			return
+		}
+
+		d.mu.Lock()
+		d.seq++
+		id := d.seq
+		d.inflight[id] = InFlight{
+			RequestID: c.GetString(RequestIDKey),
+			Method:    c.Request.Method,
+			Path:      path,
+			Started:   time.Now(),
+		}
+		d.mu.Unlock()
+
+		defer func() {
+			d.mu.Lock()
+			delete(d.inflight, id)
+			d.mu.Unlock()
+		}()
+
+		c.Next()
+	}
+}
+
+// Ready reports 503 once draining has started so load balancers stop routing
+// traffic here.
+func (d *Drainer) Ready(c *gin.Context) {
+	if d.Draining() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "draining"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/pkg/httputil"
+)
+
+// FrameOptions lists the accepted frame options, empty allows any framing.
+var FrameOptions = []string{"", "deny", "sameorigin"}
+
+var frameAncestors = map[string]string{"deny": "'none'", "sameorigin": "'self'"}
+
+// SecureHeaders sets the configured security headers on every response.
+// Frames are blocked both with X-Frame-Options and a frame-ancestors policy,
+// except on paths containing one of the exempt segments.
+func SecureHeaders(cnf *config.HeadersConfig) gin.HandlerFunc {
+	var hsts string
+	if cnf.HstsMaxAge > 0 {
+		hsts = fmt.Sprintf("max-age=%d", int64(cnf.HstsMaxAge.Seconds()))
+		if cnf.HstsIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		if cnf.HstsPreload {
+			hsts += "; preload"
+		}
+	}
+	return func(c *gin.Context) {
+		if !cnf.Enabled {
+			c.Next()
+			return
+		}
+		header := c.Writer.Header()
+		if hsts != "" && httputil.IsSecure(c.Request) {
+			header.Set("Strict-Transport-Security", hsts)
+		}
+		if cnf.ContentTypeOptions {
+			header.Set("X-Content-Type-Options", "nosniff")
+		}
+		if cnf.ReferrerPolicy != "" {
+			header.Set("Referrer-Policy", cnf.ReferrerPolicy)
+		}
+		if ancestors, ok := frameAncestors[cnf.FrameOptions]; ok && !frameExempt(c.Request.URL.Path, cnf.FrameExempt) {
+			header.Set("X-Frame-Options", strings.ToUpper(cnf.FrameOptions))
+			header.Set("Content-Security-Policy", "frame-ancestors "+ancestors)
+		}
+		c.Next()
+	}
+}
+
+func frameExempt(path string, exempt []string) bool {
+	for _, segment := range exempt {
+		if segment != "" && strings.Contains(path, segment) {
+			return true
+		}
+	}
+	return false
+}
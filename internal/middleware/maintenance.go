@@ -0,0 +1,147 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/pkg/httputil"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+)
+
+var ErrMaintenance = errors.New("service is in maintenance mode, writes are disabled")
+
+// maintenanceWait bounds how long enabling maintenance waits for in-flight
+// writes before answering.
+const maintenanceWait = 30 * time.Second
+
+// Maintenance freezes writes while reads and streams keep working. Writes
+// that started before the mode was enabled are allowed to finish; the mode is
+// engaged once none are left.
+type Maintenance struct {
+	enabled atomic.Bool
+	writes  atomic.Int64
+	mu      sync.Mutex
+	message string
+	since   *time.Time
+}
+
+func NewMaintenance(cnf *config.Config) *Maintenance {
+	m := &Maintenance{}
+	if cnf.Server.Maintenance {
+		m.set(true, cnf.Server.MaintenanceMessage)
+	}
+	return m
+}
+
+func (m *Maintenance) Enabled() bool {
+	return m.enabled.Load()
+}
+
+func (m *Maintenance) set(enabled bool, message string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if enabled {
+		if !m.enabled.Load() {
+			now := time.Now().UTC()
+			m.since = &now
+		}
+		m.message = message
+	} else {
+		m.message, m.since = "", nil
+	}
+	m.enabled.Store(enabled)
+}
+
+func (m *Maintenance) status() *schemas.Maintenance {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	writes := m.writes.Load()
+	enabled := m.enabled.Load()
+	return &schemas.Maintenance{
+		Enabled:       enabled,
+		Engaged:       enabled && writes == 0,
+		Message:       m.message,
+		Since:         m.since,
+		PendingWrites: writes,
+	}
+}
+
+// Guard refuses mutating requests with 503 while maintenance is enabled.
+// Paths containing one of skip stay writable, such as logins and the admin
+// endpoints needed to leave maintenance again.
+func (m *Maintenance) Guard(skip ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		for _, segment := range skip {
+			if strings.Contains(c.Request.URL.Path, segment) {
+				c.Next()
+				return
+			}
+		}
+
+		// Counted before the check so enabling cannot miss a write that is
+		// just starting.
+		m.writes.Add(1)
+		defer m.writes.Add(-1)
+
+		if m.Enabled() {
+			c.Header("Retry-After", "60")
+			err := ErrMaintenance
+			if status := m.status(); status.Message != "" {
+				err = errors.New(ErrMaintenance.Error() + ": " + status.Message)
+			}
+			httputil.NewError(c, http.StatusServiceUnavailable, err)
+			return
+		}
+		c.Next()
+	}
+}
+
+// Status reports the maintenance state for banners.
+func (m *Maintenance) Status(c *gin.Context) {
+	c.JSON(http.StatusOK, m.status())
+}
+
+// Update switches maintenance on or off. When switching on it waits a while
+// for in-flight writes so the response tells whether the mode is engaged.
+func (m *Maintenance) Update(c *gin.Context) {
+	var payload schemas.MaintenanceIn
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	m.set(*payload.Enabled, payload.Message)
+	logging.FromContext(c).Infow("maintenance mode changed", "enabled", *payload.Enabled, "message", payload.Message)
+
+	if *payload.Enabled {
+		deadline := time.NewTimer(maintenanceWait)
+		defer deadline.Stop()
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		// The update request itself is not a write, see Guard's skip list.
+		for m.writes.Load() > 0 {
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case <-deadline.C:
+				c.JSON(http.StatusAccepted, m.status())
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, m.status())
+}
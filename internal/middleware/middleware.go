@@ -2,18 +2,33 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/divyam234/cors"
 	"github.com/gin-contrib/secure"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/tgdrive/teldrive/internal/auth"
 	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/httputil"
+	"github.com/tgdrive/teldrive/pkg/types"
 	"gorm.io/gorm"
 
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	RequestIDHeader = "X-Request-Id"
+	RequestIDKey    = httputil.RequestIDKey
+)
+
 func TimeoutMiddleware(timeout time.Duration) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
@@ -29,20 +44,48 @@ func TimeoutMiddleware(timeout time.Duration) gin.HandlerFunc {
 	}
 }
 
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// BodyLimit rejects request bodies larger than limit bytes. Requests that
+// announce a larger Content-Length fail before the handler runs, others are
+// cut off once they read past the limit. Paths under skip are left unlimited
+// so uploads keep streaming.
+func BodyLimit(limit int64, skip ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limit <= 0 || c.Request.Body == nil {
+			c.Next()
+			return
+		}
+		for _, prefix := range skip {
+			if strings.HasPrefix(c.Request.URL.Path, prefix) {
+				c.Next()
+				return
+			}
+		}
+		if c.Request.ContentLength > limit {
+			httputil.NewError(c, http.StatusRequestEntityTooLarge, ErrBodyTooLarge)
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
+
 func Cors() gin.HandlerFunc {
 	return cors.New(cors.Config{
-		AllowMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"},
-		AllowHeaders: []string{"Authorization", "Content-Length", "Content-Type"},
-		AllowOrigins: []string{"*"},
-		MaxAge:       12 * time.Hour,
+		AllowMethods:  []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"},
+		AllowHeaders:  []string{"Authorization", "Content-Length", "Content-Type", RequestIDHeader},
+		ExposeHeaders: []string{RequestIDHeader},
+		AllowOrigins:  []string{"*"},
+		MaxAge:        12 * time.Hour,
 	})
 }
 
-func Authmiddleware(secret string, db *gorm.DB, cache cache.Cacher) gin.HandlerFunc {
+func Authmiddleware(cnf *config.JWTConfig, db *gorm.DB, cache cache.Cacher) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		user, err := auth.VerifyUser(c, db, cache, secret)
+		user, err := auth.VerifyUser(c, db, cache, cnf)
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			httputil.Unauthenticated(c, err)
 			return
 		}
 		c.Set("jwtUser", user)
@@ -50,6 +93,109 @@ func Authmiddleware(secret string, db *gorm.DB, cache cache.Cacher) gin.HandlerF
 	}
 }
 
+// UploadTicketAuth authenticates requests carrying a ticket query parameter
+// and defers to next for everything else.
+func UploadTicketAuth(cnf *config.JWTConfig, secret string, db *gorm.DB, cache cache.Cacher, next gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.Query("ticket")
+		if token == "" {
+			next(c)
+			return
+		}
+		ticket, err := auth.VerifyTicket(secret, token, time.Now())
+		if err != nil {
+			httputil.Unauthenticated(c, err)
+			return
+		}
+		if ticket.UploadId != c.Param("id") {
+			httputil.NewError(c, http.StatusForbidden, errors.New("ticket not valid for this upload"))
+			return
+		}
+		session, err := auth.GetSessionByHash(db, cache, ticket.SessionHash)
+		if err != nil || session.UserId != ticket.UserId {
+			httputil.Unauthenticated(c, errors.New("invalid session"))
+			return
+		}
+		if err := auth.CheckSession(db, cache, cnf, session, time.Now().UTC()); err != nil {
+			httputil.Unauthenticated(c, err)
+			return
+		}
+		c.Set("jwtUser", &types.JWTClaims{
+			RegisteredClaims: jwt.RegisteredClaims{Subject: strconv.FormatInt(ticket.UserId, 10)},
+			Hash:             ticket.SessionHash,
+			TgSession:        session.Session,
+		})
+		c.Set(auth.UploadTicketKey, ticket)
+		c.Next()
+	}
+}
+
+// adminUser returns the authenticated user of a request and whether they are
+// one of adminUsers.
+func adminUser(c *gin.Context, adminUsers []string) (*types.JWTClaims, bool) {
+	val, _ := c.Get("jwtUser")
+	user, ok := val.(*types.JWTClaims)
+	return user, ok && auth.IsAdmin(adminUsers, user)
+}
+
+func AdminMiddleware(adminUsers []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := adminUser(c, adminUsers); !ok {
+			httputil.NewError(c, http.StatusForbidden, errors.New("admin access required"))
+			return
+		}
+		c.Next()
+	}
+}
+
+const (
+	DCHeader       = "X-Telegram-DC"
+	EndpointHeader = "X-Telegram-Endpoint"
+)
+
+// DCOverride lets admins force the Telegram data center, and optionally the
+// address, the clients of a request connect to by sending the X-Telegram-DC
+// and X-Telegram-Endpoint headers. Other users sending them are refused.
+func DCOverride(adminUsers []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dc, addr := c.GetHeader(DCHeader), c.GetHeader(EndpointHeader)
+		if dc == "" && addr == "" {
+			c.Next()
+			return
+		}
+		user, ok := adminUser(c, adminUsers)
+		if !ok {
+			httputil.NewError(c, http.StatusForbidden, errors.New("admin access required to override the telegram dc"))
+			return
+		}
+		override, err := tgc.ParseDCOverride(dc, addr)
+		if err != nil {
+			httputil.NewError(c, http.StatusBadRequest, err)
+			return
+		}
+		logging.FromContext(c).Warnw("telegram dc override", "user", user.UserName, "dc", override.DC,
+			"addr", override.Addr, "method", c.Request.Method, "path", c.Request.URL.Path)
+		c.Set(tgc.DCOverrideKey, override)
+		c.Next()
+	}
+}
+
+// RequestID assigns a correlation id to every request, honouring an inbound
+// X-Request-Id header, and attaches a logger carrying it to the request context.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = uuid.NewString()
+		}
+		c.Set(RequestIDKey, id)
+		c.Header(RequestIDHeader, id)
+		logger := logging.FromContext(c).With("requestId", id)
+		c.Request = c.Request.WithContext(logging.WithLogger(c, logger))
+		c.Next()
+	}
+}
+
 func SecurityMiddleware() gin.HandlerFunc {
 	return secure.New(secure.Config{
 		STSSeconds:            315360000,
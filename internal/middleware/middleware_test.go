@@ -1,13 +1,22 @@
 package middleware
 
 import (
+	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/klauspost/compress/gzip"
 	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/types"
 )
 
 func TestTimeoutMiddleware(t *testing.T) {
@@ -27,6 +36,61 @@ func TestTimeoutMiddleware(t *testing.T) {
 	s.ServeHTTP(res, req)
 }
 
+func TestRequestID(t *testing.T) {
+	s := setupRouterWithHandler(func(c *gin.Engine) {
+		c.Use(RequestID())
+	}, func(c *gin.Context) {
+		assert.NotEmpty(t, c.GetString(RequestIDKey))
+	})
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/foo", nil)
+	s.ServeHTTP(res, req)
+	assert.NotEmpty(t, res.Header().Get(RequestIDHeader))
+
+	res = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "http://localhost/foo", nil)
+	req.Header.Set(RequestIDHeader, "abc")
+	s.ServeHTTP(res, req)
+	assert.Equal(t, "abc", res.Header().Get(RequestIDHeader))
+}
+
+func TestBodyLimit(t *testing.T) {
+	r := gin.New()
+	r.Use(BodyLimit(8, "/upload", "/import"))
+	handler := func(c *gin.Context) {
+		if _, err := io.ReadAll(c.Request.Body); err != nil {
+			c.Status(http.StatusRequestEntityTooLarge)
+			return
+		}
+		c.Status(http.StatusOK)
+	}
+	r.POST("/foo", handler)
+	r.POST("/upload", handler)
+	r.POST("/import", BodyLimit(16), handler)
+
+	tests := []struct {
+		path   string
+		body   string
+		length int64
+		want   int
+	}{
+		{"/foo", "small", 5, http.StatusOK},
+		{"/foo", "too large body", 14, http.StatusRequestEntityTooLarge},
+		{"/foo", "too large body", -1, http.StatusRequestEntityTooLarge},
+		{"/upload", "too large body", 14, http.StatusOK},
+		{"/import", "too large body", 14, http.StatusOK},
+		{"/import", "much too large body", 19, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "http://localhost"+tt.path, strings.NewReader(tt.body))
+		req.ContentLength = tt.length
+		r.ServeHTTP(res, req)
+		assert.Equal(t, tt.want, res.Code, tt.path+" "+tt.body)
+	}
+}
+
 func setupRouterWithHandler(middlewareFunc func(c *gin.Engine), handler func(c *gin.Context)) *gin.Engine {
 	gin.SetMode(gin.TestMode)
 	r := gin.Default()
@@ -34,3 +98,396 @@ func setupRouterWithHandler(middlewareFunc func(c *gin.Engine), handler func(c *
 	r.GET("/foo", handler)
 	return r
 }
+
+func TestDrainer(t *testing.T) {
+	d := NewDrainer()
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	r := gin.New()
+	r.Use(d.Track("/stream/"))
+	r.GET("/ready", d.Ready)
+	r.GET("/files/:id/stream/:name", func(c *gin.Context) {
+		close(started)
+		<-release
+		c.Status(http.StatusOK)
+	})
+
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest("GET", "/ready", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	done := make(chan struct{})
+	go func() {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/files/1/stream/a.mp4", nil))
+		close(done)
+	}()
+	<-started
+	assert.Len(t, d.InFlight(), 1)
+
+	d.StartDraining()
+
+	res = httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest("GET", "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+
+	res = httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest("GET", "/files/2/stream/b.mp4", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+
+	close(release)
+	<-done
+	assert.Empty(t, d.InFlight())
+}
+
+func TestExtendDeadlines(t *testing.T) {
+	r := gin.New()
+	r.Use(ExtendDeadlines(0, "/stream/"))
+	handler := func(c *gin.Context) {
+		time.Sleep(300 * time.Millisecond)
+		c.String(http.StatusOK, "ok")
+	}
+	r.GET("/stream/:id", handler)
+	r.GET("/api/files", handler)
+	r.POST("/api/files", handler)
+	r.GET("/api/files/:id", handler)
+
+	srv := httptest.NewUnstartedServer(r)
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/stream/1")
+	if assert.NoError(t, err) {
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, "ok", string(body))
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/files", nil)
+	req.Header.Set("Accept", MIMENDJSON)
+	res, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, "ok", string(body))
+	}
+
+	_, err = http.Get(srv.URL + "/api/files")
+	assert.Error(t, err)
+
+	for _, route := range []struct{ method, path string }{
+		{http.MethodPost, "/api/files"},
+		{http.MethodGet, "/api/files/1"},
+	} {
+		req, _ := http.NewRequest(route.method, srv.URL+route.path, nil)
+		req.Header.Set("Accept", MIMENDJSON)
+		_, err = http.DefaultClient.Do(req)
+		assert.Error(t, err, "%s %s", route.method, route.path)
+	}
+}
+
+func TestPublicLimit(t *testing.T) {
+	r := gin.New()
+	r.Use(PublicLimit(&config.ShareConfig{IpRate: 60, IpBurst: 2, LinkBandwidth: 10, BandwidthWindow: time.Hour}))
+	r.GET("/share/:shareID/files/:fileID/stream/:name", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+		for range 3 {
+			if _, err := c.Writer.Write([]byte("12345678")); err != nil {
+				return
+			}
+		}
+	})
+
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest("GET", "/share/a/files/1/stream/a.mp4", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "60", res.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "1", res.Header().Get("X-RateLimit-Remaining"))
+	assert.Equal(t, "12345678"+"12345678", res.Body.String())
+
+	res = httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest("GET", "/share/a/files/1/stream/a.mp4", nil))
+	assert.Equal(t, http.StatusTooManyRequests, res.Code)
+	assert.Equal(t, "3600", res.Header().Get("Retry-After"))
+
+	res = httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest("GET", "/share/b/files/1/stream/a.mp4", nil))
+	assert.Equal(t, http.StatusTooManyRequests, res.Code)
+	assert.Equal(t, "1", res.Header().Get("Retry-After"))
+	assert.Equal(t, "0", res.Header().Get("X-RateLimit-Remaining"))
+
+	req := httptest.NewRequest("GET", "/share/b/files/1/stream/a.mp4", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	res = httptest.NewRecorder()
+	r.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+}
+
+func TestMaintenance(t *testing.T) {
+	m := NewMaintenance(&config.Config{})
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	r := gin.New()
+	r.Use(m.Guard("/admin/"))
+	r.GET("/files", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.POST("/files", func(c *gin.Context) { c.Status(http.StatusCreated) })
+	r.POST("/slow", func(c *gin.Context) {
+		close(started)
+		<-release
+		c.Status(http.StatusCreated)
+	})
+	r.POST("/admin/maintenance", m.Update)
+
+	done := make(chan int)
+	go func() {
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, httptest.NewRequest("POST", "/slow", nil))
+		done <- res.Code
+	}()
+	<-started
+
+	updated := make(chan *httptest.ResponseRecorder)
+	go func() {
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, httptest.NewRequest("POST", "/admin/maintenance",
+			strings.NewReader(`{"enabled":true,"message":"upgrading"}`)))
+		updated <- res
+	}()
+
+	assert.Eventually(t, m.Enabled, time.Second, 10*time.Millisecond)
+	assert.False(t, m.status().Engaged)
+
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest("POST", "/files", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	assert.Contains(t, res.Body.String(), "upgrading")
+
+	res = httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest("GET", "/files", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	close(release)
+	assert.Equal(t, http.StatusCreated, <-done)
+	res = <-updated
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), `"engaged":true`)
+
+	res = httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest("POST", "/admin/maintenance", strings.NewReader(`{"enabled":false}`)))
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	res = httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest("POST", "/files", nil))
+	assert.Equal(t, http.StatusCreated, res.Code)
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	algorithms := []string{"zstd", "gzip"}
+	assert.Equal(t, "zstd", negotiateEncoding("gzip, deflate, br, zstd", algorithms))
+	assert.Equal(t, "gzip", negotiateEncoding("gzip;q=1.0, zstd;q=0.5", algorithms))
+	assert.Equal(t, "gzip", negotiateEncoding("zstd;q=0, *", algorithms))
+	assert.Equal(t, "", negotiateEncoding("br, identity", algorithms))
+	assert.Equal(t, "", negotiateEncoding("", algorithms))
+}
+
+func TestCompress(t *testing.T) {
+	cnf := &config.CompressionConfig{Enabled: true, MinSize: 64, Algorithms: []string{"gzip"}}
+	r := gin.New()
+	r.Use(Compress(cnf, "/stream/"))
+	large := strings.Repeat("teldrive ", 100)
+	r.GET("/large", func(c *gin.Context) {
+		c.Header("ETag", `"v1"`)
+		c.JSON(http.StatusOK, gin.H{"name": large})
+	})
+	r.GET("/small", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"name": "a"})
+	})
+	r.GET("/cached", func(c *gin.Context) {
+		c.Header("ETag", `"v1"`)
+		c.Status(http.StatusNotModified)
+	})
+	r.GET("/stream/file", func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/plain", []byte(large))
+	})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		r.ServeHTTP(res, req)
+		return res
+	}
+
+	res := get("/large")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "gzip", res.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", res.Header().Get("Vary"))
+	assert.Equal(t, `W/"v1"`, res.Header().Get("ETag"))
+	assert.Empty(t, res.Header().Get("Content-Length"))
+	zr, err := gzip.NewReader(res.Body)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(zr)
+	assert.Contains(t, string(body), large)
+
+	res = get("/small")
+	assert.Empty(t, res.Header().Get("Content-Encoding"))
+	assert.Equal(t, `{"name":"a"}`, res.Body.String())
+	assert.Equal(t, "12", res.Header().Get("Content-Length"))
+
+	res = get("/cached")
+	assert.Equal(t, http.StatusNotModified, res.Code)
+	assert.Equal(t, `W/"v1"`, res.Header().Get("ETag"))
+
+	res = get("/stream/file")
+	assert.Empty(t, res.Header().Get("Content-Encoding"))
+	assert.Equal(t, large, res.Body.String())
+}
+
+func TestAuthmiddlewareUnauthenticated(t *testing.T) {
+	cnf := &config.JWTConfig{Secret: "secret"}
+	r := gin.New()
+	r.GET("/private", Authmiddleware(cnf, nil, nil), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	expired, _ := auth.Encode(cnf.Secret, &types.JWTClaims{RegisteredClaims: jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Hour))}})
+	tampered, _ := auth.Encode("other", &types.JWTClaims{})
+
+	for _, tc := range []struct {
+		token, code, reason, challenge string
+	}{
+		{"", "UNAUTHORIZED", auth.ReasonMissing, `Bearer realm="teldrive"`},
+		{tampered, "UNAUTHORIZED", auth.ReasonInvalid, `Bearer realm="teldrive", error="invalid_token"`},
+		{expired, "SESSION_EXPIRED", auth.ReasonExpired, `Bearer realm="teldrive", error="invalid_token"`},
+	} {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/private", nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		r.ServeHTTP(res, req)
+
+		assert.Equal(t, http.StatusUnauthorized, res.Code, tc.reason)
+		assert.Equal(t, tc.challenge, res.Header().Get("WWW-Authenticate"), tc.reason)
+		var body struct {
+			Code    string `json:"code"`
+			Details struct {
+				Reason string `json:"reason"`
+			} `json:"details"`
+		}
+		assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &body))
+		assert.Equal(t, tc.code, body.Code, tc.reason)
+		assert.Equal(t, tc.reason, body.Details.Reason)
+	}
+}
+
+func TestAdminMiddleware(t *testing.T) {
+	r := gin.New()
+	r.GET("/admin", func(c *gin.Context) {
+		c.Set("jwtUser", &types.JWTClaims{
+			RegisteredClaims: jwt.RegisteredClaims{Subject: c.GetHeader("X-User-Id")},
+			UserName:         c.GetHeader("X-User"),
+		})
+	}, AdminMiddleware([]string{"", "admin", "42"}), func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	for _, tc := range []struct {
+		id, user string
+		code     int
+	}{
+		{"1", "admin", http.StatusNoContent},
+		{"42", "", http.StatusNoContent},
+		{"7", "", http.StatusForbidden},
+		{"7", "user", http.StatusForbidden},
+	} {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/admin", nil)
+		req.Header.Set("X-User-Id", tc.id)
+		req.Header.Set("X-User", tc.user)
+		r.ServeHTTP(res, req)
+		assert.Equal(t, tc.code, res.Code, tc.id+" "+tc.user)
+	}
+}
+
+func TestDCOverride(t *testing.T) {
+	r := gin.New()
+	r.GET("/check", func(c *gin.Context) {
+		if user := c.GetHeader("X-User"); user != "" {
+			c.Set("jwtUser", &types.JWTClaims{UserName: strings.TrimPrefix(user, "-")})
+		}
+	}, DCOverride([]string{"", "admin"}), func(c *gin.Context) {
+		if o := tgc.DCOverrideFrom(c); o != nil {
+			c.String(http.StatusOK, o.String())
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	for _, tc := range []struct {
+		user, dc, addr string
+		code           int
+		body           string
+	}{
+		{"", "", "", http.StatusNoContent, ""},
+		{"user", "", "", http.StatusNoContent, ""},
+		{"user", "4", "", http.StatusForbidden, ""},
+		{"-", "4", "", http.StatusForbidden, ""},
+		{"admin", "4", "", http.StatusOK, "dc4"},
+		{"admin", "9", "", http.StatusBadRequest, ""},
+		{"admin", "2", "127.0.0.1:443", http.StatusBadRequest, ""},
+	} {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/check", nil)
+		req.Header.Set("X-User", tc.user)
+		if tc.dc != "" {
+			req.Header.Set(DCHeader, tc.dc)
+		}
+		if tc.addr != "" {
+			req.Header.Set(EndpointHeader, tc.addr)
+		}
+		r.ServeHTTP(res, req)
+		assert.Equal(t, tc.code, res.Code, tc.user+" "+tc.dc)
+		if tc.body != "" {
+			assert.Equal(t, tc.body, res.Body.String())
+		}
+	}
+}
+
+func TestSecureHeaders(t *testing.T) {
+	cnf := &config.HeadersConfig{Enabled: true, HstsMaxAge: 24 * time.Hour, HstsIncludeSubdomains: true,
+		ContentTypeOptions: true, FrameOptions: "deny", FrameExempt: []string{"/share/"},
+		ReferrerPolicy: "no-referrer"}
+	r := gin.New()
+	r.Use(SecureHeaders(cnf))
+	r.GET("/foo", func(c *gin.Context) {})
+	r.GET("/share/:id", func(c *gin.Context) {})
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/foo", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	r.ServeHTTP(res, req)
+	assert.Equal(t, "max-age=86400; includeSubDomains", res.Header().Get("Strict-Transport-Security"))
+	assert.Equal(t, "nosniff", res.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "no-referrer", res.Header().Get("Referrer-Policy"))
+	assert.Equal(t, "DENY", res.Header().Get("X-Frame-Options"))
+	assert.Equal(t, "frame-ancestors 'none'", res.Header().Get("Content-Security-Policy"))
+
+	// Plain HTTP gets no HSTS, exempt paths may be framed.
+	res = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "http://localhost/share/abc", nil)
+	r.ServeHTTP(res, req)
+	assert.Empty(t, res.Header().Get("Strict-Transport-Security"))
+	assert.Empty(t, res.Header().Get("X-Frame-Options"))
+	assert.Empty(t, res.Header().Get("Content-Security-Policy"))
+	assert.Equal(t, "nosniff", res.Header().Get("X-Content-Type-Options"))
+
+	cnf.Enabled = false
+	res = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "http://localhost/foo", nil)
+	r.ServeHTTP(res, req)
+	assert.Empty(t, res.Header().Get("X-Content-Type-Options"))
+}
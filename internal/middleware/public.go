@@ -0,0 +1,284 @@
+package middleware
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/pkg/httputil"
+	"golang.org/x/time/rate"
+)
+
+var (
+	ErrRateLimited       = errors.New("too many requests")
+	ErrBandwidthExceeded = errors.New("bandwidth limit exceeded")
+)
+
+// idleAfter is how long an unused client or link is remembered.
+const idleAfter = 10 * time.Minute
+
+type bucket struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+// keyedLimiter keeps a token bucket per key, refilled at perMinute tokens a
+// minute.
+type keyedLimiter struct {
+	mu        sync.Mutex
+	perMinute int
+	burst     int
+	buckets   map[string]*bucket
+	swept     time.Time
+}
+
+func newKeyedLimiter(perMinute, burst int) *keyedLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &keyedLimiter{perMinute: perMinute, burst: max(burst, 1), buckets: make(map[string]*bucket)}
+}
+
+// take spends a token of key. It returns the tokens left and, when none was
+// available, how long until one is.
+func (l *keyedLimiter) take(key string, now time.Time) (bool, int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.swept) > time.Minute {
+		for k, b := range l.buckets {
+			if now.Sub(b.seen) > idleAfter {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(float64(l.perMinute)/60), l.burst)}
+		l.buckets[key] = b
+	}
+	b.seen = now
+
+	if b.limiter.AllowN(now, 1) {
+		return true, int(b.limiter.TokensAt(now)), 0
+	}
+	r := b.limiter.ReserveN(now, 1)
+	wait := r.DelayFrom(now)
+	r.CancelAt(now)
+	return false, 0, wait
+}
+
+type usage struct {
+	start time.Time
+	used  int64
+}
+
+// byteQuota counts bytes per key in fixed windows.
+type byteQuota struct {
+	mu     sync.Mutex
+	limit  int64
+	window time.Duration
+	usage  map[string]*usage
+	swept  time.Time
+}
+
+func newByteQuota(limit int64, window time.Duration) *byteQuota {
+	if limit <= 0 || window <= 0 {
+		return nil
+	}
+	return &byteQuota{limit: limit, window: window, usage: make(map[string]*usage)}
+}
+
+func (q *byteQuota) current(key string, now time.Time) *usage {
+	if now.Sub(q.swept) > q.window {
+		for k, u := range q.usage {
+			if now.Sub(u.start) >= q.window {
+				delete(q.usage, k)
+			}
+		}
+		q.swept = now
+	}
+	u, ok := q.usage[key]
+	if !ok || now.Sub(u.start) >= q.window {
+		u = &usage{start: now}
+		q.usage[key] = u
+	}
+	return u
+}
+
+// remaining returns the bytes key may still transfer and when its window
+// resets.
+func (q *byteQuota) remaining(key string, now time.Time) (int64, time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.current(key, now)
+	return max(q.limit-u.used, 0), u.start.Add(q.window)
+}
+
+// add charges n bytes to key and reports whether it stayed within the quota.
+func (q *byteQuota) add(key string, n int64, now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.current(key, now)
+	u.used += n
+	return u.used <= q.limit
+}
+
+// publicLimiter applies the limits of unauthenticated share requests per
+// client IP and per share link.
+type publicLimiter struct {
+	ip, link           *keyedLimiter
+	ipBytes, linkBytes *byteQuota
+
+	mu     sync.Mutex
+	logged map[string]time.Time
+}
+
+// PublicLimit rate limits the public share endpoints and caps the bandwidth
+// they serve. Clients are told their budget through X-RateLimit-* headers and
+// get a 429 with Retry-After once it is spent. Rejections are logged, at most
+// once a minute per client and reason, so abusive IPs can be blocked.
+func PublicLimit(cnf *config.ShareConfig) gin.HandlerFunc {
+	l := &publicLimiter{
+		ip:        newKeyedLimiter(cnf.IpRate, cnf.IpBurst),
+		link:      newKeyedLimiter(cnf.LinkRate, cnf.LinkBurst),
+		ipBytes:   newByteQuota(cnf.IpBandwidth, cnf.BandwidthWindow),
+		linkBytes: newByteQuota(cnf.LinkBandwidth, cnf.BandwidthWindow),
+		logged:    make(map[string]time.Time),
+	}
+	return l.handle
+}
+
+func (l *publicLimiter) handle(c *gin.Context) {
+	now := time.Now()
+	ip := c.ClientIP()
+	link := c.Param("shareID")
+	if link == "" {
+		link = c.Param("slug")
+	}
+
+	var (
+		limit     = -1
+		remaining = math.MaxInt
+		reset     time.Duration
+	)
+	for _, check := range []struct {
+		limiter *keyedLimiter
+		key     string
+		reason  string
+	}{{l.ip, ip, "ip rate"}, {l.link, link, "link rate"}} {
+		if check.limiter == nil || check.key == "" {
+			continue
+		}
+		ok, left, wait := check.limiter.take(check.key, now)
+		if !ok {
+			l.reject(c, ip, link, check.reason, wait, ErrRateLimited, check.limiter.perMinute)
+			return
+		}
+		if left < remaining {
+			limit, remaining = check.limiter.perMinute, left
+			reset = time.Duration(float64(check.limiter.burst-left) / float64(check.limiter.perMinute) * float64(time.Minute))
+		}
+	}
+	if limit >= 0 {
+		setRateHeaders(c, limit, remaining, reset)
+	}
+
+	for _, check := range []struct {
+		quota  *byteQuota
+		key    string
+		reason string
+	}{{l.ipBytes, ip, "ip bandwidth"}, {l.linkBytes, link, "link bandwidth"}} {
+		if check.quota == nil || check.key == "" {
+			continue
+		}
+		if left, resetAt := check.quota.remaining(check.key, now); left == 0 {
+			l.reject(c, ip, link, check.reason, resetAt.Sub(now), ErrBandwidthExceeded, -1)
+			return
+		}
+	}
+
+	if l.ipBytes != nil || l.linkBytes != nil {
+		c.Writer = &meteredWriter{ResponseWriter: c.Writer, charge: func(n int64) bool {
+			now := time.Now()
+			ok := l.ipBytes == nil || l.ipBytes.add(ip, n, now)
+			if l.linkBytes != nil && link != "" {
+				ok = l.linkBytes.add(link, n, now) && ok
+			}
+			return ok
+		}}
+	}
+
+	c.Next()
+}
+
+func (l *publicLimiter) reject(c *gin.Context, ip, link, reason string, wait time.Duration, err error, limit int) {
+	if limit >= 0 {
+		setRateHeaders(c, limit, 0, wait)
+	}
+	c.Header("Retry-After", strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1)))
+
+	if l.shouldLog(reason+":"+ip, time.Now()) {
+		logging.FromContext(c).Warnw("public share limit exceeded", "ip", ip, "share", link,
+			"reason", reason, "path", c.Request.URL.Path, "userAgent", c.Request.UserAgent())
+	}
+
+	httputil.NewError(c, http.StatusTooManyRequests, err)
+}
+
+// shouldLog limits abuse logs to one a minute per key.
+func (l *publicLimiter) shouldLog(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if last, ok := l.logged[key]; ok && now.Sub(last) < time.Minute {
+		return false
+	}
+	for k, t := range l.logged {
+		if now.Sub(t) >= time.Minute {
+			delete(l.logged, k)
+		}
+	}
+	l.logged[key] = now
+	return true
+}
+
+func setRateHeaders(c *gin.Context, limit, remaining int, reset time.Duration) {
+	c.Header("X-RateLimit-Limit", strconv.Itoa(limit))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	c.Header("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+}
+
+// meteredWriter charges written bytes to the bandwidth quotas and fails
+// writes once a quota is spent, which ends the stream.
+type meteredWriter struct {
+	gin.ResponseWriter
+	charge   func(n int64) bool
+	exceeded bool
+}
+
+func (w *meteredWriter) Write(b []byte) (int, error) {
+	if w.exceeded {
+		return 0, ErrBandwidthExceeded
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if !w.charge(int64(n)) {
+		w.exceeded = true
+	}
+	return n, err
+}
+
+func (w *meteredWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *meteredWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
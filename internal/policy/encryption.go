@@ -0,0 +1,120 @@
+// Package policy evaluates operator configured upload rules.
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+type Action string
+
+const (
+	Encrypt Action = "encrypt"
+	Plain   Action = "plain"
+)
+
+const (
+	kindName = "name"
+	kindMime = "mime"
+	kindPath = "path"
+)
+
+// Rule matches a file by name, mime type or parent folder path. Rules are
+// written as "[kind:]pattern=action", e.g. "*.kdbx=encrypt",
+// "mime:application/x-pem-file=encrypt" or "path:/Private/**=encrypt". The
+// kind defaults to name.
+type Rule struct {
+	Kind    string
+	Pattern string
+	Action  Action
+}
+
+func (r Rule) String() string {
+	return fmt.Sprintf("%s:%s=%s", r.Kind, r.Pattern, r.Action)
+}
+
+// Encryption is an ordered rule list; the first matching rule wins.
+type Encryption []Rule
+
+func ParseEncryption(rules []string) (Encryption, error) {
+	policy := make(Encryption, 0, len(rules))
+	for _, raw := range rules {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		idx := strings.LastIndex(raw, "=")
+		if idx <= 0 {
+			return nil, fmt.Errorf("encryption rule %q: missing action", raw)
+		}
+		rule := Rule{Kind: kindName, Pattern: raw[:idx], Action: Action(strings.ToLower(raw[idx+1:]))}
+		if rule.Action != Encrypt && rule.Action != Plain {
+			return nil, fmt.Errorf("encryption rule %q: action must be encrypt or plain", raw)
+		}
+		if kind, pattern, ok := strings.Cut(rule.Pattern, ":"); ok {
+			switch kind {
+			case kindName, kindMime, kindPath:
+				rule.Kind, rule.Pattern = kind, pattern
+			}
+		}
+		if rule.Pattern == "" {
+			return nil, fmt.Errorf("encryption rule %q: empty pattern", raw)
+		}
+		if _, err := path.Match(strings.TrimSuffix(rule.Pattern, "/**"), ""); err != nil {
+			return nil, fmt.Errorf("encryption rule %q: %w", raw, err)
+		}
+		policy = append(policy, rule)
+	}
+	return policy, nil
+}
+
+// HasPathRules reports whether evaluating the policy needs the folder path.
+func (p Encryption) HasPathRules() bool {
+	for _, rule := range p {
+		if rule.Kind == kindPath {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns the first rule matching a file called name with mimeType
+// stored in folder.
+func (p Encryption) Match(name, mimeType, folder string) (Rule, bool) {
+	for _, rule := range p {
+		if rule.matches(name, mimeType, folder) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+func (r Rule) matches(name, mimeType, folder string) bool {
+	switch r.Kind {
+	case kindMime:
+		if mimeType == "" {
+			return false
+		}
+		mimeType, _, _ = strings.Cut(mimeType, ";")
+		ok, _ := path.Match(strings.ToLower(r.Pattern), strings.ToLower(strings.TrimSpace(mimeType)))
+		return ok
+	case kindPath:
+		if folder == "" {
+			return false
+		}
+		folder = path.Clean("/" + folder)
+		if prefix, ok := strings.CutSuffix(r.Pattern, "/**"); ok {
+			prefix = path.Clean("/" + prefix)
+			if folder == prefix || strings.HasPrefix(folder, strings.TrimSuffix(prefix, "/")+"/") {
+				return true
+			}
+			return false
+		}
+		ok, _ := path.Match(path.Clean("/"+r.Pattern), folder)
+		return ok
+	default:
+		ok, _ := path.Match(strings.ToLower(r.Pattern), strings.ToLower(path.Base(name)))
+		return ok
+	}
+}
@@ -0,0 +1,61 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEncryption(t *testing.T) {
+	p, err := ParseEncryption([]string{"*.kdbx=encrypt", "mime:image/*=plain", "path:/Private/**=ENCRYPT", " "})
+	require.NoError(t, err)
+	assert.Equal(t, Encryption{
+		{Kind: "name", Pattern: "*.kdbx", Action: Encrypt},
+		{Kind: "mime", Pattern: "image/*", Action: Plain},
+		{Kind: "path", Pattern: "/Private/**", Action: Encrypt},
+	}, p)
+	assert.True(t, p.HasPathRules())
+
+	for _, bad := range []string{"*.kdbx", "*.kdbx=maybe", "mime:=encrypt", "[=encrypt"} {
+		_, err := ParseEncryption([]string{bad})
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestEncryptionMatch(t *testing.T) {
+	p, err := ParseEncryption([]string{
+		"public.pem=plain",
+		"*.pem=encrypt",
+		"*.KDBX=encrypt",
+		"path:/Private/Media/**=plain",
+		"path:/Private/**=encrypt",
+		"mime:application/pdf=encrypt",
+		"*=plain",
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name, file, mime, folder string
+		want                     Action
+	}{
+		{"earlier rule wins over overlapping glob", "public.pem", "", "/", Plain},
+		{"extension glob", "server.pem", "", "/", Encrypt},
+		{"case insensitive", "vault.kdbx", "", "/", Encrypt},
+		{"nested path exception first", "a.mp4", "video/mp4", "/Private/Media/2024", Plain},
+		{"path prefix", "a.mp4", "video/mp4", "/Private", Encrypt},
+		{"path prefix is segment aware", "a.mp4", "video/mp4", "/PrivateStuff", Plain},
+		{"mime with parameters", "doc", "application/pdf; charset=binary", "/", Encrypt},
+		{"catch all", "a.txt", "text/plain", "/", Plain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, ok := p.Match(tt.file, tt.mime, tt.folder)
+			assert.True(t, ok)
+			assert.Equal(t, tt.want, rule.Action)
+		})
+	}
+
+	_, ok := Encryption{{Kind: "path", Pattern: "/Private/**", Action: Encrypt}}.Match("a", "", "")
+	assert.False(t, ok)
+}
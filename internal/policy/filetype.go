@@ -0,0 +1,152 @@
+package policy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// SniffLength is the number of leading content bytes Sniff looks at.
+const SniffLength = 512
+
+// FileTypes restricts which files may be stored by extension and mime type.
+// Deny lists are checked before allow lists; an empty allow list allows
+// everything that is not denied. Mime entries may use globs like "image/*".
+type FileTypes struct {
+	AllowedExtensions []string `json:"allowedExtensions,omitempty"`
+	DeniedExtensions  []string `json:"deniedExtensions,omitempty"`
+	AllowedMimeTypes  []string `json:"allowedMimeTypes,omitempty"`
+	DeniedMimeTypes   []string `json:"deniedMimeTypes,omitempty"`
+}
+
+// Violation names the file type rule an upload broke.
+type Violation struct {
+	Rule  string `json:"rule"`
+	Value string `json:"value"`
+}
+
+func (v *Violation) Error() string {
+	return fmt.Sprintf("file type not allowed: %s %q", v.Rule, v.Value)
+}
+
+func (v *Violation) Details() any {
+	return v
+}
+
+func (p FileTypes) Validate() error {
+	for _, pattern := range append(append([]string{}, p.AllowedMimeTypes...), p.DeniedMimeTypes...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("mime type pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Check validates a file called name whose declared or sniffed mime types
+// are mimeTypes. Every extension of the name is checked against the deny
+// list so "invoice.exe.pdf" cannot hide an executable, while the allow list
+// looks at the final extension only.
+func (p FileTypes) Check(name string, mimeTypes ...string) *Violation {
+	exts := Extensions(name)
+	for _, ext := range exts {
+		if containsExt(p.DeniedExtensions, ext) {
+			return &Violation{Rule: "deniedExtension", Value: ext}
+		}
+	}
+	if len(p.AllowedExtensions) > 0 {
+		last := ""
+		if len(exts) > 0 {
+			last = exts[len(exts)-1]
+		}
+		if !containsExt(p.AllowedExtensions, last) {
+			return &Violation{Rule: "allowedExtensions", Value: last}
+		}
+	}
+	for _, mimeType := range mimeTypes {
+		mimeType, _, _ = strings.Cut(mimeType, ";")
+		mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+		if mimeType == "" {
+			continue
+		}
+		if matchMime(p.DeniedMimeTypes, mimeType) {
+			return &Violation{Rule: "deniedMimeType", Value: mimeType}
+		}
+		if len(p.AllowedMimeTypes) > 0 && !matchMime(p.AllowedMimeTypes, mimeType) {
+			return &Violation{Rule: "allowedMimeTypes", Value: mimeType}
+		}
+	}
+	return nil
+}
+
+// Extensions returns the lower cased extensions of name in order, e.g.
+// [".tar", ".gz"]. Trailing dots and spaces, which Windows drops when saving,
+// are ignored so "setup.exe. " still yields ".exe".
+func Extensions(name string) []string {
+	name, _, _ = strings.Cut(name, "\x00")
+	name = strings.TrimSuffix(strings.ToLower(name), "::$data")
+	name = strings.TrimRight(path.Base(strings.ReplaceAll(name, `\`, "/")), ". ")
+	parts := strings.Split(name, ".")
+	exts := make([]string, 0, len(parts)-1)
+	for _, part := range parts[1:] {
+		if part = strings.TrimSpace(part); part != "" {
+			exts = append(exts, "."+part)
+		}
+	}
+	return exts
+}
+
+var magicTypes = []struct {
+	magic    []byte
+	mimeType string
+}{
+	{[]byte("MZ"), "application/x-msdownload"},
+	{[]byte("\x7fELF"), "application/x-executable"},
+	{[]byte{0xfe, 0xed, 0xfa, 0xce}, "application/x-mach-binary"},
+	{[]byte{0xfe, 0xed, 0xfa, 0xcf}, "application/x-mach-binary"},
+	{[]byte{0xce, 0xfa, 0xed, 0xfe}, "application/x-mach-binary"},
+	{[]byte{0xcf, 0xfa, 0xed, 0xfe}, "application/x-mach-binary"},
+	{[]byte("#!"), "text/x-shellscript"},
+}
+
+// Sniff detects the mime type of content from its first bytes. Executables
+// and scripts, which http.DetectContentType reports as generic types, are
+// recognised by their magic numbers.
+func Sniff(head []byte) string {
+	for _, m := range magicTypes {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.mimeType
+		}
+	}
+	return http.DetectContentType(head)
+}
+
+func containsExt(list []string, ext string) bool {
+	for _, item := range list {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item != "" && !strings.HasPrefix(item, ".") {
+			item = "." + item
+		}
+		if item == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchMime reports whether mimeType, parameters ignored, matches any of the
+// patterns.
+func MatchMime(patterns []string, mimeType string) bool {
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	return matchMime(patterns, strings.ToLower(strings.TrimSpace(mimeType)))
+}
+
+func matchMime(patterns []string, mimeType string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(strings.TrimSpace(pattern)), mimeType); ok {
+			return true
+		}
+	}
+	return false
+}
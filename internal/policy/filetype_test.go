@@ -0,0 +1,60 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileTypesDeny(t *testing.T) {
+	p := FileTypes{
+		DeniedExtensions: []string{"exe", ".BAT", "sh"},
+		DeniedMimeTypes:  []string{"application/x-msdownload", "text/x-shellscript"},
+	}
+
+	tests := []struct {
+		name, file, mime string
+		want             *Violation
+	}{
+		{"allowed", "report.pdf", "application/pdf", nil},
+		{"denied", "setup.exe", "", &Violation{Rule: "deniedExtension", Value: ".exe"}},
+		{"upper case", "SETUP.EXE", "", &Violation{Rule: "deniedExtension", Value: ".exe"}},
+		{"double extension", "invoice.exe.pdf", "", &Violation{Rule: "deniedExtension", Value: ".exe"}},
+		{"appended extension", "photo.jpg.bat", "", &Violation{Rule: "deniedExtension", Value: ".bat"}},
+		{"trailing dot", "setup.exe.", "", &Violation{Rule: "deniedExtension", Value: ".exe"}},
+		{"trailing space", "setup.exe ", "", &Violation{Rule: "deniedExtension", Value: ".exe"}},
+		{"null byte", "setup.exe\x00.pdf", "", &Violation{Rule: "deniedExtension", Value: ".exe"}},
+		{"alternate stream", "setup.exe::$DATA", "", &Violation{Rule: "deniedExtension", Value: ".exe"}},
+		{"renamed executable", "notes.txt", "application/x-msdownload", &Violation{Rule: "deniedMimeType", Value: "application/x-msdownload"}},
+		{"mime params", "run", "Text/X-Shellscript; charset=utf-8", &Violation{Rule: "deniedMimeType", Value: "text/x-shellscript"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, p.Check(tt.file, tt.mime))
+		})
+	}
+}
+
+func TestFileTypesAllow(t *testing.T) {
+	p := FileTypes{AllowedExtensions: []string{"jpg", "png"}, AllowedMimeTypes: []string{"image/*"}}
+
+	assert.Nil(t, p.Check("cat.JPG", "image/jpeg"))
+	assert.Equal(t, &Violation{Rule: "allowedExtensions", Value: ".exe"}, p.Check("cat.jpg.exe", ""))
+	assert.Equal(t, &Violation{Rule: "allowedExtensions", Value: ""}, p.Check("cat", ""))
+	assert.Equal(t, &Violation{Rule: "allowedMimeTypes", Value: "application/x-msdownload"},
+		p.Check("cat.jpg", "image/jpeg", "application/x-msdownload"))
+}
+
+func TestSniff(t *testing.T) {
+	assert.Equal(t, "application/x-msdownload", Sniff([]byte("MZ\x90\x00")))
+	assert.Equal(t, "application/x-executable", Sniff([]byte("\x7fELF\x02\x01")))
+	assert.Equal(t, "application/x-mach-binary", Sniff([]byte{0xcf, 0xfa, 0xed, 0xfe, 0x07}))
+	assert.Equal(t, "text/x-shellscript", Sniff([]byte("#!/bin/sh\nrm -rf /\n")))
+	assert.Equal(t, "image/png", Sniff([]byte("\x89PNG\r\n\x1a\n")))
+}
+
+func TestFileTypesValidate(t *testing.T) {
+	require.NoError(t, FileTypes{AllowedMimeTypes: []string{"image/*"}}.Validate())
+	assert.Error(t, FileTypes{DeniedMimeTypes: []string{"["}}.Validate())
+}
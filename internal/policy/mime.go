@@ -0,0 +1,97 @@
+package policy
+
+import (
+	"fmt"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+const genericMimeType = "application/octet-stream"
+
+// MimeTypes maps lower case extensions, with their dot, to the mime type of
+// files named with them. Entries take precedence over the system table.
+type MimeTypes map[string]string
+
+// ParseMimeTypes parses "ext=mime/type" entries, e.g. "mkv=video/x-matroska".
+func ParseMimeTypes(entries []string) (MimeTypes, error) {
+	types := MimeTypes{}
+	for _, raw := range entries {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		ext, mimeType, ok := strings.Cut(raw, "=")
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		mimeType = strings.TrimSpace(mimeType)
+		if !ok || ext == "" || ext == "." {
+			return nil, fmt.Errorf("mime type %q: expected ext=mime/type", raw)
+		}
+		if _, _, err := mime.ParseMediaType(mimeType); err != nil || !strings.Contains(mimeType, "/") {
+			return nil, fmt.Errorf("mime type %q: invalid mime type", raw)
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		types[ext] = mimeType
+	}
+	return types, nil
+}
+
+// ByExtension returns the mime type of a file called name from its extension,
+// empty when the extension is unknown.
+func (m MimeTypes) ByExtension(name string) string {
+	ext := strings.ToLower(filepath.Ext(strings.TrimSpace(name)))
+	if ext == "" {
+		return ""
+	}
+	if mimeType, ok := m[ext]; ok {
+		return mimeType
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// IsGeneric reports whether a mime type says nothing about the content.
+func IsGeneric(mimeType string) bool {
+	switch mediaType(mimeType) {
+	case "", genericMimeType, "binary/octet-stream", "application/unknown":
+		return true
+	}
+	return false
+}
+
+func mediaType(mimeType string) string {
+	if parsed, _, err := mime.ParseMediaType(mimeType); err == nil {
+		return parsed
+	}
+	return strings.ToLower(strings.TrimSpace(mimeType))
+}
+
+// Detect settles the mime type of a file called name. A valid declared type
+// wins, otherwise the extension decides unless the sniffed content is of a
+// different kind altogether, e.g. an executable named like an image. Plain
+// text is what content without a signature sniffs as, so it never overrides
+// the extension.
+func (m MimeTypes) Detect(declared, name, sniffed string) string {
+	if !IsGeneric(declared) {
+		if _, _, err := mime.ParseMediaType(declared); err == nil && strings.Contains(declared, "/") {
+			return declared
+		}
+	}
+	byExt := m.ByExtension(name)
+	specific := !IsGeneric(sniffed) && mediaType(sniffed) != "text/plain"
+	switch {
+	case byExt != "" && specific && topLevel(byExt) != topLevel(sniffed):
+		return sniffed
+	case byExt != "":
+		return byExt
+	case !IsGeneric(sniffed):
+		return sniffed
+	}
+	return genericMimeType
+}
+
+func topLevel(mimeType string) string {
+	top, _, _ := strings.Cut(mediaType(mimeType), "/")
+	return top
+}
@@ -0,0 +1,45 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMimeTypes(t *testing.T) {
+	types, err := ParseMimeTypes([]string{"mkv=video/x-matroska", ".Nfo = text/plain", ""})
+	require.NoError(t, err)
+	assert.Equal(t, MimeTypes{".mkv": "video/x-matroska", ".nfo": "text/plain"}, types)
+
+	for _, entry := range []string{"mkv", "=video/mp4", "mkv=video", "mkv=not a type"} {
+		_, err := ParseMimeTypes([]string{entry})
+		assert.Error(t, err, entry)
+	}
+}
+
+func TestDetectMimeType(t *testing.T) {
+	types := MimeTypes{".mkv": "video/x-matroska", ".jpg": "image/jpeg"}
+
+	tests := []struct {
+		name, declared, file, sniffed, want string
+	}{
+		{"declared wins", "video/mp4", "clip.mkv", "", "video/mp4"},
+		{"invalid declared", "not a type", "clip.mkv", "", "video/x-matroska"},
+		{"generic declared", "application/octet-stream", "clip.mkv", "", "video/x-matroska"},
+		{"custom extension", "", "CLIP.MKV", "video/webm", "video/x-matroska"},
+		{"system extension", "", "report.pdf", "", "application/pdf"},
+		{"same kind keeps extension", "", "photo.jpg", "image/png", "image/jpeg"},
+		{"executable named as image", "", "photo.jpg", "application/x-msdownload", "application/x-msdownload"},
+		{"script named as video", "", "clip.mkv", "text/x-shellscript", "text/x-shellscript"},
+		{"text does not override", "", "data.pdf", "text/plain; charset=utf-8", "application/pdf"},
+		{"no extension uses content", "", "README", "text/plain; charset=utf-8", "text/plain; charset=utf-8"},
+		{"nothing known", "", "blob", "", "application/octet-stream"},
+		{"generic sniff", "", "blob", "application/octet-stream", "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, types.Detect(tt.declared, tt.file, tt.sniffed))
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package reader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+)
+
+// prefetched is a part opened ahead of time with its first bytes buffered.
+type prefetched struct {
+	done   chan struct{}
+	reader io.ReadCloser
+	err    error
+}
+
+func (p *prefetched) discard() {
+	<-p.done
+	if p.reader != nil {
+		p.reader.Close()
+	}
+}
+
+// readAhead opens the parts following the one being read in the background
+// and buffers up to size bytes of each, so reading crosses part boundaries
+// without waiting for the next part to be located and fetched. At most window
+// parts are prefetched, which bounds the memory held to window*size bytes.
+// Prefetches stop when ctx is done.
+type readAhead struct {
+	ctx    context.Context
+	open   func(pos int) (io.ReadCloser, error)
+	total  int
+	window int
+	size   int64
+	parts  map[int]*prefetched
+}
+
+func newReadAhead(ctx context.Context, total, window int, size int64, open func(pos int) (io.ReadCloser, error)) *readAhead {
+	return &readAhead{ctx: ctx, open: open, total: total, window: window, size: size, parts: map[int]*prefetched{}}
+}
+
+// next returns the reader of the part at pos and starts prefetching the parts
+// after it.
+func (a *readAhead) next(pos int) (io.ReadCloser, error) {
+	for i := pos + 1; i <= pos+a.window && i < a.total; i++ {
+		if _, ok := a.parts[i]; !ok {
+			a.parts[i] = a.prefetch(i)
+		}
+	}
+
+	p, ok := a.parts[pos]
+	if !ok {
+		return a.open(pos)
+	}
+	delete(a.parts, pos)
+	select {
+	case <-p.done:
+		return p.reader, p.err
+	case <-a.ctx.Done():
+		go p.discard()
+		return nil, a.ctx.Err()
+	}
+}
+
+func (a *readAhead) prefetch(pos int) *prefetched {
+	p := &prefetched{done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		reader, err := a.open(pos)
+		if err != nil {
+			p.err = err
+			return
+		}
+		buf := make([]byte, a.size)
+		n, err := io.ReadFull(reader, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			reader.Close()
+			p.err = err
+			return
+		}
+		p.reader = &partReader{
+			Reader:  io.MultiReader(bytes.NewReader(buf[:n]), reader),
+			closers: []io.Closer{reader},
+		}
+	}()
+	return p
+}
+
+// close releases the parts prefetched but never read.
+func (a *readAhead) close() {
+	for pos, p := range a.parts {
+		delete(a.parts, pos)
+		go p.discard()
+	}
+}
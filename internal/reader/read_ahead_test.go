@@ -0,0 +1,110 @@
+package reader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// slowParts serves parts of size bytes that take delay to open, like a part
+// whose location has to be looked up in Telegram.
+type slowParts struct {
+	size   int
+	delay  time.Duration
+	opened atomic.Int32
+}
+
+func (s *slowParts) open(ctx context.Context) func(pos int) (io.ReadCloser, error) {
+	return func(pos int) (io.ReadCloser, error) {
+		select {
+		case <-time.After(s.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		s.opened.Add(1)
+		return io.NopCloser(bytes.NewReader(bytes.Repeat([]byte{byte(pos)}, s.size))), nil
+	}
+}
+
+func readParts(a *readAhead, total int, perPart time.Duration) ([]byte, error) {
+	var out bytes.Buffer
+	for pos := 0; pos < total; pos++ {
+		r, err := a.next(pos)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(&out, r); err != nil {
+			return nil, err
+		}
+		r.Close()
+		// Playback consumes the part before it needs the next one.
+		time.Sleep(perPart)
+	}
+	return out.Bytes(), nil
+}
+
+func TestReadAhead(t *testing.T) {
+	for _, window := range []int{0, 1, 3} {
+		parts := &slowParts{size: 10}
+		a := newReadAhead(context.Background(), 5, window, 4, parts.open(context.Background()))
+		data, err := readParts(a, 5, 0)
+		assert.NoError(t, err)
+		assert.Len(t, data, 50)
+		for pos := 0; pos < 5; pos++ {
+			assert.Equal(t, bytes.Repeat([]byte{byte(pos)}, 10), data[pos*10:(pos+1)*10])
+		}
+		assert.Equal(t, int32(5), parts.opened.Load())
+	}
+}
+
+func TestReadAheadRemovesStall(t *testing.T) {
+	parts := &slowParts{size: 10, delay: 50 * time.Millisecond}
+	a := newReadAhead(context.Background(), 4, 1, 4, parts.open(context.Background()))
+
+	_, err := a.next(0)
+	assert.NoError(t, err)
+	time.Sleep(80 * time.Millisecond)
+
+	start := time.Now()
+	_, err = a.next(1)
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), 25*time.Millisecond)
+}
+
+func TestReadAheadCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	parts := &slowParts{size: 10, delay: time.Second}
+	a := newReadAhead(ctx, 4, 2, 4, parts.open(ctx))
+
+	a.parts[0] = a.prefetch(0)
+	cancel()
+	_, err := a.next(0)
+	assert.True(t, errors.Is(err, context.Canceled))
+	a.close()
+	assert.Empty(t, a.parts)
+}
+
+// BenchmarkReadAhead compares streaming parts opened on demand with parts
+// opened while the previous one is played.
+func BenchmarkReadAhead(b *testing.B) {
+	for _, bench := range []struct {
+		name   string
+		window int
+	}{{"on-demand", 0}, {"read-ahead", 1}} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				parts := &slowParts{size: 1024, delay: 2 * time.Millisecond}
+				a := newReadAhead(context.Background(), 8, bench.window, 1024, parts.open(context.Background()))
+				if _, err := readParts(a, 8, 2*time.Millisecond); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/gotd/td/tg"
 	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/compress"
 	"github.com/tgdrive/teldrive/internal/config"
 	"github.com/tgdrive/teldrive/internal/crypt"
 	"github.com/tgdrive/teldrive/pkg/schemas"
@@ -18,8 +19,13 @@ type Range struct {
 	PartNo     int64
 }
 
+// KeyFunc returns the encryption key of a key version.
+type KeyFunc func(version int) (string, error)
+
 type LinearReader struct {
 	ctx         context.Context
+	cancel      context.CancelFunc
+	ahead       *readAhead
 	file        *schemas.FileOutFull
 	parts       []types.Part
 	ranges      []Range
@@ -27,6 +33,7 @@ type LinearReader struct {
 	reader      io.ReadCloser
 	remaining   int64
 	config      *config.TGConfig
+	keys        KeyFunc
 	client      *tg.Client
 	concurrency int
 	cache       cache.Cacher
@@ -57,22 +64,29 @@ func NewLinearReader(ctx context.Context,
 	start,
 	end int64,
 	config *config.TGConfig,
+	keys KeyFunc,
 	concurrency int,
 ) (io.ReadCloser, error) {
 
+	ctx, cancel := context.WithCancel(ctx)
+
 	r := &LinearReader{
 		ctx:         ctx,
+		cancel:      cancel,
 		parts:       parts,
 		file:        file,
 		remaining:   end - start + 1,
-		ranges:      calculatePartByteRanges(start, end, parts[0].Size),
+		ranges:      calculatePartByteRanges(start, end, LogicalPartSize(parts[0], file.Encrypted)),
 		config:      config,
+		keys:        keys,
 		client:      client,
 		concurrency: concurrency,
 		cache:       cache,
 	}
+	r.ahead = newReadAhead(ctx, len(r.ranges), config.Stream.ReadAhead, config.Stream.ReadAheadSize, r.getPartReader)
 
 	if err := r.initializeReader(); err != nil {
+		r.Close()
 		return nil, err
 	}
 	return r, nil
@@ -97,6 +111,8 @@ func (r *LinearReader) Read(p []byte) (int, error) {
 }
 
 func (r *LinearReader) Close() error {
+	r.cancel()
+	r.ahead.close()
 	if r.reader != nil {
 		err := r.reader.Close()
 		r.reader = nil
@@ -106,7 +122,7 @@ func (r *LinearReader) Close() error {
 }
 
 func (r *LinearReader) initializeReader() error {
-	reader, err := r.getPartReader()
+	reader, err := r.ahead.next(r.pos)
 	if err != nil {
 		return err
 	}
@@ -123,13 +139,79 @@ func (r *LinearReader) moveToNextPart() error {
 	return io.EOF
 }
 
-func (r *LinearReader) getPartReader() (io.ReadCloser, error) {
-	currentRange := r.ranges[r.pos]
+// LogicalPartSize returns the number of bytes a part contributes to the file
+// as seen by clients.
+func LogicalPartSize(part types.Part, encrypted bool) int64 {
+	if part.Compression != "" {
+		return part.OriginalSize
+	}
+	if encrypted {
+		return part.DecryptedSize
+	}
+	return part.Size
+}
+
+func (r *LinearReader) getPartReader(pos int) (io.ReadCloser, error) {
+	currentRange := r.ranges[pos]
+	part := r.parts[currentRange.PartNo]
+
+	if part.Compression == "" {
+		return r.getStoredReader(pos, currentRange.Start, currentRange.End)
+	}
+
+	// Compressed parts can't be seeked into, so the part is decompressed from
+	// its beginning and the bytes before the requested range are discarded.
+	storedSize := part.Size
+	if r.file.Encrypted {
+		storedSize = part.DecryptedSize
+	}
+
+	stored, err := r.getStoredReader(pos, 0, storedSize-1)
+	if err != nil {
+		return nil, err
+	}
+
+	decompressed, err := compress.NewReader(part.Compression, stored)
+	if err != nil {
+		stored.Close()
+		return nil, err
+	}
+
+	if _, err := io.CopyN(io.Discard, decompressed, currentRange.Start); err != nil {
+		decompressed.Close()
+		stored.Close()
+		return nil, err
+	}
+
+	return &partReader{
+		Reader:  io.LimitReader(decompressed, currentRange.End-currentRange.Start+1),
+		closers: []io.Closer{decompressed, stored},
+	}, nil
+}
+
+type partReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (p *partReader) Close() error {
+	var err error
+	for _, c := range p.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (r *LinearReader) getStoredReader(pos int, start, end int64) (io.ReadCloser, error) {
+	currentRange := r.ranges[pos]
 	partID := r.parts[currentRange.PartNo].ID
 
 	chunkSrc := &chunkSource{
 		channelID:   *r.file.ChannelID,
 		partID:      partID,
+		replicas:    r.parts[currentRange.PartNo].Replicas,
 		client:      r.client,
 		concurrency: r.concurrency,
 		cache:       r.cache,
@@ -141,16 +223,23 @@ func (r *LinearReader) getPartReader() (io.ReadCloser, error) {
 		err    error
 	)
 	if r.file.Encrypted {
-		salt := r.parts[r.ranges[r.pos].PartNo].Salt
-		cipher, _ := crypt.NewCipher(r.config.Uploads.EncryptionKey, salt)
+		// The cipher works on independent 64KB blocks with a counter nonce, so
+		// only the blocks covering the requested range are fetched and a
+		// single block is buffered while decrypting.
+		part := r.parts[currentRange.PartNo]
+		var key string
+		if key, err = r.keys(part.KeyVersion); err != nil {
+			return nil, err
+		}
+		cipher, _ := crypt.NewCipher(key, part.Salt)
 		reader, err = cipher.DecryptDataSeek(r.ctx,
 			func(ctx context.Context,
 				underlyingOffset,
 				underlyingLimit int64) (io.ReadCloser, error) {
-				var end int64
+				end := part.Size - 1
 
 				if underlyingLimit >= 0 {
-					end = min(r.parts[r.ranges[r.pos].PartNo].Size-1, underlyingOffset+underlyingLimit-1)
+					end = min(end, underlyingOffset+underlyingLimit-1)
 				}
 
 				if r.concurrency < 2 {
@@ -158,13 +247,13 @@ func (r *LinearReader) getPartReader() (io.ReadCloser, error) {
 				}
 				return newTGMultiReader(r.ctx, underlyingOffset, end, r.config, chunkSrc)
 
-			}, currentRange.Start, currentRange.End-currentRange.Start+1)
+			}, start, end-start+1)
 
 	} else {
 		if r.concurrency < 2 {
-			reader, err = newTGReader(r.ctx, currentRange.Start, currentRange.End, chunkSrc)
+			reader, err = newTGReader(r.ctx, start, end, chunkSrc)
 		} else {
-			reader, err = newTGMultiReader(r.ctx, currentRange.Start, currentRange.End, r.config, chunkSrc)
+			reader, err = newTGMultiReader(r.ctx, start, end, r.config, chunkSrc)
 		}
 
 	}
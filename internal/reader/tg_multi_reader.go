@@ -11,6 +11,7 @@ import (
 	"github.com/tgdrive/teldrive/internal/cache"
 	"github.com/tgdrive/teldrive/internal/config"
 	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/schemas"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -27,6 +28,7 @@ type ChunkSource interface {
 type chunkSource struct {
 	channelID   int64
 	partID      int64
+	replicas    []schemas.Replica
 	concurrency int
 	client      *tg.Client
 	key         string
@@ -46,7 +48,7 @@ func (c *chunkSource) Chunk(ctx context.Context, offset int64, limit int64) ([]b
 	err = c.cache.Get(c.key, location)
 
 	if err != nil {
-		location, err = tgc.GetLocation(ctx, c.client, c.channelID, c.partID)
+		location, err = c.location(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -57,6 +59,19 @@ func (c *chunkSource) Chunk(ctx context.Context, offset int64, limit int64) ([]b
 
 }
 
+// location looks the part up in its channel and falls back to its replicas
+// when the primary message cannot be read.
+func (c *chunkSource) location(ctx context.Context) (*tg.InputDocumentFileLocation, error) {
+	location, err := tgc.GetLocation(ctx, c.client, c.channelID, c.partID)
+	for _, replica := range c.replicas {
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		location, err = tgc.GetLocation(ctx, c.client, replica.ChannelID, replica.ID)
+	}
+	return location, err
+}
+
 type tgMultiReader struct {
 	ctx         context.Context
 	cancel      context.CancelFunc
@@ -45,11 +45,10 @@ type TestSuite struct {
 }
 
 func (suite *TestSuite) SetupTest() {
-	suite.config = &config.TGConfig{Stream: struct {
-		MultiThreads int
-		Buffers      int
-		ChunkTimeout time.Duration
-	}{MultiThreads: 8, Buffers: 10, ChunkTimeout: 1 * time.Second}}
+	suite.config = &config.TGConfig{}
+	suite.config.Stream.MultiThreads = 8
+	suite.config.Stream.Buffers = 10
+	suite.config.Stream.ChunkTimeout = 1 * time.Second
 }
 
 func (suite *TestSuite) TestFullRead() {
@@ -3,6 +3,8 @@ package retry
 import (
 	"context"
 	"fmt"
+	"slices"
+	"time"
 
 	"github.com/go-faster/errors"
 	"github.com/gotd/td/bin"
@@ -23,11 +25,37 @@ var internalErrors = []string{
 	"STORAGE_CHOOSE_VOLUME_FAILED",
 }
 
+// Policy bounds the attempts of a request. Backoff doubles after every
+// attempt up to MaxBackoff and Timeout limits each attempt, zero disables
+// either.
+type Policy struct {
+	MaxRetries int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Timeout    time.Duration
+}
+
 type retry struct {
-	max    int
+	policy Policy
 	errors []string
 }
 
+// retryingKey marks requests an outer retry middleware is already handling,
+// so retries of client wide middlewares do not multiply those of a call.
+type retryingKey struct{}
+
+// TransientErrors lists the errors retried besides those given to New and
+// timed out attempts.
+func TransientErrors() []string {
+	return slices.Clone(internalErrors)
+}
+
+// Transient reports whether err is one of the internal errors Telegram fails
+// requests with that succeed when sent again.
+func Transient(err error) bool {
+	return tgerr.Is(err, internalErrors...) || isErrorMatch(err)
+}
+
 func isErrorMatch(err error) bool {
 	for _, internalError := range internalErrors {
 		if errors.Is(err, errors.New(internalError)) {
@@ -37,29 +65,84 @@ func isErrorMatch(err error) bool {
 	return false
 }
 
+// Idempotent reports whether a request may be sent again after it failed
+// without knowing whether Telegram executed it. Messages carry a random id
+// Telegram deduplicates, requests that create something or send a login code
+// do not.
+func Idempotent(input bin.Encoder) bool {
+	switch input.(type) {
+	case *tg.ChannelsCreateChannelRequest, *tg.MessagesCreateChatRequest, *tg.AuthSendCodeRequest,
+		*tg.AuthSignInRequest, *tg.AuthCheckPasswordRequest:
+		return false
+	}
+	return true
+}
+
+func (r retry) transient(ctx context.Context, err error) bool {
+	if tgerr.Is(err, r.errors...) || isErrorMatch(err) {
+		return true
+	}
+	// An attempt that ran out of its own time, not of the caller's.
+	return errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil
+}
+
+func (r retry) invoke(ctx context.Context, next tg.Invoker, input bin.Encoder, output bin.Decoder) error {
+	if r.policy.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.policy.Timeout)
+		defer cancel()
+	}
+	return next.Invoke(ctx, input, output)
+}
+
 func (r retry) Handle(next tg.Invoker) telegram.InvokeFunc {
 	return func(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
-		retries := 0
+		if ctx.Value(retryingKey{}) != nil {
+			return next.Invoke(ctx, input, output)
+		}
+		ctx = context.WithValue(ctx, retryingKey{}, struct{}{})
 
-		for retries < r.max {
-			if err := next.Invoke(ctx, input, output); err != nil {
-				if tgerr.Is(err, r.errors...) || isErrorMatch(err) {
-					retries++
-					continue
-				}
+		attempts := max(r.policy.MaxRetries, 1)
+		delay := r.policy.Backoff
+
+		for attempt := 1; ; attempt++ {
+			err := r.invoke(ctx, next, input, output)
+			if err == nil {
+				return nil
+			}
+			if !r.transient(ctx, err) || !Idempotent(input) {
 				return errors.Wrap(err, "retry middleware skip")
 			}
-
-			return nil
+			if attempt >= attempts {
+				return fmt.Errorf("retry limit reached after %d attempts: %w", attempts, err)
+			}
+			if delay > 0 {
+				timer := time.NewTimer(delay)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				case <-timer.C:
+				}
+				delay *= 2
+				if r.policy.MaxBackoff > 0 {
+					delay = min(delay, r.policy.MaxBackoff)
+				}
+			}
 		}
-
-		return fmt.Errorf("retry limit reached after %d attempts", r.max)
 	}
 }
 
+// New retries requests failing with one of errors or a transient internal
+// error up to max attempts in a row.
 func New(max int, errors ...string) telegram.Middleware {
+	return NewPolicy(Policy{MaxRetries: max}, errors...)
+}
+
+// NewPolicy retries like New with the attempts, backoff and timeout of policy.
+func NewPolicy(policy Policy, errors ...string) telegram.Middleware {
 	return retry{
-		max:    max,
+		policy: policy,
 		errors: append(errors, internalErrors...),
 	}
 }
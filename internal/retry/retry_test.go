@@ -0,0 +1,66 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"github.com/stretchr/testify/assert"
+)
+
+func failing(calls *int, err error) telegram.InvokeFunc {
+	return func(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+		*calls++
+		return err
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	transient := tgerr.New(500, "RPC_CALL_FAIL")
+	input := &tg.MessagesGetMessagesRequest{}
+
+	calls := 0
+	mw := NewPolicy(Policy{MaxRetries: 3, Backoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond})
+	start := time.Now()
+	err := mw.Handle(failing(&calls, transient)).Invoke(context.Background(), input, nil)
+	assert.ErrorIs(t, err, transient)
+	assert.Equal(t, 3, calls)
+	assert.GreaterOrEqual(t, time.Since(start), 3*time.Millisecond)
+
+	calls = 0
+	err = mw.Handle(failing(&calls, errors.New("FILE_REFERENCE_EXPIRED"))).Invoke(context.Background(), input, nil)
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+
+	calls = 0
+	err = mw.Handle(failing(&calls, transient)).Invoke(context.Background(), &tg.ChannelsCreateChannelRequest{}, nil)
+	assert.ErrorIs(t, err, transient)
+	assert.Equal(t, 1, calls)
+}
+
+func TestRetryNested(t *testing.T) {
+	calls := 0
+	inner := New(3).Handle(failing(&calls, tgerr.New(500, "RPC_CALL_FAIL")))
+	New(2).Handle(inner).Invoke(context.Background(), &tg.MessagesGetMessagesRequest{}, nil)
+	assert.Equal(t, 2, calls)
+}
+
+func TestRetryAttemptTimeout(t *testing.T) {
+	calls := 0
+	slow := telegram.InvokeFunc(func(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+		calls++
+		if calls == 1 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	mw := NewPolicy(Policy{MaxRetries: 2, Timeout: 10 * time.Millisecond})
+	assert.NoError(t, mw.Handle(slow).Invoke(context.Background(), &tg.MessagesGetMessagesRequest{}, nil))
+	assert.Equal(t, 2, calls)
+}
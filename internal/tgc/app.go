@@ -0,0 +1,71 @@
+package tgc
+
+import (
+	"encoding/hex"
+
+	"github.com/gotd/td/tgerr"
+	"github.com/pkg/errors"
+	"github.com/tgdrive/teldrive/internal/config"
+)
+
+var (
+	ErrInvalidAppCredentials = errors.New("appId and appHash must be set together and appHash must be 32 hex characters")
+	ErrAppRejected           = errors.New("telegram rejected the app credentials")
+)
+
+// AppCredentials is a Telegram app identity registered by a user or bot,
+// used in place of the configured app id and hash.
+type AppCredentials struct {
+	AppId   int
+	AppHash string
+}
+
+func (a *AppCredentials) Validate() error {
+	if a.AppId <= 0 || len(a.AppHash) != 32 {
+		return ErrInvalidAppCredentials
+	}
+	if _, err := hex.DecodeString(a.AppHash); err != nil {
+		return ErrInvalidAppCredentials
+	}
+	return nil
+}
+
+// NewAppCredentials returns the credentials of an optional id and hash pair,
+// nil when both are absent.
+func NewAppCredentials(appId *int, appHash *string) (*AppCredentials, error) {
+	if appId == nil && appHash == nil {
+		return nil, nil
+	}
+	if appId == nil || appHash == nil {
+		return nil, ErrInvalidAppCredentials
+	}
+	creds := &AppCredentials{AppId: *appId, AppHash: *appHash}
+	if err := creds.Validate(); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// WithApp returns config with the app identity of creds, or config itself
+// when creds is nil.
+func WithApp(config *config.TGConfig, creds *AppCredentials) *config.TGConfig {
+	if creds == nil {
+		return config
+	}
+	c := *config
+	c.AppId, c.AppHash = creds.AppId, creds.AppHash
+	return &c
+}
+
+// CredentialStore looks up the app identity stored with a session or bot. A
+// nil result means the configured one is used.
+type CredentialStore interface {
+	Session(session string) *AppCredentials
+	Bot(token string) *AppCredentials
+}
+
+// IsAppRejected reports whether Telegram refused the app id and hash a client
+// was built with.
+func IsAppRejected(err error) bool {
+	return tgerr.Is(err, "API_ID_INVALID", "API_ID_PUBLISHED_FLOOD")
+}
@@ -0,0 +1,127 @@
+package tgc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"golang.org/x/sync/singleflight"
+)
+
+// ChannelCacheTTL bounds how long a resolved access hash is reused before the
+// channel is looked up again.
+const ChannelCacheTTL = 24 * time.Hour
+
+type channelAccountKey struct{}
+
+// channelAccount is the account channel lookups of a context are made as.
+type channelAccount struct {
+	cache   cache.Cacher
+	account string
+}
+
+var channelGroup singleflight.Group
+
+// WithChannelCache makes the channel lookups made with ctx go through cache.
+// Access hashes are only valid for the account that resolved them, so every
+// user session and bot keeps its own entries.
+func WithChannelCache(ctx context.Context, cache cache.Cacher, account string) context.Context {
+	return context.WithValue(ctx, channelAccountKey{}, &channelAccount{cache: cache, account: account})
+}
+
+func channelCacheKey(account string, channelId int64) string {
+	return fmt.Sprintf("channels:access:%s:%d", account, channelId)
+}
+
+// InvalidChannel reports whether Telegram refused the access hash of a
+// channel, e.g. because it went stale.
+func InvalidChannel(err error) bool {
+	return tgerr.Is(err, "CHANNEL_INVALID", "CHANNEL_PRIVATE")
+}
+
+// cachedChannel returns the channel from the cache of ctx, resolving it on a
+// miss once for all concurrent callers. cached reports whether the hash was
+// taken from the cache.
+func cachedChannel(ctx context.Context, channelId int64,
+	resolve func(ctx context.Context) (*tg.InputChannel, error)) (channel *tg.InputChannel, cached bool, err error) {
+	acc, ok := ctx.Value(channelAccountKey{}).(*channelAccount)
+	if !ok {
+		channel, err = resolve(ctx)
+		return channel, false, err
+	}
+
+	key := channelCacheKey(acc.account, channelId)
+
+	var stored tg.InputChannel
+	if err := acc.cache.Get(key, &stored); err == nil && stored.ChannelID == channelId {
+		return &stored, true, nil
+	}
+
+	res, err, _ := channelGroup.Do(key, func() (any, error) {
+		channel, err := resolve(ctx)
+		if err != nil {
+			return nil, err
+		}
+		acc.cache.Set(key, channel, ChannelCacheTTL)
+		return channel, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return res.(*tg.InputChannel), false, nil
+}
+
+// forgetChannel drops the cached channel of the account of ctx.
+func forgetChannel(ctx context.Context, channelId int64) {
+	if acc, ok := ctx.Value(channelAccountKey{}).(*channelAccount); ok {
+		acc.cache.Delete(channelCacheKey(acc.account, channelId))
+	}
+}
+
+// withChannel runs fn with the input peer of channelId. When Telegram refuses
+// a cached access hash the entry is dropped, the channel resolved again and fn
+// retried once.
+func withChannel(ctx context.Context, channelId int64, resolve func(ctx context.Context) (*tg.InputChannel, error),
+	fn func(channel *tg.InputChannel) error) error {
+	channel, cached, err := cachedChannel(ctx, channelId, resolve)
+	if err != nil {
+		return err
+	}
+	err = fn(channel)
+	if !cached || !InvalidChannel(err) {
+		return err
+	}
+	forgetChannel(ctx, channelId)
+	if channel, _, err = cachedChannel(ctx, channelId, resolve); err != nil {
+		return err
+	}
+	return fn(channel)
+}
+
+func resolveChannel(client *tg.Client, channelId int64) func(ctx context.Context) (*tg.InputChannel, error) {
+	return func(ctx context.Context) (*tg.InputChannel, error) {
+		channels, err := client.ChannelsGetChannels(ctx, []tg.InputChannelClass{&tg.InputChannel{ChannelID: channelId}})
+		if err != nil {
+			return nil, err
+		}
+		if len(channels.GetChats()) == 0 {
+			return nil, ErrInValidChannelID
+		}
+		return channels.GetChats()[0].(*tg.Channel).AsInput(), nil
+	}
+}
+
+// WithChannel runs fn with the input peer of channelId as resolved by client,
+// refreshing a stale cached access hash once.
+func WithChannel(ctx context.Context, client *tg.Client, channelId int64, fn func(channel *tg.InputChannel) error) error {
+	return withChannel(ctx, channelId, resolveChannel(client, channelId), fn)
+}
+
+// ForgetChannel drops the access hash of channelId cached for the account of
+// ctx, so the next lookup resolves it again.
+func ForgetChannel(ctx context.Context, channelId int64) {
+	forgetChannel(ctx, channelId)
+}
@@ -0,0 +1,96 @@
+package tgc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/internal/cache"
+)
+
+func TestWithChannelRefreshesStaleHash(t *testing.T) {
+	ctx := WithChannelCache(context.Background(), cache.NewMemoryCache(1024*1024), "bot:1")
+
+	hash, resolves := int64(1), 0
+	resolve := func(ctx context.Context) (*tg.InputChannel, error) {
+		resolves++
+		return &tg.InputChannel{ChannelID: 100, AccessHash: hash}, nil
+	}
+
+	assert.NoError(t, withChannel(ctx, 100, resolve, func(channel *tg.InputChannel) error { return nil }))
+
+	// The hash went stale: the cached one is refused, refreshed and retried.
+	hash = 2
+	var used []int64
+	err := withChannel(ctx, 100, resolve, func(channel *tg.InputChannel) error {
+		used = append(used, channel.AccessHash)
+		if channel.AccessHash != hash {
+			return tgerr.New(400, "CHANNEL_INVALID")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1, 2}, used)
+	assert.Equal(t, 2, resolves)
+
+	channel, cached, err := cachedChannel(ctx, 100, resolve)
+	assert.NoError(t, err)
+	assert.True(t, cached)
+	assert.Equal(t, int64(2), channel.AccessHash)
+}
+
+func TestWithChannelRetriesOnce(t *testing.T) {
+	ctx := WithChannelCache(context.Background(), cache.NewMemoryCache(1024*1024), "user:1")
+	resolve := func(ctx context.Context) (*tg.InputChannel, error) {
+		return &tg.InputChannel{ChannelID: 100, AccessHash: 1}, nil
+	}
+
+	// A freshly resolved hash is not retried.
+	calls := 0
+	err := withChannel(ctx, 100, resolve, func(channel *tg.InputChannel) error {
+		calls++
+		return tgerr.New(400, "CHANNEL_PRIVATE")
+	})
+	assert.True(t, InvalidChannel(err))
+	assert.Equal(t, 1, calls)
+
+	// A cached one is retried once, other errors are not retried at all.
+	calls = 0
+	err = withChannel(ctx, 100, resolve, func(channel *tg.InputChannel) error {
+		calls++
+		return tgerr.New(400, "CHANNEL_INVALID")
+	})
+	assert.True(t, InvalidChannel(err))
+	assert.Equal(t, 2, calls)
+
+	calls = 0
+	failed := errors.New("flood")
+	assert.ErrorIs(t, withChannel(ctx, 100, resolve, func(channel *tg.InputChannel) error {
+		calls++
+		return failed
+	}), failed)
+	assert.Equal(t, 1, calls)
+}
+
+func TestChannelCachePerAccount(t *testing.T) {
+	c := cache.NewMemoryCache(1024 * 1024)
+	for account, hash := range map[string]int64{"user:1": 10, "bot:1:2": 20} {
+		ctx := WithChannelCache(context.Background(), c, account)
+		channel, _, err := cachedChannel(ctx, 100, func(ctx context.Context) (*tg.InputChannel, error) {
+			return &tg.InputChannel{ChannelID: 100, AccessHash: hash}, nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, hash, channel.AccessHash)
+	}
+
+	for account, hash := range map[string]int64{"user:1": 10, "bot:1:2": 20} {
+		ctx := WithChannelCache(context.Background(), c, account)
+		channel, cached, err := cachedChannel(ctx, 100, nil)
+		assert.NoError(t, err)
+		assert.True(t, cached)
+		assert.Equal(t, hash, channel.AccessHash)
+	}
+}
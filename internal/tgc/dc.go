@@ -0,0 +1,138 @@
+package tgc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/gotd/td/session"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/telegram/dcs"
+	"github.com/gotd/td/tg"
+	"github.com/pkg/errors"
+)
+
+// DCOverrideKey is the gin context key the override of a request is stored
+// under.
+const DCOverrideKey = "tgDCOverride"
+
+var (
+	ErrInvalidDC   = errors.New("dc is not in the address map")
+	ErrInvalidAddr = errors.New("endpoint is not an address of the dc")
+)
+
+// DCOverride forces clients to connect to a data center, and optionally to
+// one of its addresses, instead of the ones Telegram assigns. It is meant for
+// troubleshooting connectivity of single requests.
+type DCOverride struct {
+	DC   int
+	Addr string
+}
+
+// DCList is the address map clients connect with.
+func DCList() dcs.List {
+	return dcs.Prod()
+}
+
+// ParseDCOverride validates a dc id and an optional host:port against the
+// address map.
+func ParseDCOverride(dc, addr string) (*DCOverride, error) {
+	id, err := strconv.Atoi(dc)
+	if err != nil {
+		return nil, ErrInvalidDC
+	}
+	o := &DCOverride{DC: id, Addr: addr}
+	found := false
+	for _, opt := range DCList().Options {
+		if opt.ID != id || opt.CDN {
+			continue
+		}
+		found = true
+		if addr == "" || dcAddr(opt) == addr {
+			return o, nil
+		}
+	}
+	if found {
+		return nil, ErrInvalidAddr
+	}
+	return nil, ErrInvalidDC
+}
+
+func (o *DCOverride) String() string {
+	if o.Addr == "" {
+		return "dc" + strconv.Itoa(o.DC)
+	}
+	return fmt.Sprintf("dc%d@%s", o.DC, o.Addr)
+}
+
+// apply makes the overridden dc the primary one, leaving only the forced
+// address of it in the address map.
+func (o *DCOverride) apply(opts *telegram.Options) {
+	list := DCList()
+	if o.Addr != "" {
+		options := make([]tg.DCOption, 0, len(list.Options))
+		for _, opt := range list.Options {
+			if opt.ID == o.DC && dcAddr(opt) != o.Addr {
+				continue
+			}
+			options = append(options, opt)
+		}
+		list.Options = options
+	}
+	opts.DC = o.DC
+	opts.DCList = list
+}
+
+// checkSession fails when storage holds a session authorized on another dc,
+// as its key is of no use there.
+func (o *DCOverride) checkSession(ctx context.Context, storage session.Storage) error {
+	if storage == nil {
+		return nil
+	}
+	data, err := (&session.Loader{Storage: storage}).Load(ctx)
+	if errors.Is(err, session.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if data.DC != 0 && data.DC != o.DC {
+		return fmt.Errorf("session is authorized on dc %d, not dc %d", data.DC, o.DC)
+	}
+	return nil
+}
+
+func dcAddr(opt tg.DCOption) string {
+	return net.JoinHostPort(opt.IPAddress, strconv.Itoa(opt.Port))
+}
+
+type dcOverrideKey struct{}
+
+// WithDCOverride returns a context whose clients connect as o says.
+func WithDCOverride(ctx context.Context, o *DCOverride) context.Context {
+	return context.WithValue(ctx, dcOverrideKey{}, o)
+}
+
+// DCOverrideFrom returns the override of ctx, set with WithDCOverride or under
+// DCOverrideKey of a gin context, or nil.
+func DCOverrideFrom(ctx context.Context) *DCOverride {
+	if o, ok := ctx.Value(dcOverrideKey{}).(*DCOverride); ok {
+		return o
+	}
+	if o, ok := ctx.Value(DCOverrideKey).(*DCOverride); ok {
+		return o
+	}
+	return nil
+}
+
+// withDC returns spec building its clients with o, pooled apart from the
+// clients of spec.
+func withDC(spec ClientSpec, o *DCOverride) ClientSpec {
+	build := spec.New
+	spec.Key += ":" + o.String()
+	spec.New = func(ctx context.Context) (*telegram.Client, error) {
+		return build(WithDCOverride(ctx, o))
+	}
+	return spec
+}
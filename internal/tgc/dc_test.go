@@ -0,0 +1,96 @@
+package tgc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gotd/td/session"
+	"github.com/gotd/td/telegram"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/internal/config"
+)
+
+func TestParseDCOverride(t *testing.T) {
+	o, err := ParseDCOverride("4", "")
+	require.NoError(t, err)
+	assert.Equal(t, &DCOverride{DC: 4}, o)
+	assert.Equal(t, "dc4", o.String())
+
+	addr := dcAddr(DCList().Options[0])
+	o, err = ParseDCOverride("1", addr)
+	require.Equal(t, 1, DCList().Options[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, "dc1@"+addr, o.String())
+
+	_, err = ParseDCOverride("9", "")
+	assert.ErrorIs(t, err, ErrInvalidDC)
+	_, err = ParseDCOverride("two", "")
+	assert.ErrorIs(t, err, ErrInvalidDC)
+	_, err = ParseDCOverride("2", addr)
+	assert.ErrorIs(t, err, ErrInvalidAddr)
+	_, err = ParseDCOverride("2", "127.0.0.1:443")
+	assert.ErrorIs(t, err, ErrInvalidAddr)
+}
+
+func TestDCOverrideApply(t *testing.T) {
+	addr := dcAddr(DCList().Options[0])
+	o, err := ParseDCOverride("1", addr)
+	require.NoError(t, err)
+
+	var opts telegram.Options
+	o.apply(&opts)
+	assert.Equal(t, 1, opts.DC)
+	others := 0
+	for _, opt := range opts.DCList.Options {
+		if opt.ID == 1 {
+			assert.Equal(t, addr, dcAddr(opt))
+		} else {
+			others++
+		}
+	}
+	assert.NotZero(t, others)
+
+	opts = telegram.Options{}
+	(&DCOverride{DC: 4}).apply(&opts)
+	assert.Equal(t, 4, opts.DC)
+	assert.Equal(t, len(DCList().Options), len(opts.DCList.Options))
+}
+
+func TestDCOverrideReachesClient(t *testing.T) {
+	o := &DCOverride{DC: 4}
+	ctx := context.Background()
+	assert.Nil(t, DCOverrideFrom(ctx))
+
+	var built *DCOverride
+	spec := ClientSpec{Key: "user:abc", New: func(ctx context.Context) (*telegram.Client, error) {
+		built = DCOverrideFrom(ctx)
+		return nil, nil
+	}}
+	overridden := withDC(spec, o)
+	assert.Equal(t, "user:abc:dc4", overridden.Key)
+	overridden.New(ctx)
+	assert.Same(t, o, built)
+
+	spec.New(ctx)
+	assert.Nil(t, built)
+}
+
+func TestDCOverrideSession(t *testing.T) {
+	ctx := context.Background()
+	o := &DCOverride{DC: 4}
+	assert.NoError(t, o.checkSession(ctx, nil))
+
+	storage := new(session.StorageMemory)
+	assert.NoError(t, o.checkSession(ctx, storage))
+
+	require.NoError(t, (&session.Loader{Storage: storage}).Save(ctx, &session.Data{DC: 2}))
+	assert.Error(t, o.checkSession(ctx, storage))
+	assert.NoError(t, (&DCOverride{DC: 2}).checkSession(ctx, storage))
+
+	_, err := New(WithDCOverride(ctx, o), &config.TGConfig{}, nil, storage)
+	assert.Error(t, err)
+	client, err := New(WithDCOverride(ctx, &DCOverride{DC: 2}), &config.TGConfig{}, nil, storage)
+	assert.NoError(t, err)
+	assert.NotNil(t, client)
+}
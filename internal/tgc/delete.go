@@ -0,0 +1,156 @@
+package tgc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/retry"
+	"golang.org/x/sync/errgroup"
+)
+
+// MaxDeleteBatch is the most message ids Telegram deletes with one request.
+const MaxDeleteBatch = 100
+
+// DeleteOptions bounds the deletion of messages: batches of BatchSize ids are
+// sent by at most Concurrency requests at a time, and a batch refused with a
+// flood wait or a transient error is sent again up to Retries times.
+type DeleteOptions struct {
+	Concurrency int
+	BatchSize   int
+	Retries     int
+}
+
+// DefaultDeleteOptions apply to deletions made without the configuration at
+// hand, such as dropping copies that failed verification.
+var DefaultDeleteOptions = DeleteOptions{Concurrency: 4, BatchSize: MaxDeleteBatch, Retries: 3}
+
+// deleteBackoff is the wait before a batch that failed with a transient error
+// is retried, doubling with every attempt.
+var deleteBackoff = time.Second
+
+// DeleteOptionsFor returns the configured deletion options.
+func DeleteOptionsFor(config *config.TGConfig) DeleteOptions {
+	return DeleteOptions{Concurrency: config.Delete.Concurrency, BatchSize: config.Delete.BatchSize,
+		Retries: config.Delete.Retries}
+}
+
+func (o DeleteOptions) Validate() error {
+	switch {
+	case o.Concurrency < 1:
+		return errors.New("concurrency must be at least 1")
+	case o.BatchSize < 1 || o.BatchSize > MaxDeleteBatch:
+		return fmt.Errorf("batch size must be between 1 and %d", MaxDeleteBatch)
+	case o.Retries < 0:
+		return errors.New("retries must not be negative")
+	}
+	return nil
+}
+
+// DeleteChannelMessages deletes messages grouped by channel and returns how
+// many Telegram reported deleted. Messages that are already gone are skipped,
+// channels that fail do not stop the others.
+func DeleteChannelMessages(ctx context.Context, client *tg.Client, messages map[int64][]int, opts DeleteOptions) (int, error) {
+	if opts.Validate() != nil {
+		opts = DefaultDeleteOptions
+	}
+
+	sem := make(chan struct{}, opts.Concurrency)
+
+	var (
+		deleted atomic.Int64
+		mu      sync.Mutex
+		errs    []error
+		wg      sync.WaitGroup
+	)
+
+	for channelId, ids := range messages {
+		if len(ids) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := deleteChannelMessages(ctx, client, channelId, ids, opts, sem)
+			deleted.Add(int64(n))
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("channel %d: %w", channelId, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return int(deleted.Load()), errors.Join(errs...)
+}
+
+func deleteChannelMessages(ctx context.Context, client *tg.Client, channelId int64, ids []int,
+	opts DeleteOptions, sem chan struct{}) (int, error) {
+	deleted := 0
+	err := WithChannel(ctx, client, channelId, func(channel *tg.InputChannel) error {
+		n, err := deleteMessages(ctx, client, channel, ids, opts, sem)
+		deleted += n
+		return err
+	})
+	return deleted, err
+}
+
+// deleteMessages sends the batches of ids, each holding a slot of sem while
+// its request is in flight.
+func deleteMessages(ctx context.Context, client *tg.Client, channel *tg.InputChannel, ids []int,
+	opts DeleteOptions, sem chan struct{}) (int, error) {
+	var (
+		deleted atomic.Int64
+		g       errgroup.Group
+	)
+	for start := 0; start < len(ids); start += opts.BatchSize {
+		batch := ids[start:min(start+opts.BatchSize, len(ids))]
+		g.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			defer func() { <-sem }()
+			n, err := deleteBatch(ctx, client, channel, batch, opts.Retries)
+			deleted.Add(int64(n))
+			return err
+		})
+	}
+	err := g.Wait()
+	return int(deleted.Load()), err
+}
+
+func deleteBatch(ctx context.Context, client *tg.Client, channel *tg.InputChannel, ids []int, retries int) (int, error) {
+	backoff := deleteBackoff
+	for attempt := 0; ; attempt++ {
+		res, err := client.ChannelsDeleteMessages(ctx, &tg.ChannelsDeleteMessagesRequest{Channel: channel, ID: ids})
+		if err == nil {
+			return res.PtsCount, nil
+		}
+		// Ids of messages deleted before are ignored by Telegram, a batch of
+		// nothing but those is refused.
+		if tgerr.Is(err, "MESSAGE_ID_INVALID") {
+			return 0, nil
+		}
+		wait, flooded := tgerr.AsFloodWait(err)
+		if attempt >= retries || (!flooded && !retry.Transient(err)) {
+			return 0, err
+		}
+		if !flooded {
+			wait, backoff = backoff, backoff*2
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package tgc
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/internal/cache"
+)
+
+func deleteContext(channels ...int64) context.Context {
+	c := cache.NewMemoryCache(1024 * 1024)
+	for _, id := range channels {
+		c.Set(channelCacheKey("test", id), &tg.InputChannel{ChannelID: id, AccessHash: id}, 0)
+	}
+	return WithChannelCache(context.Background(), c, "test")
+}
+
+func TestDeleteChannelMessagesBatches(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		batches  = map[int64][]int{}
+		inFlight atomic.Int32
+		peak     atomic.Int32
+	)
+	client := tg.NewClient(telegram.InvokeFunc(func(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+		req := input.(*tg.ChannelsDeleteMessagesRequest)
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		channelId := req.Channel.(*tg.InputChannel).ChannelID
+		mu.Lock()
+		batches[channelId] = append(batches[channelId], len(req.ID))
+		mu.Unlock()
+		output.(*tg.MessagesAffectedMessages).PtsCount = len(req.ID)
+		return nil
+	}))
+
+	ids := make([]int, 250)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+
+	opts := DeleteOptions{Concurrency: 2, BatchSize: 100, Retries: 1}
+	deleted, err := DeleteChannelMessages(deleteContext(1, 2), client, map[int64][]int{1: ids, 2: ids[:30]}, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 280, deleted)
+	assert.ElementsMatch(t, []int{100, 100, 50}, batches[1])
+	assert.Equal(t, []int{30}, batches[2])
+	assert.LessOrEqual(t, peak.Load(), int32(2))
+}
+
+func TestDeleteChannelMessagesRetries(t *testing.T) {
+	deleteBackoff = time.Millisecond
+	t.Cleanup(func() { deleteBackoff = time.Second })
+
+	var calls atomic.Int32
+	client := tg.NewClient(telegram.InvokeFunc(func(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+		req := input.(*tg.ChannelsDeleteMessagesRequest)
+		switch req.Channel.(*tg.InputChannel).ChannelID {
+		case 1:
+			if calls.Add(1) == 1 {
+				return tgerr.New(500, "RPC_CALL_FAIL")
+			}
+		case 2:
+			return tgerr.New(400, "MESSAGE_ID_INVALID")
+		case 3:
+			return tgerr.New(403, "MESSAGE_DELETE_FORBIDDEN")
+		}
+		output.(*tg.MessagesAffectedMessages).PtsCount = len(req.ID)
+		return nil
+	}))
+
+	deleted, err := DeleteChannelMessages(deleteContext(1, 2, 3), client,
+		map[int64][]int{1: {1, 2}, 2: {3}, 3: {4}}, DeleteOptions{Concurrency: 1, BatchSize: 100, Retries: 2})
+	assert.Equal(t, 2, deleted)
+	assert.Equal(t, int32(2), calls.Load())
+	assert.True(t, tgerr.Is(err, "MESSAGE_DELETE_FORBIDDEN"))
+	assert.ErrorContains(t, err, "channel 3")
+}
+
+func TestDeleteOptionsValidate(t *testing.T) {
+	assert.NoError(t, DefaultDeleteOptions.Validate())
+	assert.Error(t, DeleteOptions{Concurrency: 0, BatchSize: 100}.Validate())
+	assert.Error(t, DeleteOptions{Concurrency: 1, BatchSize: 101}.Validate())
+	assert.Error(t, DeleteOptions{Concurrency: 1, BatchSize: 100, Retries: -1}.Validate())
+}
@@ -9,7 +9,6 @@ import (
 	"runtime"
 	"sync"
 
-	"github.com/gotd/td/telegram"
 	"github.com/gotd/td/tg"
 	"github.com/tgdrive/teldrive/internal/config"
 	"github.com/tgdrive/teldrive/internal/kv"
@@ -22,51 +21,18 @@ var (
 	ErrInvalidChannelMessages = errors.New("invalid channel messages")
 )
 
+// GetChannelById resolves the input peer of channelId, through the channel
+// cache when ctx carries one.
 func GetChannelById(ctx context.Context, client *tg.Client, channelId int64) (*tg.InputChannel, error) {
-	inputChannel := &tg.InputChannel{
-		ChannelID: channelId,
-	}
-	channels, err := client.ChannelsGetChannels(ctx, []tg.InputChannelClass{inputChannel})
-
-	if err != nil {
-		return nil, err
-	}
-
-	if len(channels.GetChats()) == 0 {
-		return nil, ErrInValidChannelID
-	}
-	return channels.GetChats()[0].(*tg.Channel).AsInput(), nil
+	channel, _, err := cachedChannel(ctx, channelId, resolveChannel(client, channelId))
+	return channel, err
 }
 
-func DeleteMessages(ctx context.Context, client *telegram.Client, channelId int64, ids []int) error {
-
-	return RunWithAuth(ctx, client, "", func(ctx context.Context) error {
-		channel, err := GetChannelById(ctx, client.API(), channelId)
-
-		if err != nil {
-			return err
-		}
-
-		batchSize := 100
-
-		batchCount := int(math.Ceil(float64(len(ids)) / float64(batchSize)))
-
-		g, _ := errgroup.WithContext(ctx)
-
-		g.SetLimit(runtime.NumCPU())
-
-		for i := 0; i < batchCount; i++ {
-			start := i * batchSize
-			end := min((i+1)*batchSize, len(ids))
-			batchIds := ids[start:end]
-			g.Go(func() error {
-				messageDeleteRequest := tg.ChannelsDeleteMessagesRequest{Channel: channel, ID: batchIds}
-				_, err = client.API().ChannelsDeleteMessages(ctx, &messageDeleteRequest)
-				return err
-			})
-		}
-		return g.Wait()
-	})
+// DeleteMessages deletes messages of a single channel with the default
+// options.
+func DeleteMessages(ctx context.Context, client *tg.Client, channelId int64, ids []int) error {
+	_, err := DeleteChannelMessages(ctx, client, map[int64][]int{channelId: ids}, DefaultDeleteOptions)
+	return err
 }
 
 func getTGMessagesBatch(ctx context.Context, client *tg.Client, channel *tg.InputChannel, ids []int) (tg.MessagesMessagesClass, error) {
@@ -93,12 +59,15 @@ func getTGMessagesBatch(ctx context.Context, client *tg.Client, channel *tg.Inpu
 }
 
 func GetMessages(ctx context.Context, client *tg.Client, ids []int, channelId int64) ([]tg.MessageClass, error) {
+	var messages []tg.MessageClass
+	err := WithChannel(ctx, client, channelId, func(channel *tg.InputChannel) (err error) {
+		messages, err = getMessages(ctx, client, channel, ids)
+		return err
+	})
+	return messages, err
+}
 
-	channel, err := GetChannelById(ctx, client, channelId)
-
-	if err != nil {
-		return nil, err
-	}
+func getMessages(ctx context.Context, client *tg.Client, channel *tg.InputChannel, ids []int) ([]tg.MessageClass, error) {
 
 	batchSize := 200
 
@@ -131,7 +100,7 @@ func GetMessages(ctx context.Context, client *tg.Client, ids []int, channelId in
 
 	}
 
-	if err = g.Wait(); err != nil {
+	if err := g.Wait(); err != nil {
 		return nil, err
 	}
 
@@ -184,9 +153,9 @@ func GetMediaContent(ctx context.Context, client *tg.Client, location tg.InputFi
 	return buff, nil
 }
 
-func GetBotInfo(ctx context.Context, KV kv.KV, config *config.TGConfig, token string) (*types.BotInfo, error) {
+func GetBotInfo(ctx context.Context, KV kv.KV, config *config.TGConfig, userId int64, token string) (*types.BotInfo, error) {
 	var user *tg.User
-	client, _ := BotClient(ctx, KV, config, token, Middlewares(config, 5)...)
+	client, _ := BotClient(ctx, KV, config, userId, token, Middlewares(config, OpControl)...)
 	err := RunWithAuth(ctx, client, token, func(ctx context.Context) error {
 		user, _ = client.Self(ctx)
 		return nil
@@ -199,17 +168,14 @@ func GetBotInfo(ctx context.Context, KV kv.KV, config *config.TGConfig, token st
 
 func GetLocation(ctx context.Context, client *tg.Client, channelId int64, partId int64) (location *tg.InputDocumentFileLocation, err error) {
 
-	channel, err := GetChannelById(ctx, client, channelId)
-
-	if err != nil {
-		return nil, err
-	}
-	messageRequest := tg.ChannelsGetMessagesRequest{
-		Channel: channel,
-		ID:      []tg.InputMessageClass{&tg.InputMessageID{ID: int(partId)}},
-	}
-
-	res, err := client.ChannelsGetMessages(ctx, &messageRequest)
+	var res tg.MessagesMessagesClass
+	err = WithChannel(ctx, client, channelId, func(channel *tg.InputChannel) (err error) {
+		res, err = client.ChannelsGetMessages(ctx, &tg.ChannelsGetMessagesRequest{
+			Channel: channel,
+			ID:      []tg.InputMessageClass{&tg.InputMessageID{ID: int(partId)}},
+		})
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,401 @@
+package tgc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/kv"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrManagerClosed  = errors.New("client manager closed")
+	ErrPoolExhausted  = errors.New("too many telegram clients in use")
+	errClientShutdown = errors.New("client stopped")
+)
+
+// ClientSpec identifies a pooled client and knows how to build it. Specs with
+// the same key share one connection.
+type ClientSpec struct {
+	Key   string
+	Token string
+	New   func(ctx context.Context) (*telegram.Client, error)
+}
+
+type pooledClient struct {
+	key       string
+	client    *telegram.Client
+	ready     chan struct{}
+	done      chan struct{}
+	initErr   error
+	cancel    context.CancelFunc
+	sem       chan struct{}
+	inUse     int
+	lastUsed  time.Time
+	lastCheck time.Time
+	broken    bool
+}
+
+func (p *pooledClient) stopped() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Manager lends authenticated Telegram clients keyed by session identity so
+// requests reuse connections instead of dialing and authorizing each time.
+// Idle clients are disconnected after a while and clients whose connection
+// broke are replaced on the next acquire.
+type Manager struct {
+	mu      sync.Mutex
+	clients map[string]*pooledClient
+	cnf     *config.TGConfig
+	kv      kv.KV
+	creds   CredentialStore
+	cache   cache.Cacher
+	sched   *Scheduler
+	logger  *zap.SugaredLogger
+	ctx     context.Context
+	cancel  context.CancelFunc
+	closed  bool
+}
+
+func NewManager(cnf *config.Config, kv kv.KV, creds CredentialStore, cache cache.Cacher, logger *zap.SugaredLogger) *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Manager{
+		clients: make(map[string]*pooledClient),
+		cnf:     &cnf.TG,
+		kv:      kv,
+		creds:   creds,
+		cache:   cache,
+		sched:   NewScheduler(),
+		logger:  logger,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	if m.cnf.Clients.IdleTimeout > 0 {
+		go m.evictIdle()
+	}
+	return m
+}
+
+// Scheduler returns the scheduler that shares the rate limit of each account
+// between its users.
+func (m *Manager) Scheduler() *Scheduler {
+	return m.sched
+}
+
+// Middlewares returns the middlewares for RPCs of op made for caller with the
+// client of spec. With rate limiting enabled they wait for the account's
+// scheduler instead of a limiter of their own, so concurrent requests share
+// the limit of the account.
+func (m *Manager) Middlewares(spec ClientSpec, op Operation, limit RateLimit, caller Caller) []telegram.Middleware {
+	middlewares := baseMiddlewares(m.cnf, op)
+	if m.cnf.RateLimit {
+		middlewares = append(middlewares, m.sched.Middleware(spec.Key, limit, caller))
+	}
+	return middlewares
+}
+
+// UserSpec pools clients for a user's own Telegram session, using the app
+// credentials stored with it.
+func (m *Manager) UserSpec(session string) ClientSpec {
+	var creds *AppCredentials
+	if m.creds != nil {
+		creds = m.creds.Session(session)
+	}
+	return m.UserSpecWithApp(session, creds)
+}
+
+// UserSpecWithApp pools clients for a session under explicit app credentials,
+// e.g. to validate them before they are stored.
+func (m *Manager) UserSpecWithApp(session string, creds *AppCredentials) ClientSpec {
+	hash := sha256.Sum256([]byte(session))
+	key := "user:" + hex.EncodeToString(hash[:])
+	if creds != nil {
+		key += ":" + strconv.Itoa(creds.AppId)
+	}
+	return ClientSpec{
+		Key: key,
+		New: func(ctx context.Context) (*telegram.Client, error) {
+			return AuthClient(ctx, WithApp(m.cnf, creds), session, clientMiddlewares(m.cnf)...)
+		},
+	}
+}
+
+// BotSpec pools clients for a bot acting on behalf of userId.
+func (m *Manager) BotSpec(userId int64, token string) ClientSpec {
+	return ClientSpec{
+		Key:   BotSessionKey(userId, token),
+		Token: token,
+		New: func(ctx context.Context) (*telegram.Client, error) {
+			var creds *AppCredentials
+			if m.creds != nil {
+				creds = m.creds.Bot(token)
+			}
+			return BotClient(ctx, m.kv, WithApp(m.cnf, creds), userId, token, clientMiddlewares(m.cnf)...)
+		},
+	}
+}
+
+// Run lends the client for spec to f. Errors returned by f that indicate a
+// dead connection or revoked session cause the client to be replaced. Channels
+// looked up with the context f gets are cached for the client's account. A dc
+// override in ctx gets a client of its own connected as it says.
+func (m *Manager) Run(ctx context.Context, spec ClientSpec, f func(ctx context.Context, client *telegram.Client) error) error {
+	if o := DCOverrideFrom(ctx); o != nil {
+		spec = withDC(spec, o)
+	}
+	entry, err := m.acquire(ctx, spec, true)
+	if err != nil {
+		return err
+	}
+	if m.cache != nil {
+		ctx = WithChannelCache(ctx, m.cache, spec.Key)
+	}
+	err = f(ctx, entry.client)
+	m.release(entry, true, err)
+	return err
+}
+
+// Evict disconnects the client for key once it is no longer in use, e.g.
+// after the session was logged out.
+func (m *Manager) Evict(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if entry, ok := m.clients[key]; ok {
+		entry.broken = true
+		if entry.inUse == 0 {
+			m.removeLocked(entry)
+		}
+	}
+}
+
+// Close disconnects every pooled client.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	m.closed = true
+	for _, entry := range m.clients {
+		m.removeLocked(entry)
+	}
+	m.mu.Unlock()
+	m.cancel()
+}
+
+func (m *Manager) acquire(ctx context.Context, spec ClientSpec, retry bool) (*pooledClient, error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, ErrManagerClosed
+	}
+	entry, ok := m.clients[spec.Key]
+	if ok && (entry.broken || entry.stopped()) {
+		if entry.inUse == 0 {
+			m.removeLocked(entry)
+		} else {
+			delete(m.clients, entry.key)
+		}
+		ok = false
+	}
+	if !ok {
+		if max := m.cnf.Clients.Max; max > 0 && len(m.clients) >= max && !m.evictLRULocked() {
+			m.mu.Unlock()
+			return nil, ErrPoolExhausted
+		}
+		entry = m.connectLocked(spec)
+	}
+	entry.inUse++
+	m.mu.Unlock()
+
+	select {
+	case <-entry.ready:
+	case <-ctx.Done():
+		m.release(entry, false, nil)
+		return nil, ctx.Err()
+	}
+	if entry.initErr != nil {
+		m.release(entry, false, entry.initErr)
+		return nil, entry.initErr
+	}
+
+	select {
+	case entry.sem <- struct{}{}:
+	case <-ctx.Done():
+		m.release(entry, false, nil)
+		return nil, ctx.Err()
+	}
+
+	if !m.healthy(ctx, entry) {
+		m.release(entry, true, errClientShutdown)
+		if retry {
+			return m.acquire(ctx, spec, false)
+		}
+		return nil, errClientShutdown
+	}
+
+	return entry, nil
+}
+
+func (m *Manager) release(entry *pooledClient, held bool, err error) {
+	if held {
+		<-entry.sem
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry.inUse--
+	entry.lastUsed = time.Now()
+	if isBroken(err) {
+		entry.broken = true
+	}
+	if (entry.broken || entry.stopped()) && entry.inUse == 0 {
+		m.removeLocked(entry)
+	}
+}
+
+func (m *Manager) connectLocked(spec ClientSpec) *pooledClient {
+	perKey := m.cnf.Clients.PerKey
+	if perKey <= 0 {
+		perKey = 1
+	}
+	ctx, cancel := context.WithCancel(m.ctx)
+	entry := &pooledClient{
+		key:       spec.Key,
+		ready:     make(chan struct{}),
+		done:      make(chan struct{}),
+		cancel:    cancel,
+		sem:       make(chan struct{}, perKey),
+		lastUsed:  time.Now(),
+		lastCheck: time.Now(),
+	}
+	m.clients[spec.Key] = entry
+
+	go func() {
+		defer close(entry.done)
+		var once sync.Once
+		markReady := func(err error) {
+			once.Do(func() {
+				entry.initErr = err
+				close(entry.ready)
+			})
+		}
+		client, err := spec.New(ctx)
+		if err != nil {
+			markReady(err)
+			return
+		}
+		entry.client = client
+		err = RunWithAuth(ctx, client, spec.Token, func(ctx context.Context) error {
+			markReady(nil)
+			<-ctx.Done()
+			return nil
+		})
+		if err == nil {
+			err = errClientShutdown
+		}
+		markReady(err)
+		m.logger.Debugw("telegram client stopped", "key", spec.Key, "err", err)
+	}()
+
+	return entry
+}
+
+// healthy pings clients that have not been checked recently.
+func (m *Manager) healthy(ctx context.Context, entry *pooledClient) bool {
+	if entry.stopped() {
+		return false
+	}
+	interval := m.cnf.Clients.HealthCheckInterval
+	m.mu.Lock()
+	due := interval > 0 && time.Since(entry.lastUsed) >= interval && time.Since(entry.lastCheck) >= interval
+	if due {
+		entry.lastCheck = time.Now()
+	}
+	m.mu.Unlock()
+	if !due {
+		return true
+	}
+	pingCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := entry.client.Ping(pingCtx); err != nil {
+		m.logger.Debugw("telegram client failed health check", "key", entry.key, "err", err)
+		return false
+	}
+	return true
+}
+
+func (m *Manager) removeLocked(entry *pooledClient) {
+	if m.clients[entry.key] == entry {
+		delete(m.clients, entry.key)
+	}
+	entry.cancel()
+}
+
+func (m *Manager) evictLRULocked() bool {
+	var oldest *pooledClient
+	for _, entry := range m.clients {
+		if entry.inUse == 0 && (oldest == nil || entry.lastUsed.Before(oldest.lastUsed)) {
+			oldest = entry
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	m.removeLocked(oldest)
+	return true
+}
+
+func (m *Manager) evictIdle() {
+	timeout := m.cnf.Clients.IdleTimeout
+	ticker := time.NewTicker(max(timeout/2, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.mu.Lock()
+			for _, entry := range m.clients {
+				if entry.inUse == 0 && (entry.stopped() || time.Since(entry.lastUsed) > timeout) {
+					m.removeLocked(entry)
+				}
+			}
+			m.mu.Unlock()
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// isBroken reports errors after which a client must not be lent out again.
+func isBroken(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, errClientShutdown) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	return tgerr.Is(err, "AUTH_KEY_UNREGISTERED", "AUTH_KEY_INVALID", "SESSION_REVOKED",
+		"SESSION_EXPIRED", "USER_DEACTIVATED", "USER_DEACTIVATED_BAN")
+}
+
+// WithMiddlewares wraps the API of client with per-call middlewares such as
+// rate limits, leaving the shared client untouched.
+func WithMiddlewares(client *telegram.Client, middlewares ...telegram.Middleware) *tg.Client {
+	var invoker tg.Invoker = client
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		invoker = middlewares[i].Handle(invoker)
+	}
+	return tg.NewClient(invoker)
+}
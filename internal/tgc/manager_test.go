@@ -0,0 +1,98 @@
+package tgc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tgerr"
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/internal/config"
+	"go.uber.org/zap"
+)
+
+func newTestManager(cnf *config.Config) *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{clients: make(map[string]*pooledClient), cnf: &cnf.TG,
+		logger: zap.NewNop().Sugar(), ctx: ctx, cancel: cancel}
+}
+
+// connected registers a ready entry so tests do not dial Telegram.
+func connected(m *Manager, key string, perKey int) *pooledClient {
+	ready := make(chan struct{})
+	close(ready)
+	_, cancel := context.WithCancel(m.ctx)
+	entry := &pooledClient{key: key, ready: ready, done: make(chan struct{}), cancel: cancel,
+		sem: make(chan struct{}, perKey), lastUsed: time.Now(), lastCheck: time.Now()}
+	m.clients[key] = entry
+	return entry
+}
+
+func failingSpec(key string) ClientSpec {
+	return ClientSpec{Key: key, New: func(ctx context.Context) (*telegram.Client, error) {
+		return nil, errors.New("dial failed")
+	}}
+}
+
+func noop(ctx context.Context, client *telegram.Client) error { return nil }
+
+func TestManagerPerKeyLimit(t *testing.T) {
+	m := newTestManager(&config.Config{})
+	connected(m, "a", 1)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go m.Run(context.Background(), failingSpec("a"), func(ctx context.Context, client *telegram.Client) error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, m.Run(ctx, failingSpec("a"), noop), context.DeadlineExceeded)
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		return m.Run(context.Background(), failingSpec("a"), noop) == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestManagerReplacesBrokenClient(t *testing.T) {
+	m := newTestManager(&config.Config{})
+	connected(m, "a", 1)
+
+	err := m.Run(context.Background(), failingSpec("a"), func(ctx context.Context, client *telegram.Client) error {
+		return tgerr.New(401, "AUTH_KEY_UNREGISTERED")
+	})
+	assert.Error(t, err)
+	assert.NotContains(t, m.clients, "a")
+
+	// the next acquire reconnects instead of reusing the broken client
+	assert.EqualError(t, m.Run(context.Background(), failingSpec("a"), noop), "dial failed")
+	assert.Eventually(t, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return len(m.clients) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestManagerCapacity(t *testing.T) {
+	cnf := &config.Config{}
+	cnf.TG.Clients.Max = 1
+	m := newTestManager(cnf)
+	busy := connected(m, "a", 1)
+	busy.inUse = 1
+
+	assert.ErrorIs(t, m.Run(context.Background(), failingSpec("b"), noop), ErrPoolExhausted)
+
+	busy.inUse = 0
+	m.Run(context.Background(), failingSpec("b"), noop)
+	assert.NotContains(t, m.clients, "a")
+
+	m.Close()
+	assert.ErrorIs(t, m.Run(context.Background(), failingSpec("a"), noop), ErrManagerClosed)
+}
@@ -0,0 +1,63 @@
+package tgc
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/tgdrive/teldrive/internal/config"
+)
+
+// ReconnectOptions shape the wait between attempts to reconnect a client. The
+// wait starts at InitialInterval and grows by Multiplier up to MaxInterval,
+// until MaxElapsed has passed, zero retrying forever. Every wait is randomized
+// by up to Jitter of itself, so clients dropped together do not all reconnect
+// at the same moment.
+type ReconnectOptions struct {
+	InitialInterval time.Duration
+	Multiplier      float64
+	MaxInterval     time.Duration
+	MaxElapsed      time.Duration
+	Jitter          float64
+}
+
+// DefaultReconnectOptions apply to clients created without a valid
+// reconnection configuration.
+var DefaultReconnectOptions = ReconnectOptions{InitialInterval: 500 * time.Millisecond, Multiplier: 1.1,
+	MaxInterval: 10 * time.Second, MaxElapsed: 5 * time.Minute, Jitter: 0.5}
+
+// ReconnectOptionsFor returns the configured reconnection options.
+func ReconnectOptionsFor(config *config.TGConfig) ReconnectOptions {
+	return ReconnectOptions{InitialInterval: config.Reconnect.InitialInterval, Multiplier: config.Reconnect.Multiplier,
+		MaxInterval: config.Reconnect.MaxInterval, MaxElapsed: config.ReconnectTimeout, Jitter: config.Reconnect.Jitter}
+}
+
+func (o ReconnectOptions) Validate() error {
+	switch {
+	case o.InitialInterval <= 0:
+		return errors.New("initial interval must be positive")
+	case o.Multiplier < 1:
+		return errors.New("multiplier must be at least 1")
+	case o.MaxInterval < o.InitialInterval:
+		return errors.New("max interval must not be less than the initial interval")
+	case o.MaxElapsed < 0:
+		return errors.New("timeout must not be negative")
+	case o.Jitter < 0 || o.Jitter > 1:
+		return errors.New("jitter must be between 0 and 1")
+	}
+	return nil
+}
+
+func (o ReconnectOptions) backoff() backoff.BackOff {
+	if o.Validate() != nil {
+		o = DefaultReconnectOptions
+	}
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = o.InitialInterval
+	b.Multiplier = o.Multiplier
+	b.MaxInterval = o.MaxInterval
+	b.MaxElapsedTime = o.MaxElapsed
+	b.RandomizationFactor = o.Jitter
+	b.Reset()
+	return b
+}
@@ -0,0 +1,46 @@
+package tgc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/internal/config"
+)
+
+func TestReconnectJitter(t *testing.T) {
+	opts := ReconnectOptions{InitialInterval: time.Second, Multiplier: 2, MaxInterval: time.Minute, Jitter: 0.5}
+
+	seen := map[time.Duration]bool{}
+	for range 50 {
+		wait := opts.backoff().NextBackOff()
+		assert.GreaterOrEqual(t, wait, 500*time.Millisecond)
+		assert.LessOrEqual(t, wait, 1500*time.Millisecond)
+		seen[wait] = true
+	}
+	assert.Greater(t, len(seen), 10)
+
+	opts.Jitter = 0
+	b := opts.backoff()
+	assert.Equal(t, time.Second, b.NextBackOff())
+	assert.Equal(t, 2*time.Second, b.NextBackOff())
+}
+
+func TestReconnectOptions(t *testing.T) {
+	assert.NoError(t, DefaultReconnectOptions.Validate())
+
+	cnf := &config.TGConfig{}
+	assert.Error(t, ReconnectOptionsFor(cnf).Validate())
+	// Clients built from an empty configuration fall back to the defaults
+	// instead of reconnecting in a tight loop.
+	wait := ReconnectOptionsFor(cnf).backoff().NextBackOff()
+	assert.GreaterOrEqual(t, wait, 250*time.Millisecond)
+	assert.LessOrEqual(t, wait, 750*time.Millisecond)
+
+	opts := DefaultReconnectOptions
+	opts.Jitter = 1.5
+	assert.Error(t, opts.Validate())
+	opts = DefaultReconnectOptions
+	opts.MaxInterval = time.Millisecond
+	assert.Error(t, opts.Validate())
+}
@@ -0,0 +1,261 @@
+package tgc
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"golang.org/x/time/rate"
+)
+
+// Caller identifies the user an RPC is made for. Users with a higher weight
+// get proportionally more of an account's rate limit while others wait.
+type Caller struct {
+	UserId int64
+	Weight int
+}
+
+// Scheduler admits RPCs to Telegram accounts. Every account has one rate
+// limiter shared by all requests using it, and callers waiting for it are
+// queued per user and served by weighted round robin so one user's transfers
+// cannot starve everybody else on the same bot.
+type Scheduler struct {
+	mu    sync.Mutex
+	lanes map[string]*lane
+}
+
+type waiter struct {
+	ready  chan struct{}
+	queued time.Time
+}
+
+type userQueue struct {
+	userId  int64
+	weight  int
+	served  int
+	waiters []*waiter
+}
+
+type waitStats struct {
+	admitted int64
+	total    time.Duration
+	max      time.Duration
+}
+
+type lane struct {
+	limiter *rate.Limiter
+	limit   RateLimit
+	ring    []*userQueue
+	next    int
+	queues  map[int64]*userQueue
+	stats   map[int64]*waitStats
+	waiting int
+	running bool
+}
+
+// UserStats describes the queue of one user on an account.
+type UserStats struct {
+	UserId   int64
+	Queued   int
+	Admitted int64
+	AvgWait  time.Duration
+	MaxWait  time.Duration
+}
+
+// LaneStats describes the queue of an account.
+type LaneStats struct {
+	Account string
+	Queued  int
+	Users   []UserStats
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{lanes: make(map[string]*lane)}
+}
+
+// Middleware delays every RPC sent through it until the scheduler of account
+// admits it on behalf of caller.
+func (s *Scheduler) Middleware(account string, limit RateLimit, caller Caller) telegram.Middleware {
+	return telegram.MiddlewareFunc(func(next tg.Invoker) telegram.InvokeFunc {
+		return func(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+			if err := s.Wait(ctx, account, limit, caller); err != nil {
+				return err
+			}
+			return next.Invoke(ctx, input, output)
+		}
+	})
+}
+
+// Wait blocks until caller may send one request through account.
+func (s *Scheduler) Wait(ctx context.Context, account string, limit RateLimit, caller Caller) error {
+	w := &waiter{ready: make(chan struct{}), queued: time.Now()}
+
+	s.mu.Lock()
+	l := s.lane(account, limit)
+	l.push(caller, w)
+	if !l.running {
+		l.running = true
+		go s.dispatch(l)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		admitted := !l.remove(caller.UserId, w)
+		s.mu.Unlock()
+		if admitted {
+			return nil
+		}
+		return ctx.Err()
+	}
+}
+
+func (s *Scheduler) lane(account string, limit RateLimit) *lane {
+	l, ok := s.lanes[account]
+	if !ok {
+		l = &lane{
+			limiter: rate.NewLimiter(limit.every(), limit.Burst),
+			limit:   limit,
+			queues:  make(map[int64]*userQueue),
+			stats:   make(map[int64]*waitStats),
+		}
+		s.lanes[account] = l
+	} else if l.limit != limit {
+		l.limiter.SetLimit(limit.every())
+		l.limiter.SetBurst(limit.Burst)
+		l.limit = limit
+	}
+	return l
+}
+
+// dispatch releases the waiters of a lane one limiter token at a time and
+// exits once nobody waits anymore.
+func (s *Scheduler) dispatch(l *lane) {
+	for {
+		s.mu.Lock()
+		if l.waiting == 0 {
+			l.running = false
+			s.mu.Unlock()
+			return
+		}
+		limiter := l.limiter
+		s.mu.Unlock()
+
+		limiter.Wait(context.Background())
+
+		s.mu.Lock()
+		if w, userId := l.pop(); w != nil {
+			l.record(userId, time.Since(w.queued))
+			close(w.ready)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Stats returns the queues of all accounts that have been used.
+func (s *Scheduler) Stats() []LaneStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]LaneStats, 0, len(s.lanes))
+	for account, l := range s.lanes {
+		ls := LaneStats{Account: account, Queued: l.waiting, Users: make([]UserStats, 0, len(l.stats))}
+		for userId, st := range l.stats {
+			us := UserStats{UserId: userId, Admitted: st.admitted, MaxWait: st.max}
+			if st.admitted > 0 {
+				us.AvgWait = st.total / time.Duration(st.admitted)
+			}
+			if q, ok := l.queues[userId]; ok {
+				us.Queued = len(q.waiters)
+			}
+			ls.Users = append(ls.Users, us)
+		}
+		sort.Slice(ls.Users, func(i, j int) bool { return ls.Users[i].UserId < ls.Users[j].UserId })
+		res = append(res, ls)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Account < res[j].Account })
+	return res
+}
+
+func (l RateLimit) every() rate.Limit {
+	return rate.Every(time.Millisecond * time.Duration(l.Rate))
+}
+
+func (l *lane) push(caller Caller, w *waiter) {
+	q, ok := l.queues[caller.UserId]
+	if !ok {
+		q = &userQueue{userId: caller.UserId}
+		l.queues[caller.UserId] = q
+		l.ring = append(l.ring, q)
+	}
+	if _, ok := l.stats[caller.UserId]; !ok {
+		l.stats[caller.UserId] = &waitStats{}
+	}
+	q.weight = max(caller.Weight, 1)
+	q.waiters = append(q.waiters, w)
+	l.waiting++
+}
+
+// pop takes the next waiter in weighted round robin order: each user is
+// served up to its weight in a row before the turn passes on.
+func (l *lane) pop() (*waiter, int64) {
+	for len(l.ring) > 0 {
+		if l.next >= len(l.ring) {
+			l.next = 0
+		}
+		q := l.ring[l.next]
+		if len(q.waiters) == 0 {
+			l.drop(l.next)
+			continue
+		}
+		w := q.waiters[0]
+		q.waiters = q.waiters[1:]
+		l.waiting--
+		q.served++
+		if len(q.waiters) == 0 {
+			l.drop(l.next)
+		} else if q.served >= q.weight {
+			q.served = 0
+			l.next++
+		}
+		return w, q.userId
+	}
+	return nil, 0
+}
+
+// drop removes the queue at index i of the ring, the turn moves on to the
+// queue that followed it.
+func (l *lane) drop(i int) {
+	delete(l.queues, l.ring[i].userId)
+	l.ring = slices.Delete(l.ring, i, i+1)
+}
+
+// remove takes back a waiter that gave up, it reports false when the waiter
+// was admitted in the meantime.
+func (l *lane) remove(userId int64, w *waiter) bool {
+	q, ok := l.queues[userId]
+	if !ok {
+		return false
+	}
+	i := slices.Index(q.waiters, w)
+	if i < 0 {
+		return false
+	}
+	q.waiters = slices.Delete(q.waiters, i, i+1)
+	l.waiting--
+	return true
+}
+
+func (l *lane) record(userId int64, wait time.Duration) {
+	st := l.stats[userId]
+	st.admitted++
+	st.total += wait
+	st.max = max(st.max, wait)
+}
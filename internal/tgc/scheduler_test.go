@@ -0,0 +1,48 @@
+package tgc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLaneWeightedRoundRobin(t *testing.T) {
+	l := &lane{queues: make(map[int64]*userQueue), stats: make(map[int64]*waitStats)}
+	for i := 0; i < 4; i++ {
+		l.push(Caller{UserId: 1, Weight: 1}, &waiter{})
+		l.push(Caller{UserId: 2, Weight: 2}, &waiter{})
+	}
+
+	var order []int64
+	for {
+		w, userId := l.pop()
+		if w == nil {
+			break
+		}
+		order = append(order, userId)
+	}
+
+	assert.Equal(t, []int64{1, 2, 2, 1, 2, 2, 1, 1}, order)
+	assert.Equal(t, 0, l.waiting)
+	assert.Empty(t, l.queues)
+}
+
+func TestSchedulerWaitCancelled(t *testing.T) {
+	s := NewScheduler()
+	limit := RateLimit{Rate: 60000, Burst: 1}
+
+	assert.NoError(t, s.Wait(context.Background(), "bot", limit, Caller{UserId: 1}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Wait(ctx, "bot", limit, Caller{UserId: 2}), context.DeadlineExceeded)
+
+	stats := s.Stats()
+	assert.Len(t, stats, 1)
+	assert.Equal(t, 0, stats[0].Queued)
+	assert.Len(t, stats[0].Users, 2)
+	assert.Equal(t, int64(1), stats[0].Users[0].Admitted)
+	assert.Equal(t, int64(0), stats[0].Users[1].Admitted)
+}
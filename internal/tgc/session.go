@@ -0,0 +1,189 @@
+package tgc
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/gotd/td/crypto"
+	"github.com/gotd/td/session"
+)
+
+var ErrUnsupportedSession = errors.New("unsupported session string, supported formats: telethon, pyrogram, gramjs, gotd json")
+
+var dcAddrs = map[int]string{
+	1: "149.154.175.53",
+	2: "149.154.167.51",
+	3: "149.154.175.100",
+	4: "149.154.167.91",
+	5: "91.108.56.130",
+}
+
+const authKeySize = 256
+
+// ParseSession decodes a session string exported by telethon, pyrogram, gramjs
+// or gotd itself.
+func ParseSession(s string) (*session.Data, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, ErrUnsupportedSession
+	}
+
+	if strings.HasPrefix(s, "{") {
+		return parseGotdSession([]byte(s))
+	}
+
+	if s[0] == '1' {
+		if data, err := session.TelethonSession(s); err == nil {
+			return data, nil
+		}
+		if data, err := parseGramJSSession(s[1:]); err == nil {
+			return data, nil
+		}
+	}
+
+	if data, err := parsePyrogramSession(s); err == nil {
+		return data, nil
+	}
+
+	if raw, err := base64.StdEncoding.DecodeString(s); err == nil && len(raw) > 0 && raw[0] == '{' {
+		return parseGotdSession(raw)
+	}
+
+	return nil, ErrUnsupportedSession
+}
+
+// EncodeSession returns the telethon string session used to store sessions,
+// pointing at the known IPv4 address of the DC.
+func EncodeSession(dcID int, authKey []byte) string {
+	return EncodeSessionAddr(dcID, "", authKey)
+}
+
+// EncodeSessionAddr returns the telethon string session for a DC reached at
+// addr. Telethon tells the address families apart by length, packing IPv4 in
+// 4 and IPv6 in 16 bytes. Addresses that are empty or not an IP fall back to
+// the known address of the DC.
+func EncodeSessionAddr(dcID int, addr string, authKey []byte) string {
+	ip, port, ok := packAddr(addr)
+	if !ok {
+		ip, port = net.ParseIP(dcAddrs[dcID]).To4(), 443
+	}
+	packet := make([]byte, 0, 3+len(ip)+len(authKey))
+	packet = append(packet, byte(dcID))
+	packet = append(packet, ip...)
+	packet = binary.BigEndian.AppendUint16(packet, port)
+	packet = append(packet, authKey...)
+	return "1" + base64.URLEncoding.EncodeToString(packet)
+}
+
+// packAddr splits a host:port address into the packed IP in the width of its
+// family and the port.
+func packAddr(addr string) (net.IP, uint16, bool) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, false
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, 0, false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, false
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4, uint16(port), true
+	}
+	return ip.To16(), uint16(port), true
+}
+
+// NormalizeSession converts any supported session string to the telethon
+// format.
+func NormalizeSession(s string) (string, error) {
+	data, err := ParseSession(s)
+	if err != nil {
+		return "", err
+	}
+	return EncodeSessionAddr(data.DC, data.Addr, data.AuthKey), nil
+}
+
+func newSessionData(dcID int, addr string, key []byte) (*session.Data, error) {
+	if len(key) != authKeySize {
+		return nil, ErrUnsupportedSession
+	}
+	if addr == "" {
+		ip, ok := dcAddrs[dcID]
+		if !ok {
+			return nil, ErrUnsupportedSession
+		}
+		addr = net.JoinHostPort(ip, "443")
+	}
+	var authKey crypto.Key
+	copy(authKey[:], key)
+	id := authKey.WithID().ID
+	return &session.Data{DC: dcID, Addr: addr, AuthKey: authKey[:], AuthKeyID: id[:]}, nil
+}
+
+// parsePyrogramSession decodes the formats produced by pyrogram's
+// export_session_string, which are distinguished by their length.
+func parsePyrogramSession(s string) (*session.Data, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	var dcID int
+	var key []byte
+	switch len(raw) {
+	case 271:
+		// >BI?256sQ? dc id, api id, test mode, auth key, user id, is bot
+		dcID, key = int(raw[0]), raw[6:262]
+	case 263, 267:
+		// >B?256sI? and >B?256sQ? dc id, test mode, auth key, user id, is bot
+		dcID, key = int(raw[0]), raw[2:258]
+	default:
+		return nil, ErrUnsupportedSession
+	}
+	return newSessionData(dcID, "", key)
+}
+
+// parseGramJSSession decodes a gramjs StringSession without its version
+// prefix: dc id, length prefixed server address, port and auth key.
+func parseGramJSSession(s string) (*session.Data, error) {
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < 3 {
+		return nil, ErrUnsupportedSession
+	}
+	dcID := int(raw[0])
+	addrLen := int(binary.BigEndian.Uint16(raw[1:3]))
+	if len(raw) != 3+addrLen+2+authKeySize {
+		return nil, ErrUnsupportedSession
+	}
+	host := string(raw[3 : 3+addrLen])
+	port := binary.BigEndian.Uint16(raw[3+addrLen : 5+addrLen])
+	return newSessionData(dcID, net.JoinHostPort(host, strconv.Itoa(int(port))), raw[5+addrLen:])
+}
+
+// parseGotdSession decodes the json written by gotd's session storages.
+func parseGotdSession(raw []byte) (*session.Data, error) {
+	var stored struct {
+		Version int
+		Data    session.Data
+	}
+	if err := json.Unmarshal(raw, &stored); err != nil {
+		return nil, ErrUnsupportedSession
+	}
+	data := stored.Data
+	if data.DC == 0 {
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return nil, ErrUnsupportedSession
+		}
+	}
+	return newSessionData(data.DC, data.Addr, data.AuthKey)
+}
@@ -0,0 +1,112 @@
+package tgc
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/gotd/td/session"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testAuthKey(t *testing.T) []byte {
+	key := make([]byte, authKeySize)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return key
+}
+
+func TestParseSession(t *testing.T) {
+	key := testAuthKey(t)
+
+	pyrogram := []byte{2}
+	pyrogram = binary.BigEndian.AppendUint32(pyrogram, 12345)
+	pyrogram = append(pyrogram, 0)
+	pyrogram = append(pyrogram, key...)
+	pyrogram = binary.BigEndian.AppendUint64(pyrogram, 777)
+	pyrogram = append(pyrogram, 0)
+
+	pyrogramLegacy := []byte{2, 0}
+	pyrogramLegacy = append(pyrogramLegacy, key...)
+	pyrogramLegacy = binary.BigEndian.AppendUint32(pyrogramLegacy, 777)
+	pyrogramLegacy = append(pyrogramLegacy, 0)
+
+	host := "149.154.167.51"
+	gramjs := []byte{2}
+	gramjs = binary.BigEndian.AppendUint16(gramjs, uint16(len(host)))
+	gramjs = append(gramjs, host...)
+	gramjs = binary.BigEndian.AppendUint16(gramjs, 443)
+	gramjs = append(gramjs, key...)
+
+	gotd, err := json.Marshal(struct {
+		Version int
+		Data    session.Data
+	}{Version: 1, Data: session.Data{DC: 2, Addr: host + ":443", AuthKey: key}})
+	require.NoError(t, err)
+
+	formats := map[string]string{
+		"telethon":        EncodeSession(2, key),
+		"pyrogram":        base64.RawURLEncoding.EncodeToString(pyrogram),
+		"pyrogram legacy": base64.URLEncoding.EncodeToString(pyrogramLegacy),
+		"gramjs":          "1" + base64.StdEncoding.EncodeToString(gramjs),
+		"gotd":            string(gotd),
+		"gotd base64":     base64.StdEncoding.EncodeToString(gotd),
+	}
+
+	for name, s := range formats {
+		t.Run(name, func(t *testing.T) {
+			data, err := ParseSession(s)
+			require.NoError(t, err)
+			assert.Equal(t, 2, data.DC)
+			assert.Equal(t, key, data.AuthKey)
+			assert.Len(t, data.AuthKeyID, 8)
+
+			normalized, err := NormalizeSession(s)
+			require.NoError(t, err)
+			assert.Equal(t, EncodeSession(2, key), normalized)
+		})
+	}
+}
+
+func TestParseSession_Invalid(t *testing.T) {
+	for _, s := range []string{"", "1abc", "not a session", "{}"} {
+		_, err := ParseSession(s)
+		assert.ErrorIs(t, err, ErrUnsupportedSession)
+	}
+}
+
+func TestEncodeSessionAddr(t *testing.T) {
+	key := testAuthKey(t)
+
+	for _, tc := range []struct {
+		addr string
+		size int
+		want string
+	}{
+		{"149.154.167.51:443", 263, "149.154.167.51:443"},
+		{"[2001:67c:4e8:f002::a]:443", 275, "[2001:67c:4e8:f002::a]:443"},
+		{"[::ffff:149.154.167.51]:80", 263, "149.154.167.51:80"},
+		{"", 263, "149.154.167.51:443"},
+		{"venus.web.telegram.org:443", 263, "149.154.167.51:443"},
+	} {
+		t.Run(tc.addr, func(t *testing.T) {
+			s := EncodeSessionAddr(2, tc.addr, key)
+			raw, err := base64.URLEncoding.DecodeString(s[1:])
+			require.NoError(t, err)
+			assert.Len(t, raw, tc.size)
+
+			data, err := ParseSession(s)
+			require.NoError(t, err)
+			assert.Equal(t, 2, data.DC)
+			assert.Equal(t, tc.want, data.Addr)
+			assert.Equal(t, key, data.AuthKey)
+
+			normalized, err := NormalizeSession(s)
+			require.NoError(t, err)
+			assert.Equal(t, s, normalized)
+		})
+	}
+}
@@ -2,6 +2,9 @@ package tgc
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
@@ -19,7 +22,6 @@ import (
 	"github.com/tgdrive/teldrive/internal/utils"
 	"go.uber.org/zap"
 	"golang.org/x/net/proxy"
-	"golang.org/x/time/rate"
 )
 
 func New(ctx context.Context, config *config.TGConfig, handler telegram.UpdateHandler, storage session.Storage, middlewares ...telegram.Middleware) (*telegram.Client, error) {
@@ -44,7 +46,7 @@ func New(ctx context.Context, config *config.TGConfig, handler telegram.UpdateHa
 			Dial: dialer,
 		}),
 		ReconnectionBackoff: func() backoff.BackOff {
-			return newBackoff(config.ReconnectTimeout)
+			return ReconnectOptionsFor(config).backoff()
 		},
 		Device: telegram.DeviceConfig{
 			DeviceModel:    config.DeviceModel,
@@ -63,19 +65,30 @@ func New(ctx context.Context, config *config.TGConfig, handler telegram.UpdateHa
 		Logger:         logger,
 	}
 
+	if o := DCOverrideFrom(ctx); o != nil {
+		if err := o.checkSession(ctx, storage); err != nil {
+			return nil, err
+		}
+		o.apply(&opts)
+		logging.FromContext(ctx).Warnw("telegram client with dc override", "dc", o.DC, "addr", o.Addr)
+	}
+
 	return telegram.NewClient(config.AppId, config.AppHash, opts), nil
 }
 
-func NoAuthClient(ctx context.Context, config *config.TGConfig, handler telegram.UpdateHandler, storage session.Storage) (*telegram.Client, error) {
+// NoAuthClient builds a client for a login, limited to limit whether or not
+// rate limiting is enabled.
+func NoAuthClient(ctx context.Context, config *config.TGConfig, handler telegram.UpdateHandler, storage session.Storage,
+	limit RateLimit) (*telegram.Client, error) {
 	middlewares := []telegram.Middleware{
 		floodwait.NewSimpleWaiter(),
+		ratelimit.New(limit.every(), limit.Burst),
 	}
-	middlewares = append(middlewares, ratelimit.New(rate.Every(time.Millisecond*100), 5))
 	return New(ctx, config, handler, storage, middlewares...)
 }
 
 func AuthClient(ctx context.Context, config *config.TGConfig, sessionStr string, middlewares ...telegram.Middleware) (*telegram.Client, error) {
-	data, err := session.TelethonSession(sessionStr)
+	data, err := ParseSession(sessionStr)
 
 	if err != nil {
 		return nil, err
@@ -92,31 +105,135 @@ func AuthClient(ctx context.Context, config *config.TGConfig, sessionStr string,
 	return New(ctx, config, nil, storage, middlewares...)
 }
 
-func BotClient(ctx context.Context, KV kv.KV, config *config.TGConfig, token string, middlewares ...telegram.Middleware) (*telegram.Client, error) {
+// BotSessionKey namespaces a bot session by the owning user and stores only a
+// hash of the token so the secret never ends up in the session store.
+func BotSessionKey(userId int64, token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return kv.Key("botsession", strconv.FormatInt(userId, 10), hex.EncodeToString(hash[:]))
+}
+
+func BotClient(ctx context.Context, KV kv.KV, config *config.TGConfig, userId int64, token string, middlewares ...telegram.Middleware) (*telegram.Client, error) {
 
-	storage := kv.NewSession(KV, kv.Key("botsession", token))
+	storage := kv.NewSession(KV, BotSessionKey(userId, token))
 
 	return New(ctx, config, nil, storage, middlewares...)
 
 }
 
-func Middlewares(config *config.TGConfig, retries int) []telegram.Middleware {
-	middlewares := []telegram.Middleware{
-		floodwait.NewSimpleWaiter(),
-		recovery.New(context.Background(), newBackoff(config.ReconnectTimeout)),
-		retry.New(retries),
+// RateLimit allows one request every Rate milliseconds with bursts of up to
+// Burst requests.
+type RateLimit struct {
+	Rate  int
+	Burst int
+}
+
+const (
+	MaxRate  = 60000
+	MaxBurst = 100
+)
+
+var ErrInvalidRateLimit = errors.New("rate must be between 1 and 60000 and burst between 1 and 100")
+
+func (l RateLimit) Validate() error {
+	if l.Rate < 1 || l.Rate > MaxRate || l.Burst < 1 || l.Burst > MaxBurst {
+		return ErrInvalidRateLimit
+	}
+	return nil
+}
+
+func mergeRateLimit(config *config.TGConfig, rate, burst *int) RateLimit {
+	limit := RateLimit{Rate: config.Rate, Burst: config.RateBurst}
+	if rate != nil {
+		limit.Rate = *rate
+	}
+	if burst != nil {
+		limit.Burst = *burst
 	}
+	return limit
+}
+
+// EffectiveRateLimit overrides the configured defaults with the values stored
+// for a user or bot, ignoring stored values that are invalid.
+func EffectiveRateLimit(config *config.TGConfig, rate, burst *int) RateLimit {
+	limit := mergeRateLimit(config, rate, burst)
+	if limit.Validate() != nil {
+		return mergeRateLimit(config, nil, nil)
+	}
+	return limit
+}
+
+// ValidateRateLimit checks rate and burst merged with the configured defaults.
+func ValidateRateLimit(config *config.TGConfig, rate, burst *int) error {
+	return mergeRateLimit(config, rate, burst).Validate()
+}
+
+// Operation selects the retry policy of the requests made for it.
+type Operation string
+
+const (
+	OpUpload   Operation = "upload"
+	OpDownload Operation = "download"
+	OpControl  Operation = "control"
+)
+
+var Operations = []Operation{OpUpload, OpDownload, OpControl}
+
+// RetryPolicyFor returns the configured retry policy of op.
+func RetryPolicyFor(config *config.TGConfig, op Operation) retry.Policy {
+	policy := config.Retry.Control
+	switch op {
+	case OpUpload:
+		policy = config.Retry.Upload
+	case OpDownload:
+		policy = config.Retry.Download
+	}
+	return retry.Policy(policy)
+}
+
+func ValidateRetryPolicy(policy retry.Policy) error {
+	switch {
+	case policy.MaxRetries < 1:
+		return errors.New("max retries must be at least 1")
+	case policy.Backoff < 0 || policy.MaxBackoff < 0 || policy.Timeout < 0:
+		return errors.New("durations must not be negative")
+	case policy.MaxBackoff > 0 && policy.MaxBackoff < policy.Backoff:
+		return errors.New("max backoff must not be below backoff")
+	}
+	return nil
+}
+
+func Middlewares(config *config.TGConfig, op Operation) []telegram.Middleware {
+	return MiddlewaresWithLimit(config, op, RateLimit{Rate: config.Rate, Burst: config.RateBurst})
+}
+
+func MiddlewaresWithLimit(config *config.TGConfig, op Operation, limit RateLimit) []telegram.Middleware {
+	middlewares := baseMiddlewares(config, op)
 	if config.RateLimit {
-		middlewares = append(middlewares, ratelimit.New(rate.Every(time.Millisecond*time.Duration(config.Rate)), config.RateBurst))
+		middlewares = append(middlewares, ratelimit.New(limit.every(), limit.Burst))
 	}
 	return middlewares
 
 }
 
-func newBackoff(timeout time.Duration) backoff.BackOff {
-	b := backoff.NewExponentialBackOff()
-	b.Multiplier = 1.1
-	b.MaxElapsedTime = timeout
-	b.MaxInterval = 10 * time.Second
-	return b
+func baseMiddlewares(config *config.TGConfig, op Operation) []telegram.Middleware {
+	return []telegram.Middleware{
+		floodWaiter(config),
+		recovery.New(context.Background(), ReconnectOptionsFor(config).backoff()),
+		retry.NewPolicy(RetryPolicyFor(config, op)),
+	}
+}
+
+// floodWaiter waits out short flood waits. Longer ones fail the request so the
+// client gets a 429 to back off on instead of a request that hangs.
+func floodWaiter(config *config.TGConfig) *floodwait.SimpleWaiter {
+	return floodwait.NewSimpleWaiter().WithMaxWait(config.FloodMaxWait)
+}
+
+// clientMiddlewares apply to every request of a pooled client that is not
+// made through middlewares of its own, which are control requests.
+func clientMiddlewares(config *config.TGConfig) []telegram.Middleware {
+	return []telegram.Middleware{
+		floodWaiter(config),
+		retry.NewPolicy(RetryPolicyFor(config, OpControl)),
+	}
 }
@@ -0,0 +1,55 @@
+package tgc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/internal/config"
+)
+
+func TestEffectiveRateLimit(t *testing.T) {
+	cnf := &config.TGConfig{Rate: 100, RateBurst: 5}
+
+	assert.Equal(t, RateLimit{Rate: 100, Burst: 5}, EffectiveRateLimit(cnf, nil, nil))
+
+	rate, burst := 50, 10
+	assert.Equal(t, RateLimit{Rate: 50, Burst: 10}, EffectiveRateLimit(cnf, &rate, &burst))
+	assert.Equal(t, RateLimit{Rate: 50, Burst: 5}, EffectiveRateLimit(cnf, &rate, nil))
+
+	invalid := 0
+	assert.Equal(t, RateLimit{Rate: 100, Burst: 5}, EffectiveRateLimit(cnf, &invalid, &burst))
+	assert.Error(t, ValidateRateLimit(cnf, &invalid, nil))
+	assert.NoError(t, ValidateRateLimit(cnf, nil, &burst))
+}
+
+func TestBotSessionKey(t *testing.T) {
+	token := "123456:secret"
+	key := BotSessionKey(42, token)
+
+	assert.NotContains(t, key, "secret")
+	assert.True(t, strings.HasPrefix(key, "botsession:42:"))
+	assert.NotEqual(t, key, BotSessionKey(43, token))
+}
+
+func TestAppCredentials(t *testing.T) {
+	cnf := &config.TGConfig{AppId: 1, AppHash: "global"}
+
+	creds, err := NewAppCredentials(nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, creds)
+	assert.Same(t, cnf, WithApp(cnf, creds))
+
+	id, hash, short := 12345, "0123456789abcdef0123456789abcdef", "abc"
+	_, err = NewAppCredentials(&id, nil)
+	assert.ErrorIs(t, err, ErrInvalidAppCredentials)
+	_, err = NewAppCredentials(&id, &short)
+	assert.ErrorIs(t, err, ErrInvalidAppCredentials)
+
+	creds, err = NewAppCredentials(&id, &hash)
+	assert.NoError(t, err)
+	app := WithApp(cnf, creds)
+	assert.Equal(t, 12345, app.AppId)
+	assert.Equal(t, hash, app.AppHash)
+	assert.Equal(t, 1, cnf.AppId)
+}
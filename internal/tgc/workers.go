@@ -2,6 +2,8 @@ package tgc
 
 import (
 	"context"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -12,35 +14,42 @@ import (
 	"go.uber.org/zap"
 )
 
+// BotWorker rotates through the bots of a pool, keyed by channel and role.
 type BotWorker struct {
-	mu      sync.RWMutex
-	bots    map[int64][]string
-	currIdx map[int64]int
+	mu      sync.Mutex
+	bots    map[string][]string
+	currIdx map[string]int
 }
 
 func NewBotWorker() *BotWorker {
 	return &BotWorker{
-		bots:    make(map[int64][]string),
-		currIdx: make(map[int64]int),
+		bots:    make(map[string][]string),
+		currIdx: make(map[string]int),
 	}
 }
 
-func (w *BotWorker) Set(bots []string, channelID int64) {
+// BotPoolKey identifies the bots used for role in a channel.
+func BotPoolKey(channelID int64, role string) string {
+	return strconv.FormatInt(channelID, 10) + ":" + role
+}
+
+// Set registers the bots of a pool. The rotation restarts when they changed.
+func (w *BotWorker) Set(bots []string, key string) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	if _, ok := w.bots[channelID]; ok {
+	if slices.Equal(w.bots[key], bots) {
 		return
 	}
-	w.bots[channelID] = bots
-	w.currIdx[channelID] = 0
+	w.bots[key] = bots
+	w.currIdx[key] = 0
 }
 
-func (w *BotWorker) Next(channelID int64) (string, int) {
-	w.mu.RLock()
-	defer w.mu.RUnlock()
-	bots := w.bots[channelID]
-	index := w.currIdx[channelID]
-	w.currIdx[channelID] = (index + 1) % len(bots)
+func (w *BotWorker) Next(key string) (string, int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	bots := w.bots[key]
+	index := w.currIdx[key]
+	w.currIdx[key] = (index + 1) % len(bots)
 	return bots[index], index
 }
 
@@ -63,6 +72,7 @@ type StreamWorker struct {
 	clients       map[string]*Client
 	currIdx       map[int64]int
 	channelBots   map[int64][]string
+	channelOwner  map[int64]int64
 	cnf           *config.TGConfig
 	kv            kv.KV
 	ctx           context.Context
@@ -74,24 +84,26 @@ type StreamWorker struct {
 func NewStreamWorker(cnf *config.Config, kv kv.KV, logger *zap.SugaredLogger) *StreamWorker {
 	ctx, cancel := context.WithCancel(context.Background())
 	worker := &StreamWorker{
-		cnf:         &cnf.TG,
-		kv:          kv,
-		ctx:         ctx,
-		clients:     make(map[string]*Client),
-		currIdx:     make(map[int64]int),
-		channelBots: make(map[int64][]string),
-		logger:      logger,
-		cancel:      cancel,
+		cnf:          &cnf.TG,
+		kv:           kv,
+		ctx:          ctx,
+		clients:      make(map[string]*Client),
+		currIdx:      make(map[int64]int),
+		channelBots:  make(map[int64][]string),
+		channelOwner: make(map[int64]int64),
+		logger:       logger,
+		cancel:       cancel,
 	}
 	go worker.startIdleClientMonitor()
 	return worker
 
 }
 
-func (w *StreamWorker) Set(bots []string, channelID int64) {
+func (w *StreamWorker) Set(bots []string, channelID, ownerID int64) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	w.channelBots[channelID] = bots
+	w.channelOwner[channelID] = ownerID
 	w.currIdx[channelID] = 0
 }
 
@@ -104,7 +116,7 @@ func (w *StreamWorker) Next(channelID int64) (*Client, error) {
 	token := bots[index]
 	userID := strings.Split(token, ":")[0]
 
-	client, err := w.getOrCreateClient(userID, token)
+	client, err := w.getOrCreateClient(w.channelOwner[channelID], userID, token)
 	if err != nil {
 		return nil, err
 	}
@@ -133,11 +145,11 @@ func (w *StreamWorker) DecActiveStreams() error {
 	return nil
 }
 
-func (w *StreamWorker) getOrCreateClient(userID, token string) (*Client, error) {
+func (w *StreamWorker) getOrCreateClient(ownerID int64, userID, token string) (*Client, error) {
 	client, ok := w.clients[userID]
 	if !ok || (client.Status == StatusIdle && client.Stop == nil) {
-		middlewares := Middlewares(w.cnf, 5)
-		tgClient, _ := BotClient(w.ctx, w.kv, w.cnf, token, middlewares...)
+		middlewares := Middlewares(w.cnf, OpDownload)
+		tgClient, _ := BotClient(w.ctx, w.kv, w.cnf, ownerID, token, middlewares...)
 		client = &Client{Tg: tgClient, Status: StatusIdle, UserID: userID}
 		w.clients[userID] = client
 		stop, err := Connect(client.Tg, WithBotToken(token))
@@ -181,3 +193,18 @@ func (w *StreamWorker) checkIdleClients() {
 	}
 
 }
+
+// Close disconnects every stream client and stops the idle monitor.
+func (w *StreamWorker) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	defer w.cancel()
+	for _, client := range w.clients {
+		if client.Stop != nil {
+			client.Stop()
+			client.Stop = nil
+			client.Tg = nil
+			client.Status = StatusIdle
+		}
+	}
+}
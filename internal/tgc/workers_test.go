@@ -0,0 +1,28 @@
+package tgc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBotWorkerPools(t *testing.T) {
+	w := NewBotWorker()
+	upload, download := BotPoolKey(1, "upload"), BotPoolKey(1, "download")
+	w.Set([]string{"a", "b"}, upload)
+	w.Set([]string{"c"}, download)
+
+	bot, _ := w.Next(upload)
+	assert.Equal(t, "a", bot)
+	bot, _ = w.Next(download)
+	assert.Equal(t, "c", bot)
+
+	w.Set([]string{"a", "b"}, upload)
+	bot, index := w.Next(upload)
+	assert.Equal(t, "b", bot)
+	assert.Equal(t, 1, index)
+
+	w.Set([]string{"d", "e"}, upload)
+	bot, _ = w.Next(upload)
+	assert.Equal(t, "d", bot)
+}
@@ -0,0 +1,436 @@
+package check
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"go.uber.org/zap"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+const (
+	KindBrokenParent  = "broken-parent"
+	KindExpiredUpload = "expired-upload"
+	KindMissingParts  = "missing-parts"
+)
+
+// LostAndFound collects entries whose parent chain is broken.
+const LostAndFound = "/lost+found"
+
+// StatusUnavailable marks files whose content is gone from Telegram. They
+// drop out of listings like deleted files but keep their row for inspection.
+const StatusUnavailable = "unavailable"
+
+type Finding struct {
+	Kind     string
+	UserId   int64
+	FileId   string
+	Detail   string
+	Repaired bool
+}
+
+// RunFunc runs f with a Telegram client of session.
+type RunFunc func(ctx context.Context, session string, f func(ctx context.Context, api *tg.Client) error) error
+
+type Options struct {
+	// Repair fixes what can be undone: orphaned entries are moved to
+	// LostAndFound, expired upload rows are dropped and files with missing
+	// parts are marked unavailable.
+	Repair bool
+	// DeleteMessages also deletes the Telegram messages of expired uploads.
+	DeleteMessages bool
+	SkipTelegram   bool
+	// UserId limits the check to the data of one user, 0 checks all users.
+	UserId int64
+	// Kinds limits the check to some kinds of problems, empty checks all.
+	Kinds []string
+	// FileIds limits the check to some entries. Expired uploads belong to no
+	// entry and are skipped.
+	FileIds []string
+	// Destination is the folder orphaned entries are moved to, LostAndFound
+	// by default.
+	Destination string
+	// Run lends clients to the Telegram checks, by default a client is
+	// dialed for every user.
+	Run RunFunc
+}
+
+// Kinds lists the problems a Checker looks for.
+var Kinds = []string{KindBrokenParent, KindExpiredUpload, KindMissingParts}
+
+// Checker scans the database for inconsistencies with itself and with the
+// messages stored in Telegram.
+type Checker struct {
+	db       *gorm.DB
+	cnf      *config.Config
+	opts     Options
+	logger   *zap.SugaredLogger
+	findings []Finding
+}
+
+func New(db *gorm.DB, cnf *config.Config, opts Options, logger *zap.SugaredLogger) *Checker {
+	return &Checker{db: db, cnf: cnf, opts: opts, logger: logger}
+}
+
+func (c *Checker) Run(ctx context.Context) ([]Finding, error) {
+	c.findings = nil
+	if c.enabled(KindBrokenParent) {
+		if err := c.checkParents(); err != nil {
+			return c.findings, fmt.Errorf("check parents: %w", err)
+		}
+	}
+	sessions, err := c.sessions()
+	if err != nil {
+		return c.findings, err
+	}
+	if c.enabled(KindExpiredUpload) && len(c.opts.FileIds) == 0 {
+		if err := c.checkUploads(ctx, sessions); err != nil {
+			return c.findings, fmt.Errorf("check uploads: %w", err)
+		}
+	}
+	if c.enabled(KindMissingParts) && !c.opts.SkipTelegram {
+		if err := c.checkParts(ctx, sessions); err != nil {
+			return c.findings, fmt.Errorf("check parts: %w", err)
+		}
+	}
+	return c.findings, nil
+}
+
+func (c *Checker) enabled(kind string) bool {
+	return len(c.opts.Kinds) == 0 || slices.Contains(c.opts.Kinds, kind)
+}
+
+// scope limits a query to the user and entries the check is run for.
+func (c *Checker) scope(db *gorm.DB) *gorm.DB {
+	if c.opts.UserId != 0 {
+		db = db.Where("user_id = ?", c.opts.UserId)
+	}
+	if len(c.opts.FileIds) > 0 {
+		db = db.Where("id IN ?", c.opts.FileIds)
+	}
+	return db
+}
+
+type entry struct {
+	Id       string
+	UserId   int64
+	Name     string
+	ParentId *string
+}
+
+// orphanHeads returns the entries of an unreachable set that have to move
+// for all of it to become reachable again: those whose parent is outside the
+// set, and the lowest id of every parent cycle.
+func orphanHeads(entries []entry) []entry {
+	byId := make(map[string]entry, len(entries))
+	for _, e := range entries {
+		byId[e.Id] = e
+	}
+	heads := map[string]bool{}
+	for _, e := range entries {
+		seen := map[string]bool{}
+		cur := e
+		for {
+			if cur.ParentId == nil {
+				heads[cur.Id] = true
+				break
+			}
+			parent, ok := byId[*cur.ParentId]
+			if !ok {
+				heads[cur.Id] = true
+				break
+			}
+			if seen[cur.Id] {
+				cycle := []string{}
+				for id := cur.Id; ; {
+					cycle = append(cycle, id)
+					id = *byId[id].ParentId
+					if id == cur.Id {
+						break
+					}
+				}
+				heads[slices.Min(cycle)] = true
+				break
+			}
+			seen[cur.Id] = true
+			cur = parent
+		}
+	}
+	res := []entry{}
+	for _, e := range entries {
+		if heads[e.Id] {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// checkParents finds active entries that cannot be reached from their user's
+// root folder, because a parent is missing, is a file or is part of a cycle.
+func (c *Checker) checkParents() error {
+	var unreachable []entry
+	if err := c.db.Raw(`WITH RECURSIVE reachable AS (
+		SELECT id, type FROM teldrive.files WHERE parent_id IS NULL AND type = 'folder'
+		AND (@user = 0 OR user_id = @user)
+		UNION ALL
+		SELECT f.id, f.type FROM teldrive.files f JOIN reachable r ON f.parent_id = r.id AND r.type = 'folder'
+	) SELECT id, user_id, name, parent_id FROM teldrive.files f
+	WHERE f.status = 'active' AND (@user = 0 OR f.user_id = @user)
+	AND NOT EXISTS (SELECT 1 FROM reachable r WHERE r.id = f.id)`, sql.Named("user", c.opts.UserId)).
+		Scan(&unreachable).Error; err != nil {
+		return err
+	}
+
+	for _, head := range orphanHeads(unreachable) {
+		if len(c.opts.FileIds) > 0 && !slices.Contains(c.opts.FileIds, head.Id) {
+			continue
+		}
+		finding := Finding{Kind: KindBrokenParent, UserId: head.UserId, FileId: head.Id,
+			Detail: fmt.Sprintf("%q is not reachable from the root folder", head.Name)}
+		if c.opts.Repair {
+			if err := c.adopt(head); err != nil {
+				c.logger.Warnw("failed to move entry to lost+found", "file", head.Id, "err", err)
+			} else {
+				finding.Repaired = true
+			}
+		}
+		c.findings = append(c.findings, finding)
+	}
+	return nil
+}
+
+// adopt moves an orphaned entry below the destination folder, suffixing its
+// name with its id so it cannot collide with an earlier one.
+func (c *Checker) adopt(e entry) error {
+	dest := c.opts.Destination
+	if dest == "" {
+		dest = LostAndFound
+	}
+	return c.db.Transaction(func(tx *gorm.DB) error {
+		var ids []string
+		if err := tx.Raw("select id from teldrive.create_directories(?, ?)", e.UserId, dest).
+			Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return fmt.Errorf("create %s failed", dest)
+		}
+		return tx.Model(&models.File{}).Where("id = ?", e.Id).Updates(map[string]any{
+			"parent_id": ids[0],
+			"name":      fmt.Sprintf("%s (%s)", e.Name, e.Id[:min(len(e.Id), 8)]),
+		}).Error
+	})
+}
+
+type session struct {
+	UserId  int64
+	Session string
+	AppId   *int
+	AppHash *string
+}
+
+// sessions returns the latest session of every user.
+func (c *Checker) sessions() (map[int64]session, error) {
+	var rows []session
+	if err := c.db.Raw(`SELECT DISTINCT ON (user_id) user_id, session, app_id, app_hash
+		FROM teldrive.sessions WHERE @user = 0 OR user_id = @user ORDER BY user_id, created_at DESC`,
+		sql.Named("user", c.opts.UserId)).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	res := make(map[int64]session, len(rows))
+	for _, row := range rows {
+		res[row.UserId] = row
+	}
+	return res, nil
+}
+
+// runAs runs f with a client of the user's latest session.
+func (c *Checker) runAs(ctx context.Context, s session, f func(ctx context.Context, api *tg.Client) error) error {
+	if c.opts.Run != nil {
+		return c.opts.Run(ctx, s.Session, f)
+	}
+	creds, _ := tgc.NewAppCredentials(s.AppId, s.AppHash)
+	client, err := tgc.AuthClient(ctx, tgc.WithApp(&c.cnf.TG, creds), s.Session, tgc.Middlewares(&c.cnf.TG, tgc.OpControl)...)
+	if err != nil {
+		return err
+	}
+	return client.Run(ctx, func(ctx context.Context) error {
+		return f(ctx, client.API())
+	})
+}
+
+// checkUploads reports upload rows kept past the retention, which a server
+// whose cleanup job did not run leaves behind. Uploads whose retention was
+// extended are kept until it runs out.
+func (c *Checker) checkUploads(ctx context.Context, sessions map[int64]session) error {
+	var rows []struct {
+		UserId    int64
+		ChannelId int64
+		Parts     datatypes.JSONSlice[int]
+	}
+	if err := c.scope(c.db.Model(&models.Upload{})).Select("user_id", "channel_id", "JSONB_AGG(part_id) as parts").
+		Scopes(ExpiredUploads(c.cnf.TG.Uploads.Retention, time.Now().UTC())).
+		Group("user_id").Group("channel_id").Scan(&rows).Error; err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		finding := Finding{Kind: KindExpiredUpload, UserId: row.UserId,
+			Detail: fmt.Sprintf("%d upload parts in channel %d are past retention", len(row.Parts), row.ChannelId)}
+		if c.opts.Repair {
+			var err error
+			if s, ok := sessions[row.UserId]; c.opts.DeleteMessages && ok {
+				err = c.runAs(ctx, s, func(ctx context.Context, api *tg.Client) error {
+					_, err := tgc.DeleteChannelMessages(ctx, api, map[int64][]int{row.ChannelId: row.Parts},
+						tgc.DeleteOptionsFor(&c.cnf.TG))
+					return err
+				})
+			}
+			if err == nil {
+				err = c.db.Where("user_id = ?", row.UserId).Where("channel_id = ?", row.ChannelId).
+					Where("part_id IN ?", []int(row.Parts)).Delete(&models.Upload{}).Error
+			}
+			if err != nil {
+				c.logger.Warnw("failed to purge uploads", "user", row.UserId, "channel", row.ChannelId, "err", err)
+			} else {
+				finding.Repaired = true
+			}
+		}
+		c.findings = append(c.findings, finding)
+	}
+	return nil
+}
+
+// presentParts returns the ids of messages that still carry a document.
+func presentParts(messages []tg.MessageClass) map[int]bool {
+	present := make(map[int]bool, len(messages))
+	for _, message := range messages {
+		m, ok := message.(*tg.Message)
+		if !ok {
+			continue
+		}
+		if media, ok := m.Media.(*tg.MessageMediaDocument); ok {
+			if _, ok := media.Document.(*tg.Document); ok {
+				present[m.ID] = true
+			}
+		}
+	}
+	return present
+}
+
+// checkParts looks up the messages of every active file stored in Telegram
+// and reports files with parts that no longer exist.
+func (c *Checker) checkParts(ctx context.Context, sessions map[int64]session) error {
+	var groups []struct {
+		UserId    int64
+		ChannelId int64
+	}
+	if err := c.scope(c.db.Model(&models.File{})).Distinct("user_id", "channel_id").
+		Where("type = ?", "file").Where("status = ?", "active").
+		Where("inline_data IS NULL").Where("channel_id IS NOT NULL").
+		Scan(&groups).Error; err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		s, ok := sessions[group.UserId]
+		if !ok {
+			c.logger.Warnw("skipping parts check, user has no session", "user", group.UserId)
+			continue
+		}
+
+		var files []struct {
+			Id    string
+			Name  string
+			Parts datatypes.JSONSlice[schemas.Part]
+		}
+		if err := c.scope(c.db.Model(&models.File{})).Select("id", "name", "parts").
+			Where("user_id = ?", group.UserId).Where("channel_id = ?", group.ChannelId).
+			Where("type = ?", "file").Where("status = ?", "active").Where("inline_data IS NULL").
+			Scan(&files).Error; err != nil {
+			return err
+		}
+
+		ids := []int{}
+		for _, file := range files {
+			for _, part := range file.Parts {
+				ids = append(ids, int(part.ID))
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+
+		var (
+			present  map[int]bool
+			replicas = map[schemas.Replica]bool{}
+		)
+		if err := c.runAs(ctx, s, func(ctx context.Context, api *tg.Client) error {
+			messages, err := tgc.GetMessages(ctx, api, ids, group.ChannelId)
+			if err != nil {
+				return err
+			}
+			present = presentParts(messages)
+
+			// Parts lost from the channel are still readable from a replica.
+			lost := []schemas.Part{}
+			for _, file := range files {
+				for _, part := range file.Parts {
+					if !present[int(part.ID)] {
+						lost = append(lost, part)
+					}
+				}
+			}
+			for channelId, ids := range schemas.ReplicaMessages(lost) {
+				messages, err := tgc.GetMessages(ctx, api, ids, channelId)
+				if err != nil {
+					c.logger.Warnw("failed to read replica messages", "user", group.UserId, "channel", channelId, "err", err)
+					continue
+				}
+				for id := range presentParts(messages) {
+					replicas[schemas.Replica{ChannelID: channelId, ID: int64(id)}] = true
+				}
+			}
+			return nil
+		}); err != nil {
+			c.logger.Warnw("failed to read channel messages", "user", group.UserId, "channel", group.ChannelId, "err", err)
+			continue
+		}
+
+		for _, file := range files {
+			if len(file.Parts) == 0 {
+				continue
+			}
+			missing := 0
+			for _, part := range file.Parts {
+				if !present[int(part.ID)] && !slices.ContainsFunc(part.Replicas, func(r schemas.Replica) bool { return replicas[r] }) {
+					missing++
+				}
+			}
+			if missing == 0 {
+				continue
+			}
+			finding := Finding{Kind: KindMissingParts, UserId: group.UserId, FileId: file.Id,
+				Detail: fmt.Sprintf("%q is missing %d of %d parts", file.Name, missing, len(file.Parts))}
+			if c.opts.Repair {
+				if err := c.db.Model(&models.File{}).Where("id = ?", file.Id).
+					Update("status", StatusUnavailable).Error; err != nil {
+					c.logger.Warnw("failed to mark file unavailable", "file", file.Id, "err", err)
+				} else {
+					finding.Repaired = true
+				}
+			}
+			c.findings = append(c.findings, finding)
+		}
+	}
+	return nil
+}
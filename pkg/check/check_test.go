@@ -0,0 +1,49 @@
+package check
+
+import (
+	"testing"
+
+	"github.com/gotd/td/tg"
+	"github.com/stretchr/testify/assert"
+)
+
+func ptr(s string) *string { return &s }
+
+func headIds(entries []entry) []string {
+	ids := []string{}
+	for _, e := range entries {
+		ids = append(ids, e.Id)
+	}
+	return ids
+}
+
+func TestOrphanHeads(t *testing.T) {
+	entries := []entry{
+		// a's parent is gone, b and c hang below it.
+		{Id: "a", ParentId: ptr("missing")},
+		{Id: "b", ParentId: ptr("a")},
+		{Id: "c", ParentId: ptr("b")},
+		// x, y and z form a cycle with w below it.
+		{Id: "y", ParentId: ptr("x")},
+		{Id: "z", ParentId: ptr("y")},
+		{Id: "x", ParentId: ptr("z")},
+		{Id: "w", ParentId: ptr("z")},
+		// A second root without parent.
+		{Id: "r"},
+	}
+	assert.ElementsMatch(t, []string{"a", "x", "r"}, headIds(orphanHeads(entries)))
+	assert.Empty(t, orphanHeads(nil))
+
+	self := []entry{{Id: "s", ParentId: ptr("s")}}
+	assert.Equal(t, []string{"s"}, headIds(orphanHeads(self)))
+}
+
+func TestPresentParts(t *testing.T) {
+	messages := []tg.MessageClass{
+		&tg.Message{ID: 1, Media: &tg.MessageMediaDocument{Document: &tg.Document{ID: 10}}},
+		&tg.Message{ID: 2, Media: &tg.MessageMediaDocument{Document: &tg.DocumentEmpty{}}},
+		&tg.Message{ID: 3},
+		&tg.MessageEmpty{ID: 4},
+	}
+	assert.Equal(t, map[int]bool{1: true}, presentParts(messages))
+}
@@ -0,0 +1,27 @@
+package check
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// extended matches upload parts whose upload has its retention extended past
+// a moment.
+const extended = `EXISTS (SELECT 1 FROM teldrive.upload_retentions AS retention
+	WHERE retention.upload_id = uploads.upload_id AND retention.user_id = uploads.user_id AND retention.expires_at > ?)`
+
+// ExpiredUploads scopes upload parts to those older than retention whose
+// upload was not extended past now.
+func ExpiredUploads(retention time.Duration, now time.Time) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("uploads.created_at < ? AND NOT "+extended, now.Add(-retention), now)
+	}
+}
+
+// LiveUploads scopes upload parts to those ExpiredUploads leaves out.
+func LiveUploads(retention time.Duration, now time.Time) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("(uploads.created_at >= ? OR "+extended+")", now.Add(-retention), now)
+	}
+}
@@ -0,0 +1,192 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tgdrive/teldrive/pkg/httputil"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+)
+
+func (ac *Controller) GetLogLevel(c *gin.Context) {
+	c.JSON(http.StatusOK, ac.AdminService.GetLogLevel())
+}
+
+func (ac *Controller) GetSchedulerQueues(c *gin.Context) {
+	c.JSON(http.StatusOK, ac.AdminService.GetSchedulerQueues())
+}
+
+func (ac *Controller) GetRetryPolicies(c *gin.Context) {
+	c.JSON(http.StatusOK, ac.AdminService.GetRetryPolicies())
+}
+
+func (ac *Controller) CheckTelegram(c *gin.Context) {
+	res, err := ac.AdminService.CheckTelegram(c)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (ac *Controller) SetLogLevel(c *gin.Context) {
+	var payload schemas.LogLevel
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := ac.AdminService.SetLogLevel(&payload)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func adminUserParam(c *gin.Context) (int64, bool) {
+	userId, err := strconv.ParseInt(c.Param("userId"), 10, 64)
+	if err != nil {
+		httputil.NewError(c, http.StatusBadRequest, errors.New("invalid user id"))
+		return 0, false
+	}
+	return userId, true
+}
+
+func (ac *Controller) GetUserFileTypes(c *gin.Context) {
+	userId, ok := adminUserParam(c)
+	if !ok {
+		return
+	}
+
+	res, err := ac.AdminService.GetUserFileTypes(userId)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (ac *Controller) SetUserFileTypes(c *gin.Context) {
+	userId, ok := adminUserParam(c)
+	if !ok {
+		return
+	}
+
+	var payload schemas.FileTypes
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := ac.AdminService.SetUserFileTypes(userId, &payload)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (ac *Controller) ResetUserFileTypes(c *gin.Context) {
+	userId, ok := adminUserParam(c)
+	if !ok {
+		return
+	}
+
+	res, err := ac.AdminService.SetUserFileTypes(userId, nil)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (ac *Controller) GetUserEntryLimits(c *gin.Context) {
+	userId, ok := adminUserParam(c)
+	if !ok {
+		return
+	}
+
+	res, err := ac.AdminService.GetUserEntryLimits(userId)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (ac *Controller) SetUserEntryLimits(c *gin.Context) {
+	userId, ok := adminUserParam(c)
+	if !ok {
+		return
+	}
+
+	var payload schemas.EntryLimits
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := ac.AdminService.SetUserEntryLimits(userId, &payload)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (ac *Controller) ResetUserEntryLimits(c *gin.Context) {
+	userId, ok := adminUserParam(c)
+	if !ok {
+		return
+	}
+
+	res, err := ac.AdminService.SetUserEntryLimits(userId, nil)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (ac *Controller) ListOrphans(c *gin.Context) {
+	query := schemas.OrphanQuery{Limit: 100, Page: 1}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := ac.AdminService.ListOrphans(c, &query)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (ac *Controller) RepairOrphans(c *gin.Context) {
+	var payload schemas.OrphanRepair
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := ac.AdminService.RepairOrphans(c, &payload)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
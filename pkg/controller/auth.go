@@ -31,6 +31,23 @@ func (ac *Controller) LogIn(c *gin.Context) {
 	c.JSON(http.StatusOK, res)
 }
 
+func (ac *Controller) ValidateSession(c *gin.Context) {
+
+	var check schemas.SessionCheck
+	if err := c.ShouldBindJSON(&check); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := ac.AuthService.ValidateSession(c, &check)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
 func (ac *Controller) Logout(c *gin.Context) {
 	res, err := ac.AuthService.Logout(c)
 	if err != nil {
@@ -41,6 +58,10 @@ func (ac *Controller) Logout(c *gin.Context) {
 	c.JSON(http.StatusOK, res)
 }
 
+func (ac *Controller) GetLoginGate(c *gin.Context) {
+	c.JSON(http.StatusOK, ac.AuthService.GetLoginGate())
+}
+
 func (ac *Controller) HandleMultipleLogin(c *gin.Context) {
 	ac.AuthService.HandleMultipleLogin(c)
 }
@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tgdrive/teldrive/pkg/httputil"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+)
+
+var browseTemplate = template.Must(template.New("browse").Funcs(template.FuncMap{
+	"size": humanSize,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Name}}{{.Path}}</title>
+<style>
+body{font-family:system-ui,sans-serif;margin:2rem auto;max-width:960px;padding:0 1rem}
+table{border-collapse:collapse;width:100%}
+th,td{padding:.4rem .6rem;text-align:left;border-bottom:1px solid #ddd}
+td.size{text-align:right;white-space:nowrap}
+</style>
+</head>
+<body>
+<h1>{{.Name}}{{.Path}}</h1>
+<table>
+<thead><tr><th>Name</th><th>Size</th><th>Modified</th></tr></thead>
+<tbody>
+{{if .Parent}}<tr><td><a href="{{.Parent}}">../</a></td><td></td><td></td></tr>{{end}}
+{{range .Files}}<tr>
+<td><a href="{{.URL}}">{{.Name}}{{if eq .Type "folder"}}/{{end}}</a></td>
+<td class="size">{{if eq .Type "file"}}{{size .Size}}{{end}}</td>
+<td>{{.UpdatedAt.Format "2006-01-02 15:04"}}</td>
+</tr>{{end}}
+</tbody>
+</table>
+<p>Page {{.Meta.CurrentPage}} of {{.Meta.TotalPages}}</p>
+</body>
+</html>
+`))
+
+func (sc *Controller) BrowseShare(c *gin.Context) {
+
+	query := schemas.BrowseQuery{
+		Limit: 100,
+		Page:  1,
+		Order: "asc",
+		Sort:  "name",
+	}
+
+	if err := c.ShouldBindQuery(&query); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := sc.ShareService.Browse(c.Param("slug"), c.Param("path"), httputil.BasePath(c.Request), &query, c.GetHeader("Authorization"))
+	if err != nil {
+		if err.Code == http.StatusUnauthorized {
+			c.Header("WWW-Authenticate", `Basic realm="share"`)
+		}
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) == gin.MIMEHTML {
+		c.Status(http.StatusOK)
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		if err := browseTemplate.Execute(c.Writer, res); err != nil {
+			c.Error(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
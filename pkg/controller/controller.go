@@ -10,18 +10,21 @@ type Controller struct {
 	UploadService *services.UploadService
 	AuthService   *services.AuthService
 	ShareService  *services.ShareService
+	AdminService  *services.AdminService
 }
 
 func NewController(fileService *services.FileService,
 	userService *services.UserService,
 	uploadService *services.UploadService,
 	authService *services.AuthService,
-	shareService *services.ShareService) *Controller {
+	shareService *services.ShareService,
+	adminService *services.AdminService) *Controller {
 	return &Controller{
 		FileService:   fileService,
 		UserService:   userService,
 		UploadService: uploadService,
 		AuthService:   authService,
 		ShareService:  shareService,
+		AdminService:  adminService,
 	}
 }
@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/pkg/httputil"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+)
+
+func (fc *Controller) ExportFiles(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+
+	res, err := fc.FileService.ExportFiles(userId)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	fileName := fmt.Sprintf("teldrive-export-%s.json", time.Now().UTC().Format("20060102"))
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+	c.JSON(http.StatusOK, res)
+}
+
+func (fc *Controller) ImportFiles(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+
+	var payload schemas.Export
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := fc.FileService.ImportFiles(userId, &payload)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
@@ -1,12 +1,16 @@
 package controller
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/database"
 	"github.com/tgdrive/teldrive/pkg/httputil"
 	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/services"
 )
 
 func (fc *Controller) CreateFile(c *gin.Context) {
@@ -20,11 +24,17 @@ func (fc *Controller) CreateFile(c *gin.Context) {
 
 	userId, _ := auth.GetUser(c)
 
+	fileIn.DryRun = c.Query("dryRun") == "true"
+
 	res, err := fc.FileService.CreateFile(c, userId, &fileIn)
 	if err != nil {
 		httputil.NewError(c, err.Code, err.Error)
 		return
 	}
+	if res.DryRun {
+		c.JSON(http.StatusOK, res)
+		return
+	}
 	c.JSON(http.StatusCreated, res)
 }
 
@@ -38,12 +48,15 @@ func (fc *Controller) UpdateFile(c *gin.Context) {
 		httputil.NewError(c, http.StatusBadRequest, err)
 		return
 	}
+	fileUpdate.IfMatch = c.GetHeader("If-Match")
+
 	res, err := fc.FileService.UpdateFile(c.Param("fileID"), userId, &fileUpdate)
 	if err != nil {
 		httputil.NewError(c, err.Code, err.Error)
 		return
 	}
 
+	c.Header("ETag", services.FileETag(res.Id, res.Version))
 	c.JSON(http.StatusOK, res)
 }
 
@@ -54,6 +67,143 @@ func (fc *Controller) GetFileByID(c *gin.Context) {
 		return
 	}
 
+	if res.Type == "file" {
+		fc.FileService.MarkAccessed(res.Id)
+	}
+
+	etag := services.FileETag(res.Id, res.Version)
+
+	if c.Query("includeAncestors") == "true" {
+		userId, _ := auth.GetUser(c)
+		if err := fc.FileService.AttachAncestors(userId, res.FileOut); err != nil {
+			httputil.NewError(c, err.Code, err.Error)
+			return
+		}
+		etag = services.AncestorsETag(res.Id, res.Version, res.Ancestors)
+	}
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, no-cache")
+
+	if match := c.GetHeader("If-None-Match"); match != "" && services.ETagMatches(match, etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	if res.Type == "file" && c.Query("links") == "true" {
+		// Links are signed for the caller, so only hand them out for the
+		// caller's own files.
+		if userId, _ := auth.GetUser(c); res.UserID != userId {
+			httputil.NewError(c, http.StatusNotFound, database.ErrNotFound)
+			return
+		}
+		res.Links = fc.FileService.FileLinks(c, res)
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (fc *Controller) ListRecent(c *gin.Context) {
+
+	userId, _ := auth.GetUser(c)
+
+	var query schemas.RecentQuery
+
+	if err := c.ShouldBindQuery(&query); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := fc.FileService.ListRecent(userId, &query)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (fc *Controller) ListChannelFiles(c *gin.Context) {
+
+	userId, _ := auth.GetUser(c)
+
+	channelId, err := strconv.ParseInt(c.Param("channelId"), 10, 64)
+	if err != nil {
+		httputil.NewError(c, http.StatusBadRequest, errors.New("invalid channel id"))
+		return
+	}
+
+	var query schemas.ChannelFileQuery
+
+	if err := c.ShouldBindQuery(&query); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, appErr := fc.FileService.ListChannelFiles(userId, channelId, &query)
+	if appErr != nil {
+		httputil.NewError(c, appErr.Code, appErr.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (fc *Controller) SetFileExpiry(c *gin.Context) {
+
+	userId, _ := auth.GetUser(c)
+
+	var payload schemas.FileExpiry
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := fc.FileService.SetFileExpiry(userId, c.Param("fileID"), &payload)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (fc *Controller) ListExpiring(c *gin.Context) {
+
+	userId, _ := auth.GetUser(c)
+
+	var query schemas.ExpiringQuery
+
+	if err := c.ShouldBindQuery(&query); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := fc.FileService.ListExpiring(userId, &query)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (fc *Controller) ListChanges(c *gin.Context) {
+
+	userId, _ := auth.GetUser(c)
+
+	var query schemas.ChangeQuery
+
+	if err := c.ShouldBindQuery(&query); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := fc.FileService.ListChanges(userId, &query)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
 	c.JSON(http.StatusOK, res)
 }
 
@@ -69,11 +219,18 @@ func (fc *Controller) ListFiles(c *gin.Context) {
 		Op:    "list",
 	}
 
+	fc.FileService.ApplyListDefaults(userId, &fquery)
+
 	if err := c.ShouldBindQuery(&fquery); err != nil {
 		httputil.NewError(c, http.StatusBadRequest, err)
 		return
 	}
 
+	if c.NegotiateFormat(gin.MIMEJSON, "application/x-ndjson") == "application/x-ndjson" {
+		fc.FileService.StreamFiles(c, userId, &fquery)
+		return
+	}
+
 	res, err := fc.FileService.ListFiles(userId, &fquery)
 	if err != nil {
 		httputil.NewError(c, err.Code, err.Error)
@@ -83,6 +240,11 @@ func (fc *Controller) ListFiles(c *gin.Context) {
 	c.JSON(http.StatusOK, res)
 }
 
+func (fc *Controller) ExportReport(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+	fc.FileService.ExportReport(c, userId)
+}
+
 func (fc *Controller) MakeDirectory(c *gin.Context) {
 
 	userId, _ := auth.GetUser(c)
@@ -120,6 +282,8 @@ func (fc *Controller) MoveFiles(c *gin.Context) {
 		httputil.NewError(c, http.StatusBadRequest, err)
 		return
 	}
+	payload.DryRun = c.Query("dryRun") == "true"
+
 	res, err := fc.FileService.MoveFiles(userId, &payload)
 	if err != nil {
 		httputil.NewError(c, err.Code, err.Error)
@@ -129,6 +293,64 @@ func (fc *Controller) MoveFiles(c *gin.Context) {
 	c.JSON(http.StatusOK, res)
 }
 
+func (fc *Controller) Reorganize(c *gin.Context) {
+
+	userId, _ := auth.GetUser(c)
+
+	var payload schemas.Reorganize
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+	payload.DryRun = c.Query("dryRun") == "true"
+
+	res, err := fc.FileService.Reorganize(userId, &payload)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (fc *Controller) MoveToChannel(c *gin.Context) {
+
+	userId, _ := auth.GetUser(c)
+
+	var payload schemas.ChannelMove
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := fc.FileService.MoveToChannel(c, userId, &payload)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (fc *Controller) TransferFiles(c *gin.Context) {
+
+	userId, _ := auth.GetUser(c)
+
+	var payload schemas.FileTransfer
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := fc.FileService.TransferFiles(c, userId, &payload)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
 func (fc *Controller) DeleteFiles(c *gin.Context) {
 
 	userId, _ := auth.GetUser(c)
@@ -138,6 +360,8 @@ func (fc *Controller) DeleteFiles(c *gin.Context) {
 		httputil.NewError(c, http.StatusBadRequest, err)
 		return
 	}
+	payload.DryRun = c.Query("dryRun") == "true"
+
 	res, err := fc.FileService.DeleteFiles(userId, &payload)
 	if err != nil {
 		httputil.NewError(c, err.Code, err.Error)
@@ -198,6 +422,32 @@ func (fc *Controller) DeleteShare(c *gin.Context) {
 	c.Status(http.StatusNoContent)
 }
 
+func (fc *Controller) ListFileShares(c *gin.Context) {
+
+	userId, _ := auth.GetUser(c)
+
+	res, err := fc.FileService.ListFileShares(c.Param("fileID"), userId)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (fc *Controller) RevokeFileShares(c *gin.Context) {
+
+	userId, _ := auth.GetUser(c)
+
+	res, err := fc.FileService.RevokeFileShares(c.Param("fileID"), userId, c.Query("recursive") == "true")
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
 func (fc *Controller) GetShareByFileId(c *gin.Context) {
 
 	userId, _ := auth.GetUser(c)
@@ -230,6 +480,44 @@ func (fc *Controller) UpdateParts(c *gin.Context) {
 	c.JSON(http.StatusOK, res)
 }
 
+func (fc *Controller) AppendFile(c *gin.Context) {
+
+	userId, _ := auth.GetUser(c)
+
+	var payload schemas.FileAppend
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := fc.FileService.AppendFile(c, userId, c.Param("fileID"), &payload)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (fc *Controller) TruncateFile(c *gin.Context) {
+
+	userId, _ := auth.GetUser(c)
+
+	var payload schemas.FileTruncate
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := fc.FileService.TruncateFile(c, userId, c.Param("fileID"), &payload)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
 func (fc *Controller) MoveDirectory(c *gin.Context) {
 	userId, _ := auth.GetUser(c)
 
@@ -266,3 +554,248 @@ func (fc *Controller) GetFileStream(c *gin.Context) {
 func (fc *Controller) GetFileDownload(c *gin.Context) {
 	fc.FileService.GetFileStream(c, true, nil)
 }
+
+func (fc *Controller) ExtractFile(c *gin.Context) {
+	fc.FileService.ExtractFile(c)
+}
+
+func (fc *Controller) PreviewText(c *gin.Context) {
+	fc.FileService.PreviewText(c)
+}
+
+func (fc *Controller) GetFileManifest(c *gin.Context) {
+	fc.FileService.GetFileManifest(c)
+}
+
+func (fc *Controller) GetFileChecksum(c *gin.Context) {
+	fc.FileService.GetFileChecksum(c)
+}
+
+func (fc *Controller) GetFilePart(c *gin.Context) {
+	fc.FileService.GetFilePart(c)
+}
+
+func (fc *Controller) CompareFile(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+
+	var payload schemas.FileCompare
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+	res, err := fc.FileService.CompareFile(userId, &payload)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (fc *Controller) CompareFolders(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+
+	var payload schemas.FolderCompare
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+	res, err := fc.FileService.CompareFolders(userId, &payload)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (fc *Controller) ImportFromTelegram(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+
+	var payload schemas.TelegramImport
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+	res, err := fc.FileService.ImportFromTelegram(c, userId, &payload)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusCreated, res)
+}
+
+func (fc *Controller) CloneStructure(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+
+	var payload schemas.CloneStructure
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+	res, err := fc.FileService.CloneStructure(userId, &payload)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusCreated, res)
+}
+
+func (fc *Controller) ListTemplates(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+
+	res, err := fc.FileService.ListTemplates(userId)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (fc *Controller) CreateTemplate(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+
+	var payload schemas.FolderTemplateIn
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+	res, err := fc.FileService.CreateTemplate(userId, &payload)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusCreated, res)
+}
+
+func (fc *Controller) DeleteTemplate(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+
+	res, err := fc.FileService.DeleteTemplate(userId, c.Param("templateID"))
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (fc *Controller) InstantiateTemplate(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+
+	var payload schemas.InstantiateTemplate
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+	res, err := fc.FileService.InstantiateTemplate(userId, c.Param("templateID"), &payload)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusCreated, res)
+}
+
+func (fc *Controller) GetFileStats(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+
+	var query schemas.FileStatsQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+	res, err := fc.FileService.GetFileStats(c.Param("fileID"), userId, &query)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (fc *Controller) ComputeFileHash(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+
+	var query schemas.ComputeHashQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := fc.FileService.ComputeHash(c, userId, c.Param("fileID"), &query)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (fc *Controller) QueueHashJob(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+
+	var payload schemas.HashJobIn
+	if err := c.ShouldBindQuery(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := fc.FileService.QueueHashJob(userId, &payload)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, res)
+}
+
+func (fc *Controller) GetHashJob(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+
+	res, err := fc.FileService.GetHashJob(userId, c.Param("jobID"))
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (fc *Controller) CancelHashJob(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+
+	res, err := fc.FileService.CancelHashJob(userId, c.Param("jobID"))
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// CheckRoot repairs a missing root folder on the first file operation of a
+// session before handing the request on.
+func (fc *Controller) CheckRoot(c *gin.Context) {
+	if err := fc.FileService.CheckRoot(c); err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+	c.Next()
+}
+
+func (fc *Controller) RepairRoot(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+
+	res, err := fc.FileService.RepairRoot(userId)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
@@ -48,7 +48,7 @@ func (sc *Controller) ListShareFiles(c *gin.Context) {
 		return
 	}
 
-	res, err := sc.ShareService.ListShareFiles(c.Param("shareID"), &query, c.GetHeader("Authorization"))
+	res, err := sc.ShareService.ListShareFiles(c.Param("shareID"), httputil.BasePath(c.Request), &query, c.GetHeader("Authorization"))
 	if err != nil {
 		httputil.NewError(c, err.Code, err.Error)
 		return
@@ -64,3 +64,7 @@ func (sc *Controller) StreamSharedFile(c *gin.Context) {
 func (sc *Controller) DownloadSharedFile(c *gin.Context) {
 	sc.ShareService.StreamSharedFile(c, true)
 }
+
+func (sc *Controller) ShareThumbnail(c *gin.Context) {
+	sc.ShareService.ShareThumbnail(c)
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/tgdrive/teldrive/internal/auth"
 	"github.com/tgdrive/teldrive/pkg/httputil"
+	"github.com/tgdrive/teldrive/pkg/schemas"
 )
 
 func (uc *Controller) GetUploadFileById(c *gin.Context) {
@@ -19,6 +20,36 @@ func (uc *Controller) GetUploadFileById(c *gin.Context) {
 	c.JSON(http.StatusOK, res)
 }
 
+func (uc *Controller) GetUploadRetention(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+
+	res, err := uc.UploadService.GetUploadRetention(userId, c.Param("id"))
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (uc *Controller) SetUploadRetention(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+
+	var payload schemas.UploadRetentionIn
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := uc.UploadService.SetUploadRetention(userId, c.Param("id"), &payload)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
 func (uc *Controller) DeleteUploadFile(c *gin.Context) {
 	res, err := uc.UploadService.DeleteUploadFile(c)
 	if err != nil {
@@ -39,6 +70,115 @@ func (uc *Controller) UploadFile(c *gin.Context) {
 	c.JSON(http.StatusCreated, res)
 }
 
+func (uc *Controller) IssueUploadTicket(c *gin.Context) {
+	var payload schemas.UploadTicketIn
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := uc.UploadService.IssueUploadTicket(c, &payload)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusCreated, res)
+}
+
+// CreateUpload starts an upload session for a JSON body and takes any other
+// body as a whole multipart upload.
+func (uc *Controller) CreateUpload(c *gin.Context) {
+	if c.ContentType() != gin.MIMEJSON {
+		uc.UploadMultipart(c)
+		return
+	}
+
+	var payload schemas.UploadSessionIn
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, created, err := uc.UploadService.CreateUploadSession(c, &payload)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	if !created {
+		c.JSON(http.StatusOK, res)
+		return
+	}
+	c.JSON(http.StatusCreated, res)
+}
+
+func (uc *Controller) UploadMultipart(c *gin.Context) {
+	res, err := uc.UploadService.UploadMultipart(c)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusCreated, res)
+}
+
+func (uc *Controller) ImportArchive(c *gin.Context) {
+	res, err := uc.UploadService.ImportArchive(c)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusCreated, res)
+}
+
+func (uc *Controller) ListArchiveImports(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+
+	res, err := uc.UploadService.ListArchiveImports(userId)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (uc *Controller) GetArchiveImport(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+
+	res, err := uc.UploadService.GetArchiveImport(userId, c.Param("jobID"))
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (uc *Controller) ListArchiveEntries(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+
+	var query schemas.ArchiveEntryQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := uc.UploadService.ListArchiveEntries(userId, c.Param("jobID"), &query)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (uc *Controller) GetUploadLimits(c *gin.Context) {
+	c.JSON(http.StatusOK, uc.UploadService.GetLimits())
+}
+
 func (uc *Controller) UploadStats(c *gin.Context) {
 	userId, _ := auth.GetUser(c)
 
@@ -56,3 +196,7 @@ func (uc *Controller) UploadStats(c *gin.Context) {
 
 	c.JSON(http.StatusCreated, res)
 }
+
+func (uc *Controller) WatchUploadProgress(c *gin.Context) {
+	uc.UploadService.WatchUploadProgress(c)
+}
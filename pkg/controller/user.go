@@ -17,6 +17,16 @@ func (uc *Controller) GetStats(c *gin.Context) {
 	c.JSON(http.StatusOK, res)
 }
 
+func (uc *Controller) GetTelegramStatus(c *gin.Context) {
+	res, err := uc.UserService.GetTelegramStatus(c)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
 func (uc *Controller) UpdateChannel(c *gin.Context) {
 	res, err := uc.UserService.UpdateChannel(c)
 	if err != nil {
@@ -27,6 +37,16 @@ func (uc *Controller) UpdateChannel(c *gin.Context) {
 	c.JSON(http.StatusOK, res)
 }
 
+func (uc *Controller) UpdateRateLimit(c *gin.Context) {
+	res, err := uc.UserService.UpdateRateLimit(c)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
 func (uc *Controller) ListChannels(c *gin.Context) {
 	res, err := uc.UserService.ListChannels(c)
 	if err != nil {
@@ -81,3 +101,103 @@ func (uc *Controller) GetProfilePhoto(c *gin.Context) {
 		uc.UserService.GetProfilePhoto(c)
 	}
 }
+
+func (uc *Controller) GetSettings(c *gin.Context) {
+	res, err := uc.UserService.GetSettings(c)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (uc *Controller) UpdateSettings(c *gin.Context) {
+	res, err := uc.UserService.UpdateSettings(c)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (uc *Controller) ListBots(c *gin.Context) {
+	res, err := uc.UserService.ListBots(c)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (uc *Controller) ValidateBots(c *gin.Context) {
+	res, err := uc.UserService.ValidateBots(c)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (uc *Controller) CreateBots(c *gin.Context) {
+	res, err := uc.UserService.CreateBots(c)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusCreated, res)
+}
+
+func (uc *Controller) DeleteBot(c *gin.Context) {
+	res, err := uc.UserService.DeleteBot(c)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (uc *Controller) ListBotPools(c *gin.Context) {
+	res, err := uc.UserService.ListBotPools(c)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (uc *Controller) UpdateBotPool(c *gin.Context) {
+	res, err := uc.UserService.UpdateBotPool(c)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (uc *Controller) RotateKey(c *gin.Context) {
+	res, err := uc.UserService.RotateKey(c)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusCreated, res)
+}
+
+func (uc *Controller) MigrateKeys(c *gin.Context) {
+	res, err := uc.UserService.MigrateKeys(c)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
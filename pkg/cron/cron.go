@@ -5,12 +5,17 @@ import (
 	"time"
 
 	"github.com/go-co-op/gocron"
+	"github.com/gotd/td/telegram"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/kv"
 	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/middleware"
 	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/check"
 	"github.com/tgdrive/teldrive/pkg/models"
 	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/services"
 	"go.uber.org/zap"
 	"gorm.io/datatypes"
 	"gorm.io/gorm"
@@ -30,34 +35,85 @@ type Result struct {
 
 type UploadResult struct {
 	Parts     datatypes.JSONSlice[int]
+	Replicas  datatypes.JSONSlice[[]schemas.Replica]
 	Session   string
 	UserId    int64
 	ChannelId int64
 }
 
 type CronService struct {
-	db     *gorm.DB
-	cnf    *config.Config
-	logger *zap.SugaredLogger
+	db          *gorm.DB
+	cnf         *config.Config
+	kv          kv.KV
+	clients     *tgc.Manager
+	maintenance *middleware.Maintenance
+	logger      *zap.SugaredLogger
 }
 
-func StartCronJobs(scheduler *gocron.Scheduler, db *gorm.DB, cnf *config.Config) {
+func StartCronJobs(scheduler *gocron.Scheduler, db *gorm.DB, cnf *config.Config, kv kv.KV, clients *tgc.Manager,
+	maintenance *middleware.Maintenance, files *services.FileService) {
+	cron := CronService{db: db, cnf: cnf, kv: kv, clients: clients, maintenance: maintenance, logger: logging.DefaultLogger()}
+
+	cron.MigrateBotSessions()
+
 	if !cnf.CronJobs.Enable {
 		return
 	}
 	ctx := context.Background()
 
-	cron := CronService{db: db, cnf: cnf, logger: logging.DefaultLogger()}
+	scheduler.Every(cnf.CronJobs.CleanFilesInterval).Do(cron.unlessMaintenance(func() { cron.CleanFiles(ctx) }))
+
+	scheduler.Every(cnf.CronJobs.FolderSizeInterval).Do(cron.unlessMaintenance(cron.UpdateFolderSize))
+
+	scheduler.Every(cnf.CronJobs.CleanUploadsInterval).Do(cron.unlessMaintenance(func() { cron.CleanUploads(ctx) }))
 
-	scheduler.Every(cnf.CronJobs.CleanFilesInterval).Do(cron.CleanFiles, ctx)
+	scheduler.Every(cnf.CronJobs.CleanBotSessionsInterval).Do(cron.unlessMaintenance(cron.CleanBotSessions))
 
-	scheduler.Every(cnf.CronJobs.FolderSizeInterval).Do(cron.UpdateFolderSize)
+	scheduler.Every(cnf.CronJobs.HashJobsInterval).Do(cron.unlessMaintenance(func() { files.RunHashJobs(ctx) }))
 
-	scheduler.Every(cnf.CronJobs.CleanUploadsInterval).Do(cron.CleanUploads, ctx)
+	scheduler.Every(cnf.CronJobs.CleanFilesInterval).Do(cron.unlessMaintenance(cron.ExpireFiles))
+
+	if cnf.CronJobs.ChangeLogRetention > 0 {
+		scheduler.Every(cnf.CronJobs.CleanFilesInterval).Do(cron.unlessMaintenance(cron.PruneChangeLog))
+	}
 
 	scheduler.StartAsync()
 }
 
+// PruneChangeLog drops file changes past the retention.
+func (c *CronService) PruneChangeLog() {
+	pruned, err := services.PruneChangeLog(c.db, c.cnf.CronJobs.ChangeLogRetention)
+	if err != nil {
+		c.logger.Errorw("failed to prune change log", "err", err)
+		return
+	}
+	if pruned > 0 {
+		c.logger.Infow("pruned change log", "entries", pruned)
+	}
+}
+
+// ExpireFiles deletes the files past their scheduled expiry.
+func (c *CronService) ExpireFiles() {
+	expired, err := services.ExpireFiles(c.db)
+	if err != nil {
+		c.logger.Errorw("failed to expire files", "err", err)
+		return
+	}
+	if expired > 0 {
+		c.logger.Infow("expired files", "entries", expired)
+	}
+}
+
+// unlessMaintenance skips a job's runs while writes are frozen.
+func (c *CronService) unlessMaintenance(job func()) func() {
+	return func() {
+		if c.maintenance != nil && c.maintenance.Enabled() {
+			return
+		}
+		job()
+	}
+}
+
 func (c *CronService) CleanFiles(ctx context.Context) {
 
 	var results []Result
@@ -81,15 +137,25 @@ func (c *CronService) CleanFiles(ctx context.Context) {
 
 		fileIds := []string{}
 
+		parts := []schemas.Part{}
+
 		for _, file := range row.Files {
 			fileIds = append(fileIds, file.ID)
 			for _, part := range file.Parts {
 				ids = append(ids, int(part.ID))
 			}
+			parts = append(parts, file.Parts...)
 
 		}
-		client, _ := tgc.AuthClient(ctx, &c.cnf.TG, row.Session)
-		err := tgc.DeleteMessages(ctx, client, row.ChannelId, ids)
+		messages := schemas.ReplicaMessages(parts)
+		messages[row.ChannelId] = append(messages[row.ChannelId], ids...)
+
+		deleted := 0
+		err := c.clients.Run(ctx, c.clients.UserSpec(row.Session), func(ctx context.Context, client *telegram.Client) error {
+			var err error
+			deleted, err = tgc.DeleteChannelMessages(ctx, client.API(), messages, tgc.DeleteOptionsFor(&c.cnf.TG))
+			return err
+		})
 
 		if err != nil {
 			c.logger.Errorw("failed to delete messages", err)
@@ -104,7 +170,7 @@ func (c *CronService) CleanFiles(ctx context.Context) {
 
 		c.db.Where("id = any($1)", items).Delete(&models.File{})
 
-		c.logger.Infow("cleaned files", "user", row.UserId, "channel", row.ChannelId)
+		c.logger.Infow("cleaned files", "user", row.UserId, "channel", row.ChannelId, "messages", deleted)
 	}
 }
 
@@ -112,10 +178,11 @@ func (c *CronService) CleanUploads(ctx context.Context) {
 
 	var upResults []UploadResult
 	if err := c.db.Model(&models.Upload{}).
-		Select("JSONB_AGG(uploads.part_id) as parts", "uploads.channel_id", "uploads.user_id", "s.session").
+		Select("JSONB_AGG(uploads.part_id) as parts", "JSONB_AGG(uploads.replicas) as replicas",
+			"uploads.channel_id", "uploads.user_id", "s.session").
 		Joins("left join teldrive.users as u  on u.user_id = uploads.user_id").
 		Joins("left join (select * from teldrive.sessions order by created_at desc limit 1) as s on s.user_id = uploads.user_id").
-		Where("uploads.created_at < ?", time.Now().UTC().Add(-c.cnf.TG.Uploads.Retention)).
+		Scopes(check.ExpiredUploads(c.cnf.TG.Uploads.Retention, time.Now().UTC())).
 		Group("uploads.channel_id").Group("uploads.user_id").Group("s.session").
 		Scan(&upResults).Error; err != nil {
 		return
@@ -124,9 +191,16 @@ func (c *CronService) CleanUploads(ctx context.Context) {
 	for _, result := range upResults {
 
 		if result.Session != "" && len(result.Parts) > 0 {
-			client, _ := tgc.AuthClient(ctx, &c.cnf.TG, result.Session)
-
-			err := tgc.DeleteMessages(ctx, client, result.ChannelId, result.Parts)
+			parts := make([]schemas.Part, 0, len(result.Replicas))
+			for _, replicas := range result.Replicas {
+				parts = append(parts, schemas.Part{Replicas: replicas})
+			}
+			messages := schemas.ReplicaMessages(parts)
+			messages[result.ChannelId] = append(messages[result.ChannelId], result.Parts...)
+			err := c.clients.Run(ctx, c.clients.UserSpec(result.Session), func(ctx context.Context, client *telegram.Client) error {
+				_, err := tgc.DeleteChannelMessages(ctx, client.API(), messages, tgc.DeleteOptionsFor(&c.cnf.TG))
+				return err
+			})
 			if err != nil {
 				c.logger.Errorw("failed to delete messages", err)
 				return
@@ -141,6 +215,67 @@ func (c *CronService) CleanUploads(ctx context.Context) {
 			Where("user_id = ?", result.UserId).Delete(&models.Upload{}).Delete(&models.Upload{})
 
 	}
+
+	c.db.Where("expires_at < ?", time.Now().UTC()).Delete(&models.UploadSession{})
+	c.db.Where("expires_at < ?", time.Now().UTC()).Delete(&models.UploadRetention{})
+	c.db.Where("updated_at < ?", time.Now().UTC().Add(-c.cnf.TG.Uploads.Retention)).Delete(&models.UploadPartNumber{})
+}
+
+// MigrateBotSessions moves sessions stored under the legacy token keyed scheme
+// to the per user hashed keys.
+func (c *CronService) MigrateBotSessions() {
+	keys, err := c.kv.Keys(kv.Key("botsession", ""))
+	if err != nil || len(keys) == 0 {
+		return
+	}
+
+	var bots []models.Bot
+	if err := c.db.Select("token", "user_id").Find(&bots).Error; err != nil {
+		return
+	}
+
+	for _, bot := range bots {
+		legacy := kv.Key("botsession", bot.Token)
+		data, err := c.kv.Get(legacy)
+		if err != nil {
+			continue
+		}
+		if err := c.kv.Set(tgc.BotSessionKey(bot.UserID, bot.Token), data); err != nil {
+			c.logger.Errorw("failed to migrate bot session", "bot", bot.BotID, "err", err)
+			continue
+		}
+		c.kv.Delete(legacy)
+	}
+}
+
+// CleanBotSessions removes stored sessions of bots that no longer exist,
+// including legacy sessions that could not be migrated.
+func (c *CronService) CleanBotSessions() {
+	keys, err := c.kv.Keys(kv.Key("botsession", ""))
+	if err != nil || len(keys) == 0 {
+		return
+	}
+
+	var bots []models.Bot
+	if err := c.db.Select("token", "user_id").Find(&bots).Error; err != nil {
+		return
+	}
+
+	valid := make(map[string]struct{}, len(bots))
+	for _, bot := range bots {
+		valid[tgc.BotSessionKey(bot.UserID, bot.Token)] = struct{}{}
+	}
+
+	removed := 0
+	for _, key := range keys {
+		if _, ok := valid[key]; !ok {
+			c.kv.Delete(key)
+			removed++
+		}
+	}
+	if removed > 0 {
+		c.logger.Infow("cleaned bot sessions", "count", removed)
+	}
 }
 
 func (c *CronService) UpdateFolderSize() {
@@ -0,0 +1,70 @@
+package httputil
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+type basePathKey struct{}
+
+// NormalizeBasePath turns a base path into the "/prefix" form, empty for the
+// root. Prefixes with characters outside a plain URL path are dropped.
+func NormalizeBasePath(base string) string {
+	base = strings.Trim(strings.TrimSpace(base), "/")
+	if base == "" {
+		return ""
+	}
+	for i := 0; i < len(base); i++ {
+		c := base[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0) {
+			return ""
+		}
+	}
+	return "/" + base
+}
+
+// Mount serves next under base. The prefix is stripped before routing so the
+// routes and middlewares of next stay root relative, requests outside it are
+// not found.
+func Mount(base string, next http.Handler) http.Handler {
+	base = NormalizeBasePath(base)
+	if base == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != base && !strings.HasPrefix(r.URL.Path, base+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), basePathKey{}, base))
+		u := *r.URL
+		u.Path = strings.TrimPrefix(u.Path, base)
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		if u.RawPath != "" {
+			u.RawPath = strings.TrimPrefix(u.RawPath, base)
+		}
+		r.URL = &u
+		next.ServeHTTP(w, r)
+	})
+}
+
+// BasePath is the prefix clients reach the app under: the X-Forwarded-Prefix
+// of a proxy that strips its own prefix followed by the mounted base path.
+func BasePath(r *http.Request) string {
+	base, _ := r.Context().Value(basePathKey{}).(string)
+	if fwd := r.Header.Get("X-Forwarded-Prefix"); fwd != "" {
+		return NormalizeBasePath(strings.Split(fwd, ",")[0]) + base
+	}
+	return base
+}
+
+// CookiePath is the path cookies set for r are scoped to.
+func CookiePath(r *http.Request) string {
+	if base := BasePath(r); base != "" {
+		return base
+	}
+	return "/"
+}
@@ -0,0 +1,63 @@
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeBasePath(t *testing.T) {
+	assert.Equal(t, "", NormalizeBasePath(""))
+	assert.Equal(t, "", NormalizeBasePath("/"))
+	assert.Equal(t, "/teldrive", NormalizeBasePath("teldrive/"))
+	assert.Equal(t, "/apps/teldrive", NormalizeBasePath(" /apps/teldrive "))
+	assert.Equal(t, "", NormalizeBasePath("/a;b"))
+}
+
+func TestMount(t *testing.T) {
+	var path, base, cookie string
+	h := Mount("/teldrive/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, base, cookie = r.URL.Path, BasePath(r), CookiePath(r)
+	}))
+
+	for target, want := range map[string]string{
+		"/teldrive":              "/",
+		"/teldrive/":             "/",
+		"/teldrive/api/files/1":  "/api/files/1",
+		"/teldrive/api/a%2Fb/fn": "/api/a/b/fn",
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusOK, w.Code, target)
+		assert.Equal(t, want, path, target)
+		assert.Equal(t, "/teldrive", base)
+		assert.Equal(t, "/teldrive", cookie)
+	}
+
+	for _, target := range []string{"/api/files/1", "/teldrivex/api"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusNotFound, w.Code, target)
+	}
+}
+
+func TestBasePathForwarded(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/files", nil)
+	assert.Equal(t, "", BasePath(r))
+	assert.Equal(t, "/", CookiePath(r))
+
+	r.Header.Set("X-Forwarded-Prefix", "/drive/, /outer")
+	assert.Equal(t, "/drive", BasePath(r))
+
+	var base string
+	Mount("/teldrive", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		base = BasePath(r)
+	})).ServeHTTP(httptest.NewRecorder(), func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/teldrive/api", nil)
+		r.Header.Set("X-Forwarded-Prefix", "/drive")
+		return r
+	}())
+	assert.Equal(t, "/drive/teldrive", base)
+}
@@ -0,0 +1,49 @@
+package httputil
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+// ContentDisposition formats a Content-Disposition header for filename. Names
+// outside ASCII get an RFC 5987 filename* parameter with a plain fallback for
+// clients that do not understand it.
+func ContentDisposition(disposition, filename string) string {
+	ascii := true
+	for i := 0; i < len(filename); i++ {
+		if filename[i] >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		if header := mime.FormatMediaType(disposition, map[string]string{"filename": filename}); header != "" {
+			return header
+		}
+	}
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r >= 0x7f || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, filename)
+	return fmt.Sprintf("%s; filename=\"%s\"; filename*=UTF-8''%s", disposition, fallback, encodeExtValue(filename))
+}
+
+// encodeExtValue percent encodes every byte that is not an attr-char of
+// RFC 5987.
+func encodeExtValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
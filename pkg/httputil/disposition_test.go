@@ -0,0 +1,16 @@
+package httputil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentDisposition(t *testing.T) {
+	assert.Equal(t, `attachment; filename="report v2.pdf"`, ContentDisposition("attachment", "report v2.pdf"))
+	assert.Equal(t, `inline; filename=notes.txt`, ContentDisposition("inline", "notes.txt"))
+	assert.Equal(t, `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`,
+		ContentDisposition("attachment", "résumé.pdf"))
+	assert.Equal(t, `inline; filename="a_b _.txt"; filename*=UTF-8''a%22b%20%E2%9C%93.txt`,
+		ContentDisposition("inline", `a"b ✓.txt`))
+}
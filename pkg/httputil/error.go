@@ -1,23 +1,228 @@
 package httputil
 
 import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
 	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/gotd/td/tgerr"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/database"
 	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/gorm"
+)
+
+// RequestIDKey is the gin context key holding the correlation id of a request.
+const RequestIDKey = "requestId"
+
+// ErrorCode is a stable, machine-readable identifier of an error. Clients
+// should branch on it rather than on the message.
+type ErrorCode string
+
+const (
+	CodeBadRequest          ErrorCode = "BAD_REQUEST"
+	CodeValidation          ErrorCode = "VALIDATION_FAILED"
+	CodeUnauthorized        ErrorCode = "UNAUTHORIZED"
+	CodeSessionExpired      ErrorCode = "SESSION_EXPIRED"
+	CodeForbidden           ErrorCode = "FORBIDDEN"
+	CodeNotFound            ErrorCode = "NOT_FOUND"
+	CodeConflict            ErrorCode = "CONFLICT"
+	CodeStaleVersion        ErrorCode = "STALE_VERSION"
+	CodePreconditionFailed  ErrorCode = "PRECONDITION_FAILED"
+	CodePayloadTooLarge     ErrorCode = "PAYLOAD_TOO_LARGE"
+	CodeUnsupportedMedia    ErrorCode = "UNSUPPORTED_MEDIA_TYPE"
+	CodeRangeNotSatisfiable ErrorCode = "RANGE_NOT_SATISFIABLE"
+	CodeRateLimited         ErrorCode = "RATE_LIMITED"
+	CodeChannelInvalid      ErrorCode = "CHANNEL_INVALID"
+	CodeTelegram            ErrorCode = "TELEGRAM_ERROR"
+	CodeCanceled            ErrorCode = "CANCELED"
+	CodeInternal            ErrorCode = "INTERNAL"
 )
 
+type HTTPError struct {
+	Code      ErrorCode `json:"code"`
+	Message   string    `json:"message"`
+	Details   any       `json:"details,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+}
+
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// RetryDetails tells rate limited clients how many seconds to back off.
+type RetryDetails struct {
+	RetryAfter int `json:"retryAfter"`
+}
+
+// RetryAfter returns the whole seconds a client should wait before retrying
+// a request that failed with a Telegram FLOOD_WAIT.
+func RetryAfter(err error) (int, bool) {
+	d, ok := tgerr.AsFloodWait(err)
+	if !ok {
+		return 0, false
+	}
+	return max(int(math.Ceil(d.Seconds())), 1), true
+}
+
+// NewError writes err as an HTTPError and aborts the request. status is the
+// status chosen by the caller; a zero or 500 status is refined from the error
+// itself. The full error is always logged, but messages of server errors are
+// only returned to clients in development mode.
 func NewError(ctx *gin.Context, status int, err error) {
+	status, _ = Classify(status, err)
+	if seconds, ok := RetryAfter(err); ok {
+		ctx.Header("Retry-After", strconv.Itoa(seconds))
+	}
+	ctx.AbortWithStatusJSON(status, ErrorBody(ctx, status, err))
+}
+
+// Unauthenticated refuses a request without a usable session with a 401 and
+// a bearer challenge. The reason in the details tells clients whether to send
+// the user to the login or report an expired session.
+func Unauthenticated(ctx *gin.Context, err error) {
+	authErr := auth.Unauthenticated(err)
+	challenge := `Bearer realm="teldrive"`
+	if authErr.Reason != auth.ReasonMissing {
+		challenge += `, error="invalid_token"`
+	}
+	ctx.Header("WWW-Authenticate", challenge)
+	NewError(ctx, http.StatusUnauthorized, authErr)
+}
+
+// ErrorBody logs err and returns the HTTPError describing it, for responses
+// that report errors other than through the status line.
+func ErrorBody(ctx *gin.Context, status int, err error) HTTPError {
+	status, code := Classify(status, err)
+
 	logger := logging.FromContext(ctx)
-	logger.Error(err)
+	if status >= http.StatusInternalServerError {
+		logger.Errorw(err.Error(), "code", code, "status", status)
+	} else {
+		logger.Debugw(err.Error(), "code", code, "status", status)
+	}
+
+	httpErr := HTTPError{
+		Code:      code,
+		Message:   err.Error(),
+		RequestID: ctx.GetString(RequestIDKey),
+	}
+
+	if status >= http.StatusInternalServerError && !logging.Development() {
+		httpErr.Message = http.StatusText(status)
+	}
+
+	var (
+		detailed   types.DetailedError
+		validation validator.ValidationErrors
+	)
+	if errors.As(err, &detailed) {
+		httpErr.Details = detailed.Details()
+	} else if seconds, ok := RetryAfter(err); ok {
+		httpErr.Details = RetryDetails{RetryAfter: seconds}
+	} else if errors.As(err, &validation) {
+		fields := make([]FieldError, 0, len(validation))
+		for _, fe := range validation {
+			fields = append(fields, FieldError{Field: fe.Field(), Reason: fe.Tag()})
+		}
+		httpErr.Details = fields
+	}
+
+	return httpErr
+}
+
+// Classify returns the HTTP status and error code for err. An explicit status
+// other than 500 is kept, only its code is derived from the error.
+func Classify(status int, err error) (int, ErrorCode) {
 	if status == 0 {
-		status = 500
+		status = http.StatusInternalServerError
+	}
+
+	mapped, code := classifyError(err)
+	if code == "" {
+		return status, codeFromStatus(status)
+	}
+	// A flood wait is never the client's fault whatever the caller chose.
+	if status == http.StatusInternalServerError || code == CodePayloadTooLarge || code == CodeRateLimited {
+		status = mapped
 	}
-	ctx.JSON(status, HTTPError{
-		Code:    status,
-		Message: err.Error(),
-	})
+	return status, code
 }
 
-type HTTPError struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+func classifyError(err error) (int, ErrorCode) {
+	var (
+		validation validator.ValidationErrors
+		maxBytes   *http.MaxBytesError
+		authErr    *auth.AuthError
+	)
+	switch {
+	case errors.As(err, &authErr) && authErr.Reason == auth.ReasonExpired:
+		return http.StatusUnauthorized, CodeSessionExpired
+	case errors.As(err, &authErr):
+		return http.StatusUnauthorized, CodeUnauthorized
+	case errors.As(err, &maxBytes):
+		return http.StatusRequestEntityTooLarge, CodePayloadTooLarge
+	case errors.Is(err, database.ErrStaleVersion):
+		return http.StatusConflict, CodeStaleVersion
+	case errors.Is(err, gorm.ErrRecordNotFound), errors.Is(err, database.ErrNotFound):
+		return http.StatusNotFound, CodeNotFound
+	case errors.Is(err, database.ErrKeyConflict), errors.Is(err, gorm.ErrDuplicatedKey),
+		database.IsKeyConflictErr(err):
+		return http.StatusConflict, CodeConflict
+	case errors.As(err, &validation):
+		return http.StatusBadRequest, CodeValidation
+	case errors.Is(err, context.Canceled):
+		return 499, CodeCanceled
+	case errors.Is(err, auth.ErrSessionExpired):
+		return http.StatusUnauthorized, CodeSessionExpired
+	}
+
+	if _, ok := tgerr.AsFloodWait(err); ok {
+		return http.StatusTooManyRequests, CodeRateLimited
+	}
+	if tgerr.Is(err, "CHANNEL_INVALID", "CHANNEL_PRIVATE", "CHAT_ADMIN_REQUIRED") {
+		return http.StatusBadRequest, CodeChannelInvalid
+	}
+	if tgerr.Is(err, "AUTH_KEY_UNREGISTERED", "SESSION_REVOKED", "USER_DEACTIVATED") {
+		return http.StatusUnauthorized, CodeUnauthorized
+	}
+	if _, ok := tgerr.As(err); ok {
+		return http.StatusBadGateway, CodeTelegram
+	}
+	return 0, ""
+}
+
+func codeFromStatus(status int) ErrorCode {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusPreconditionFailed:
+		return CodePreconditionFailed
+	case http.StatusRequestEntityTooLarge:
+		return CodePayloadTooLarge
+	case http.StatusUnsupportedMediaType:
+		return CodeUnsupportedMedia
+	case http.StatusRequestedRangeNotSatisfiable:
+		return CodeRangeNotSatisfiable
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	}
+	if status < http.StatusInternalServerError {
+		return CodeBadRequest
+	}
+	return CodeInternal
 }
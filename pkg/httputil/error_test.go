@@ -0,0 +1,115 @@
+package httputil
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gotd/td/tgerr"
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"go.uber.org/zap/zapcore"
+	"gorm.io/gorm"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		err    error
+		want   int
+		code   ErrorCode
+	}{
+		{"record not found", 0, gorm.ErrRecordNotFound, http.StatusNotFound, CodeNotFound},
+		{"wrapped not found", 500, fmt.Errorf("load: %w", database.ErrNotFound), http.StatusNotFound, CodeNotFound},
+		{"stale version", http.StatusConflict, database.ErrStaleVersion, http.StatusConflict, CodeStaleVersion},
+		{"session expired", http.StatusUnauthorized, auth.ErrSessionExpired, http.StatusUnauthorized, CodeSessionExpired},
+		{"key conflict", 0, database.ErrKeyConflict, http.StatusConflict, CodeConflict},
+		{"flood wait", 0, tgerr.New(420, "FLOOD_WAIT_30"), http.StatusTooManyRequests, CodeRateLimited},
+		{"flood wait over explicit", http.StatusBadRequest, fmt.Errorf("upload: %w", tgerr.New(420, "FLOOD_WAIT_30")),
+			http.StatusTooManyRequests, CodeRateLimited},
+		{"channel invalid", 0, tgerr.New(400, "CHANNEL_INVALID"), http.StatusBadRequest, CodeChannelInvalid},
+		{"telegram", 0, tgerr.New(400, "MESSAGE_ID_INVALID"), http.StatusBadGateway, CodeTelegram},
+		{"explicit status kept", http.StatusBadRequest, gorm.ErrRecordNotFound, http.StatusBadRequest, CodeNotFound},
+		{"plain bad request", http.StatusBadRequest, errors.New("bad"), http.StatusBadRequest, CodeBadRequest},
+		{"body too large", http.StatusBadRequest, &http.MaxBytesError{Limit: 8}, http.StatusRequestEntityTooLarge, CodePayloadTooLarge},
+		{"unsupported media", http.StatusUnsupportedMediaType, errors.New("exe"), http.StatusUnsupportedMediaType, CodeUnsupportedMedia},
+		{"plain internal", 0, errors.New("boom"), http.StatusInternalServerError, CodeInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, code := Classify(tt.status, tt.err)
+			assert.Equal(t, tt.want, status)
+			assert.Equal(t, tt.code, code)
+		})
+	}
+}
+
+type detailedErr struct{}
+
+func (detailedErr) Error() string { return "too large" }
+func (detailedErr) Details() any  { return map[string]int{"max": 1} }
+
+func TestNewError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer logging.SetConfig(&logging.Config{Level: zapcore.InfoLevel, Development: true})
+
+	run := func(status int, err error) (int, HTTPError) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/", nil)
+		c.Set(RequestIDKey, "req-1")
+		NewError(c, status, err)
+		var body HTTPError
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.True(t, c.IsAborted())
+		return w.Code, body
+	}
+
+	logging.SetConfig(&logging.Config{Level: zapcore.InfoLevel, Development: false})
+
+	code, body := run(http.StatusRequestEntityTooLarge, detailedErr{})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+	assert.Equal(t, CodePayloadTooLarge, body.Code)
+	assert.Equal(t, "too large", body.Message)
+	assert.Equal(t, "req-1", body.RequestID)
+	assert.Equal(t, map[string]any{"max": float64(1)}, body.Details)
+
+	code, body = run(0, errors.New("dial tcp 10.0.0.1:5432: timeout"))
+	assert.Equal(t, http.StatusInternalServerError, code)
+	assert.Equal(t, CodeInternal, body.Code)
+	assert.Equal(t, "Internal Server Error", body.Message)
+
+	logging.SetConfig(&logging.Config{Level: zapcore.InfoLevel, Development: true})
+
+	_, body = run(0, errors.New("dial tcp 10.0.0.1:5432: timeout"))
+	assert.Equal(t, "dial tcp 10.0.0.1:5432: timeout", body.Message)
+}
+
+func TestNewErrorRetryAfter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/", nil)
+	NewError(c, 0, fmt.Errorf("send part: %w", tgerr.New(420, "FLOOD_WAIT_42")))
+
+	var body HTTPError
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "42", w.Header().Get("Retry-After"))
+	assert.Equal(t, CodeRateLimited, body.Code)
+	assert.Equal(t, map[string]any{"retryAfter": float64(42)}, body.Details)
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/", nil)
+	NewError(c, 0, errors.New("boom"))
+	assert.Empty(t, w.Header().Get("Retry-After"))
+}
@@ -0,0 +1,114 @@
+package httputil
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/tgdrive/teldrive/internal/config"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLS holds what serving HTTPS directly needs. HTTP/2 is negotiated by the
+// server for any TLS config.
+type TLS struct {
+	Config  *tls.Config
+	manager *autocert.Manager
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewTLS checks cnf and loads the certificate it names, nil when TLS is not
+// configured.
+func NewTLS(cnf *config.TLSConfig) (*TLS, error) {
+	minVersion := uint16(tls.VersionTLS12)
+	if cnf.MinVersion != "" {
+		version, ok := tlsVersions[cnf.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown min version %q, use 1.0, 1.1, 1.2 or 1.3", cnf.MinVersion)
+		}
+		minVersion = version
+	}
+
+	hasCert := cnf.CertFile != "" || cnf.KeyFile != ""
+	switch {
+	case hasCert && len(cnf.Domains) > 0:
+		return nil, errors.New("set either a certificate or domains, not both")
+	case hasCert && (cnf.CertFile == "" || cnf.KeyFile == ""):
+		return nil, errors.New("a certificate needs both the cert and the key file")
+	case !hasCert && len(cnf.Domains) == 0:
+		if cnf.RedirectPort != 0 {
+			return nil, errors.New("redirect port needs a certificate or domains")
+		}
+		return nil, nil
+	}
+
+	if hasCert {
+		cert, err := tls.LoadX509KeyPair(cnf.CertFile, cnf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load certificate: %w", err)
+		}
+		return &TLS{Config: &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: minVersion}}, nil
+	}
+
+	dir := cnf.CacheDir
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(home, ".teldrive", "certs")
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cnf.Domains...),
+		Cache:      autocert.DirCache(dir),
+		Email:      cnf.Email,
+	}
+	tlsConfig := manager.TLSConfig()
+	tlsConfig.MinVersion = minVersion
+	return &TLS{Config: tlsConfig, manager: manager}, nil
+}
+
+// RedirectHandler sends plain HTTP requests to the same URL over HTTPS on
+// port. With Let's Encrypt it also answers the http-01 challenges.
+func (t *TLS) RedirectHandler(port int) http.Handler {
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+	if t.manager != nil {
+		return t.manager.HTTPHandler(redirect)
+	}
+	return redirect
+}
+
+// IsSecure reports whether r reached the client over HTTPS, directly or
+// through a proxy terminating TLS.
+func IsSecure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
@@ -0,0 +1,98 @@
+package httputil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/internal/config"
+)
+
+func writeCert(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: []string{"localhost"},
+		NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func TestNewTLS(t *testing.T) {
+	res, err := NewTLS(&config.TLSConfig{})
+	assert.NoError(t, err)
+	assert.Nil(t, res)
+
+	certFile, keyFile := writeCert(t)
+	res, err = NewTLS(&config.TLSConfig{CertFile: certFile, KeyFile: keyFile})
+	require.NoError(t, err)
+	assert.Len(t, res.Config.Certificates, 1)
+	assert.Equal(t, uint16(tls.VersionTLS12), res.Config.MinVersion)
+
+	res, err = NewTLS(&config.TLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.3"})
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), res.Config.MinVersion)
+
+	res, err = NewTLS(&config.TLSConfig{Domains: []string{"drive.example.com"}, CacheDir: t.TempDir()})
+	require.NoError(t, err)
+	assert.Contains(t, res.Config.NextProtos, "h2")
+
+	for _, cnf := range []config.TLSConfig{
+		{CertFile: certFile},
+		{CertFile: certFile, KeyFile: keyFile, Domains: []string{"drive.example.com"}},
+		{CertFile: certFile, KeyFile: certFile},
+		{CertFile: filepath.Join(t.TempDir(), "missing.pem"), KeyFile: keyFile},
+		{RedirectPort: 80},
+		{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.4"},
+	} {
+		_, err := NewTLS(&cnf)
+		assert.Error(t, err, cnf)
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	h := (&TLS{}).RedirectHandler(8443)
+	for target, want := range map[string]string{
+		"http://drive.example.com/api/files?x=1": "https://drive.example.com:8443/api/files?x=1",
+		"http://drive.example.com:8080/":         "https://drive.example.com:8443/",
+		"http://[::1]:8080/a":                    "https://[::1]:8443/a",
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, nil))
+		assert.Equal(t, http.StatusPermanentRedirect, rec.Code)
+		assert.Equal(t, want, rec.Header().Get("Location"), target)
+	}
+
+	rec := httptest.NewRecorder()
+	(&TLS{}).RedirectHandler(443).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://[::1]:80/", nil))
+	assert.Equal(t, "https://[::1]/", rec.Header().Get("Location"))
+}
+
+func TestIsSecure(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.False(t, IsSecure(r))
+	r.Header.Set("X-Forwarded-Proto", "HTTPS, http")
+	assert.True(t, IsSecure(r))
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.TLS = &tls.ConnectionState{}
+	assert.True(t, IsSecure(r))
+}
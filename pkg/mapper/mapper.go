@@ -10,37 +10,89 @@ func ToFileOut(file models.File) *schemas.FileOut {
 	if file.Size != nil {
 		size = *file.Size
 	}
+	var hash, hashAlgorithm string
+	if file.Hash != nil {
+		hash = *file.Hash
+	}
+	if file.HashAlgorithm != nil {
+		hashAlgorithm = *file.HashAlgorithm
+	}
 	return &schemas.FileOut{
-		Id:        file.Id,
-		Name:      file.Name,
-		Type:      file.Type,
-		MimeType:  file.MimeType,
-		Category:  file.Category,
-		Encrypted: file.Encrypted,
-		Size:      size,
-		ParentID:  file.ParentID.String,
-		UpdatedAt: file.UpdatedAt,
+		Id:               file.Id,
+		Name:             file.Name,
+		Type:             file.Type,
+		MimeType:         file.MimeType,
+		Category:         file.Category,
+		Encrypted:        file.Encrypted,
+		Encryption:       file.Encryption,
+		Size:             size,
+		ParentID:         file.ParentID.String,
+		UpdatedAt:        file.UpdatedAt,
+		ExpiresAt:        file.ExpiresAt,
+		Version:          file.Version,
+		Hash:             hash,
+		HashAlgorithm:    hashAlgorithm,
+		DefaultChannelID: file.DefaultChannelID,
+		DefaultEncrypted: file.DefaultEncrypted,
+
+		DefaultReplicaChannels: file.DefaultReplicaChannels,
 	}
 }
 
 func ToFileOutFull(file models.File) *schemas.FileOutFull {
 
 	return &schemas.FileOutFull{
-		FileOut:   ToFileOut(file),
-		Parts:     file.Parts,
-		ChannelID: file.ChannelID,
+		FileOut:    ToFileOut(file),
+		Parts:      file.Parts,
+		ChannelID:  file.ChannelID,
+		InlineData: file.InlineData,
+		KeyVersion: file.KeyVersion,
+		UserID:     file.UserID,
 	}
 }
 
 func ToUploadOut(in *models.Upload) *schemas.UploadPartOut {
 	out := &schemas.UploadPartOut{
+		Name:         in.Name,
+		PartId:       in.PartId,
+		ChannelID:    in.ChannelID,
+		PartNo:       in.PartNo,
+		Size:         in.Size,
+		Encrypted:    in.Encrypted,
+		Salt:         in.Salt,
+		Compression:  in.Compression,
+		OriginalSize: in.OriginalSize,
+		Replicas:     in.Replicas,
+		KeyVersion:   in.KeyVersion,
+	}
+	return out
+}
+
+func ToFileChange(in *models.ChangeLog) schemas.FileChange {
+	out := schemas.FileChange{
+		Event:     in.Event,
+		FileID:    in.FileId,
+		Type:      in.Type,
 		Name:      in.Name,
-		PartId:    in.PartId,
-		ChannelID: in.ChannelID,
-		PartNo:    in.PartNo,
-		Size:      in.Size,
-		Encrypted: in.Encrypted,
-		Salt:      in.Salt,
+		Timestamp: in.CreatedAt,
+	}
+	if in.ParentId != nil {
+		out.ParentID = *in.ParentId
+	}
+	if in.Path != nil {
+		out.Path = *in.Path
+	}
+	if in.OldPath != nil {
+		out.OldPath = *in.OldPath
+	}
+	if in.Size != nil {
+		out.Size = *in.Size
+	}
+	if in.Hash != nil {
+		out.Hash = *in.Hash
+	}
+	if in.HashAlgorithm != nil {
+		out.HashAlgorithm = *in.HashAlgorithm
 	}
 	return out
 }
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// FileAccess counts the streams and downloads of a file per day.
+type FileAccess struct {
+	FileID string    `gorm:"type:uuid;primaryKey"`
+	Day    time.Time `gorm:"type:date;primaryKey"`
+	Views  int64     `gorm:"type:bigint;not null;default:0"`
+	Bytes  int64     `gorm:"type:bigint;not null;default:0"`
+}
+
+// FileViewer counts the accesses of a file by one viewer, a user id or the
+// hash of a public client's IP.
+type FileViewer struct {
+	FileID    string    `gorm:"type:uuid;primaryKey"`
+	Viewer    string    `gorm:"type:text;primaryKey"`
+	Views     int64     `gorm:"type:bigint;not null;default:0"`
+	Bytes     int64     `gorm:"type:bigint;not null;default:0"`
+	FirstSeen time.Time `gorm:"type:timestamp;not null"`
+	LastSeen  time.Time `gorm:"type:timestamp;not null"`
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+)
+
+// ArchiveImport is an archive being extracted into a folder of the user. The
+// counters move as entries are handled, every entry is kept as an
+// ArchiveEntry.
+type ArchiveImport struct {
+	Id        string    `gorm:"type:uuid;primaryKey;default:uuid7()"`
+	UserId    int64     `gorm:"type:bigint;not null"`
+	Path      string    `gorm:"type:text;not null"`
+	Format    string    `gorm:"type:text;not null"`
+	Status    string    `gorm:"type:text;not null;default:'running'"`
+	Entries   int       `gorm:"type:integer;not null"`
+	Imported  int       `gorm:"type:integer;not null"`
+	Skipped   int       `gorm:"type:integer;not null"`
+	Failed    int       `gorm:"type:integer;not null"`
+	Bytes     int64     `gorm:"type:bigint;not null"`
+	Error     *string   `gorm:"type:text"`
+	CreatedAt time.Time `gorm:"default:timezone('utc'::text, now())"`
+	UpdatedAt time.Time `gorm:"default:timezone('utc'::text, now())"`
+}
+
+// ArchiveEntry is the outcome of one member of an imported archive, Seq is
+// its position in the archive.
+type ArchiveEntry struct {
+	ImportId string  `gorm:"type:uuid;primaryKey"`
+	Seq      int     `gorm:"type:integer;primaryKey"`
+	Path     string  `gorm:"type:text;not null"`
+	Type     string  `gorm:"type:text;not null"`
+	Status   string  `gorm:"type:text;not null"`
+	FileId   *string `gorm:"type:uuid"`
+	Size     int64   `gorm:"type:bigint;not null"`
+	Error    *string `gorm:"type:text"`
+}
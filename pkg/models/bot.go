@@ -1,9 +1,28 @@
 package models
 
+import "time"
+
 type Bot struct {
-	Token       string `gorm:"type:text;primaryKey"`
-	UserID      int64  `gorm:"type:bigint"`
-	BotID       int64  `gorm:"type:bigint"`
-	BotUserName string `gorm:"type:text"`
-	ChannelID   int64  `gorm:"type:bigint"`
+	Token       string  `gorm:"type:text;primaryKey"`
+	UserID      int64   `gorm:"type:bigint"`
+	BotID       int64   `gorm:"type:bigint"`
+	BotUserName string  `gorm:"type:text"`
+	ChannelID   int64   `gorm:"type:bigint"`
+	Rate        *int    `gorm:"type:integer"`
+	RateBurst   *int    `gorm:"type:integer"`
+	AppId       *int    `gorm:"type:integer"`
+	AppHash     *string `gorm:"type:text"`
+	Pool        string  `gorm:"type:text;not null;default:default"`
+
+	ValidatedAt     *time.Time `gorm:"type:timestamp"`
+	ValidationError *string    `gorm:"type:text"`
+}
+
+// BotPool assigns a role to the bots of a named pool in a channel. Pools
+// without a row have the default role.
+type BotPool struct {
+	UserID    int64  `gorm:"type:bigint;primaryKey"`
+	ChannelID int64  `gorm:"type:bigint;primaryKey"`
+	Name      string `gorm:"type:text;primaryKey"`
+	Role      string `gorm:"type:text;not null;default:default"`
 }
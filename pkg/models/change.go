@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// ChangeLog is an entry of the log the files table writes every change of an
+// active entry to. Seq orders the changes of all users.
+type ChangeLog struct {
+	Seq           int64     `gorm:"type:bigserial;primaryKey"`
+	UserId        int64     `gorm:"type:bigint;not null"`
+	FileId        string    `gorm:"type:uuid;not null"`
+	Event         string    `gorm:"type:text;not null"`
+	Type          string    `gorm:"type:text;not null"`
+	Name          string    `gorm:"type:text;not null"`
+	ParentId      *string   `gorm:"type:uuid"`
+	Path          *string   `gorm:"type:text"`
+	OldPath       *string   `gorm:"type:text"`
+	Size          *int64    `gorm:"type:bigint"`
+	Hash          *string   `gorm:"type:text"`
+	HashAlgorithm *string   `gorm:"type:text"`
+	CreatedAt     time.Time `gorm:"default:timezone('utc'::text, now())"`
+}
+
+func (ChangeLog) TableName() string {
+	return "teldrive.change_log"
+}
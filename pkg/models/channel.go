@@ -1,8 +1,12 @@
 package models
 
+import "time"
+
 type Channel struct {
-	ChannelID   int64  `gorm:"type:bigint;primaryKey"`
-	ChannelName string `gorm:"type:text"`
-	UserID      int64  `gorm:"type:bigint;"`
-	Selected    bool   `gorm:"type:boolean;"`
+	ChannelID   int64      `gorm:"type:bigint;primaryKey"`
+	ChannelName string     `gorm:"type:text"`
+	UserID      int64      `gorm:"type:bigint;"`
+	Selected    bool       `gorm:"type:boolean;"`
+	Messages    int64      `gorm:"type:bigint;default:0"`
+	PickedAt    *time.Time `gorm:"type:timestamp"`
 }
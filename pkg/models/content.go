@@ -0,0 +1,7 @@
+package models
+
+// FileContent holds the searchable text of a small text file.
+type FileContent struct {
+	FileID  string `gorm:"type:uuid;primaryKey"`
+	Content string `gorm:"type:text;not null"`
+}
@@ -9,18 +9,29 @@ import (
 )
 
 type File struct {
-	Id        string                            `gorm:"type:uuid;primaryKey;default:uuid7()"`
-	Name      string                            `gorm:"type:text;not null"`
-	Type      string                            `gorm:"type:text;not null"`
-	MimeType  string                            `gorm:"type:text;not null"`
-	Size      *int64                            `gorm:"type:bigint"`
-	Category  string                            `gorm:"type:text"`
-	Encrypted bool                              `gorm:"default:false"`
-	UserID    int64                             `gorm:"type:bigint;not null"`
-	Status    string                            `gorm:"type:text"`
-	ParentID  sql.NullString                    `gorm:"type:uuid;index"`
-	Parts     datatypes.JSONSlice[schemas.Part] `gorm:"type:jsonb"`
-	ChannelID *int64                            `gorm:"type:bigint"`
-	CreatedAt time.Time                         `gorm:"default:timezone('utc'::text, now())"`
-	UpdatedAt time.Time                         `gorm:"default:timezone('utc'::text, now())"`
+	Id                     string                            `gorm:"type:uuid;primaryKey;default:uuid7()"`
+	Name                   string                            `gorm:"type:text;not null"`
+	Type                   string                            `gorm:"type:text;not null"`
+	MimeType               string                            `gorm:"type:text;not null"`
+	Size                   *int64                            `gorm:"type:bigint"`
+	Category               string                            `gorm:"type:text"`
+	Encrypted              bool                              `gorm:"default:false"`
+	Encryption             string                            `gorm:"type:text;not null;default:'none'"`
+	UserID                 int64                             `gorm:"type:bigint;not null"`
+	Status                 string                            `gorm:"type:text"`
+	ParentID               sql.NullString                    `gorm:"type:uuid;index"`
+	Parts                  datatypes.JSONSlice[schemas.Part] `gorm:"type:jsonb"`
+	ChannelID              *int64                            `gorm:"type:bigint"`
+	Version                int64                             `gorm:"type:bigint;not null;default:1"`
+	Hash                   *string                           `gorm:"type:text"`
+	HashAlgorithm          *string                           `gorm:"type:text"`
+	InlineData             []byte                            `gorm:"type:bytea"`
+	KeyVersion             int                               `gorm:"type:integer;not null;default:0"`
+	LastAccessedAt         *time.Time                        `gorm:"type:timestamp"`
+	ExpiresAt              *time.Time                        `gorm:"type:timestamp"`
+	DefaultChannelID       *int64                            `gorm:"type:bigint"`
+	DefaultEncrypted       *bool                             `gorm:"type:boolean"`
+	DefaultReplicaChannels datatypes.JSONSlice[int64]        `gorm:"type:jsonb"`
+	CreatedAt              time.Time                         `gorm:"default:timezone('utc'::text, now())"`
+	UpdatedAt              time.Time                         `gorm:"default:timezone('utc'::text, now())"`
 }
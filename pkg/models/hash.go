@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+)
+
+// HashJob backfills the hashes of a user's files in the background. Files are
+// visited in id order, LastFileID lets an interrupted job resume.
+type HashJob struct {
+	Id         string    `gorm:"type:uuid;primaryKey;default:uuid7()"`
+	UserId     int64     `gorm:"type:bigint;not null"`
+	Algorithm  string    `gorm:"type:text;not null"`
+	Status     string    `gorm:"type:text;not null;default:'queued'"`
+	LastFileID *string   `gorm:"type:uuid"`
+	Total      int       `gorm:"type:integer;not null"`
+	Hashed     int       `gorm:"type:integer;not null"`
+	Failed     int       `gorm:"type:integer;not null"`
+	Error      *string   `gorm:"type:text"`
+	CreatedAt  time.Time `gorm:"default:timezone('utc'::text, now())"`
+	UpdatedAt  time.Time `gorm:"default:timezone('utc'::text, now())"`
+}
+
+// HashCheckpoint is the saved state of a hash interrupted part way through a
+// file.
+type HashCheckpoint struct {
+	FileID      string    `gorm:"type:uuid;primaryKey"`
+	Algorithm   string    `gorm:"type:text;not null"`
+	HashedBytes int64     `gorm:"type:bigint;not null"`
+	State       []byte    `gorm:"type:bytea;not null"`
+	UpdatedAt   time.Time `gorm:"default:timezone('utc'::text, now())"`
+}
@@ -5,9 +5,12 @@ import (
 )
 
 type Session struct {
-	UserId      int64     `gorm:"type:bigint;primaryKey"`
-	Hash        string    `gorm:"type:text"`
-	SessionDate int       `gorm:"type:text"`
-	Session     string    `gorm:"type:text"`
-	CreatedAt   time.Time `gorm:"default:timezone('utc'::text, now())"`
+	UserId      int64      `gorm:"type:bigint;primaryKey"`
+	Hash        string     `gorm:"type:text"`
+	SessionDate int        `gorm:"type:text"`
+	Session     string     `gorm:"type:text"`
+	AppId       *int       `gorm:"type:integer"`
+	AppHash     *string    `gorm:"type:text"`
+	CreatedAt   time.Time  `gorm:"default:timezone('utc'::text, now())"`
+	LastSeenAt  *time.Time `gorm:"type:timestamp"`
 }
@@ -9,7 +9,14 @@ type FileShare struct {
 	FileID    string     `gorm:"type:uuid;not null"`
 	Password  *string    `gorm:"type:text"`
 	ExpiresAt *time.Time `gorm:"type:timestamp"`
-	CreatedAt time.Time  `gorm:"type:timestamp;not null;default:current_timestamp"`
-	UpdatedAt time.Time  `gorm:"type:timestamp;not null;default:current_timestamp"`
-	UserID    int64      `gorm:"type:bigint;not null"`
+	// FollowsFile keeps the share working when the file is moved or renamed.
+	FollowsFile *bool `gorm:"type:boolean;not null;default:true"`
+	// MaxDownloads disables the share once Downloads reaches it.
+	MaxDownloads *int64    `gorm:"type:bigint"`
+	Downloads    int64     `gorm:"type:bigint;not null;default:0"`
+	CreatedAt    time.Time `gorm:"type:timestamp;not null;default:current_timestamp"`
+	UpdatedAt    time.Time `gorm:"type:timestamp;not null;default:current_timestamp"`
+	UserID       int64     `gorm:"type:bigint;not null"`
+	// DownloadName replaces the file name downloaders of a shared file see.
+	DownloadName *string `gorm:"type:text"`
 }
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"gorm.io/datatypes"
+)
+
+// FolderTemplate is a saved folder structure that can be recreated anywhere.
+type FolderTemplate struct {
+	ID        string                                  `gorm:"type:uuid;default:uuid_generate_v4();primary_key"`
+	UserID    int64                                   `gorm:"type:bigint;not null"`
+	Name      string                                  `gorm:"type:text;not null"`
+	Folders   datatypes.JSONSlice[schemas.FolderNode] `gorm:"type:jsonb;not null"`
+	CreatedAt time.Time                               `gorm:"type:timestamp;not null;default:current_timestamp"`
+}
@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+// FileTransfer records files handed over from one user to another. Files are
+// the top level entries, Entries counts them along with everything below.
+type FileTransfer struct {
+	Id          string                      `gorm:"type:uuid;primaryKey;default:uuid7()"`
+	FromUserId  int64                       `gorm:"type:bigint;not null"`
+	ToUserId    int64                       `gorm:"type:bigint;not null"`
+	Files       datatypes.JSONSlice[string] `gorm:"type:jsonb;not null"`
+	Destination string                      `gorm:"type:text;not null"`
+	Entries     int                         `gorm:"type:integer;not null"`
+	Parts       int                         `gorm:"type:integer;not null"`
+	Bytes       int64                       `gorm:"type:bigint;not null"`
+	CreatedAt   time.Time                   `gorm:"default:timezone('utc'::text, now())"`
+}
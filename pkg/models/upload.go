@@ -2,17 +2,61 @@ package models
 
 import (
 	"time"
+
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"gorm.io/datatypes"
 )
 
 type Upload struct {
-	UploadId  string    `gorm:"type:text"`
-	UserId    int64     `gorm:"type:bigint"`
-	Name      string    `gorm:"type:text"`
-	PartNo    int       `gorm:"type:integer"`
-	PartId    int       `gorm:"type:integer"`
-	Encrypted bool      `gorm:"default:false"`
-	Salt      string    `gorm:"type:text"`
-	ChannelID int64     `gorm:"type:bigint"`
-	Size      int64     `gorm:"type:bigint"`
+	UploadId     string                               `gorm:"type:text"`
+	UserId       int64                                `gorm:"type:bigint"`
+	Name         string                               `gorm:"type:text"`
+	PartNo       int                                  `gorm:"type:integer"`
+	PartId       int                                  `gorm:"type:integer"`
+	Encrypted    bool                                 `gorm:"default:false"`
+	Salt         string                               `gorm:"type:text"`
+	ChannelID    int64                                `gorm:"type:bigint"`
+	Size         int64                                `gorm:"type:bigint"`
+	Compression  string                               `gorm:"type:text"`
+	OriginalSize int64                                `gorm:"type:bigint"`
+	InlineData   []byte                               `gorm:"type:bytea"`
+	Content      *string                              `gorm:"type:text"`
+	MimeType     *string                              `gorm:"type:text"`
+	Replicas     datatypes.JSONSlice[schemas.Replica] `gorm:"type:jsonb"`
+	KeyVersion   int                                  `gorm:"type:integer;not null;default:0"`
+	CreatedAt    time.Time                            `gorm:"default:timezone('utc'::text, now())"`
+}
+
+// UploadSession pins the destination, channel and encryption of an upload
+// before its parts are sent and holds the size and part count it reserved.
+type UploadSession struct {
+	UploadId   string    `gorm:"type:text;primaryKey"`
+	UserId     int64     `gorm:"type:bigint;not null"`
+	Name       string    `gorm:"type:text;not null"`
+	Path       string    `gorm:"type:text;not null"`
+	ParentID   string    `gorm:"type:text;not null"`
+	ChannelID  int64     `gorm:"type:bigint;not null"`
+	Encryption string    `gorm:"type:text;not null"`
+	TotalSize  *int64    `gorm:"type:bigint"`
+	TotalParts *int      `gorm:"type:integer"`
+	CreatedAt  time.Time `gorm:"default:timezone('utc'::text, now())"`
+	ExpiresAt  time.Time `gorm:"type:timestamp;not null"`
+}
+
+// UploadPartNumber holds the last part number handed out for an upload whose
+// parts the server numbers.
+type UploadPartNumber struct {
+	UserId    int64     `gorm:"type:bigint;primaryKey"`
+	UploadId  string    `gorm:"type:text;primaryKey"`
+	PartNo    int       `gorm:"type:integer;not null"`
+	UpdatedAt time.Time `gorm:"default:timezone('utc'::text, now())"`
+}
+
+// UploadRetention keeps the parts of an upload past the configured retention
+// until ExpiresAt.
+type UploadRetention struct {
+	UploadId  string    `gorm:"type:text;primaryKey"`
+	UserId    int64     `gorm:"type:bigint;not null"`
+	ExpiresAt time.Time `gorm:"type:timestamp;not null"`
 	CreatedAt time.Time `gorm:"default:timezone('utc'::text, now())"`
 }
@@ -2,13 +2,39 @@ package models
 
 import (
 	"time"
+
+	"gorm.io/datatypes"
 )
 
 type User struct {
+	UserId     int64          `gorm:"type:bigint;primaryKey"`
+	Name       string         `gorm:"type:text"`
+	UserName   string         `gorm:"type:text"`
+	IsPremium  bool           `gorm:"type:bool"`
+	Rate       *int           `gorm:"type:integer"`
+	RateBurst  *int           `gorm:"type:integer"`
+	FileTypes  datatypes.JSON `gorm:"type:jsonb"`
+	MaxFiles   *int64         `gorm:"type:bigint"`
+	MaxFolders *int64         `gorm:"type:bigint"`
+	Settings   datatypes.JSON `gorm:"type:jsonb"`
+	UpdatedAt  time.Time      `gorm:"default:timezone('utc'::text, now())"`
+	CreatedAt  time.Time      `gorm:"default:timezone('utc'::text, now())"`
+}
+
+// UserKey is a version of the secret the user's encryption key is derived
+// from. Parts record the version that encrypted them, so older versions stay
+// readable after a rotation.
+type UserKey struct {
 	UserId    int64     `gorm:"type:bigint;primaryKey"`
-	Name      string    `gorm:"type:text"`
-	UserName  string    `gorm:"type:text"`
-	IsPremium bool      `gorm:"type:bool"`
-	UpdatedAt time.Time `gorm:"default:timezone('utc'::text, now())"`
+	Version   int       `gorm:"type:integer;primaryKey"`
+	Secret    string    `gorm:"type:text;not null"`
 	CreatedAt time.Time `gorm:"default:timezone('utc'::text, now())"`
 }
+
+// EntryCount is the number of active files and folders of a user, kept up to
+// date by a trigger on the files table.
+type EntryCount struct {
+	UserId  int64 `gorm:"type:bigint;primaryKey"`
+	Files   int64 `gorm:"type:bigint;not null"`
+	Folders int64 `gorm:"type:bigint;not null"`
+}
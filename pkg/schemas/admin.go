@@ -0,0 +1,124 @@
+package schemas
+
+import "time"
+
+type LogLevel struct {
+	Level string `json:"level" binding:"required"`
+}
+
+type FileTypes struct {
+	AllowedExtensions []string `json:"allowedExtensions,omitempty"`
+	DeniedExtensions  []string `json:"deniedExtensions,omitempty"`
+	AllowedMimeTypes  []string `json:"allowedMimeTypes,omitempty"`
+	DeniedMimeTypes   []string `json:"deniedMimeTypes,omitempty"`
+}
+
+type UserFileTypes struct {
+	UserID    int64     `json:"userId"`
+	Override  bool      `json:"override"`
+	FileTypes FileTypes `json:"fileTypes"`
+}
+
+// EntryLimits caps the files and folders of a user, zero meaning no limit. A
+// missing limit keeps the configured one.
+type EntryLimits struct {
+	MaxFiles   *int64 `json:"maxFiles" binding:"omitempty,min=0"`
+	MaxFolders *int64 `json:"maxFolders" binding:"omitempty,min=0"`
+}
+
+type UserEntryLimits struct {
+	UserID     int64 `json:"userId"`
+	Override   bool  `json:"override"`
+	MaxFiles   int64 `json:"maxFiles"`
+	MaxFolders int64 `json:"maxFolders"`
+	Files      int64 `json:"files"`
+	Folders    int64 `json:"folders"`
+}
+
+// Maintenance is the read-only mode state. Engaged turns true once writes
+// started before the mode was enabled have finished.
+type Maintenance struct {
+	Enabled       bool       `json:"enabled"`
+	Engaged       bool       `json:"engaged"`
+	Message       string     `json:"message,omitempty"`
+	Since         *time.Time `json:"since,omitempty"`
+	PendingWrites int64      `json:"pendingWrites"`
+}
+
+type MaintenanceIn struct {
+	Enabled *bool  `json:"enabled" binding:"required"`
+	Message string `json:"message"`
+}
+
+// SchedulerQueue is the request queue of a Telegram account, wait times are
+// in milliseconds.
+type SchedulerQueue struct {
+	Account string              `json:"account"`
+	Queued  int                 `json:"queued"`
+	Users   []SchedulerUserWait `json:"users"`
+}
+
+type SchedulerUserWait struct {
+	UserID    int64   `json:"userId"`
+	Queued    int     `json:"queued"`
+	Admitted  int64   `json:"admitted"`
+	AvgWaitMs float64 `json:"avgWaitMs"`
+	MaxWaitMs float64 `json:"maxWaitMs"`
+}
+
+// RetryPolicy is the retry policy in effect for an operation, durations are
+// in milliseconds and zero disables them.
+type RetryPolicy struct {
+	Operation    string   `json:"operation"`
+	MaxRetries   int      `json:"maxRetries"`
+	BackoffMs    int64    `json:"backoffMs"`
+	MaxBackoffMs int64    `json:"maxBackoffMs"`
+	TimeoutMs    int64    `json:"timeoutMs"`
+	RetriedOn    []string `json:"retriedOn"`
+}
+
+// OrphanQuery selects the dangling entries to report. UserID is only honoured
+// for admins, 0 reports all users.
+type OrphanQuery struct {
+	Kind         string `form:"kind" binding:"omitempty,oneof=broken-parent expired-upload missing-parts"`
+	UserID       int64  `form:"userId"`
+	SkipTelegram bool   `form:"skipTelegram"`
+	Limit        int    `form:"limit" binding:"omitempty,min=1,max=500"`
+	Page         int    `form:"page" binding:"omitempty,min=1"`
+}
+
+type Orphan struct {
+	Kind     string `json:"kind"`
+	UserID   int64  `json:"userId"`
+	FileID   string `json:"fileId,omitempty"`
+	Detail   string `json:"detail"`
+	Repaired bool   `json:"repaired"`
+}
+
+type OrphanList struct {
+	Counts map[string]int `json:"counts"`
+	Items  []Orphan       `json:"items"`
+	Meta   Meta           `json:"meta"`
+}
+
+// OrphanRepair cleans up dangling entries. Broken parents are moved to
+// Destination, expired uploads are dropped and files with missing parts are
+// marked unavailable.
+type OrphanRepair struct {
+	Kinds          []string `json:"kinds" binding:"omitempty,dive,oneof=broken-parent expired-upload missing-parts"`
+	FileIDs        []string `json:"fileIds"`
+	UserID         int64    `json:"userId"`
+	Destination    string   `json:"destination"`
+	DeleteMessages bool     `json:"deleteMessages"`
+	SkipTelegram   bool     `json:"skipTelegram"`
+}
+
+// TelegramCheck is the data center a client of the caller's session reached,
+// with the round trip of the check in milliseconds.
+type TelegramCheck struct {
+	ThisDC    int     `json:"thisDc"`
+	NearestDC int     `json:"nearestDc"`
+	Country   string  `json:"country"`
+	Override  string  `json:"override,omitempty"`
+	LatencyMs float64 `json:"latencyMs"`
+}
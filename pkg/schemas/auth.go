@@ -1,12 +1,20 @@
 package schemas
 
 type TgSession struct {
-	Sesssion  string `json:"session"`
-	UserID    int64  `json:"userId"`
-	Bot       bool   `json:"bot"`
-	UserName  string `json:"userName"`
-	Name      string `json:"name"`
-	IsPremium bool   `json:"isPremium"`
+	Sesssion  string  `json:"session"`
+	UserID    int64   `json:"userId"`
+	Bot       bool    `json:"bot"`
+	UserName  string  `json:"userName"`
+	Name      string  `json:"name"`
+	IsPremium bool    `json:"isPremium"`
+	AppId     *int    `json:"appId,omitempty"`
+	AppHash   *string `json:"appHash,omitempty"`
+}
+
+type LoginOut struct {
+	Message   string   `json:"message"`
+	ChannelID int64    `json:"channelId,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
 }
 
 type Session struct {
@@ -26,3 +34,35 @@ type SessionOut struct {
 	Valid       bool   `json:"valid"`
 	Current     bool   `json:"current"`
 }
+
+// LoginGateOut tells the login page what to collect before opening the login
+// socket, the solved CAPTCHA or invite code goes in its gateToken parameter.
+type LoginGateOut struct {
+	Gate     string `json:"gate"`
+	Provider string `json:"provider,omitempty"`
+	SiteKey  string `json:"siteKey,omitempty"`
+}
+
+// SessionCheck is a session string to check before logging in with it.
+// Offline only decodes it, without asking Telegram whether it is still live.
+type SessionCheck struct {
+	Session   string  `json:"session" binding:"required"`
+	Offline   bool    `json:"offline,omitempty"`
+	AppId     *int    `json:"appId,omitempty"`
+	AppHash   *string `json:"appHash,omitempty"`
+	GateToken string  `json:"gateToken,omitempty"`
+}
+
+// SessionCheckOut describes a checked session. The account is only known
+// once Telegram accepted the session, Reason explains any other status.
+type SessionCheckOut struct {
+	Status    string `json:"status"`
+	Dc        int    `json:"dc"`
+	UserID    int64  `json:"userId,omitempty"`
+	UserName  string `json:"userName,omitempty"`
+	Name      string `json:"name,omitempty"`
+	IsPremium bool   `json:"isPremium,omitempty"`
+	Bot       bool   `json:"bot,omitempty"`
+	Allowed   bool   `json:"allowed,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
@@ -3,3 +3,24 @@ package schemas
 type Message struct {
 	Message string `json:"message"`
 }
+
+type AffectedFile struct {
+	Id          string `json:"id,omitempty"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Action      string `json:"action"`
+	Descendants int64  `json:"descendants,omitempty"`
+}
+
+type OperationConflict struct {
+	Id     string `json:"id,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Reason string `json:"reason"`
+}
+
+type OperationResult struct {
+	Message   string              `json:"message"`
+	DryRun    bool                `json:"dryRun,omitempty"`
+	Files     []AffectedFile      `json:"files"`
+	Conflicts []OperationConflict `json:"conflicts,omitempty"`
+}
@@ -0,0 +1,67 @@
+package schemas
+
+import "time"
+
+const ExportVersion = 1
+
+type ExportFile struct {
+	Id            string    `json:"id" binding:"required"`
+	Name          string    `json:"name" binding:"required"`
+	Type          string    `json:"type" binding:"required,oneof=file folder"`
+	MimeType      string    `json:"mimeType"`
+	Category      string    `json:"category,omitempty"`
+	Size          int64     `json:"size"`
+	Encrypted     bool      `json:"encrypted"`
+	Encryption    string    `json:"encryption,omitempty" binding:"omitempty,oneof=none server client"`
+	ParentID      string    `json:"parentId,omitempty"`
+	Parts         []Part    `json:"parts,omitempty"`
+	ChannelID     int64     `json:"channelId,omitempty"`
+	Hash          string    `json:"hash,omitempty"`
+	HashAlgorithm string    `json:"hashAlgorithm,omitempty" binding:"omitempty,oneof=md5 sha1 sha256 sha512"`
+	Data          []byte    `json:"data,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+type Export struct {
+	Version    int          `json:"version" binding:"required"`
+	ExportedAt time.Time    `json:"exportedAt"`
+	Channels   []Channel    `json:"channels"`
+	Files      []ExportFile `json:"files" binding:"dive"`
+}
+
+type ImportResult struct {
+	Imported int      `json:"imported"`
+	Merged   int      `json:"merged"`
+	Skipped  int      `json:"skipped"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// FileReportQuery selects the entries of an inventory report. Path limits it
+// to a folder and everything below it, Since and Until to entries updated in
+// that window. After resumes a report following the entry with that id, as
+// entries are reported in id order.
+type FileReportQuery struct {
+	Format   string     `form:"format" binding:"omitempty,oneof=csv json"`
+	Path     string     `form:"path"`
+	Type     string     `form:"type" binding:"omitempty,oneof=file folder"`
+	Category string     `form:"category"`
+	Since    *time.Time `form:"since"`
+	Until    *time.Time `form:"until"`
+	After    string     `form:"after" binding:"omitempty,uuid"`
+}
+
+// FileReportRow is an entry of an inventory report.
+type FileReportRow struct {
+	Id            string    `json:"id"`
+	Path          string    `json:"path"`
+	Type          string    `json:"type"`
+	Size          int64     `json:"size"`
+	MimeType      string    `json:"mimeType"`
+	Category      string    `json:"category,omitempty"`
+	Hash          string    `json:"hash,omitempty"`
+	HashAlgorithm string    `json:"hashAlgorithm,omitempty"`
+	ChannelID     int64     `json:"channelId,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
@@ -7,51 +7,212 @@ import (
 )
 
 type Part struct {
-	ID   int64  `json:"id"`
-	Salt string `json:"salt,omitempty"`
+	ID           int64     `json:"id"`
+	Salt         string    `json:"salt,omitempty"`
+	Compression  string    `json:"compression,omitempty"`
+	OriginalSize int64     `json:"originalSize,omitempty"`
+	Replicas     []Replica `json:"replicas,omitempty"`
+	KeyVersion   int       `json:"keyVersion,omitempty"`
 }
 
+// Replica is a copy of a part's message in another channel, read when the
+// primary message can no longer be.
+type Replica struct {
+	ChannelID int64 `json:"channelId"`
+	ID        int64 `json:"id"`
+}
+
+// ReplicaStatus tells how many parts of a file have a replica in a channel.
+type ReplicaStatus struct {
+	ChannelID int64 `json:"channelId"`
+	Parts     int   `json:"parts"`
+	Complete  bool  `json:"complete"`
+}
+
+// ReplicaMessages groups the message ids of the replicas of parts by channel.
+func ReplicaMessages(parts []Part) map[int64][]int {
+	messages := map[int64][]int{}
+	for _, part := range parts {
+		for _, replica := range part.Replicas {
+			messages[replica.ChannelID] = append(messages[replica.ChannelID], int(replica.ID))
+		}
+	}
+	return messages
+}
+
+// FileQuery filters a listing. Sort is one of name, size, updatedAt or
+// createdAt and Order asc or desc, files with equal sort keys are ordered by
+// id.
 type FileQuery struct {
 	Name       string `form:"name"`
 	Query      string `form:"query"`
+	Content    bool   `form:"content"`
 	Type       string `form:"type"`
 	Path       string `form:"path"`
 	Op         string `form:"op"`
 	DeepSearch bool   `form:"deepSearch"`
+	Recursive  bool   `form:"recursive"`
 	Shared     *bool  `form:"shared"`
 	ParentID   string `form:"parentId"`
 	Category   string `form:"category"`
 	UpdatedAt  string `form:"updatedAt"`
-	Sort       string `form:"sort"`
-	Order      string `form:"order"`
+	MimeType   string `form:"mimeType"`
+	MinSize    *int64 `form:"minSize" binding:"omitempty,min=0"`
+	MaxSize    *int64 `form:"maxSize" binding:"omitempty,min=0"`
+	Sort       string `form:"sort" binding:"omitempty,oneof=name size updatedAt createdAt"`
+	Order      string `form:"order" binding:"omitempty,oneof=asc desc"`
 	Limit      int    `form:"limit"`
 	Page       int    `form:"page"`
+
+	IncludeAncestors bool `form:"includeAncestors"`
+}
+
+type ExtractQuery struct {
+	Start int64  `form:"start" binding:"min=0"`
+	End   *int64 `form:"end" binding:"omitempty,min=0"`
+}
+
+// TextPreviewQuery selects the window of a text file a preview returns.
+// Offset counts bytes of the stored file, Lines caps the lines returned and
+// Encoding overrides detection, the encoding of a previous window is passed
+// back when paging.
+type TextPreviewQuery struct {
+	Offset   int64  `form:"offset" binding:"min=0"`
+	Bytes    int64  `form:"bytes" binding:"omitempty,min=64,max=1048576"`
+	Lines    int    `form:"lines" binding:"omitempty,min=1"`
+	Encoding string `form:"encoding" binding:"omitempty,oneof=utf-8 utf-16le utf-16be latin-1"`
+}
+
+// TextPreview is a window of a text file decoded to UTF-8. NextOffset is
+// where the following window starts, zero once the end of the file is in.
+type TextPreview struct {
+	Text       string `json:"text"`
+	Encoding   string `json:"encoding"`
+	Offset     int64  `json:"offset"`
+	NextOffset int64  `json:"nextOffset,omitempty"`
+	Size       int64  `json:"size"`
+	Lines      int    `json:"lines"`
+	Truncated  bool   `json:"truncated"`
+}
+
+type RecentQuery struct {
+	By    string `form:"by" binding:"omitempty,oneof=created accessed"`
+	Limit int    `form:"limit" binding:"omitempty,min=1,max=500"`
+}
+
+// FileExpiry schedules the deletion of a file or folder. A null ExpiresAt
+// cancels it.
+type FileExpiry struct {
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// ExpiringQuery pages through the entries of the user due to be deleted
+// within the next Days days.
+type ExpiringQuery struct {
+	Days  int `form:"days" binding:"omitempty,min=1,max=3650"`
+	Limit int `form:"limit" binding:"omitempty,min=1,max=1000"`
+	Page  int `form:"page" binding:"omitempty,min=1"`
+}
+
+// ChannelFileQuery pages through the files stored in a channel. With
+// Replicas set files keeping only a replica of their parts there are included.
+type ChannelFileQuery struct {
+	Replicas bool `form:"replicas"`
+	Limit    int  `form:"limit" binding:"omitempty,min=1,max=1000"`
+	Page     int  `form:"page" binding:"omitempty,min=1"`
+}
+
+type ChannelFiles struct {
+	ChannelID int64     `json:"channelId"`
+	Count     int64     `json:"count"`
+	TotalSize int64     `json:"totalSize"`
+	Files     []FileOut `json:"files"`
+	Meta      Meta      `json:"meta"`
+}
+
+// ChangeQuery asks for the changes after the Since cursor. Without a cursor
+// only the current cursor is returned, to start following changes from.
+type ChangeQuery struct {
+	Since string `form:"since"`
+	Limit int    `form:"limit" binding:"omitempty,min=1,max=1000"`
+}
+
+type FileChange struct {
+	Event         string    `json:"event"`
+	FileID        string    `json:"fileId"`
+	Type          string    `json:"type"`
+	Name          string    `json:"name"`
+	ParentID      string    `json:"parentId,omitempty"`
+	Path          string    `json:"path,omitempty"`
+	OldPath       string    `json:"oldPath,omitempty"`
+	Size          int64     `json:"size,omitempty"`
+	Hash          string    `json:"hash,omitempty"`
+	HashAlgorithm string    `json:"hashAlgorithm,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+type ChangeList struct {
+	Changes []FileChange `json:"changes"`
+	Cursor  string       `json:"cursor"`
+	HasMore bool         `json:"hasMore"`
 }
 
 type FileIn struct {
-	Name      string `json:"name" binding:"required"`
-	Type      string `json:"type" binding:"required"`
-	Parts     []Part `json:"parts,omitempty"`
-	MimeType  string `json:"mimeType"`
-	ChannelID int64  `json:"channelId"`
-	Path      string `json:"path" binding:"required"`
-	Size      int64  `json:"size"`
-	ParentID  string `json:"parentId"`
-	Encrypted bool   `json:"encrypted"`
+	Name          string  `json:"name" binding:"required"`
+	Type          string  `json:"type" binding:"required"`
+	Parts         []Part  `json:"parts,omitempty"`
+	MimeType      string  `json:"mimeType"`
+	ChannelID     int64   `json:"channelId"`
+	Path          string  `json:"path" binding:"required"`
+	Size          int64   `json:"size"`
+	ParentID      string  `json:"parentId"`
+	Encrypted     *bool   `json:"encrypted,omitempty"`
+	Encryption    string  `json:"encryption,omitempty" binding:"omitempty,oneof=none server client"`
+	Conflict      string  `json:"conflict" binding:"omitempty,oneof=error rename replace"`
+	UploadId      string  `json:"uploadId,omitempty"`
+	Hash          string  `json:"hash,omitempty"`
+	HashAlgorithm string  `json:"hashAlgorithm,omitempty" binding:"omitempty,oneof=md5 sha1 sha256 sha512"`
+	Data          []byte  `json:"data,omitempty"`
+	DryRun        bool    `json:"-"`
+	Content       *string `json:"-"`
 }
 
 type FileOut struct {
-	Id         string    `json:"id"`
-	Name       string    `json:"name"`
-	Type       string    `json:"type"`
-	MimeType   string    `json:"mimeType"`
-	Category   string    `json:"category,omitempty"`
-	Encrypted  bool      `json:"encrypted"`
-	Size       int64     `json:"size,omitempty"`
-	ParentID   string    `json:"parentId,omitempty"`
-	ParentPath string    `json:"parentPath,omitempty"`
-	UpdatedAt  time.Time `json:"updatedAt,omitempty"`
-	Total      int       `json:"total,omitempty"`
+	Id               string     `json:"id"`
+	Name             string     `json:"name"`
+	Type             string     `json:"type"`
+	MimeType         string     `json:"mimeType"`
+	Category         string     `json:"category,omitempty"`
+	Encrypted        bool       `json:"encrypted"`
+	Encryption       string     `json:"encryption,omitempty"`
+	Size             int64      `json:"size,omitempty"`
+	ParentID         string     `json:"parentId,omitempty"`
+	ParentPath       string     `json:"parentPath,omitempty"`
+	UpdatedAt        time.Time  `json:"updatedAt,omitempty"`
+	Total            int        `json:"total,omitempty"`
+	Conflict         string     `json:"conflict,omitempty"`
+	Version          int64      `json:"version,omitempty"`
+	Hash             string     `json:"hash,omitempty"`
+	HashAlgorithm    string     `json:"hashAlgorithm,omitempty"`
+	DryRun           bool       `json:"dryRun,omitempty"`
+	Replaced         []string   `json:"replaced,omitempty"`
+	CreatedAt        *time.Time `json:"createdAt,omitempty"`
+	LastAccessedAt   *time.Time `json:"lastAccessedAt,omitempty"`
+	ExpiresAt        *time.Time `json:"expiresAt,omitempty"`
+	DefaultChannelID *int64     `json:"defaultChannelId,omitempty"`
+	DefaultEncrypted *bool      `json:"defaultEncrypted,omitempty"`
+	Thumbnail        string     `json:"thumbnail,omitempty" gorm:"-"`
+
+	DefaultReplicaChannels datatypes.JSONSlice[int64] `json:"defaultReplicaChannels,omitempty"`
+	Replication            []ReplicaStatus            `json:"replication,omitempty" gorm:"-"`
+	Ancestors              []Ancestor                 `json:"ancestors,omitempty" gorm:"-"`
+}
+
+// Ancestor is a folder above an entry. Chains run from the root, which is
+// named "/", down to the entry's parent.
+type Ancestor struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
 }
 
 type FileOutFull struct {
@@ -59,13 +220,45 @@ type FileOutFull struct {
 	Parts     datatypes.JSONSlice[Part] `json:"parts,omitempty"`
 	ChannelID *int64                    `json:"channelId,omitempty"`
 	Path      string                    `json:"path,omitempty"`
+	Links     *FileLinks                `json:"links,omitempty" gorm:"-"`
+	// InlineData holds the content of files small enough to live in the
+	// database, encrypted like a part when the file is.
+	InlineData []byte `json:"-" msgpack:",omitempty"`
+	// KeyVersion is the version of the owner's key that sealed InlineData.
+	KeyVersion int   `json:"-"`
+	UserID     int64 `json:"-"`
+}
+
+type FileLinks struct {
+	Stream    string            `json:"stream"`
+	Download  string            `json:"download"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+	Apps      map[string]string `json:"apps,omitempty"`
 }
 
+// Version is bumped by the database on every update of a file row. UpdateFile,
+// MoveFiles and DeleteFiles reject the request with 409 when an expected
+// version is supplied and no longer matches.
+//
+// GetFileByID and UpdateFile also send the version as an ETag. UpdateFile
+// honours If-Match with that ETag and answers 412 when it is stale, while
+// GetFileByID answers 304 to a matching If-None-Match.
 type FileUpdate struct {
 	Name      string    `json:"name,omitempty"`
 	UpdatedAt time.Time `json:"updatedAt,omitempty"`
 	Parts     []Part    `json:"parts,omitempty"`
 	Size      *int64    `json:"size,omitempty"`
+	Version   *int64    `json:"version,omitempty"`
+	IfMatch   string    `json:"-"`
+
+	// Upload defaults of a folder, inherited by uploads into it and its
+	// descendants. Parts of files uploaded below a folder with replica channels
+	// are mirrored to them. ResetDefaults clears all defaults before the new
+	// values are applied.
+	DefaultChannelID       *int64   `json:"defaultChannelId,omitempty"`
+	DefaultEncrypted       *bool    `json:"defaultEncrypted,omitempty"`
+	DefaultReplicaChannels *[]int64 `json:"defaultReplicaChannels,omitempty"`
+	ResetDefaults          bool     `json:"resetDefaults,omitempty"`
 }
 
 type Meta struct {
@@ -79,18 +272,76 @@ type FileResponse struct {
 }
 
 type FileOperation struct {
-	Files       []string `json:"files"  binding:"required"`
-	Destination string   `json:"destination,omitempty"`
+	Files        []string         `json:"files"  binding:"required"`
+	Destination  string           `json:"destination,omitempty"`
+	Versions     map[string]int64 `json:"versions,omitempty"`
+	RevokeShares bool             `json:"revokeShares,omitempty"`
+	DryRun       bool             `json:"-"`
+}
+
+// ReorganizeOp moves a file or folder into the folder at Destination, created
+// when missing, renaming it to Name when one is given.
+type ReorganizeOp struct {
+	ID          string `json:"id" binding:"required"`
+	Destination string `json:"destination" binding:"required"`
+	Name        string `json:"name,omitempty"`
+}
+
+// Reorganize applies its operations in order in a single transaction, so each
+// one sees the tree as left by the ones before it.
+type Reorganize struct {
+	Operations   []ReorganizeOp `json:"operations" binding:"required,min=1,max=1000,dive"`
+	Conflict     string         `json:"conflict" binding:"omitempty,oneof=error rename replace"`
+	RevokeShares bool           `json:"revokeShares,omitempty"`
+	DryRun       bool           `json:"-"`
+}
+
+type ReorganizeResult struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name,omitempty"`
+	Destination string   `json:"destination"`
+	Action      string   `json:"action,omitempty"`
+	Replaced    []string `json:"replaced,omitempty"`
+	Conflict    string   `json:"conflict,omitempty"`
 }
+
+type ReorganizeOut struct {
+	Message string             `json:"message"`
+	DryRun  bool               `json:"dryRun,omitempty"`
+	Results []ReorganizeResult `json:"results"`
+}
+
 type DeleteOperation struct {
-	Files  []string `json:"files,omitempty"`
-	Source string   `json:"source,omitempty"`
+	Files    []string         `json:"files,omitempty"`
+	Source   string           `json:"source,omitempty"`
+	Versions map[string]int64 `json:"versions,omitempty"`
+	DryRun   bool             `json:"-"`
 }
 type PartUpdate struct {
-	Parts     []Part    `json:"parts"`
-	UploadId  string    `json:"uploadId"`
-	UpdatedAt time.Time `json:"updatedAt" binding:"required"`
-	Size      int64     `json:"size"`
+	Parts         []Part    `json:"parts"`
+	UploadId      string    `json:"uploadId"`
+	UpdatedAt     time.Time `json:"updatedAt" binding:"required"`
+	Size          int64     `json:"size"`
+	Hash          string    `json:"hash"`
+	HashAlgorithm string    `json:"hashAlgorithm,omitempty" binding:"omitempty,oneof=md5 sha1 sha256 sha512"`
+}
+
+// FileAppend adds the parts of a finished upload after the existing parts of
+// a file. Version, when set, must match the file's current version. Hash is
+// the hash of the whole file after the append.
+type FileAppend struct {
+	UploadId      string `json:"uploadId" binding:"required"`
+	Version       *int64 `json:"version,omitempty"`
+	Hash          string `json:"hash,omitempty"`
+	HashAlgorithm string `json:"hashAlgorithm,omitempty" binding:"omitempty,oneof=md5 sha1 sha256 sha512"`
+}
+
+// FileTruncate keeps the first Parts parts of a file and drops the rest.
+type FileTruncate struct {
+	Parts         *int   `json:"parts" binding:"required,min=0"`
+	Version       *int64 `json:"version,omitempty"`
+	Hash          string `json:"hash,omitempty"`
+	HashAlgorithm string `json:"hashAlgorithm,omitempty" binding:"omitempty,oneof=md5 sha1 sha256 sha512"`
 }
 
 type DirMove struct {
@@ -102,6 +353,34 @@ type MkDir struct {
 	Path string `json:"path" binding:"required"`
 }
 
+type ChannelMove struct {
+	Files     []string `json:"files" binding:"required,min=1"`
+	ChannelID int64    `json:"channelId" binding:"required"`
+}
+
+type ChannelMoveOut struct {
+	Moved  []string          `json:"moved"`
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// FileTransfer hands files and folders over to another user, named by user id
+// or username, into a folder of theirs.
+type FileTransfer struct {
+	Files []string `json:"files" binding:"required,min=1"`
+	User  string   `json:"user" binding:"required"`
+}
+
+type FileTransferOut struct {
+	Id          string    `json:"id"`
+	UserId      int64     `json:"userId"`
+	Destination string    `json:"destination"`
+	Files       []string  `json:"files"`
+	Entries     int       `json:"entries"`
+	Parts       int       `json:"parts"`
+	Bytes       int64     `json:"bytes"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
 type Copy struct {
 	ID          string `json:"id" binding:"required"`
 	Name        string `json:"name" binding:"required"`
@@ -115,25 +394,195 @@ type FileCategoryStats struct {
 }
 
 type FileShareIn struct {
-	Password  string     `json:"password,omitempty"`
-	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Password         string     `json:"password,omitempty"`
+	ExpiresAt        *time.Time `json:"expiresAt,omitempty"`
+	ShareFollowsFile *bool      `json:"shareFollowsFile,omitempty"`
+	MaxDownloads     *int64     `json:"maxDownloads,omitempty" binding:"omitempty,min=1"`
+	DownloadName     string     `json:"downloadName,omitempty"`
 }
 
 type FileShareOut struct {
-	ID        string     `json:"id,omitempty"`
-	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
-	Protected bool       `json:"protected"`
-	UserID    int64      `json:"userId,omitempty"`
-	Type      string     `json:"type"`
-	Name      string     `json:"name"`
+	ID               string     `json:"id,omitempty"`
+	FileID           string     `json:"-"`
+	ExpiresAt        *time.Time `json:"expiresAt,omitempty"`
+	Protected        bool       `json:"protected"`
+	ShareFollowsFile bool       `json:"shareFollowsFile"`
+	MaxDownloads     *int64     `json:"maxDownloads,omitempty"`
+	Downloads        int64      `json:"downloads"`
+	DownloadName     string     `json:"downloadName,omitempty"`
+	UserID           int64      `json:"userId,omitempty"`
+	Type             string     `json:"type"`
+	Name             string     `json:"name"`
 }
 
 type FileShare struct {
-	Password  *string
-	ExpiresAt *time.Time
-	Type      string
-	FileID    string
-	UserID    int64
-	Path      string
-	Name      string
+	Password     *string
+	ExpiresAt    *time.Time
+	MaxDownloads *int64
+	Downloads    int64
+	DownloadName *string
+	Type         string
+	FileID       string
+	UserID       int64
+	Path         string
+	Name         string
+}
+
+type ManifestPart struct {
+	Index  int   `json:"index"`
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+type FileManifest struct {
+	ID       string         `json:"id"`
+	Name     string         `json:"name"`
+	MimeType string         `json:"mimeType"`
+	Size     int64          `json:"size"`
+	ETag     string         `json:"etag"`
+	Parts    []ManifestPart `json:"parts"`
+}
+
+// FileCompare checks a local file against the stored file at ID or Path.
+// Hash is the client's whole-file hash in the same format it uploaded with.
+type FileCompare struct {
+	ID   string `json:"id"`
+	Path string `json:"path" binding:"required_without=ID"`
+	Size *int64 `json:"size" binding:"required,min=0"`
+	Hash string `json:"hash"`
+}
+
+type FileCompareOut struct {
+	Status     string   `json:"status"`
+	Match      bool     `json:"match"`
+	ID         string   `json:"id,omitempty"`
+	Size       int64    `json:"size"`
+	Hash       string   `json:"hash,omitempty"`
+	Duplicates []string `json:"duplicates,omitempty"`
+}
+
+type FolderCompare struct {
+	Source    string `json:"source" binding:"required"`
+	Target    string `json:"target" binding:"required"`
+	Recursive bool   `json:"recursive"`
+}
+
+type FolderDiffEntry struct {
+	Path       string `json:"path"`
+	Status     string `json:"status"`
+	SourceID   string `json:"sourceId,omitempty"`
+	TargetID   string `json:"targetId,omitempty"`
+	SourceSize *int64 `json:"sourceSize,omitempty"`
+	TargetSize *int64 `json:"targetSize,omitempty"`
+	SourceHash string `json:"sourceHash,omitempty"`
+	TargetHash string `json:"targetHash,omitempty"`
+}
+
+type FolderDiff struct {
+	Entries []FolderDiffEntry `json:"entries"`
+}
+
+// TelegramImport copies media messages the user can already read in another
+// chat into a storage channel. Chat is a username, t.me link, numeric chat id
+// or "me" for saved messages.
+type TelegramImport struct {
+	Chat       string `json:"chat" binding:"required"`
+	MessageIDs []int  `json:"messageIds" binding:"required,min=1,max=100,dive,min=1"`
+	Path       string `json:"path" binding:"required"`
+	ChannelID  int64  `json:"channelId"`
+	Album      bool   `json:"album"`
+	Join       bool   `json:"join"`
+	Name       string `json:"name" binding:"required_if=Join true"`
+	Conflict   string `json:"conflict" binding:"omitempty,oneof=error rename replace"`
+}
+
+type TelegramImportOut struct {
+	Files []FileOut `json:"files"`
+}
+
+// FolderNode is a folder of a structure and the folders below it.
+type FolderNode struct {
+	Name     string       `json:"name" binding:"required"`
+	Children []FolderNode `json:"children,omitempty" binding:"dive"`
+	Source   string       `json:"-"`
+}
+
+type CloneStructure struct {
+	Source      string `json:"source" binding:"required"`
+	Destination string `json:"destination" binding:"required"`
+	Conflict    string `json:"conflict" binding:"omitempty,oneof=error rename merge"`
+}
+
+// StructureOut lists the top level folders created and maps the ids of
+// cloned folders to the ids of their copies.
+type StructureOut struct {
+	Folders []FileOut         `json:"folders"`
+	Created int               `json:"created"`
+	Mapping map[string]string `json:"mapping,omitempty"`
+}
+
+type FolderTemplateIn struct {
+	Name    string       `json:"name" binding:"required"`
+	Source  string       `json:"source"`
+	Folders []FolderNode `json:"folders" binding:"dive"`
+}
+
+type FolderTemplateOut struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	Folders   []FolderNode `json:"folders"`
+	CreatedAt time.Time    `json:"createdAt"`
+}
+
+type InstantiateTemplate struct {
+	Destination string `json:"destination" binding:"required"`
+	Conflict    string `json:"conflict" binding:"omitempty,oneof=error rename merge"`
+}
+
+type FileStatsQuery struct {
+	Days int `form:"days" binding:"omitempty,min=1,max=365"`
+}
+
+// FileStats sums up the streams and downloads of a file. Only requests from
+// the start of the file count as views, Bytes includes every range served.
+type FileStats struct {
+	FileID         string           `json:"fileId"`
+	Views          int64            `json:"views"`
+	UniqueViewers  int64            `json:"uniqueViewers"`
+	Bytes          int64            `json:"bytes"`
+	LastAccessedAt *time.Time       `json:"lastAccessedAt,omitempty"`
+	Series         []FileStatsPoint `json:"series"`
+}
+
+type FileStatsPoint struct {
+	Date  string `json:"date"`
+	Views int64  `json:"views"`
+	Bytes int64  `json:"bytes"`
+}
+
+type ComputeHashQuery struct {
+	Algorithm string `form:"algorithm" binding:"omitempty,oneof=md5 sha1 sha256 sha512"`
+	Force     bool   `form:"force"`
+}
+
+type FileHashOut struct {
+	Hash          string `json:"hash"`
+	HashAlgorithm string `json:"hashAlgorithm"`
+	Computed      bool   `json:"computed"`
+}
+
+type HashJobIn struct {
+	Algorithm string `form:"algorithm" binding:"omitempty,oneof=md5 sha1 sha256 sha512"`
+}
+
+type HashJobOut struct {
+	Id        string    `json:"id"`
+	Algorithm string    `json:"algorithm"`
+	Status    string    `json:"status"`
+	Total     int       `json:"total"`
+	Hashed    int       `json:"hashed"`
+	Failed    int       `json:"failed"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
 }
@@ -4,10 +4,43 @@ type ShareAccess struct {
 	Password string `json:"password" binding:"required"`
 }
 
+type BrowseQuery struct {
+	Query    string `form:"query"`
+	Type     string `form:"type" binding:"omitempty,oneof=file folder"`
+	Category string `form:"category"`
+	MimeType string `form:"mimeType"`
+	MinSize  *int64 `form:"minSize" binding:"omitempty,min=0"`
+	MaxSize  *int64 `form:"maxSize" binding:"omitempty,min=0"`
+	Sort     string `form:"sort" binding:"omitempty,oneof=name size updatedAt"`
+	Order    string `form:"order" binding:"omitempty,oneof=asc desc"`
+	Limit    int    `form:"limit" binding:"omitempty,min=1,max=500"`
+	Page     int    `form:"page" binding:"omitempty,min=1"`
+}
+
+type BrowseEntry struct {
+	FileOut
+	URL string `json:"url"`
+}
+
+type BrowseOut struct {
+	Name   string        `json:"name"`
+	Path   string        `json:"path"`
+	Parent string        `json:"parent,omitempty"`
+	Files  []BrowseEntry `json:"files"`
+	Meta   Meta          `json:"meta"`
+}
+
 type ShareFileQuery struct {
 	Path  string `form:"path"`
-	Sort  string `form:"sort"`
-	Order string `form:"order"`
+	Sort  string `form:"sort" binding:"omitempty,oneof=name size updatedAt createdAt"`
+	Order string `form:"order" binding:"omitempty,oneof=asc desc"`
 	Limit int    `form:"limit"`
 	Page  int    `form:"page"`
 }
+
+// ShareEvent is the data of a share.accessed event.
+type ShareEvent struct {
+	ShareId  string `json:"shareId"`
+	FileId   string `json:"fileId"`
+	Download bool   `json:"download"`
+}
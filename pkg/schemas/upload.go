@@ -1,25 +1,136 @@
 package schemas
 
+import (
+	"time"
+
+	"gorm.io/datatypes"
+)
+
 type UploadQuery struct {
-	PartName  string `form:"partName" binding:"required"`
-	FileName  string `form:"fileName" binding:"required"`
-	PartNo    int    `form:"partNo" binding:"required"`
-	ChannelID int64  `form:"channelId"`
-	Encrypted bool   `form:"encrypted"`
+	PartName     string `form:"partName" binding:"required"`
+	FileName     string `form:"fileName" binding:"required"`
+	PartNo       int    `form:"partNo" binding:"required_without=AssignPartNo,excluded_with=AssignPartNo"`
+	AssignPartNo bool   `form:"assignPartNo"`
+	ChannelID    int64  `form:"channelId"`
+	Encrypted    *bool  `form:"encrypted"`
+	Encryption   string `form:"encryption" binding:"omitempty,oneof=none server client"`
+	Path         string `form:"path"`
+	ParentID     string `form:"parentId"`
+	Compression  string `form:"compression" binding:"omitempty,oneof=gzip zstd"`
+	TotalParts   int    `form:"totalParts" binding:"omitempty,min=1"`
+	TotalSize    int64  `form:"totalSize" binding:"omitempty,min=0"`
+	// ReplicaChannels overrides the replica channels of the target folder.
+	ReplicaChannels []int64 `form:"replicaChannels"`
+}
+
+type MultipartUploadQuery struct {
+	Path            string  `form:"path" binding:"required"`
+	Name            string  `form:"name"`
+	ChannelID       int64   `form:"channelId"`
+	Encrypted       *bool   `form:"encrypted"`
+	Encryption      string  `form:"encryption" binding:"omitempty,oneof=none server client"`
+	PartSize        int64   `form:"partSize" binding:"omitempty,min=1048576,max=4194304000"`
+	Conflict        string  `form:"conflict" binding:"omitempty,oneof=error rename replace"`
+	ReplicaChannels []int64 `form:"replicaChannels"`
+}
+
+// ArchiveImportQuery describes where an uploaded archive is extracted to. The
+// format is detected from the content when not given.
+type ArchiveImportQuery struct {
+	Path            string  `form:"path" binding:"required"`
+	Format          string  `form:"format" binding:"omitempty,oneof=tar tgz zip"`
+	ChannelID       int64   `form:"channelId"`
+	Encrypted       *bool   `form:"encrypted"`
+	Encryption      string  `form:"encryption" binding:"omitempty,oneof=none server client"`
+	PartSize        int64   `form:"partSize" binding:"omitempty,min=1048576,max=4194304000"`
+	Conflict        string  `form:"conflict" binding:"omitempty,oneof=error rename replace skip"`
+	ReplicaChannels []int64 `form:"replicaChannels"`
+}
+
+type ArchiveImportOut struct {
+	Id        string    `json:"id"`
+	Path      string    `json:"path"`
+	Format    string    `json:"format"`
+	Status    string    `json:"status"`
+	Entries   int       `json:"entries"`
+	Imported  int       `json:"imported"`
+	Skipped   int       `json:"skipped"`
+	Failed    int       `json:"failed"`
+	Bytes     int64     `json:"bytes"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type ArchiveEntryOut struct {
+	Seq    int    `json:"seq"`
+	Path   string `json:"path"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	FileID string `json:"fileId,omitempty"`
+	Size   int64  `json:"size"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ArchiveEntryQuery struct {
+	Status string `form:"status" binding:"omitempty,oneof=imported skipped failed"`
+	Limit  int    `form:"limit" binding:"omitempty,min=1,max=1000"`
+	Page   int    `form:"page" binding:"omitempty,min=1"`
+}
+
+type ArchiveEntryResponse struct {
+	Entries []ArchiveEntryOut `json:"entries"`
+	Meta    Meta              `json:"meta"`
 }
 
 type UploadPartOut struct {
-	Name      string `json:"name"`
-	PartId    int    `json:"partId"`
-	PartNo    int    `json:"partNo"`
-	ChannelID int64  `json:"channelId"`
-	Size      int64  `json:"size"`
-	Encrypted bool   `json:"encrypted"`
-	Salt      string `json:"salt"`
+	Name           string                       `json:"name"`
+	PartId         int                          `json:"partId"`
+	PartNo         int                          `json:"partNo"`
+	ChannelID      int64                        `json:"channelId"`
+	Size           int64                        `json:"size"`
+	Encrypted      bool                         `json:"encrypted"`
+	EncryptionRule string                       `json:"encryptionRule,omitempty" gorm:"-"`
+	Salt           string                       `json:"salt"`
+	Compression    string                       `json:"compression,omitempty"`
+	OriginalSize   int64                        `json:"originalSize,omitempty"`
+	Replicas       datatypes.JSONSlice[Replica] `json:"replicas,omitempty"`
+	KeyVersion     int                          `json:"keyVersion,omitempty"`
+	FailedOver     bool                         `json:"failedOver,omitempty" gorm:"-"`
 }
 
 type UploadOut struct {
-	Parts []UploadPartOut `json:"parts"`
+	Parts   []UploadPartOut   `json:"parts"`
+	Session *UploadSessionOut `json:"session,omitempty"`
+}
+
+// UploadSessionIn creates an upload up front. UploadId is optional, sending
+// the same one again returns the session already created for it.
+type UploadSessionIn struct {
+	UploadId   string `json:"uploadId" binding:"omitempty,max=128"`
+	Name       string `json:"name" binding:"required"`
+	Path       string `json:"path" binding:"required_without=ParentID"`
+	ParentID   string `json:"parentId"`
+	ChannelID  int64  `json:"channelId"`
+	Encrypted  *bool  `json:"encrypted,omitempty"`
+	Encryption string `json:"encryption,omitempty" binding:"omitempty,oneof=none server client"`
+	TotalSize  int64  `json:"totalSize" binding:"omitempty,min=0"`
+	TotalParts int    `json:"totalParts" binding:"omitempty,min=1"`
+}
+
+type UploadSessionOut struct {
+	UploadId   string    `json:"uploadId"`
+	Name       string    `json:"name"`
+	Path       string    `json:"path,omitempty"`
+	ParentID   string    `json:"parentId,omitempty"`
+	ChannelID  int64     `json:"channelId"`
+	Encryption string    `json:"encryption"`
+	TotalSize  *int64    `json:"totalSize,omitempty"`
+	TotalParts *int      `json:"totalParts,omitempty"`
+	Parts      int       `json:"parts"`
+	Uploaded   int64     `json:"uploaded"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
 }
 
 type UploadPart struct {
@@ -32,7 +143,70 @@ type UploadPart struct {
 	Encrypted bool   `json:"encrypted"`
 }
 
+// UploadLimits are the configured upload limits. PartLimit is the largest
+// part Telegram accepts from the uploading account, set where it is known.
+type UploadLimits struct {
+	MaxPartSize int64 `json:"maxPartSize"`
+	MaxFileSize int64 `json:"maxFileSize,omitempty"`
+	MaxParts    int   `json:"maxParts"`
+	PartLimit   int64 `json:"partLimit,omitempty"`
+	Premium     bool  `json:"premium,omitempty"`
+}
+
+// UploadProgress is sent to progress watchers of an upload. Type is one of
+// snapshot, part, finalized or aborted. Totals are only known when the
+// uploading client passed them.
+type UploadProgress struct {
+	Type       string `json:"type"`
+	UploadId   string `json:"uploadId"`
+	PartNo     int    `json:"partNo,omitempty"`
+	PartSize   int64  `json:"partSize,omitempty"`
+	Parts      int    `json:"parts"`
+	Uploaded   int64  `json:"uploaded"`
+	TotalParts int    `json:"totalParts,omitempty"`
+	TotalSize  int64  `json:"totalSize,omitempty"`
+	FileID     string `json:"fileId,omitempty"`
+}
+
 type UploadStats struct {
 	UploadDate    string `json:"uploadDate"`
 	TotalUploaded int64  `json:"totalUploaded"`
 }
+
+type UploadTicketIn struct {
+	Path        string     `json:"path" binding:"required"`
+	ChannelID   int64      `json:"channelId"`
+	MaxSize     int64      `json:"maxSize" binding:"required,min=1"`
+	MaxPartSize int64      `json:"maxPartSize" binding:"omitempty,min=1"`
+	MaxParts    int        `json:"maxParts" binding:"omitempty,min=1"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+}
+
+type UploadTicketOut struct {
+	Ticket    string    `json:"ticket"`
+	UploadId  string    `json:"uploadId"`
+	UploadURL string    `json:"uploadUrl"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// UploadRetentionIn keeps the parts of an upload until ExpiresAt. A null
+// ExpiresAt goes back to the configured retention.
+type UploadRetentionIn struct {
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// UploadRetention is the retention of an upload's parts. ExpiresAt is the
+// extension of the upload if any, PartsExpireAt when its oldest part is
+// reaped.
+type UploadRetention struct {
+	UploadId      string     `json:"uploadId"`
+	Retention     string     `json:"retention"`
+	ExpiresAt     *time.Time `json:"expiresAt,omitempty"`
+	PartsExpireAt *time.Time `json:"partsExpireAt,omitempty"`
+}
+
+// UploadEvent is the data of an upload.completed event.
+type UploadEvent struct {
+	File     *FileOut `json:"file"`
+	UploadId string   `json:"uploadId,omitempty"`
+}
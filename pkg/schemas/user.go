@@ -1,11 +1,146 @@
 package schemas
 
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
 type Channel struct {
 	ChannelID   int64  `json:"channelId"`
 	ChannelName string `json:"channelName"`
 }
 
 type AccountStats struct {
-	ChannelID int64    `json:"channelId,omitempty"`
-	Bots      []string `json:"bots"`
+	ChannelID  int64    `json:"channelId,omitempty"`
+	Bots       []string `json:"bots"`
+	Files      int64    `json:"files"`
+	Folders    int64    `json:"folders"`
+	MaxFiles   int64    `json:"maxFiles,omitempty"`
+	MaxFolders int64    `json:"maxFolders,omitempty"`
+}
+
+type ChannelStatus struct {
+	ChannelID    int64  `json:"channelId"`
+	ChannelName  string `json:"channelName"`
+	Selected     bool   `json:"selected"`
+	Accessible   bool   `json:"accessible"`
+	MessageCount int    `json:"messageCount"`
+	Warning      string `json:"warning,omitempty"`
+}
+
+type RateLimit struct {
+	Rate  int `json:"rate"`
+	Burst int `json:"burst"`
+}
+
+type RateLimitUpdate struct {
+	BotID int64 `json:"botId,omitempty"`
+	Rate  *int  `json:"rate" binding:"omitempty,min=1,max=60000"`
+	Burst *int  `json:"burst" binding:"omitempty,min=1,max=100"`
+}
+
+// BotIn is a bot to add, either a bare token or an object that also carries
+// the bot's own app credentials.
+type BotIn struct {
+	Token   string  `json:"token"`
+	AppId   *int    `json:"appId,omitempty"`
+	AppHash *string `json:"appHash,omitempty"`
+}
+
+func (b *BotIn) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`)) {
+		b.AppId, b.AppHash = nil, nil
+		return json.Unmarshal(data, &b.Token)
+	}
+	type bot BotIn
+	return json.Unmarshal(data, (*bot)(b))
+}
+
+// BotStatus describes a bot of a channel. Valid tells the outcome of the last
+// check of its rights in the channel, absent before the first check.
+type BotStatus struct {
+	BotID           int64      `json:"botId"`
+	BotUserName     string     `json:"botUserName"`
+	ChannelID       int64      `json:"channelId"`
+	Pool            string     `json:"pool"`
+	Role            string     `json:"role,omitempty"`
+	RateLimit       RateLimit  `json:"rateLimit"`
+	Valid           *bool      `json:"valid,omitempty"`
+	ValidationError string     `json:"validationError,omitempty"`
+	ValidatedAt     *time.Time `json:"validatedAt,omitempty"`
+}
+
+// BotValidation is the outcome of checking the rights of a bot in a channel,
+// Error telling what is missing.
+type BotValidation struct {
+	BotID       int64  `json:"botId"`
+	BotUserName string `json:"botUserName"`
+	ChannelID   int64  `json:"channelId"`
+	Valid       bool   `json:"valid"`
+	Error       string `json:"error,omitempty"`
+}
+
+// BotsIn adds bots to a pool of a channel, the default channel when omitted.
+type BotsIn struct {
+	ChannelID int64   `json:"channelId"`
+	Pool      string  `json:"pool" binding:"omitempty,max=64"`
+	Bots      []BotIn `json:"bots" binding:"required,min=1"`
+}
+
+type BotQuery struct {
+	ChannelID int64 `form:"channelId"`
+}
+
+// BotPool is a named set of bots of a channel. Uploads use the pools with
+// the upload role and streams those with the download role, either falls
+// back to the default pools.
+type BotPool struct {
+	ChannelID int64  `json:"channelId"`
+	Name      string `json:"name" binding:"required,max=64"`
+	Role      string `json:"role" binding:"required,oneof=default upload download"`
+	Bots      int    `json:"bots"`
+}
+
+type TelegramStatus struct {
+	Restricted        bool            `json:"restricted"`
+	RestrictionReason []string        `json:"restrictionReason,omitempty"`
+	IsPremium         bool            `json:"isPremium"`
+	FloodWait         int             `json:"floodWait"`
+	Channels          []ChannelStatus `json:"channels"`
+	RateLimit         RateLimit       `json:"rateLimit"`
+	UploadLimits      UploadLimits    `json:"uploadLimits"`
+	Bots              []BotStatus     `json:"bots"`
+	Warnings          []string        `json:"warnings,omitempty"`
+}
+
+// UserSettings are per-user defaults. Unset fields fall back to folder
+// defaults and server configuration. DefaultChannelID mirrors the selected
+// channel rather than being stored with the other settings. FailoverChannels
+// are tried in order when an upload to the default channel fails.
+type UserSettings struct {
+	DefaultEncrypted *bool   `json:"defaultEncrypted,omitempty"`
+	DefaultChannelID *int64  `json:"defaultChannelId,omitempty"`
+	DefaultSort      *string `json:"defaultSort,omitempty"`
+	DefaultOrder     *string `json:"defaultOrder,omitempty"`
+	Timezone         *string `json:"timezone,omitempty"`
+	UploadStrategy   *string `json:"uploadStrategy,omitempty"`
+	FailoverChannels []int64 `json:"failoverChannels,omitempty"`
+}
+
+type UserKeyOut struct {
+	Version int `json:"version"`
+}
+
+// KeyMigrationOut reports files resealed under the current key and encrypted
+// files whose parts still use an older one.
+type KeyMigrationOut struct {
+	Version   int   `json:"version"`
+	Rekeyed   int   `json:"rekeyed"`
+	Remaining int64 `json:"remaining"`
+}
+
+type RootRepair struct {
+	Created    bool  `json:"created"`
+	Reattached int64 `json:"reattached"`
 }
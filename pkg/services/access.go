@@ -0,0 +1,176 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const defaultStatsDays = 30
+
+type accessKey struct {
+	fileId string
+	viewer string
+	day    time.Time
+}
+
+type accessCount struct {
+	views     int64
+	bytes     int64
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// accessRecorder sums up streams and downloads in memory and writes them as
+// counters on Flush, so a busy file costs a few upserts per interval rather
+// than a row per request.
+type accessRecorder struct {
+	db      *gorm.DB
+	logger  *zap.SugaredLogger
+	mu      sync.Mutex
+	pending map[accessKey]*accessCount
+}
+
+func newAccessRecorder(db *gorm.DB, logger *zap.SugaredLogger, interval time.Duration) *accessRecorder {
+	r := &accessRecorder{db: db, logger: logger, pending: make(map[accessKey]*accessCount)}
+	if interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				r.Flush()
+			}
+		}()
+	}
+	return r
+}
+
+// userViewer identifies an authenticated viewer.
+func userViewer(userId int64) string {
+	return "user:" + strconv.FormatInt(userId, 10)
+}
+
+// ipViewer identifies a public viewer by a keyed hash of its IP, which can
+// tell repeat visits apart without storing the address.
+func ipViewer(secret, ip string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ip))
+	return "ip:" + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// record adds an access of bytes to a file. Only accesses from the start of
+// the file count as a view, the range requests a player makes while seeking
+// add to the bandwidth alone.
+func (r *accessRecorder) record(fileId, viewer string, view bool, bytes int64, now time.Time) {
+	if r == nil || (!view && bytes == 0) {
+		return
+	}
+	now = now.UTC()
+	key := accessKey{fileId: fileId, viewer: viewer, day: now.Truncate(24 * time.Hour)}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count, ok := r.pending[key]
+	if !ok {
+		count = &accessCount{firstSeen: now}
+		r.pending[key] = count
+	}
+	if view {
+		count.views++
+	}
+	count.bytes += bytes
+	count.lastSeen = now
+}
+
+// Flush writes the pending counters. Accesses of files deleted meanwhile are
+// dropped.
+func (r *accessRecorder) Flush() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = make(map[accessKey]*accessCount)
+	r.mu.Unlock()
+
+	for key, count := range pending {
+		access := models.FileAccess{FileID: key.fileId, Day: key.day, Views: count.views, Bytes: count.bytes}
+		err := r.db.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "file_id"}, {Name: "day"}},
+			DoUpdates: clause.Assignments(map[string]any{
+				"views": gorm.Expr("file_accesses.views + excluded.views"),
+				"bytes": gorm.Expr("file_accesses.bytes + excluded.bytes"),
+			}),
+		}).Create(&access).Error
+		if err == nil {
+			viewer := models.FileViewer{FileID: key.fileId, Viewer: key.viewer, Views: count.views, Bytes: count.bytes,
+				FirstSeen: count.firstSeen, LastSeen: count.lastSeen}
+			err = r.db.Clauses(clause.OnConflict{
+				Columns: []clause.Column{{Name: "file_id"}, {Name: "viewer"}},
+				DoUpdates: clause.Assignments(map[string]any{
+					"views":     gorm.Expr("file_viewers.views + excluded.views"),
+					"bytes":     gorm.Expr("file_viewers.bytes + excluded.bytes"),
+					"last_seen": gorm.Expr("excluded.last_seen"),
+				}),
+			}).Create(&viewer).Error
+		}
+		if err != nil {
+			r.logger.Debugw("failed to record file access", "file", key.fileId, "err", err)
+		}
+	}
+}
+
+// FlushAccess writes the stream statistics still held in memory.
+func (fs *FileService) FlushAccess() {
+	fs.access.Flush()
+}
+
+// GetFileStats reports how often a file of the user was streamed or
+// downloaded, by how many viewers, and the daily views of the last days.
+func (fs *FileService) GetFileStats(id string, userId int64, query *schemas.FileStatsQuery) (*schemas.FileStats, *types.AppError) {
+	var count int64
+	if err := fs.db.Model(&models.File{}).Where("id = ? AND user_id = ?", id, userId).Count(&count).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	if count == 0 {
+		return nil, &types.AppError{Error: database.ErrNotFound, Code: http.StatusNotFound}
+	}
+
+	fs.access.Flush()
+
+	days := query.Days
+	if days == 0 {
+		days = defaultStatsDays
+	}
+
+	res := &schemas.FileStats{FileID: id, Series: []schemas.FileStatsPoint{}}
+
+	if err := fs.db.Model(&models.FileViewer{}).Where("file_id = ?", id).
+		Select("coalesce(sum(views), 0) AS views, count(*) AS unique_viewers, coalesce(sum(bytes), 0) AS bytes, max(last_seen) AS last_accessed_at").
+		Scan(res).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	var accesses []models.FileAccess
+	since := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -days+1)
+	if err := fs.db.Where("file_id = ? AND day >= ?", id, since).Order("day").Find(&accesses).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	for _, access := range accesses {
+		res.Series = append(res.Series, schemas.FileStatsPoint{
+			Date:  access.Day.Format(time.DateOnly),
+			Views: access.Views,
+			Bytes: access.Bytes,
+		})
+	}
+	return res, nil
+}
@@ -0,0 +1,40 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessRecorder(t *testing.T) {
+	r := &accessRecorder{pending: make(map[accessKey]*accessCount)}
+	now := time.Date(2024, 10, 18, 10, 0, 0, 0, time.UTC)
+
+	r.record("f1", "user:1", true, 100, now)
+	r.record("f1", "user:1", false, 50, now.Add(time.Minute))
+	r.record("f1", "user:1", false, 0, now.Add(2*time.Minute))
+	r.record("f1", "user:1", true, 10, now.Add(24*time.Hour))
+	r.record("f1", "user:2", true, 0, now)
+
+	day := now.Truncate(24 * time.Hour)
+	assert.Len(t, r.pending, 3)
+	count := r.pending[accessKey{fileId: "f1", viewer: "user:1", day: day}]
+	assert.Equal(t, int64(1), count.views)
+	assert.Equal(t, int64(150), count.bytes)
+	assert.Equal(t, now, count.firstSeen)
+	assert.Equal(t, now.Add(time.Minute), count.lastSeen)
+	assert.Equal(t, int64(1), r.pending[accessKey{fileId: "f1", viewer: "user:1", day: day.AddDate(0, 0, 1)}].views)
+
+	var nilRecorder *accessRecorder
+	nilRecorder.record("f1", "user:1", true, 1, now)
+	nilRecorder.Flush()
+}
+
+func TestIpViewer(t *testing.T) {
+	a := ipViewer("secret", "203.0.113.7")
+	assert.Equal(t, a, ipViewer("secret", "203.0.113.7"))
+	assert.NotEqual(t, a, ipViewer("secret", "203.0.113.8"))
+	assert.NotEqual(t, a, ipViewer("other", "203.0.113.7"))
+	assert.NotContains(t, a, "203.0.113.7")
+}
@@ -0,0 +1,201 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gotd/td/telegram"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/policy"
+	"github.com/tgdrive/teldrive/internal/retry"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"go.uber.org/zap/zapcore"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+type AdminService struct {
+	db      *gorm.DB
+	cnf     *config.Config
+	cache   cache.Cacher
+	clients *tgc.Manager
+}
+
+func NewAdminService(db *gorm.DB, cnf *config.Config, cache cache.Cacher, clients *tgc.Manager) *AdminService {
+	return &AdminService{db: db, cnf: cnf, cache: cache, clients: clients}
+}
+
+func (as *AdminService) GetLogLevel() *schemas.LogLevel {
+	return &schemas.LogLevel{Level: logging.Level().String()}
+}
+
+func (as *AdminService) SetLogLevel(payload *schemas.LogLevel) (*schemas.LogLevel, *types.AppError) {
+	level, err := zapcore.ParseLevel(payload.Level)
+	if err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+	logging.SetLevel(level)
+	as.cnf.Log.Level = int(level)
+	logging.DefaultLogger().Infow("log level changed", "level", level.String())
+	return &schemas.LogLevel{Level: level.String()}, nil
+}
+
+// GetSchedulerQueues reports the request queues of the Telegram accounts in
+// use and how long their users waited to be admitted.
+func (as *AdminService) GetSchedulerQueues() []schemas.SchedulerQueue {
+	stats := as.clients.Scheduler().Stats()
+	res := make([]schemas.SchedulerQueue, 0, len(stats))
+	for _, lane := range stats {
+		queue := schemas.SchedulerQueue{Account: lane.Account, Queued: lane.Queued,
+			Users: make([]schemas.SchedulerUserWait, 0, len(lane.Users))}
+		for _, user := range lane.Users {
+			queue.Users = append(queue.Users, schemas.SchedulerUserWait{
+				UserID:    user.UserId,
+				Queued:    user.Queued,
+				Admitted:  user.Admitted,
+				AvgWaitMs: float64(user.AvgWait) / float64(time.Millisecond),
+				MaxWaitMs: float64(user.MaxWait) / float64(time.Millisecond),
+			})
+		}
+		res = append(res, queue)
+	}
+	return res
+}
+
+// GetRetryPolicies reports the retry policy of each kind of Telegram request.
+func (as *AdminService) GetRetryPolicies() []schemas.RetryPolicy {
+	res := make([]schemas.RetryPolicy, 0, len(tgc.Operations))
+	for _, op := range tgc.Operations {
+		policy := tgc.RetryPolicyFor(&as.cnf.TG, op)
+		res = append(res, schemas.RetryPolicy{
+			Operation:    string(op),
+			MaxRetries:   max(policy.MaxRetries, 1),
+			BackoffMs:    policy.Backoff.Milliseconds(),
+			MaxBackoffMs: policy.MaxBackoff.Milliseconds(),
+			TimeoutMs:    policy.Timeout.Milliseconds(),
+			RetriedOn:    retry.TransientErrors(),
+		})
+	}
+	return res
+}
+
+// GetUserFileTypes returns the file type policy applied to a user's uploads.
+func (as *AdminService) GetUserFileTypes(userId int64) (*schemas.UserFileTypes, *types.AppError) {
+	var row struct {
+		FileTypes datatypes.JSON
+	}
+	chain := as.db.Model(&models.User{}).Select("file_types").Where("user_id = ?", userId).Scan(&row)
+	if chain.Error != nil {
+		return nil, &types.AppError{Error: chain.Error}
+	}
+	if chain.RowsAffected == 0 {
+		return nil, &types.AppError{Error: errors.New("user not found"), Code: http.StatusNotFound}
+	}
+	res := &schemas.UserFileTypes{UserID: userId, FileTypes: schemas.FileTypes(as.cnf.TG.Uploads.FileTypes)}
+	if len(row.FileTypes) > 0 {
+		if err := json.Unmarshal(row.FileTypes, &res.FileTypes); err != nil {
+			return nil, &types.AppError{Error: err}
+		}
+		res.Override = true
+	}
+	return res, nil
+}
+
+// SetUserFileTypes replaces the configured file type policy for one user.
+// A nil payload removes the override.
+func (as *AdminService) SetUserFileTypes(userId int64, payload *schemas.FileTypes) (*schemas.UserFileTypes, *types.AppError) {
+	var value any
+	if payload != nil {
+		if err := policy.FileTypes(*payload).Validate(); err != nil {
+			return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+		}
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, &types.AppError{Error: err}
+		}
+		value = datatypes.JSON(data)
+	}
+	chain := as.db.Model(&models.User{}).Where("user_id = ?", userId).Update("file_types", value)
+	if chain.Error != nil {
+		return nil, &types.AppError{Error: chain.Error}
+	}
+	if chain.RowsAffected == 0 {
+		return nil, &types.AppError{Error: errors.New("user not found"), Code: http.StatusNotFound}
+	}
+	as.cache.Delete(fmt.Sprintf("users:filetypes:%d", userId))
+	return as.GetUserFileTypes(userId)
+}
+
+// GetUserEntryLimits reports the file and folder limits of a user and how
+// many they have.
+func (as *AdminService) GetUserEntryLimits(userId int64) (*schemas.UserEntryLimits, *types.AppError) {
+	var exists int64
+	if err := as.db.Model(&models.User{}).Where("user_id = ?", userId).Count(&exists).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	if exists == 0 {
+		return nil, &types.AppError{Error: errors.New("user not found"), Code: http.StatusNotFound}
+	}
+	res := &schemas.UserEntryLimits{UserID: userId}
+	res.MaxFiles, res.MaxFolders, res.Override = entryLimits(as.db, as.cache, as.cnf, userId)
+	var err error
+	if res.Files, res.Folders, err = entryCounts(as.db, userId); err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	return res, nil
+}
+
+// SetUserEntryLimits replaces the configured file and folder limits for one
+// user. A nil payload removes the override.
+func (as *AdminService) SetUserEntryLimits(userId int64, payload *schemas.EntryLimits) (*schemas.UserEntryLimits, *types.AppError) {
+	if payload == nil {
+		payload = &schemas.EntryLimits{}
+	}
+	chain := as.db.Model(&models.User{}).Where("user_id = ?", userId).
+		Updates(map[string]any{"max_files": payload.MaxFiles, "max_folders": payload.MaxFolders})
+	if chain.Error != nil {
+		return nil, &types.AppError{Error: chain.Error}
+	}
+	if chain.RowsAffected == 0 {
+		return nil, &types.AppError{Error: errors.New("user not found"), Code: http.StatusNotFound}
+	}
+	as.cache.Delete(fmt.Sprintf("users:entrylimits:%d", userId))
+	return as.GetUserEntryLimits(userId)
+}
+
+// CheckTelegram connects with the caller's session, through the dc override
+// of the request if any, and reports the data center it reached.
+func (as *AdminService) CheckTelegram(c *gin.Context) (*schemas.TelegramCheck, *types.AppError) {
+	_, session := auth.GetUser(c)
+
+	res := &schemas.TelegramCheck{}
+	if o := tgc.DCOverrideFrom(c); o != nil {
+		res.Override = o.String()
+	}
+
+	err := as.clients.Run(c, as.clients.UserSpec(session), func(ctx context.Context, client *telegram.Client) error {
+		start := time.Now()
+		nearest, err := client.API().HelpGetNearestDC(ctx)
+		if err != nil {
+			return err
+		}
+		res.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+		res.ThisDC, res.NearestDC, res.Country = nearest.ThisDC, nearest.NearestDC, nearest.Country
+		return nil
+	})
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	return res, nil
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/gorm"
+)
+
+type ancestorRow struct {
+	Start    string
+	Id       string
+	Name     string
+	ParentID *string
+}
+
+// folderChains returns the ancestors of every folder in ids, the folder
+// itself included, ordered from the root down. All chains are read in one
+// walk up the parent links. Folders of other users, and folders whose chain
+// does not reach the root, get no chain.
+func folderChains(db *gorm.DB, userId int64, ids []string) (map[string][]schemas.Ancestor, error) {
+	chains := map[string][]schemas.Ancestor{}
+	if len(ids) == 0 {
+		return chains, nil
+	}
+
+	var rows []ancestorRow
+	if err := db.Raw(`WITH RECURSIVE chain AS (
+		SELECT id AS start, id, name, parent_id, 0 AS depth FROM teldrive.files
+		WHERE id IN ? AND user_id = ? AND type = 'folder'
+		UNION ALL
+		SELECT chain.start, f.id, f.name, f.parent_id, chain.depth + 1 FROM teldrive.files f
+		JOIN chain ON f.id = chain.parent_id WHERE f.user_id = ?
+	) SELECT start, id, name, parent_id FROM chain ORDER BY start, depth DESC`, ids, userId, userId).
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	for i, row := range rows {
+		if i == 0 || rows[i-1].Start != row.Start {
+			// The topmost folder of a chain has to be the root.
+			if row.ParentID != nil {
+				continue
+			}
+			chains[row.Start] = []schemas.Ancestor{{Id: row.Id, Name: "/"}}
+			continue
+		}
+		if chain, ok := chains[row.Start]; ok {
+			chains[row.Start] = append(chain, schemas.Ancestor{Id: row.Id, Name: row.Name})
+		}
+	}
+	return chains, nil
+}
+
+// attachAncestors sets the ancestors of files, from the root down to their
+// parent. The root itself has none.
+func (fs *FileService) attachAncestors(userId int64, files []*schemas.FileOut) error {
+	parents := []string{}
+	seen := map[string]bool{}
+	for _, file := range files {
+		if file.ParentID != "" && !seen[file.ParentID] {
+			seen[file.ParentID] = true
+			parents = append(parents, file.ParentID)
+		}
+	}
+
+	chains, err := folderChains(fs.db, userId, parents)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.ParentID != "" {
+			file.Ancestors = chains[file.ParentID]
+		}
+	}
+	return nil
+}
+
+// AncestorsETag is the weak entity tag of a file returned with its ancestors.
+// Renaming or moving a folder above the file changes the response without
+// changing the file's version, so the chain is part of the tag.
+func AncestorsETag(id string, version int64, ancestors []schemas.Ancestor) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s:%d", id, version)
+	for _, ancestor := range ancestors {
+		fmt.Fprintf(&b, "/%s:%s", ancestor.Id, ancestor.Name)
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// AttachAncestors sets the ancestors of a single file, as seen by userId.
+func (fs *FileService) AttachAncestors(userId int64, file *schemas.FileOut) *types.AppError {
+	if err := fs.attachAncestors(userId, []*schemas.FileOut{file}); err != nil {
+		return &types.AppError{Error: err}
+	}
+	return nil
+}
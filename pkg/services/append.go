@@ -0,0 +1,332 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gotd/td/telegram"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/internal/reader"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/mapper"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrInlineResize   = errors.New("files stored inline cannot be appended to or truncated")
+	ErrAppendMismatch = errors.New("appended parts must use the channel and encryption of the file")
+	ErrTruncateParts  = errors.New("a file can only be truncated to fewer parts than it has")
+	ErrAppendPartSize = errors.New("appended parts must have the part size of the file and follow a full last part")
+)
+
+// lockResizable locks the row of a file of the user that is about to be
+// appended to or truncated, checking the version the client expects first.
+func lockResizable(tx *gorm.DB, userId int64, id string, version *int64) (*models.File, error) {
+	if version != nil {
+		if err := checkVersions(tx, userId, map[string]int64{id: *version}); err != nil {
+			return nil, err
+		}
+	}
+	var file models.File
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", id).Where("user_id = ?", userId).
+		Where("type = ?", "file").Where("status = ?", "active").First(&file).Error; err != nil {
+		return nil, err
+	}
+	if file.InlineData != nil {
+		return nil, ErrInlineResize
+	}
+	return &file, nil
+}
+
+// resize stores the new parts and size of a file. The hash sent along
+// replaces the stored one, without one it is cleared as it describes the old
+// content.
+func resize(tx *gorm.DB, id string, parts []schemas.Part, size int64, hash, algorithm string) error {
+	stored := normalizeHash(hash)
+	return tx.Model(&models.File{}).Where("id = ?", id).Updates(map[string]any{
+		"parts":          datatypes.NewJSONSlice(parts),
+		"size":           size,
+		"hash":           stored,
+		"hash_algorithm": hashAlgorithm(stored, algorithm),
+		"updated_at":     time.Now().UTC(),
+	}).Error
+}
+
+// checkAppendSizes verifies that parts of the given logical sizes can follow
+// the stored ones. Readers map offsets to parts by the size of the first
+// part, so every part but the last has to be that size.
+func checkAppendSizes(stored, added []int64) error {
+	if len(added) == 0 {
+		return nil
+	}
+	full := added[0]
+	if len(stored) > 0 {
+		full = stored[0]
+		if stored[len(stored)-1] != full {
+			return ErrAppendPartSize
+		}
+	}
+	for i, size := range added {
+		if size > full || (i < len(added)-1 && size != full) {
+			return ErrAppendPartSize
+		}
+	}
+	return nil
+}
+
+// keptSize is the number of bytes clients see in parts.
+func keptSize(parts []types.Part, encrypted bool) int64 {
+	var size int64
+	for _, part := range parts {
+		size += reader.LogicalPartSize(part, encrypted)
+	}
+	return size
+}
+
+func resizeError(err error) *types.AppError {
+	var limitErr *LimitError
+	switch {
+	case errors.As(err, &limitErr):
+		return &types.AppError{Error: err, Code: http.StatusRequestEntityTooLarge}
+	case errors.Is(err, ErrInlineResize), errors.Is(err, ErrAppendMismatch), errors.Is(err, ErrTruncateParts),
+		errors.Is(err, ErrAppendPartSize):
+		return &types.AppError{Error: err, Code: http.StatusBadRequest}
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return &types.AppError{Error: database.ErrNotFound, Code: http.StatusNotFound}
+	}
+	return operationError(err)
+}
+
+// rehash recomputes in the background the hash of a file whose content
+// changed without a new hash, when it had one before.
+func (fs *FileService) rehash(c *gin.Context, userId int64, id string, previous *string, sent string) {
+	if previous == nil || sent != "" {
+		return
+	}
+	file, appErr := fs.GetFileByID(id)
+	if appErr != nil {
+		return
+	}
+	_, tgSession := auth.GetUser(c)
+	go func() {
+		if _, err := fs.storeFileHash(context.Background(), &models.Session{UserId: userId, Session: tgSession},
+			file, *previous); err != nil {
+			fs.logger.Warnw("failed to rehash file", "fileId", id, "err", err)
+		}
+	}()
+}
+
+func (fs *FileService) resizedFile(id string) (*schemas.FileOut, *types.AppError) {
+	fs.cache.Delete(fmt.Sprintf("files:%s", id), fmt.Sprintf("files:messages:%s", id))
+	var file models.File
+	if err := fs.db.Where("id = ?", id).First(&file).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	return mapper.ToFileOut(file), nil
+}
+
+// AppendFile extends a file with the parts of a finished upload, for content
+// that grows such as logs. Parts are encrypted on their own, so the new parts
+// only have to share the channel, encryption and part size of the file. The
+// part sizes are read before the file is locked, a file changed in between
+// fails as stale.
+func (fs *FileService) AppendFile(c *gin.Context, userId int64, id string, payload *schemas.FileAppend) (*schemas.FileOut, *types.AppError) {
+
+	parts, uploads, appErr := uploadedParts(fs.db, userId, payload.UploadId, nil)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if parts == nil {
+		return nil, &types.AppError{Error: ErrInlineResize, Code: http.StatusBadRequest}
+	}
+	if appErr := fs.verifyUploadParts(c, uploads); appErr != nil {
+		return nil, appErr
+	}
+
+	added := uploadsLogicalSize(uploads)
+
+	current, appErr := fs.GetFileByID(id)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if current.UserID != userId || current.Type != "file" {
+		return nil, &types.AppError{Error: database.ErrNotFound, Code: http.StatusNotFound}
+	}
+	if current.InlineData != nil {
+		return nil, &types.AppError{Error: ErrInlineResize, Code: http.StatusBadRequest}
+	}
+
+	_, session := auth.GetUser(c)
+
+	// The sizes of the stored parts are only known to Telegram.
+	var stored []types.Part
+	err := fs.clients.Run(c, fs.clients.UserSpec(session), func(ctx context.Context, client *telegram.Client) error {
+		var err error
+		stored, err = getParts(ctx, client.API(), fs.cache, current)
+		return err
+	})
+	if err != nil {
+		return nil, telegramError(err)
+	}
+	storedSizes := make([]int64, 0, len(stored))
+	for _, part := range stored {
+		storedSizes = append(storedSizes, reader.LogicalPartSize(part, current.Encrypted))
+	}
+	addedSizes := make([]int64, 0, len(uploads))
+	for i := range uploads {
+		addedSizes = append(addedSizes, uploadLogicalSize(&uploads[i]))
+	}
+	if err := checkAppendSizes(storedSizes, addedSizes); err != nil {
+		return nil, resizeError(err)
+	}
+
+	var previous *string
+
+	err = fs.db.Transaction(func(tx *gorm.DB) error {
+		file, err := lockResizable(tx, userId, id, payload.Version)
+		if err != nil {
+			return err
+		}
+		if len(file.Parts) != len(current.Parts) {
+			return database.ErrStaleVersion
+		}
+		for i := range file.Parts {
+			if file.Parts[i].ID != current.Parts[i].ID {
+				return database.ErrStaleVersion
+			}
+		}
+		for _, upload := range uploads {
+			if file.ChannelID == nil || upload.ChannelID != *file.ChannelID || upload.Encrypted != file.Encrypted {
+				return ErrAppendMismatch
+			}
+		}
+
+		size := added
+		if file.Size != nil {
+			size += *file.Size
+		}
+		all := append(file.Parts, parts...)
+		if err := checkUploadLimits(&fs.cnf.TG, 0, size, len(all)); err != nil {
+			return err
+		}
+		previous = file.HashAlgorithm
+
+		if err := resize(tx, id, all, size, payload.Hash, payload.HashAlgorithm); err != nil {
+			return err
+		}
+		if err := tx.Where("upload_id = ?", payload.UploadId).Where("user_id = ?", userId).
+			Delete(&models.UploadSession{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("upload_id = ?", payload.UploadId).Where("user_id = ?", userId).
+			Delete(&models.Upload{}).Error
+	})
+	if err != nil {
+		return nil, resizeError(err)
+	}
+
+	finishUploadProgress(fs.cache, userId, payload.UploadId, ProgressFinalized, id)
+
+	res, appErr := fs.resizedFile(id)
+	if appErr != nil {
+		return nil, appErr
+	}
+	fs.rehash(c, userId, id, previous, payload.Hash)
+	return res, nil
+}
+
+// TruncateFile drops the trailing parts of a file and deletes their messages.
+// The kept size is read from the stored parts before the file is locked, a
+// file changed in between fails as stale.
+func (fs *FileService) TruncateFile(c *gin.Context, userId int64, id string, payload *schemas.FileTruncate) (*schemas.FileOut, *types.AppError) {
+
+	file, appErr := fs.GetFileByID(id)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if file.UserID != userId || file.Type != "file" {
+		return nil, &types.AppError{Error: database.ErrNotFound, Code: http.StatusNotFound}
+	}
+	if file.InlineData != nil {
+		return nil, &types.AppError{Error: ErrInlineResize, Code: http.StatusBadRequest}
+	}
+	keep := *payload.Parts
+	if keep >= len(file.Parts) {
+		return nil, &types.AppError{Error: ErrTruncateParts, Code: http.StatusBadRequest}
+	}
+
+	_, session := auth.GetUser(c)
+
+	var stored []types.Part
+	err := fs.clients.Run(c, fs.clients.UserSpec(session), func(ctx context.Context, client *telegram.Client) error {
+		var err error
+		stored, err = getParts(ctx, client.API(), fs.cache, file)
+		return err
+	})
+	if err != nil {
+		return nil, telegramError(err)
+	}
+	size := keptSize(stored[:keep], file.Encrypted)
+
+	var (
+		removed  []schemas.Part
+		previous *string
+	)
+
+	err = fs.db.Transaction(func(tx *gorm.DB) error {
+		locked, err := lockResizable(tx, userId, id, payload.Version)
+		if err != nil {
+			return err
+		}
+		if len(locked.Parts) != len(file.Parts) {
+			return database.ErrStaleVersion
+		}
+		for i := range locked.Parts {
+			if locked.Parts[i].ID != file.Parts[i].ID {
+				return database.ErrStaleVersion
+			}
+		}
+		removed = locked.Parts[keep:]
+		previous = locked.HashAlgorithm
+
+		if err := resize(tx, id, locked.Parts[:keep], size, payload.Hash, payload.HashAlgorithm); err != nil {
+			return err
+		}
+		// A checkpoint past the new end hashed bytes that are gone.
+		return tx.Where("file_id = ?", id).Where("hashed_bytes > ?", size).Delete(&models.HashCheckpoint{}).Error
+	})
+	if err != nil {
+		return nil, resizeError(err)
+	}
+
+	ids := make([]int, 0, len(removed))
+	keys := make([]string, 0, len(removed))
+	for _, part := range removed {
+		ids = append(ids, int(part.ID))
+		keys = append(keys, fmt.Sprintf("files:location:%d:%s:%d", userId, id, part.ID))
+	}
+	fs.cache.Delete(keys...)
+	fs.clients.Run(c, fs.clients.UserSpec(session), func(ctx context.Context, client *telegram.Client) error {
+		if err := tgc.DeleteMessages(ctx, client.API(), *file.ChannelID, ids); err != nil {
+			return err
+		}
+		return deleteReplicas(ctx, client.API(), removed)
+	})
+
+	res, appErr := fs.resizedFile(id)
+	if appErr != nil {
+		return nil, appErr
+	}
+	fs.rehash(c, userId, id, previous, payload.Hash)
+	return res, nil
+}
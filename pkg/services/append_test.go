@@ -0,0 +1,44 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/gorm"
+)
+
+func TestKeptSize(t *testing.T) {
+	parts := []types.Part{
+		{Size: 100, DecryptedSize: 80},
+		{Size: 50, DecryptedSize: 40, Compression: "zstd", OriginalSize: 200},
+	}
+	assert.Equal(t, int64(300), keptSize(parts, false))
+	assert.Equal(t, int64(280), keptSize(parts, true))
+	assert.Equal(t, int64(0), keptSize(nil, true))
+}
+
+func TestCheckAppendSizes(t *testing.T) {
+	assert.NoError(t, checkAppendSizes([]int64{100, 100}, []int64{100, 40}))
+	assert.NoError(t, checkAppendSizes([]int64{100}, []int64{60}))
+	assert.NoError(t, checkAppendSizes(nil, []int64{80, 80, 10}))
+	assert.ErrorIs(t, checkAppendSizes([]int64{100, 40}, []int64{100}), ErrAppendPartSize)
+	assert.ErrorIs(t, checkAppendSizes([]int64{100}, []int64{60, 100}), ErrAppendPartSize)
+	assert.ErrorIs(t, checkAppendSizes([]int64{100}, []int64{120}), ErrAppendPartSize)
+}
+
+func TestResizeError(t *testing.T) {
+	for err, code := range map[error]int{
+		ErrInlineResize: http.StatusBadRequest,
+		fmt.Errorf("wrapped: %w", ErrAppendMismatch): http.StatusBadRequest,
+		ErrAppendPartSize:                  http.StatusBadRequest,
+		&LimitError{msg: "too many parts"}: http.StatusRequestEntityTooLarge,
+		gorm.ErrRecordNotFound:             http.StatusNotFound,
+		database.ErrStaleVersion:           http.StatusConflict,
+	} {
+		assert.Equal(t, code, resizeError(err).Code, err.Error())
+	}
+}
@@ -0,0 +1,452 @@
+package services
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/gorm"
+)
+
+const (
+	ArchiveTar   = "tar"
+	ArchiveTarGz = "tgz"
+	ArchiveZip   = "zip"
+)
+
+const (
+	ArchiveRunning   = "running"
+	ArchiveCompleted = "completed"
+	ArchiveFailed    = "failed"
+
+	ArchiveEntryImported = "imported"
+	ArchiveEntrySkipped  = "skipped"
+	ArchiveEntryFailed   = "failed"
+)
+
+// ConflictSkip leaves an entry whose name is taken out of an archive import.
+const ConflictSkip = "skip"
+
+var (
+	ErrArchiveFormat    = errors.New("unsupported archive format")
+	ErrArchivePath      = errors.New("entry path leaves the archive")
+	ErrArchiveEntryType = errors.New("only files and folders are imported")
+	ErrArchiveEmpty     = errors.New("empty file")
+	ErrArchiveNotFound  = errors.New("archive import not found")
+)
+
+// archiveSniffLength covers the ustar magic of a tar header.
+const archiveSniffLength = 512
+
+// archiveFormat returns the declared format or the one the head of the
+// archive reveals, empty when it is neither tar, gzipped tar nor zip.
+func archiveFormat(declared string, head []byte) string {
+	switch {
+	case declared != "":
+		return declared
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return ArchiveTarGz
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		return ArchiveZip
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return ArchiveTar
+	}
+	return ""
+}
+
+// archivePath normalizes the name of an entry to slash separated segments
+// relative to the import folder. Names climbing out of it are refused.
+func archivePath(name string) (string, error) {
+	var segments []string
+	for _, segment := range strings.Split(strings.ReplaceAll(name, `\`, "/"), "/") {
+		switch segment {
+		case "", ".":
+			continue
+		case "..":
+			return "", ErrArchivePath
+		}
+		if err := checkEntryName(segment); err != nil {
+			return "", err
+		}
+		segments = append(segments, segment)
+	}
+	if len(segments) == 0 {
+		return "", ErrArchivePath
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// archiveEntry is a member of an archive. Content is nil for anything but
+// regular files.
+type archiveEntry struct {
+	name    string
+	dir     bool
+	size    int64
+	content io.Reader
+}
+
+// walkArchive hands the entries of an archive to fn in archive order. Tar
+// archives are read as they arrive; a zip keeps its index at the end, so it
+// is spooled to disk first.
+func walkArchive(format string, r io.Reader, fn func(*archiveEntry) error) error {
+	switch format {
+	case ArchiveTarGz:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		return walkTar(gz, fn)
+	case ArchiveTar:
+		return walkTar(r, fn)
+	case ArchiveZip:
+		return walkZip(r, fn)
+	}
+	return ErrArchiveFormat
+}
+
+func walkTar(r io.Reader, fn func(*archiveEntry) error) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entry := &archiveEntry{name: header.Name, size: header.Size}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			entry.dir, entry.size = true, 0
+		case tar.TypeReg:
+			entry.content = tr
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
+
+func walkZip(r io.Reader, fn func(*archiveEntry) error) error {
+	tmp, err := os.CreateTemp("", "teldrive-archive-*")
+	if err != nil {
+		return err
+	}
+	spool := &spoolFile{File: tmp}
+	defer spool.Close()
+
+	size, err := io.Copy(spool, r)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(spool, size)
+	if err != nil {
+		return err
+	}
+	for _, file := range zr.File {
+		entry := &archiveEntry{name: file.Name, size: int64(file.UncompressedSize64)}
+		var content io.ReadCloser
+		switch mode := file.Mode(); {
+		case mode.IsDir() || strings.HasSuffix(file.Name, "/"):
+			entry.dir, entry.size = true, 0
+		case mode.IsRegular():
+			if content, err = file.Open(); err != nil {
+				return err
+			}
+			entry.content = content
+		}
+		err := fn(entry)
+		if content != nil {
+			content.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func toArchiveImportOut(job *models.ArchiveImport) *schemas.ArchiveImportOut {
+	out := &schemas.ArchiveImportOut{Id: job.Id, Path: job.Path, Format: job.Format, Status: job.Status,
+		Entries: job.Entries, Imported: job.Imported, Skipped: job.Skipped, Failed: job.Failed, Bytes: job.Bytes,
+		CreatedAt: job.CreatedAt, UpdatedAt: job.UpdatedAt}
+	if job.Error != nil {
+		out.Error = *job.Error
+	}
+	return out
+}
+
+// archiveImport extracts one archive, remembering the folders it has created.
+type archiveImport struct {
+	us      *UploadService
+	c       *gin.Context
+	userId  int64
+	session string
+	query   *schemas.ArchiveImportQuery
+	job     *models.ArchiveImport
+	folders map[string]string
+}
+
+// folder returns the id of the folder at rel below the import folder,
+// creating it and any folder above it.
+func (imp *archiveImport) folder(rel string) (string, error) {
+	if id, ok := imp.folders[rel]; ok {
+		return id, nil
+	}
+	files, err := createDirectories(imp.us.db, imp.us.cache, imp.us.fs.cnf, imp.userId, path.Join(imp.query.Path, rel))
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", database.ErrNotFound
+	}
+	imp.folders[rel] = files[0].Id
+	return files[0].Id, nil
+}
+
+// store imports a single entry, reporting whether it was skipped.
+func (imp *archiveImport) store(entry *archiveEntry, record *models.ArchiveEntry) (bool, error) {
+	rel, err := archivePath(entry.name)
+	if err != nil {
+		return false, err
+	}
+	record.Path = rel
+	if entry.dir {
+		record.Type = "folder"
+		_, err := imp.folder(rel)
+		return false, err
+	}
+	if entry.content == nil {
+		return true, ErrArchiveEntryType
+	}
+	if entry.size == 0 {
+		return true, ErrArchiveEmpty
+	}
+
+	dir, name := path.Split(rel)
+	dir = strings.TrimSuffix(dir, "/")
+	if err := checkUploadLimits(imp.us.cnf, 0, entry.size, 0); err != nil {
+		return false, err
+	}
+	if err := checkFileType(imp.us.db, imp.us.cache, imp.us.cnf, imp.userId, name); err != nil {
+		return false, err
+	}
+	if err := checkEntryRoom(imp.us.db, imp.us.cache, imp.us.fs.cnf, imp.userId, 1, 0); err != nil {
+		return false, err
+	}
+
+	parentId, err := imp.folder(dir)
+	if err != nil {
+		return false, err
+	}
+
+	conflict := imp.query.Conflict
+	if conflict == "" || conflict == ConflictError || conflict == ConflictSkip {
+		// Taken names are settled before anything is sent to Telegram.
+		var taken int64
+		if err := imp.us.db.Model(&models.File{}).Where("parent_id = ?", parentId).Where("name = ?", name).
+			Where("user_id = ?", imp.userId).Where("status = ?", "active").Count(&taken).Error; err != nil {
+			return false, err
+		}
+		if taken > 0 {
+			return conflict == ConflictSkip, database.ErrKeyConflict
+		}
+		if conflict == ConflictSkip {
+			conflict = ""
+		}
+	}
+
+	res, appErr := imp.us.uploadStream(imp.c, imp.userId, imp.session, &schemas.MultipartUploadQuery{
+		Path:            path.Join(imp.query.Path, dir),
+		ChannelID:       imp.query.ChannelID,
+		Encrypted:       imp.query.Encrypted,
+		Encryption:      imp.query.Encryption,
+		PartSize:        imp.query.PartSize,
+		Conflict:        conflict,
+		ReplicaChannels: imp.query.ReplicaChannels,
+	}, name, "", entry.content)
+	if appErr != nil {
+		return false, appErr.Error
+	}
+	record.FileId = &res.Id
+	return false, nil
+}
+
+// entry records the outcome of an entry on the job. Entries that cannot be
+// imported are reported and do not stop the import.
+func (imp *archiveImport) entry(entry *archiveEntry) error {
+	imp.job.Entries++
+	record := models.ArchiveEntry{ImportId: imp.job.Id, Seq: imp.job.Entries, Path: entry.name, Type: "file",
+		Size: entry.size}
+
+	skipped, err := imp.store(entry, &record)
+	if imp.c.Request.Context().Err() != nil {
+		return imp.c.Request.Context().Err()
+	}
+	switch {
+	case err != nil && skipped:
+		record.Status = ArchiveEntrySkipped
+		imp.job.Skipped++
+	case err != nil:
+		record.Status = ArchiveEntryFailed
+		imp.job.Failed++
+	default:
+		record.Status = ArchiveEntryImported
+		imp.job.Imported++
+		imp.job.Bytes += record.Size
+	}
+	if err != nil {
+		msg := err.Error()
+		record.Error = &msg
+	}
+
+	return imp.us.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&record).Error; err != nil {
+			return err
+		}
+		return tx.Model(imp.job).Updates(map[string]any{"entries": imp.job.Entries, "imported": imp.job.Imported,
+			"skipped": imp.job.Skipped, "failed": imp.job.Failed, "bytes": imp.job.Bytes,
+			"updated_at": time.Now().UTC()}).Error
+	})
+}
+
+// ImportArchive extracts a tar, gzipped tar or zip archive sent as the request
+// body into a folder of the user. Folders are recreated and every file goes
+// through the regular upload path, the progress of each entry is recorded on
+// the import job as it happens.
+func (us *UploadService) ImportArchive(c *gin.Context) (*schemas.ArchiveImportOut, *types.AppError) {
+	var query schemas.ArchiveImportQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+	query.Path = strings.TrimSpace(query.Path)
+
+	userId, session := auth.GetUser(c)
+
+	target, err := us.fs.getFileFromPath(query.Path, userId)
+	if err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusNotFound}
+	}
+
+	body := bufio.NewReaderSize(c.Request.Body, archiveSniffLength)
+	head, _ := body.Peek(archiveSniffLength)
+	format := archiveFormat(query.Format, head)
+	if format == "" {
+		return nil, &types.AppError{Error: ErrArchiveFormat, Code: http.StatusUnsupportedMediaType}
+	}
+
+	job := &models.ArchiveImport{UserId: userId, Path: query.Path, Format: format, Status: ArchiveRunning}
+	if err := us.db.Create(job).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	imp := &archiveImport{us: us, c: c, userId: userId, session: session, query: &query, job: job,
+		folders: map[string]string{"": target.Id}}
+
+	walkErr := walkArchive(format, body, imp.entry)
+
+	values := map[string]any{"status": ArchiveCompleted, "updated_at": time.Now().UTC()}
+	if walkErr != nil {
+		msg := walkErr.Error()
+		job.Error = &msg
+		values["status"], values["error"] = ArchiveFailed, msg
+	}
+	job.Status = values["status"].(string)
+	if err := us.db.Model(job).Updates(values).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	if walkErr != nil {
+		return nil, &types.AppError{Error: walkErr, Code: http.StatusBadRequest}
+	}
+	return us.GetArchiveImport(userId, job.Id)
+}
+
+func (us *UploadService) GetArchiveImport(userId int64, id string) (*schemas.ArchiveImportOut, *types.AppError) {
+	var jobs []models.ArchiveImport
+	if err := us.db.Where("id = ?", id).Where("user_id = ?", userId).Find(&jobs).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	if len(jobs) == 0 {
+		return nil, &types.AppError{Error: ErrArchiveNotFound, Code: http.StatusNotFound}
+	}
+	return toArchiveImportOut(&jobs[0]), nil
+}
+
+// ListArchiveImports returns the user's archive imports, newest first.
+func (us *UploadService) ListArchiveImports(userId int64) ([]schemas.ArchiveImportOut, *types.AppError) {
+	var jobs []models.ArchiveImport
+	if err := us.db.Where("user_id = ?", userId).Order("created_at desc").Limit(100).
+		Find(&jobs).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	res := make([]schemas.ArchiveImportOut, len(jobs))
+	for i := range jobs {
+		res[i] = *toArchiveImportOut(&jobs[i])
+	}
+	return res, nil
+}
+
+// ListArchiveEntries pages through the entries of an import in archive order.
+func (us *UploadService) ListArchiveEntries(userId int64, id string, query *schemas.ArchiveEntryQuery) (*schemas.ArchiveEntryResponse, *types.AppError) {
+	if _, appErr := us.GetArchiveImport(userId, id); appErr != nil {
+		return nil, appErr
+	}
+
+	limit := query.Limit
+	if limit == 0 {
+		limit = 500
+	}
+	page := max(query.Page, 1)
+
+	scope := func(db *gorm.DB) *gorm.DB {
+		db = db.Where("import_id = ?", id)
+		if query.Status != "" {
+			db = db.Where("status = ?", query.Status)
+		}
+		return db
+	}
+
+	var count int64
+	if err := us.db.Model(&models.ArchiveEntry{}).Scopes(scope).Count(&count).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	var entries []models.ArchiveEntry
+	if err := us.db.Scopes(scope).Order("seq").Offset((page - 1) * limit).Limit(limit).
+		Find(&entries).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	res := &schemas.ArchiveEntryResponse{Entries: make([]schemas.ArchiveEntryOut, len(entries)),
+		Meta: schemas.Meta{Count: int(count), TotalPages: int(math.Ceil(float64(count) / float64(limit))),
+			CurrentPage: page}}
+	for i, entry := range entries {
+		out := schemas.ArchiveEntryOut{Seq: entry.Seq, Path: entry.Path, Type: entry.Type, Status: entry.Status,
+			Size: entry.Size}
+		if entry.FileId != nil {
+			out.FileID = *entry.FileId
+		}
+		if entry.Error != nil {
+			out.Error = *entry.Error
+		}
+		res.Entries[i] = out
+	}
+	return res, nil
+}
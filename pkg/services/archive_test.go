@@ -0,0 +1,107 @@
+package services
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchivePath(t *testing.T) {
+	for name, want := range map[string]string{
+		"docs/a.txt":        "docs/a.txt",
+		"./docs//a.txt":     "docs/a.txt",
+		`photos\2024\b.jpg`: "photos/2024/b.jpg",
+		"/abs/c.txt":        "abs/c.txt",
+		"docs/":             "docs",
+	} {
+		got, err := archivePath(name)
+		assert.NoError(t, err, name)
+		assert.Equal(t, want, got, name)
+	}
+	for _, name := range []string{"../evil", "docs/../../evil", "./", " /a"} {
+		_, err := archivePath(name)
+		assert.Error(t, err, name)
+	}
+}
+
+func testTar(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "docs/", Typeflag: tar.TypeDir, Mode: 0755}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "docs/a.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 5}))
+	_, err := tw.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "docs/a.txt"}))
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestArchiveFormat(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(testTar(t))
+	w.Close()
+
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	zw.Create("a.txt")
+	zw.Close()
+
+	assert.Equal(t, ArchiveTar, archiveFormat("", testTar(t)))
+	assert.Equal(t, ArchiveTarGz, archiveFormat("", gz.Bytes()))
+	assert.Equal(t, ArchiveZip, archiveFormat("", zipped.Bytes()))
+	assert.Equal(t, "", archiveFormat("", []byte("plain text")))
+	assert.Equal(t, ArchiveZip, archiveFormat(ArchiveZip, []byte("plain text")))
+}
+
+type walkedEntry struct {
+	name    string
+	dir     bool
+	content string
+	regular bool
+}
+
+func walked(t *testing.T, format string, data []byte) []walkedEntry {
+	var res []walkedEntry
+	err := walkArchive(format, bytes.NewReader(data), func(entry *archiveEntry) error {
+		w := walkedEntry{name: entry.name, dir: entry.dir, regular: entry.content != nil}
+		if entry.content != nil {
+			content, err := io.ReadAll(entry.content)
+			require.NoError(t, err)
+			w.content = string(content)
+		}
+		res = append(res, w)
+		return nil
+	})
+	require.NoError(t, err)
+	return res
+}
+
+func TestWalkArchive(t *testing.T) {
+	want := []walkedEntry{
+		{name: "docs/", dir: true},
+		{name: "docs/a.txt", content: "hello", regular: true},
+		{name: "link"},
+	}
+	assert.Equal(t, want, walked(t, ArchiveTar, testTar(t)))
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(testTar(t))
+	w.Close()
+	assert.Equal(t, want, walked(t, ArchiveTarGz, gz.Bytes()))
+
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	zw.Create("docs/")
+	f, _ := zw.Create("docs/a.txt")
+	f.Write([]byte("hello"))
+	require.NoError(t, zw.Close())
+	assert.Equal(t, want[:2], walked(t, ArchiveZip, zipped.Bytes()))
+}
@@ -1,25 +1,22 @@
 package services
 
 import (
-	"bytes"
 	"context"
 	"crypto/md5"
-	"encoding/base64"
-	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math/big"
-	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/websocket"
 	"github.com/gotd/td/session"
+	"github.com/gotd/td/telegram"
 	tgauth "github.com/gotd/td/telegram/auth"
 	"github.com/gotd/td/telegram/auth/qrlogin"
 	"github.com/gotd/td/tg"
@@ -27,7 +24,9 @@ import (
 	"github.com/tgdrive/teldrive/internal/auth"
 	"github.com/tgdrive/teldrive/internal/cache"
 	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/logging"
 	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/httputil"
 	"github.com/tgdrive/teldrive/pkg/models"
 	"github.com/tgdrive/teldrive/pkg/schemas"
 	"github.com/tgdrive/teldrive/pkg/types"
@@ -36,23 +35,45 @@ import (
 )
 
 type AuthService struct {
-	db    *gorm.DB
-	cnf   *config.Config
-	cache cache.Cacher
+	db      *gorm.DB
+	cnf     *config.Config
+	cache   cache.Cacher
+	clients *tgc.Manager
+	gate    *auth.LoginGate
 }
 
-func NewAuthService(db *gorm.DB, cnf *config.Config, cache cache.Cacher) *AuthService {
-	return &AuthService{db: db, cnf: cnf, cache: cache}
+func NewAuthService(db *gorm.DB, cnf *config.Config, cache cache.Cacher, clients *tgc.Manager) *AuthService {
+	return &AuthService{db: db, cnf: cnf, cache: cache, clients: clients, gate: auth.NewLoginGate(&cnf.Login)}
 
 }
 
-func (as *AuthService) LogIn(c *gin.Context, session *schemas.TgSession) (*schemas.Message, *types.AppError) {
+func (as *AuthService) GetLoginGate() *schemas.LoginGateOut {
+	out := &schemas.LoginGateOut{Gate: as.gate.Mode()}
+	if out.Gate == auth.GateCaptcha {
+		out.Provider = as.cnf.Login.Captcha.Provider
+		out.SiteKey = as.cnf.Login.Captcha.SiteKey
+	}
+	return out
+}
+
+func (as *AuthService) LogIn(c *gin.Context, session *schemas.TgSession) (*schemas.LoginOut, *types.AppError) {
 
-	if !checkUserIsAllowed(as.cnf.JWT.AllowedUsers, session.UserName) {
+	if !as.userAllowed(session.UserID, session.UserName) {
 		return nil, &types.AppError{Error: errors.New("user not allowed"),
 			Code: http.StatusUnauthorized}
 	}
 
+	normalized, err := tgc.NormalizeSession(session.Sesssion)
+	if err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+	session.Sesssion = normalized
+
+	creds, err := tgc.NewAppCredentials(session.AppId, session.AppHash)
+	if err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+
 	now := time.Now().UTC()
 
 	jwtClaims := &types.JWTClaims{
@@ -83,11 +104,15 @@ func (as *AuthService) LogIn(c *gin.Context, session *schemas.TgSession) (*schem
 		IsPremium: session.IsPremium,
 	}
 
+	firstLogin := false
+
 	err = as.db.Transaction(func(tx *gorm.DB) error {
 
-		if err := as.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&user).Error; err != nil {
-			return err
+		res := as.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&user)
+		if res.Error != nil {
+			return res.Error
 		}
+		firstLogin = res.RowsAffected == 1
 		file := &models.File{
 			Name:     "root",
 			Type:     "folder",
@@ -106,11 +131,11 @@ func (as *AuthService) LogIn(c *gin.Context, session *schemas.TgSession) (*schem
 		return nil, &types.AppError{Error: err}
 	}
 
-	client, _ := tgc.AuthClient(c, &as.cnf.TG, session.Sesssion)
-
 	var auth *tg.Authorization
 
-	err = client.Run(c, func(ctx context.Context) error {
+	out := &schemas.LoginOut{Message: "login success"}
+
+	err = as.clients.Run(c, as.clients.UserSpecWithApp(session.Sesssion, creds), func(ctx context.Context, client *telegram.Client) error {
 		auths, err := client.API().AccountGetAuthorizations(c)
 		if err != nil {
 			return err
@@ -121,9 +146,21 @@ func (as *AuthService) LogIn(c *gin.Context, session *schemas.TgSession) (*schem
 				break
 			}
 		}
+		if firstLogin && as.cnf.TG.AutoChannel.Enabled {
+			channelId, err := as.createStorageChannel(ctx, client.API(), session)
+			if err != nil {
+				logging.FromContext(c).Warnw("failed to create storage channel", "err", err)
+				out.Warnings = append(out.Warnings, fmt.Sprintf("storage channel was not created: %s", err))
+			} else {
+				out.ChannelID = channelId
+			}
+		}
 		return nil
 	})
 
+	if tgc.IsAppRejected(err) {
+		return nil, &types.AppError{Error: tgc.ErrAppRejected, Code: http.StatusBadRequest}
+	}
 	if err != nil {
 		return nil, &types.AppError{Error: err}
 
@@ -131,18 +168,68 @@ func (as *AuthService) LogIn(c *gin.Context, session *schemas.TgSession) (*schem
 
 	//create session
 	if err := as.db.Create(&models.Session{UserId: session.UserID, Hash: hexToken,
-		Session: session.Sesssion, SessionDate: auth.DateCreated}).Error; err != nil {
+		Session: session.Sesssion, SessionDate: auth.DateCreated,
+		AppId: session.AppId, AppHash: session.AppHash}).Error; err != nil {
 		return nil, &types.AppError{Error: err}
 	}
+	as.cache.Delete(sessionAppKey(session.Sesssion))
 
 	setSessionCookie(c, jweToken, int(as.cnf.JWT.SessionTime.Seconds()))
 
-	return &schemas.Message{Message: "login success"}, nil
+	return out, nil
+}
+
+// createStorageChannel creates a private channel with the user's session and
+// selects it as the default upload channel. The access hash is cached for the
+// user account so the first upload does not need to resolve the channel.
+func (as *AuthService) createStorageChannel(ctx context.Context, api *tg.Client, session *schemas.TgSession) (int64, error) {
+	if session.Bot {
+		return 0, errors.New("bots cannot create channels")
+	}
+
+	updates, err := api.ChannelsCreateChannel(ctx, &tg.ChannelsCreateChannelRequest{
+		Broadcast: true,
+		Title:     as.cnf.TG.AutoChannel.Name,
+		About:     "Storage channel created by Teldrive",
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var channel *tg.Channel
+	if u, ok := updates.(interface{ GetChats() []tg.ChatClass }); ok {
+		for _, chat := range u.GetChats() {
+			if c, ok := chat.(*tg.Channel); ok {
+				channel = c
+				break
+			}
+		}
+	}
+	if channel == nil {
+		return 0, errors.New("channel missing from response")
+	}
+
+	if err := as.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Channel{}).Where("user_id = ?", session.UserID).
+			Update("selected", false).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.Channel{ChannelID: channel.ID, ChannelName: channel.Title,
+			UserID: session.UserID, Selected: true}).Error
+	}); err != nil {
+		return 0, err
+	}
+
+	as.cache.Set(fmt.Sprintf("users:channel:%d", session.UserID), channel.ID, 0)
+	as.cache.Set(inputChannelKey(session.UserID, strconv.FormatInt(session.UserID, 10), channel.ID),
+		channel.AsInput(), 0)
+
+	return channel.ID, nil
 }
 
 func (as *AuthService) GetSession(c *gin.Context) *schemas.Session {
 
-	claims, err := auth.VerifyUser(c, as.db, as.cache, as.cnf.JWT.Secret)
+	claims, err := auth.VerifyUser(c, as.db, as.cache, &as.cnf.JWT)
 
 	if err != nil {
 		return nil
@@ -154,6 +241,13 @@ func (as *AuthService) GetSession(c *gin.Context) *schemas.Session {
 
 	newExpires := now.Add(as.cnf.JWT.SessionTime)
 
+	// The token is not renewed past the absolute session lifetime.
+	if dbSession, err := auth.GetSessionByHash(as.db, as.cache, claims.Hash); err == nil && as.cnf.JWT.MaxAge > 0 {
+		if expiry := dbSession.CreatedAt.Add(as.cnf.JWT.MaxAge); expiry.Before(newExpires) {
+			newExpires = expiry
+		}
+	}
+
 	userId, _ := strconv.ParseInt(claims.Subject, 10, 64)
 
 	session := &schemas.Session{Name: claims.Name,
@@ -171,26 +265,43 @@ func (as *AuthService) GetSession(c *gin.Context) *schemas.Session {
 	if err != nil {
 		return nil
 	}
-	setSessionCookie(c, jweToken, int(as.cnf.JWT.SessionTime.Seconds()))
+	setSessionCookie(c, jweToken, int(newExpires.Sub(now).Seconds()))
 	return session
 }
 
 func (as *AuthService) Logout(c *gin.Context) (*schemas.Message, *types.AppError) {
 	val, _ := c.Get("jwtUser")
 	jwtUser := val.(*types.JWTClaims)
-	client, _ := tgc.AuthClient(c, &as.cnf.TG, jwtUser.TgSession)
+	spec := as.clients.UserSpec(jwtUser.TgSession)
 
-	tgc.RunWithAuth(c, client, "", func(ctx context.Context) error {
+	as.clients.Run(c, spec, func(ctx context.Context, client *telegram.Client) error {
 		_, err := client.API().AuthLogOut(c)
 		return err
 	})
+	as.clients.Evict(spec.Key)
 	setSessionCookie(c, "", -1)
 	as.db.Where("session = ?", jwtUser.TgSession).Delete(&models.Session{})
 	as.cache.Delete(fmt.Sprintf("sessions:%s", jwtUser.Hash))
+	as.cache.Delete(sessionAppKey(jwtUser.TgSession))
 	return &schemas.Message{Message: "logout success"}, nil
 }
 
+// gateStatus is the status a request refused by the login gate fails with.
+func gateStatus(err error) int {
+	if errors.Is(err, auth.ErrGateRequired) || errors.Is(err, auth.ErrGateRejected) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
 func (as *AuthService) HandleMultipleLogin(c *gin.Context) {
+	// The gate runs before the upgrade so rejected clients never reach
+	// Telegram with the app credentials.
+	if err := as.gate.Check(c, c.Query("gateToken"), c.ClientIP()); err != nil {
+		httputil.NewError(c, gateStatus(err), err)
+		return
+	}
+
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
 			return true
@@ -202,10 +313,34 @@ func (as *AuthService) HandleMultipleLogin(c *gin.Context) {
 	}
 	defer conn.Close()
 
+	if as.cnf.Server.MaxWsMessageSize > 0 {
+		conn.SetReadLimit(as.cnf.Server.MaxWsMessageSize)
+	}
+
 	dispatcher := tg.NewUpdateDispatcher()
 	loggedIn := qrlogin.OnLoginToken(dispatcher)
 	sessionStorage := &session.StorageMemory{}
-	tgClient, _ := tgc.NoAuthClient(c, &as.cnf.TG, dispatcher, sessionStorage)
+	// Logins under the user's own Telegram app pass its credentials as query
+	// parameters; they are echoed in the session payload for /auth/login.
+	var (
+		appId   *int
+		appHash *string
+	)
+	if v := c.Query("appId"); v != "" {
+		id, _ := strconv.Atoi(v)
+		appId = &id
+	}
+	if v := c.Query("appHash"); v != "" {
+		appHash = &v
+	}
+	creds, err := tgc.NewAppCredentials(appId, appHash)
+	if err != nil {
+		conn.WriteJSON(map[string]interface{}{"type": "error", "message": err.Error()})
+		return
+	}
+
+	tgClient, _ := tgc.NoAuthClient(c, tgc.WithApp(&as.cnf.TG, creds), dispatcher, sessionStorage,
+		tgc.EffectiveRateLimit(&as.cnf.TG, nil, nil))
 
 	err = tgClient.Run(c, func(ctx context.Context) error {
 		for {
@@ -236,7 +371,7 @@ func (as *AuthService) HandleMultipleLogin(c *gin.Context) {
 						conn.WriteJSON(map[string]interface{}{"type": "error", "message": "auth failed"})
 						return
 					}
-					if !checkUserIsAllowed(as.cnf.JWT.AllowedUsers, user.Username) {
+					if !as.userAllowed(user.ID, user.Username) {
 						conn.WriteJSON(map[string]interface{}{"type": "error", "message": "user not allowed"})
 						tgClient.API().AuthLogOut(c)
 						return
@@ -244,7 +379,7 @@ func (as *AuthService) HandleMultipleLogin(c *gin.Context) {
 					res, _ := sessionStorage.LoadSession(c)
 					sessionData := &types.SessionData{}
 					json.Unmarshal(res, sessionData)
-					session := prepareSession(user, &sessionData.Data)
+					session := prepareSession(user, &sessionData.Data, creds)
 					conn.WriteJSON(map[string]interface{}{"type": "auth", "payload": session, "message": "success"})
 				}()
 			}
@@ -277,7 +412,7 @@ func (as *AuthService) HandleMultipleLogin(c *gin.Context) {
 						conn.WriteJSON(map[string]interface{}{"type": "error", "message": "auth failed"})
 						return
 					}
-					if !checkUserIsAllowed(as.cnf.JWT.AllowedUsers, user.Username) {
+					if !as.userAllowed(user.ID, user.Username) {
 						conn.WriteJSON(map[string]interface{}{"type": "error", "message": "user not allowed"})
 						tgClient.API().AuthLogOut(c)
 						return
@@ -285,7 +420,7 @@ func (as *AuthService) HandleMultipleLogin(c *gin.Context) {
 					res, _ := sessionStorage.LoadSession(c)
 					sessionData := &types.SessionData{}
 					json.Unmarshal(res, sessionData)
-					session := prepareSession(user, &sessionData.Data)
+					session := prepareSession(user, &sessionData.Data, creds)
 					conn.WriteJSON(map[string]interface{}{"type": "auth", "payload": session, "message": "success"})
 				}()
 			}
@@ -302,7 +437,7 @@ func (as *AuthService) HandleMultipleLogin(c *gin.Context) {
 						conn.WriteJSON(map[string]interface{}{"type": "error", "message": "auth failed"})
 						return
 					}
-					if !checkUserIsAllowed(as.cnf.JWT.AllowedUsers, user.Username) {
+					if !as.userAllowed(user.ID, user.Username) {
 						conn.WriteJSON(map[string]interface{}{"type": "error", "message": "user not allowed"})
 						tgClient.API().AuthLogOut(c)
 						return
@@ -310,7 +445,7 @@ func (as *AuthService) HandleMultipleLogin(c *gin.Context) {
 					res, _ := sessionStorage.LoadSession(c)
 					sessionData := &types.SessionData{}
 					json.Unmarshal(res, sessionData)
-					session := prepareSession(user, &sessionData.Data)
+					session := prepareSession(user, &sessionData.Data, creds)
 					conn.WriteJSON(map[string]interface{}{"type": "auth", "payload": session, "message": "success"})
 				}()
 			}
@@ -322,61 +457,29 @@ func (as *AuthService) HandleMultipleLogin(c *gin.Context) {
 	}
 }
 
-func ip4toInt(IPv4Address net.IP) int64 {
-	IPv4Int := big.NewInt(0)
-	IPv4Int.SetBytes(IPv4Address.To4())
-	return IPv4Int.Int64()
-}
-
-func pack32BinaryIP4(ip4Address string) []byte {
-	ipv4Decimal := ip4toInt(net.ParseIP(ip4Address))
-
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.BigEndian, uint32(ipv4Decimal))
-	return buf.Bytes()
-}
-
-func generateTgSession(dcID int, authKey []byte, port int) string {
-
-	dcMaps := map[int]string{
-		1: "149.154.175.53",
-		2: "149.154.167.51",
-		3: "149.154.175.100",
-		4: "149.154.167.91",
-		5: "91.108.56.130",
+// checkUserIsAllowed matches a user against the configured allow and deny
+// lists. Entries are numeric user ids or username globs such as "team_*";
+// ids match even after a username change and username entries never match
+// accounts without one. Denied users are refused even when the allow list is
+// empty or blank.
+func checkUserIsAllowed(allowedUsers, deniedUsers []string, userId int64, userName string) bool {
+	if auth.MatchUser(deniedUsers, userId, userName) {
+		return false
 	}
-
-	dcIDByte := byte(dcID)
-	serverAddressBytes := pack32BinaryIP4(dcMaps[dcID])
-	portByte := make([]byte, 2)
-	binary.BigEndian.PutUint16(portByte, uint16(port))
-
-	packet := make([]byte, 0)
-	packet = append(packet, dcIDByte)
-	packet = append(packet, serverAddressBytes...)
-	packet = append(packet, portByte...)
-	packet = append(packet, authKey...)
-
-	base64Encoded := base64.URLEncoding.EncodeToString(packet)
-	return "1" + base64Encoded
-}
-
-func checkUserIsAllowed(allowedUsers []string, userName string) bool {
-	found := false
-	if len(allowedUsers) > 0 {
-		for _, user := range allowedUsers {
-			if user == userName {
-				found = true
-				break
-			}
+	for _, entry := range allowedUsers {
+		if strings.TrimSpace(entry) != "" {
+			return auth.MatchUser(allowedUsers, userId, userName)
 		}
-	} else {
-		found = true
 	}
-	return found
+	return true
 }
-func prepareSession(user *tg.User, data *session.Data) *schemas.TgSession {
-	sessionString := generateTgSession(data.DC, data.AuthKey, 443)
+
+func (as *AuthService) userAllowed(userId int64, userName string) bool {
+	return checkUserIsAllowed(as.cnf.JWT.AllowedUsers, as.cnf.JWT.DeniedUsers, userId, userName)
+}
+
+func prepareSession(user *tg.User, data *session.Data, creds *tgc.AppCredentials) *schemas.TgSession {
+	sessionString := tgc.EncodeSessionAddr(data.DC, data.Addr, data.AuthKey)
 	session := &schemas.TgSession{
 		Sesssion:  sessionString,
 		UserID:    user.ID,
@@ -385,10 +488,13 @@ func prepareSession(user *tg.User, data *session.Data) *schemas.TgSession {
 		Name:      fmt.Sprintf("%s %s", user.FirstName, user.LastName),
 		IsPremium: user.Premium,
 	}
+	if creds != nil {
+		session.AppId, session.AppHash = &creds.AppId, &creds.AppHash
+	}
 	return session
 }
 
 func setSessionCookie(c *gin.Context, value string, maxAge int) {
 	c.SetSameSite(2)
-	c.SetCookie("user-session", value, maxAge, "/", "", false, true)
+	c.SetCookie("user-session", value, maxAge, httputil.CookiePath(c.Request), "", httputil.IsSecure(c.Request), true)
 }
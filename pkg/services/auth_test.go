@@ -0,0 +1,76 @@
+package services
+
+import (
+	"crypto/rand"
+	"net/http"
+	"testing"
+
+	"github.com/gotd/td/tgerr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+)
+
+func TestCheckUserIsAllowed(t *testing.T) {
+	tests := []struct {
+		name            string
+		allowed, denied []string
+		userId          int64
+		userName        string
+		want            bool
+	}{
+		{"open instance", nil, nil, 1, "alice", true},
+		{"username", []string{"alice"}, nil, 1, "alice", true},
+		{"username case and at", []string{"@Alice"}, nil, 1, "alice", true},
+		{"not listed", []string{"alice"}, nil, 2, "bob", false},
+		{"glob", []string{"team_*"}, nil, 3, "team_ops", true},
+		{"id", []string{"42"}, nil, 42, "renamed", true},
+		{"id without username", []string{"42"}, nil, 42, "", true},
+		{"no username vs glob", []string{"*"}, nil, 42, "", false},
+		{"id does not match username", []string{"42"}, nil, 7, "42", false},
+		{"denied on open instance", nil, []string{"mallory"}, 9, "mallory", false},
+		{"denied id beats allowed username", []string{"alice"}, []string{"1"}, 1, "alice", false},
+		{"denied glob beats allowed id", []string{"1"}, []string{"ali*"}, 1, "alice", false},
+		{"denied username gone, id allowed", []string{"1"}, []string{"oldname"}, 1, "", true},
+		{"blank entries ignored", []string{""}, []string{""}, 1, "alice", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, checkUserIsAllowed(tt.allowed, tt.denied, tt.userId, tt.userName))
+		})
+	}
+}
+
+func TestValidateSessionOffline(t *testing.T) {
+	as := &AuthService{}
+
+	key := make([]byte, 256)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+
+	out, appErr := as.ValidateSession(nil, &schemas.SessionCheck{Session: tgc.EncodeSession(4, key), Offline: true})
+	require.Nil(t, appErr)
+	assert.Equal(t, SessionParsed, out.Status)
+	assert.Equal(t, 4, out.Dc)
+
+	_, appErr = as.ValidateSession(nil, &schemas.SessionCheck{Session: "not a session", Offline: true})
+	require.NotNil(t, appErr)
+	assert.Equal(t, http.StatusBadRequest, appErr.Code)
+}
+
+func TestSessionStatus(t *testing.T) {
+	for err, want := range map[error]string{
+		tgerr.New(401, "AUTH_KEY_UNREGISTERED"): SessionRevoked,
+		tgerr.New(401, "SESSION_REVOKED"):       SessionRevoked,
+		tgerr.New(401, "USER_DEACTIVATED_BAN"):  SessionDeactivated,
+	} {
+		status, ok := sessionStatus(err)
+		assert.True(t, ok)
+		assert.Equal(t, want, status)
+	}
+	for _, err := range []error{nil, tgerr.New(420, "FLOOD_WAIT_3")} {
+		_, ok := sessionStatus(err)
+		assert.False(t, ok)
+	}
+}
@@ -0,0 +1,418 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/telegram/message/peer"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	BotRoleDefault  = "default"
+	BotRoleUpload   = "upload"
+	BotRoleDownload = "download"
+
+	defaultBotPool = "default"
+)
+
+var ErrBotNotFound = errors.New("bot not found")
+
+const roleBotsQuery = `
+SELECT b.token FROM teldrive.bots b
+LEFT JOIN teldrive.bot_pools p ON p.user_id = b.user_id AND p.channel_id = b.channel_id AND p.name = b.pool
+WHERE b.user_id = ? AND b.channel_id = ? AND coalesce(p.role, 'default') = ?
+ORDER BY b.token`
+
+// getRoleBots returns the bots of a channel that serve role: those of the
+// pools assigned to it, else those of the default pools, else all of them.
+func getRoleBots(db *gorm.DB, cache cache.Cacher, userId, channelId int64, role string) ([]string, error) {
+	var bots []string
+
+	key := fmt.Sprintf("users:bots:%d:%d:%s", userId, channelId, role)
+
+	if err := cache.Get(key, &bots); err == nil {
+		return bots, nil
+	}
+
+	for _, r := range []string{role, BotRoleDefault} {
+		if err := db.Raw(roleBotsQuery, userId, channelId, r).Scan(&bots).Error; err != nil {
+			return nil, err
+		}
+		if len(bots) > 0 {
+			break
+		}
+	}
+
+	if len(bots) == 0 {
+		var err error
+		if bots, err = getBotsToken(db, cache, userId, channelId); err != nil {
+			return nil, err
+		}
+	}
+
+	cache.Set(key, &bots, 0)
+	return bots, nil
+}
+
+func clearBotsCache(cache cache.Cacher, userId, channelId int64) {
+	cache.Delete(fmt.Sprintf("users:bots:%d:%d", userId, channelId),
+		fmt.Sprintf("users:bots:%d:%d:%s", userId, channelId, BotRoleDefault),
+		fmt.Sprintf("users:bots:%d:%d:%s", userId, channelId, BotRoleUpload),
+		fmt.Sprintf("users:bots:%d:%d:%s", userId, channelId, BotRoleDownload))
+}
+
+// botChannel returns the channel given, which must belong to the user, or
+// the default channel.
+func (us *UserService) botChannel(userId, channelId int64) (int64, *types.AppError) {
+	if channelId == 0 {
+		channelId, err := getDefaultChannel(us.db, us.cache, userId)
+		if err != nil {
+			return 0, &types.AppError{Error: err, Code: http.StatusBadRequest}
+		}
+		return channelId, nil
+	}
+	if err := checkChannelAccess(us.db, us.cache, userId, channelId); err != nil {
+		return 0, channelAccessError(err)
+	}
+	return channelId, nil
+}
+
+// ListBots returns the user's bots with their pool and its role, optionally
+// only those of one channel.
+func (us *UserService) ListBots(c *gin.Context) ([]schemas.BotStatus, *types.AppError) {
+	userId, _ := auth.GetUser(c)
+
+	var query schemas.BotQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+
+	var rows []struct {
+		models.Bot
+		Role *string
+	}
+	chain := us.db.Table("teldrive.bots b").Select("b.*, p.role").
+		Joins("LEFT JOIN teldrive.bot_pools p ON p.user_id = b.user_id AND p.channel_id = b.channel_id AND p.name = b.pool").
+		Where("b.user_id = ?", userId)
+	if query.ChannelID != 0 {
+		chain = chain.Where("b.channel_id = ?", query.ChannelID)
+	}
+	if err := chain.Order("b.channel_id, b.pool, b.bot_user_name").Scan(&rows).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	res := make([]schemas.BotStatus, 0, len(rows))
+	for _, row := range rows {
+		role := BotRoleDefault
+		if row.Role != nil {
+			role = *row.Role
+		}
+		status := toBotStatus(&us.cnf.TG, &row.Bot)
+		status.Role = role
+		res = append(res, status)
+	}
+	return res, nil
+}
+
+func toBotStatus(cnf *config.TGConfig, bot *models.Bot) schemas.BotStatus {
+	limit := tgc.EffectiveRateLimit(cnf, bot.Rate, bot.RateBurst)
+	status := schemas.BotStatus{BotID: bot.BotID, BotUserName: bot.BotUserName, ChannelID: bot.ChannelID,
+		Pool: bot.Pool, RateLimit: schemas.RateLimit{Rate: limit.Rate, Burst: limit.Burst}, ValidatedAt: bot.ValidatedAt}
+	if bot.ValidatedAt != nil {
+		valid := bot.ValidationError == nil
+		status.Valid = &valid
+		if !valid {
+			status.ValidationError = *bot.ValidationError
+		}
+	}
+	return status
+}
+
+// ValidateBots checks that the user's bots, optionally only those of one
+// channel, are admins of their channel allowed to post and delete messages.
+// The outcome is stored with every bot and shows in its status.
+func (us *UserService) ValidateBots(c *gin.Context) ([]schemas.BotValidation, *types.AppError) {
+	userId, session := auth.GetUser(c)
+
+	var query schemas.BotQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+
+	var bots []models.Bot
+	chain := us.db.Where("user_id = ?", userId)
+	if query.ChannelID != 0 {
+		chain = chain.Where("channel_id = ?", query.ChannelID)
+	}
+	if err := chain.Order("channel_id, bot_user_name").Find(&bots).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	byChannel := map[int64][]models.Bot{}
+	for _, bot := range bots {
+		byChannel[bot.ChannelID] = append(byChannel[bot.ChannelID], bot)
+	}
+
+	problems := map[int64]map[int64]string{}
+
+	err := us.clients.Run(c, us.clients.UserSpec(session), func(ctx context.Context, client *telegram.Client) error {
+		for channelId, bots := range byChannel {
+			found := map[int64]string{}
+			problems[channelId] = found
+
+			channel, err := tgc.GetChannelById(ctx, client.API(), channelId)
+			if err != nil {
+				if tgerr.Is(err, "CHANNEL_INVALID", "CHANNEL_PRIVATE") {
+					for _, bot := range bots {
+						found[bot.BotID] = "channel is not accessible"
+					}
+					continue
+				}
+				return err
+			}
+
+			users := make([]tg.InputUser, 0, len(bots))
+			for _, bot := range bots {
+				resolved, err := peer.DefaultResolver(client.API()).ResolveDomain(ctx, bot.BotUserName)
+				if err != nil {
+					if tgerr.Is(err, "USERNAME_INVALID", "USERNAME_NOT_OCCUPIED") {
+						found[bot.BotID] = "bot username no longer exists"
+						continue
+					}
+					return err
+				}
+				if user, ok := resolved.(*tg.InputPeerUser); ok {
+					users = append(users, tg.InputUser{UserID: user.UserID, AccessHash: user.AccessHash})
+				}
+			}
+
+			checked, err := checkBotRights(ctx, client.API(), channel, users)
+			if err != nil {
+				return err
+			}
+			for botId, problem := range checked {
+				found[botId] = problem
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	res := make([]schemas.BotValidation, 0, len(bots))
+	for _, bot := range bots {
+		problem := problems[bot.ChannelID][bot.BotID]
+		res = append(res, schemas.BotValidation{BotID: bot.BotID, BotUserName: bot.BotUserName,
+			ChannelID: bot.ChannelID, Valid: problem == "", Error: problem})
+	}
+	for channelId, found := range problems {
+		if err := saveBotValidation(us.db, userId, channelId, byChannel[channelId], found); err != nil {
+			return nil, &types.AppError{Error: err}
+		}
+	}
+	us.cache.Delete(fmt.Sprintf("users:tgstatus:%d", userId))
+
+	return res, nil
+}
+
+// checkBotRights reports what keeps each bot from storing files in channel,
+// bots that may post and delete messages there are left out.
+func checkBotRights(ctx context.Context, api *tg.Client, channel *tg.InputChannel, bots []tg.InputUser) (map[int64]string, error) {
+	problems := map[int64]string{}
+	for _, bot := range bots {
+		res, err := api.ChannelsGetParticipant(ctx, &tg.ChannelsGetParticipantRequest{
+			Channel:     channel,
+			Participant: &tg.InputPeerUser{UserID: bot.UserID, AccessHash: bot.AccessHash},
+		})
+		if err != nil {
+			if tgerr.Is(err, "USER_NOT_PARTICIPANT", "PARTICIPANT_ID_INVALID") {
+				problems[bot.UserID] = "bot is not a member of the channel"
+				continue
+			}
+			return nil, err
+		}
+		if problem := botRightsProblem(res.Participant); problem != "" {
+			problems[bot.UserID] = problem
+		}
+	}
+	return problems, nil
+}
+
+// botRightsProblem tells what a channel participant lacks to upload and
+// delete files, empty when nothing.
+func botRightsProblem(participant tg.ChannelParticipantClass) string {
+	switch p := participant.(type) {
+	case *tg.ChannelParticipantCreator:
+		return ""
+	case *tg.ChannelParticipantAdmin:
+		var missing []string
+		if !p.AdminRights.PostMessages {
+			missing = append(missing, "post messages")
+		}
+		if !p.AdminRights.DeleteMessages {
+			missing = append(missing, "delete messages")
+		}
+		if len(missing) > 0 {
+			return "bot may not " + strings.Join(missing, " or ")
+		}
+		return ""
+	}
+	return "bot is not an admin of the channel"
+}
+
+// saveBotValidation stores the outcome of checking the bots of a channel.
+func saveBotValidation(db *gorm.DB, userId, channelId int64, bots []models.Bot, problems map[int64]string) error {
+	now := time.Now().UTC()
+	for _, bot := range bots {
+		var problem *string
+		if p, ok := problems[bot.BotID]; ok {
+			problem = &p
+		}
+		if err := db.Model(&models.Bot{}).Where("user_id = ? AND channel_id = ? AND bot_id = ?", userId, channelId, bot.BotID).
+			Updates(map[string]any{"validated_at": now, "validation_error": problem}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateBots checks the tokens with Telegram, makes the bots admins of the
+// channel and adds them to a pool. Bots already in the channel move to it.
+func (us *UserService) CreateBots(c *gin.Context) (*schemas.Message, *types.AppError) {
+	userId, session := auth.GetUser(c)
+
+	var payload schemas.BotsIn
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+
+	for _, bot := range payload.Bots {
+		if _, err := tgc.NewAppCredentials(bot.AppId, bot.AppHash); err != nil {
+			return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+		}
+	}
+
+	channelId, appErr := us.botChannel(userId, payload.ChannelID)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	pool := payload.Pool
+	if pool == "" {
+		pool = defaultBotPool
+	}
+
+	return us.addBots(c, session, userId, channelId, pool, payload.Bots)
+}
+
+// DeleteBot removes a bot from one channel or, without channelId, from all
+// channels of the user.
+func (us *UserService) DeleteBot(c *gin.Context) (*schemas.Message, *types.AppError) {
+	userId, _ := auth.GetUser(c)
+
+	botId, err := strconv.ParseInt(c.Param("botID"), 10, 64)
+	if err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+
+	var query schemas.BotQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+
+	var bots []models.Bot
+	chain := us.db.Clauses(clause.Returning{}).Where("user_id = ? AND bot_id = ?", userId, botId)
+	if query.ChannelID != 0 {
+		chain = chain.Where("channel_id = ?", query.ChannelID)
+	}
+	if err := chain.Delete(&bots).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	if len(bots) == 0 {
+		return nil, &types.AppError{Error: ErrBotNotFound, Code: http.StatusNotFound}
+	}
+
+	for _, bot := range bots {
+		clearBotsCache(us.cache, userId, bot.ChannelID)
+	}
+
+	var remaining int64
+	us.db.Model(&models.Bot{}).Where("user_id = ? AND token = ?", userId, bots[0].Token).Count(&remaining)
+	if remaining == 0 {
+		us.kv.Delete(tgc.BotSessionKey(userId, bots[0].Token))
+		us.clients.Evict(tgc.BotSessionKey(userId, bots[0].Token))
+	}
+
+	return &schemas.Message{Message: "bot deleted"}, nil
+}
+
+// ListBotPools returns the pools of the user's channels with their role and
+// size. Pools that only exist through their bots have the default role.
+func (us *UserService) ListBotPools(c *gin.Context) ([]schemas.BotPool, *types.AppError) {
+	userId, _ := auth.GetUser(c)
+
+	var res []schemas.BotPool
+	if err := us.db.Raw(`
+SELECT coalesce(p.channel_id, b.channel_id) AS channel_id, coalesce(p.name, b.pool) AS name,
+	coalesce(p.role, 'default') AS role, count(b.token) AS bots
+FROM (SELECT * FROM teldrive.bot_pools WHERE user_id = @user) p
+FULL JOIN (SELECT * FROM teldrive.bots WHERE user_id = @user) b
+	ON p.channel_id = b.channel_id AND p.name = b.pool
+GROUP BY 1, 2, 3 ORDER BY 1, 2`, map[string]any{"user": userId}).Scan(&res).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	if res == nil {
+		res = []schemas.BotPool{}
+	}
+	return res, nil
+}
+
+// UpdateBotPool sets the role of a pool.
+func (us *UserService) UpdateBotPool(c *gin.Context) (*schemas.BotPool, *types.AppError) {
+	userId, _ := auth.GetUser(c)
+
+	var payload schemas.BotPool
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+
+	channelId, appErr := us.botChannel(userId, payload.ChannelID)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	pool := models.BotPool{UserID: userId, ChannelID: channelId, Name: payload.Name, Role: payload.Role}
+	if err := us.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "channel_id"}, {Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"role"}),
+	}).Create(&pool).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	clearBotsCache(us.cache, userId, channelId)
+
+	var count int64
+	us.db.Model(&models.Bot{}).Where("user_id = ? AND channel_id = ? AND pool = ?", userId, channelId, payload.Name).
+		Count(&count)
+
+	return &schemas.BotPool{ChannelID: channelId, Name: pool.Name, Role: pool.Role, Bots: int(count)}, nil
+}
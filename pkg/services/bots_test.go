@@ -0,0 +1,38 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/pkg/models"
+)
+
+func TestBotRightsProblem(t *testing.T) {
+	assert.Empty(t, botRightsProblem(&tg.ChannelParticipantCreator{}))
+	assert.Empty(t, botRightsProblem(&tg.ChannelParticipantAdmin{
+		AdminRights: tg.ChatAdminRights{PostMessages: true, DeleteMessages: true}}))
+	assert.Equal(t, "bot may not delete messages", botRightsProblem(&tg.ChannelParticipantAdmin{
+		AdminRights: tg.ChatAdminRights{PostMessages: true}}))
+	assert.Equal(t, "bot may not post messages or delete messages",
+		botRightsProblem(&tg.ChannelParticipantAdmin{}))
+	assert.Equal(t, "bot is not an admin of the channel", botRightsProblem(&tg.ChannelParticipant{}))
+}
+
+func TestToBotStatusValidation(t *testing.T) {
+	cnf := &config.TGConfig{Rate: 100, RateBurst: 5}
+
+	status := toBotStatus(cnf, &models.Bot{BotID: 1})
+	assert.Nil(t, status.Valid)
+
+	now := time.Now()
+	status = toBotStatus(cnf, &models.Bot{BotID: 1, ValidatedAt: &now})
+	assert.True(t, *status.Valid)
+
+	problem := "bot is not an admin of the channel"
+	status = toBotStatus(cnf, &models.Bot{BotID: 1, ValidatedAt: &now, ValidationError: &problem})
+	assert.False(t, *status.Valid)
+	assert.Equal(t, problem, status.ValidationError)
+}
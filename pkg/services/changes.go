@@ -0,0 +1,96 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tgdrive/teldrive/pkg/mapper"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid change cursor")
+	ErrCursorExpired = errors.New("changes after the cursor were pruned, resync from a full listing")
+)
+
+func parseCursor(cursor string) (int64, error) {
+	seq, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, ErrInvalidCursor
+	}
+	return seq, nil
+}
+
+// latestSeq returns the cursor of the newest change of any user, so a cursor
+// handed out moves past changes of others too.
+func latestSeq(db *gorm.DB) (int64, error) {
+	var seq int64
+	err := db.Model(&models.ChangeLog{}).Select("coalesce(max(seq), 0)").Scan(&seq).Error
+	return seq, err
+}
+
+// ListChanges returns the user's changes after the query cursor in the order
+// they happened. Cursors older than the pruned part of the log are refused,
+// the changes the client missed are gone.
+func (fs *FileService) ListChanges(userId int64, query *schemas.ChangeQuery) (*schemas.ChangeList, *types.AppError) {
+	limit := query.Limit
+	if limit == 0 {
+		limit = 500
+	}
+
+	if query.Since == "" {
+		seq, err := latestSeq(fs.db)
+		if err != nil {
+			return nil, &types.AppError{Error: err}
+		}
+		return &schemas.ChangeList{Changes: []schemas.FileChange{}, Cursor: strconv.FormatInt(seq, 10)}, nil
+	}
+
+	since, err := parseCursor(query.Since)
+	if err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+
+	var oldest int64
+	if err := fs.db.Model(&models.ChangeLog{}).Select("coalesce(min(seq), 0)").Scan(&oldest).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	if since > 0 && oldest > since+1 {
+		return nil, &types.AppError{Error: ErrCursorExpired, Code: http.StatusGone}
+	}
+
+	// Read the cursor first, anything committed while the page is read is
+	// picked up by the next request.
+	latest, err := latestSeq(fs.db)
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	var rows []models.ChangeLog
+	if err := fs.db.Where("user_id = ?", userId).Where("seq > ?", since).Where("seq <= ?", latest).
+		Order("seq").Limit(limit + 1).Find(&rows).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	res := &schemas.ChangeList{Changes: []schemas.FileChange{}, Cursor: strconv.FormatInt(latest, 10)}
+	if len(rows) > limit {
+		rows = rows[:limit]
+		res.HasMore = true
+		res.Cursor = strconv.FormatInt(rows[len(rows)-1].Seq, 10)
+	}
+	for i := range rows {
+		res.Changes = append(res.Changes, mapper.ToFileChange(&rows[i]))
+	}
+	return res, nil
+}
+
+// PruneChangeLog drops changes older than retention.
+func PruneChangeLog(db *gorm.DB, retention time.Duration) (int64, error) {
+	res := db.Where("created_at < ?", time.Now().UTC().Add(-retention)).Delete(&models.ChangeLog{})
+	return res.RowsAffected, res.Error
+}
@@ -0,0 +1,18 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCursor(t *testing.T) {
+	seq, err := parseCursor("42")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), seq)
+
+	for _, cursor := range []string{"abc", "-1", "1.5"} {
+		_, err := parseCursor(cursor)
+		assert.ErrorIs(t, err, ErrInvalidCursor, cursor)
+	}
+}
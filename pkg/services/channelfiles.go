@@ -0,0 +1,65 @@
+package services
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/gorm"
+)
+
+// channelFilesScope matches the active files of the user stored in channelId,
+// and with replicas also those holding a replica of any part there.
+func channelFilesScope(userId, channelId int64, replicas bool) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		db = db.Where("user_id = ?", userId).Where("type = ?", "file").Where("status = ?", "active")
+		if !replicas {
+			return db.Where("channel_id = ?", channelId)
+		}
+		return db.Where("channel_id = ? OR parts @> ?::jsonb", channelId,
+			fmt.Sprintf(`[{"replicas": [{"channelId": %d}]}]`, channelId))
+	}
+}
+
+// ListChannelFiles lists the files whose parts live in a channel of the user
+// with their count and total size, to see what a channel holds before
+// rebalancing or removing it.
+func (fs *FileService) ListChannelFiles(userId, channelId int64, query *schemas.ChannelFileQuery) (*schemas.ChannelFiles, *types.AppError) {
+	if err := checkChannelAccess(fs.db, fs.cache, userId, channelId); err != nil {
+		return nil, channelAccessError(err)
+	}
+
+	limit := query.Limit
+	if limit == 0 {
+		limit = 500
+	}
+	page := max(query.Page, 1)
+
+	scope := channelFilesScope(userId, channelId, query.Replicas)
+
+	var totals struct {
+		Count int64
+		Size  int64
+	}
+	if err := fs.db.Model(&models.File{}).Scopes(scope).
+		Select("count(*) as count, coalesce(sum(size), 0) as size").Scan(&totals).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	files := []schemas.FileOut{}
+	if err := fs.db.Model(&models.File{}).Scopes(scope).Select("*", parentPathColumn).
+		Order("created_at, id").Offset((page - 1) * limit).Limit(limit).Scan(&files).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	return &schemas.ChannelFiles{
+		ChannelID: channelId,
+		Count:     totals.Count,
+		TotalSize: totals.Size,
+		Files:     files,
+		Meta: schemas.Meta{Count: int(totals.Count), TotalPages: int(math.Ceil(float64(totals.Count) / float64(limit))),
+			CurrentPage: page},
+	}, nil
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tgdrive/teldrive/pkg/httputil"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+)
+
+var ErrNoChecksum = errors.New("file has no checksum")
+
+// hashDigestLengths are the hex lengths of the whole-file hashes clients may
+// upload. Hashes are always taken over the plaintext a client uploads and
+// downloads, so encrypted files carry the same hash as their content.
+var hashDigestLengths = map[string]int{
+	"md5":    32,
+	"sha1":   40,
+	"sha256": 64,
+	"sha512": 128,
+}
+
+// digestNames map hash algorithms to their Digest header tokens.
+var digestNames = map[string]string{
+	"md5":    "md5",
+	"sha1":   "sha",
+	"sha256": "sha-256",
+	"sha512": "sha-512",
+}
+
+// hashAlgorithm returns the algorithm of a normalized hash: the declared one,
+// or else the one whose hex digest length matches. Unknown formats stay
+// unlabeled.
+func hashAlgorithm(hash *string, declared string) *string {
+	if hash == nil {
+		return nil
+	}
+	if declared != "" {
+		return &declared
+	}
+	if _, err := hex.DecodeString(*hash); err != nil {
+		return nil
+	}
+	for name, length := range hashDigestLengths {
+		if len(*hash) == length {
+			return &name
+		}
+	}
+	return nil
+}
+
+// fileDigest decodes the stored hash of file when it is a hex digest of its
+// labeled algorithm.
+func fileDigest(file *schemas.FileOut) []byte {
+	length, ok := hashDigestLengths[file.HashAlgorithm]
+	if !ok || len(file.Hash) != length {
+		return nil
+	}
+	digest, err := hex.DecodeString(file.Hash)
+	if err != nil {
+		return nil
+	}
+	return digest
+}
+
+// setDigestHeaders announces the whole-file hash. Digest and Repr-Digest
+// always describe the complete representation, also on range responses, while
+// Content-MD5 covers the body and is only sent when that is the whole file.
+func setDigestHeaders(header http.Header, file *schemas.FileOut, whole bool) {
+	digest := fileDigest(file)
+	if digest == nil {
+		return
+	}
+	encoded := base64.StdEncoding.EncodeToString(digest)
+	name := digestNames[file.HashAlgorithm]
+	header.Set("Digest", name+"="+encoded)
+	if file.HashAlgorithm == "sha256" || file.HashAlgorithm == "sha512" {
+		header.Set("Repr-Digest", fmt.Sprintf("%s=:%s:", name, encoded))
+	}
+	if file.HashAlgorithm == "md5" && whole {
+		header.Set("Content-MD5", encoded)
+	}
+}
+
+// GetFileChecksum serves the stored hash as a checksum sidecar in the format
+// of sha256sum and friends, named after the file and the algorithm.
+func (fs *FileService) GetFileChecksum(c *gin.Context) {
+	_, file, ok := fs.resolveStreamFile(c, nil)
+	if !ok {
+		return
+	}
+	if fileDigest(file.FileOut) == nil {
+		httputil.NewError(c, http.StatusNotFound, ErrNoChecksum)
+		return
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": file.Name + "." + file.HashAlgorithm}))
+	c.String(http.StatusOK, "%s  %s\n", file.Hash, file.Name)
+}
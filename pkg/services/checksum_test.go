@@ -0,0 +1,38 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+)
+
+func TestHashAlgorithm(t *testing.T) {
+	sha := normalizeHash("E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855")
+	assert.Equal(t, "sha256", *hashAlgorithm(sha, ""))
+	assert.Equal(t, "sha512", *hashAlgorithm(sha, "sha512"))
+	assert.Equal(t, "md5", *hashAlgorithm(normalizeHash("d41d8cd98f00b204e9800998ecf8427e"), ""))
+	assert.Nil(t, hashAlgorithm(normalizeHash("quickxor:AAAA"), ""))
+	assert.Nil(t, hashAlgorithm(nil, "sha256"))
+}
+
+func TestSetDigestHeaders(t *testing.T) {
+	file := &schemas.FileOut{Hash: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", HashAlgorithm: "sha256"}
+	header := http.Header{}
+	setDigestHeaders(header, file, false)
+	assert.Equal(t, "sha-256=47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", header.Get("Digest"))
+	assert.Equal(t, "sha-256=:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=:", header.Get("Repr-Digest"))
+
+	file = &schemas.FileOut{Hash: "d41d8cd98f00b204e9800998ecf8427e", HashAlgorithm: "md5"}
+	header = http.Header{}
+	setDigestHeaders(header, file, false)
+	assert.Empty(t, header.Get("Content-MD5"))
+	assert.Empty(t, header.Get("Repr-Digest"))
+	setDigestHeaders(header, file, true)
+	assert.Equal(t, "1B2M2Y8AsgTpgAmY7PhCfg==", header.Get("Content-MD5"))
+
+	header = http.Header{}
+	setDigestHeaders(header, &schemas.FileOut{Hash: "abc", HashAlgorithm: "sha256"}, true)
+	assert.Empty(t, header)
+}
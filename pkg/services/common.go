@@ -2,22 +2,33 @@ package services
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
-	"github.com/gotd/td/telegram"
 	"github.com/gotd/td/tg"
 	"github.com/pkg/errors"
 	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/config"
 	"github.com/tgdrive/teldrive/internal/crypt"
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/internal/policy"
 	"github.com/tgdrive/teldrive/internal/tgc"
 	"github.com/tgdrive/teldrive/pkg/models"
 	"github.com/tgdrive/teldrive/pkg/schemas"
 	"github.com/tgdrive/teldrive/pkg/types"
+	"golang.org/x/sync/singleflight"
+	"gorm.io/datatypes"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-func getParts(ctx context.Context, client *telegram.Client, cache cache.Cacher, file *schemas.FileOutFull) ([]types.Part, error) {
+func getParts(ctx context.Context, client *tg.Client, cache cache.Cacher, file *schemas.FileOutFull) ([]types.Part, error) {
 
 	parts := []types.Part{}
 
@@ -33,21 +44,36 @@ func getParts(ctx context.Context, client *telegram.Client, cache cache.Cacher,
 	for _, part := range file.Parts {
 		ids = append(ids, int(part.ID))
 	}
-	messages, err := tgc.GetMessages(ctx, client.API(), ids, *file.ChannelID)
+	messages, err := tgc.GetMessages(ctx, client, ids, *file.ChannelID)
 
-	if err != nil {
+	if err != nil && len(schemas.ReplicaMessages(file.Parts)) == 0 {
 		return nil, err
 	}
 
-	for i, message := range messages {
-		item := message.(*tg.Message)
-		media := item.Media.(*tg.MessageMediaDocument)
-		document := media.Document.(*tg.Document)
+	for i, filePart := range file.Parts {
+		var document *tg.Document
+		if err == nil && i < len(messages) {
+			document, _ = messageDocument(messages[i])
+		}
+		if document == nil {
+			// The primary message is gone, the replicas carry the same document.
+			document = replicaDocument(ctx, client, filePart.Replicas)
+		}
+		if document == nil {
+			if err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("part %d of %s is unavailable", filePart.ID, file.Id)
+		}
 
 		part := types.Part{
-			ID:   file.Parts[i].ID,
-			Size: document.Size,
-			Salt: file.Parts[i].Salt,
+			ID:           filePart.ID,
+			Size:         document.Size,
+			Salt:         filePart.Salt,
+			Compression:  filePart.Compression,
+			OriginalSize: filePart.OriginalSize,
+			Replicas:     filePart.Replicas,
+			KeyVersion:   filePart.KeyVersion,
 		}
 		if file.Encrypted {
 			part.DecryptedSize, _ = crypt.DecryptedSize(document.Size)
@@ -58,31 +84,389 @@ func getParts(ctx context.Context, client *telegram.Client, cache cache.Cacher,
 	return parts, nil
 }
 
+// getRateLimit returns the rate limit for a bot token, or for the user's own
+// session when token is empty.
+func getRateLimit(db *gorm.DB, cache cache.Cacher, cnf *config.TGConfig, userId int64, token string) tgc.RateLimit {
+	var (
+		limit tgc.RateLimit
+		key   string
+		row   struct {
+			Rate      *int
+			RateBurst *int
+		}
+	)
+
+	if token == "" {
+		key = fmt.Sprintf("users:ratelimit:%d", userId)
+	} else {
+		key = fmt.Sprintf("bots:ratelimit:%d:%s", userId, strings.Split(token, ":")[0])
+	}
+
+	if err := cache.Get(key, &limit); err == nil {
+		return limit
+	}
+
+	if token == "" {
+		db.Model(&models.User{}).Select("rate", "rate_burst").Where("user_id = ?", userId).Scan(&row)
+	} else {
+		db.Model(&models.Bot{}).Select("rate", "rate_burst").Where("user_id = ? AND token = ?", userId, token).Scan(&row)
+	}
+
+	limit = tgc.EffectiveRateLimit(cnf, row.Rate, row.RateBurst)
+	cache.Set(key, &limit, 0)
+	return limit
+}
+
+// getCaller returns how the request scheduler weighs the requests of a user,
+// premium users get the configured larger share of an account.
+func getCaller(db *gorm.DB, cache cache.Cacher, cnf *config.TGConfig, userId int64) tgc.Caller {
+	caller := tgc.Caller{UserId: userId, Weight: 1}
+	if isPremium(db, cache, userId) {
+		caller.Weight = cnf.Scheduler.PremiumWeight
+	}
+	return caller
+}
+
+// isPremium reports whether the user's Telegram account was premium when they
+// last logged in.
+func isPremium(db *gorm.DB, cache cache.Cacher, userId int64) bool {
+	var premium bool
+
+	key := fmt.Sprintf("users:premium:%d", userId)
+
+	if err := cache.Get(key, &premium); err != nil {
+		db.Model(&models.User{}).Select("is_premium").Where("user_id = ?", userId).Scan(&premium)
+		cache.Set(key, premium, 60*time.Minute)
+	}
+	return premium
+}
+
+// getFileTypePolicy returns the file type policy an admin assigned to the user,
+// falling back to the configured one.
+func getFileTypePolicy(db *gorm.DB, cache cache.Cacher, cnf *config.TGConfig, userId int64) policy.FileTypes {
+	var (
+		p   policy.FileTypes
+		row struct {
+			FileTypes datatypes.JSON
+		}
+	)
+
+	key := fmt.Sprintf("users:filetypes:%d", userId)
+
+	if err := cache.Get(key, &p); err == nil {
+		return p
+	}
+
+	db.Model(&models.User{}).Select("file_types").Where("user_id = ?", userId).Scan(&row)
+
+	if len(row.FileTypes) == 0 || json.Unmarshal(row.FileTypes, &p) != nil {
+		p = policy.FileTypes(cnf.Uploads.FileTypes)
+	}
+	cache.Set(key, &p, 0)
+	return p
+}
+
+// checkFileType rejects names and mime types the user's file type policy
+// does not allow. The returned error is a *policy.Violation.
+func checkFileType(db *gorm.DB, cache cache.Cacher, cnf *config.TGConfig, userId int64, name string, mimeTypes ...string) error {
+	if v := getFileTypePolicy(db, cache, cnf, userId).Check(name, mimeTypes...); v != nil {
+		return v
+	}
+	return nil
+}
+
+var (
+	ErrDefaultChannelNotSet = errors.New("default channel not set")
+	ErrEncryptionKeyMissing = errors.New("encryption key not found")
+	ErrEncryptionMode       = errors.New("encryption mode conflicts with encrypted")
+	ErrEncryptionRule       = errors.New("requested encryption conflicts with an encryption rule")
+	ErrUploadConflict       = errors.New("file settings conflict with its uploaded parts")
+)
+
+// Encryption modes of a file. Client encrypted files hold ciphertext the
+// server has no key for and serves as it is.
+const (
+	EncryptionNone   = "none"
+	EncryptionServer = "server"
+	EncryptionClient = "client"
+)
+
+// channelGroup collapses concurrent lookups of the same default channel or
+// channel access hash into a single query.
+var channelGroup singleflight.Group
+
 func getDefaultChannel(db *gorm.DB, cache cache.Cacher, userID int64) (int64, error) {
 
 	var channelId int64
 	key := fmt.Sprintf("users:channel:%d", userID)
 
-	err := cache.Get(key, &channelId)
-
-	if err == nil {
+	if err := cache.Get(key, &channelId); err == nil && channelId != 0 {
 		return channelId, nil
 	}
 
-	var channelIds []int64
-	db.Model(&models.Channel{}).Where("user_id = ?", userID).Where("selected = ?", true).
-		Pluck("channel_id", &channelIds)
+	res, err, _ := channelGroup.Do(key, func() (any, error) {
+		var channelIds []int64
+		if err := db.Model(&models.Channel{}).Where("user_id = ?", userID).Where("selected = ?", true).
+			Pluck("channel_id", &channelIds).Error; err != nil {
+			return int64(0), err
+		}
+		// A user who has not picked a channel yet has no default; nothing is
+		// cached so the channel is found as soon as it is selected.
+		if len(channelIds) != 1 {
+			return int64(0), ErrDefaultChannelNotSet
+		}
+		cache.Set(key, channelIds[0], 0)
+		return channelIds[0], nil
+	})
 
-	if len(channelIds) == 1 {
-		channelId = channelIds[0]
-		cache.Set(key, channelId, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.(int64), nil
+}
+
+func inputChannelKey(userId int64, account string, channelId int64) string {
+	return fmt.Sprintf("channels:input:%d:%s:%d", userId, account, channelId)
+}
+
+// getInputChannel returns the input peer of channelId as seen by account, the
+// user or bot the client is logged in as. Access hashes differ between
+// accounts, so they are cached per account and resolve is only called on a
+// miss, once for all concurrent callers.
+func getInputChannel(ctx context.Context, cache cache.Cacher, userId int64, account string, channelId int64,
+	resolve func(ctx context.Context) (*tg.InputChannel, error)) (*tg.InputChannel, error) {
+
+	key := inputChannelKey(userId, account, channelId)
+
+	var channel tg.InputChannel
+	if err := cache.Get(key, &channel); err == nil && channel.ChannelID == channelId {
+		return &channel, nil
+	}
+
+	res, err, _ := channelGroup.Do(key, func() (any, error) {
+		channel, err := resolve(ctx)
+		if err != nil {
+			return nil, err
+		}
+		cache.Set(key, channel, tgc.ChannelCacheTTL)
+		return channel, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return res.(*tg.InputChannel), nil
+}
+
+// invalidateInputChannel drops the cached access hash when Telegram rejected
+// the channel, so the next request resolves it again.
+func invalidateInputChannel(cache cache.Cacher, userId int64, account string, channelId int64, err error) {
+	if tgc.InvalidChannel(err) {
+		cache.Delete(inputChannelKey(userId, account, channelId))
+	}
+}
+
+type folderDefaults struct {
+	ChannelID       *int64
+	Encrypted       *bool
+	ReplicaChannels datatypes.JSONSlice[int64]
+}
+
+// getFolderDefaults returns the nearest channel, encryption and replica
+// defaults set on the folder or any of its ancestors. The values are resolved
+// independently.
+func getFolderDefaults(db *gorm.DB, userId int64, folderId string) (*folderDefaults, error) {
+	var defaults folderDefaults
+	if err := db.Raw(`WITH RECURSIVE up AS (
+		SELECT id, parent_id, default_channel_id, default_encrypted, default_replica_channels, 0 AS depth
+		FROM teldrive.files WHERE id = ? AND user_id = ?
+		UNION ALL
+		SELECT f.id, f.parent_id, f.default_channel_id, f.default_encrypted, f.default_replica_channels, up.depth + 1
+		FROM teldrive.files f JOIN up ON f.id = up.parent_id
+	) SELECT
+		(SELECT default_channel_id FROM up WHERE default_channel_id IS NOT NULL ORDER BY depth LIMIT 1) AS channel_id,
+		(SELECT default_encrypted FROM up WHERE default_encrypted IS NOT NULL ORDER BY depth LIMIT 1) AS encrypted,
+		(SELECT default_replica_channels FROM up WHERE default_replica_channels IS NOT NULL ORDER BY depth LIMIT 1) AS replica_channels`,
+		folderId, userId).Scan(&defaults).Error; err != nil {
+		return nil, err
+	}
+	return &defaults, nil
+}
+
+// resolveUploadSettings fills in the channel and encryption the client left
+// unspecified, first from the defaults of the target folder and its ancestors
+// and then from the user's settings and default channel. The folder is given either by id
+// or by path; an unknown path simply has no defaults. place, when set, picks
+// the channel instead of the default one.
+func resolveUploadSettings(db *gorm.DB, cache cache.Cacher, userId int64, folderId, path string,
+	channelId int64, encrypted *bool, place func() (int64, error)) (int64, bool, error) {
+
+	if channelId == 0 || encrypted == nil {
+		if folderId == "" && path != "" {
+			var ids []string
+			if err := db.Raw("select id from teldrive.get_file_from_path(?, ?, ?)", path, userId, false).
+				Pluck("id", &ids).Error; err != nil {
+				return 0, false, err
+			}
+			if len(ids) > 0 {
+				folderId = ids[0]
+			}
+		}
+		if folderId != "" {
+			defaults, err := getFolderDefaults(db, userId, folderId)
+			if err != nil {
+				return 0, false, err
+			}
+			if channelId == 0 && defaults.ChannelID != nil {
+				channelId = *defaults.ChannelID
+			}
+			if encrypted == nil {
+				encrypted = defaults.Encrypted
+			}
+		}
+	}
+
+	if encrypted == nil {
+		encrypted = getUserSettings(db, cache, userId).DefaultEncrypted
 	}
 
 	if channelId == 0 {
-		return channelId, errors.New("default channel not set")
+		if place == nil {
+			place = func() (int64, error) { return getDefaultChannel(db, cache, userId) }
+		}
+		var err error
+		if channelId, err = place(); err != nil {
+			return 0, false, err
+		}
+	} else if err := checkChannelAccess(db, cache, userId, channelId); err != nil {
+		return 0, false, err
+	}
+
+	return channelId, encrypted != nil && *encrypted, nil
+}
+
+// checkChannelAccess verifies that channelId is one of the channels the user
+// added to their account, before a request reads from or writes to it.
+// Granted access is cached for a minute, refusals are not so a channel can be
+// used as soon as it is added.
+func checkChannelAccess(db *gorm.DB, cache cache.Cacher, userId, channelId int64) error {
+	key := fmt.Sprintf("users:channel-access:%d:%d", userId, channelId)
+
+	var allowed bool
+	if err := cache.Get(key, &allowed); err == nil && allowed {
+		return nil
 	}
 
-	return channelId, nil
+	var count int64
+	if err := db.Model(&models.Channel{}).Where("channel_id = ?", channelId).
+		Where("user_id = ?", userId).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrChannelForbidden
+	}
+	cache.Set(key, true, time.Minute)
+	return nil
+}
+
+func channelAccessError(err error) *types.AppError {
+	if errors.Is(err, ErrChannelForbidden) {
+		return &types.AppError{Error: err, Code: http.StatusForbidden}
+	}
+	return &types.AppError{Error: err}
+}
+
+// detectMimeType settles the mime type stored for a file from the declared
+// type, the configured extension table and, when enabled, the sniffed content.
+func detectMimeType(cnf *config.TGConfig, declared, name, sniffed string) string {
+	var types policy.MimeTypes
+	if cnf != nil {
+		types, _ = policy.ParseMimeTypes(cnf.Uploads.MimeTypes)
+		if !cnf.Uploads.MimeSniff {
+			sniffed = ""
+		}
+	}
+	return types.Detect(declared, name, sniffed)
+}
+
+// uploadMimeType returns the type sniffed from the first part of an upload.
+func uploadMimeType(db *gorm.DB, userId int64, uploadId string) (string, error) {
+	var types []*string
+	if err := db.Model(&models.Upload{}).Where("upload_id = ?", uploadId).Where("user_id = ?", userId).
+		Where("part_no = ?", 1).Pluck("mime_type", &types).Error; err != nil {
+		return "", err
+	}
+	if len(types) == 0 || types[0] == nil {
+		return "", nil
+	}
+	return *types[0], nil
+}
+
+// applyEncryptionPolicy lets the configured encryption rules override the
+// default encryption of a file and returns the rule that decided it. An
+// explicit request the matching rule disagrees with is refused rather than
+// overridden. The folder path is only looked up when a path rule needs it.
+func applyEncryptionPolicy(db *gorm.DB, cnf *config.TGConfig, name, mimeType, folderId, folderPath string,
+	encrypted, explicit bool) (bool, string, error) {
+
+	rules, err := policy.ParseEncryption(cnf.Uploads.EncryptionRules)
+	if err != nil {
+		return false, "", err
+	}
+
+	var matched string
+
+	if len(rules) > 0 {
+		if mimeType == "" {
+			mimeType = mime.TypeByExtension(filepath.Ext(name))
+		}
+		if folderPath == "" && folderId != "" && rules.HasPathRules() {
+			if err := db.Raw("select teldrive.get_path_from_file_id(?)", folderId).Scan(&folderPath).Error; err != nil {
+				return false, "", err
+			}
+		}
+		if rule, ok := rules.Match(name, mimeType, folderPath); ok {
+			matched = rule.String()
+			if explicit && encrypted != (rule.Action == policy.Encrypt) {
+				return false, matched, fmt.Errorf("%w: %s", ErrEncryptionRule, matched)
+			}
+			encrypted = rule.Action == policy.Encrypt
+		}
+	}
+
+	if encrypted && cnf.Uploads.EncryptionKey == "" {
+		if matched != "" {
+			return false, matched, fmt.Errorf("%w: rule %s requires encryption", ErrEncryptionKeyMissing, matched)
+		}
+		return false, "", ErrEncryptionKeyMissing
+	}
+
+	return encrypted, matched, nil
+}
+
+// encryptionMode folds the encryption mode of a request into its encrypted
+// flag and reports whether the client encrypted the content itself.
+func encryptionMode(mode string, encrypted *bool) (*bool, bool, error) {
+	if mode == "" {
+		return encrypted, false, nil
+	}
+	server := mode == EncryptionServer
+	if encrypted != nil && *encrypted != server {
+		return nil, false, ErrEncryptionMode
+	}
+	return &server, mode == EncryptionClient, nil
+}
+
+func encryptionOf(encrypted, client bool) string {
+	switch {
+	case client:
+		return EncryptionClient
+	case encrypted:
+		return EncryptionServer
+	}
+	return EncryptionNone
 }
 
 func getBotsToken(db *gorm.DB, cache cache.Cacher, userID, channelId int64) ([]string, error) {
@@ -105,3 +489,177 @@ func getBotsToken(db *gorm.DB, cache cache.Cacher, userID, channelId int64) ([]s
 	return bots, nil
 
 }
+
+// resolveNameConflict applies the conflict policy to file before it is inserted
+// and returns the ids of the files it replaced.
+// The parent row is locked so concurrent creates in the same folder are serialized.
+func resolveNameConflict(tx *gorm.DB, file *models.File, policy string) ([]string, error) {
+
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").
+		Where("id = ?", file.ParentID.String).Find(&models.File{}).Error; err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	base, ext := splitFileName(file.Name)
+
+	if err := tx.Model(&models.File{}).Where("parent_id = ?", file.ParentID.String).
+		Where("user_id = ?", file.UserID).Where("type = ?", file.Type).Where("status = ?", "active").
+		Where("name = ? OR name LIKE ?", file.Name, escapeLike(base)+" (%)"+escapeLike(ext)).
+		Pluck("name", &names).Error; err != nil {
+		return nil, err
+	}
+
+	if !slices.Contains(names, file.Name) {
+		return nil, nil
+	}
+
+	switch policy {
+	case ConflictError:
+		return nil, database.ErrKeyConflict
+	case ConflictRename:
+		taken := make(map[string]bool, len(names))
+		for _, name := range names {
+			taken[name] = true
+		}
+		for i := 1; ; i++ {
+			name := fmt.Sprintf("%s (%d)%s", base, i, ext)
+			if !taken[name] {
+				file.Name = name
+				return nil, nil
+			}
+		}
+	case ConflictReplace:
+		var replaced []string
+		if err := tx.Model(&models.File{}).Where("parent_id = ?", file.ParentID.String).
+			Where("user_id = ?", file.UserID).Where("type = ?", "file").Where("status = ?", "active").
+			Where("name = ?", file.Name).Pluck("id", &replaced).Error; err != nil {
+			return nil, err
+		}
+		return replaced, tx.Model(&models.File{}).Where("id IN ?", replaced).
+			Update("status", "pending_deletion").Error
+	}
+	return nil, nil
+}
+
+// checkVersions locks the given files and fails with ErrStaleVersion when any
+// of them no longer has the version the client expects.
+func checkVersions(tx *gorm.DB, userId int64, versions map[string]int64) error {
+	if len(versions) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(versions))
+	for id := range versions {
+		ids = append(ids, id)
+	}
+	var files []models.File
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "version").
+		Where("id IN ? AND user_id = ?", ids, userId).Find(&files).Error; err != nil {
+		return err
+	}
+	if len(files) != len(ids) {
+		return database.ErrNotFound
+	}
+	for _, file := range files {
+		if file.Version != versions[file.Id] {
+			return database.ErrStaleVersion
+		}
+	}
+	return nil
+}
+
+// LimitError reports an upload that exceeds one of the configured limits. The
+// limits are sent back to the client so it can adjust and retry.
+type LimitError struct {
+	msg    string
+	limits schemas.UploadLimits
+}
+
+func (e *LimitError) Error() string {
+	return e.msg
+}
+
+func (e *LimitError) Details() any {
+	return e.limits
+}
+
+func uploadLimits(cnf *config.TGConfig) schemas.UploadLimits {
+	return schemas.UploadLimits{
+		MaxPartSize: cnf.Uploads.MaxPartSize,
+		MaxFileSize: cnf.Uploads.MaxFileSize,
+		MaxParts:    cnf.Uploads.MaxParts,
+	}
+}
+
+// Largest document Telegram accepts from an account, 4000 parts of 512 KiB
+// or 8000 for premium accounts. Bots are never premium.
+const (
+	TelegramPartLimit        int64 = 4000 * 512 * 1024
+	TelegramPremiumPartLimit int64 = 8000 * 512 * 1024
+)
+
+func telegramPartLimit(premium bool) int64 {
+	if premium {
+		return TelegramPremiumPartLimit
+	}
+	return TelegramPartLimit
+}
+
+// effectiveUploadLimits are the configured limits narrowed to what Telegram
+// accepts from the uploading account.
+func effectiveUploadLimits(cnf *config.TGConfig, premium bool) schemas.UploadLimits {
+	limits := uploadLimits(cnf)
+	limits.PartLimit = telegramPartLimit(premium)
+	limits.Premium = premium
+	if limits.MaxPartSize == 0 || limits.MaxPartSize > limits.PartLimit {
+		limits.MaxPartSize = limits.PartLimit
+	}
+	return limits
+}
+
+// checkTelegramPartSize validates the size a part takes in Telegram, after
+// server side encryption, against the tier of the uploading account.
+func checkTelegramPartSize(cnf *config.TGConfig, size int64, encrypted, premium bool) error {
+	if encrypted {
+		size = crypt.EncryptedSize(size)
+	}
+	limits := effectiveUploadLimits(cnf, premium)
+	if size <= limits.PartLimit {
+		return nil
+	}
+	msg := fmt.Sprintf("part size exceeds Telegram limit of %d bytes", limits.PartLimit)
+	if !premium {
+		msg += " for non-premium accounts"
+	}
+	return &LimitError{msg: msg, limits: limits}
+}
+
+// checkUploadLimits validates a part size, total size and part count against
+// the configured limits. Zero values are not checked. The part size is what
+// is sent to Telegram, the total size is the logical size of the file as it
+// is stored and listed.
+func checkUploadLimits(cnf *config.TGConfig, partSize, fileSize int64, parts int) error {
+	limits := uploadLimits(cnf)
+	switch {
+	case limits.MaxPartSize > 0 && partSize > limits.MaxPartSize:
+		return &LimitError{msg: fmt.Sprintf("part size exceeds limit of %d bytes", limits.MaxPartSize), limits: limits}
+	case limits.MaxFileSize > 0 && fileSize > limits.MaxFileSize:
+		return &LimitError{msg: fmt.Sprintf("file size exceeds limit of %d bytes", limits.MaxFileSize), limits: limits}
+	case limits.MaxParts > 0 && parts > limits.MaxParts:
+		return &LimitError{msg: fmt.Sprintf("part count exceeds limit of %d", limits.MaxParts), limits: limits}
+	}
+	return nil
+}
+
+func splitFileName(name string) (string, string) {
+	ext := filepath.Ext(name)
+	if ext == name {
+		return name, ""
+	}
+	return strings.TrimSuffix(name, ext), ext
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
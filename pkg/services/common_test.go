@@ -0,0 +1,264 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+)
+
+func TestCheckUploadLimits(t *testing.T) {
+	cnf := &config.TGConfig{}
+	cnf.Uploads.MaxPartSize = 100
+	cnf.Uploads.MaxFileSize = 1000
+	cnf.Uploads.MaxParts = 10
+
+	assert.NoError(t, checkUploadLimits(cnf, 100, 1000, 10))
+
+	for _, err := range []error{
+		checkUploadLimits(cnf, 101, 0, 0),
+		checkUploadLimits(cnf, 0, 1001, 0),
+		checkUploadLimits(cnf, 0, 0, 11),
+	} {
+		var limitErr *LimitError
+		assert.True(t, errors.As(err, &limitErr))
+		assert.Equal(t, uploadLimits(cnf), limitErr.Details())
+	}
+
+	cnf.Uploads.MaxFileSize = 0
+	assert.NoError(t, checkUploadLimits(cnf, 0, 1<<40, 0))
+}
+
+func TestTelegramPartSize(t *testing.T) {
+	cnf := &config.TGConfig{}
+
+	assert.NoError(t, checkTelegramPartSize(cnf, TelegramPartLimit, false, false))
+	var limitErr *LimitError
+	assert.ErrorAs(t, checkTelegramPartSize(cnf, TelegramPartLimit, true, false), &limitErr)
+	assert.Equal(t, TelegramPartLimit, limitErr.limits.PartLimit)
+	assert.NoError(t, checkTelegramPartSize(cnf, TelegramPartLimit+1, false, true))
+	assert.Error(t, checkTelegramPartSize(cnf, TelegramPremiumPartLimit+1, false, true))
+
+	assert.Equal(t, TelegramPartLimit, effectiveUploadLimits(cnf, false).MaxPartSize)
+	cnf.Uploads.MaxPartSize = 100
+	assert.Equal(t, int64(100), effectiveUploadLimits(cnf, true).MaxPartSize)
+
+	assert.Equal(t, int64(100), multipartPartSize(cnf, 0, true))
+	cnf.Uploads.MaxPartSize = 0
+	assert.Equal(t, int64(defaultMultipartPartSize), multipartPartSize(cnf, 0, false))
+	assert.Equal(t, int64(defaultPremiumMultipartPartSize), multipartPartSize(cnf, 0, true))
+	assert.Equal(t, int64(5<<20), multipartPartSize(cnf, 5<<20, true))
+}
+
+func TestGetInputChannelConcurrent(t *testing.T) {
+	c := cache.NewMemoryCache(1024 * 1024)
+
+	var calls atomic.Int32
+	resolve := func(ctx context.Context) (*tg.InputChannel, error) {
+		calls.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		return &tg.InputChannel{ChannelID: 100, AccessHash: 42}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			channel, err := getInputChannel(context.Background(), c, 1, "bot", 100, resolve)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(42), channel.AccessHash)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls.Load())
+
+	channel, err := getInputChannel(context.Background(), c, 1, "bot", 100, resolve)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), channel.AccessHash)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestGetInputChannelPerAccount(t *testing.T) {
+	c := cache.NewMemoryCache(1024 * 1024)
+
+	for account, hash := range map[string]int64{"user": 1, "bot": 2} {
+		channel, err := getInputChannel(context.Background(), c, 1, account, 100,
+			func(ctx context.Context) (*tg.InputChannel, error) {
+				return &tg.InputChannel{ChannelID: 100, AccessHash: hash}, nil
+			})
+		assert.NoError(t, err)
+		assert.Equal(t, hash, channel.AccessHash)
+	}
+
+	channel, err := getInputChannel(context.Background(), c, 1, "user", 100, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), channel.AccessHash)
+}
+
+func TestInvalidateInputChannel(t *testing.T) {
+	c := cache.NewMemoryCache(1024 * 1024)
+
+	hash := int64(1)
+	resolve := func(ctx context.Context) (*tg.InputChannel, error) {
+		return &tg.InputChannel{ChannelID: 100, AccessHash: hash}, nil
+	}
+
+	_, err := getInputChannel(context.Background(), c, 1, "bot", 100, resolve)
+	assert.NoError(t, err)
+
+	hash = 2
+	invalidateInputChannel(c, 1, "bot", 100, errors.New("network error"))
+	channel, _ := getInputChannel(context.Background(), c, 1, "bot", 100, resolve)
+	assert.Equal(t, int64(1), channel.AccessHash)
+
+	invalidateInputChannel(c, 1, "bot", 100, tgerr.New(400, "CHANNEL_INVALID"))
+	channel, _ = getInputChannel(context.Background(), c, 1, "bot", 100, resolve)
+	assert.Equal(t, int64(2), channel.AccessHash)
+}
+
+func TestGetInputChannelError(t *testing.T) {
+	c := cache.NewMemoryCache(1024 * 1024)
+
+	_, err := getInputChannel(context.Background(), c, 1, "bot", 100,
+		func(ctx context.Context) (*tg.InputChannel, error) {
+			return nil, tgerr.New(400, "CHANNEL_INVALID")
+		})
+	assert.True(t, tgerr.Is(err, "CHANNEL_INVALID"))
+
+	channel, err := getInputChannel(context.Background(), c, 1, "bot", 100,
+		func(ctx context.Context) (*tg.InputChannel, error) {
+			return &tg.InputChannel{ChannelID: 100, AccessHash: 7}, nil
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), channel.AccessHash)
+}
+
+func TestETagMatches(t *testing.T) {
+	etag := FileETag("a", 1)
+	assert.NotEqual(t, etag, FileETag("a", 2))
+	assert.True(t, ETagMatches(etag, etag))
+	assert.True(t, ETagMatches(`"other", `+etag, etag))
+	assert.True(t, ETagMatches("W/"+etag, etag))
+	assert.True(t, ETagMatches("*", etag))
+	assert.False(t, ETagMatches(FileETag("a", 2), etag))
+}
+
+func TestAncestorsETag(t *testing.T) {
+	chain := []schemas.Ancestor{{Id: "r", Name: "/"}, {Id: "d", Name: "docs"}}
+	etag := AncestorsETag("a", 1, chain)
+	assert.True(t, strings.HasPrefix(etag, "W/"))
+	assert.True(t, ETagMatches(etag, etag))
+	assert.NotEqual(t, etag, AncestorsETag("a", 1, []schemas.Ancestor{{Id: "r", Name: "/"}, {Id: "d", Name: "papers"}}))
+	assert.False(t, ETagMatches(FileETag("a", 1), etag))
+}
+
+func TestApplyEncryptionPolicy(t *testing.T) {
+	cnf := &config.TGConfig{}
+	cnf.Uploads.EncryptionRules = []string{"*.kdbx=encrypt", "mime:video/*=plain", "path:/Private/**=encrypt"}
+
+	_, rule, err := applyEncryptionPolicy(nil, cnf, "vault.kdbx", "", "", "/", false, false)
+	assert.ErrorIs(t, err, ErrEncryptionKeyMissing)
+	assert.Equal(t, "name:*.kdbx=encrypt", rule)
+
+	cnf.Uploads.EncryptionKey = "secret"
+
+	encrypted, rule, err := applyEncryptionPolicy(nil, cnf, "vault.kdbx", "", "", "/", false, false)
+	assert.NoError(t, err)
+	assert.True(t, encrypted)
+	assert.Equal(t, "name:*.kdbx=encrypt", rule)
+
+	encrypted, _, err = applyEncryptionPolicy(nil, cnf, "movie.mp4", "", "", "/Private", true, false)
+	assert.NoError(t, err)
+	assert.False(t, encrypted)
+
+	encrypted, rule, err = applyEncryptionPolicy(nil, cnf, "notes.txt", "", "", "/Private/2024", false, false)
+	assert.NoError(t, err)
+	assert.True(t, encrypted)
+	assert.Equal(t, "path:/Private/**=encrypt", rule)
+
+	encrypted, rule, err = applyEncryptionPolicy(nil, cnf, "notes.txt", "", "", "/Public", true, false)
+	assert.NoError(t, err)
+	assert.True(t, encrypted)
+	assert.Empty(t, rule)
+
+	_, rule, err = applyEncryptionPolicy(nil, cnf, "movie.mp4", "", "", "/", true, true)
+	assert.ErrorIs(t, err, ErrEncryptionRule)
+	assert.Equal(t, "mime:video/*=plain", rule)
+
+	encrypted, _, err = applyEncryptionPolicy(nil, cnf, "vault.kdbx", "", "", "/", true, true)
+	assert.NoError(t, err)
+	assert.True(t, encrypted)
+}
+
+func TestEncryptionMode(t *testing.T) {
+	yes, no := true, false
+
+	encrypted, client, err := encryptionMode("", &yes)
+	assert.NoError(t, err)
+	assert.Equal(t, &yes, encrypted)
+	assert.False(t, client)
+
+	encrypted, client, err = encryptionMode(EncryptionClient, nil)
+	assert.NoError(t, err)
+	assert.False(t, *encrypted)
+	assert.True(t, client)
+	assert.Equal(t, EncryptionClient, encryptionOf(*encrypted, client))
+
+	encrypted, _, err = encryptionMode(EncryptionServer, &yes)
+	assert.NoError(t, err)
+	assert.True(t, *encrypted)
+
+	_, _, err = encryptionMode(EncryptionClient, &yes)
+	assert.ErrorIs(t, err, ErrEncryptionMode)
+	_, _, err = encryptionMode(EncryptionServer, &no)
+	assert.ErrorIs(t, err, ErrEncryptionMode)
+
+	assert.Equal(t, EncryptionServer, encryptionOf(true, false))
+	assert.Equal(t, EncryptionNone, encryptionOf(false, false))
+}
+
+func TestTelegramError(t *testing.T) {
+	flood := fmt.Errorf("send part: %w", tgerr.New(420, "FLOOD_WAIT_120"))
+	assert.Equal(t, http.StatusTooManyRequests, telegramError(flood).Code)
+	assert.Equal(t, 0, telegramError(tgerr.New(400, "MESSAGE_ID_INVALID")).Code)
+}
+
+func TestChannelAccess(t *testing.T) {
+	c := cache.NewMemoryCache(1024 * 1024)
+
+	// Granted access is served from the cache without a database.
+	c.Set(fmt.Sprintf("users:channel-access:%d:%d", 1, 100), true, time.Minute)
+	assert.NoError(t, checkChannelAccess(nil, c, 1, 100))
+
+	assert.Equal(t, http.StatusForbidden, channelAccessError(ErrChannelForbidden).Code)
+	assert.Equal(t, http.StatusForbidden, uploadSettingsError(ErrChannelForbidden).Code)
+	assert.Equal(t, 0, channelAccessError(errors.New("db down")).Code)
+}
+
+func TestDetectMimeType(t *testing.T) {
+	cnf := &config.TGConfig{}
+	cnf.Uploads.MimeTypes = []string{"mkv=video/x-matroska"}
+	cnf.Uploads.MimeSniff = true
+
+	assert.Equal(t, "video/x-matroska", detectMimeType(cnf, "application/octet-stream", "clip.mkv", ""))
+	assert.Equal(t, "application/x-msdownload", detectMimeType(cnf, "", "clip.mkv", "application/x-msdownload"))
+	assert.Equal(t, "video/mp4", detectMimeType(cnf, "video/mp4", "clip.mkv", "application/x-msdownload"))
+
+	cnf.Uploads.MimeSniff = false
+	assert.Equal(t, "video/x-matroska", detectMimeType(cnf, "", "clip.mkv", "application/x-msdownload"))
+	assert.Equal(t, "video/webm", detectMimeType(nil, "", "clip.webm", ""))
+}
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+)
+
+const (
+	CompareMatch        = "match"
+	CompareDiffers      = "differs"
+	CompareUnverified   = "unverified"
+	CompareMissing      = "missing"
+	CompareOnlyInSource = "onlyInSource"
+	CompareOnlyInTarget = "onlyInTarget"
+)
+
+const maxCompareDuplicates = 100
+
+// normalizeHash stores client supplied whole-file hashes in one canonical
+// form so equality checks stay plain indexed comparisons.
+func normalizeHash(hash string) *string {
+	hash = strings.ToLower(strings.TrimSpace(hash))
+	if hash == "" {
+		return nil
+	}
+	return &hash
+}
+
+// compareStatus decides whether stored size and hash describe the candidate.
+// A size mismatch is conclusive on its own, equal sizes only match once both
+// sides carry a hash.
+func compareStatus(size *int64, hash *string, wantSize *int64, wantHash *string) string {
+	if size == nil || wantSize == nil || *size != *wantSize {
+		return CompareDiffers
+	}
+	if hash == nil || wantHash == nil {
+		return CompareUnverified
+	}
+	if *hash != *wantHash {
+		return CompareDiffers
+	}
+	return CompareMatch
+}
+
+func (fs *FileService) findFileForCompare(userId int64, payload *schemas.FileCompare) (*models.File, error) {
+	query := fs.db.Where("user_id = ?", userId).Where("type = ?", "file").Where("status = ?", "active")
+	if payload.ID != "" {
+		query = query.Where("id = ?", payload.ID)
+	} else {
+		dir, name := path.Split(path.Clean("/" + strings.TrimSpace(payload.Path)))
+		// A missing folder means a missing file here, not an error.
+		var parents []models.File
+		if err := fs.db.Raw("select * from teldrive.get_file_from_path(?, ?, ?)", path.Clean(dir), userId, false).
+			Scan(&parents).Error; err != nil {
+			return nil, err
+		}
+		if len(parents) == 0 {
+			return nil, database.ErrNotFound
+		}
+		query = query.Where("parent_id = ?", parents[0].Id).Where("name = ?", name)
+	}
+	var files []models.File
+	if err := query.Limit(1).Find(&files).Error; err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, database.ErrNotFound
+	}
+	return &files[0], nil
+}
+
+// CompareFile tells a sync client whether its local copy matches the stored
+// file without transferring content. When nothing is stored at the location,
+// files elsewhere with the same hash and size are listed as duplicates.
+func (fs *FileService) CompareFile(userId int64, payload *schemas.FileCompare) (*schemas.FileCompareOut, *types.AppError) {
+	hash := normalizeHash(payload.Hash)
+
+	file, err := fs.findFileForCompare(userId, payload)
+	if errors.Is(err, database.ErrNotFound) {
+		res := &schemas.FileCompareOut{Status: CompareMissing, Size: *payload.Size}
+		if hash != nil {
+			res.Hash = *hash
+			if err := fs.db.Model(&models.File{}).Where("user_id = ?", userId).Where("hash = ?", *hash).
+				Where("size = ?", *payload.Size).Where("type = ?", "file").Where("status = ?", "active").
+				Limit(maxCompareDuplicates).Pluck("id", &res.Duplicates).Error; err != nil {
+				return nil, &types.AppError{Error: err}
+			}
+		}
+		return res, nil
+	}
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	status := compareStatus(file.Size, file.Hash, payload.Size, hash)
+	res := &schemas.FileCompareOut{Status: status, Match: status == CompareMatch, ID: file.Id}
+	if file.Size != nil {
+		res.Size = *file.Size
+	}
+	if file.Hash != nil {
+		res.Hash = *file.Hash
+	}
+	return res, nil
+}
+
+const folderDiffQuery = `
+WITH RECURSIVE src AS (
+	SELECT id, type, size, hash, name AS path FROM teldrive.files
+	WHERE parent_id = @source AND user_id = @user AND status = 'active'
+	UNION ALL
+	SELECT f.id, f.type, f.size, f.hash, src.path || '/' || f.name FROM teldrive.files f
+	JOIN src ON f.parent_id = src.id
+	WHERE @recursive AND src.type = 'folder' AND f.status = 'active'
+), dst AS (
+	SELECT id, type, size, hash, name AS path FROM teldrive.files
+	WHERE parent_id = @target AND user_id = @user AND status = 'active'
+	UNION ALL
+	SELECT f.id, f.type, f.size, f.hash, dst.path || '/' || f.name FROM teldrive.files f
+	JOIN dst ON f.parent_id = dst.id
+	WHERE @recursive AND dst.type = 'folder' AND f.status = 'active'
+)
+SELECT coalesce(s.path, d.path) AS path, s.id AS source_id, d.id AS target_id,
+	s.size AS source_size, d.size AS target_size, s.hash AS source_hash, d.hash AS target_hash
+FROM (SELECT * FROM src WHERE type = 'file') s
+FULL OUTER JOIN (SELECT * FROM dst WHERE type = 'file') d ON s.path = d.path
+WHERE s.id IS NULL OR d.id IS NULL OR s.size IS DISTINCT FROM d.size
+	OR s.hash IS NULL OR d.hash IS NULL OR s.hash <> d.hash
+ORDER BY 1`
+
+type folderDiffRow struct {
+	Path       string
+	SourceID   *string
+	TargetID   *string
+	SourceSize *int64
+	TargetSize *int64
+	SourceHash *string
+	TargetHash *string
+}
+
+func (row *folderDiffRow) entry() schemas.FolderDiffEntry {
+	entry := schemas.FolderDiffEntry{Path: row.Path, SourceSize: row.SourceSize, TargetSize: row.TargetSize}
+	if row.SourceID != nil {
+		entry.SourceID = *row.SourceID
+	}
+	if row.TargetID != nil {
+		entry.TargetID = *row.TargetID
+	}
+	if row.SourceHash != nil {
+		entry.SourceHash = *row.SourceHash
+	}
+	if row.TargetHash != nil {
+		entry.TargetHash = *row.TargetHash
+	}
+	switch {
+	case row.TargetID == nil:
+		entry.Status = CompareOnlyInSource
+	case row.SourceID == nil:
+		entry.Status = CompareOnlyInTarget
+	default:
+		entry.Status = compareStatus(row.SourceSize, row.SourceHash, row.TargetSize, row.TargetHash)
+	}
+	return entry
+}
+
+// CompareFolders lists the files that differ between two folders by relative
+// path. Files with the same size and hash on both sides are left out, equal
+// sized files lacking a hash on either side are reported as unverified.
+func (fs *FileService) CompareFolders(userId int64, payload *schemas.FolderCompare) (*schemas.FolderDiff, *types.AppError) {
+	source, err := fs.getFileFromPath(payload.Source, userId)
+	if err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusNotFound}
+	}
+	target, err := fs.getFileFromPath(payload.Target, userId)
+	if err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusNotFound}
+	}
+
+	var rows []folderDiffRow
+	if err := fs.db.Raw(folderDiffQuery, sql.Named("source", source.Id), sql.Named("target", target.Id),
+		sql.Named("user", userId), sql.Named("recursive", payload.Recursive)).Scan(&rows).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	res := &schemas.FolderDiff{Entries: make([]schemas.FolderDiffEntry, 0, len(rows))}
+	for i := range rows {
+		res.Entries = append(res.Entries, rows[i].entry())
+	}
+	return res, nil
+}
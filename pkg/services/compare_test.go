@@ -0,0 +1,37 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareStatus(t *testing.T) {
+	size, other := int64(10), int64(11)
+	hash, otherHash := normalizeHash(" ABC "), normalizeHash("abd")
+
+	assert.Equal(t, "abc", *hash)
+	assert.Nil(t, normalizeHash("  "))
+
+	assert.Equal(t, CompareMatch, compareStatus(&size, hash, &size, normalizeHash("abc")))
+	assert.Equal(t, CompareDiffers, compareStatus(&size, hash, &size, otherHash))
+	assert.Equal(t, CompareDiffers, compareStatus(&size, hash, &other, hash))
+	assert.Equal(t, CompareDiffers, compareStatus(&size, nil, &other, nil))
+	assert.Equal(t, CompareUnverified, compareStatus(&size, nil, &size, hash))
+	assert.Equal(t, CompareUnverified, compareStatus(&size, hash, &size, nil))
+}
+
+func TestFolderDiffEntry(t *testing.T) {
+	id, size := "a", int64(1)
+
+	row := folderDiffRow{Path: "x/y", SourceID: &id, SourceSize: &size}
+	assert.Equal(t, CompareOnlyInSource, row.entry().Status)
+
+	row = folderDiffRow{Path: "x/y", TargetID: &id, TargetSize: &size}
+	entry := row.entry()
+	assert.Equal(t, CompareOnlyInTarget, entry.Status)
+	assert.Equal(t, "a", entry.TargetID)
+
+	row = folderDiffRow{Path: "x/y", SourceID: &id, TargetID: &id, SourceSize: &size, TargetSize: &size}
+	assert.Equal(t, CompareUnverified, row.entry().Status)
+}
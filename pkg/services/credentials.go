@@ -0,0 +1,63 @@
+package services
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"gorm.io/gorm"
+)
+
+// appCredentialStore resolves the app credentials stored with sessions and
+// bots for the client manager.
+type appCredentialStore struct {
+	db    *gorm.DB
+	cache cache.Cacher
+}
+
+func NewAppCredentialStore(db *gorm.DB, cache cache.Cacher) tgc.CredentialStore {
+	return &appCredentialStore{db: db, cache: cache}
+}
+
+type storedApp struct {
+	AppId   *int
+	AppHash *string
+}
+
+func sessionAppKey(session string) string {
+	hash := md5.Sum([]byte(session))
+	return "sessions:app:" + hex.EncodeToString(hash[:])
+}
+
+func botAppKey(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return "bots:app:" + hex.EncodeToString(hash[:])
+}
+
+// lookup reads the credentials of one row, caching absent ones too so the
+// common case without custom credentials does not query each time.
+func (s *appCredentialStore) lookup(key string, query *gorm.DB) *tgc.AppCredentials {
+	var app storedApp
+	if err := s.cache.Get(key, &app); err != nil {
+		if err := query.Select("app_id", "app_hash").Limit(1).Scan(&app).Error; err != nil {
+			return nil
+		}
+		s.cache.Set(key, &app, 0)
+	}
+	creds, err := tgc.NewAppCredentials(app.AppId, app.AppHash)
+	if err != nil {
+		return nil
+	}
+	return creds
+}
+
+func (s *appCredentialStore) Session(session string) *tgc.AppCredentials {
+	return s.lookup(sessionAppKey(session), s.db.Model(&models.Session{}).Where("session = ?", session))
+}
+
+func (s *appCredentialStore) Bot(token string) *tgc.AppCredentials {
+	return s.lookup(botAppKey(token), s.db.Model(&models.Bot{}).Where("token = ?", token))
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+var ErrFolderDepth = errors.New("folder tree too deep")
+
+// maxDepth is the configured limit of nested folders, zero when there is none.
+func (fs *FileService) maxDepth() int {
+	if fs.cnf == nil {
+		return 0
+	}
+	return fs.cnf.Files.MaxDepth
+}
+
+// pathDepth counts the folders of p below the root.
+func pathDepth(p string) int {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return 0
+	}
+	return strings.Count(p, "/") + 1
+}
+
+// folderHeight returns how many levels of folders ids span, themselves
+// included: 1 for folders without subfolders, 0 when none is a folder.
+func folderHeight(tx *gorm.DB, userId int64, ids []string) (int, error) {
+	var height int
+	err := tx.Raw(`WITH RECURSIVE down AS (
+		SELECT id, 1 AS level FROM teldrive.files WHERE id IN ? AND user_id = ? AND type = 'folder'
+		UNION ALL
+		SELECT f.id, down.level + 1 FROM teldrive.files f JOIN down ON f.parent_id = down.id
+		WHERE f.type = 'folder' AND f.user_id = ? AND f.status = 'active'
+	) SELECT coalesce(max(level), 0) FROM down`, ids, userId, userId).Scan(&height).Error
+	return height, err
+}
+
+// checkDepth fails when folders reaching depth would be deeper than allowed.
+func checkDepth(depth, max int) error {
+	if max > 0 && depth > max {
+		return fmt.Errorf("%w: %d nested folders, at most %d allowed", ErrFolderDepth, depth, max)
+	}
+	return nil
+}
+
+// checkMoveDepth fails when moving ids into the folder at dest would nest
+// folders deeper than allowed.
+func checkMoveDepth(tx *gorm.DB, userId int64, ids []string, dest string, max int) error {
+	if max <= 0 {
+		return nil
+	}
+	height, err := folderHeight(tx, userId, ids)
+	if err != nil {
+		return err
+	}
+	return checkDepth(pathDepth(dest)+height, max)
+}
@@ -0,0 +1,21 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathDepth(t *testing.T) {
+	assert.Equal(t, 0, pathDepth("/"))
+	assert.Equal(t, 0, pathDepth(""))
+	assert.Equal(t, 1, pathDepth("/docs"))
+	assert.Equal(t, 3, pathDepth("docs/a/b/"))
+	assert.Equal(t, 2, pathDepth("/docs//a/../b"))
+}
+
+func TestCheckDepth(t *testing.T) {
+	assert.NoError(t, checkDepth(3, 3))
+	assert.ErrorIs(t, checkDepth(4, 3), ErrFolderDepth)
+	assert.NoError(t, checkDepth(1000, 0))
+}
@@ -0,0 +1,147 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrFileLimit   = errors.New("file count limit reached")
+	ErrFolderLimit = errors.New("folder count limit reached")
+)
+
+// entryLimits returns the file and folder limits of a user, those an admin
+// set for them or else the configured ones. Zero means no limit.
+func entryLimits(db *gorm.DB, cache cache.Cacher, cnf *config.Config, userId int64) (maxFiles, maxFolders int64, override bool) {
+	var limits struct {
+		MaxFiles   *int64
+		MaxFolders *int64
+	}
+
+	key := fmt.Sprintf("users:entrylimits:%d", userId)
+
+	if err := cache.Get(key, &limits); err != nil {
+		db.Model(&models.User{}).Select("max_files", "max_folders").Where("user_id = ?", userId).Scan(&limits)
+		cache.Set(key, &limits, 0)
+	}
+
+	if cnf != nil {
+		maxFiles, maxFolders = cnf.Files.MaxFiles, cnf.Files.MaxFolders
+	}
+	if limits.MaxFiles != nil {
+		maxFiles, override = *limits.MaxFiles, true
+	}
+	if limits.MaxFolders != nil {
+		maxFolders, override = *limits.MaxFolders, true
+	}
+	return maxFiles, maxFolders, override
+}
+
+// entryCounts returns the number of active files and folders of a user.
+func entryCounts(db *gorm.DB, userId int64) (files, folders int64, err error) {
+	var counts models.EntryCount
+	err = db.Where("user_id = ?", userId).Limit(1).Find(&counts).Error
+	return counts.Files, counts.Folders, err
+}
+
+// checkEntryRoom fails with ErrFileLimit or ErrFolderLimit when adding files
+// and folders would take a user past their limits. It spares work that would
+// be refused anyway, the limits themselves are held by enforceEntryLimits.
+func checkEntryRoom(db *gorm.DB, cache cache.Cacher, cnf *config.Config, userId int64, files, folders int64) error {
+	maxFiles, maxFolders, _ := entryLimits(db, cache, cnf, userId)
+	if maxFiles <= 0 && maxFolders <= 0 {
+		return nil
+	}
+	haveFiles, haveFolders, err := entryCounts(db, userId)
+	if err != nil {
+		return err
+	}
+	if files > 0 {
+		if err := entryLimitError("file", haveFiles+files, haveFolders, maxFiles, maxFolders); err != nil {
+			return err
+		}
+	}
+	if folders > 0 {
+		return entryLimitError("folder", haveFiles, haveFolders+folders, maxFiles, maxFolders)
+	}
+	return nil
+}
+
+// enforceEntryLimits fails with ErrFileLimit or ErrFolderLimit when the
+// entries of entryTypes written in tx took a user past their limits. The
+// counts are kept by a trigger that locks the row of the user until tx ends,
+// so concurrent writers queue behind it and see its entries.
+func enforceEntryLimits(tx *gorm.DB, cache cache.Cacher, cnf *config.Config, userId int64, entryTypes ...string) error {
+	maxFiles, maxFolders, _ := entryLimits(tx, cache, cnf, userId)
+	if maxFiles <= 0 && maxFolders <= 0 {
+		return nil
+	}
+	files, folders, err := entryCounts(tx, userId)
+	if err != nil {
+		return err
+	}
+	for _, entryType := range entryTypes {
+		if err := entryLimitError(entryType, files, folders, maxFiles, maxFolders); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createDirectories creates the folders of dirPath a user is missing, within
+// their folder limit, and returns the folder at dirPath first.
+func createDirectories(db *gorm.DB, cache cache.Cacher, cnf *config.Config, userId int64, dirPath string) ([]models.File, error) {
+	var folders []models.File
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Raw("select * from teldrive.create_directories(?, ?)", userId, dirPath).
+			Scan(&folders).Error; err != nil {
+			return err
+		}
+		return enforceEntryLimits(tx, cache, cnf, userId, "folder")
+	})
+	return folders, err
+}
+
+func isEntryLimitErr(err error) bool {
+	return errors.Is(err, ErrFileLimit) || errors.Is(err, ErrFolderLimit)
+}
+
+func entryLimitAppError(err error) *types.AppError {
+	if isEntryLimitErr(err) {
+		return &types.AppError{Error: err, Code: http.StatusForbidden}
+	}
+	return &types.AppError{Error: err}
+}
+
+// entryLimitError reports the limit of entryType a user holding files and
+// folders is past.
+func entryLimitError(entryType string, files, folders, maxFiles, maxFolders int64) error {
+	if entryType == "folder" {
+		if maxFolders > 0 && folders > maxFolders {
+			return ErrFolderLimit
+		}
+		return nil
+	}
+	if maxFiles > 0 && files > maxFiles {
+		return ErrFileLimit
+	}
+	return nil
+}
+
+// accountEntries fills the entry counts and limits of the account stats.
+func accountEntries(db *gorm.DB, cache cache.Cacher, cnf *config.Config, userId int64, stats *schemas.AccountStats) error {
+	var err error
+	if stats.Files, stats.Folders, err = entryCounts(db, userId); err != nil {
+		return err
+	}
+	stats.MaxFiles, stats.MaxFolders, _ = entryLimits(db, cache, cnf, userId)
+	return nil
+}
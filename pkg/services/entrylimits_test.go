@@ -0,0 +1,16 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntryLimitError(t *testing.T) {
+	assert.NoError(t, entryLimitError("file", 10, 0, 10, 0))
+	assert.ErrorIs(t, entryLimitError("file", 11, 0, 10, 0), ErrFileLimit)
+	assert.NoError(t, entryLimitError("file", 1000, 0, 0, 5))
+	assert.NoError(t, entryLimitError("folder", 1000, 5, 10, 5))
+	assert.ErrorIs(t, entryLimitError("folder", 0, 6, 10, 5), ErrFolderLimit)
+	assert.NoError(t, entryLimitError("folder", 0, 1000, 10, 0))
+}
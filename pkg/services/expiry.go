@@ -0,0 +1,123 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/pkg/mapper"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrFileExpired  = errors.New("file expired")
+	ErrExpiryInPast = errors.New("expiresAt must be in the future")
+	ErrRootExpiry   = errors.New("the root folder cannot expire")
+)
+
+// expiringDays is how far ahead upcoming expirations are listed by default.
+const expiringDays = 7
+
+// fileExpired reports whether a file is past its expiry but not yet picked up
+// by the expiry job.
+func fileExpired(file *schemas.FileOut, now time.Time) bool {
+	return file.ExpiresAt != nil && !file.ExpiresAt.After(now)
+}
+
+// SetFileExpiry schedules or cancels the deletion of a file or folder of the
+// user. A folder takes everything below it along when it expires.
+func (fs *FileService) SetFileExpiry(userId int64, id string, payload *schemas.FileExpiry) (*schemas.FileOut, *types.AppError) {
+
+	if payload.ExpiresAt != nil {
+		if !payload.ExpiresAt.After(time.Now().UTC()) {
+			return nil, &types.AppError{Error: ErrExpiryInPast, Code: http.StatusBadRequest}
+		}
+		expiresAt := payload.ExpiresAt.UTC()
+		payload.ExpiresAt = &expiresAt
+	}
+
+	var file models.File
+	if err := fs.db.Where("id = ?", id).Where("user_id = ?", userId).Where("status = ?", "active").
+		First(&file).Error; err != nil {
+		if database.IsRecordNotFoundErr(err) {
+			return nil, &types.AppError{Error: database.ErrNotFound, Code: http.StatusNotFound}
+		}
+		return nil, &types.AppError{Error: err}
+	}
+	if !file.ParentID.Valid {
+		return nil, &types.AppError{Error: ErrRootExpiry, Code: http.StatusBadRequest}
+	}
+
+	if err := fs.db.Model(&file).Update("expires_at", payload.ExpiresAt).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	fs.cache.Delete(fmt.Sprintf("files:%s", id))
+
+	return mapper.ToFileOut(file), nil
+}
+
+// ListExpiring lists the entries of the user that expire within the next days,
+// soonest first.
+func (fs *FileService) ListExpiring(userId int64, query *schemas.ExpiringQuery) (*schemas.FileResponse, *types.AppError) {
+
+	days := query.Days
+	if days == 0 {
+		days = expiringDays
+	}
+	limit := query.Limit
+	if limit == 0 {
+		limit = 500
+	}
+	page := max(query.Page, 1)
+
+	scope := func(db *gorm.DB) *gorm.DB {
+		return db.Where("user_id = ?", userId).Where("status = ?", "active").
+			Where("expires_at IS NOT NULL").Where("expires_at <= ?", time.Now().UTC().AddDate(0, 0, days))
+	}
+
+	var count int64
+	if err := fs.db.Model(&models.File{}).Scopes(scope).Count(&count).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	files := []schemas.FileOut{}
+	if err := fs.db.Model(&models.File{}).Scopes(scope).Select("*", parentPathColumn).
+		Order("expires_at, id").Offset((page - 1) * limit).Limit(limit).Scan(&files).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	return &schemas.FileResponse{Files: files,
+		Meta: schemas.Meta{Count: int(count), TotalPages: int(math.Ceil(float64(count) / float64(limit))),
+			CurrentPage: page}}, nil
+}
+
+// ExpireFiles deletes the entries past their expiry the way a user deleting
+// them would, the messages of their parts are removed by the file cleanup.
+func ExpireFiles(db *gorm.DB) (int64, error) {
+	var expired []models.File
+	if err := db.Model(&models.File{}).Select("id", "user_id").Where("status = ?", "active").
+		Where("expires_at IS NOT NULL").Where("expires_at <= ?", time.Now().UTC()).
+		Order("user_id").Find(&expired).Error; err != nil {
+		return 0, err
+	}
+
+	byUser := map[int64][]string{}
+	for _, file := range expired {
+		byUser[file.UserID] = append(byUser[file.UserID], file.Id)
+	}
+
+	var total int64
+	for userId, ids := range byUser {
+		if err := db.Exec("call teldrive.delete_files_bulk($1 , $2)", ids, userId).Error; err != nil {
+			return total, err
+		}
+		total += int64(len(ids))
+	}
+	return total, nil
+}
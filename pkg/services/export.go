@@ -0,0 +1,306 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/tgdrive/teldrive/internal/category"
+	"github.com/tgdrive/teldrive/internal/reader"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+var ErrInvalidExport = errors.New("invalid export")
+
+// ExportFiles returns the metadata of every active file and folder owned by
+// the user. The bytes stay in telegram so the export is enough to recreate the
+// tree on another instance with access to the same channels; files stored
+// inline carry their content.
+func (fs *FileService) ExportFiles(userId int64) (*schemas.Export, *types.AppError) {
+	var files []models.File
+
+	if err := fs.db.Where("user_id = ?", userId).Where("status = ?", "active").
+		Order("created_at").Find(&files).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	var channels []models.Channel
+
+	if err := fs.db.Where("user_id = ?", userId).Find(&channels).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	export := &schemas.Export{
+		Version:    schemas.ExportVersion,
+		ExportedAt: time.Now().UTC(),
+		Channels:   []schemas.Channel{},
+		Files:      make([]schemas.ExportFile, 0, len(files)),
+	}
+
+	for _, channel := range channels {
+		export.Channels = append(export.Channels, schemas.Channel{ChannelID: channel.ChannelID, ChannelName: channel.ChannelName})
+	}
+
+	var keys reader.KeyFunc
+	if fs.cnf != nil {
+		keys = keyResolver(fs.db, &fs.cnf.TG, userId)
+	}
+
+	for _, file := range files {
+		item := schemas.ExportFile{
+			Id:         file.Id,
+			Name:       file.Name,
+			Type:       file.Type,
+			MimeType:   file.MimeType,
+			Category:   file.Category,
+			Encrypted:  file.Encrypted,
+			Encryption: file.Encryption,
+			ParentID:   file.ParentID.String,
+			Parts:      file.Parts,
+			CreatedAt:  file.CreatedAt,
+			UpdatedAt:  file.UpdatedAt,
+		}
+		if file.Size != nil {
+			item.Size = *file.Size
+		}
+		if file.ChannelID != nil {
+			item.ChannelID = *file.ChannelID
+		}
+		if file.Hash != nil {
+			item.Hash = *file.Hash
+		}
+		if file.HashAlgorithm != nil {
+			item.HashAlgorithm = *file.HashAlgorithm
+		}
+		if file.InlineData != nil {
+			// Keys do not travel with the export, inline content is exported
+			// opened and sealed again for whoever imports it.
+			var (
+				key string
+				err error
+			)
+			if file.Encrypted {
+				if keys == nil {
+					return nil, &types.AppError{Error: ErrKeyUnavailable}
+				}
+				if key, err = keys(file.KeyVersion); err != nil {
+					return nil, &types.AppError{Error: err}
+				}
+			}
+			if item.Data, err = openInline(key, file.InlineData, file.Encrypted); err != nil {
+				return nil, &types.AppError{Error: err}
+			}
+		}
+		export.Files = append(export.Files, item)
+	}
+
+	return export, nil
+}
+
+// ImportFiles recreates an exported tree under the user's root. Every entry
+// gets a new id, folders that already exist at the same path are merged and
+// files that already exist with the same name and size are skipped, as are
+// files stored in channels the user has not added.
+func (fs *FileService) ImportFiles(userId int64, export *schemas.Export) (*schemas.ImportResult, *types.AppError) {
+	if export.Version != schemas.ExportVersion {
+		return nil, &types.AppError{Error: fmt.Errorf("%w: unsupported version %d", ErrInvalidExport, export.Version),
+			Code: http.StatusBadRequest}
+	}
+
+	ordered, rootId, err := orderExport(export.Files)
+	if err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+
+	root, err := fs.getFileFromPath("/", userId)
+	if err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusNotFound}
+	}
+
+	result := &schemas.ImportResult{}
+
+	err = fs.db.Transaction(func(tx *gorm.DB) error {
+		denied := map[int64]bool{}
+
+		ids := map[string]string{rootId: root.Id}
+
+		for _, item := range ordered {
+			parentId := ids[item.ParentID]
+
+			if item.Type == "folder" {
+				var existing models.File
+				err := tx.Where("user_id = ? AND parent_id = ? AND name = ? AND type = ? AND status = ?",
+					userId, parentId, item.Name, "folder", "active").First(&existing).Error
+				if err == nil {
+					ids[item.Id] = existing.Id
+					result.Merged++
+					continue
+				}
+				if !errors.Is(err, gorm.ErrRecordNotFound) {
+					return err
+				}
+			} else {
+				if item.ChannelID == 0 || denied[item.ChannelID] {
+					result.Skipped++
+					continue
+				}
+				if err := checkChannelAccess(tx, fs.cache, userId, item.ChannelID); err != nil {
+					if !errors.Is(err, ErrChannelForbidden) {
+						return err
+					}
+					denied[item.ChannelID] = true
+					result.Skipped++
+					result.Warnings = append(result.Warnings,
+						fmt.Sprintf("channel %d is not one of your channels, its files were skipped", item.ChannelID))
+					continue
+				}
+				if len(item.Data) > 0 && item.Encrypted && fs.cnf == nil {
+					result.Skipped++
+					continue
+				}
+				var count int64
+				if err := tx.Model(&models.File{}).Where("user_id = ? AND parent_id = ? AND name = ? AND size = ? AND status = ?",
+					userId, parentId, item.Name, item.Size, "active").Count(&count).Error; err != nil {
+					return err
+				}
+				if count > 0 {
+					result.Skipped++
+					continue
+				}
+			}
+
+			file := models.File{
+				Name:       item.Name,
+				Type:       item.Type,
+				MimeType:   item.MimeType,
+				Encrypted:  item.Encrypted,
+				Encryption: encryptionOf(item.Encrypted, item.Encryption == EncryptionClient),
+				UserID:     userId,
+				Status:     "active",
+				ParentID:   sql.NullString{String: parentId, Valid: true},
+				CreatedAt:  item.CreatedAt,
+				UpdatedAt:  item.UpdatedAt,
+			}
+			if item.Type == "folder" {
+				file.MimeType = "drive/folder"
+			} else {
+				size := item.Size
+				channelId := item.ChannelID
+				file.Size = &size
+				file.ChannelID = &channelId
+				file.Parts = datatypes.NewJSONSlice(item.Parts)
+				file.Hash = normalizeHash(item.Hash)
+				file.HashAlgorithm = hashAlgorithm(file.Hash, item.HashAlgorithm)
+				if len(item.Data) > 0 {
+					var (
+						key string
+						err error
+					)
+					if item.Encrypted {
+						if file.KeyVersion, key, err = uploadKey(tx, &fs.cnf.TG, userId); err != nil {
+							return err
+						}
+					}
+					if file.InlineData, err = sealInline(key, item.Data, item.Encrypted); err != nil {
+						return err
+					}
+					size = int64(len(item.Data))
+					file.Parts = nil
+				}
+				file.Category = item.Category
+				if file.Category == "" {
+					file.Category = string(category.GetCategory(item.Name))
+				}
+			}
+
+			if err := tx.Create(&file).Error; err != nil {
+				return err
+			}
+			ids[item.Id] = file.Id
+			result.Imported++
+		}
+		return enforceEntryLimits(tx, fs.cache, fs.cnf, userId, "file", "folder")
+	})
+
+	if err != nil {
+		return nil, entryLimitAppError(err)
+	}
+
+	return result, nil
+}
+
+// orderExport validates that the exported entries form a single tree and
+// returns them parents first, without the root.
+func orderExport(files []schemas.ExportFile) ([]schemas.ExportFile, string, error) {
+	byId := make(map[string]*schemas.ExportFile, len(files))
+	rootId := ""
+
+	for i := range files {
+		file := &files[i]
+		if _, ok := byId[file.Id]; ok {
+			return nil, "", fmt.Errorf("%w: duplicate id %s", ErrInvalidExport, file.Id)
+		}
+		byId[file.Id] = file
+		if file.ParentID == "" {
+			if rootId != "" {
+				return nil, "", fmt.Errorf("%w: multiple root folders", ErrInvalidExport)
+			}
+			if file.Type != "folder" {
+				return nil, "", fmt.Errorf("%w: root must be a folder", ErrInvalidExport)
+			}
+			rootId = file.Id
+		}
+	}
+
+	if rootId == "" {
+		return nil, "", fmt.Errorf("%w: root folder not found", ErrInvalidExport)
+	}
+
+	depths := map[string]int{rootId: 0}
+
+	var depth func(id string, seen int) (int, error)
+	depth = func(id string, seen int) (int, error) {
+		if d, ok := depths[id]; ok {
+			return d, nil
+		}
+		if seen > len(files) {
+			return 0, fmt.Errorf("%w: cycle at %s", ErrInvalidExport, id)
+		}
+		parent, ok := byId[byId[id].ParentID]
+		if !ok {
+			return 0, fmt.Errorf("%w: parent of %s not found", ErrInvalidExport, id)
+		}
+		if parent.Type != "folder" {
+			return 0, fmt.Errorf("%w: parent of %s is not a folder", ErrInvalidExport, id)
+		}
+		d, err := depth(parent.Id, seen+1)
+		if err != nil {
+			return 0, err
+		}
+		depths[id] = d + 1
+		return d + 1, nil
+	}
+
+	ordered := make([]schemas.ExportFile, 0, len(files))
+	for _, file := range files {
+		if _, err := depth(file.Id, 0); err != nil {
+			return nil, "", err
+		}
+		if file.Id != rootId {
+			ordered = append(ordered, file)
+		}
+	}
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return depths[ordered[i].Id] < depths[ordered[j].Id]
+	})
+
+	return ordered, rootId, nil
+}
@@ -0,0 +1,84 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+)
+
+func TestOrderExport(t *testing.T) {
+	files := []schemas.ExportFile{
+		{Id: "c", Name: "c.txt", Type: "file", ParentID: "b"},
+		{Id: "b", Name: "b", Type: "folder", ParentID: "a"},
+		{Id: "a", Name: "a", Type: "folder", ParentID: "root"},
+		{Id: "root", Name: "root", Type: "folder"},
+	}
+
+	ordered, rootId, err := orderExport(files)
+	assert.NoError(t, err)
+	assert.Equal(t, "root", rootId)
+	assert.Equal(t, []string{"a", "b", "c"}, []string{ordered[0].Id, ordered[1].Id, ordered[2].Id})
+}
+
+func TestOrderExport_Invalid(t *testing.T) {
+	cases := [][]schemas.ExportFile{
+		{{Id: "a", Type: "folder", ParentID: "missing"}},
+		{{Id: "root", Type: "folder"}, {Id: "a", Type: "file", ParentID: "missing"}},
+		{{Id: "root", Type: "folder"}, {Id: "f", Type: "file", ParentID: "root"}, {Id: "x", Type: "file", ParentID: "f"}},
+		{{Id: "root", Type: "folder"}, {Id: "a", Type: "folder", ParentID: "b"}, {Id: "b", Type: "folder", ParentID: "a"}},
+	}
+	for _, files := range cases {
+		_, _, err := orderExport(files)
+		assert.True(t, errors.Is(err, ErrInvalidExport), err)
+	}
+}
+
+func TestReportWriter(t *testing.T) {
+	at := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+	rows := []schemas.FileReportRow{
+		{Id: "a", Path: "/docs/a, b.txt", Type: "file", Size: 10, MimeType: "text/plain", ChannelID: 7,
+			CreatedAt: at, UpdatedAt: at},
+		{Id: "b", Path: "/docs/sub", Type: "folder", CreatedAt: at, UpdatedAt: at},
+	}
+
+	rec := httptest.NewRecorder()
+	report := newReportWriter(rec, "csv")
+	for i := range rows {
+		assert.NoError(t, report.write(&rows[i]))
+	}
+	report.close()
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	assert.Len(t, lines, 3)
+	assert.Equal(t, strings.Join(reportColumns, ","), lines[0])
+	assert.Equal(t, `a,"/docs/a, b.txt",file,10,text/plain,,,,7,2024-10-01T12:00:00Z,2024-10-01T12:00:00Z`, lines[1])
+
+	rec = httptest.NewRecorder()
+	report = newReportWriter(rec, "json")
+	for i := range rows {
+		assert.NoError(t, report.write(&rows[i]))
+	}
+	report.close()
+	var decoded []schemas.FileReportRow
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &decoded))
+	assert.Equal(t, rows, decoded)
+
+	rec = httptest.NewRecorder()
+	newReportWriter(rec, "json").close()
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &decoded))
+	assert.Empty(t, decoded)
+}
+
+func TestReportSQL(t *testing.T) {
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sql, args := reportSQL(&schemas.FileReportQuery{Type: "file", Since: &since, After: "x"}, 1, "root", "/docs")
+	assert.Contains(t, sql, "AND f.type = @type AND f.updated_at >= @since AND f.id > @after ORDER BY f.id")
+	assert.NotContains(t, sql, "@until")
+	assert.Equal(t, "/docs", args["prefix"])
+	assert.Equal(t, since, args["since"])
+}
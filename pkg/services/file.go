@@ -3,14 +3,18 @@ package services
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math"
-	"mime"
 	"net/http"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -19,17 +23,21 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/gotd/td/telegram"
 	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
 	"github.com/tgdrive/teldrive/internal/auth"
 	"github.com/tgdrive/teldrive/internal/cache"
 	"github.com/tgdrive/teldrive/internal/category"
 	"github.com/tgdrive/teldrive/internal/config"
 	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/internal/events"
 	"github.com/tgdrive/teldrive/internal/http_range"
 	"github.com/tgdrive/teldrive/internal/kv"
 	"github.com/tgdrive/teldrive/internal/md5"
+	"github.com/tgdrive/teldrive/internal/policy"
 	"github.com/tgdrive/teldrive/internal/reader"
 	"github.com/tgdrive/teldrive/internal/tgc"
 	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/httputil"
 	"github.com/tgdrive/teldrive/pkg/mapper"
 	"github.com/tgdrive/teldrive/pkg/models"
 	"github.com/tgdrive/teldrive/pkg/schemas"
@@ -43,7 +51,23 @@ import (
 )
 
 var (
-	ErrorStreamAbandoned = errors.New("stream abandoned")
+	ErrorStreamAbandoned  = errors.New("stream abandoned")
+	ErrReplaceFolder      = errors.New("replace is not supported for folders")
+	ErrPreconditionFailed = errors.New("file does not match If-Match")
+	ErrFolderDefaults     = errors.New("upload defaults can only be set on folders")
+	ErrChannelForbidden   = errors.New("channel does not belong to the user")
+)
+
+const (
+	viewerKey = "streamViewer"
+
+	ConflictError   = "error"
+	ConflictRename  = "rename"
+	ConflictReplace = "replace"
+
+	accessDebounce = 5 * time.Minute
+
+	streamFlushRows = 100
 )
 
 type buffer struct {
@@ -83,6 +107,9 @@ type FileService struct {
 	botWorker *tgc.BotWorker
 	cache     cache.Cacher
 	kv        kv.KV
+	clients   *tgc.Manager
+	access    *accessRecorder
+	events    *events.Emitter
 	logger    *zap.SugaredLogger
 }
 
@@ -93,16 +120,26 @@ func NewFileService(
 	botWorker *tgc.BotWorker,
 	kv kv.KV,
 	cache cache.Cacher,
+	clients *tgc.Manager,
+	events *events.Emitter,
 	logger *zap.SugaredLogger) *FileService {
-	return &FileService{db: db, cnf: cnf, botWorker: botWorker, cache: cache, kv: kv, logger: logger}
+	fs := &FileService{db: db, cnf: cnf, botWorker: botWorker, cache: cache, kv: kv, clients: clients, events: events,
+		logger: logger}
+	if cnf.Stats.Enabled {
+		fs.access = newAccessRecorder(db, logger, cnf.Stats.FlushInterval)
+	}
+	return fs
 }
 
 func (fs *FileService) CreateFile(c *gin.Context, userId int64, fileIn *schemas.FileIn) (*schemas.FileOut, *types.AppError) {
 
 	var (
-		fileDB models.File
-		parent *models.File
-		err    error
+		fileDB   models.File
+		parent   *models.File
+		reserved *models.UploadSession
+		appErr   *types.AppError
+		err      error
+		content  = fileIn.Content
 	)
 
 	fileIn.Path = strings.TrimSpace(fileIn.Path)
@@ -130,35 +167,207 @@ func (fs *FileService) CreateFile(c *gin.Context, userId int64, fileIn *schemas.
 		fileDB.MimeType = "drive/folder"
 		fileDB.Parts = nil
 	} else if fileIn.Type == "file" {
-		channelId := fileIn.ChannelID
-		if fileIn.ChannelID == 0 {
-			var err error
-			channelId, err = getDefaultChannel(fs.db, fs.cache, userId)
+		if fileIn.UploadId != "" {
+			if reserved, appErr = pinUploadSession(fs.db, userId, fileIn); appErr != nil {
+				return nil, appErr
+			}
+		}
+		var (
+			cnf     *config.TGConfig
+			sniffed string
+		)
+		if fs.cnf != nil {
+			cnf = &fs.cnf.TG
+		}
+		if fileIn.UploadId != "" {
+			if sniffed, err = uploadMimeType(fs.db, userId, fileIn.UploadId); err != nil {
+				return nil, &types.AppError{Error: err}
+			}
+		} else if len(fileIn.Data) > 0 {
+			sniffed = policy.Sniff(fileIn.Data[:min(len(fileIn.Data), policy.SniffLength)])
+		}
+		fileIn.MimeType = detectMimeType(cnf, fileIn.MimeType, fileIn.Name, sniffed)
+		if cnf != nil {
+			if err := checkFileType(fs.db, fs.cache, cnf, userId, fileIn.Name, fileIn.MimeType, sniffed); err != nil {
+				return nil, &types.AppError{Error: err, Code: http.StatusUnsupportedMediaType}
+			}
+		}
+		requested, client, err := encryptionMode(fileIn.Encryption, fileIn.Encrypted)
+		if err != nil {
+			return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+		}
+		channelId, encrypted, err := resolveUploadSettings(fs.db, fs.cache, userId, fileDB.ParentID.String, "",
+			fileIn.ChannelID, requested, nil)
+		if errors.Is(err, ErrChannelForbidden) {
+			return nil, &types.AppError{Error: err, Code: http.StatusForbidden}
+		}
+		if err != nil {
+			return nil, &types.AppError{Error: err, Code: http.StatusNotFound}
+		}
+		// Uploaded parts were sealed under the rules when they were sent, only
+		// content stored here is decided now.
+		if fileIn.UploadId == "" && !client && fs.cnf != nil {
+			encrypted, _, err = applyEncryptionPolicy(fs.db, &fs.cnf.TG, fileIn.Name, fileIn.MimeType,
+				fileDB.ParentID.String, fileIn.Path, encrypted, requested != nil)
 			if err != nil {
-				return nil, &types.AppError{Error: err, Code: http.StatusNotFound}
+				return nil, uploadSettingsError(err)
+			}
+		}
+		if fileIn.UploadId != "" {
+			parts, uploads, appErr := uploadedParts(fs.db, userId, fileIn.UploadId, fileIn.Parts)
+			if appErr != nil {
+				return nil, appErr
+			}
+			fileIn.Parts = parts
+			if len(uploads) == 1 {
+				content = uploads[0].Content
+			}
+			// The file lives wherever its parts were stored, which is not
+			// always the default channel: parts may have failed over or the
+			// folder default may have changed since.
+			stored := uploads[0].ChannelID
+			if slices.ContainsFunc(uploads, func(u models.Upload) bool { return u.ChannelID != stored }) ||
+				(fileIn.ChannelID != 0 && fileIn.ChannelID != stored) {
+				return nil, &types.AppError{Error: fmt.Errorf("%w: channel", ErrUploadConflict), Code: http.StatusBadRequest}
+			}
+			channelId = stored
+			if client && slices.ContainsFunc(uploads, func(u models.Upload) bool { return u.Encrypted }) {
+				return nil, &types.AppError{Error: errors.New("client encrypted files cannot have server encrypted parts"),
+					Code: http.StatusBadRequest}
+			}
+			// The file is encrypted exactly when its parts are.
+			sealed := uploads[0].Encrypted
+			if slices.ContainsFunc(uploads, func(u models.Upload) bool { return u.Encrypted != sealed }) ||
+				(requested != nil && *requested != sealed) {
+				return nil, &types.AppError{Error: fmt.Errorf("%w: encryption", ErrUploadConflict), Code: http.StatusBadRequest}
+			}
+			encrypted = sealed
+			if inline := uploads[0]; inline.InlineData != nil {
+				// The content was sealed when it was uploaded.
+				fileDB.InlineData = inline.InlineData
+				fileDB.KeyVersion = inline.KeyVersion
+				fileIn.Size = inline.Size
+			} else if appErr := fs.verifyUploadParts(c, uploads); appErr != nil {
+				return nil, appErr
+			} else {
+				// Clients may declare the stored size, which encryption
+				// inflates; the file reports the size its parts decrypt to.
+				fileIn.Size = uploadsLogicalSize(uploads)
+			}
+		} else if len(fileIn.Data) > 0 {
+			if fs.cnf == nil || int64(len(fileIn.Data)) > fs.cnf.TG.Uploads.InlineThreshold {
+				return nil, &types.AppError{Error: ErrInlineTooLarge, Code: http.StatusRequestEntityTooLarge}
+			}
+			if len(fileIn.Parts) > 0 {
+				return nil, &types.AppError{Error: errors.New("data and parts cannot be combined"), Code: http.StatusBadRequest}
+			}
+			var key string
+			if encrypted {
+				if fileDB.KeyVersion, key, err = uploadKey(fs.db, &fs.cnf.TG, userId); err != nil {
+					return nil, &types.AppError{Error: err}
+				}
+			}
+			fileDB.InlineData, err = sealInline(key, fileIn.Data, encrypted)
+			if err != nil {
+				return nil, &types.AppError{Error: err}
+			}
+			fileIn.Size = int64(len(fileIn.Data))
+			if indexable(&fs.cnf.TG, fileIn.Name, fileIn.MimeType, "", fileIn.Size, encrypted || client) {
+				content = indexText(fileIn.Data)
+			}
+		}
+		if reserved != nil {
+			if err := checkSessionTotals(reserved, fileIn.Size, len(fileIn.Parts)); err != nil {
+				return nil, &types.AppError{Error: err, Code: http.StatusConflict}
 			}
 		}
 		fileDB.ChannelID = &channelId
+		fileDB.Encrypted = encrypted
+		fileDB.Encryption = encryptionOf(encrypted, client)
 		fileDB.MimeType = fileIn.MimeType
 		fileDB.Category = string(category.GetCategory(fileIn.Name))
 		fileDB.Parts = datatypes.NewJSONSlice(fileIn.Parts)
 		fileDB.Size = &fileIn.Size
+		fileDB.Hash = normalizeHash(fileIn.Hash)
+		fileDB.HashAlgorithm = hashAlgorithm(fileDB.Hash, fileIn.HashAlgorithm)
 	}
 	fileDB.Name = fileIn.Name
 	fileDB.Type = fileIn.Type
 	fileDB.UserID = userId
 	fileDB.Status = "active"
-	fileDB.Encrypted = fileIn.Encrypted
 
-	if err := fs.db.Create(&fileDB).Error; err != nil {
+	if fileDB.Type == "file" && fs.cnf != nil {
+		if err := checkUploadLimits(&fs.cnf.TG, 0, fileIn.Size, len(fileIn.Parts)); err != nil {
+			return nil, &types.AppError{Error: err, Code: http.StatusRequestEntityTooLarge}
+		}
+	}
+
+	if fileIn.Conflict == ConflictReplace && fileDB.Type == "folder" {
+		return nil, &types.AppError{Error: ErrReplaceFolder, Code: http.StatusBadRequest}
+	}
+
+	var replaced []string
+
+	err = fs.db.Transaction(func(tx *gorm.DB) error {
+		if fileIn.Conflict != "" {
+			if replaced, err = resolveNameConflict(tx, &fileDB, fileIn.Conflict); err != nil {
+				return err
+			}
+		}
+		if err := tx.Create(&fileDB).Error; err != nil {
+			return err
+		}
+		if err := enforceEntryLimits(tx, fs.cache, fs.cnf, userId, fileDB.Type); err != nil {
+			return err
+		}
+		if fileIn.DryRun {
+			return errDryRun
+		}
+		if content != nil && fileDB.Type == "file" && fileDB.Encryption == EncryptionNone {
+			if err := tx.Create(&models.FileContent{FileID: fileDB.Id, Content: *content}).Error; err != nil {
+				return err
+			}
+		}
+		if fileIn.UploadId != "" && fileDB.Type == "file" {
+			if err := tx.Where("upload_id = ?", fileIn.UploadId).Where("user_id = ?", userId).
+				Delete(&models.UploadSession{}).Error; err != nil {
+				return err
+			}
+			return tx.Where("upload_id = ?", fileIn.UploadId).Where("user_id = ?", userId).
+				Delete(&models.Upload{}).Error
+		}
+		return nil
+	})
+
+	if err != nil && err != errDryRun {
 		if database.IsKeyConflictErr(err) {
 			return nil, &types.AppError{Error: database.ErrKeyConflict, Code: http.StatusConflict}
 		}
+		if isEntryLimitErr(err) {
+			return nil, &types.AppError{Error: err, Code: http.StatusForbidden}
+		}
 		return nil, &types.AppError{Error: err}
 	}
 
+	if fileIn.UploadId != "" && fileDB.Type == "file" && !fileIn.DryRun {
+		finishUploadProgress(fs.cache, userId, fileIn.UploadId, ProgressFinalized, fileDB.Id)
+	}
+
 	res := mapper.ToFileOut(fileDB)
 
+	res.Conflict = fileIn.Conflict
+	res.Replaced = replaced
+
+	if fileDB.Type == "file" && !fileIn.DryRun {
+		fs.events.Emit(events.New(events.UploadCompleted, userId, schemas.UploadEvent{File: res, UploadId: fileIn.UploadId}))
+	}
+
+	if fileIn.DryRun {
+		res.Id = ""
+		res.Version = 0
+		res.DryRun = true
+	}
+
 	return res, nil
 }
 
@@ -168,30 +377,156 @@ func (fs *FileService) UpdateFile(id string, userId int64, update *schemas.FileU
 		chain *gorm.DB
 	)
 
-	updateDb := models.File{
-		Name:      update.Name,
-		UpdatedAt: update.UpdatedAt,
-		Size:      update.Size,
-	}
+	updateDb := map[string]any{}
 
+	if update.Name != "" {
+		if fs.cnf != nil {
+			var kinds []string
+			if err := fs.db.Model(&models.File{}).Where("id = ?", id).Pluck("type", &kinds).Error; err != nil {
+				return nil, &types.AppError{Error: err}
+			}
+			if len(kinds) > 0 && kinds[0] == "file" {
+				if err := checkFileType(fs.db, fs.cache, &fs.cnf.TG, userId, update.Name); err != nil {
+					return nil, &types.AppError{Error: err, Code: http.StatusUnsupportedMediaType}
+				}
+			}
+		}
+		updateDb["name"] = update.Name
+	}
+	if !update.UpdatedAt.IsZero() {
+		updateDb["updated_at"] = update.UpdatedAt
+	}
+	if update.Size != nil {
+		updateDb["size"] = *update.Size
+	}
 	if len(update.Parts) > 0 {
-		updateDb.Parts = datatypes.NewJSONSlice(update.Parts)
+		updateDb["parts"] = datatypes.NewJSONSlice(update.Parts)
+		updateDb["inline_data"] = nil
+	}
+
+	if update.ResetDefaults || update.DefaultChannelID != nil || update.DefaultEncrypted != nil ||
+		update.DefaultReplicaChannels != nil {
+		if appErr := fs.validateFolderDefaults(id, userId, update); appErr != nil {
+			return nil, appErr
+		}
+		if update.ResetDefaults {
+			updateDb["default_channel_id"] = nil
+			updateDb["default_encrypted"] = nil
+			updateDb["default_replica_channels"] = nil
+		}
+		if update.DefaultReplicaChannels != nil {
+			updateDb["default_replica_channels"] = datatypes.NewJSONSlice(*update.DefaultReplicaChannels)
+		}
+		if update.DefaultChannelID != nil {
+			updateDb["default_channel_id"] = *update.DefaultChannelID
+		}
+		if update.DefaultEncrypted != nil {
+			updateDb["default_encrypted"] = *update.DefaultEncrypted
+		}
 	}
-	chain = fs.db.Model(&files).Clauses(clause.Returning{}).Where("id = ?", id).Updates(updateDb)
+
+	if update.IfMatch != "" {
+		var versions []int64
+		if err := fs.db.Model(&models.File{}).Where("id = ?", id).Pluck("version", &versions).Error; err != nil {
+			return nil, &types.AppError{Error: err}
+		}
+		if len(versions) == 0 {
+			return nil, &types.AppError{Error: database.ErrNotFound, Code: http.StatusNotFound}
+		}
+		if !ETagMatches(update.IfMatch, FileETag(id, versions[0])) {
+			return nil, &types.AppError{Error: ErrPreconditionFailed, Code: http.StatusPreconditionFailed}
+		}
+		if update.Version == nil {
+			update.Version = &versions[0]
+		}
+	}
+
+	chain = fs.db.Model(&files).Clauses(clause.Returning{}).Where("id = ?", id)
+
+	if update.Version != nil {
+		chain = chain.Where("version = ?", *update.Version)
+	}
+
+	chain = chain.Updates(updateDb)
 
 	if chain.Error != nil {
 		return nil, &types.AppError{Error: chain.Error}
 	}
 	if chain.RowsAffected == 0 {
+		if update.Version != nil {
+			var count int64
+			fs.db.Model(&models.File{}).Where("id = ?", id).Count(&count)
+			if count > 0 && update.IfMatch != "" {
+				return nil, &types.AppError{Error: ErrPreconditionFailed, Code: http.StatusPreconditionFailed}
+			}
+			if count > 0 {
+				return nil, &types.AppError{Error: database.ErrStaleVersion, Code: http.StatusConflict}
+			}
+		}
 		return nil, &types.AppError{Error: database.ErrNotFound, Code: http.StatusNotFound}
 	}
 
 	fs.cache.Delete(fmt.Sprintf("files:%s", id))
 
+	if update.Name != "" {
+		shares, err := detachShares(fs.db, userId, []string{id}, false)
+		if err != nil {
+			return nil, &types.AppError{Error: err}
+		}
+		fs.clearShareCache(shares)
+	}
+
 	return mapper.ToFileOut(files[0]), nil
 
 }
 
+// FileETag is the entity tag of a file's metadata. It changes whenever the
+// database bumps the file version.
+func FileETag(id string, version int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d", id, version)))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// ETagMatches reports whether an If-Match or If-None-Match header value lists
+// etag. Weak tags compare by their opaque value.
+func ETagMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// validateFolderDefaults checks that upload defaults are only set on folders
+// and only point at channels of the user.
+func (fs *FileService) validateFolderDefaults(id string, userId int64, update *schemas.FileUpdate) *types.AppError {
+	var fileTypes []string
+	if err := fs.db.Model(&models.File{}).Where("id = ?", id).Where("user_id = ?", userId).
+		Pluck("type", &fileTypes).Error; err != nil {
+		return &types.AppError{Error: err}
+	}
+	if len(fileTypes) == 0 {
+		return &types.AppError{Error: database.ErrNotFound, Code: http.StatusNotFound}
+	}
+	if fileTypes[0] != "folder" {
+		return &types.AppError{Error: ErrFolderDefaults, Code: http.StatusBadRequest}
+	}
+	if update.DefaultChannelID != nil {
+		if err := checkChannelAccess(fs.db, fs.cache, userId, *update.DefaultChannelID); err != nil {
+			return channelAccessError(err)
+		}
+	}
+	if update.DefaultReplicaChannels != nil {
+		if err := checkReplicaChannels(fs.db, fs.cache, userId, *update.DefaultReplicaChannels); err != nil {
+			return uploadSettingsError(err)
+		}
+	}
+	return nil
+}
+
 func (fs *FileService) GetFileByID(id string) (*schemas.FileOutFull, *types.AppError) {
 	var result []schemas.FileOutFull
 	if err := fs.db.Model(&models.File{}).Select("*", "(select get_path_from_file_id as path from teldrive.get_path_from_file_id(id))").
@@ -202,14 +537,215 @@ func (fs *FileService) GetFileByID(id string) (*schemas.FileOutFull, *types.AppE
 		return nil, &types.AppError{Error: database.ErrNotFound, Code: http.StatusNotFound}
 	}
 
+	result[0].Replication = replicationStatus(result[0].Parts)
+
 	return &result[0], nil
 }
 
+// ListRecent returns the user's most recently created or accessed files across
+// all folders.
+func (fs *FileService) ListRecent(userId int64, query *schemas.RecentQuery) ([]schemas.FileOut, *types.AppError) {
+	limit := query.Limit
+	if limit == 0 {
+		limit = 50
+	}
+
+	chain := fs.db.Model(&models.File{}).Where("user_id = ?", userId).
+		Where("type = ?", "file").Where("status = ?", "active")
+
+	if query.By == "accessed" {
+		chain = chain.Where("last_accessed_at IS NOT NULL").Order("last_accessed_at DESC")
+	} else {
+		chain = chain.Order("created_at DESC")
+	}
+
+	files := []schemas.FileOut{}
+
+	if err := chain.Limit(limit).Scan(&files).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	return files, nil
+}
+
+// MarkAccessed records that a file was served. Writes are debounced so a file
+// being streamed in many range requests is updated at most once per interval.
+func (fs *FileService) MarkAccessed(id string) {
+	key := fmt.Sprintf("files:accessed:%s", id)
+
+	var seen bool
+	if err := fs.cache.Get(key, &seen); err == nil {
+		return
+	}
+	fs.cache.Set(key, true, accessDebounce)
+
+	fs.db.Model(&models.File{}).Where("id = ?", id).
+		Where("last_accessed_at IS NULL OR last_accessed_at < ?", time.Now().UTC().Add(-accessDebounce)).
+		UpdateColumn("last_accessed_at", time.Now().UTC())
+}
+
 func (fs *FileService) ListFiles(userId int64, fquery *schemas.FileQuery) (*schemas.FileResponse, *types.AppError) {
 
+	if err := normalizeSort(fquery); err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+
+	query, appErr := fs.fileFilter(userId, fquery)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	orderField := utils.CamelToSnake(fquery.Sort)
+	direction := strings.ToUpper(fquery.Order)
+
+	var op string
+
+	if fquery.Page == 1 {
+		if fquery.Order == "asc" {
+			op = ">="
+		} else {
+			op = "<="
+		}
+	} else {
+		if fquery.Order == "asc" {
+			op = ">"
+		} else {
+			op = "<"
+		}
+
+	}
+
+	fileQuery := fs.fileQueryBase(userId, fquery)
+
+	columns := []string{"*", "(select total from ranked_scores limit 1) as total"}
+	if fquery.Recursive {
+		columns = append(columns, parentPathColumn)
+	}
+
+	fileQuery = fileQuery.Clauses(exclause.NewWith("ranked_scores", fs.db.Model(&models.File{}).Select(orderField, "id", "count(*) OVER () as total",
+		fmt.Sprintf("ROW_NUMBER() OVER (ORDER BY %s %s, id %s) AS rank", orderField, direction, direction)).Where(query))).
+		Model(&models.File{}).Select(columns).
+		Where(fmt.Sprintf("(%s, id) %s (SELECT %s, id FROM ranked_scores WHERE rank = ?)", orderField, op, orderField),
+			max((fquery.Page-1)*fquery.Limit, 1)).
+		Where(query).Order(getOrder(fquery)).Limit(fquery.Limit)
+
+	files := []schemas.FileOut{}
+
+	if err := fileQuery.Scan(&files).Error; err != nil {
+		if strings.Contains(err.Error(), "file not found") {
+			return nil, &types.AppError{Error: database.ErrNotFound, Code: http.StatusNotFound}
+		}
+		return nil, &types.AppError{Error: err}
+	}
+
+	count := 0
+
+	if len(files) > 0 {
+		count = files[0].Total
+	}
+
+	for i := range files {
+		files[i].Total = 0
+	}
+
+	if fquery.IncludeAncestors {
+		refs := make([]*schemas.FileOut, len(files))
+		for i := range files {
+			refs[i] = &files[i]
+		}
+		if err := fs.attachAncestors(userId, refs); err != nil {
+			return nil, &types.AppError{Error: err}
+		}
+	}
+
+	res := &schemas.FileResponse{Files: files,
+		Meta: schemas.Meta{Count: count, TotalPages: int(math.Ceil(float64(count) / float64(fquery.Limit))),
+			CurrentPage: fquery.Page}}
+
+	return res, nil
+}
+
+// StreamFiles writes every file matching fquery as newline-delimited JSON while
+// it is read from the database cursor, ignoring pagination. Once the first line
+// is sent a failure can no longer change the status, so it is reported as a
+// final {"error": ...} line instead.
+func (fs *FileService) StreamFiles(c *gin.Context, userId int64, fquery *schemas.FileQuery) {
+
+	if err := normalizeSort(fquery); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	query, appErr := fs.fileFilter(userId, fquery)
+	if appErr != nil {
+		httputil.NewError(c, appErr.Code, appErr.Error)
+		return
+	}
+
+	columns := []string{"*"}
+	if fquery.Recursive {
+		columns = append(columns, parentPathColumn)
+	}
+
+	rows, err := fs.fileQueryBase(userId, fquery).Model(&models.File{}).Select(columns).Where(query).
+		Order(getOrder(fquery)).Rows()
+	if err != nil {
+		if strings.Contains(err.Error(), "file not found") {
+			err = database.ErrNotFound
+		}
+		httputil.NewError(c, 0, err)
+		return
+	}
+	defer rows.Close()
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Status(http.StatusOK)
+
+	enc := json.NewEncoder(c.Writer)
+
+	n := 0
+	for rows.Next() {
+		var file schemas.FileOut
+		if err = fs.db.ScanRows(rows, &file); err != nil {
+			break
+		}
+		if err = enc.Encode(file); err != nil {
+			return
+		}
+		n++
+		if n%streamFlushRows == 0 {
+			c.Writer.Flush()
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if err != nil {
+		enc.Encode(gin.H{"error": httputil.ErrorBody(c, 0, err)})
+	}
+	c.Writer.Flush()
+}
+
+// fileFilter builds the conditions of a ListFiles query.
+func (fs *FileService) fileFilter(userId int64, fquery *schemas.FileQuery) (*gorm.DB, *types.AppError) {
+
 	query := fs.db.Where("user_id = ?", userId).Where("status = ?", "active")
 
-	if fquery.Op == "list" {
+	if fquery.Op == "list" && fquery.Recursive {
+		if fquery.Path != "" || fquery.ParentID != "" {
+			query.Where("parent_id in (select id from subdirs)")
+		}
+		if fquery.Type != "" {
+			query.Where("type = ?", fquery.Type)
+		}
+		if fquery.Query != "" {
+			query = query.Where(fs.searchFilter(fquery))
+		}
+		if fquery.Category != "" {
+			query.Where(fs.categoryFilter(fquery.Category))
+		}
+	} else if fquery.Op == "list" {
 		if fquery.Path != "" && fquery.ParentID == "" {
 			query.Where("parent_id in (SELECT id FROM teldrive.get_file_from_path(?, ?, ?))", fquery.Path, userId, true)
 		}
@@ -248,27 +784,11 @@ func (fs *FileService) ListFiles(userId int64, fquery *schemas.FileQuery) (*sche
 		}
 
 		if fquery.Query != "" {
-			query = query.Where("name &@~ REGEXP_REPLACE(?, '[.,-_]', ' ', 'g')", strings.ToLower(fquery.Query))
+			query = query.Where(fs.searchFilter(fquery))
 		}
 
 		if fquery.Category != "" {
-			categories := strings.Split(fquery.Category, ",")
-			var filterQuery *gorm.DB
-			if categories[0] == "folder" {
-				filterQuery = fs.db.Where("type = ?", categories[0])
-			} else {
-				filterQuery = fs.db.Where("category = ?", categories[0])
-			}
-			if len(categories) > 1 {
-				for _, category := range categories[1:] {
-					if category == "folder" {
-						filterQuery.Or("type = ?", category)
-					} else {
-						filterQuery.Or("category = ?", category)
-					}
-				}
-			}
-			query.Where(filterQuery)
+			query.Where(fs.categoryFilter(fquery.Category))
 		}
 
 		if fquery.Name != "" {
@@ -289,73 +809,75 @@ func (fs *FileService) ListFiles(userId int64, fquery *schemas.FileQuery) (*sche
 		}
 	}
 
-	orderField := utils.CamelToSnake(fquery.Sort)
-
-	var op string
-
-	if fquery.Page == 1 {
-		if fquery.Order == "asc" {
-			op = ">="
-		} else {
-			op = "<="
-		}
-	} else {
-		if fquery.Order == "asc" {
-			op = ">"
-		} else {
-			op = "<"
-		}
-
+	if fquery.MimeType != "" {
+		query.Where("mime_type LIKE ?", escapeLike(fquery.MimeType)+"%")
 	}
-
-	var fileQuery *gorm.DB
-
-	if fquery.DeepSearch && fquery.Query != "" && fquery.Path != "" {
-		fileQuery = fs.db.Clauses(exclause.With{Recursive: true, CTEs: []exclause.CTE{{Name: "subdirs",
-			Subquery: exclause.Subquery{DB: fs.db.Model(&models.File{}).Select("id", "parent_id").
-				Where("id in (SELECT id FROM teldrive.get_file_from_path(?, ?, ?))", fquery.Path, userId, true).
-				Clauses(exclause.NewUnion("ALL ?",
-					fs.db.Table("teldrive.files as f").Select("f.id", "f.parent_id").
-						Joins("inner join subdirs ON f.parent_id = subdirs.id")))}}}})
+	if fquery.MinSize != nil {
+		query.Where("size >= ?", *fquery.MinSize)
 	}
-
-	if fileQuery == nil {
-		fileQuery = fs.db
+	if fquery.MaxSize != nil {
+		query.Where("size <= ?", *fquery.MaxSize)
 	}
 
-	fileQuery = fileQuery.Clauses(exclause.NewWith("ranked_scores", fs.db.Model(&models.File{}).Select(orderField, "count(*) OVER () as total",
-		fmt.Sprintf("ROW_NUMBER() OVER (ORDER BY %s %s) AS rank", orderField, strings.ToUpper(fquery.Order))).Where(query))).
-		Model(&models.File{}).Select("*", "(select total from ranked_scores limit 1) as total").
-		Where(fmt.Sprintf("%s %s (SELECT %s FROM ranked_scores WHERE rank = ?)", orderField, op, orderField),
-			max((fquery.Page-1)*fquery.Limit, 1)).
-		Where(query).Order(getOrder(fquery)).Limit(fquery.Limit)
+	return query, nil
+}
 
-	files := []schemas.FileOut{}
+// searchFilter matches the name, and with Content set the indexed content,
+// of files against the query of fquery.
+func (fs *FileService) searchFilter(fquery *schemas.FileQuery) *gorm.DB {
+	search := fs.db.Where("name &@~ REGEXP_REPLACE(?, '[.,-_]', ' ', 'g')", strings.ToLower(fquery.Query))
+	if fquery.Content {
+		search.Or("id in (SELECT file_id FROM teldrive.file_contents WHERE content &@~ ?)", fquery.Query)
+	}
+	return search
+}
 
-	if err := fileQuery.Scan(&files).Error; err != nil {
-		if strings.Contains(err.Error(), "file not found") {
-			return nil, &types.AppError{Error: database.ErrNotFound, Code: http.StatusNotFound}
+// categoryFilter matches entries in any of the comma separated categories,
+// folder standing for every folder.
+func (fs *FileService) categoryFilter(categories string) *gorm.DB {
+	var filterQuery *gorm.DB
+	for i, category := range strings.Split(categories, ",") {
+		column := "category = ?"
+		if category == "folder" {
+			column = "type = ?"
+		}
+		if i == 0 {
+			filterQuery = fs.db.Where(column, category)
+		} else {
+			filterQuery.Or(column, category)
 		}
-		return nil, &types.AppError{Error: err}
 	}
+	return filterQuery
+}
 
-	count := 0
-
-	if len(files) > 0 {
-		count = files[0].Total
+// fileQueryBase returns the session a ListFiles query starts from, declaring
+// the recursive subdirs CTE for deep searches and recursive listings.
+func (fs *FileService) fileQueryBase(userId int64, fquery *schemas.FileQuery) *gorm.DB {
+	var root *gorm.DB
+	switch {
+	case fquery.Op == "list" && fquery.Recursive && fquery.ParentID != "":
+		root = fs.db.Model(&models.File{}).Select("id", "parent_id").
+			Where("id = ?", fquery.ParentID).Where("user_id = ?", userId)
+	case fquery.Op == "list" && fquery.Recursive && fquery.Path != "",
+		fquery.DeepSearch && fquery.Query != "" && fquery.Path != "":
+		root = fs.db.Model(&models.File{}).Select("id", "parent_id").
+			Where("id in (SELECT id FROM teldrive.get_file_from_path(?, ?, ?))", fquery.Path, userId, true)
 	}
-
-	for i := range files {
-		files[i].Total = 0
+	if root == nil {
+		return fs.db
 	}
-
-	res := &schemas.FileResponse{Files: files,
-		Meta: schemas.Meta{Count: count, TotalPages: int(math.Ceil(float64(count) / float64(fquery.Limit))),
-			CurrentPage: fquery.Page}}
-
-	return res, nil
+	return fs.db.Clauses(exclause.With{Recursive: true, CTEs: []exclause.CTE{{Name: "subdirs",
+		Subquery: exclause.Subquery{DB: root.
+			Clauses(exclause.NewUnion("ALL ?",
+				fs.db.Table("teldrive.files as f").Select("f.id", "f.parent_id").
+					Joins("inner join subdirs ON f.parent_id = subdirs.id")))}}}})
 }
 
+// parentPathColumn selects the path of each file's folder so flat listings
+// can show where a file lives.
+const parentPathColumn = `(select case when p.parent_id is null then '/' else teldrive.get_path_from_file_id(p.id) end
+	from teldrive.files p where p.id = files.parent_id) as parent_path`
+
 func (fs *FileService) getFileFromPath(path string, userId int64) (*models.File, error) {
 
 	var res []models.File
@@ -372,11 +894,13 @@ func (fs *FileService) getFileFromPath(path string, userId int64) (*models.File,
 }
 
 func (fs *FileService) MakeDirectory(userId int64, payload *schemas.MkDir) (*schemas.FileOut, *types.AppError) {
-	var files []models.File
+	if err := checkDepth(pathDepth(payload.Path), fs.maxDepth()); err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
 
-	if err := fs.db.Raw("select * from teldrive.create_directories(?, ?)", userId, payload.Path).
-		Scan(&files).Error; err != nil {
-		return nil, &types.AppError{Error: err}
+	files, err := createDirectories(fs.db, fs.cache, fs.cnf, userId, payload.Path)
+	if err != nil {
+		return nil, entryLimitAppError(err)
 	}
 
 	file := mapper.ToFileOut(files[0])
@@ -384,29 +908,104 @@ func (fs *FileService) MakeDirectory(userId int64, payload *schemas.MkDir) (*sch
 	return file, nil
 }
 
-func (fs *FileService) MoveFiles(userId int64, payload *schemas.FileOperation) (*schemas.Message, *types.AppError) {
+func (fs *FileService) MoveFiles(userId int64, payload *schemas.FileOperation) (*schemas.OperationResult, *types.AppError) {
 
-	if err := fs.db.Exec("select * from teldrive.move_items($1 , $2 , $3)", payload.Files, payload.Destination, userId).Error; err != nil {
-		return nil, &types.AppError{Error: err}
+	var (
+		result *schemas.OperationResult
+		shares []string
+	)
+
+	err := fs.db.Transaction(func(tx *gorm.DB) error {
+		if err := checkVersions(tx, userId, payload.Versions); err != nil {
+			return err
+		}
+		var err error
+		if result, err = previewMove(tx, userId, payload.Files, payload.Destination); err != nil {
+			return err
+		}
+		if payload.DryRun {
+			return errDryRun
+		}
+		if len(result.Conflicts) > 0 {
+			return &OperationError{result: result}
+		}
+		if err := checkMoveDepth(tx, userId, payload.Files, payload.Destination, fs.maxDepth()); err != nil {
+			return err
+		}
+		if err := tx.Exec("select * from teldrive.move_items($1 , $2 , $3)", payload.Files, payload.Destination, userId).Error; err != nil {
+			return err
+		}
+		shares, err = detachShares(tx, userId, payload.Files, payload.RevokeShares)
+		return err
+	})
+
+	if appErr := operationError(err); appErr != nil {
+		return nil, appErr
 	}
 
-	return &schemas.Message{Message: "files moved"}, nil
+	fs.clearShareCache(shares)
+
+	result.Message = "files moved"
+	result.DryRun = payload.DryRun
+
+	return result, nil
 }
 
-func (fs *FileService) DeleteFiles(userId int64, payload *schemas.DeleteOperation) (*schemas.Message, *types.AppError) {
+func (fs *FileService) DeleteFiles(userId int64, payload *schemas.DeleteOperation) (*schemas.OperationResult, *types.AppError) {
 
-	if payload.Source != "" {
-		if err := fs.db.Exec("call teldrive.delete_folder_recursive($1 , $2)", payload.Source, userId).Error; err != nil {
-			return nil, &types.AppError{Error: err}
+	var result *schemas.OperationResult
+
+	err := fs.db.Transaction(func(tx *gorm.DB) error {
+		if err := checkVersions(tx, userId, payload.Versions); err != nil {
+			return err
 		}
-	} else if payload.Source == "" && len(payload.Files) > 0 {
-		if err := fs.db.Exec("call teldrive.delete_files_bulk($1 , $2)", payload.Files, userId).Error; err != nil {
-			return nil, &types.AppError{Error: err}
+		var err error
+		if result, err = previewDelete(tx, userId, payload); err != nil {
+			return err
 		}
+		if payload.DryRun {
+			return errDryRun
+		}
+		if payload.Source != "" {
+			if len(result.Files) == 0 {
+				return database.ErrNotFound
+			}
+			return tx.Exec("call teldrive.delete_folder_recursive($1 , $2)", payload.Source, userId).Error
+		} else if len(payload.Files) > 0 {
+			return tx.Exec("call teldrive.delete_files_bulk($1 , $2)", payload.Files, userId).Error
+		}
+		return nil
+	})
 
+	if appErr := operationError(err); appErr != nil {
+		return nil, appErr
 	}
 
-	return &schemas.Message{Message: "files deleted"}, nil
+	result.Message = "files deleted"
+	result.DryRun = payload.DryRun
+
+	if !payload.DryRun {
+		for _, file := range result.Files {
+			fs.events.Emit(events.New(events.FileDeleted, userId, file))
+		}
+	}
+
+	return result, nil
+}
+
+func operationError(err error) *types.AppError {
+	var opErr *OperationError
+	switch {
+	case err == nil, err == errDryRun:
+		return nil
+	case err == database.ErrStaleVersion, errors.As(err, &opErr):
+		return &types.AppError{Error: err, Code: http.StatusConflict}
+	case database.IsRecordNotFoundErr(err):
+		return &types.AppError{Error: err, Code: http.StatusNotFound}
+	case errors.Is(err, ErrFolderDepth):
+		return &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+	return &types.AppError{Error: err}
 }
 
 func (fs *FileService) CreateShare(fileId string, userId int64, payload *schemas.FileShareIn) *types.AppError {
@@ -424,6 +1023,15 @@ func (fs *FileService) CreateShare(fileId string, userId int64, payload *schemas
 	fileShare.FileID = fileId
 	fileShare.ExpiresAt = payload.ExpiresAt
 	fileShare.UserID = userId
+	fileShare.FollowsFile = payload.ShareFollowsFile
+	fileShare.MaxDownloads = payload.MaxDownloads
+
+	if payload.DownloadName != "" {
+		if err := checkDownloadName(payload.DownloadName); err != nil {
+			return &types.AppError{Error: err, Code: http.StatusBadRequest}
+		}
+		fileShare.DownloadName = &payload.DownloadName
+	}
 
 	if err := fs.db.Create(&fileShare).Error; err != nil {
 		return &types.AppError{Error: err}
@@ -445,12 +1053,28 @@ func (fs *FileService) UpdateShare(fileId string, userId int64, payload *schemas
 	}
 
 	fileShareUpdate.ExpiresAt = payload.ExpiresAt
+	fileShareUpdate.FollowsFile = payload.ShareFollowsFile
+	fileShareUpdate.MaxDownloads = payload.MaxDownloads
 
-	if err := fs.db.Model(&models.FileShare{}).Where("file_id = ?", fileId).Where("user_id = ?", userId).
+	if payload.DownloadName != "" {
+		if err := checkDownloadName(payload.DownloadName); err != nil {
+			return &types.AppError{Error: err, Code: http.StatusBadRequest}
+		}
+		fileShareUpdate.DownloadName = &payload.DownloadName
+	}
+
+	var updated []models.FileShare
+
+	if err := fs.db.Model(&updated).Clauses(clause.Returning{Columns: []clause.Column{{Name: "id"}}}).
+		Where("file_id = ?", fileId).Where("user_id = ?", userId).
 		Updates(fileShareUpdate).Error; err != nil {
 		return &types.AppError{Error: err}
 	}
 
+	for _, share := range updated {
+		fs.cache.Delete(fmt.Sprintf("shares:%s", share.ID))
+	}
+
 	return nil
 }
 
@@ -467,38 +1091,143 @@ func (fs *FileService) GetShareByFileId(fileId string, userId int64) (*schemas.F
 		return nil, nil
 	}
 
-	res := &schemas.FileShareOut{ID: result[0].ID, ExpiresAt: result[0].ExpiresAt, Protected: result[0].Password != nil}
+	return toShareOut(&result[0]), nil
+}
+
+func (fs *FileService) DeleteShare(fileId string, userId int64) *types.AppError {
+
+	var deleted []models.FileShare
+
+	if err := fs.db.Clauses(clause.Returning{}).Where("file_id = ?", fileId).Where("user_id = ?", userId).
+		Delete(&deleted).Error; err != nil {
+		return &types.AppError{Error: err}
+	}
+
+	for _, share := range deleted {
+		fs.cache.Delete(fmt.Sprintf("shares:%s", share.ID))
+	}
+
+	return nil
+}
+
+// ListFileShares returns the shares of a file that have not expired.
+func (fs *FileService) ListFileShares(fileId string, userId int64) ([]schemas.FileShareOut, *types.AppError) {
+
+	var result []models.FileShare
+
+	if err := fs.db.Model(&models.FileShare{}).Where("file_id = ?", fileId).Where("user_id = ?", userId).
+		Where("expires_at is null or expires_at > ?", time.Now().UTC()).Order("created_at").
+		Find(&result).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	res := make([]schemas.FileShareOut, 0, len(result))
+	for i := range result {
+		res = append(res, *toShareOut(&result[i]))
+	}
+	return res, nil
+}
+
+// RevokeFileShares deletes every share of a file and, when recursive is set,
+// of everything below it.
+func (fs *FileService) RevokeFileShares(fileId string, userId int64, recursive bool) (*schemas.Message, *types.AppError) {
+
+	var (
+		revoked []string
+		err     error
+	)
+
+	if recursive {
+		revoked, err = detachShares(fs.db, userId, []string{fileId}, true)
+	} else {
+		err = fs.db.Raw("delete from teldrive.file_shares where file_id = ? and user_id = ? returning id",
+			fileId, userId).Scan(&revoked).Error
+	}
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	fs.clearShareCache(revoked)
 
-	return res, nil
+	return &schemas.Message{Message: fmt.Sprintf("%d shares revoked", len(revoked))}, nil
 }
 
-func (fs *FileService) DeleteShare(fileId string, userId int64) *types.AppError {
-
-	var deletedShare models.FileShare
-
-	if err := fs.db.Clauses(clause.Returning{}).Where("file_id = ?", fileId).Where("user_id = ?", userId).
-		Delete(&deletedShare).Error; err != nil {
-		return &types.AppError{Error: err}
+func toShareOut(share *models.FileShare) *schemas.FileShareOut {
+	out := &schemas.FileShareOut{
+		ID:               share.ID,
+		ExpiresAt:        share.ExpiresAt,
+		Protected:        share.Password != nil,
+		ShareFollowsFile: share.FollowsFile == nil || *share.FollowsFile,
+		MaxDownloads:     share.MaxDownloads,
+		Downloads:        share.Downloads,
+	}
+	if share.DownloadName != nil {
+		out.DownloadName = *share.DownloadName
 	}
+	return out
+}
 
-	if deletedShare.ID != "" {
-		fs.cache.Delete(fmt.Sprintf("shares:%s", deletedShare.ID))
+// sharedTreeCTE selects the given files of a user and everything below them.
+const sharedTreeCTE = `WITH RECURSIVE tree AS (
+	SELECT id FROM teldrive.files WHERE id = ANY(@ids::uuid[]) AND user_id = @userId
+	UNION ALL
+	SELECT f.id FROM teldrive.files f JOIN tree ON f.parent_id = tree.id
+)`
+
+// detachShares runs after files were moved or renamed. It deletes the shares
+// of the files and their descendants that do not follow the file, or all of
+// them when revokeAll is set, and returns the ids of every affected share so
+// cached share paths can be dropped.
+func detachShares(tx *gorm.DB, userId int64, fileIds []string, revokeAll bool) ([]string, error) {
+	var affected []string
+	if len(fileIds) == 0 {
+		return affected, nil
+	}
+	args := map[string]any{"ids": fileIds, "userId": userId, "all": revokeAll}
+	if err := tx.Raw(sharedTreeCTE+` SELECT s.id FROM teldrive.file_shares s JOIN tree ON s.file_id = tree.id`,
+		args).Scan(&affected).Error; err != nil {
+		return nil, err
+	}
+	if len(affected) == 0 {
+		return affected, nil
+	}
+	if err := tx.Exec(sharedTreeCTE+` DELETE FROM teldrive.file_shares s USING tree
+		WHERE s.file_id = tree.id AND (@all OR NOT s.follows_file)`, args).Error; err != nil {
+		return nil, err
 	}
+	return affected, nil
+}
 
-	return nil
+func (fs *FileService) clearShareCache(shareIds []string) {
+	for _, id := range shareIds {
+		fs.cache.Delete(fmt.Sprintf("shares:%s", id))
+	}
 }
 
 func (fs *FileService) UpdateParts(c *gin.Context, id string, userId int64, payload *schemas.PartUpdate) (*schemas.Message, *types.AppError) {
 
 	var file models.File
 
+	if fs.cnf != nil {
+		if err := checkUploadLimits(&fs.cnf.TG, 0, payload.Size, len(payload.Parts)); err != nil {
+			return nil, &types.AppError{Error: err, Code: http.StatusRequestEntityTooLarge}
+		}
+	}
+
 	updatePayload := models.File{
 		UpdatedAt: payload.UpdatedAt,
 		Size:      utils.Int64Pointer(payload.Size),
+		Hash:      normalizeHash(payload.Hash),
 	}
+	updatePayload.HashAlgorithm = hashAlgorithm(updatePayload.Hash, payload.HashAlgorithm)
+
+	// The stored hash describes the old content, so it is replaced or cleared,
+	// and content kept inline gives way to the new parts.
+	columns := []string{"updated_at", "size", "hash", "hash_algorithm", "inline_data"}
 
 	if len(payload.Parts) > 0 {
 		updatePayload.Parts = datatypes.NewJSONSlice(payload.Parts)
+		columns = append(columns, "parts")
 	}
 
 	err := fs.db.Transaction(func(tx *gorm.DB) error {
@@ -507,12 +1236,13 @@ func (fs *FileService) UpdateParts(c *gin.Context, id string, userId int64, payl
 			return err
 		}
 
-		if err := tx.Model(models.File{}).Where("id = ?", id).Updates(updatePayload).Error; err != nil {
+		if err := tx.Model(models.File{}).Where("id = ?", id).Select(columns).Updates(updatePayload).Error; err != nil {
 			return err
 		}
 
 		if payload.UploadId != "" {
-			if err := tx.Where("upload_id = ?", payload.UploadId).Delete(&models.Upload{}).Error; err != nil {
+			if err := tx.Where("upload_id = ?", payload.UploadId).Where("user_id = ?", userId).
+				Delete(&models.Upload{}).Error; err != nil {
 				return err
 			}
 		}
@@ -524,14 +1254,22 @@ func (fs *FileService) UpdateParts(c *gin.Context, id string, userId int64, payl
 		return nil, &types.AppError{Error: err}
 	}
 
+	if payload.UploadId != "" {
+		finishUploadProgress(fs.cache, userId, payload.UploadId, ProgressFinalized, id)
+	}
+
 	if len(file.Parts) > 0 && file.ChannelID != nil {
 		_, session := auth.GetUser(c)
 		ids := []int{}
 		for _, part := range file.Parts {
 			ids = append(ids, int(part.ID))
 		}
-		client, _ := tgc.AuthClient(c, &fs.cnf.TG, session)
-		tgc.DeleteMessages(c, client, *file.ChannelID, ids)
+		fs.clients.Run(c, fs.clients.UserSpec(session), func(ctx context.Context, client *telegram.Client) error {
+			if err := tgc.DeleteMessages(ctx, client.API(), *file.ChannelID, ids); err != nil {
+				return err
+			}
+			return deleteReplicas(ctx, client.API(), file.Parts)
+		})
 		keys := []string{fmt.Sprintf("files:%s", id), fmt.Sprintf("files:messages:%s:%d", id, userId)}
 		for _, part := range file.Parts {
 			keys = append(keys, fmt.Sprintf("files:location:%d:%s:%d", userId, id, part.ID))
@@ -547,14 +1285,40 @@ func (fs *FileService) UpdateParts(c *gin.Context, id string, userId int64, payl
 
 func (fs *FileService) MoveDirectory(userId int64, payload *schemas.DirMove) (*schemas.Message, *types.AppError) {
 
-	if err := fs.db.Exec("select * from teldrive.move_directory(? , ? , ?)", payload.Source,
-		payload.Destination, userId).Error; err != nil {
+	var shares []string
+
+	if err := fs.db.Transaction(func(tx *gorm.DB) error {
+		var ids []string
+		if err := tx.Raw("select id from teldrive.get_file_from_path(?, ?, ?)", payload.Source, userId, false).
+			Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		// The source becomes the destination folder, its subfolders land
+		// one level below it.
+		if err := checkMoveDepth(tx, userId, ids, path.Dir(path.Clean("/"+payload.Destination)), fs.maxDepth()); err != nil {
+			return err
+		}
+		if err := tx.Exec("select * from teldrive.move_directory(? , ? , ?)", payload.Source,
+			payload.Destination, userId).Error; err != nil {
+			return err
+		}
+		var err error
+		shares, err = detachShares(tx, userId, ids, false)
+		return err
+	}); err != nil {
+		if errors.Is(err, ErrFolderDepth) {
+			return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+		}
 		return nil, &types.AppError{Error: err}
 	}
 
+	fs.clearShareCache(shares)
+
 	return &schemas.Message{Message: "directory moved"}, nil
 }
 
+// GetCategoryStats sums the stored file sizes, the logical sizes clients see,
+// not the bytes encryption adds in Telegram.
 func (fs *FileService) GetCategoryStats(userId int64) ([]schemas.FileCategoryStats, *types.AppError) {
 
 	var stats []schemas.FileCategoryStats
@@ -578,8 +1342,6 @@ func (fs *FileService) CopyFile(c *gin.Context) (*schemas.FileOut, *types.AppErr
 
 	userId, session := auth.GetUser(c)
 
-	client, _ := tgc.AuthClient(c, &fs.cnf.TG, session)
-
 	var res []models.File
 
 	if err := fs.db.Model(&models.File{}).Where("id = ?", payload.ID).Find(&res).Error; err != nil {
@@ -588,6 +1350,15 @@ func (fs *FileService) CopyFile(c *gin.Context) (*schemas.FileOut, *types.AppErr
 
 	file := mapper.ToFileOutFull(res[0])
 
+	// Keys derived for the owner cannot be used by anyone else.
+	if file.UserID != userId && usesUserKey(file) {
+		return nil, &types.AppError{Error: ErrForeignUserKey, Code: http.StatusBadRequest}
+	}
+
+	if err := checkEntryRoom(fs.db, fs.cache, fs.cnf, userId, 1, 0); err != nil {
+		return nil, entryLimitAppError(err)
+	}
+
 	newIds := []schemas.Part{}
 
 	channelId, err := getDefaultChannel(fs.db, fs.cache, userId)
@@ -595,13 +1366,13 @@ func (fs *FileService) CopyFile(c *gin.Context) (*schemas.FileOut, *types.AppErr
 		return nil, &types.AppError{Error: err}
 	}
 
-	err = tgc.RunWithAuth(c, client, "", func(ctx context.Context) error {
+	copyParts := func(ctx context.Context, client *telegram.Client) error {
 		ids := []int{}
 
 		for _, part := range file.Parts {
 			ids = append(ids, int(part.ID))
 		}
-		messages, err := tgc.GetMessages(c, client.API(), ids, *file.ChannelID)
+		messages, err := tgc.GetMessages(ctx, client.API(), ids, *file.ChannelID)
 
 		if err != nil {
 			return err
@@ -642,24 +1413,22 @@ func (fs *FileService) CopyFile(c *gin.Context) (*schemas.FileOut, *types.AppErr
 				}
 
 			}
-			newIds = append(newIds, schemas.Part{ID: int64(msg.ID), Salt: file.Parts[i].Salt})
+			newIds = append(newIds, schemas.Part{ID: int64(msg.ID), Salt: file.Parts[i].Salt,
+				KeyVersion: file.Parts[i].KeyVersion})
 
 		}
 		return nil
-	})
-
-	if err != nil {
-		return nil, &types.AppError{Error: err}
 	}
 
-	var destRes []models.File
+	// Inline content is copied with the row, there are no messages to forward.
+	if file.InlineData == nil {
+		err = fs.clients.Run(c, fs.clients.UserSpec(session), copyParts)
+	}
 
-	if err := fs.db.Raw("select * from teldrive.create_directories(?, ?)", userId, payload.Destination).Scan(&destRes).Error; err != nil {
+	if err != nil {
 		return nil, &types.AppError{Error: err}
 	}
 
-	dest := destRes[0]
-
 	dbFile := models.File{}
 
 	dbFile.Name = payload.Name
@@ -669,16 +1438,31 @@ func (fs *FileService) CopyFile(c *gin.Context) (*schemas.FileOut, *types.AppErr
 	dbFile.Parts = datatypes.NewJSONSlice(newIds)
 	dbFile.UserID = userId
 	dbFile.Status = "active"
-	dbFile.ParentID = sql.NullString{
-		String: dest.Id,
-		Valid:  true,
-	}
 	dbFile.ChannelID = &channelId
 	dbFile.Encrypted = file.Encrypted
+	dbFile.Encryption = file.Encryption
 	dbFile.Category = file.Category
+	dbFile.Hash = res[0].Hash
+	dbFile.HashAlgorithm = res[0].HashAlgorithm
+	dbFile.InlineData = res[0].InlineData
+	dbFile.KeyVersion = res[0].KeyVersion
 
-	if err := fs.db.Create(&dbFile).Error; err != nil {
-		return nil, &types.AppError{Error: err}
+	if err := fs.db.Transaction(func(tx *gorm.DB) error {
+		dest, err := createDirectories(tx, fs.cache, fs.cnf, userId, payload.Destination)
+		if err != nil {
+			return err
+		}
+		dbFile.ParentID = sql.NullString{String: dest[0].Id, Valid: true}
+		if err := tx.Create(&dbFile).Error; err != nil {
+			return err
+		}
+		if err := enforceEntryLimits(tx, fs.cache, fs.cnf, userId, "file"); err != nil {
+			return err
+		}
+		return tx.Exec("INSERT INTO teldrive.file_contents (file_id, content) SELECT ?, content FROM teldrive.file_contents WHERE file_id = ?",
+			dbFile.Id, file.Id).Error
+	}); err != nil {
+		return nil, entryLimitAppError(err)
 	}
 
 	return mapper.ToFileOut(dbFile), nil
@@ -690,52 +1474,15 @@ func (fs *FileService) GetFileStream(c *gin.Context, download bool, sharedFile *
 
 	r := c.Request
 
-	fileID := c.Param("fileID")
-
-	var (
-		session *models.Session
-		err     error
-		appErr  *types.AppError
-		user    *types.JWTClaims
-	)
-
-	if sharedFile == nil {
-		authHash := c.Query("hash")
-
-		if authHash == "" {
-			user, err = auth.VerifyUser(c, fs.db, fs.cache, fs.cnf.JWT.Secret)
-			if err != nil {
-				http.Error(w, "missing session or authash", http.StatusUnauthorized)
-				return
-			}
-			userId, _ := strconv.ParseInt(user.Subject, 10, 64)
-			session = &models.Session{UserId: userId, Session: user.TgSession}
-		} else {
-			session, err = auth.GetSessionByHash(fs.db, fs.cache, authHash)
-			if err != nil {
-				http.Error(w, "invalid hash", http.StatusBadRequest)
-				return
-			}
-		}
-
-	} else {
-
-		session = &models.Session{UserId: sharedFile.UserID}
+	session, file, ok := fs.resolveStreamFile(c, sharedFile)
+	if !ok || !fs.checkStreamKeys(c, session, file) {
+		return
 	}
 
-	file := &schemas.FileOutFull{}
-
-	key := fmt.Sprintf("files:%s", fileID)
-
-	err = fs.cache.Get(key, file)
-
+	fileName, err := downloadName(c, file, sharedFile)
 	if err != nil {
-		file, appErr = fs.GetFileByID(fileID)
-		if appErr != nil {
-			http.Error(w, appErr.Error.Error(), http.StatusBadRequest)
-			return
-		}
-		fs.cache.Set(key, file, 0)
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
 	}
 
 	c.Header("Accept-Ranges", "bytes")
@@ -744,17 +1491,19 @@ func (fs *FileService) GetFileStream(c *gin.Context, download bool, sharedFile *
 
 	rangeHeader := r.Header.Get("Range")
 
+	setDigestHeaders(w.Header(), file.FileOut, rangeHeader == "")
+
 	if file.Size == 0 {
 		c.Header("Content-Type", file.MimeType)
 		c.Header("Content-Length", "0")
 
 		if rangeHeader != "" {
 			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", file.Size))
-			http.Error(w, "Requested Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			httputil.NewError(c, http.StatusRequestedRangeNotSatisfiable, errors.New("Requested Range Not Satisfiable"))
 			return
 		}
 
-		c.Header("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": file.Name}))
+		c.Header("Content-Disposition", httputil.ContentDisposition("inline", fileName))
 		w.WriteHeader(http.StatusOK)
 		return
 	}
@@ -767,15 +1516,15 @@ func (fs *FileService) GetFileStream(c *gin.Context, download bool, sharedFile *
 		ranges, err := http_range.Parse(rangeHeader, file.Size)
 		if err == http_range.ErrNoOverlap {
 			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", file.Size))
-			http.Error(w, http_range.ErrNoOverlap.Error(), http.StatusRequestedRangeNotSatisfiable)
+			httputil.NewError(c, http.StatusRequestedRangeNotSatisfiable, http_range.ErrNoOverlap)
 			return
 		}
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			httputil.NewError(c, http.StatusBadRequest, err)
 			return
 		}
 		if len(ranges) > 1 {
-			http.Error(w, "multiple ranges are not supported", http.StatusRequestedRangeNotSatisfiable)
+			httputil.NewError(c, http.StatusRequestedRangeNotSatisfiable, errors.New("multiple ranges are not supported"))
 			return
 		}
 		start = ranges[0].Start
@@ -785,107 +1534,359 @@ func (fs *FileService) GetFileStream(c *gin.Context, download bool, sharedFile *
 		w.WriteHeader(http.StatusPartialContent)
 	}
 
-	contentLength := end - start + 1
-
-	mimeType := file.MimeType
+	disposition := "inline"
 
-	if mimeType == "" {
-		mimeType = "application/octet-stream"
+	if download {
+		disposition = "attachment"
 	}
 
-	c.Header("Content-Type", mimeType)
+	fs.streamRange(c, session, file, start, end, fileName, disposition, !download)
+}
 
-	c.Header("Content-Length", strconv.FormatInt(contentLength, 10))
-	c.Header("E-Tag", fmt.Sprintf("\"%s\"", md5.FromString(file.Id+strconv.FormatInt(file.Size, 10))))
-	c.Header("Last-Modified", file.UpdatedAt.UTC().Format(http.TimeFormat))
+// ExtractFile streams the byte range given by the start and end query params
+// as a standalone attachment. Unlike a Range request the response is always a
+// plain 200 so the slice can be saved as its own file.
+func (fs *FileService) ExtractFile(c *gin.Context) {
 
-	disposition := "inline"
+	w := c.Writer
 
-	if download {
-		disposition = "attachment"
+	var query schemas.ExtractQuery
+
+	if err := c.ShouldBindQuery(&query); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	session, file, ok := fs.resolveStreamFile(c, nil)
+	if !ok || !fs.checkStreamKeys(c, session, file) {
+		return
 	}
 
-	c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": file.Name}))
+	if file.Type != "file" {
+		httputil.NewError(c, http.StatusBadRequest, errors.New("only files can be extracted"))
+		return
+	}
 
-	tokens, err := getBotsToken(fs.db, fs.cache, session.UserId, *file.ChannelID)
+	start := query.Start
+	end := file.Size - 1
+	if query.End != nil {
+		end = *query.End
+	}
 
-	if err != nil {
-		fs.handleError(fmt.Errorf("failed to get bots: %w", err), w)
+	if start > end || end >= file.Size {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", file.Size))
+		httputil.NewError(c, http.StatusRequestedRangeNotSatisfiable, errors.New("Requested Range Not Satisfiable"))
 		return
 	}
 
+	w.WriteHeader(http.StatusOK)
+
+	fs.streamRange(c, session, file, start, end, extractFileName(file.Name, start, end), "attachment", false)
+}
+
+// resolveStreamFile authenticates a stream request and loads the requested
+// file, which must belong to the caller or the share owner, writing the error response itself when either step fails. The viewer
+// the access is counted for is kept in the context.
+func (fs *FileService) resolveStreamFile(c *gin.Context, sharedFile *schemas.FileShareOut) (*models.Session, *schemas.FileOutFull, bool) {
+
+	r := c.Request
+
+	fileID := c.Param("fileID")
+
 	var (
-		lr           io.ReadCloser
-		client       *telegram.Client
-		multiThreads int
-		token        string
+		session *models.Session
+		err     error
+		appErr  *types.AppError
+		user    *types.JWTClaims
+		viewer  string
 	)
 
-	multiThreads = fs.cnf.TG.Stream.MultiThreads
+	if sharedFile == nil {
+		authHash := c.Query("hash")
 
-	if fs.cnf.TG.DisableStreamBots || len(tokens) == 0 {
-		client, err = tgc.AuthClient(c, &fs.cnf.TG, session.Session)
-		if err != nil {
-			fs.handleError(err, w)
-			return
+		if sig := c.Query("sig"); sig != "" {
+			userId, err := auth.VerifyFile(fs.cnf.JWT.Secret, fileID, c.Request.URL.Query(), time.Now())
+			if err != nil {
+				httputil.Unauthenticated(c, err)
+				return nil, nil, false
+			}
+			session = &models.Session{UserId: userId}
+			viewer = ipViewer(fs.cnf.JWT.Secret, c.ClientIP())
+		} else if authHash == "" {
+			user, err = auth.VerifyUser(c, fs.db, fs.cache, &fs.cnf.JWT)
+			var authErr *auth.AuthError
+			if errors.As(err, &authErr) && authErr.Reason == auth.ReasonMissing {
+				err = &auth.AuthError{Reason: auth.ReasonMissing, Err: errors.New("missing session or authash")}
+			}
+			if err != nil {
+				httputil.Unauthenticated(c, err)
+				return nil, nil, false
+			}
+			userId, _ := strconv.ParseInt(user.Subject, 10, 64)
+			session = &models.Session{UserId: userId, Session: user.TgSession}
+			viewer = userViewer(userId)
+		} else {
+			session, err = auth.GetSessionByHash(fs.db, fs.cache, authHash)
+			if err != nil {
+				httputil.NewError(c, http.StatusBadRequest, errors.New("invalid hash"))
+				return nil, nil, false
+			}
+			if err := auth.CheckSession(fs.db, fs.cache, &fs.cnf.JWT, session, time.Now().UTC()); err != nil {
+				httputil.Unauthenticated(c, err)
+				return nil, nil, false
+			}
+			viewer = userViewer(session.UserId)
 		}
-		multiThreads = 0
 
 	} else {
-		fs.botWorker.Set(tokens, *file.ChannelID)
 
-		token, _ = fs.botWorker.Next(*file.ChannelID)
+		session = &models.Session{UserId: sharedFile.UserID}
+		viewer = ipViewer(fs.cnf.JWT.Secret, c.ClientIP())
+	}
+
+	c.Set(viewerKey, viewer)
 
-		middlewares := tgc.Middlewares(&fs.cnf.TG, 5)
-		client, err = tgc.BotClient(c, fs.kv, &fs.cnf.TG, token, middlewares...)
-		if err != nil {
-			fs.handleError(err, w)
-			return
+	file := &schemas.FileOutFull{}
+
+	key := fmt.Sprintf("files:%s", fileID)
+
+	err = fs.cache.Get(key, file)
+
+	if err != nil {
+		file, appErr = fs.GetFileByID(fileID)
+		if appErr != nil {
+			httputil.NewError(c, appErr.Code, appErr.Error)
+			return nil, nil, false
 		}
+		fs.cache.Set(key, file, 0)
 	}
-	if download {
-		multiThreads = 0
+
+	// Inline content is served straight from the database, so only the
+	// owner, or a share of the owner, may read a file.
+	if file.UserID != session.UserId {
+		httputil.NewError(c, http.StatusNotFound, database.ErrNotFound)
+		return nil, nil, false
+	}
+
+	if fileExpired(file.FileOut, time.Now()) {
+		httputil.NewError(c, http.StatusGone, ErrFileExpired)
+		return nil, nil, false
 	}
 
 	if r.Method != "HEAD" {
-		handleStream := func() error {
-			parts, err := getParts(c, client, fs.cache, file)
+		fs.MarkAccessed(file.Id)
+	}
+
+	return session, file, true
+}
+
+// checkStreamKeys fails the request with a 503 when the keys of an encrypted
+// file cannot be resolved, before the status line is written. Keys are those
+// of the session resolveStreamFile checked the file against.
+func (fs *FileService) checkStreamKeys(c *gin.Context, session *models.Session, file *schemas.FileOutFull) bool {
+	if err := checkFileKeys(keyResolver(fs.db, &fs.cnf.TG, session.UserId), file); err != nil {
+		httputil.NewError(c, http.StatusServiceUnavailable, err)
+		return false
+	}
+	return true
+}
+
+// streamRange writes bytes start..end of file to the response. The status
+// line must already have been written by the caller.
+func (fs *FileService) streamRange(c *gin.Context, session *models.Session, file *schemas.FileOutFull,
+	start, end int64, fileName, disposition string, multiThreaded bool) {
+
+	w := c.Writer
+
+	r := c.Request
+
+	contentLength := end - start + 1
+
+	mimeType := file.MimeType
+
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	c.Header("Content-Type", mimeType)
+
+	c.Header("Content-Length", strconv.FormatInt(contentLength, 10))
+	c.Header("E-Tag", fmt.Sprintf("\"%s\"", md5.FromString(file.Id+strconv.FormatInt(file.Size, 10))))
+	c.Header("Last-Modified", file.UpdatedAt.UTC().Format(http.TimeFormat))
+
+	c.Header("Content-Disposition", httputil.ContentDisposition(disposition, fileName))
+
+	if file.InlineData != nil {
+		if r.Method != "HEAD" {
+			var (
+				data []byte
+				key  string
+				err  error
+			)
+			if file.Encrypted {
+				key, err = encryptionKey(fs.db, &fs.cnf.TG, session.UserId, file.KeyVersion)
+			}
+			if err == nil {
+				data, err = openInline(key, file.InlineData, file.Encrypted)
+			}
 			if err != nil {
-				fs.handleError(err, w)
-				return nil
+				fs.handleError(c, err)
+				return
 			}
-			lr, err = reader.NewLinearReader(c, client.API(), fs.cache, file, parts, start, end, &fs.cnf.TG, multiThreads)
+			if end >= int64(len(data)) {
+				fs.handleError(c, fmt.Errorf("inline data of %s is truncated", file.Id))
+				return
+			}
+			n, _ := w.Write(data[start : end+1])
+			fs.access.record(file.Id, c.GetString(viewerKey), start == 0, int64(n), time.Now())
+		}
+		return
+	}
 
-			if err != nil {
-				fs.handleError(err, w)
-				return nil
+	spec, middlewares, multiThreads, err := fs.streamClient(session, file)
+
+	if err != nil {
+		fs.handleError(c, err)
+		return
+	}
+
+	if !multiThreaded {
+		multiThreads = 0
+	}
+
+	keys := keyResolver(fs.db, &fs.cnf.TG, session.UserId)
+
+	if r.Method != "HEAD" {
+		// A connection that drops mid-stream is replaced by the pool and the
+		// read resumes at the first byte not yet delivered, so the client only
+		// sees a pause. Failures before reading started are not retried.
+		policy := &reconnectPolicy{retries: fs.cnf.TG.Stream.ReconnectRetries, timeout: fs.cnf.TG.Stream.ReconnectTimeout}
+		out := &streamWriter{w: w}
+		defer func() {
+			fs.access.record(file.Id, c.GetString(viewerKey), start == 0 && out.n > 0, out.n, time.Now())
+		}()
+		streaming := false
+		for {
+			offset := start + out.n
+			err := fs.clients.Run(c, spec, func(ctx context.Context, client *telegram.Client) error {
+				api := tgc.WithMiddlewares(client, middlewares...)
+				parts, err := getParts(ctx, api, fs.cache, file)
+				if err != nil {
+					return err
+				}
+				lr, err := reader.NewLinearReader(ctx, api, fs.cache, file, parts, offset, end, &fs.cnf.TG, keys, multiThreads)
+				if err != nil {
+					return err
+				}
+				if lr == nil {
+					return fmt.Errorf("failed to initialise reader")
+				}
+				defer lr.Close()
+				streaming = true
+				_, err = io.CopyN(out, lr, end-offset+1)
+				return err
+			})
+			if err == nil || out.err != nil || c.Request.Context().Err() != nil {
+				return
 			}
-			if lr == nil {
-				fs.handleError(fmt.Errorf("failed to initialise reader"), w)
-				return nil
+			// Reconnecting does not lift a flood wait, the client has to back off.
+			_, flooded := tgerr.AsFloodWait(err)
+			wait, ok := policy.next(time.Now())
+			if !streaming || flooded || !ok {
+				fs.handleError(c, err)
+				return
 			}
-			_, err = io.CopyN(w, lr, contentLength)
-			if err != nil {
-				lr.Close()
+			fs.logger.Warnw("stream interrupted, reconnecting", "file", file.Id, "offset", start+out.n,
+				"attempt", policy.attempts, "err", err)
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case <-time.After(wait):
 			}
-			return nil
 		}
-		tgc.RunWithAuth(c, client, token, func(ctx context.Context) error {
-			return handleStream()
-		})
+	}
+}
+
+// streamClient picks the client used to read file for session: the next bot
+// of the file's channel, or the user's own session when no bots are usable.
+func (fs *FileService) streamClient(session *models.Session, file *schemas.FileOutFull) (tgc.ClientSpec, []telegram.Middleware, int, error) {
+	tokens, err := getRoleBots(fs.db, fs.cache, session.UserId, *file.ChannelID, BotRoleDownload)
 
+	if err != nil {
+		return tgc.ClientSpec{}, nil, 0, fmt.Errorf("failed to get bots: %w", err)
+	}
+
+	caller := getCaller(fs.db, fs.cache, &fs.cnf.TG, session.UserId)
+
+	if fs.cnf.TG.DisableStreamBots || len(tokens) == 0 {
+		spec := fs.clients.UserSpec(session.Session)
+		middlewares := fs.clients.Middlewares(spec, tgc.OpDownload,
+			getRateLimit(fs.db, fs.cache, &fs.cnf.TG, session.UserId, ""), caller)
+		return spec, middlewares, 0, nil
 	}
+
+	key := tgc.BotPoolKey(*file.ChannelID, BotRoleDownload)
+
+	fs.botWorker.Set(tokens, key)
+
+	token, _ := fs.botWorker.Next(key)
+
+	spec := fs.clients.BotSpec(session.UserId, token)
+
+	middlewares := fs.clients.Middlewares(spec, tgc.OpDownload,
+		getRateLimit(fs.db, fs.cache, &fs.cnf.TG, session.UserId, token), caller)
+
+	return spec, middlewares, fs.cnf.TG.Stream.MultiThreads, nil
 }
 
-func (fs *FileService) handleError(err error, w http.ResponseWriter) {
-	fs.logger.Error(err)
-	http.Error(w, err.Error(), http.StatusInternalServerError)
+func extractFileName(name string, start, end int64) string {
+	base, ext := splitFileName(name)
+	return fmt.Sprintf("%s_%d-%d%s", base, start, end, ext)
+}
 
+// handleError reports a failure of a stream. Once the body has started the
+// error can only be logged.
+func (fs *FileService) handleError(c *gin.Context, err error) {
+	if c.Writer.Written() {
+		fs.logger.Error(err)
+		return
+	}
+	for _, header := range []string{"Content-Length", "Content-Disposition", "E-Tag", "Last-Modified"} {
+		c.Writer.Header().Del(header)
+	}
+	httputil.NewError(c, http.StatusInternalServerError, err)
 }
 
-func getOrder(fquery *schemas.FileQuery) clause.OrderByColumn {
-	sortColumn := utils.CamelToSnake(fquery.Sort)
+// listSorts are the fields listings can be sorted by, listOrders the
+// directions.
+var (
+	listSorts  = []string{"name", "updatedAt", "createdAt", "size"}
+	listOrders = []string{"asc", "desc"}
+)
+
+var ErrInvalidSort = fmt.Errorf("sort must be one of %v and order one of %v", listSorts, listOrders)
+
+// normalizeSort fills in the default sort of a listing and rejects any other
+// than listSorts, as the field ends up in the order clause.
+func normalizeSort(fquery *schemas.FileQuery) error {
+	if fquery.Sort == "" {
+		fquery.Sort = "name"
+	}
+	if fquery.Order == "" {
+		fquery.Order = "asc"
+	}
+	if !slices.Contains(listSorts, fquery.Sort) || !slices.Contains(listOrders, fquery.Order) {
+		return ErrInvalidSort
+	}
+	return nil
+}
 
-	return clause.OrderByColumn{Column: clause.Column{Name: sortColumn},
-		Desc: fquery.Order == "desc"}
+// getOrder sorts by the requested field and then by id, so files with equal
+// keys keep their order between requests and pages.
+func getOrder(fquery *schemas.FileQuery) clause.OrderBy {
+	desc := fquery.Order == "desc"
+	return clause.OrderBy{Columns: []clause.OrderByColumn{
+		{Column: clause.Column{Name: utils.CamelToSnake(fquery.Sort)}, Desc: desc},
+		{Column: clause.Column{Name: "id"}, Desc: desc},
+	}}
 }
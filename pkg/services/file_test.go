@@ -1,14 +1,26 @@
 package services
 
 import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/config"
 	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/internal/utils"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 	"github.com/tgdrive/teldrive/pkg/models"
 	"github.com/tgdrive/teldrive/pkg/schemas"
+	"gorm.io/datatypes"
 	"gorm.io/gorm"
 )
 
@@ -20,7 +32,9 @@ type FileServiceSuite struct {
 
 func (s *FileServiceSuite) SetupSuite() {
 	s.db = database.NewTestDatabase(s.T(), false)
-	s.srv = NewFileService(s.db, nil, nil, nil, nil, nil, nil)
+	s.srv = NewFileService(s.db, nil, nil, nil, nil, cache.NewMemoryCache(1024*1024), nil, nil, nil)
+	s.db.Save(&models.User{UserId: 123456, Name: "test", UserName: "test"})
+	s.db.Save(&models.Channel{ChannelID: 123456, ChannelName: "test", UserID: 123456})
 }
 
 func (s *FileServiceSuite) SetupTest() {
@@ -43,7 +57,6 @@ func (s *FileServiceSuite) entry(name string) *schemas.FileIn {
 		Path:      "/",
 		ChannelID: 123456,
 		Size:      121531,
-		Encrypted: false,
 	}
 }
 
@@ -87,3 +100,580 @@ func (s *FileServiceSuite) Test_NoFound() {
 	s.Error(err.Error)
 	s.Equal(err, database.ErrNotFound)
 }
+
+func (s *FileServiceSuite) TestSave_ConflictRename() {
+	c := &gin.Context{}
+	_, err := s.srv.CreateFile(c, 123456, s.entry("file4.jpeg"))
+	s.Nil(err)
+
+	entry := s.entry("file4.jpeg")
+	entry.Conflict = ConflictRename
+	res, err := s.srv.CreateFile(c, 123456, entry)
+	s.Nil(err)
+	s.Equal("file4 (1).jpeg", res.Name)
+	s.Equal(ConflictRename, res.Conflict)
+}
+
+func (s *FileServiceSuite) TestSave_ConflictError() {
+	c := &gin.Context{}
+	_, err := s.srv.CreateFile(c, 123456, s.entry("file5.jpeg"))
+	s.Nil(err)
+
+	entry := s.entry("file5.jpeg")
+	entry.Size = 1
+	entry.Conflict = ConflictError
+	_, err = s.srv.CreateFile(c, 123456, entry)
+	s.Equal(database.ErrKeyConflict, err.Error)
+}
+
+func (s *FileServiceSuite) Test_UpdateStaleVersion() {
+	res, err := s.srv.CreateFile(&gin.Context{}, 123456, s.entry("file6.jpeg"))
+	s.Nil(err)
+
+	stale := res.Version - 1
+	_, err = s.srv.UpdateFile(res.Id, 123456, &schemas.FileUpdate{Name: "file7.jpeg", Version: &stale})
+	s.Equal(database.ErrStaleVersion, err.Error)
+	s.Equal(http.StatusConflict, err.Code)
+}
+
+func (s *FileServiceSuite) Test_RefreshKeepsVersion() {
+	res, err := s.srv.CreateFile(&gin.Context{}, 123456, s.entry("file14.jpeg"))
+	s.Nil(err)
+
+	s.NoError(s.db.Model(&models.File{}).Where("id = ?", res.Id).
+		UpdateColumns(map[string]any{"hash": "d41d8cd98f00b204e9800998ecf8427e", "hash_algorithm": "md5", "size": 42}).Error)
+
+	refreshed, err := s.srv.GetFileByID(res.Id)
+	s.Nil(err)
+	s.Equal(res.Version, refreshed.Version)
+}
+
+func (s *FileServiceSuite) TestSave_ReplaceDryRun() {
+	c := &gin.Context{}
+	existing, err := s.srv.CreateFile(c, 123456, s.entry("file8.jpeg"))
+	s.Nil(err)
+
+	entry := s.entry("file8.jpeg")
+	entry.Conflict = ConflictReplace
+	entry.DryRun = true
+	res, err := s.srv.CreateFile(c, 123456, entry)
+	s.Nil(err)
+	s.True(res.DryRun)
+	s.Equal([]string{existing.Id}, res.Replaced)
+
+	find, err := s.srv.GetFileByID(existing.Id)
+	s.Nil(err)
+	s.Equal(existing.Id, find.Id)
+}
+
+func (s *FileServiceSuite) Test_DeleteDryRun() {
+	res, err := s.srv.CreateFile(&gin.Context{}, 123456, s.entry("file9.jpeg"))
+	s.Nil(err)
+
+	out, err := s.srv.DeleteFiles(123456, &schemas.DeleteOperation{Files: []string{res.Id}, DryRun: true})
+	s.Nil(err)
+	s.True(out.DryRun)
+	s.Len(out.Files, 1)
+	s.Equal(ActionDelete, out.Files[0].Action)
+
+	_, err = s.srv.GetFileByID(res.Id)
+	s.Nil(err)
+}
+
+func (s *FileServiceSuite) TestSave_InheritFolderDefaults() {
+	c := &gin.Context{}
+	folder, err := s.srv.CreateFile(c, 123456, &schemas.FileIn{Name: "secret", Type: "folder", Path: "/"})
+	s.Nil(err)
+
+	encrypted := true
+	_, err = s.srv.UpdateFile(folder.Id, 123456, &schemas.FileUpdate{DefaultEncrypted: &encrypted})
+	s.Nil(err)
+
+	entry := s.entry("file10.jpeg")
+	entry.Path = "/secret"
+	res, err := s.srv.CreateFile(c, 123456, entry)
+	s.Nil(err)
+	s.True(res.Encrypted)
+}
+
+func (s *FileServiceSuite) Test_StreamFiles() {
+	for _, name := range []string{"a.jpeg", "b.jpeg"} {
+		_, err := s.srv.CreateFile(&gin.Context{}, 123456, s.entry(name))
+		s.Nil(err)
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/api/files", nil)
+	s.srv.StreamFiles(c, 123456, &schemas.FileQuery{Op: "list", Path: "/", Sort: "name", Order: "asc"})
+
+	s.Equal(http.StatusOK, w.Code)
+	s.Equal("application/x-ndjson", w.Header().Get("Content-Type"))
+
+	var names []string
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var file schemas.FileOut
+		s.NoError(json.Unmarshal(scanner.Bytes(), &file))
+		names = append(names, file.Name)
+	}
+	s.Equal([]string{"a.jpeg", "b.jpeg"}, names)
+}
+
+func (s *FileServiceSuite) Test_UpdateIfMatch() {
+	res, err := s.srv.CreateFile(&gin.Context{}, 123456, s.entry("file11.jpeg"))
+	s.Nil(err)
+
+	etag := FileETag(res.Id, res.Version)
+	updated, err := s.srv.UpdateFile(res.Id, 123456, &schemas.FileUpdate{Name: "file12.jpeg", IfMatch: etag})
+	s.Nil(err)
+	s.NotEqual(etag, FileETag(updated.Id, updated.Version))
+
+	_, err = s.srv.UpdateFile(res.Id, 123456, &schemas.FileUpdate{Name: "file13.jpeg", IfMatch: etag})
+	s.Equal(ErrPreconditionFailed, err.Error)
+	s.Equal(http.StatusPreconditionFailed, err.Code)
+}
+
+func (s *FileServiceSuite) Test_ListRecursive() {
+	_, err := s.srv.MakeDirectory(123456, &schemas.MkDir{Path: "/docs/2024"})
+	s.Nil(err)
+	for _, path := range []string{"/", "/docs/2024"} {
+		entry := s.entry("report.jpeg")
+		entry.Path = path
+		_, err := s.srv.CreateFile(&gin.Context{}, 123456, entry)
+		s.Nil(err)
+	}
+
+	res, err := s.srv.ListFiles(123456, &schemas.FileQuery{Op: "list", Recursive: true, Type: "file",
+		Sort: "name", Order: "asc", Limit: 10, Page: 1})
+	s.Nil(err)
+	s.Equal(2, res.Meta.Count)
+	paths := []string{res.Files[0].ParentPath, res.Files[1].ParentPath}
+	s.ElementsMatch([]string{"/", "/docs/2024"}, paths)
+
+	res, err = s.srv.ListFiles(123456, &schemas.FileQuery{Op: "list", Recursive: true, Type: "file", Path: "/docs",
+		Sort: "name", Order: "asc", Limit: 10, Page: 1})
+	s.Nil(err)
+	s.Len(res.Files, 1)
+	s.Equal("/docs/2024", res.Files[0].ParentPath)
+
+	res, err = s.srv.ListFiles(123456, &schemas.FileQuery{Op: "list", Recursive: true, Type: "file", Path: "/docs",
+		Sort: "name", Order: "asc", Limit: 10, Page: 1, IncludeAncestors: true})
+	s.Nil(err)
+	names := []string{}
+	for _, ancestor := range res.Files[0].Ancestors {
+		names = append(names, ancestor.Name)
+	}
+	s.Equal([]string{"/", "docs", "2024"}, names)
+	s.Equal(res.Files[0].ParentID, res.Files[0].Ancestors[2].Id)
+
+	res, err = s.srv.ListFiles(123456, &schemas.FileQuery{Op: "list", Recursive: true, Query: "missing",
+		Sort: "name", Order: "asc", Limit: 10, Page: 1})
+	s.Nil(err)
+	s.Empty(res.Files)
+
+	res, err = s.srv.ListFiles(123456, &schemas.FileQuery{Op: "list", Recursive: true, Category: "folder",
+		Sort: "name", Order: "asc", Limit: 10, Page: 1})
+	s.Nil(err)
+	s.Len(res.Files, 2)
+}
+
+func (s *FileServiceSuite) Test_StreamOtherUsersFile() {
+	s.srv.cnf = &config.Config{JWT: config.JWTConfig{Secret: "secret"}}
+	defer func() { s.srv.cnf = nil }()
+
+	file := &models.File{Name: "note.txt", Type: "file", MimeType: "text/plain", UserID: 123456, Status: "active",
+		Size: utils.Int64Pointer(5), InlineData: []byte("hello")}
+	s.Require().NoError(s.db.Create(file).Error)
+
+	stream := func(userId int64) int {
+		res := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(res)
+		query := auth.SignFile("secret", file.Id, userId, time.Now().Add(time.Hour)).Encode()
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/files/"+file.Id+"/stream/note.txt?"+query, nil)
+		c.Params = gin.Params{{Key: "fileID", Value: file.Id}}
+		s.srv.GetFileStream(c, false, nil)
+		return res.Code
+	}
+
+	s.Equal(http.StatusNotFound, stream(654321))
+	s.Equal(http.StatusOK, stream(123456))
+}
+
+func (s *FileServiceSuite) Test_ShareSurvivesRename() {
+	res, err := s.srv.CreateFile(&gin.Context{}, 123456, s.entry("shared.jpeg"))
+	s.Nil(err)
+	s.Nil(s.srv.CreateShare(res.Id, 123456, &schemas.FileShareIn{}))
+
+	_, err = s.srv.UpdateFile(res.Id, 123456, &schemas.FileUpdate{Name: "renamed.jpeg"})
+	s.Nil(err)
+
+	shares, err := s.srv.ListFileShares(res.Id, 123456)
+	s.Nil(err)
+	s.Len(shares, 1)
+	s.True(shares[0].ShareFollowsFile)
+}
+
+func (s *FileServiceSuite) Test_ShareBreaksOnRename() {
+	res, err := s.srv.CreateFile(&gin.Context{}, 123456, s.entry("pinned.jpeg"))
+	s.Nil(err)
+	follows := false
+	s.Nil(s.srv.CreateShare(res.Id, 123456, &schemas.FileShareIn{ShareFollowsFile: &follows}))
+
+	_, err = s.srv.UpdateFile(res.Id, 123456, &schemas.FileUpdate{Name: "moved.jpeg"})
+	s.Nil(err)
+
+	shares, err := s.srv.ListFileShares(res.Id, 123456)
+	s.Nil(err)
+	s.Empty(shares)
+}
+
+func (s *FileServiceSuite) Test_MoveRevokesShares() {
+	_, err := s.srv.MakeDirectory(123456, &schemas.MkDir{Path: "/public"})
+	s.Nil(err)
+	entry := s.entry("doc.jpeg")
+	entry.Path = "/public"
+	res, err := s.srv.CreateFile(&gin.Context{}, 123456, entry)
+	s.Nil(err)
+	s.Nil(s.srv.CreateShare(res.Id, 123456, &schemas.FileShareIn{}))
+
+	_, err = s.srv.MoveFiles(123456, &schemas.FileOperation{Files: []string{res.Id}, Destination: "/private"})
+	s.Nil(err)
+	shares, _ := s.srv.ListFileShares(res.Id, 123456)
+	s.Len(shares, 1)
+
+	_, err = s.srv.MoveFiles(123456, &schemas.FileOperation{Files: []string{res.Id}, Destination: "/",
+		RevokeShares: true})
+	s.Nil(err)
+	shares, _ = s.srv.ListFileShares(res.Id, 123456)
+	s.Empty(shares)
+}
+
+func (s *FileServiceSuite) folderId(path string) string {
+	var ids []string
+	s.db.Raw("select id from teldrive.get_file_from_path(?, ?, ?)", path, 123456, false).Pluck("id", &ids)
+	s.Require().Len(ids, 1)
+	return ids[0]
+}
+
+func (s *FileServiceSuite) Test_MoveDeepTree() {
+	deep := "/проекты/über/a/b/c/d/e/f/g/h"
+	_, err := s.srv.MakeDirectory(123456, &schemas.MkDir{Path: deep})
+	s.Nil(err)
+	for _, path := range []string{"/проекты/über", deep} {
+		entry := s.entry("日本語.jpeg")
+		entry.Path = path
+		_, err := s.srv.CreateFile(&gin.Context{}, 123456, entry)
+		s.Nil(err)
+	}
+
+	_, err = s.srv.MoveFiles(123456, &schemas.FileOperation{Files: []string{s.folderId("/проекты/über")},
+		Destination: "/archive/2024 年"})
+	s.Nil(err)
+
+	res, err := s.srv.ListFiles(123456, &schemas.FileQuery{Op: "list", Recursive: true, Type: "file",
+		Sort: "name", Order: "asc", Limit: 10, Page: 1})
+	s.Nil(err)
+	s.Len(res.Files, 2)
+	s.ElementsMatch([]string{"/archive/2024 年/über", "/archive/2024 年/über/a/b/c/d/e/f/g/h"},
+		[]string{res.Files[0].ParentPath, res.Files[1].ParentPath})
+}
+
+func (s *FileServiceSuite) Test_MaxDepth() {
+	s.srv.cnf = &config.Config{Files: config.FilesConfig{MaxDepth: 3}}
+	defer func() { s.srv.cnf = nil }()
+
+	_, err := s.srv.MakeDirectory(123456, &schemas.MkDir{Path: "/a/b/c"})
+	s.Nil(err)
+	_, err = s.srv.MakeDirectory(123456, &schemas.MkDir{Path: "/a/b/c/d"})
+	s.Require().NotNil(err)
+	s.Equal(http.StatusBadRequest, err.Code)
+
+	_, err = s.srv.MakeDirectory(123456, &schemas.MkDir{Path: "/x/y"})
+	s.Nil(err)
+
+	// /x/y would end up at /a/b/x/y, one level too deep.
+	_, err = s.srv.MoveFiles(123456, &schemas.FileOperation{Files: []string{s.folderId("/x")}, Destination: "/a/b"})
+	s.Require().NotNil(err)
+	s.Equal(http.StatusBadRequest, err.Code)
+	s.folderId("/x/y")
+
+	_, err = s.srv.MoveFiles(123456, &schemas.FileOperation{Files: []string{s.folderId("/x")}, Destination: "/a"})
+	s.Nil(err)
+	s.folderId("/a/x/y")
+
+	_, err = s.srv.MoveDirectory(123456, &schemas.DirMove{Source: "/a/x", Destination: "/a/b/c/x"})
+	s.Require().NotNil(err)
+	s.Equal(http.StatusBadRequest, err.Code)
+}
+
+func (s *FileServiceSuite) Test_MoveIntoNewSubfolderOfItself() {
+	_, err := s.srv.MakeDirectory(123456, &schemas.MkDir{Path: "/outer/inner"})
+	s.Nil(err)
+
+	_, err = s.srv.MoveFiles(123456, &schemas.FileOperation{Files: []string{s.folderId("/outer")},
+		Destination: "/outer/inner/new"})
+	s.Require().NotNil(err)
+	s.Equal(http.StatusConflict, err.Code)
+	s.folderId("/outer/inner")
+}
+
+func (s *FileServiceSuite) Test_MoveSameNamedFolders() {
+	for _, path := range []string{"/one/logs", "/two/logs"} {
+		_, err := s.srv.MakeDirectory(123456, &schemas.MkDir{Path: path})
+		s.Nil(err)
+	}
+
+	_, err := s.srv.MoveFiles(123456, &schemas.FileOperation{
+		Files: []string{s.folderId("/one/logs"), s.folderId("/two/logs")}, Destination: "/merged"})
+	s.Require().NotNil(err)
+	s.Equal(http.StatusConflict, err.Code)
+}
+
+func (s *FileServiceSuite) TestReorganize() {
+	a, err := s.srv.CreateFile(&gin.Context{}, 123456, s.entry("a.jpeg"))
+	s.Require().Nil(err)
+	b, err := s.srv.CreateFile(&gin.Context{}, 123456, s.entry("b.jpeg"))
+	s.Require().Nil(err)
+	_, err = s.srv.MakeDirectory(123456, &schemas.MkDir{Path: "/import"})
+	s.Require().Nil(err)
+
+	_, err = s.srv.Reorganize(123456, &schemas.Reorganize{Operations: []schemas.ReorganizeOp{
+		{ID: a.Id, Destination: "/sorted", Name: "same.jpeg"},
+		{ID: b.Id, Destination: "/sorted", Name: "same.jpeg"},
+	}})
+	s.Require().NotNil(err)
+	s.Equal(http.StatusConflict, err.Code)
+	file, _ := s.srv.GetFileByID(a.Id)
+	s.Equal("a.jpeg", file.Name)
+
+	res, err := s.srv.Reorganize(123456, &schemas.Reorganize{Conflict: ConflictRename, Operations: []schemas.ReorganizeOp{
+		{ID: a.Id, Destination: "/sorted", Name: "same.jpeg"},
+		{ID: b.Id, Destination: "/sorted", Name: "same.jpeg"},
+		{ID: s.folderId("/import"), Destination: "/sorted"},
+	}})
+	s.Require().Nil(err)
+	s.Equal(ReorganizeMoved, res.Results[0].Action)
+	s.Equal("same (1).jpeg", res.Results[1].Name)
+	s.Equal(s.folderId("/sorted"), s.parentOf(s.folderId("/sorted/import")))
+
+	_, err = s.srv.Reorganize(123456, &schemas.Reorganize{Operations: []schemas.ReorganizeOp{
+		{ID: s.folderId("/sorted"), Destination: "/sorted/import"},
+	}})
+	s.Require().NotNil(err)
+	s.Equal(http.StatusConflict, err.Code)
+}
+
+func (s *FileServiceSuite) parentOf(id string) string {
+	file, err := s.srv.GetFileByID(id)
+	s.Require().Nil(err)
+	return file.ParentID
+}
+
+func (s *FileServiceSuite) TestListChannelFiles() {
+	for _, name := range []string{"a.jpeg", "b.jpeg"} {
+		_, err := s.srv.CreateFile(&gin.Context{}, 123456, s.entry(name))
+		s.Require().Nil(err)
+	}
+
+	res, err := s.srv.ListChannelFiles(123456, 123456, &schemas.ChannelFileQuery{Limit: 1})
+	s.Require().Nil(err)
+	s.Equal(int64(2), res.Count)
+	s.Equal(int64(2*121531), res.TotalSize)
+	s.Len(res.Files, 1)
+	s.Equal(2, res.Meta.TotalPages)
+	s.Equal("/", res.Files[0].ParentPath)
+
+	_, err = s.srv.ListChannelFiles(123456, 654321, &schemas.ChannelFileQuery{})
+	s.Require().NotNil(err)
+	s.Equal(http.StatusForbidden, err.Code)
+}
+
+func (s *FileServiceSuite) TestEnsureRoot() {
+	res, err := s.srv.CreateFile(&gin.Context{}, 123456, s.entry("kept.jpeg"))
+	s.Require().Nil(err)
+
+	repair, rerr := ensureRoot(s.srv.db, 123456)
+	s.Require().NoError(rerr)
+	s.False(repair.Created)
+
+	s.Require().NoError(s.srv.db.Where("user_id = ?", 123456).Where("parent_id IS NULL").Delete(&models.File{}).Error)
+
+	repair, rerr = ensureRoot(s.srv.db, 123456)
+	s.Require().NoError(rerr)
+	s.True(repair.Created)
+	s.Equal(int64(1), repair.Reattached)
+
+	var root models.File
+	s.Require().NoError(s.srv.db.Where("user_id = ?", 123456).Where("parent_id IS NULL").First(&root).Error)
+	file, _ := s.srv.GetFileByID(res.Id)
+	s.Equal(root.Id, file.ParentID)
+	s.Equal("kept.jpeg", file.Name)
+}
+
+func TestNormalizeSort(t *testing.T) {
+	fquery := &schemas.FileQuery{}
+	assert.NoError(t, normalizeSort(fquery))
+	assert.Equal(t, "name", fquery.Sort)
+	assert.Equal(t, "asc", fquery.Order)
+
+	assert.ErrorIs(t, normalizeSort(&schemas.FileQuery{Sort: "name; drop table files", Order: "asc"}), ErrInvalidSort)
+	assert.ErrorIs(t, normalizeSort(&schemas.FileQuery{Sort: "size", Order: "up"}), ErrInvalidSort)
+
+	order := getOrder(&schemas.FileQuery{Sort: "updatedAt", Order: "desc"})
+	assert.Len(t, order.Columns, 2)
+	assert.Equal(t, "updated_at", order.Columns[0].Column.Name)
+	assert.Equal(t, "id", order.Columns[1].Column.Name)
+	assert.True(t, order.Columns[1].Desc)
+}
+
+func TestCheckEntryName(t *testing.T) {
+	assert.NoError(t, checkEntryName("photo (1).jpeg"))
+	for _, name := range []string{"", " ", ".", "..", "a/b"} {
+		assert.ErrorIs(t, checkEntryName(name), ErrInvalidName, name)
+	}
+}
+
+func TestCheckDownloadName(t *testing.T) {
+	for _, name := range []string{"report-v2.pdf", "résumé final.pdf", "..hidden"} {
+		assert.NoError(t, checkDownloadName(name), name)
+	}
+	for _, name := range []string{"", ".", "..", "a/b.txt", `a\b.txt`, "line\nbreak", "tab\tname", strings.Repeat("a", 256)} {
+		assert.ErrorIs(t, checkDownloadName(name), ErrInvalidDownloadName, name)
+	}
+}
+
+func (s *FileServiceSuite) TestPlaceUpload() {
+	s.db.Save(&models.User{UserId: 777, Name: "placement", UserName: "placement"})
+	s.db.Save(&models.Channel{ChannelID: 7771, ChannelName: "a", UserID: 777, Messages: 10})
+	s.db.Save(&models.Channel{ChannelID: 7772, ChannelName: "b", UserID: 777, Messages: 5})
+
+	first, err := pickChannel(s.db, 777, PlacementRoundRobin)
+	s.Require().NoError(err)
+	second, err := pickChannel(s.db, 777, PlacementRoundRobin)
+	s.Require().NoError(err)
+	s.NotEqual(first, second)
+
+	least, err := pickChannel(s.db, 777, PlacementLeastFull)
+	s.Require().NoError(err)
+	s.Equal(int64(7772), least)
+
+	// Every part of an upload lands in the channel of the first one.
+	picked, err := placeUpload(s.db, s.srv.cache, 777, "placed", PlacementRoundRobin)
+	s.Require().NoError(err)
+	again, err := placeUpload(s.db, s.srv.cache, 777, "placed", PlacementRoundRobin)
+	s.Require().NoError(err)
+	s.Equal(picked, again)
+
+	s.Require().NoError(recordChannelUsage(s.db, 777, 7772, []schemas.Replica{{ChannelID: 7771}}))
+	var channel models.Channel
+	s.Require().NoError(s.db.Where("channel_id = ?", 7772).First(&channel).Error)
+	s.Equal(int64(6), channel.Messages)
+}
+
+func (s *FileServiceSuite) TestUploadChannels() {
+	s.db.Save(&models.User{UserId: 778, Name: "failover", UserName: "failover",
+		Settings: datatypes.JSON(`{"failoverChannels":[7783,7781,7799,7782]}`)})
+	s.db.Save(&models.Channel{ChannelID: 7781, ChannelName: "a", UserID: 778, Selected: true})
+	s.db.Save(&models.Channel{ChannelID: 7782, ChannelName: "b", UserID: 778})
+	s.db.Save(&models.Channel{ChannelID: 7783, ChannelName: "c", UserID: 778})
+
+	channels, err := uploadChannels(s.db, s.srv.cache, 778, "failover", nil, 7781)
+	s.Require().NoError(err)
+	s.Equal([]int64{7781, 7783, 7782}, channels)
+
+	// Only uploads to the default channel fail over.
+	channels, err = uploadChannels(s.db, s.srv.cache, 778, "failover", nil, 7782)
+	s.Require().NoError(err)
+	s.Equal([]int64{7782}, channels)
+
+	// Later parts follow the first one stored.
+	s.Require().NoError(s.db.Create(&models.Upload{Name: "part", UploadId: "failover", PartId: 1, ChannelID: 7783,
+		PartNo: 1, UserId: 778}).Error)
+	channels, err = uploadChannels(s.db, s.srv.cache, 778, "failover", nil, 7781)
+	s.Require().NoError(err)
+	s.Equal([]int64{7783}, channels)
+}
+
+func (s *FileServiceSuite) TestFileExpiry() {
+	res, err := s.srv.CreateFile(&gin.Context{}, 123456, s.entry("expiring.jpeg"))
+	s.Require().Nil(err)
+
+	past := time.Now().Add(-time.Hour)
+	_, err = s.srv.SetFileExpiry(123456, res.Id, &schemas.FileExpiry{ExpiresAt: &past})
+	s.Require().NotNil(err)
+	s.Equal(http.StatusBadRequest, err.Code)
+
+	soon := time.Now().Add(time.Hour)
+	file, err := s.srv.SetFileExpiry(123456, res.Id, &schemas.FileExpiry{ExpiresAt: &soon})
+	s.Require().Nil(err)
+	s.NotNil(file.ExpiresAt)
+
+	expiring, err := s.srv.ListExpiring(123456, &schemas.ExpiringQuery{})
+	s.Require().Nil(err)
+	s.Require().Len(expiring.Files, 1)
+	s.Equal(res.Id, expiring.Files[0].Id)
+
+	s.Require().NoError(s.db.Model(&models.File{}).Where("id = ?", res.Id).
+		Update("expires_at", time.Now().UTC().Add(-time.Minute)).Error)
+	expired, rerr := ExpireFiles(s.db)
+	s.Require().NoError(rerr)
+	s.Equal(int64(1), expired)
+
+	var stored models.File
+	s.Require().NoError(s.db.Where("id = ?", res.Id).First(&stored).Error)
+	s.Equal("pending_deletion", stored.Status)
+}
+
+func (s *FileServiceSuite) TestTransferFiles() {
+	s.db.Save(&models.User{UserId: 654321, Name: "other", UserName: "Other"})
+	s.db.Create(&models.File{Name: "root", Type: "folder", MimeType: "drive/folder", UserID: 654321, Status: "active"})
+
+	folder, err := s.srv.MakeDirectory(123456, &schemas.MkDir{Path: "/docs"})
+	s.Require().Nil(err)
+	entry := s.entry("a.jpeg")
+	entry.Path = "/docs"
+	file, err := s.srv.CreateFile(&gin.Context{}, 123456, entry)
+	s.Require().Nil(err)
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/files/transfer", nil)
+
+	var root models.File
+	s.Require().NoError(s.db.Where("parent_id is NULL").Where("user_id = ?", 123456).First(&root).Error)
+	_, err = s.srv.TransferFiles(c, 123456, &schemas.FileTransfer{Files: []string{root.Id}, User: "@other"})
+	s.Require().NotNil(err)
+	s.Equal(http.StatusBadRequest, err.Code)
+
+	_, err = s.srv.TransferFiles(c, 123456, &schemas.FileTransfer{Files: []string{folder.Id}, User: "nobody"})
+	s.Require().NotNil(err)
+	s.Equal(http.StatusNotFound, err.Code)
+
+	res, err := s.srv.TransferFiles(c, 123456, &schemas.FileTransfer{Files: []string{folder.Id}, User: "@other"})
+	s.Require().Nil(err)
+	s.Equal(int64(654321), res.UserId)
+	s.Equal(TransferInbox, res.Destination)
+	s.Equal(2, res.Entries)
+
+	var moved []models.File
+	s.Require().NoError(s.db.Where("id IN ?", []string{folder.Id, file.Id}).Find(&moved).Error)
+	for _, f := range moved {
+		s.Equal(int64(654321), f.UserID)
+	}
+
+	inbox, ferr := s.srv.getFileFromPath(TransferInbox+"/docs", 654321)
+	s.Require().NoError(ferr)
+	s.Equal(folder.Id, inbox.Id)
+
+	_, err = s.srv.TransferFiles(c, 123456, &schemas.FileTransfer{Files: []string{folder.Id}, User: "@other"})
+	s.Require().NotNil(err)
+	s.Equal(http.StatusConflict, err.Code)
+}
+
+func TestFileExpired(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Second), now.Add(time.Second)
+	assert.False(t, fileExpired(&schemas.FileOut{}, now))
+	assert.True(t, fileExpired(&schemas.FileOut{ExpiresAt: &past}, now))
+	assert.False(t, fileExpired(&schemas.FileOut{ExpiresAt: &future}, now))
+}
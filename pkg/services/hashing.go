@@ -0,0 +1,415 @@
+package services
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gotd/td/telegram"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/internal/reader"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/mapper"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"golang.org/x/time/rate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	HashJobQueued    = "queued"
+	HashJobRunning   = "running"
+	HashJobCompleted = "completed"
+	HashJobCancelled = "cancelled"
+)
+
+var (
+	ErrHashClientEncrypted = errors.New("client encrypted files cannot be hashed on the server")
+	ErrHashInProgress      = errors.New("file is already being hashed")
+	ErrHashJobActive       = errors.New("a hash job is already queued for this account")
+	ErrHashJobNotFound     = errors.New("hash job not found")
+)
+
+// HashAlgorithms are the algorithms the server computes file hashes with.
+var HashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// hashingFiles holds the files being hashed by this process, a file is hashed
+// by one request or job at a time.
+var hashingFiles sync.Map
+
+// hashJobsRunning keeps overlapping scheduler runs from working the same jobs.
+var hashJobsRunning sync.Mutex
+
+// hashState is a hash part way through a file.
+type hashState struct {
+	hash.Hash
+	offset int64
+}
+
+// resumeHash continues from the checkpoint of a file when it was taken with
+// the same algorithm, and starts over otherwise.
+func resumeHash(db *gorm.DB, fileId, algorithm string) *hashState {
+	state := &hashState{Hash: HashAlgorithms[algorithm]()}
+	var checkpoints []models.HashCheckpoint
+	if err := db.Where("file_id = ?", fileId).Find(&checkpoints).Error; err != nil ||
+		len(checkpoints) == 0 || checkpoints[0].Algorithm != algorithm {
+		return state
+	}
+	if u, ok := state.Hash.(encoding.BinaryUnmarshaler); ok && u.UnmarshalBinary(checkpoints[0].State) == nil {
+		state.offset = checkpoints[0].HashedBytes
+	} else {
+		state.Hash = HashAlgorithms[algorithm]()
+	}
+	return state
+}
+
+func saveCheckpoint(db *gorm.DB, fileId, algorithm string, state *hashState) error {
+	m, ok := state.Hash.(encoding.BinaryMarshaler)
+	if !ok || state.offset == 0 {
+		return nil
+	}
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&models.HashCheckpoint{FileID: fileId,
+		Algorithm: algorithm, HashedBytes: state.offset, State: data, UpdatedAt: time.Now().UTC()}).Error
+}
+
+// throttledWriter caps the rate bytes are written to w.
+type throttledWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *rate.Limiter
+}
+
+func newThrottledWriter(ctx context.Context, w io.Writer, bytesPerSecond int64) *throttledWriter {
+	burst := int(min(bytesPerSecond, 1<<20))
+	return &throttledWriter{ctx: ctx, w: w, limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), burst)}
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), t.limiter.Burst())
+		if err := t.limiter.WaitN(t.ctx, n); err != nil {
+			return written, err
+		}
+		m, err := t.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// hashFile reads the plaintext of file and returns its hex digest. Progress
+// is checkpointed while reading, so a failed hash continues where it stopped
+// the next time.
+func (fs *FileService) hashFile(ctx context.Context, session *models.Session, file *schemas.FileOutFull,
+	algorithm string) (string, error) {
+	if file.Encryption == EncryptionClient {
+		return "", ErrHashClientEncrypted
+	}
+
+	if file.InlineData != nil {
+		var key string
+		if file.Encrypted {
+			var err error
+			if key, err = encryptionKey(fs.db, &fs.cnf.TG, file.UserID, file.KeyVersion); err != nil {
+				return "", err
+			}
+		}
+		data, err := openInline(key, file.InlineData, file.Encrypted)
+		if err != nil {
+			return "", err
+		}
+		h := HashAlgorithms[algorithm]()
+		h.Write(data)
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+
+	state := resumeHash(fs.db, file.Id, algorithm)
+	if state.offset < file.Size {
+		var dst io.Writer = state
+		if fs.cnf.TG.Hashing.MaxRate > 0 {
+			dst = newThrottledWriter(ctx, state, fs.cnf.TG.Hashing.MaxRate)
+		}
+		every := fs.cnf.TG.Hashing.CheckpointSize
+		if every <= 0 {
+			every = file.Size
+		}
+
+		spec, middlewares, _, err := fs.streamClient(session, file)
+		if err != nil {
+			return "", err
+		}
+		keys := keyResolver(fs.db, &fs.cnf.TG, file.UserID)
+
+		err = fs.clients.Run(ctx, spec, func(ctx context.Context, client *telegram.Client) error {
+			api := tgc.WithMiddlewares(client, middlewares...)
+			parts, err := getParts(ctx, api, fs.cache, file)
+			if err != nil {
+				return err
+			}
+			lr, err := reader.NewLinearReader(ctx, api, fs.cache, file, parts, state.offset, file.Size-1, &fs.cnf.TG, keys, 0)
+			if err != nil {
+				return err
+			}
+			defer lr.Close()
+			for state.offset < file.Size {
+				n, err := io.CopyN(dst, lr, min(every, file.Size-state.offset))
+				state.offset += n
+				if err != nil {
+					return err
+				}
+				if state.offset < file.Size {
+					if err := saveCheckpoint(fs.db, file.Id, algorithm, state); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			if err := saveCheckpoint(fs.db, file.Id, algorithm, state); err != nil {
+				fs.logger.Warnw("failed to save hash checkpoint", "fileId", file.Id, "err", err)
+			}
+			return "", err
+		}
+	}
+	return hex.EncodeToString(state.Sum(nil)), nil
+}
+
+// storeFileHash hashes file and stores the hash on its row.
+func (fs *FileService) storeFileHash(ctx context.Context, session *models.Session, file *schemas.FileOutFull,
+	algorithm string) (string, error) {
+	if _, busy := hashingFiles.LoadOrStore(file.Id, struct{}{}); busy {
+		return "", ErrHashInProgress
+	}
+	defer hashingFiles.Delete(file.Id)
+
+	sum, err := fs.hashFile(ctx, session, file, algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	err = fs.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.File{}).Where("id = ?", file.Id).
+			UpdateColumns(map[string]any{"hash": sum, "hash_algorithm": algorithm}).Error; err != nil {
+			return err
+		}
+		return tx.Where("file_id = ?", file.Id).Delete(&models.HashCheckpoint{}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	fs.cache.Delete(fmt.Sprintf("files:%s", file.Id))
+	return sum, nil
+}
+
+func (fs *FileService) hashAlgorithmOf(requested string) string {
+	if requested != "" {
+		return requested
+	}
+	return fs.cnf.TG.Hashing.Algorithm
+}
+
+// ComputeHash hashes a file on the server and stores the hash. A stored hash
+// of the requested algorithm is returned as is unless force is set. Large
+// files may outlast the request; calling again resumes from the last
+// checkpoint.
+func (fs *FileService) ComputeHash(c *gin.Context, userId int64, fileId string,
+	query *schemas.ComputeHashQuery) (*schemas.FileHashOut, *types.AppError) {
+	file, appErr := fs.GetFileByID(fileId)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if file.UserID != userId {
+		return nil, &types.AppError{Error: database.ErrNotFound, Code: http.StatusNotFound}
+	}
+	if file.Type != "file" {
+		return nil, &types.AppError{Error: errors.New("only files can be hashed"), Code: http.StatusBadRequest}
+	}
+	if file.Encryption == EncryptionClient {
+		return nil, &types.AppError{Error: ErrHashClientEncrypted, Code: http.StatusBadRequest}
+	}
+
+	algorithm := fs.hashAlgorithmOf(query.Algorithm)
+	if !query.Force && file.Hash != "" && file.HashAlgorithm == algorithm {
+		return &schemas.FileHashOut{Hash: file.Hash, HashAlgorithm: algorithm}, nil
+	}
+
+	_, tgSession := auth.GetUser(c)
+	sum, err := fs.storeFileHash(c, &models.Session{UserId: userId, Session: tgSession}, file, algorithm)
+	if errors.Is(err, ErrHashInProgress) {
+		return nil, &types.AppError{Error: err, Code: http.StatusConflict}
+	}
+	if err != nil {
+		return nil, telegramError(err)
+	}
+	return &schemas.FileHashOut{Hash: sum, HashAlgorithm: algorithm, Computed: true}, nil
+}
+
+// hashBackfill selects the files of the user a hash job covers.
+func hashBackfill(db *gorm.DB, userId int64) *gorm.DB {
+	return db.Model(&models.File{}).Where("user_id = ?", userId).Where("type = ?", "file").
+		Where("status = ?", "active").Where("hash IS NULL").Where("encryption <> ?", EncryptionClient)
+}
+
+func toHashJobOut(job *models.HashJob) *schemas.HashJobOut {
+	out := &schemas.HashJobOut{Id: job.Id, Algorithm: job.Algorithm, Status: job.Status, Total: job.Total,
+		Hashed: job.Hashed, Failed: job.Failed, CreatedAt: job.CreatedAt, UpdatedAt: job.UpdatedAt}
+	if job.Error != nil {
+		out.Error = *job.Error
+	}
+	return out
+}
+
+// QueueHashJob queues a background backfill of the hashes of every file of
+// the user that has none. An account runs one job at a time.
+func (fs *FileService) QueueHashJob(userId int64, payload *schemas.HashJobIn) (*schemas.HashJobOut, *types.AppError) {
+	job := models.HashJob{UserId: userId, Algorithm: fs.hashAlgorithmOf(payload.Algorithm), Status: HashJobQueued}
+
+	var total int64
+	if err := hashBackfill(fs.db, userId).Count(&total).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	job.Total = int(total)
+
+	if err := fs.db.Create(&job).Error; err != nil {
+		if database.IsKeyConflictErr(err) {
+			return nil, &types.AppError{Error: ErrHashJobActive, Code: http.StatusConflict}
+		}
+		return nil, &types.AppError{Error: err}
+	}
+	return toHashJobOut(&job), nil
+}
+
+func (fs *FileService) GetHashJob(userId int64, jobId string) (*schemas.HashJobOut, *types.AppError) {
+	var jobs []models.HashJob
+	if err := fs.db.Where("id = ?", jobId).Where("user_id = ?", userId).Find(&jobs).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	if len(jobs) == 0 {
+		return nil, &types.AppError{Error: ErrHashJobNotFound, Code: http.StatusNotFound}
+	}
+	return toHashJobOut(&jobs[0]), nil
+}
+
+// CancelHashJob stops a job after the file it is hashing.
+func (fs *FileService) CancelHashJob(userId int64, jobId string) (*schemas.HashJobOut, *types.AppError) {
+	if err := fs.db.Model(&models.HashJob{}).Where("id = ?", jobId).Where("user_id = ?", userId).
+		Where("status IN ?", []string{HashJobQueued, HashJobRunning}).
+		Updates(map[string]any{"status": HashJobCancelled, "updated_at": time.Now().UTC()}).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	return fs.GetHashJob(userId, jobId)
+}
+
+// RunHashJobs works through the queued hash jobs one file at a time. A job
+// interrupted by a restart continues after the last file it finished.
+func (fs *FileService) RunHashJobs(ctx context.Context) {
+	if !hashJobsRunning.TryLock() {
+		return
+	}
+	defer hashJobsRunning.Unlock()
+
+	var jobs []models.HashJob
+	if err := fs.db.Where("status IN ?", []string{HashJobQueued, HashJobRunning}).
+		Order("created_at").Find(&jobs).Error; err != nil {
+		fs.logger.Errorw("failed to load hash jobs", "err", err)
+		return
+	}
+	for i := range jobs {
+		if ctx.Err() != nil {
+			return
+		}
+		fs.runHashJob(ctx, &jobs[i])
+	}
+}
+
+func (fs *FileService) runHashJob(ctx context.Context, job *models.HashJob) {
+	logger := fs.logger.With("jobId", job.Id)
+
+	var sessions []models.Session
+	if err := fs.db.Where("user_id = ?", job.UserId).Order("created_at desc").Limit(1).
+		Find(&sessions).Error; err != nil || len(sessions) == 0 {
+		// Without a session the parts cannot be read, the job waits for the
+		// next login.
+		return
+	}
+
+	update := func(values map[string]any) bool {
+		values["updated_at"] = time.Now().UTC()
+		res := fs.db.Model(&models.HashJob{}).Where("id = ?", job.Id).
+			Where("status IN ?", []string{HashJobQueued, HashJobRunning}).Updates(values)
+		if res.Error != nil {
+			logger.Errorw("failed to update hash job", "err", res.Error)
+			return false
+		}
+		// No row means the job was cancelled meanwhile.
+		return res.RowsAffected > 0
+	}
+
+	if !update(map[string]any{"status": HashJobRunning}) {
+		return
+	}
+
+	for ctx.Err() == nil {
+		chain := hashBackfill(fs.db, job.UserId).Order("id").Limit(1)
+		if job.LastFileID != nil {
+			chain = chain.Where("id > ?", *job.LastFileID)
+		}
+		var files []models.File
+		if err := chain.Find(&files).Error; err != nil {
+			logger.Errorw("failed to load files to hash", "err", err)
+			return
+		}
+		if len(files) == 0 {
+			update(map[string]any{"status": HashJobCompleted})
+			return
+		}
+
+		file := mapper.ToFileOutFull(files[0])
+		values := map[string]any{"last_file_id": file.Id}
+		if _, err := fs.storeFileHash(ctx, &sessions[0], file, job.Algorithm); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Warnw("failed to hash file", "fileId", file.Id, "err", err)
+			job.Failed++
+			values["failed"] = job.Failed
+			values["error"] = fmt.Sprintf("%s: %v", file.Name, err)
+		} else {
+			job.Hashed++
+			values["hashed"] = job.Hashed
+		}
+		job.LastFileID = &file.Id
+		if !update(values) {
+			return
+		}
+	}
+}
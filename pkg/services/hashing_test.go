@@ -0,0 +1,41 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashAlgorithms(t *testing.T) {
+	for name, newHash := range HashAlgorithms {
+		h := newHash()
+		assert.Equal(t, hashDigestLengths[name], len(hex.EncodeToString(h.Sum(nil))), name)
+
+		// Checkpoints rely on every algorithm saving its state.
+		_, ok := h.(encoding.BinaryMarshaler)
+		assert.True(t, ok, name)
+	}
+}
+
+func TestThrottledWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := newThrottledWriter(context.Background(), &buf, 4096)
+
+	data := bytes.Repeat([]byte("x"), 6000)
+	start := time.Now()
+	n, err := w.Write(data)
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), n)
+	assert.Equal(t, data, buf.Bytes())
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = newThrottledWriter(ctx, &buf, 4096).Write(data)
+	assert.Error(t, err)
+}
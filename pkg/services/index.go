@@ -0,0 +1,64 @@
+package services
+
+import (
+	"bytes"
+	"mime"
+	"path/filepath"
+	"unicode/utf8"
+
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/policy"
+)
+
+// indexable reports whether the content of a file is added to the search
+// index. The first known of its declared, extension and sniffed mime types is
+// matched against the allowlist. Encrypted files are never indexed, that would
+// keep their plaintext in the database. A negative size means unknown.
+func indexable(cnf *config.TGConfig, name, mimeType, sniffed string, size int64, encrypted bool) bool {
+	index := cnf.Uploads.Index
+	if !index.Enabled || encrypted || size > index.MaxSize {
+		return false
+	}
+	for _, candidate := range []string{mimeType, mime.TypeByExtension(filepath.Ext(name)), sniffed} {
+		if candidate != "" && candidate != "application/octet-stream" {
+			return policy.MatchMime(index.MimeTypes, candidate)
+		}
+	}
+	return false
+}
+
+// indexText returns data as searchable text, nil when it is empty or binary.
+func indexText(data []byte) *string {
+	if len(bytes.TrimSpace(data)) == 0 || bytes.IndexByte(data, 0) >= 0 || !utf8.Valid(data) {
+		return nil
+	}
+	text := string(data)
+	return &text
+}
+
+// textCapture keeps what is written to it while it fits in max bytes, so the
+// content of a streamed upload can be indexed once it is stored.
+type textCapture struct {
+	buf      bytes.Buffer
+	max      int64
+	overflow bool
+}
+
+func (t *textCapture) Write(p []byte) (int, error) {
+	if t.overflow || int64(t.buf.Len()+len(p)) > t.max {
+		t.overflow = true
+		t.buf.Reset()
+	} else {
+		t.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+// Text returns the captured content, nil when nothing was captured or it
+// did not fit.
+func (t *textCapture) Text() *string {
+	if t == nil || t.overflow {
+		return nil
+	}
+	return indexText(t.buf.Bytes())
+}
@@ -0,0 +1,46 @@
+package services
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/internal/config"
+)
+
+func TestIndexable(t *testing.T) {
+	cnf := &config.TGConfig{}
+	assert.False(t, indexable(cnf, "notes.txt", "", "", 10, false))
+
+	cnf.Uploads.Index.Enabled = true
+	cnf.Uploads.Index.MaxSize = 100
+	cnf.Uploads.Index.MimeTypes = []string{"text/*", "application/json"}
+	assert.True(t, indexable(cnf, "notes.txt", "", "", 10, false))
+	assert.True(t, indexable(cnf, "data", "application/json; charset=utf-8", "", -1, false))
+	assert.True(t, indexable(cnf, "README", "", "text/plain; charset=utf-8", 10, false))
+	assert.False(t, indexable(cnf, "notes.txt", "", "", 10, true))
+	assert.False(t, indexable(cnf, "notes.txt", "", "", 101, false))
+	assert.False(t, indexable(cnf, "movie.mp4", "", "text/plain; charset=utf-8", 10, false))
+	assert.False(t, indexable(cnf, "blob", "", "", 10, false))
+}
+
+func TestIndexText(t *testing.T) {
+	assert.Equal(t, "héllo wörld", *indexText([]byte("héllo wörld")))
+	assert.Nil(t, indexText([]byte(" \n")))
+	assert.Nil(t, indexText([]byte("a\x00b")))
+	assert.Nil(t, indexText([]byte{0xff, 0xfe}))
+}
+
+func TestTextCapture(t *testing.T) {
+	capture := &textCapture{max: 8}
+	io.Copy(io.Discard, io.TeeReader(strings.NewReader("short"), capture))
+	assert.Equal(t, "short", *capture.Text())
+
+	capture = &textCapture{max: 8}
+	io.Copy(io.Discard, io.TeeReader(strings.NewReader("a little too long"), capture))
+	assert.Nil(t, capture.Text())
+
+	var none *textCapture
+	assert.Nil(t, none.Text())
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/tgdrive/teldrive/internal/crypt"
+)
+
+// MaxInlineSize caps the inline threshold so small-file storage cannot grow
+// rows past what the database handles comfortably.
+const MaxInlineSize = 64 << 10
+
+// inlineSalt derives the key of inline content. Every blob still carries its
+// own random nonce, so a fixed salt does not repeat keystreams.
+const inlineSalt = "teldrive-inline"
+
+var ErrInlineTooLarge = errors.New("inline data exceeds the inline threshold")
+
+// inlineEligible reports whether an uploaded part is the whole file and small
+// enough to be kept in the database.
+func inlineEligible(threshold, size int64, partNo, totalParts int, totalSize int64) bool {
+	if threshold <= 0 || size <= 0 || size > threshold || partNo != 1 {
+		return false
+	}
+	return totalParts == 1 || (totalParts == 0 && totalSize > 0 && totalSize == size)
+}
+
+// sealInline returns data as it is stored, encrypted when requested.
+func sealInline(key string, data []byte, encrypted bool) ([]byte, error) {
+	if !encrypted {
+		return data, nil
+	}
+	cipher, err := crypt.NewCipher(key, inlineSalt)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := cipher.EncryptData(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// openInline reverses sealInline.
+func openInline(key string, blob []byte, encrypted bool) ([]byte, error) {
+	if !encrypted {
+		return blob, nil
+	}
+	cipher, err := crypt.NewCipher(key, inlineSalt)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := cipher.DecryptData(io.NopCloser(bytes.NewReader(blob)))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt inline data: %w", err)
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
@@ -0,0 +1,44 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInlineEligible(t *testing.T) {
+	assert.True(t, inlineEligible(1024, 100, 1, 1, 0))
+	assert.True(t, inlineEligible(1024, 100, 1, 0, 100))
+	assert.True(t, inlineEligible(1024, 1024, 1, 1, 0))
+	assert.False(t, inlineEligible(0, 100, 1, 1, 0))
+	assert.False(t, inlineEligible(1024, 1025, 1, 1, 0))
+	assert.False(t, inlineEligible(1024, 100, 2, 1, 0))
+	assert.False(t, inlineEligible(1024, 100, 1, 2, 0))
+	assert.False(t, inlineEligible(1024, 100, 1, 0, 0))
+	assert.False(t, inlineEligible(1024, 100, 1, 0, 200))
+	assert.False(t, inlineEligible(1024, 0, 1, 1, 0))
+}
+
+func TestSealInline(t *testing.T) {
+	data := []byte("small file content")
+
+	plain, err := sealInline("key", data, false)
+	require.NoError(t, err)
+	assert.Equal(t, data, plain)
+
+	sealed, err := sealInline("key", data, true)
+	require.NoError(t, err)
+	assert.NotEqual(t, data, sealed)
+
+	again, err := sealInline("key", data, true)
+	require.NoError(t, err)
+	assert.NotEqual(t, sealed, again)
+
+	opened, err := openInline("key", sealed, true)
+	require.NoError(t, err)
+	assert.Equal(t, data, opened)
+
+	opened, _ = openInline("other", sealed, true)
+	assert.NotEqual(t, data, opened)
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/pkg/httputil"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+)
+
+// appLinks maps a player name to a function building its protocol-handler
+// link from an absolute stream URL.
+var appLinks = map[string]func(stream, name string) string{
+	"vlc": func(stream, _ string) string {
+		return "vlc://" + stream
+	},
+	"potplayer": func(stream, _ string) string {
+		return "potplayer://" + stream
+	},
+	"iina": func(stream, _ string) string {
+		return "iina://weblink?url=" + url.QueryEscape(stream)
+	},
+	"infuse": func(stream, _ string) string {
+		return "infuse://x-callback-url/play?url=" + url.QueryEscape(stream)
+	},
+	"mpv": func(stream, _ string) string {
+		return "mpv://" + url.QueryEscape(stream)
+	},
+	"mxplayer": func(stream, name string) string {
+		u, _ := url.Parse(stream)
+		return fmt.Sprintf("intent:%s#Intent;package=com.mxtech.videoplayer.ad;S.title=%s;end",
+			strings.TrimPrefix(stream, u.Scheme+":"), url.QueryEscape(name))
+	},
+}
+
+func requestBaseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+	}
+	host := c.Request.Host
+	if fwd := c.GetHeader("X-Forwarded-Host"); fwd != "" {
+		host = strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	return scheme + "://" + host + httputil.BasePath(c.Request)
+}
+
+// FileLinks builds ready-to-use stream, download and player links for file.
+// The download link is signed and expires after the configured presign expiry.
+func (fs *FileService) FileLinks(c *gin.Context, file *schemas.FileOutFull) *schemas.FileLinks {
+	val, _ := c.Get("jwtUser")
+	claims := val.(*types.JWTClaims)
+	userId, _ := auth.GetUser(c)
+
+	base := requestBaseURL(c)
+	name := url.PathEscape(file.Name)
+
+	stream := fmt.Sprintf("%s/api/files/%s/stream/%s?%s", base, file.Id, name,
+		url.Values{"hash": {claims.Hash}}.Encode())
+
+	expires := time.Now().Add(fs.cnf.Links.PresignExpiry).UTC().Truncate(time.Second)
+	signed := auth.SignFile(fs.cnf.JWT.Secret, file.Id, userId, expires).Encode()
+
+	links := &schemas.FileLinks{
+		Stream:    stream,
+		Download:  fmt.Sprintf("%s/api/files/%s/download/%s?%s", base, file.Id, name, signed),
+		ExpiresAt: expires,
+	}
+
+	for _, app := range fs.cnf.Links.Apps {
+		build, ok := appLinks[strings.ToLower(app)]
+		if !ok {
+			continue
+		}
+		if links.Apps == nil {
+			links.Apps = make(map[string]string)
+		}
+		links.Apps[strings.ToLower(app)] = build(stream, file.Name)
+	}
+
+	return links
+}
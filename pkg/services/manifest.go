@@ -0,0 +1,140 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gotd/td/telegram"
+	"github.com/tgdrive/teldrive/internal/http_range"
+	"github.com/tgdrive/teldrive/internal/md5"
+	"github.com/tgdrive/teldrive/internal/reader"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/httputil"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+)
+
+var ErrPartNotFound = errors.New("part not found")
+
+// manifestParts lays parts out as the byte ranges they cover in the file.
+// Only sizes and offsets are exposed, never message ids or salts.
+func manifestParts(parts []types.Part, encrypted bool) []schemas.ManifestPart {
+	res := make([]schemas.ManifestPart, 0, len(parts))
+	var offset int64
+	for i, part := range parts {
+		size := reader.LogicalPartSize(part, encrypted)
+		res = append(res, schemas.ManifestPart{Index: i, Offset: offset, Size: size})
+		offset += size
+	}
+	return res
+}
+
+func (fs *FileService) manifestPartsFor(c *gin.Context, session *models.Session, file *schemas.FileOutFull) ([]schemas.ManifestPart, error) {
+	if file.Type != "file" || file.Size == 0 {
+		return []schemas.ManifestPart{}, nil
+	}
+	if file.InlineData != nil {
+		return []schemas.ManifestPart{{Index: 0, Offset: 0, Size: file.Size}}, nil
+	}
+	spec, middlewares, _, err := fs.streamClient(session, file)
+	if err != nil {
+		return nil, err
+	}
+	var parts []types.Part
+	err = fs.clients.Run(c, spec, func(ctx context.Context, client *telegram.Client) error {
+		parts, err = getParts(ctx, tgc.WithMiddlewares(client, middlewares...), fs.cache, file)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return manifestParts(parts, file.Encrypted), nil
+}
+
+// GetFileManifest describes how a file splits into independently fetchable
+// parts for download managers. The first parts are hinted for preloading.
+func (fs *FileService) GetFileManifest(c *gin.Context) {
+	session, file, ok := fs.resolveStreamFile(c, nil)
+	if !ok {
+		return
+	}
+
+	parts, err := fs.manifestPartsFor(c, session, file)
+	if err != nil {
+		httputil.NewError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	fs.hintParts(c, file.Id, 0, len(parts))
+
+	c.JSON(http.StatusOK, &schemas.FileManifest{
+		ID:       file.Id,
+		Name:     file.Name,
+		MimeType: file.MimeType,
+		Size:     file.Size,
+		ETag:     md5.FromString(file.Id + strconv.FormatInt(file.Size, 10)),
+		Parts:    parts,
+	})
+}
+
+// GetFilePart streams a single part of a file by its manifest index. Range
+// requests are relative to the part. The parts after it are hinted for
+// preloading.
+func (fs *FileService) GetFilePart(c *gin.Context) {
+	session, file, ok := fs.resolveStreamFile(c, nil)
+	if !ok || !fs.checkStreamKeys(c, session, file) {
+		return
+	}
+
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil || index < 0 {
+		httputil.NewError(c, http.StatusBadRequest, errors.New("invalid part index"))
+		return
+	}
+
+	parts, err := fs.manifestPartsFor(c, session, file)
+	if err != nil {
+		httputil.NewError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if index >= len(parts) {
+		httputil.NewError(c, http.StatusNotFound, ErrPartNotFound)
+		return
+	}
+	part := parts[index]
+
+	c.Header("Accept-Ranges", "bytes")
+	fs.hintParts(c, file.Id, index+1, len(parts))
+
+	start, end := int64(0), part.Size-1
+
+	if rangeHeader := c.GetHeader("Range"); rangeHeader == "" {
+		c.Writer.WriteHeader(http.StatusOK)
+	} else {
+		ranges, err := http_range.Parse(rangeHeader, part.Size)
+		if err == http_range.ErrNoOverlap {
+			c.Header("Content-Range", fmt.Sprintf("bytes */%d", part.Size))
+			httputil.NewError(c, http.StatusRequestedRangeNotSatisfiable, http_range.ErrNoOverlap)
+			return
+		}
+		if err != nil {
+			httputil.NewError(c, http.StatusBadRequest, err)
+			return
+		}
+		if len(ranges) > 1 {
+			httputil.NewError(c, http.StatusRequestedRangeNotSatisfiable, errors.New("multiple ranges are not supported"))
+			return
+		}
+		start, end = ranges[0].Start, ranges[0].End
+		c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, part.Size))
+		c.Writer.WriteHeader(http.StatusPartialContent)
+	}
+
+	fs.streamRange(c, session, file, part.Offset+start, part.Offset+end,
+		fmt.Sprintf("%s.%d", file.Name, index), "attachment", false)
+}
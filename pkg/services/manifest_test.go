@@ -0,0 +1,80 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+)
+
+func TestManifestParts(t *testing.T) {
+	parts := []types.Part{
+		{ID: 11, Size: 116, DecryptedSize: 100, Salt: "s1"},
+		{ID: 12, Size: 116, DecryptedSize: 100, Salt: "s2"},
+		{ID: 13, Size: 66, DecryptedSize: 50, Salt: "s3"},
+	}
+
+	assert.Equal(t, []schemas.ManifestPart{
+		{Index: 0, Offset: 0, Size: 100},
+		{Index: 1, Offset: 100, Size: 100},
+		{Index: 2, Offset: 200, Size: 50},
+	}, manifestParts(parts, true))
+
+	assert.Equal(t, []schemas.ManifestPart{
+		{Index: 0, Offset: 0, Size: 116},
+		{Index: 1, Offset: 116, Size: 116},
+		{Index: 2, Offset: 232, Size: 66},
+	}, manifestParts(parts, false))
+
+	compressed := []types.Part{{Size: 40, Compression: "zstd", OriginalSize: 100}, {Size: 10, Compression: "zstd", OriginalSize: 30}}
+	assert.Equal(t, []schemas.ManifestPart{
+		{Index: 0, Offset: 0, Size: 100},
+		{Index: 1, Offset: 100, Size: 30},
+	}, manifestParts(compressed, false))
+}
+
+func TestPreloadTargets(t *testing.T) {
+	query := url.Values{"hash": {"abc"}, "download": {"1"}}
+	assert.Equal(t, []string{"/api/files/f1/parts/3?hash=abc", "/api/files/f1/parts/4?hash=abc"},
+		preloadTargets("/api/files/f1/parts/2", "f1", query, 3, 2, 10))
+	assert.Equal(t, []string{"/drive/api/files/f1/parts/0"},
+		preloadTargets("/drive/api/files/f1/manifest", "f1", url.Values{}, 0, 4, 1))
+
+	signed := url.Values{"uid": {"7"}, "exp": {"100"}, "sig": {"s"}}
+	assert.Equal(t, []string{"/api/files/f1/parts/1?exp=100&sig=s&uid=7"},
+		preloadTargets("/api/files/f1/manifest", "f1", signed, 1, 1, 5))
+
+	assert.Empty(t, preloadTargets("/api/files/f1/parts/9", "f1", query, 10, 2, 10))
+	assert.Empty(t, preloadTargets("/api/files/f1/manifest", "f1", query, 0, 0, 10))
+	assert.Empty(t, preloadTargets("/api/other", "f1", query, 0, 2, 10))
+}
+
+func TestHintParts(t *testing.T) {
+	cnf := &config.Config{}
+	cnf.TG.Stream.PreloadParts = 2
+	cnf.TG.Stream.PreloadPush = true
+	fs := &FileService{cnf: cnf}
+
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/files/f1/manifest?hash=abc", nil)
+	fs.hintParts(c, "f1", 0, 3)
+	c.Status(http.StatusOK)
+
+	// HTTP/1.1 has no push, the Link headers still go out.
+	assert.Equal(t, []string{"</api/files/f1/parts/0?hash=abc>; rel=preload; as=fetch",
+		"</api/files/f1/parts/1?hash=abc>; rel=preload; as=fetch"}, rec.Header().Values("Link"))
+
+	cnf.TG.Stream.PreloadParts = 0
+	rec = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/files/f1/manifest", nil)
+	fs.hintParts(c, "f1", 0, 3)
+	assert.Empty(t, rec.Header().Values("Link"))
+}
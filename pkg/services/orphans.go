@@ -0,0 +1,124 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"path"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/pkg/check"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+)
+
+var ErrOrphanScope = errors.New("admin access required to check other users")
+
+// orphanScope returns the user a cleanup runs for. Admins may pick any user
+// or all of them, everybody else only sees their own data.
+func (as *AdminService) orphanScope(c *gin.Context, requested int64) (int64, *types.AppError) {
+	userId, _ := auth.GetUser(c)
+	val, _ := c.Get("jwtUser")
+	if claims, ok := val.(*types.JWTClaims); ok && auth.IsAdmin(as.cnf.JWT.AdminUsers, claims) {
+		return requested, nil
+	}
+	if requested != 0 && requested != userId {
+		return 0, &types.AppError{Error: ErrOrphanScope, Code: http.StatusForbidden}
+	}
+	return userId, nil
+}
+
+func (as *AdminService) runOrphanCheck(ctx context.Context, opts check.Options) ([]check.Finding, *types.AppError) {
+	opts.Run = func(ctx context.Context, session string, f func(ctx context.Context, api *tg.Client) error) error {
+		return as.clients.Run(ctx, as.clients.UserSpec(session), func(ctx context.Context, client *telegram.Client) error {
+			return f(ctx, client.API())
+		})
+	}
+	findings, err := check.New(as.db, as.cnf, opts, logging.FromContext(ctx)).Run(ctx)
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	return findings, nil
+}
+
+func orphanCounts(findings []check.Finding) map[string]int {
+	counts := make(map[string]int, len(check.Kinds))
+	for _, kind := range check.Kinds {
+		counts[kind] = 0
+	}
+	for _, finding := range findings {
+		counts[finding.Kind]++
+	}
+	return counts
+}
+
+func toOrphans(findings []check.Finding) []schemas.Orphan {
+	res := make([]schemas.Orphan, 0, len(findings))
+	for _, finding := range findings {
+		res = append(res, schemas.Orphan{Kind: finding.Kind, UserID: finding.UserId, FileID: finding.FileId,
+			Detail: finding.Detail, Repaired: finding.Repaired})
+	}
+	return res
+}
+
+// paginateOrphans returns one page of the findings along with the counts of
+// all of them.
+func paginateOrphans(findings []check.Finding, page, limit int) *schemas.OrphanList {
+	count := len(findings)
+	start := min((page-1)*limit, count)
+	end := min(start+limit, count)
+	return &schemas.OrphanList{
+		Counts: orphanCounts(findings),
+		Items:  toOrphans(findings[start:end]),
+		Meta: schemas.Meta{Count: count, TotalPages: int(math.Ceil(float64(count) / float64(limit))),
+			CurrentPage: page},
+	}
+}
+
+// ListOrphans reports entries with a broken parent, upload parts that were
+// never finalized and files whose messages are gone, without changing them.
+func (as *AdminService) ListOrphans(c *gin.Context, query *schemas.OrphanQuery) (*schemas.OrphanList, *types.AppError) {
+	userId, appErr := as.orphanScope(c, query.UserID)
+	if appErr != nil {
+		return nil, appErr
+	}
+	opts := check.Options{UserId: userId, SkipTelegram: query.SkipTelegram}
+	if query.Kind != "" {
+		opts.Kinds = []string{query.Kind}
+	}
+	findings, appErr := as.runOrphanCheck(c, opts)
+	if appErr != nil {
+		return nil, appErr
+	}
+	return paginateOrphans(findings, query.Page, query.Limit), nil
+}
+
+// RepairOrphans cleans up what ListOrphans reports, limited to the kinds and
+// entries of the payload.
+func (as *AdminService) RepairOrphans(c *gin.Context, payload *schemas.OrphanRepair) (*schemas.OrphanList, *types.AppError) {
+	userId, appErr := as.orphanScope(c, payload.UserID)
+	if appErr != nil {
+		return nil, appErr
+	}
+	opts := check.Options{
+		Repair:         true,
+		DeleteMessages: payload.DeleteMessages,
+		SkipTelegram:   payload.SkipTelegram,
+		UserId:         userId,
+		Kinds:          payload.Kinds,
+		FileIds:        payload.FileIDs,
+	}
+	if payload.Destination != "" {
+		opts.Destination = path.Clean("/" + payload.Destination)
+	}
+	findings, appErr := as.runOrphanCheck(c, opts)
+	if appErr != nil {
+		return nil, appErr
+	}
+	return paginateOrphans(findings, 1, max(len(findings), 1)), nil
+}
@@ -0,0 +1,27 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/pkg/check"
+)
+
+func TestPaginateOrphans(t *testing.T) {
+	findings := []check.Finding{
+		{Kind: check.KindBrokenParent, FileId: "a"},
+		{Kind: check.KindBrokenParent, FileId: "b"},
+		{Kind: check.KindMissingParts, FileId: "c"},
+	}
+
+	res := paginateOrphans(findings, 2, 2)
+	assert.Equal(t, map[string]int{check.KindBrokenParent: 2, check.KindExpiredUpload: 0, check.KindMissingParts: 1}, res.Counts)
+	assert.Len(t, res.Items, 1)
+	assert.Equal(t, "c", res.Items[0].FileID)
+	assert.Equal(t, 3, res.Meta.Count)
+	assert.Equal(t, 2, res.Meta.TotalPages)
+
+	res = paginateOrphans(findings, 5, 2)
+	assert.Empty(t, res.Items)
+	assert.Equal(t, 3, res.Meta.Count)
+}
@@ -0,0 +1,300 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrUploadNotFound     = errors.New("upload not found")
+	ErrUploadPartMismatch = errors.New("parts do not match upload")
+	ErrUploadMixedInline  = errors.New("upload mixes inline and telegram parts")
+)
+
+// PartSequenceError reports an upload whose part numbers do not form the
+// sequence 1..N.
+type PartSequenceError struct {
+	Missing   []int `json:"missing,omitempty"`
+	Duplicate []int `json:"duplicate,omitempty"`
+}
+
+func (e *PartSequenceError) Error() string {
+	return fmt.Sprintf("upload parts are not contiguous: missing %v, duplicate %v", e.Missing, e.Duplicate)
+}
+
+func (e *PartSequenceError) Details() any {
+	return e
+}
+
+// checkPartSequence verifies that sorted part numbers are exactly 1..N.
+func checkPartSequence(partNos []int) error {
+	var (
+		res  PartSequenceError
+		next = 1
+	)
+	for i, no := range partNos {
+		if i > 0 && no == partNos[i-1] {
+			if len(res.Duplicate) == 0 || res.Duplicate[len(res.Duplicate)-1] != no {
+				res.Duplicate = append(res.Duplicate, no)
+			}
+			continue
+		}
+		for ; next < no; next++ {
+			res.Missing = append(res.Missing, next)
+		}
+		next = no + 1
+	}
+	if len(res.Missing) > 0 || len(res.Duplicate) > 0 {
+		return &res
+	}
+	return nil
+}
+
+// uploadedParts loads the stored parts of an upload in order after checking
+// that none are missing or duplicated. Parts sent by the client must list the
+// same messages in the same order. The upload rows are returned alongside; an
+// upload stored inline has a single row and no parts.
+func uploadedParts(db *gorm.DB, userId int64, uploadId string, sent []schemas.Part) ([]schemas.Part, []models.Upload, *types.AppError) {
+	var uploads []models.Upload
+	if err := db.Where("upload_id = ?", uploadId).Where("user_id = ?", userId).
+		Order("part_no").Order("created_at").Find(&uploads).Error; err != nil {
+		return nil, nil, &types.AppError{Error: err}
+	}
+	if len(uploads) == 0 {
+		return nil, nil, &types.AppError{Error: ErrUploadNotFound, Code: http.StatusNotFound}
+	}
+
+	for _, upload := range uploads {
+		if upload.InlineData != nil {
+			if len(uploads) > 1 || len(sent) > 0 {
+				return nil, nil, &types.AppError{Error: ErrUploadMixedInline, Code: http.StatusBadRequest}
+			}
+			return nil, uploads, nil
+		}
+	}
+
+	partNos := make([]int, 0, len(uploads))
+	for _, upload := range uploads {
+		partNos = append(partNos, upload.PartNo)
+	}
+	if err := checkPartSequence(partNos); err != nil {
+		return nil, nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+
+	parts := make([]schemas.Part, 0, len(uploads))
+	for _, upload := range uploads {
+		parts = append(parts, schemas.Part{ID: int64(upload.PartId), Salt: upload.Salt,
+			Compression: upload.Compression, OriginalSize: upload.OriginalSize, Replicas: upload.Replicas,
+			KeyVersion: upload.KeyVersion})
+	}
+
+	if len(sent) > 0 {
+		if len(sent) != len(parts) {
+			return nil, nil, &types.AppError{Error: ErrUploadPartMismatch, Code: http.StatusBadRequest}
+		}
+		for i := range sent {
+			if sent[i].ID != parts[i].ID {
+				return nil, nil, &types.AppError{Error: ErrUploadPartMismatch, Code: http.StatusBadRequest}
+			}
+		}
+	}
+	return parts, uploads, nil
+}
+
+type PartMismatch struct {
+	PartNo   int   `json:"partNo"`
+	Expected int64 `json:"expected"`
+	Actual   int64 `json:"actual"`
+}
+
+// PartVerifyError lists the parts of an upload whose telegram messages are
+// gone or hold a different number of bytes than were uploaded.
+type PartVerifyError struct {
+	Missing    []int          `json:"missing,omitempty"`
+	Mismatched []PartMismatch `json:"mismatched,omitempty"`
+}
+
+func (e *PartVerifyError) Error() string {
+	return fmt.Sprintf("upload parts failed verification: missing %v, mismatched %d", e.Missing, len(e.Mismatched))
+}
+
+func (e *PartVerifyError) Details() any {
+	return e
+}
+
+// checkPartMessages matches the messages fetched for an upload against its
+// rows by message id.
+func checkPartMessages(uploads []models.Upload, messages []tg.MessageClass) error {
+	byId := make(map[int]tg.MessageClass, len(messages))
+	for _, message := range messages {
+		byId[message.GetID()] = message
+	}
+	var res PartVerifyError
+	for _, upload := range uploads {
+		message, ok := byId[upload.PartId]
+		if !ok {
+			res.Missing = append(res.Missing, upload.PartNo)
+			continue
+		}
+		sizes, err := documentSizes([]tg.MessageClass{message})
+		if err != nil {
+			res.Missing = append(res.Missing, upload.PartNo)
+			continue
+		}
+		if sizes[0] != upload.Size {
+			res.Mismatched = append(res.Mismatched, PartMismatch{PartNo: upload.PartNo, Expected: upload.Size, Actual: sizes[0]})
+		}
+	}
+	if len(res.Missing) > 0 || len(res.Mismatched) > 0 {
+		return &res
+	}
+	return nil
+}
+
+// verifyUploadParts confirms every part of an upload is still stored in
+// telegram with the size recorded for it. Rows of failed parts are dropped so
+// the client can send those parts again.
+func (fs *FileService) verifyUploadParts(c *gin.Context, uploads []models.Upload) *types.AppError {
+	_, session := auth.GetUser(c)
+
+	byChannel := make(map[int64][]int)
+	for _, upload := range uploads {
+		byChannel[upload.ChannelID] = append(byChannel[upload.ChannelID], upload.PartId)
+	}
+
+	var messages []tg.MessageClass
+	err := fs.clients.Run(c, fs.clients.UserSpec(session), func(ctx context.Context, client *telegram.Client) error {
+		for channelId, ids := range byChannel {
+			res, err := tgc.GetMessages(ctx, client.API(), ids, channelId)
+			if err != nil {
+				return err
+			}
+			messages = append(messages, res...)
+		}
+		return nil
+	})
+	if err != nil {
+		return &types.AppError{Error: err}
+	}
+
+	verifyErr := checkPartMessages(uploads, messages)
+	if verifyErr == nil {
+		return nil
+	}
+
+	failed := verifyErr.(*PartVerifyError)
+	partNos := append([]int{}, failed.Missing...)
+	for _, mismatch := range failed.Mismatched {
+		partNos = append(partNos, mismatch.PartNo)
+	}
+	fs.db.Where("upload_id = ?", uploads[0].UploadId).Where("user_id = ?", uploads[0].UserId).
+		Where("part_no in ?", partNos).Delete(&models.Upload{})
+
+	return &types.AppError{Error: verifyErr, Code: http.StatusConflict}
+}
+
+// PartNoHeader carries the number the server gave a part, on failed requests
+// too, so the part can be sent again under that number.
+const PartNoHeader = "X-Part-No"
+
+// reservePartNo numbers a part of an upload when its request arrives, after
+// every number handed out or stored for the upload before. Parts are then
+// numbered in the order they were sent, not the order they finish in.
+func reservePartNo(db *gorm.DB, userId int64, uploadId string) (int, error) {
+	var partNo int
+	err := db.Raw(`INSERT INTO teldrive.upload_part_numbers AS n (user_id, upload_id, part_no)
+		SELECT ?, ?, coalesce(max(part_no), 0) + 1 FROM teldrive.uploads WHERE user_id = ? AND upload_id = ?
+		ON CONFLICT (user_id, upload_id) DO UPDATE
+		SET part_no = greatest(n.part_no + 1, excluded.part_no), updated_at = timezone('utc'::text, now())
+		RETURNING part_no`, userId, uploadId, userId, uploadId).Scan(&partNo).Error
+	return partNo, err
+}
+
+// insertUploadPart stores part and returns the parts it replaced: a part
+// stored before under the same number, from a retried request. Upload ids are
+// only unique per user, an advisory lock on the user and upload id
+// serializes the replacement.
+func insertUploadPart(db *gorm.DB, part *models.Upload) ([]models.Upload, error) {
+	var replaced []models.Upload
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("select pg_advisory_xact_lock(hashtext(?))",
+			fmt.Sprintf("uploads:%d:%s", part.UserId, part.UploadId)).Error; err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Returning{}).Where("upload_id = ?", part.UploadId).
+			Where("user_id = ?", part.UserId).Where("part_no = ?", part.PartNo).Delete(&replaced).Error; err != nil {
+			return err
+		}
+		return tx.Create(part).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return replaced, nil
+}
+
+// commitSentPart stores a part sent to Telegram only after fetch read its
+// message back with the size sent, so a failed upload never leaves a row,
+// and with it a salt, for a message that cannot be read. When the part is
+// not stored discard removes the message and its replicas.
+func commitSentPart(db *gorm.DB, part *models.Upload,
+	fetch func() ([]tg.MessageClass, error), discard func()) ([]models.Upload, error) {
+	messages, err := fetch()
+	if err == nil {
+		err = checkPartMessages([]models.Upload{*part}, messages)
+	}
+	var replaced []models.Upload
+	if err == nil {
+		replaced, err = insertUploadPart(db, part)
+	}
+	if err != nil {
+		discard()
+		return nil, err
+	}
+	return replaced, nil
+}
+
+// replacedMessages groups the Telegram messages of replaced parts by channel,
+// inline parts have none.
+func replacedMessages(parts []models.Upload) map[int64][]int {
+	messages := map[int64][]int{}
+	for _, part := range parts {
+		if part.InlineData == nil && part.PartId > 0 {
+			messages[part.ChannelID] = append(messages[part.ChannelID], part.PartId)
+		}
+	}
+	return messages
+}
+
+// uploadMessages groups the Telegram messages of upload parts along with
+// those of their replicas by channel.
+func uploadMessages(parts []models.Upload) map[int64][]int {
+	messages := replacedMessages(parts)
+	replicas := make([]schemas.Part, 0, len(parts))
+	for _, part := range parts {
+		replicas = append(replicas, schemas.Part{Replicas: part.Replicas})
+	}
+	for channelId, ids := range schemas.ReplicaMessages(replicas) {
+		messages[channelId] = append(messages[channelId], ids...)
+	}
+	return messages
+}
+
+// deleteReplacedParts removes the messages and replicas of replaced parts.
+func deleteReplacedParts(ctx context.Context, client *tg.Client, parts []models.Upload) error {
+	_, err := tgc.DeleteChannelMessages(ctx, client, uploadMessages(parts), tgc.DefaultDeleteOptions)
+	return err
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gotd/td/tg"
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"gorm.io/datatypes"
+)
+
+func TestCheckPartSequence(t *testing.T) {
+	assert.NoError(t, checkPartSequence([]int{1}))
+	assert.NoError(t, checkPartSequence([]int{1, 2, 3}))
+
+	tests := []struct {
+		name    string
+		partNos []int
+		want    *PartSequenceError
+	}{
+		{"missing middle", []int{1, 2, 5}, &PartSequenceError{Missing: []int{3, 4}}},
+		{"missing first", []int{2, 3}, &PartSequenceError{Missing: []int{1}}},
+		{"duplicate", []int{1, 2, 2, 2, 3}, &PartSequenceError{Duplicate: []int{2}}},
+		{"both", []int{1, 1, 3}, &PartSequenceError{Missing: []int{2}, Duplicate: []int{1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, checkPartSequence(tt.partNos))
+		})
+	}
+}
+
+func TestCheckPartMessages(t *testing.T) {
+	document := func(id int, size int64) tg.MessageClass {
+		return &tg.Message{ID: id, Media: &tg.MessageMediaDocument{Document: &tg.Document{Size: size}}}
+	}
+	uploads := []models.Upload{
+		{PartNo: 1, PartId: 10, Size: 100},
+		{PartNo: 2, PartId: 11, Size: 100},
+		{PartNo: 3, PartId: 12, Size: 50},
+		{PartNo: 4, PartId: 13, Size: 50},
+	}
+
+	assert.NoError(t, checkPartMessages(uploads[:1], []tg.MessageClass{document(10, 100)}))
+
+	err := checkPartMessages(uploads, []tg.MessageClass{
+		document(10, 100), &tg.MessageEmpty{ID: 11}, document(12, 40),
+	})
+	assert.Equal(t, &PartVerifyError{
+		Missing:    []int{2, 4},
+		Mismatched: []PartMismatch{{PartNo: 3, Expected: 50, Actual: 40}},
+	}, err)
+}
+
+func TestReplacedMessages(t *testing.T) {
+	parts := []models.Upload{
+		{PartNo: 1, PartId: 10, ChannelID: 1},
+		{PartNo: 2, PartId: 11, ChannelID: 2},
+		{PartNo: 3, PartId: 12, ChannelID: 1},
+		{PartNo: 4, ChannelID: 1, InlineData: []byte("x")},
+	}
+	assert.Equal(t, map[int64][]int{1: {10, 12}, 2: {11}}, replacedMessages(parts))
+	assert.Empty(t, replacedMessages(nil))
+}
+
+func TestUploadMessages(t *testing.T) {
+	parts := []models.Upload{
+		{PartNo: 1, PartId: 10, ChannelID: 1, Replicas: datatypes.NewJSONSlice([]schemas.Replica{{ChannelID: 3, ID: 30}})},
+		{PartNo: 2, PartId: 11, ChannelID: 1, Replicas: datatypes.NewJSONSlice([]schemas.Replica{{ChannelID: 1, ID: 31}})},
+	}
+	assert.Equal(t, map[int64][]int{1: {10, 11, 31}, 3: {30}}, uploadMessages(parts))
+}
+
+func TestCommitSentPartDiscards(t *testing.T) {
+	part := &models.Upload{UploadId: "up", PartNo: 1, PartId: 10, Size: 100, Salt: "salt", Encrypted: true}
+
+	// The connection drops after the part was sent, before it is read back.
+	discarded := 0
+	_, err := commitSentPart(nil, part,
+		func() ([]tg.MessageClass, error) { return nil, errors.New("connection reset") },
+		func() { discarded++ })
+	assert.EqualError(t, err, "connection reset")
+	assert.Equal(t, 1, discarded)
+
+	// The message was cut short.
+	_, err = commitSentPart(nil, part,
+		func() ([]tg.MessageClass, error) {
+			return []tg.MessageClass{&tg.Message{ID: 10, Media: &tg.MessageMediaDocument{Document: &tg.Document{Size: 60}}}}, nil
+		},
+		func() { discarded++ })
+	assert.IsType(t, &PartVerifyError{}, err)
+	assert.Equal(t, 2, discarded)
+
+	// The message never arrived.
+	_, err = commitSentPart(nil, part,
+		func() ([]tg.MessageClass, error) { return []tg.MessageClass{&tg.MessageEmpty{ID: 10}}, nil },
+		func() { discarded++ })
+	assert.IsType(t, &PartVerifyError{}, err)
+	assert.Equal(t, 3, discarded)
+}
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gotd/td/tgerr"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"gorm.io/gorm"
+)
+
+// Placement strategies picking the channel of an upload that names none and
+// whose folder has no default channel.
+const (
+	PlacementDefault    = "default"
+	PlacementRoundRobin = "round-robin"
+	PlacementLeastFull  = "least-full"
+)
+
+var PlacementStrategies = []string{PlacementDefault, PlacementRoundRobin, PlacementLeastFull}
+
+// maxFailoverChannels bounds the channels an upload falls back to, every one
+// may cost another attempt at sending the part.
+const maxFailoverChannels = 5
+
+var ErrTooManyFailovers = fmt.Errorf("at most %d failover channels are allowed", maxFailoverChannels)
+
+// placementTTL is how long the channel picked for an upload is remembered for
+// its remaining parts.
+const placementTTL = 24 * time.Hour
+
+// uploadStrategy returns the placement strategy of the user, falling back to
+// the configured one.
+func uploadStrategy(db *gorm.DB, cache cache.Cacher, cnf *config.TGConfig, userId int64) string {
+	if strategy := getUserSettings(db, cache, userId).UploadStrategy; strategy != nil {
+		return *strategy
+	}
+	if cnf != nil && cnf.Uploads.ChannelStrategy != "" {
+		return cnf.Uploads.ChannelStrategy
+	}
+	return PlacementDefault
+}
+
+// pickChannel chooses one of the user's channels: the one picked longest ago
+// for round-robin, the one holding the fewest messages for least-full.
+// Choosing and marking happen in one statement so concurrent uploads spread.
+func pickChannel(db *gorm.DB, userId int64, strategy string) (int64, error) {
+	order := "messages, channel_id"
+	if strategy == PlacementRoundRobin {
+		order = "picked_at NULLS FIRST, channel_id"
+	}
+	var picked []int64
+	if err := db.Raw(fmt.Sprintf(`UPDATE teldrive.channels SET picked_at = timezone('utc'::text, now()) WHERE channel_id = (
+		SELECT channel_id FROM teldrive.channels WHERE user_id = ? ORDER BY %s LIMIT 1 FOR UPDATE SKIP LOCKED
+	) RETURNING channel_id`, order), userId).Scan(&picked).Error; err != nil {
+		return 0, err
+	}
+	if len(picked) == 0 {
+		return 0, ErrDefaultChannelNotSet
+	}
+	return picked[0], nil
+}
+
+// placeUpload returns the channel an upload goes to under strategy. All parts
+// of a file share one channel, so the pick is kept for the upload: parts
+// already stored decide it and concurrent first parts share a single pick.
+func placeUpload(db *gorm.DB, cache cache.Cacher, userId int64, uploadId, strategy string) (int64, error) {
+	if strategy == PlacementDefault || uploadId == "" {
+		return getDefaultChannel(db, cache, userId)
+	}
+
+	key := fmt.Sprintf("uploads:channel:%d:%s", userId, uploadId)
+
+	var channelId int64
+	if err := cache.Get(key, &channelId); err == nil && channelId != 0 {
+		return channelId, nil
+	}
+
+	res, err, _ := channelGroup.Do(key, func() (any, error) {
+		var stored []int64
+		if err := db.Model(&models.Upload{}).Where("upload_id = ?", uploadId).Where("user_id = ?", userId).
+			Limit(1).Pluck("channel_id", &stored).Error; err != nil {
+			return int64(0), err
+		}
+		if len(stored) > 0 {
+			cache.Set(key, stored[0], placementTTL)
+			return stored[0], nil
+		}
+		channelId, err := pickChannel(db, userId, strategy)
+		if err != nil {
+			return int64(0), err
+		}
+		cache.Set(key, channelId, placementTTL)
+		return channelId, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.(int64), nil
+}
+
+// recordChannelUsage counts a part sent to channelId and its replicas towards
+// the usage least-full placement compares.
+func recordChannelUsage(db *gorm.DB, userId, channelId int64, replicas []schemas.Replica) error {
+	channels := []int64{channelId}
+	for _, replica := range replicas {
+		channels = append(channels, replica.ChannelID)
+	}
+	for _, id := range channels {
+		if err := db.Model(&models.Channel{}).Where("channel_id = ?", id).Where("user_id = ?", userId).
+			Update("messages", gorm.Expr("messages + 1")).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadChannels returns the channels a part is tried on, in order. A part
+// bound for the user's default channel falls back along their failover list,
+// but only until the upload has a part stored: all parts of a file share one
+// channel, so later parts follow the first wherever it landed.
+func uploadChannels(db *gorm.DB, cache cache.Cacher, userId int64, uploadId string, reserved *models.UploadSession,
+	channelId int64) ([]int64, error) {
+	failover := getUserSettings(db, cache, userId).FailoverChannels
+	if reserved != nil || len(failover) == 0 {
+		return []int64{channelId}, nil
+	}
+	if defaultId, err := getDefaultChannel(db, cache, userId); err != nil || defaultId != channelId {
+		return []int64{channelId}, nil
+	}
+	var stored []int64
+	if err := db.Model(&models.Upload{}).Where("upload_id = ?", uploadId).Where("user_id = ?", userId).
+		Limit(1).Pluck("channel_id", &stored).Error; err != nil {
+		return nil, err
+	}
+	if len(stored) > 0 {
+		return stored[:1], nil
+	}
+	channels := []int64{channelId}
+	for _, id := range failover {
+		if slices.Contains(channels, id) || checkChannelAccess(db, cache, userId, id) != nil {
+			continue
+		}
+		channels = append(channels, id)
+	}
+	return channels, nil
+}
+
+// channelFailover reports whether a part that failed with err may be sent to
+// the next channel, because Telegram refused the channel rather than the
+// account or the part.
+func channelFailover(err error) bool {
+	return tgerr.Is(err, "CHANNEL_INVALID", "CHANNEL_PRIVATE", "CHAT_ADMIN_REQUIRED", "CHAT_WRITE_FORBIDDEN",
+		"CHAT_SEND_MEDIA_FORBIDDEN", "USER_BANNED_IN_CHANNEL", "CHANNEL_PUBLIC_GROUP_NA")
+}
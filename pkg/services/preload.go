@@ -0,0 +1,76 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MaxPreloadParts bounds the parts hinted by one response.
+const MaxPreloadParts = 16
+
+// preloadAuthParams authenticate a request on their own, a signed link or a
+// session hash, and are carried over to the hinted URLs. Requests made with
+// a cookie send it along with the preloads.
+var preloadAuthParams = []string{"hash", "uid", "exp", "sig"}
+
+// preloadTargets returns the URLs of up to n parts of a file with count parts
+// from first on, on the same route prefix as reqPath and authenticated like
+// it.
+func preloadTargets(reqPath, fileID string, query url.Values, first, n, count int) []string {
+	i := strings.LastIndex(reqPath, "/"+fileID+"/")
+	if i < 0 || n <= 0 {
+		return nil
+	}
+	base := reqPath[:i+1+len(fileID)] + "/parts/"
+
+	auth := url.Values{}
+	for _, param := range preloadAuthParams {
+		if v := query.Get(param); v != "" {
+			auth.Set(param, v)
+		}
+	}
+	suffix := ""
+	if len(auth) > 0 {
+		suffix = "?" + auth.Encode()
+	}
+
+	targets := []string{}
+	for index := max(first, 0); index < min(first+n, count); index++ {
+		targets = append(targets, base+strconv.Itoa(index)+suffix)
+	}
+	return targets
+}
+
+// hintParts announces the parts a client is likely to fetch next with Link
+// preload headers, and pushes them when enabled and the connection is HTTP/2.
+// It has to run before the response is written.
+func (fs *FileService) hintParts(c *gin.Context, fileID string, first, count int) {
+	targets := preloadTargets(c.Request.URL.Path, fileID, c.Request.URL.Query(), first,
+		fs.cnf.TG.Stream.PreloadParts, count)
+	for _, target := range targets {
+		c.Writer.Header().Add("Link", fmt.Sprintf("<%s>; rel=preload; as=fetch", target))
+	}
+	if len(targets) == 0 || !fs.cnf.TG.Stream.PreloadPush {
+		return
+	}
+	pusher := c.Writer.Pusher()
+	if pusher == nil {
+		return
+	}
+	header := http.Header{}
+	for _, name := range []string{"Authorization", "Cookie"} {
+		if v := c.Request.Header.Values(name); len(v) > 0 {
+			header[name] = v
+		}
+	}
+	for _, target := range targets {
+		if err := pusher.Push(target, &http.PushOptions{Header: header}); err != nil {
+			break
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package services
+
+import (
+	"errors"
+	"path"
+	"slices"
+
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"gorm.io/gorm"
+)
+
+// errDryRun rolls back the transaction of a dry run once it has been evaluated.
+var errDryRun = errors.New("dry run")
+
+const (
+	ActionMove    = "move"
+	ActionDelete  = "delete"
+	ActionCreate  = "create"
+	ActionReplace = "replace"
+)
+
+// OperationError rejects an operation whose preview found conflicts and
+// returns the preview to the client.
+type OperationError struct {
+	result *schemas.OperationResult
+}
+
+func (e *OperationError) Error() string {
+	return e.result.Conflicts[0].Reason
+}
+
+func (e *OperationError) Details() any {
+	return e.result
+}
+
+type previewItem struct {
+	Id       string
+	Name     string
+	Type     string
+	Size     *int64
+	ParentID *string
+}
+
+// loadPreviewItems returns the requested active files and reports every id that
+// could not be found as a conflict.
+func loadPreviewItems(tx *gorm.DB, userId int64, ids []string, result *schemas.OperationResult) ([]previewItem, error) {
+	var items []previewItem
+
+	if len(ids) == 0 {
+		return items, nil
+	}
+
+	if err := tx.Model(&models.File{}).Select("id", "name", "type", "size", "parent_id").
+		Where("id IN ?", ids).Where("user_id = ?", userId).Where("status = ?", "active").
+		Scan(&items).Error; err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		if !slices.ContainsFunc(items, func(item previewItem) bool { return item.Id == id }) {
+			result.Conflicts = append(result.Conflicts, schemas.OperationConflict{Id: id, Reason: "file not found"})
+		}
+	}
+	return items, nil
+}
+
+// countDescendants returns the number of active entries below each folder.
+func countDescendants(tx *gorm.DB, userId int64, items []previewItem) (map[string]int64, error) {
+	counts := map[string]int64{}
+
+	var folders []string
+	for _, item := range items {
+		if item.Type == "folder" {
+			folders = append(folders, item.Id)
+		}
+	}
+	if len(folders) == 0 {
+		return counts, nil
+	}
+
+	var rows []struct {
+		Root  string
+		Count int64
+	}
+
+	if err := tx.Raw(`WITH RECURSIVE tree AS (
+		SELECT id, id AS root FROM teldrive.files WHERE id IN ? AND user_id = ?
+		UNION ALL
+		SELECT f.id, tree.root FROM teldrive.files f JOIN tree ON f.parent_id = tree.id
+		WHERE f.user_id = ? AND f.status = 'active'
+	) SELECT root, count(*) - 1 AS count FROM tree GROUP BY root`, folders, userId, userId).
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		counts[row.Root] = row.Count
+	}
+	return counts, nil
+}
+
+func appendAffected(result *schemas.OperationResult, items []previewItem, counts map[string]int64, action string) {
+	for _, item := range items {
+		result.Files = append(result.Files, schemas.AffectedFile{Id: item.Id, Name: item.Name, Type: item.Type,
+			Action: action, Descendants: counts[item.Id]})
+	}
+}
+
+// movePrefixes lists dest followed by each of its parent folders up to the
+// root, so the closest existing folder of a destination that is still to be
+// created can be found.
+func movePrefixes(dest string) []string {
+	current := path.Clean("/" + dest)
+	prefixes := []string{current}
+	for current != "/" {
+		current = path.Dir(current)
+		prefixes = append(prefixes, current)
+	}
+	return prefixes
+}
+
+// collides reports whether two entries cannot share a folder, following the
+// unique indexes: folders by name, files by name and size.
+func collides(item, other previewItem) bool {
+	if other.Name != item.Name || other.Type != item.Type {
+		return false
+	}
+	return item.Type != "file" || (other.Size != nil && item.Size != nil && *other.Size == *item.Size)
+}
+
+// batchCollisions reports moved entries that would collide with one another
+// in the destination, following the unique indexes: folders by name, files by
+// name and size.
+func batchCollisions(items []previewItem) []schemas.OperationConflict {
+	var conflicts []schemas.OperationConflict
+	for i, item := range items {
+		for _, other := range items[:i] {
+			if !collides(item, other) {
+				continue
+			}
+			conflicts = append(conflicts, schemas.OperationConflict{Id: item.Id, Name: item.Name,
+				Reason: "another moved entry is also named " + item.Name})
+			break
+		}
+	}
+	return conflicts
+}
+
+// closestFolder resolves dest, or when it does not exist yet, the deepest of
+// its parents that does. exists reports whether dest itself was found.
+func closestFolder(tx *gorm.DB, userId int64, dest string) (id string, exists bool, err error) {
+	for i, prefix := range movePrefixes(dest) {
+		var ids []string
+		if err := tx.Raw("select id from teldrive.get_file_from_path(?, ?, ?)", prefix, userId, false).
+			Pluck("id", &ids).Error; err != nil {
+			return "", false, err
+		}
+		if len(ids) > 0 {
+			return ids[0], i == 0, nil
+		}
+	}
+	return "", false, nil
+}
+
+// previewMove reports the effect of moving ids into dest: the moved entries,
+// whether dest has to be created, moves of a folder into itself or below it
+// and name collisions in dest, including ones among the moved entries.
+func previewMove(tx *gorm.DB, userId int64, ids []string, dest string) (*schemas.OperationResult, error) {
+	result := &schemas.OperationResult{Files: []schemas.AffectedFile{}}
+
+	items, err := loadPreviewItems(tx, userId, ids, result)
+	if err != nil {
+		return nil, err
+	}
+
+	counts, err := countDescendants(tx, userId, items)
+	if err != nil {
+		return nil, err
+	}
+
+	destId, exists, err := closestFolder(tx, userId, dest)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		result.Files = append(result.Files, schemas.AffectedFile{Name: dest, Type: "folder", Action: ActionCreate})
+	}
+
+	// A destination that is still to be created lands below its closest
+	// existing folder, so that folder's ancestors decide about cycles too.
+	var ancestors []string
+	if destId != "" {
+		if ancestors, err = folderAncestors(tx, destId); err != nil {
+			return nil, err
+		}
+	}
+
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		names = append(names, item.Name)
+	}
+
+	var existing []previewItem
+	if exists && len(names) > 0 {
+		if err := tx.Model(&models.File{}).Select("id", "name", "type", "size").
+			Where("parent_id = ?", destId).Where("user_id = ?", userId).Where("status = ?", "active").
+			Where("name IN ?", names).Scan(&existing).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	var moving []previewItem
+
+items:
+	for _, item := range items {
+		if item.Type == "folder" && slices.Contains(ancestors, item.Id) {
+			result.Conflicts = append(result.Conflicts, schemas.OperationConflict{Id: item.Id, Name: item.Name,
+				Reason: "cannot move a folder into itself"})
+			continue
+		}
+		if exists && item.ParentID != nil && *item.ParentID == destId {
+			continue
+		}
+		for _, other := range existing {
+			if !collides(item, other) {
+				continue
+			}
+			result.Conflicts = append(result.Conflicts, schemas.OperationConflict{Id: item.Id, Name: item.Name,
+				Reason: "destination already contains " + item.Name})
+			continue items
+		}
+		moving = append(moving, item)
+	}
+
+	result.Conflicts = append(result.Conflicts, batchCollisions(moving)...)
+
+	appendAffected(result, items, counts, ActionMove)
+
+	return result, nil
+}
+
+// previewDelete reports the entries that a delete would remove along with the
+// number of descendants of each folder.
+func previewDelete(tx *gorm.DB, userId int64, payload *schemas.DeleteOperation) (*schemas.OperationResult, error) {
+	result := &schemas.OperationResult{Files: []schemas.AffectedFile{}}
+
+	ids := payload.Files
+
+	if payload.Source != "" {
+		if payload.Source[0] == '/' {
+			var sourceIds []string
+			if err := tx.Raw("select id from teldrive.get_file_from_path(?, ?, ?)", payload.Source, userId, false).
+				Pluck("id", &sourceIds).Error; err != nil {
+				return nil, err
+			}
+			if len(sourceIds) == 0 {
+				result.Conflicts = append(result.Conflicts, schemas.OperationConflict{Name: payload.Source,
+					Reason: "source not found"})
+				return result, nil
+			}
+			ids = sourceIds
+		} else {
+			ids = []string{payload.Source}
+		}
+	}
+
+	items, err := loadPreviewItems(tx, userId, ids, result)
+	if err != nil {
+		return nil, err
+	}
+
+	counts, err := countDescendants(tx, userId, items)
+	if err != nil {
+		return nil, err
+	}
+
+	appendAffected(result, items, counts, ActionDelete)
+
+	return result, nil
+}
@@ -0,0 +1,32 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMovePrefixes(t *testing.T) {
+	assert.Equal(t, []string{"/"}, movePrefixes("/"))
+	assert.Equal(t, []string{"/"}, movePrefixes(""))
+	assert.Equal(t, []string{"/проекты/über/日本", "/проекты/über", "/проекты", "/"},
+		movePrefixes("/проекты/über/日本/"))
+	assert.Equal(t, []string{"/a/b", "/a", "/"}, movePrefixes("a//b"))
+}
+
+func TestBatchCollisions(t *testing.T) {
+	small, large := int64(1), int64(2)
+	items := []previewItem{
+		{Id: "1", Name: "über", Type: "folder"},
+		{Id: "2", Name: "über", Type: "folder"},
+		{Id: "3", Name: "über", Type: "file", Size: &small},
+		{Id: "4", Name: "a.txt", Type: "file", Size: &small},
+		{Id: "5", Name: "a.txt", Type: "file", Size: &large},
+		{Id: "6", Name: "a.txt", Type: "file", Size: &small},
+	}
+
+	conflicts := batchCollisions(items)
+	assert.Len(t, conflicts, 2)
+	assert.Equal(t, "2", conflicts[0].Id)
+	assert.Equal(t, "6", conflicts[1].Id)
+}
@@ -0,0 +1,217 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"gorm.io/gorm"
+)
+
+const (
+	ProgressSnapshot  = "snapshot"
+	ProgressPart      = "part"
+	ProgressFinalized = "finalized"
+	ProgressAborted   = "aborted"
+)
+
+const progressBuffer = 32
+
+// progressHub fans upload events out to the watchers connected to this
+// process. A watcher that falls behind loses events rather than slowing the
+// upload down; the final event is always delivered.
+type progressHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan schemas.UploadProgress]struct{}
+}
+
+var uploadProgress = &progressHub{}
+
+// progressTopic scopes events to the owner so upload ids cannot be watched
+// across accounts.
+func progressTopic(userId int64, uploadId string) string {
+	return fmt.Sprintf("%d:%s", userId, uploadId)
+}
+
+func (h *progressHub) subscribe(topic string) (<-chan schemas.UploadProgress, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = make(map[string]map[chan schemas.UploadProgress]struct{})
+	}
+	if h.subs[topic] == nil {
+		h.subs[topic] = make(map[chan schemas.UploadProgress]struct{})
+	}
+	ch := make(chan schemas.UploadProgress, progressBuffer)
+	h.subs[topic][ch] = struct{}{}
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[topic][ch]; ok {
+			delete(h.subs[topic], ch)
+			close(ch)
+			if len(h.subs[topic]) == 0 {
+				delete(h.subs, topic)
+			}
+		}
+	}
+}
+
+func (h *progressHub) publish(topic string, event schemas.UploadProgress) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[topic] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// finish delivers a last event, making room for it if needed, and ends every
+// subscription to the topic.
+func (h *progressHub) finish(topic string, event schemas.UploadProgress) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[topic] {
+		select {
+		case ch <- event:
+		default:
+			select {
+			case <-ch:
+			default:
+			}
+			select {
+			case ch <- event:
+			default:
+			}
+		}
+		close(ch)
+	}
+	delete(h.subs, topic)
+}
+
+type progressTotals struct {
+	TotalParts int
+	TotalSize  int64
+}
+
+func progressTotalsKey(topic string) string {
+	return "uploads:progress:" + topic
+}
+
+// uploadProgressState reads how much of an upload is stored so far. Totals
+// announced by earlier parts are kept in the cache for the upload's lifetime.
+func uploadProgressState(db *gorm.DB, cache cache.Cacher, userId int64, uploadId string) (schemas.UploadProgress, error) {
+	state := schemas.UploadProgress{UploadId: uploadId}
+	var row struct {
+		Parts    int
+		Uploaded int64
+	}
+	if err := db.Model(&models.Upload{}).Where("upload_id = ?", uploadId).Where("user_id = ?", userId).
+		Select("count(*) as parts, coalesce(sum(size), 0) as uploaded").Scan(&row).Error; err != nil {
+		return state, err
+	}
+	state.Parts, state.Uploaded = row.Parts, row.Uploaded
+
+	var totals progressTotals
+	if cache.Get(progressTotalsKey(progressTopic(userId, uploadId)), &totals) == nil {
+		state.TotalParts, state.TotalSize = totals.TotalParts, totals.TotalSize
+	}
+	return state, nil
+}
+
+// publishPartProgress announces a stored part to the upload's watchers.
+func (us *UploadService) publishPartProgress(userId int64, part *models.Upload, query *schemas.UploadQuery) {
+	topic := progressTopic(userId, part.UploadId)
+	if query.TotalParts > 0 || query.TotalSize > 0 {
+		us.cache.Set(progressTotalsKey(topic), &progressTotals{TotalParts: query.TotalParts, TotalSize: query.TotalSize},
+			us.cnf.Uploads.Retention)
+	}
+	state, err := uploadProgressState(us.db, us.cache, userId, part.UploadId)
+	if err != nil {
+		return
+	}
+	state.Type = ProgressPart
+	state.PartNo = part.PartNo
+	state.PartSize = part.Size
+	uploadProgress.publish(topic, state)
+}
+
+// finishUploadProgress closes the watchers of an upload once it has been
+// turned into a file or discarded.
+func finishUploadProgress(cache cache.Cacher, userId int64, uploadId, eventType, fileId string) {
+	topic := progressTopic(userId, uploadId)
+	cache.Delete(progressTotalsKey(topic))
+	uploadProgress.finish(topic, schemas.UploadProgress{Type: eventType, UploadId: uploadId, FileID: fileId})
+}
+
+// WatchUploadProgress streams part completions of one of the user's uploads
+// over a websocket, starting with a snapshot of what is already stored. The
+// socket is closed when the upload is finalized or aborted.
+func (us *UploadService) WatchUploadProgress(c *gin.Context) {
+	userId, _ := auth.GetUser(c)
+	uploadId := c.Param("id")
+	topic := progressTopic(userId, uploadId)
+
+	// Subscribe before the snapshot so no part falls in between.
+	events, cancel := uploadProgress.subscribe(topic)
+	defer cancel()
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	conn.SetReadLimit(512)
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	state, err := uploadProgressState(us.db, us.cache, userId, uploadId)
+	if err != nil {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseInternalServerErr, ""), time.Now().Add(time.Second))
+		return
+	}
+	state.Type = ProgressSnapshot
+	if conn.WriteJSON(state) != nil {
+		return
+	}
+
+	for {
+		select {
+		case <-closed:
+			return
+		case event, ok := <-events:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+				return
+			}
+			if conn.WriteJSON(event) != nil {
+				return
+			}
+		}
+	}
+}
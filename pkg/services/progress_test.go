@@ -0,0 +1,36 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+)
+
+func TestProgressHub(t *testing.T) {
+	hub := &progressHub{}
+	topic := progressTopic(1, "upload")
+
+	events, cancel := hub.subscribe(topic)
+	other, cancelOther := hub.subscribe(progressTopic(2, "upload"))
+	defer cancelOther()
+
+	for i := 1; i <= progressBuffer+5; i++ {
+		hub.publish(topic, schemas.UploadProgress{Type: ProgressPart, PartNo: i})
+	}
+	hub.finish(topic, schemas.UploadProgress{Type: ProgressFinalized, FileID: "file"})
+
+	var last schemas.UploadProgress
+	count := 0
+	for event := range events {
+		last = event
+		count++
+	}
+	assert.Equal(t, progressBuffer, count)
+	assert.Equal(t, ProgressFinalized, last.Type)
+	assert.Equal(t, "file", last.FileID)
+	assert.Len(t, other, 0)
+
+	// cancelling after finish must not close the channel twice
+	cancel()
+}
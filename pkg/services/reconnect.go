@@ -0,0 +1,47 @@
+package services
+
+import (
+	"io"
+	"time"
+)
+
+// reconnectPolicy bounds how often and for how long a stream that broke on
+// the Telegram side is resumed on a fresh connection.
+type reconnectPolicy struct {
+	retries  int
+	timeout  time.Duration
+	attempts int
+	since    time.Time
+}
+
+// next reports whether another attempt is allowed and how long to back off
+// before it. The time budget starts with the first failure.
+func (p *reconnectPolicy) next(now time.Time) (time.Duration, bool) {
+	if p.attempts >= p.retries {
+		return 0, false
+	}
+	if p.attempts == 0 {
+		p.since = now
+	} else if p.timeout > 0 && now.Sub(p.since) >= p.timeout {
+		return 0, false
+	}
+	p.attempts++
+	return min(time.Duration(p.attempts)*500*time.Millisecond, 5*time.Second), true
+}
+
+// streamWriter counts the bytes delivered to the HTTP client and keeps its
+// write error apart from read errors, which are the only ones worth retrying.
+type streamWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.n += int64(n)
+	if err != nil {
+		s.err = err
+	}
+	return n, err
+}
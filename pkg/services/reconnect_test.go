@@ -0,0 +1,45 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconnectPolicy(t *testing.T) {
+	now := time.Now()
+	p := &reconnectPolicy{retries: 3, timeout: time.Minute}
+
+	wait, ok := p.next(now)
+	assert.True(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	_, ok = p.next(now.Add(30 * time.Second))
+	assert.True(t, ok)
+	_, ok = p.next(now.Add(time.Minute))
+	assert.False(t, ok, "time budget spent")
+
+	p = &reconnectPolicy{retries: 2}
+	_, ok = p.next(now)
+	assert.True(t, ok)
+	_, ok = p.next(now.Add(time.Hour))
+	assert.True(t, ok)
+	_, ok = p.next(now.Add(time.Hour))
+	assert.False(t, ok, "retries spent")
+
+	_, ok = (&reconnectPolicy{}).next(now)
+	assert.False(t, ok, "disabled")
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 2, errors.New("broken pipe") }
+
+func TestStreamWriter(t *testing.T) {
+	out := &streamWriter{w: failingWriter{}}
+	_, err := out.Write([]byte("abcd"))
+	assert.Error(t, err)
+	assert.Equal(t, int64(2), out.n)
+	assert.Equal(t, err, out.err)
+}
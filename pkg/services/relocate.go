@@ -0,0 +1,263 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/datatypes"
+)
+
+var (
+	ErrSameChannel       = errors.New("file is already stored in the target channel")
+	ErrRelocateVerify    = errors.New("forwarded messages do not match the original parts")
+	ErrRelocateNotFile   = errors.New("only files can be moved to another channel")
+	ErrRelocateMissing   = errors.New("file has no stored parts")
+	errForwardIncomplete = errors.New("telegram did not return all forwarded messages")
+)
+
+// MoveToChannel forwards the messages backing each file into the target
+// channel and repoints the file at the copies. Files keep their place in the
+// folder tree; the original messages are deleted once the database update
+// has been committed.
+func (fs *FileService) MoveToChannel(c *gin.Context, userId int64, payload *schemas.ChannelMove) (*schemas.ChannelMoveOut, *types.AppError) {
+	if err := checkChannelAccess(fs.db, fs.cache, userId, payload.ChannelID); err != nil {
+		return nil, channelAccessError(err)
+	}
+
+	var files []models.File
+	if err := fs.db.Where("id IN ?", payload.Files).Where("user_id = ?", userId).
+		Where("status = ?", "active").Find(&files).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	out := &schemas.ChannelMoveOut{Moved: []string{}, Failed: map[string]string{}}
+
+	found := make(map[string]bool, len(files))
+	for _, file := range files {
+		found[file.Id] = true
+	}
+	for _, id := range payload.Files {
+		if !found[id] {
+			out.Failed[id] = "file not found"
+		}
+	}
+
+	// The user's own session is the only account guaranteed to see both
+	// channels; bots are usually admins of a single channel.
+	_, session := auth.GetUser(c)
+
+	logger := logging.FromContext(c)
+
+	err := fs.clients.Run(c, fs.clients.UserSpec(session), func(ctx context.Context, client *telegram.Client) error {
+		target, err := tgc.GetChannelById(ctx, client.API(), payload.ChannelID)
+		if err != nil {
+			return err
+		}
+		for i := range files {
+			file := &files[i]
+			oldChannel, oldIds, err := fs.relocateFile(ctx, client, target, file)
+			if err != nil {
+				out.Failed[file.Id] = err.Error()
+				continue
+			}
+			out.Moved = append(out.Moved, file.Id)
+			fs.clearFileCache(file)
+			if err := tgc.DeleteMessages(ctx, client.API(), oldChannel, oldIds); err != nil {
+				logger.Warnw("failed to delete original messages", "fileId", file.Id, "channelId", oldChannel, "err", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	return out, nil
+}
+
+// relocateFile forwards and verifies the parts of one file and commits the new
+// location. It returns the previous channel and message ids.
+func (fs *FileService) relocateFile(ctx context.Context, client *telegram.Client, target *tg.InputChannel, file *models.File) (int64, []int, error) {
+	oldIds, newIds, err := forwardParts(ctx, client, target, file)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	parts := make([]schemas.Part, len(file.Parts))
+	for i, part := range file.Parts {
+		part.ID = int64(newIds[i])
+		parts[i] = part
+	}
+
+	oldChannel := *file.ChannelID
+	if err := fs.db.Model(&models.File{}).Where("id = ?", file.Id).
+		Updates(map[string]any{
+			"channel_id": target.ChannelID,
+			"parts":      datatypes.NewJSONSlice(parts),
+		}).Error; err != nil {
+		tgc.DeleteMessages(ctx, client.API(), target.ChannelID, newIds)
+		return 0, nil, err
+	}
+	file.Parts = datatypes.NewJSONSlice(parts)
+	file.ChannelID = &target.ChannelID
+
+	return oldChannel, oldIds, nil
+}
+
+// forwardParts forwards the messages of a file into target and checks the
+// copies against the originals. It returns the ids of the originals and of
+// the copies, in part order, and leaves the file untouched.
+func forwardParts(ctx context.Context, client *telegram.Client, target *tg.InputChannel, file *models.File) ([]int, []int, error) {
+	if file.Type != "file" {
+		return nil, nil, ErrRelocateNotFile
+	}
+	if file.ChannelID == nil || len(file.Parts) == 0 {
+		return nil, nil, ErrRelocateMissing
+	}
+	if *file.ChannelID == target.ChannelID {
+		return nil, nil, ErrSameChannel
+	}
+
+	oldIds := make([]int, len(file.Parts))
+	for i, part := range file.Parts {
+		oldIds[i] = int(part.ID)
+	}
+
+	originals, err := tgc.GetMessages(ctx, client.API(), oldIds, *file.ChannelID)
+	if err != nil {
+		return nil, nil, err
+	}
+	sizes, err := documentSizes(originals)
+	if err != nil || len(sizes) != len(oldIds) {
+		return nil, nil, ErrRelocateMissing
+	}
+
+	source, err := tgc.GetChannelById(ctx, client.API(), *file.ChannelID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	newIds, err := forwardMessages(ctx, client.API(),
+		&tg.InputPeerChannel{ChannelID: source.ChannelID, AccessHash: source.AccessHash}, target, oldIds)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	copies, err := tgc.GetMessages(ctx, client.API(), newIds, target.ChannelID)
+	if err != nil {
+		tgc.DeleteMessages(ctx, client.API(), target.ChannelID, newIds)
+		return nil, nil, err
+	}
+	newSizes, err := documentSizes(copies)
+	if err != nil || len(newSizes) != len(sizes) {
+		tgc.DeleteMessages(ctx, client.API(), target.ChannelID, newIds)
+		return nil, nil, ErrRelocateVerify
+	}
+	for i := range sizes {
+		if sizes[i] != newSizes[i] {
+			tgc.DeleteMessages(ctx, client.API(), target.ChannelID, newIds)
+			return nil, nil, ErrRelocateVerify
+		}
+	}
+
+	return oldIds, newIds, nil
+}
+
+func (fs *FileService) clearFileCache(file *models.File) {
+	keys := []string{fmt.Sprintf("files:%s", file.Id), fmt.Sprintf("files:messages:%s", file.Id)}
+	for _, id := range file.Parts {
+		keys = append(keys, fmt.Sprintf("files:location:%s:%d", file.Id, id.ID))
+	}
+	fs.cache.Delete(keys...)
+}
+
+func documentSizes(messages []tg.MessageClass) ([]int64, error) {
+	sizes := make([]int64, 0, len(messages))
+	for _, message := range messages {
+		item, ok := message.(*tg.Message)
+		if !ok {
+			return nil, ErrRelocateMissing
+		}
+		media, ok := item.Media.(*tg.MessageMediaDocument)
+		if !ok {
+			return nil, ErrRelocateMissing
+		}
+		document, ok := media.Document.(*tg.Document)
+		if !ok {
+			return nil, ErrRelocateMissing
+		}
+		sizes = append(sizes, document.Size)
+	}
+	return sizes, nil
+}
+
+// forwardBatchSize is the most messages Telegram forwards in one request.
+const forwardBatchSize = 100
+
+// forwardMessages forwards the messages ids of from into target in batches
+// Telegram accepts and returns the ids of the copies in the order of ids. The
+// copies made so far are deleted when a batch fails.
+func forwardMessages(ctx context.Context, api *tg.Client, from tg.InputPeerClass, target *tg.InputChannel, ids []int) ([]int, error) {
+	newIds := make([]int, 0, len(ids))
+	for start := 0; start < len(ids); start += forwardBatchSize {
+		batch := ids[start:min(start+forwardBatchSize, len(ids))]
+		randomIds := make([]int64, len(batch))
+		for i := range randomIds {
+			randomIds[i], _ = randInt64()
+		}
+		res, err := api.MessagesForwardMessages(ctx, &tg.MessagesForwardMessagesRequest{
+			Silent:     true,
+			DropAuthor: true,
+			FromPeer:   from,
+			ToPeer:     &tg.InputPeerChannel{ChannelID: target.ChannelID, AccessHash: target.AccessHash},
+			ID:         batch,
+			RandomID:   randomIds,
+		})
+		var forwarded []int
+		if err == nil {
+			forwarded, err = forwardedIds(res, randomIds)
+		}
+		if err != nil {
+			if len(newIds) > 0 {
+				tgc.DeleteMessages(ctx, api, target.ChannelID, newIds)
+			}
+			return nil, err
+		}
+		newIds = append(newIds, forwarded...)
+	}
+	return newIds, nil
+}
+
+// forwardedIds maps the random ids sent with a forward request to the ids of
+// the new messages, preserving request order.
+func forwardedIds(res tg.UpdatesClass, randomIds []int64) ([]int, error) {
+	updates, ok := res.(*tg.Updates)
+	if !ok {
+		return nil, errForwardIncomplete
+	}
+	byRandom := make(map[int64]int, len(randomIds))
+	for _, update := range updates.Updates {
+		if u, ok := update.(*tg.UpdateMessageID); ok {
+			byRandom[u.RandomID] = u.ID
+		}
+	}
+	ids := make([]int, len(randomIds))
+	for i, random := range randomIds {
+		id, ok := byRandom[random]
+		if !ok {
+			return nil, errForwardIncomplete
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
@@ -0,0 +1,23 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/gotd/td/tg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardedIds(t *testing.T) {
+	res := &tg.Updates{Updates: []tg.UpdateClass{
+		&tg.UpdateMessageID{RandomID: 22, ID: 102},
+		&tg.UpdateNewChannelMessage{Message: &tg.Message{ID: 102}},
+		&tg.UpdateMessageID{RandomID: 11, ID: 101},
+	}}
+
+	ids, err := forwardedIds(res, []int64{11, 22})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{101, 102}, ids)
+
+	_, err = forwardedIds(res, []int64{11, 22, 33})
+	assert.ErrorIs(t, err, errForwardIncomplete)
+}
@@ -0,0 +1,253 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/gorm"
+)
+
+// Actions of a reorganize operation.
+const (
+	ReorganizeMoved     = "moved"
+	ReorganizeRenamed   = "renamed"
+	ReorganizeUnchanged = "unchanged"
+)
+
+var ErrInvalidName = errors.New("name must not be empty, . or .. and must not contain a slash")
+
+// ReorganizeError rejects a batch in which any operation conflicts. Nothing
+// is applied and the results of every operation are returned to the client.
+type ReorganizeError struct {
+	out *schemas.ReorganizeOut
+}
+
+func (e *ReorganizeError) Error() string {
+	for _, res := range e.out.Results {
+		if res.Conflict != "" {
+			return res.Conflict
+		}
+	}
+	return "reorganize failed"
+}
+
+func (e *ReorganizeError) Details() any {
+	return e.out
+}
+
+func checkEntryName(name string) error {
+	if strings.TrimSpace(name) == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return ErrInvalidName
+	}
+	return nil
+}
+
+// folderAncestors returns id followed by the ids of every folder above it.
+func folderAncestors(tx *gorm.DB, id string) ([]string, error) {
+	var ancestors []string
+	err := tx.Raw(`WITH RECURSIVE up AS (
+		SELECT id, parent_id FROM teldrive.files WHERE id = ?
+		UNION ALL
+		SELECT f.id, f.parent_id FROM teldrive.files f JOIN up ON f.id = up.parent_id
+	) SELECT id FROM up`, id).Pluck("id", &ancestors).Error
+	return ancestors, err
+}
+
+type reorganizer struct {
+	tx     *gorm.DB
+	userId int64
+	policy string
+	seen   map[string]bool
+}
+
+// destination resolves the folder at dest, creating it and any missing parent.
+// It reports a conflict when dest names a file.
+func (r *reorganizer) destination(dest string) (id, conflict string, err error) {
+	dest = path.Clean("/" + dest)
+
+	var found []models.File
+	if err := r.tx.Raw("select * from teldrive.get_file_from_path(?, ?, ?)", dest, r.userId, false).
+		Scan(&found).Error; err != nil {
+		return "", "", err
+	}
+	if len(found) > 0 {
+		if found[0].Type != "folder" {
+			return "", "destination is not a folder", nil
+		}
+		return found[0].Id, "", nil
+	}
+
+	var created []models.File
+	if err := r.tx.Raw("select * from teldrive.create_directories(?, ?)", r.userId, dest).
+		Scan(&created).Error; err != nil {
+		return "", "", err
+	}
+	return created[0].Id, "", nil
+}
+
+// apply runs a single operation against the tree as left by the ones before
+// it. Conflicts are reported in the result, errors abort the whole batch.
+func (r *reorganizer) apply(op schemas.ReorganizeOp) (schemas.ReorganizeResult, error) {
+	res := schemas.ReorganizeResult{ID: op.ID, Destination: op.Destination}
+
+	if r.seen[op.ID] {
+		res.Conflict = "file is listed more than once"
+		return res, nil
+	}
+	r.seen[op.ID] = true
+
+	var items []previewItem
+	if err := r.tx.Model(&models.File{}).Select("id", "name", "type", "size", "parent_id").
+		Where("id = ?", op.ID).Where("user_id = ?", r.userId).Where("status = ?", "active").
+		Scan(&items).Error; err != nil {
+		return res, err
+	}
+	if len(items) == 0 {
+		res.Conflict = "file not found"
+		return res, nil
+	}
+	item := items[0]
+
+	res.Name = item.Name
+	if op.Name != "" {
+		if err := checkEntryName(op.Name); err != nil {
+			res.Conflict = err.Error()
+			return res, nil
+		}
+		res.Name = op.Name
+	}
+
+	if item.ParentID == nil {
+		res.Conflict = "the root folder cannot be moved"
+		return res, nil
+	}
+
+	destId, conflict, err := r.destination(op.Destination)
+	if err != nil || conflict != "" {
+		res.Conflict = conflict
+		return res, err
+	}
+
+	if item.Type == "folder" {
+		ancestors, err := folderAncestors(r.tx, destId)
+		if err != nil {
+			return res, err
+		}
+		if slices.Contains(ancestors, item.Id) {
+			res.Conflict = "cannot move a folder into itself"
+			return res, nil
+		}
+	}
+
+	sameParent := *item.ParentID == destId
+	if sameParent && res.Name == item.Name {
+		res.Action = ReorganizeUnchanged
+		return res, nil
+	}
+
+	// Replacing only ever removes files, a folder in the way is a conflict.
+	policy := r.policy
+	if item.Type == "folder" && policy == ConflictReplace {
+		policy = ConflictError
+	}
+
+	file := &models.File{Name: res.Name, Type: item.Type, UserID: r.userId,
+		ParentID: sql.NullString{String: destId, Valid: true}}
+
+	replaced, err := resolveNameConflict(r.tx, file, policy)
+	if errors.Is(err, database.ErrKeyConflict) {
+		res.Conflict = "destination already contains " + res.Name
+		return res, nil
+	}
+	if err != nil {
+		return res, err
+	}
+
+	if err := r.tx.Model(&models.File{}).Where("id = ?", item.Id).
+		Updates(map[string]any{"parent_id": destId, "name": file.Name}).Error; err != nil {
+		return res, err
+	}
+
+	res.Name = file.Name
+	res.Replaced = replaced
+	res.Action = ReorganizeMoved
+	if sameParent {
+		res.Action = ReorganizeRenamed
+	}
+	return res, nil
+}
+
+// Reorganize moves and renames many entries in one transaction, for imports
+// that sort files into a new layout. The whole batch is rolled back when any
+// operation conflicts.
+func (fs *FileService) Reorganize(userId int64, payload *schemas.Reorganize) (*schemas.ReorganizeOut, *types.AppError) {
+
+	policy := payload.Conflict
+	if policy == "" {
+		policy = ConflictError
+	}
+
+	out := &schemas.ReorganizeOut{Results: make([]schemas.ReorganizeResult, 0, len(payload.Operations))}
+
+	var shares []string
+
+	err := fs.db.Transaction(func(tx *gorm.DB) error {
+		r := &reorganizer{tx: tx, userId: userId, policy: policy, seen: map[string]bool{}}
+
+		var (
+			changed  []string
+			conflict bool
+		)
+		for _, op := range payload.Operations {
+			res, err := r.apply(op)
+			if err != nil {
+				return err
+			}
+			if res.Conflict != "" {
+				conflict = true
+			} else if res.Action != ReorganizeUnchanged {
+				changed = append(changed, res.ID)
+			}
+			out.Results = append(out.Results, res)
+		}
+
+		if err := enforceEntryLimits(tx, fs.cache, fs.cnf, userId, "folder"); err != nil {
+			return err
+		}
+
+		if payload.DryRun {
+			return errDryRun
+		}
+		if conflict {
+			return &ReorganizeError{out: out}
+		}
+		var err error
+		shares, err = detachShares(tx, userId, changed, payload.RevokeShares)
+		return err
+	})
+
+	var reorgErr *ReorganizeError
+	switch {
+	case errors.As(err, &reorgErr):
+		return nil, &types.AppError{Error: err, Code: http.StatusConflict}
+	case isEntryLimitErr(err):
+		return nil, entryLimitAppError(err)
+	case err != nil && err != errDryRun:
+		return nil, &types.AppError{Error: err}
+	}
+
+	fs.clearShareCache(shares)
+
+	out.Message = "files reorganized"
+	out.DryRun = payload.DryRun
+
+	return out, nil
+}
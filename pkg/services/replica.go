@@ -0,0 +1,185 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"gorm.io/gorm"
+)
+
+// maxReplicas bounds the channels a part is mirrored to, every replica costs
+// a request per part on upload and on deletion.
+const maxReplicas = 3
+
+var ErrTooManyReplicas = fmt.Errorf("at most %d replica channels are allowed", maxReplicas)
+
+// checkReplicaChannels verifies that every replica channel belongs to the user.
+func checkReplicaChannels(db *gorm.DB, cache cache.Cacher, userId int64, channels []int64) error {
+	channels = uniqueChannels(channels, 0)
+	if len(channels) > maxReplicas {
+		return ErrTooManyReplicas
+	}
+	for _, channelId := range channels {
+		if err := checkChannelAccess(db, cache, userId, channelId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uniqueChannels drops duplicates and the primary channel from channels.
+func uniqueChannels(channels []int64, primary int64) []int64 {
+	res := make([]int64, 0, len(channels))
+	for _, id := range channels {
+		if id != 0 && id != primary && !slices.Contains(res, id) {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// resolveReplicaChannels returns the channels the parts of an upload are
+// mirrored to: the requested ones when given, else the nearest replica
+// default of the target folder.
+func resolveReplicaChannels(db *gorm.DB, cache cache.Cacher, userId int64, folderId, path string, requested []int64, primary int64) ([]int64, error) {
+	channels := requested
+	if channels == nil {
+		if folderId == "" && path != "" {
+			var ids []string
+			if err := db.Raw("select id from teldrive.get_file_from_path(?, ?, ?)", path, userId, false).
+				Pluck("id", &ids).Error; err != nil {
+				return nil, err
+			}
+			if len(ids) > 0 {
+				folderId = ids[0]
+			}
+		}
+		if folderId != "" {
+			defaults, err := getFolderDefaults(db, userId, folderId)
+			if err != nil {
+				return nil, err
+			}
+			channels = defaults.ReplicaChannels
+		}
+	} else if err := checkReplicaChannels(db, cache, userId, channels); err != nil {
+		return nil, err
+	}
+	return uniqueChannels(channels, primary), nil
+}
+
+// replicationStatus counts the replicated parts of a file per channel.
+func replicationStatus(parts []schemas.Part) []schemas.ReplicaStatus {
+	var status []schemas.ReplicaStatus
+	for _, part := range parts {
+		for _, replica := range part.Replicas {
+			i := slices.IndexFunc(status, func(s schemas.ReplicaStatus) bool { return s.ChannelID == replica.ChannelID })
+			if i < 0 {
+				status = append(status, schemas.ReplicaStatus{ChannelID: replica.ChannelID})
+				i = len(status) - 1
+			}
+			status[i].Parts++
+		}
+	}
+	for i := range status {
+		status[i].Complete = status[i].Parts == len(parts)
+	}
+	return status
+}
+
+// sendDocument posts an already stored document to channel without
+// uploading it again and returns the id of the new message.
+func sendDocument(ctx context.Context, client *tg.Client, channel *tg.InputChannel, document *tg.Document) (int, error) {
+	id, _ := randInt64()
+	res, err := client.MessagesSendMedia(ctx, &tg.MessagesSendMediaRequest{
+		Silent:   true,
+		Peer:     &tg.InputPeerChannel{ChannelID: channel.ChannelID, AccessHash: channel.AccessHash},
+		Media:    &tg.InputMediaDocument{ID: document.AsInput()},
+		RandomID: id,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if updates, ok := res.(*tg.Updates); ok {
+		for _, update := range updates.Updates {
+			if channelMsg, ok := update.(*tg.UpdateNewChannelMessage); ok {
+				if msg, ok := channelMsg.Message.(*tg.Message); ok {
+					return msg.ID, nil
+				}
+			}
+		}
+	}
+	return 0, errors.New("message not sent")
+}
+
+// messageDocument returns the document carried by a part message.
+func messageDocument(message tg.MessageClass) (*tg.Document, bool) {
+	msg, ok := message.(*tg.Message)
+	if !ok {
+		return nil, false
+	}
+	media, ok := msg.Media.(*tg.MessageMediaDocument)
+	if !ok {
+		return nil, false
+	}
+	document, ok := media.Document.(*tg.Document)
+	return document, ok
+}
+
+// replicaDocument returns the document of the first replica that can still
+// be read.
+func replicaDocument(ctx context.Context, client *tg.Client, replicas []schemas.Replica) *tg.Document {
+	for _, replica := range replicas {
+		messages, err := tgc.GetMessages(ctx, client, []int{int(replica.ID)}, replica.ChannelID)
+		if err != nil || len(messages) == 0 {
+			continue
+		}
+		if document, ok := messageDocument(messages[0]); ok {
+			return document
+		}
+	}
+	return nil
+}
+
+// mirrorPart sends the document of a stored part to every replica channel.
+// When one of them fails the replicas already sent are deleted again.
+func (us *UploadService) mirrorPart(ctx context.Context, tc *telegram.Client, client *tg.Client, userId int64,
+	account string, message *tg.Message, channels []int64) ([]schemas.Replica, error) {
+	if len(channels) == 0 {
+		return nil, nil
+	}
+	document, ok := messageDocument(message)
+	if !ok {
+		return nil, errors.New("stored part has no document")
+	}
+	replicas := make([]schemas.Replica, 0, len(channels))
+	sent := make(map[*tg.InputChannel]int, len(channels))
+	for _, channelId := range channels {
+		channel, err := us.inputChannel(ctx, tc, userId, account, channelId)
+		var id int
+		if err == nil {
+			id, err = sendDocument(ctx, client, channel, document)
+		}
+		if err != nil {
+			for channel, id := range sent {
+				deleteMessages(ctx, client, channel, []int{id})
+			}
+			return nil, fmt.Errorf("replicate to channel %d: %w", channelId, err)
+		}
+		sent[channel] = id
+		replicas = append(replicas, schemas.Replica{ChannelID: channelId, ID: int64(id)})
+	}
+	return replicas, nil
+}
+
+// deleteReplicas deletes the replica messages of parts.
+func deleteReplicas(ctx context.Context, client *tg.Client, parts []schemas.Part) error {
+	_, err := tgc.DeleteChannelMessages(ctx, client, schemas.ReplicaMessages(parts), tgc.DefaultDeleteOptions)
+	return err
+}
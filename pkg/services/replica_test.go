@@ -0,0 +1,27 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+)
+
+func TestUniqueChannels(t *testing.T) {
+	assert.Equal(t, []int64{2, 3}, uniqueChannels([]int64{1, 2, 2, 0, 3, 1}, 1))
+	assert.Empty(t, uniqueChannels(nil, 1))
+}
+
+func TestReplicationStatus(t *testing.T) {
+	parts := []schemas.Part{
+		{ID: 1, Replicas: []schemas.Replica{{ChannelID: 10, ID: 11}, {ChannelID: 20, ID: 21}}},
+		{ID: 2, Replicas: []schemas.Replica{{ChannelID: 10, ID: 12}}},
+	}
+	assert.Equal(t, []schemas.ReplicaStatus{
+		{ChannelID: 10, Parts: 2, Complete: true},
+		{ChannelID: 20, Parts: 1, Complete: false},
+	}, replicationStatus(parts))
+	assert.Nil(t, replicationStatus([]schemas.Part{{ID: 1}}))
+
+	assert.Equal(t, map[int64][]int{10: {11, 12}, 20: {21}}, schemas.ReplicaMessages(parts))
+}
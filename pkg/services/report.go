@@ -0,0 +1,205 @@
+package services
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/pkg/httputil"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+)
+
+// reportErrorTrailer carries the error that cut a report short, as the
+// status is sent before the first entry is read.
+const reportErrorTrailer = "X-Export-Error"
+
+var reportColumns = []string{"id", "path", "type", "size", "mimeType", "category", "hash", "hashAlgorithm",
+	"channelId", "createdAt", "updatedAt"}
+
+// reportQuery walks down from the reported folder building the path of every
+// folder below it once, so no path is computed per entry.
+const reportQuery = `WITH RECURSIVE folders AS (
+	SELECT id, @prefix::text AS path FROM teldrive.files WHERE id = @root
+	UNION ALL
+	SELECT f.id, folders.path || '/' || f.name FROM teldrive.files f JOIN folders ON f.parent_id = folders.id
+	WHERE f.type = 'folder' AND f.user_id = @user AND f.status = 'active'
+)
+SELECT f.id, folders.path || '/' || f.name AS path, f.type, coalesce(f.size, 0) AS size, f.mime_type,
+	coalesce(f.category, '') AS category, coalesce(f.hash, '') AS hash, coalesce(f.hash_algorithm, '') AS hash_algorithm,
+	coalesce(f.channel_id, 0) AS channel_id, f.created_at, f.updated_at
+FROM teldrive.files f JOIN folders ON f.parent_id = folders.id
+WHERE f.user_id = @user AND f.status = 'active'`
+
+// ExportReport streams every entry of the user below a folder as a CSV or
+// JSON report meant for spreadsheets and audits, unlike ExportFiles which is
+// meant for re-import. Entries are read from a database cursor and written as
+// they come, so the size of the inventory does not matter. A failure after
+// the first entry is reported in the X-Export-Error trailer.
+func (fs *FileService) ExportReport(c *gin.Context, userId int64) {
+
+	var query schemas.FileReportQuery
+
+	if err := c.ShouldBindQuery(&query); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+	if query.Format == "" {
+		query.Format = "csv"
+	}
+
+	folder := path.Clean("/" + query.Path)
+	root, err := fs.getFileFromPath(folder, userId)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			httputil.NewError(c, http.StatusNotFound, err)
+			return
+		}
+		httputil.NewError(c, 0, err)
+		return
+	}
+	if root.Type != "folder" {
+		httputil.NewError(c, http.StatusBadRequest, errors.New("path is not a folder"))
+		return
+	}
+
+	sql, args := reportSQL(&query, userId, root.Id, strings.TrimSuffix(folder, "/"))
+
+	rows, err := fs.db.Raw(sql, args).Rows()
+	if err != nil {
+		httputil.NewError(c, 0, err)
+		return
+	}
+	defer rows.Close()
+
+	contentType := "text/csv; charset=utf-8"
+	if query.Format == "json" {
+		contentType = "application/json"
+	}
+	name := fmt.Sprintf("teldrive-files-%s.%s", time.Now().UTC().Format("20060102"), query.Format)
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", httputil.ContentDisposition("attachment", name))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Trailer", reportErrorTrailer)
+	c.Status(http.StatusOK)
+
+	report := newReportWriter(c.Writer, query.Format)
+
+	n := 0
+	for rows.Next() {
+		var row schemas.FileReportRow
+		if err = fs.db.ScanRows(rows, &row); err != nil {
+			break
+		}
+		if err = report.write(&row); err != nil {
+			return
+		}
+		n++
+		if n%streamFlushRows == 0 {
+			report.flush()
+			c.Writer.Flush()
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	report.close()
+	if err != nil {
+		fs.logger.Errorw("file report failed", "userId", userId, "rows", n, "err", err)
+		c.Writer.Header().Set(reportErrorTrailer, err.Error())
+	}
+	c.Writer.Flush()
+}
+
+// reportSQL adds the filters of query to reportQuery.
+func reportSQL(query *schemas.FileReportQuery, userId int64, root, prefix string) (string, map[string]any) {
+	var b strings.Builder
+	b.WriteString(reportQuery)
+	args := map[string]any{"user": userId, "root": root, "prefix": prefix}
+	if query.Type != "" {
+		b.WriteString(" AND f.type = @type")
+		args["type"] = query.Type
+	}
+	if query.Category != "" {
+		b.WriteString(" AND f.category = @category")
+		args["category"] = query.Category
+	}
+	if query.Since != nil {
+		b.WriteString(" AND f.updated_at >= @since")
+		args["since"] = query.Since.UTC()
+	}
+	if query.Until != nil {
+		b.WriteString(" AND f.updated_at < @until")
+		args["until"] = query.Until.UTC()
+	}
+	if query.After != "" {
+		b.WriteString(" AND f.id > @after")
+		args["after"] = query.After
+	}
+	b.WriteString(" ORDER BY f.id")
+	return b.String(), args
+}
+
+// reportWriter writes report rows as CSV with a header line, or as the
+// elements of a JSON array.
+type reportWriter struct {
+	csv  *csv.Writer
+	w    http.ResponseWriter
+	rows int
+}
+
+func newReportWriter(w http.ResponseWriter, format string) *reportWriter {
+	r := &reportWriter{w: w}
+	if format == "json" {
+		w.Write([]byte("["))
+		return r
+	}
+	r.csv = csv.NewWriter(w)
+	r.csv.Write(reportColumns)
+	return r
+}
+
+func (r *reportWriter) write(row *schemas.FileReportRow) error {
+	r.rows++
+	if r.csv == nil {
+		data, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		sep := ",\n"
+		if r.rows == 1 {
+			sep = "\n"
+		}
+		_, err = r.w.Write(append([]byte(sep), data...))
+		return err
+	}
+	channel := ""
+	if row.ChannelID != 0 {
+		channel = strconv.FormatInt(row.ChannelID, 10)
+	}
+	return r.csv.Write([]string{row.Id, row.Path, row.Type, strconv.FormatInt(row.Size, 10), row.MimeType,
+		row.Category, row.Hash, row.HashAlgorithm, channel, row.CreatedAt.UTC().Format(time.RFC3339),
+		row.UpdatedAt.UTC().Format(time.RFC3339)})
+}
+
+func (r *reportWriter) flush() {
+	if r.csv != nil {
+		r.csv.Flush()
+	}
+}
+
+func (r *reportWriter) close() {
+	if r.csv == nil {
+		r.w.Write([]byte("\n]\n"))
+		return
+	}
+	r.csv.Flush()
+}
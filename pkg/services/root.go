@@ -0,0 +1,118 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// rootCheckTTL is how long a session skips the root check after passing it.
+const rootCheckTTL = 24 * time.Hour
+
+// reattachQuery moves the active entries of a user whose parent no longer
+// exists below the root. Entries that would clash with a sibling get their
+// id appended to the name, the first of several orphans with one name keeps it.
+const reattachQuery = `
+WITH orphans AS (
+	SELECT f.id, row_number() OVER (PARTITION BY f.name ORDER BY f.created_at, f.id) AS n
+	FROM teldrive.files f
+	WHERE f.user_id = @user AND f.status = 'active' AND f.parent_id IS NOT NULL AND f.id <> @root
+	AND NOT EXISTS (SELECT 1 FROM teldrive.files p WHERE p.id = f.parent_id)
+)
+UPDATE teldrive.files f SET parent_id = @root,
+	name = CASE WHEN o.n > 1 OR EXISTS (SELECT 1 FROM teldrive.files s WHERE s.parent_id = @root AND s.name = f.name)
+		THEN f.name || ' (' || left(f.id::text, 8) || ')' ELSE f.name END
+FROM orphans o WHERE f.id = o.id`
+
+// ensureRoot recreates the root folder of the user when it is missing or no
+// longer active and reattaches the entries left without a parent below it.
+// An existing root is left alone, broken parents below it are for the orphan
+// check to repair.
+func ensureRoot(db *gorm.DB, userId int64) (*schemas.RootRepair, error) {
+	res := &schemas.RootRepair{}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var root models.File
+		err := tx.Where("user_id = ?", userId).Where("parent_id IS NULL").
+			Where("type = ?", "folder").Where("name = ?", "root").First(&root).Error
+		switch {
+		case err == nil && root.Status == "active":
+			return nil
+		case err == nil:
+			if err := tx.Model(&root).Update("status", "active").Error; err != nil {
+				return err
+			}
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			root = models.File{
+				Name:     "root",
+				Type:     "folder",
+				MimeType: "drive/folder",
+				UserID:   userId,
+				Status:   "active",
+			}
+			created := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&root)
+			if created.Error != nil {
+				return created.Error
+			}
+			if created.RowsAffected == 0 {
+				// created concurrently by another request
+				return nil
+			}
+		default:
+			return err
+		}
+		res.Created = true
+
+		moved := tx.Exec(reattachQuery, sql.Named("user", userId), sql.Named("root", root.Id))
+		if moved.Error != nil {
+			return moved.Error
+		}
+		res.Reattached = moved.RowsAffected
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// RepairRoot recreates a missing root folder of the user on demand.
+func (fs *FileService) RepairRoot(userId int64) (*schemas.RootRepair, *types.AppError) {
+	res, err := ensureRoot(fs.db, userId)
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	if res.Created {
+		fs.logger.Infow("root folder recreated", "user", userId, "reattached", res.Reattached)
+	}
+	return res, nil
+}
+
+// CheckRoot runs the root repair once per session, on its first file
+// operation, so a drive whose root went missing heals without user action.
+func (fs *FileService) CheckRoot(c *gin.Context) *types.AppError {
+	val, _ := c.Get("jwtUser")
+	claims := val.(*types.JWTClaims)
+	userId, _ := auth.GetUser(c)
+
+	key := fmt.Sprintf("users:root-checked:%s", claims.Hash)
+
+	var checked bool
+	if err := fs.cache.Get(key, &checked); err == nil && checked {
+		return nil
+	}
+	if _, err := fs.RepairRoot(userId); err != nil {
+		return err
+	}
+	fs.cache.Set(key, true, rootCheckTTL)
+	return nil
+}
@@ -0,0 +1,101 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+)
+
+const (
+	SessionParsed      = "parsed"
+	SessionValid       = "valid"
+	SessionRevoked     = "revoked"
+	SessionDeactivated = "deactivated"
+)
+
+// ValidateSession decodes a session string in any supported format and, unless
+// asked not to, connects with it to resolve the account it belongs to once
+// the login gate admits the request. Nothing is stored: the session still has
+// to be sent to the login.
+func (as *AuthService) ValidateSession(c *gin.Context, check *schemas.SessionCheck) (*schemas.SessionCheckOut, *types.AppError) {
+	data, err := tgc.ParseSession(check.Session)
+	if err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+
+	out := &schemas.SessionCheckOut{Status: SessionParsed, Dc: data.DC}
+	if check.Offline {
+		return out, nil
+	}
+
+	// Connecting uses the instance's app credentials, so online checks pass
+	// the same gate as a login.
+	if err := as.gate.Check(c, check.GateToken, c.ClientIP()); err != nil {
+		return nil, &types.AppError{Error: err, Code: gateStatus(err)}
+	}
+
+	creds, err := tgc.NewAppCredentials(check.AppId, check.AppHash)
+	if err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+
+	spec := as.clients.UserSpecWithApp(tgc.EncodeSessionAddr(data.DC, data.Addr, data.AuthKey), creds)
+
+	var user *tg.User
+	err = as.clients.Run(c, spec, func(ctx context.Context, client *telegram.Client) error {
+		users, err := client.API().UsersGetUsers(ctx, []tg.InputUserClass{&tg.InputUserSelf{}})
+		if err != nil {
+			return err
+		}
+		if len(users) > 0 {
+			user, _ = users[0].(*tg.User)
+		}
+		return nil
+	})
+
+	if status, ok := sessionStatus(err); ok {
+		out.Status, out.Reason = status, err.Error()
+		return out, nil
+	}
+	if tgc.IsAppRejected(err) {
+		return nil, &types.AppError{Error: tgc.ErrAppRejected, Code: http.StatusBadRequest}
+	}
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	if user == nil {
+		out.Status, out.Reason = SessionRevoked, "telegram did not return the account of the session"
+		return out, nil
+	}
+
+	out.Status = SessionValid
+	out.UserID = user.ID
+	out.UserName = user.Username
+	out.Name = strings.TrimSpace(user.FirstName + " " + user.LastName)
+	out.IsPremium = user.Premium
+	out.Bot = user.Bot
+	out.Allowed = as.userAllowed(user.ID, user.Username)
+	return out, nil
+}
+
+// sessionStatus maps the errors Telegram refuses a dead session with to the
+// status reported for it.
+func sessionStatus(err error) (string, bool) {
+	switch {
+	case err == nil:
+		return "", false
+	case tgerr.Is(err, "AUTH_KEY_UNREGISTERED", "AUTH_KEY_INVALID", "SESSION_REVOKED", "SESSION_EXPIRED"):
+		return SessionRevoked, true
+	case tgerr.Is(err, "USER_DEACTIVATED", "USER_DEACTIVATED_BAN"):
+		return SessionDeactivated, true
+	}
+	return "", false
+}
@@ -0,0 +1,229 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrDefaultChannelClear = errors.New("defaultChannelId cannot be cleared, select another channel instead")
+
+func settingsKey(userId int64) string {
+	return fmt.Sprintf("users:settings:%d", userId)
+}
+
+// decodeUserSettings parses stored or patched settings, rejecting unknown keys
+// and values of the wrong type.
+func decodeUserSettings(raw []byte) (*schemas.UserSettings, error) {
+	var settings schemas.UserSettings
+	if len(raw) == 0 {
+		return &settings, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&settings); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+func validateUserSettings(settings *schemas.UserSettings) error {
+	if settings.DefaultSort != nil && !slices.Contains(listSorts, *settings.DefaultSort) {
+		return fmt.Errorf("defaultSort must be one of %v", listSorts)
+	}
+	if settings.DefaultOrder != nil && !slices.Contains(listOrders, *settings.DefaultOrder) {
+		return fmt.Errorf("defaultOrder must be one of %v", listOrders)
+	}
+	if settings.UploadStrategy != nil && !slices.Contains(PlacementStrategies, *settings.UploadStrategy) {
+		return fmt.Errorf("uploadStrategy must be one of %v", PlacementStrategies)
+	}
+	if len(settings.FailoverChannels) > maxFailoverChannels {
+		return ErrTooManyFailovers
+	}
+	for i, id := range settings.FailoverChannels {
+		if id == 0 || slices.Contains(settings.FailoverChannels[:i], id) {
+			return errors.New("failoverChannels must be distinct channel ids")
+		}
+	}
+	if settings.Timezone != nil {
+		if _, err := time.LoadLocation(*settings.Timezone); err != nil || *settings.Timezone == "" ||
+			*settings.Timezone == "Local" {
+			return fmt.Errorf("unknown timezone %q", *settings.Timezone)
+		}
+	}
+	return nil
+}
+
+// mergeSettingsPatch applies a JSON merge patch to the stored settings: keys
+// set to null are removed, all others replace the stored value.
+func mergeSettingsPatch(stored []byte, patch map[string]json.RawMessage) ([]byte, error) {
+	current := map[string]json.RawMessage{}
+	if len(stored) > 0 {
+		if err := json.Unmarshal(stored, &current); err != nil {
+			return nil, err
+		}
+	}
+	for key, value := range patch {
+		if string(bytes.TrimSpace(value)) == "null" {
+			delete(current, key)
+		} else {
+			current[key] = value
+		}
+	}
+	return json.Marshal(current)
+}
+
+// getUserSettings returns the stored settings of a user. Unreadable settings
+// are treated as empty so a bad row never blocks uploads or listings.
+func getUserSettings(db *gorm.DB, cache cache.Cacher, userId int64) *schemas.UserSettings {
+	var (
+		settings schemas.UserSettings
+		row      struct {
+			Settings datatypes.JSON
+		}
+	)
+
+	key := settingsKey(userId)
+
+	if err := cache.Get(key, &settings); err == nil {
+		return &settings
+	}
+
+	db.Model(&models.User{}).Select("settings").Where("user_id = ?", userId).Scan(&row)
+
+	if decoded, err := decodeUserSettings(row.Settings); err == nil {
+		settings = *decoded
+	}
+	cache.Set(key, &settings, 0)
+	return &settings
+}
+
+// ApplyListDefaults sets the user's preferred sort on a listing before the
+// request's own query parameters are bound over it.
+func (fs *FileService) ApplyListDefaults(userId int64, fquery *schemas.FileQuery) {
+	settings := getUserSettings(fs.db, fs.cache, userId)
+	if settings.DefaultSort != nil {
+		fquery.Sort = *settings.DefaultSort
+	}
+	if settings.DefaultOrder != nil {
+		fquery.Order = *settings.DefaultOrder
+	}
+}
+
+func (us *UserService) GetSettings(c *gin.Context) (*schemas.UserSettings, *types.AppError) {
+	userId, _ := auth.GetUser(c)
+
+	settings := *getUserSettings(us.db, us.cache, userId)
+
+	if channelId, err := getDefaultChannel(us.db, us.cache, userId); err == nil {
+		settings.DefaultChannelID = &channelId
+	}
+	return &settings, nil
+}
+
+// UpdateSettings merges the request body into the stored settings. Setting a
+// key to null resets it; defaultChannelId selects one of the user's channels
+// and failoverChannels may only list channels of the user.
+func (us *UserService) UpdateSettings(c *gin.Context) (*schemas.UserSettings, *types.AppError) {
+	userId, _ := auth.GetUser(c)
+
+	var patch map[string]json.RawMessage
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+
+	channelPatch, hasChannel := patch["defaultChannelId"]
+	delete(patch, "defaultChannelId")
+
+	var channelId int64
+	if hasChannel {
+		if string(bytes.TrimSpace(channelPatch)) == "null" {
+			return nil, &types.AppError{Error: ErrDefaultChannelClear, Code: http.StatusBadRequest}
+		}
+		if err := json.Unmarshal(channelPatch, &channelId); err != nil || channelId == 0 {
+			return nil, &types.AppError{Error: errors.New("defaultChannelId must be a channel id"), Code: http.StatusBadRequest}
+		}
+		if err := checkChannelAccess(us.db, us.cache, userId, channelId); err != nil {
+			return nil, channelAccessError(err)
+		}
+	}
+
+	if failoverPatch, ok := patch["failoverChannels"]; ok {
+		var failover []int64
+		if err := json.Unmarshal(failoverPatch, &failover); err != nil {
+			return nil, &types.AppError{Error: errors.New("failoverChannels must be a list of channel ids"),
+				Code: http.StatusBadRequest}
+		}
+		for _, id := range failover {
+			if err := checkChannelAccess(us.db, us.cache, userId, id); err != nil {
+				return nil, channelAccessError(err)
+			}
+		}
+	}
+
+	var invalid error
+
+	err := us.db.Transaction(func(tx *gorm.DB) error {
+		var row struct {
+			Settings datatypes.JSON
+		}
+		if err := tx.Model(&models.User{}).Clauses(clause.Locking{Strength: "UPDATE"}).Select("settings").
+			Where("user_id = ?", userId).Scan(&row).Error; err != nil {
+			return err
+		}
+		merged, err := mergeSettingsPatch(row.Settings, patch)
+		if err != nil {
+			return err
+		}
+		settings, err := decodeUserSettings(merged)
+		if err == nil {
+			err = validateUserSettings(settings)
+		}
+		if err != nil {
+			invalid = err
+			return err
+		}
+		stored, _ := json.Marshal(settings)
+		if err := tx.Model(&models.User{}).Where("user_id = ?", userId).
+			Update("settings", datatypes.JSON(stored)).Error; err != nil {
+			return err
+		}
+		if hasChannel {
+			if err := tx.Model(&models.Channel{}).Where("user_id = ?", userId).
+				Update("selected", gorm.Expr("channel_id = ?", channelId)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if invalid != nil {
+		return nil, &types.AppError{Error: invalid, Code: http.StatusBadRequest}
+	}
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	us.cache.Delete(settingsKey(userId))
+	if hasChannel {
+		key := fmt.Sprintf("users:channel:%d", userId)
+		channelGroup.Forget(key)
+		us.cache.Delete(key)
+	}
+
+	return us.GetSettings(c)
+}
@@ -0,0 +1,39 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserSettingsPatch(t *testing.T) {
+	stored := []byte(`{"defaultSort":"size","timezone":"Europe/Berlin"}`)
+
+	merged, err := mergeSettingsPatch(stored, map[string]json.RawMessage{
+		"timezone":     json.RawMessage(`null`),
+		"defaultOrder": json.RawMessage(`"desc"`),
+	})
+	require.NoError(t, err)
+
+	settings, err := decodeUserSettings(merged)
+	require.NoError(t, err)
+	assert.Equal(t, "size", *settings.DefaultSort)
+	assert.Equal(t, "desc", *settings.DefaultOrder)
+	assert.Nil(t, settings.Timezone)
+	assert.NoError(t, validateUserSettings(settings))
+
+	_, err = decodeUserSettings([]byte(`{"theme":"dark"}`))
+	assert.Error(t, err)
+	_, err = decodeUserSettings([]byte(`{"defaultEncrypted":"yes"}`))
+	assert.Error(t, err)
+
+	for _, raw := range []string{`{"defaultSort":"random"}`, `{"defaultOrder":"up"}`,
+		`{"timezone":"Mars/Olympus"}`, `{"timezone":""}`, `{"uploadStrategy":"random"}`,
+		`{"failoverChannels":[1,1]}`, `{"failoverChannels":[0]}`, `{"failoverChannels":[1,2,3,4,5,6]}`} {
+		settings, err := decodeUserSettings([]byte(raw))
+		require.NoError(t, err)
+		assert.Error(t, validateUserSettings(settings), raw)
+	}
+}
@@ -3,19 +3,29 @@ package services
 import (
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"path"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
+	"github.com/tgdrive/teldrive/internal/auth"
 	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/category"
 	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/internal/events"
+	"github.com/tgdrive/teldrive/pkg/httputil"
 	"github.com/tgdrive/teldrive/pkg/mapper"
 	"github.com/tgdrive/teldrive/pkg/models"
 	"github.com/tgdrive/teldrive/pkg/schemas"
 	"github.com/tgdrive/teldrive/pkg/types"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type ShareService struct {
@@ -28,8 +38,58 @@ var (
 	ErrShareNotFound   = errors.New("share not found")
 	ErrInvalidPassword = errors.New("invalid password")
 	ErrShareExpired    = errors.New("share expired")
+	ErrShareExhausted  = errors.New("share download limit reached")
+
+	ErrShareThumbnailSize = errors.New("image is too large to preview")
+
+	ErrInvalidDownloadName = errors.New("invalid download name")
 )
 
+// checkDownloadName rejects names that cannot be offered as a download file
+// name: empty, too long, or holding control characters or path separators.
+func checkDownloadName(name string) error {
+	if name == "" || name == "." || name == ".." || len(name) > 255 || !utf8.ValidString(name) {
+		return ErrInvalidDownloadName
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) || r == '/' || r == '\\' {
+			return ErrInvalidDownloadName
+		}
+	}
+	return nil
+}
+
+// downloadName is the file name a stream is offered under: the filename query
+// parameter, else the download name of the share when the shared item is the
+// file itself, else the stored name.
+func downloadName(c *gin.Context, file *schemas.FileOutFull, sharedFile *schemas.FileShareOut) (string, error) {
+	if name, ok := c.GetQuery("filename"); ok {
+		if err := checkDownloadName(name); err != nil {
+			return "", err
+		}
+		return name, nil
+	}
+	if sharedFile != nil && sharedFile.DownloadName != "" && sharedFile.FileID == file.Id {
+		return sharedFile.DownloadName, nil
+	}
+	return file.Name, nil
+}
+
+// shareExhausted reports whether a share reached its download limit.
+func shareExhausted(share *schemas.FileShare) bool {
+	return share.MaxDownloads != nil && share.Downloads >= *share.MaxDownloads
+}
+
+// countsAsDownload tells whether a stream request starts a download. Players
+// seek with many range requests, only those starting at the beginning count.
+func countsAsDownload(r *http.Request) bool {
+	if r.Method == http.MethodHead {
+		return false
+	}
+	rangeHeader := strings.TrimSpace(r.Header.Get("Range"))
+	return rangeHeader == "" || strings.HasPrefix(rangeHeader, "bytes=0-")
+}
+
 func NewShareService(db *gorm.DB, fs *FileService, cache cache.Cacher) *ShareService {
 	return &ShareService{db: db, fs: fs, cache: cache}
 }
@@ -53,12 +113,22 @@ func (ss *ShareService) GetShareById(shareId string) (*schemas.FileShareOut, *ty
 		return nil, &types.AppError{Error: ErrShareExpired, Code: http.StatusNotFound}
 	}
 
+	if shareExhausted(&result[0]) {
+		return nil, &types.AppError{Error: ErrShareExhausted, Code: http.StatusGone}
+	}
+
 	res := &schemas.FileShareOut{
-		ExpiresAt: result[0].ExpiresAt,
-		Protected: result[0].Password != nil,
-		UserID:    result[0].UserID,
-		Type:      result[0].Type,
-		Name:      result[0].Name,
+		ExpiresAt:    result[0].ExpiresAt,
+		Protected:    result[0].Password != nil,
+		MaxDownloads: result[0].MaxDownloads,
+		Downloads:    result[0].Downloads,
+		UserID:       result[0].UserID,
+		Type:         result[0].Type,
+		Name:         result[0].Name,
+		FileID:       result[0].FileID,
+	}
+	if result[0].DownloadName != nil {
+		res.DownloadName = *result[0].DownloadName
 	}
 
 	return res, nil
@@ -82,12 +152,9 @@ func (ss *ShareService) ShareUnlock(shareId string, payload *schemas.ShareAccess
 	return nil
 }
 
-func (ss *ShareService) ListShareFiles(shareId string, query *schemas.ShareFileQuery, auth string) (*schemas.FileResponse, *types.AppError) {
-
-	var (
-		userId   int64
-		fileType string
-	)
+// getShare loads a share together with the type, name and path of the shared
+// file, checking the password sent as basic auth when the share is protected.
+func (ss *ShareService) getShare(shareId string, auth string) (*schemas.FileShare, *types.AppError) {
 
 	var result []schemas.FileShare
 
@@ -95,7 +162,7 @@ func (ss *ShareService) ListShareFiles(shareId string, query *schemas.ShareFileQ
 
 	if err := ss.cache.Get(key, &result); err != nil {
 		if err := ss.db.Model(&models.FileShare{}).Where("file_shares.id = ?", shareId).
-			Select("file_shares.*", "f.type",
+			Select("file_shares.*", "f.type", "f.name",
 				"(select get_path_from_file_id as path from teldrive.get_path_from_file_id(f.id))").
 			Joins("left join teldrive.files as f on f.id = file_shares.file_id").
 			Scan(&result).Error; err != nil {
@@ -108,21 +175,45 @@ func (ss *ShareService) ListShareFiles(shareId string, query *schemas.ShareFileQ
 		ss.cache.Set(key, result, 0)
 	}
 
+	if result[0].ExpiresAt != nil && result[0].ExpiresAt.Before(time.Now().UTC()) {
+		return nil, &types.AppError{Error: ErrShareExpired, Code: http.StatusNotFound}
+	}
+
+	if shareExhausted(&result[0]) {
+		return nil, &types.AppError{Error: ErrShareExhausted, Code: http.StatusGone}
+	}
+
 	if result[0].Password != nil {
 		if auth == "" {
 			return nil, &types.AppError{Error: ErrInvalidPassword, Code: http.StatusUnauthorized}
 		}
 		bytes, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
-		password := strings.Split(string(bytes), ":")[1]
 		if err != nil {
-			return nil, &types.AppError{Error: err}
+			return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
 		}
+		_, password, _ := strings.Cut(string(bytes), ":")
 		if err := bcrypt.CompareHashAndPassword([]byte(*result[0].Password), []byte(password)); err != nil {
 			return nil, &types.AppError{Error: ErrInvalidPassword, Code: http.StatusUnauthorized}
 		}
+	}
+
+	return &result[0], nil
+}
+
+func (ss *ShareService) ListShareFiles(shareId, basePath string, query *schemas.ShareFileQuery, auth string) (*schemas.FileResponse, *types.AppError) {
+
+	var (
+		userId   int64
+		fileType string
+	)
 
+	share, appErr := ss.getShare(shareId, auth)
+	if appErr != nil {
+		return nil, appErr
 	}
 
+	result := []schemas.FileShare{*share}
+
 	userId = result[0].UserID
 
 	fileType = "folder"
@@ -132,13 +223,20 @@ func (ss *ShareService) ListShareFiles(shareId string, query *schemas.ShareFileQ
 	}
 
 	if fileType == "folder" {
-		return ss.fs.ListFiles(userId, &schemas.FileQuery{
+		res, appErr := ss.fs.ListFiles(userId, &schemas.FileQuery{
 			Path:  result[0].Path + query.Path,
 			Limit: query.Limit,
 			Page:  query.Page,
 			Order: query.Order,
 			Sort:  query.Sort,
 			Op:    "list"})
+		if appErr != nil {
+			return nil, appErr
+		}
+		for i := range res.Files {
+			res.Files[i].Thumbnail = ss.thumbnailURL(basePath, shareId, share, &res.Files[i])
+		}
+		return res, nil
 	} else {
 		var file models.File
 		if err := ss.db.Where("id = ?", result[0].FileID).First(&file).Error; err != nil {
@@ -147,7 +245,9 @@ func (ss *ShareService) ListShareFiles(shareId string, query *schemas.ShareFileQ
 			}
 			return nil, &types.AppError{Error: err}
 		}
-		return &schemas.FileResponse{Files: []schemas.FileOut{*mapper.ToFileOut(file)},
+		out := mapper.ToFileOut(file)
+		out.Thumbnail = ss.thumbnailURL(basePath, shareId, share, out)
+		return &schemas.FileResponse{Files: []schemas.FileOut{*out},
 			Meta: schemas.Meta{TotalPages: 1, Count: 1, CurrentPage: 1}}, nil
 	}
 
@@ -160,8 +260,226 @@ func (ss *ShareService) StreamSharedFile(c *gin.Context, download bool) {
 	res, err := ss.GetShareById(shareID)
 
 	if err != nil {
-		http.Error(c.Writer, err.Error.Error(), err.Code)
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	inShare, dbErr := ss.inShare(res.FileID, c.Param("fileID"))
+	if dbErr != nil {
+		httputil.NewError(c, http.StatusInternalServerError, dbErr)
 		return
 	}
+	if !inShare {
+		httputil.NewError(c, http.StatusNotFound, database.ErrNotFound)
+		return
+	}
+
+	if res.MaxDownloads != nil && countsAsDownload(c.Request) {
+		if appErr := ss.recordDownload(shareID); appErr != nil {
+			httputil.NewError(c, appErr.Code, appErr.Error)
+			return
+		}
+	}
+
+	if countsAsDownload(c.Request) {
+		ss.fs.events.Emit(events.New(events.ShareAccessed, res.UserID, schemas.ShareEvent{ShareId: shareID,
+			FileId: c.Param("fileID"), Download: download}))
+	}
+
 	ss.fs.GetFileStream(c, download, res)
 }
+
+// ShareThumbnail serves the preview of an image in a share to anyone holding a
+// link signed by thumbnailURL. The share is looked up again, so links stop
+// working once it is revoked or expires. Previews serve the original image,
+// so they count against the download limit like any other stream and are
+// refused for images above the preview size.
+func (ss *ShareService) ShareThumbnail(c *gin.Context) {
+
+	shareID := c.Param("shareID")
+	fileID := c.Param("fileID")
+
+	if err := auth.VerifyShareFile(ss.fs.cnf.JWT.Secret, shareID, fileID, c.Request.URL.Query(), time.Now()); err != nil {
+		httputil.Unauthenticated(c, err)
+		return
+	}
+
+	res, err := ss.GetShareById(shareID)
+	if err != nil {
+		httputil.NewError(c, err.Code, err.Error)
+		return
+	}
+
+	inShare, dbErr := ss.inShare(res.FileID, fileID)
+	if dbErr != nil {
+		httputil.NewError(c, http.StatusInternalServerError, dbErr)
+		return
+	}
+	if !inShare {
+		httputil.NewError(c, http.StatusNotFound, database.ErrNotFound)
+		return
+	}
+
+	file, appErr := ss.fs.GetFileByID(fileID)
+	if appErr != nil {
+		httputil.NewError(c, appErr.Code, appErr.Error)
+		return
+	}
+	if !ss.previewable(file.Size) {
+		httputil.NewError(c, http.StatusRequestEntityTooLarge, ErrShareThumbnailSize)
+		return
+	}
+
+	if res.MaxDownloads != nil && countsAsDownload(c.Request) {
+		if appErr := ss.recordDownload(shareID); appErr != nil {
+			httputil.NewError(c, appErr.Code, appErr.Error)
+			return
+		}
+	}
+
+	ss.fs.GetFileStream(c, false, res)
+}
+
+// previewable reports whether an image of size is small enough to be served
+// as a preview.
+func (ss *ShareService) previewable(size int64) bool {
+	limit := ss.fs.cnf.Share.ThumbnailSize
+	return limit <= 0 || size <= limit
+}
+
+// recordDownload counts a download against the share's limit. The check and
+// the increment happen in one statement so concurrent downloads cannot get
+// past the limit.
+func (ss *ShareService) recordDownload(shareId string) *types.AppError {
+	var counted []models.FileShare
+	if err := ss.db.Model(&counted).Clauses(clause.Returning{}).Where("id = ?", shareId).
+		Where("max_downloads is null or downloads < max_downloads").
+		Update("downloads", gorm.Expr("downloads + 1")).Error; err != nil {
+		return &types.AppError{Error: err}
+	}
+	if len(counted) == 0 {
+		ss.cache.Delete("shares:" + shareId)
+		return &types.AppError{Error: ErrShareExhausted, Code: http.StatusGone}
+	}
+	if share := counted[0]; share.MaxDownloads != nil && share.Downloads >= *share.MaxDownloads {
+		// Listings are served from the cached share, drop it so they see the
+		// share as used up.
+		ss.cache.Delete("shares:" + shareId)
+	}
+	return nil
+}
+
+// inShare reports whether fileId is the shared file or lies below it.
+func (ss *ShareService) inShare(rootId, fileId string) (bool, error) {
+	if rootId == fileId {
+		return true, nil
+	}
+	var ids []string
+	if err := ss.db.Raw(`WITH RECURSIVE up AS (
+		SELECT id, parent_id FROM teldrive.files WHERE id = ?
+		UNION ALL
+		SELECT f.id, f.parent_id FROM teldrive.files f JOIN up ON f.id = up.parent_id
+	) SELECT id FROM up WHERE id = ?`, fileId, rootId).Pluck("id", &ids).Error; err != nil {
+		return false, err
+	}
+	return len(ids) > 0, nil
+}
+
+// Browse lists the folder at subPath inside a shared folder. subPath is
+// cleaned before it is joined to the share path so it can never leave the
+// shared subtree, and a search covers the folder and its subfolders.
+func (ss *ShareService) Browse(shareId, subPath, basePath string, query *schemas.BrowseQuery, auth string) (*schemas.BrowseOut, *types.AppError) {
+
+	share, appErr := ss.getShare(shareId, auth)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	subPath = path.Clean("/" + subPath)
+
+	base := fmt.Sprintf("%s/api/browse/%s", basePath, shareId)
+
+	out := &schemas.BrowseOut{Name: share.Name, Path: subPath, Files: []schemas.BrowseEntry{}}
+
+	if subPath != "/" {
+		out.Parent = base + path.Dir(subPath)
+	}
+
+	if share.Type != "folder" {
+		if subPath != "/" {
+			return nil, &types.AppError{Error: database.ErrNotFound, Code: http.StatusNotFound}
+		}
+		var file models.File
+		if err := ss.db.Where("id = ?", share.FileID).First(&file).Error; err != nil {
+			return nil, &types.AppError{Error: err}
+		}
+		entry := schemas.BrowseEntry{FileOut: *mapper.ToFileOut(file),
+			URL: shareStreamURL(basePath, shareId, file.Id, file.Name)}
+		entry.Thumbnail = ss.thumbnailURL(basePath, shareId, share, &entry.FileOut)
+		out.Files = append(out.Files, entry)
+		out.Meta = schemas.Meta{Count: 1, TotalPages: 1, CurrentPage: 1}
+		return out, nil
+	}
+
+	folderPath := strings.TrimSuffix(share.Path, "/") + subPath
+	if subPath == "/" {
+		folderPath = share.Path
+	}
+
+	fquery := &schemas.FileQuery{
+		Op:       "find",
+		Path:     folderPath,
+		Query:    query.Query,
+		Type:     query.Type,
+		Category: query.Category,
+		MimeType: query.MimeType,
+		MinSize:  query.MinSize,
+		MaxSize:  query.MaxSize,
+		Sort:     query.Sort,
+		Order:    query.Order,
+		Limit:    query.Limit,
+		Page:     query.Page,
+	}
+	if query.Query != "" {
+		fquery.DeepSearch = true
+	}
+
+	res, appErr := ss.fs.ListFiles(share.UserID, fquery)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	for _, file := range res.Files {
+		entry := schemas.BrowseEntry{FileOut: file}
+		if file.Type == "folder" {
+			entry.URL = base + path.Join(subPath, file.Name)
+		} else {
+			entry.URL = shareStreamURL(basePath, shareId, file.Id, file.Name)
+			entry.Thumbnail = ss.thumbnailURL(basePath, shareId, share, &entry.FileOut)
+		}
+		out.Files = append(out.Files, entry)
+	}
+	out.Meta = res.Meta
+
+	return out, nil
+}
+
+// thumbnailURL returns a signed preview link for an image in a share small
+// enough to preview, empty for anything else. The link expires with the
+// presigned links, or with the share when that comes first.
+func (ss *ShareService) thumbnailURL(basePath, shareId string, share *schemas.FileShare, file *schemas.FileOut) string {
+	if file.Type != "file" || file.Category != string(category.Image) || !ss.previewable(file.Size) {
+		return ""
+	}
+	expires := time.Now().Add(ss.fs.cnf.Links.PresignExpiry)
+	if share.ExpiresAt != nil && share.ExpiresAt.Before(expires) {
+		expires = *share.ExpiresAt
+	}
+	expires = expires.UTC().Truncate(time.Second)
+	return fmt.Sprintf("%s/api/share/%s/files/%s/thumbnail?%s", basePath, shareId, file.Id,
+		auth.SignShareFile(ss.fs.cnf.JWT.Secret, shareId, file.Id, expires).Encode())
+}
+
+func shareStreamURL(basePath, shareId, fileId, name string) string {
+	return fmt.Sprintf("%s/api/share/%s/files/%s/stream/%s", basePath, shareId, fileId, url.PathEscape(name))
+}
@@ -0,0 +1,294 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/pkg/mapper"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// ConflictMerge reuses an existing folder of the same name instead of
+// creating another one.
+const ConflictMerge = "merge"
+
+// maxStructureFolders bounds the folders cloned or stored in a template.
+const maxStructureFolders = 1000
+
+var (
+	ErrStructureTooLarge = fmt.Errorf("structures are limited to %d folders", maxStructureFolders)
+	ErrTemplateSource    = errors.New("either source or folders is required")
+)
+
+const folderTreeQuery = `
+WITH RECURSIVE tree AS (
+	SELECT id, parent_id, name, 0 AS depth FROM teldrive.files
+	WHERE id = @root AND user_id = @user AND type = 'folder' AND status = 'active'
+	UNION ALL
+	SELECT f.id, f.parent_id, f.name, t.depth + 1 FROM teldrive.files f
+	JOIN tree t ON f.parent_id = t.id
+	WHERE f.user_id = @user AND f.type = 'folder' AND f.status = 'active'
+)
+SELECT id, parent_id, name FROM tree ORDER BY depth LIMIT @limit`
+
+type folderTreeRow struct {
+	Id       string
+	ParentId sql.NullString
+	Name     string
+}
+
+// buildFolderTree nests the rows of folderTreeQuery below the first one.
+// Children are sorted by name.
+func buildFolderTree(rows []folderTreeRow) schemas.FolderNode {
+	nodes := make(map[string]*schemas.FolderNode, len(rows))
+	for _, row := range rows {
+		nodes[row.Id] = &schemas.FolderNode{Name: row.Name, Source: row.Id}
+	}
+	sortChildren := func(node *schemas.FolderNode) {
+		slices.SortFunc(node.Children, func(a, b schemas.FolderNode) int { return strings.Compare(a.Name, b.Name) })
+	}
+	// Rows come parents first, so walking them backwards completes every
+	// folder before it is copied into its parent.
+	for i := len(rows) - 1; i > 0; i-- {
+		node := nodes[rows[i].Id]
+		sortChildren(node)
+		parent := nodes[rows[i].ParentId.String]
+		parent.Children = append(parent.Children, *node)
+	}
+	root := nodes[rows[0].Id]
+	sortChildren(root)
+	return *root
+}
+
+// loadFolderTree returns the folder structure below the folder id.
+func loadFolderTree(db *gorm.DB, userId int64, id string) (*schemas.FolderNode, error) {
+	var rows []folderTreeRow
+	if err := db.Raw(folderTreeQuery, sql.Named("root", id), sql.Named("user", userId),
+		sql.Named("limit", maxStructureFolders+1)).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, database.ErrNotFound
+	}
+	if len(rows) > maxStructureFolders {
+		return nil, ErrStructureTooLarge
+	}
+	root := buildFolderTree(rows)
+	return &root, nil
+}
+
+// validateFolderTree checks the names of a user supplied structure and its
+// size. Siblings must have distinct names.
+func validateFolderTree(nodes []schemas.FolderNode) error {
+	count := 0
+	var walk func(nodes []schemas.FolderNode) error
+	walk = func(nodes []schemas.FolderNode) error {
+		names := make(map[string]bool, len(nodes))
+		for _, node := range nodes {
+			if count++; count > maxStructureFolders {
+				return ErrStructureTooLarge
+			}
+			if node.Name == "" || node.Name == "." || node.Name == ".." || strings.Contains(node.Name, "/") {
+				return fmt.Errorf("invalid folder name %q", node.Name)
+			}
+			if names[node.Name] {
+				return fmt.Errorf("duplicate folder name %q", node.Name)
+			}
+			names[node.Name] = true
+			if err := walk(node.Children); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(nodes)
+}
+
+// createFolderTree creates node and its children below parentId and records
+// the ids of cloned folders in res. The conflict policy only matters for
+// folders that may already exist: the top level one, or any with merge.
+func createFolderTree(tx *gorm.DB, userId int64, parentId string, node schemas.FolderNode, policy string,
+	res *schemas.StructureOut) (*models.File, error) {
+	folder := &models.File{
+		Name:     node.Name,
+		Type:     "folder",
+		MimeType: "drive/folder",
+		UserID:   userId,
+		Status:   "active",
+		ParentID: sql.NullString{String: parentId, Valid: true},
+	}
+
+	var existing []models.File
+	if policy == ConflictMerge {
+		if err := tx.Where("parent_id = ? AND user_id = ? AND type = ? AND name = ? AND status = ?",
+			parentId, userId, "folder", node.Name, "active").Limit(1).Find(&existing).Error; err != nil {
+			return nil, err
+		}
+	} else if _, err := resolveNameConflict(tx, folder, policy); err != nil {
+		return nil, err
+	}
+
+	if len(existing) > 0 {
+		folder = &existing[0]
+	} else {
+		if err := tx.Create(folder).Error; err != nil {
+			return nil, err
+		}
+		res.Created++
+	}
+	if node.Source != "" {
+		res.Mapping[node.Source] = folder.Id
+	}
+
+	if policy != ConflictMerge {
+		policy = ConflictError
+	}
+	for _, child := range node.Children {
+		if _, err := createFolderTree(tx, userId, folder.Id, child, policy, res); err != nil {
+			return nil, err
+		}
+	}
+	return folder, nil
+}
+
+// createStructure recreates folders below the destination path, creating
+// the destination when missing.
+func (fs *FileService) createStructure(userId int64, destination string, folders []schemas.FolderNode,
+	policy string) (*schemas.StructureOut, *types.AppError) {
+	if policy == "" {
+		policy = ConflictRename
+	}
+
+	res := &schemas.StructureOut{Folders: []schemas.FileOut{}, Mapping: map[string]string{}}
+
+	err := fs.db.Transaction(func(tx *gorm.DB) error {
+		var dest []models.File
+		if err := tx.Raw("select * from teldrive.create_directories(?, ?)", userId, destination).
+			Scan(&dest).Error; err != nil {
+			return err
+		}
+		for _, node := range folders {
+			folder, err := createFolderTree(tx, userId, dest[0].Id, node, policy, res)
+			if err != nil {
+				return err
+			}
+			res.Folders = append(res.Folders, *mapper.ToFileOut(*folder))
+		}
+		return enforceEntryLimits(tx, fs.cache, fs.cnf, userId, "folder")
+	})
+
+	if err != nil {
+		if database.IsKeyConflictErr(err) {
+			return nil, &types.AppError{Error: err, Code: http.StatusConflict}
+		}
+		if isEntryLimitErr(err) {
+			return nil, entryLimitAppError(err)
+		}
+		return nil, &types.AppError{Error: err}
+	}
+	return res, nil
+}
+
+// CloneStructure recreates the folder tree below a folder without any of
+// its files.
+func (fs *FileService) CloneStructure(userId int64, payload *schemas.CloneStructure) (*schemas.StructureOut, *types.AppError) {
+	root, err := loadFolderTree(fs.db, userId, payload.Source)
+	if err != nil {
+		return nil, structureError(err)
+	}
+	return fs.createStructure(userId, payload.Destination, []schemas.FolderNode{*root}, payload.Conflict)
+}
+
+func (fs *FileService) ListTemplates(userId int64) ([]schemas.FolderTemplateOut, *types.AppError) {
+	var templates []models.FolderTemplate
+	if err := fs.db.Where("user_id = ?", userId).Order("name").Find(&templates).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	res := make([]schemas.FolderTemplateOut, 0, len(templates))
+	for i := range templates {
+		res = append(res, toTemplateOut(&templates[i]))
+	}
+	return res, nil
+}
+
+// CreateTemplate saves a folder structure under a name, either the tree of
+// an existing folder or the one given.
+func (fs *FileService) CreateTemplate(userId int64, payload *schemas.FolderTemplateIn) (*schemas.FolderTemplateOut, *types.AppError) {
+	folders := payload.Folders
+	switch {
+	case payload.Source != "" && len(folders) > 0, payload.Source == "" && len(folders) == 0:
+		return nil, &types.AppError{Error: ErrTemplateSource, Code: http.StatusBadRequest}
+	case payload.Source != "":
+		root, err := loadFolderTree(fs.db, userId, payload.Source)
+		if err != nil {
+			return nil, structureError(err)
+		}
+		folders = []schemas.FolderNode{*root}
+	default:
+		if err := validateFolderTree(folders); err != nil {
+			return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+		}
+	}
+
+	template := &models.FolderTemplate{UserID: userId, Name: payload.Name, Folders: datatypes.NewJSONSlice(folders)}
+	if err := fs.db.Create(template).Error; err != nil {
+		if database.IsKeyConflictErr(err) {
+			return nil, &types.AppError{Error: errors.New("template name already exists"), Code: http.StatusConflict}
+		}
+		return nil, &types.AppError{Error: err}
+	}
+	res := toTemplateOut(template)
+	return &res, nil
+}
+
+func (fs *FileService) DeleteTemplate(userId int64, id string) (*schemas.Message, *types.AppError) {
+	res := fs.db.Where("id = ? AND user_id = ?", id, userId).Delete(&models.FolderTemplate{})
+	if res.Error != nil {
+		return nil, &types.AppError{Error: res.Error}
+	}
+	if res.RowsAffected == 0 {
+		return nil, &types.AppError{Error: database.ErrNotFound, Code: http.StatusNotFound}
+	}
+	return &schemas.Message{Message: "template deleted"}, nil
+}
+
+// InstantiateTemplate creates the folders of a template below the
+// destination path.
+func (fs *FileService) InstantiateTemplate(userId int64, id string, payload *schemas.InstantiateTemplate) (*schemas.StructureOut, *types.AppError) {
+	var templates []models.FolderTemplate
+	if err := fs.db.Where("id = ? AND user_id = ?", id, userId).Find(&templates).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	if len(templates) == 0 {
+		return nil, &types.AppError{Error: database.ErrNotFound, Code: http.StatusNotFound}
+	}
+	return fs.createStructure(userId, payload.Destination, templates[0].Folders, payload.Conflict)
+}
+
+func structureError(err error) *types.AppError {
+	switch {
+	case database.IsRecordNotFoundErr(err):
+		return &types.AppError{Error: err, Code: http.StatusNotFound}
+	case errors.Is(err, ErrStructureTooLarge):
+		return &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+	return &types.AppError{Error: err}
+}
+
+func toTemplateOut(template *models.FolderTemplate) schemas.FolderTemplateOut {
+	return schemas.FolderTemplateOut{
+		ID:        template.ID,
+		Name:      template.Name,
+		Folders:   template.Folders,
+		CreatedAt: template.CreatedAt,
+	}
+}
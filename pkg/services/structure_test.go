@@ -0,0 +1,44 @@
+package services
+
+import (
+	"database/sql"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+)
+
+func TestBuildFolderTree(t *testing.T) {
+	parent := func(id string) sql.NullString { return sql.NullString{String: id, Valid: true} }
+	rows := []folderTreeRow{
+		{Id: "1", Name: "project"},
+		{Id: "2", ParentId: parent("1"), Name: "src"},
+		{Id: "3", ParentId: parent("1"), Name: "docs"},
+		{Id: "4", ParentId: parent("2"), Name: "main"},
+		{Id: "5", ParentId: parent("4"), Name: "go"},
+	}
+
+	root := buildFolderTree(rows)
+	assert.Equal(t, schemas.FolderNode{Name: "project", Source: "1", Children: []schemas.FolderNode{
+		{Name: "docs", Source: "3"},
+		{Name: "src", Source: "2", Children: []schemas.FolderNode{
+			{Name: "main", Source: "4", Children: []schemas.FolderNode{{Name: "go", Source: "5"}}},
+		}},
+	}}, root)
+}
+
+func TestValidateFolderTree(t *testing.T) {
+	assert.NoError(t, validateFolderTree([]schemas.FolderNode{
+		{Name: "a", Children: []schemas.FolderNode{{Name: "b"}, {Name: "c", Children: []schemas.FolderNode{{Name: "b"}}}}},
+	}))
+	assert.Error(t, validateFolderTree([]schemas.FolderNode{{Name: "a/b"}}))
+	assert.Error(t, validateFolderTree([]schemas.FolderNode{{Name: ".."}}))
+	assert.Error(t, validateFolderTree([]schemas.FolderNode{{Name: "a", Children: []schemas.FolderNode{{Name: "b"}, {Name: "b"}}}}))
+
+	large := make([]schemas.FolderNode, maxStructureFolders+1)
+	for i := range large {
+		large[i].Name = strconv.Itoa(i)
+	}
+	assert.ErrorIs(t, validateFolderTree(large), ErrStructureTooLarge)
+}
@@ -0,0 +1,371 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gotd/td/telegram"
+	"github.com/tgdrive/teldrive/internal/policy"
+	"github.com/tgdrive/teldrive/internal/reader"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/httputil"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+)
+
+var (
+	ErrPreviewBinary    = errors.New("file is not text and cannot be previewed")
+	ErrPreviewEncrypted = errors.New("client encrypted files cannot be previewed")
+)
+
+// DefaultPreviewBytes is the window a preview reads when none is given.
+const DefaultPreviewBytes = 64 * 1024
+
+const (
+	EncodingUTF8    = "utf-8"
+	EncodingUTF16LE = "utf-16le"
+	EncodingUTF16BE = "utf-16be"
+	EncodingLatin1  = "latin-1"
+)
+
+// previewMimeTypes are the mime types of files holding text.
+var previewMimeTypes = []string{"text/*", "application/json", "application/*+json", "application/xml",
+	"application/*+xml", "application/javascript", "application/x-javascript", "application/ecmascript",
+	"application/yaml", "application/x-yaml", "application/toml", "application/sql", "application/x-sh",
+	"application/x-shellscript", "application/x-httpd-php", "application/x-tex", "application/x-subrip",
+	"image/svg+xml"}
+
+// PreviewText returns a window of a text file decoded to UTF-8. The file is
+// read with the same authentication and ranged reads as a stream, so only the
+// window is fetched. The next window starts at the returned next offset.
+func (fs *FileService) PreviewText(c *gin.Context) {
+
+	var query schemas.TextPreviewQuery
+
+	if err := c.ShouldBindQuery(&query); err != nil {
+		httputil.NewError(c, http.StatusBadRequest, err)
+		return
+	}
+	if query.Bytes == 0 {
+		query.Bytes = DefaultPreviewBytes
+	}
+
+	session, file, ok := fs.resolveStreamFile(c, nil)
+	if !ok || !fs.checkStreamKeys(c, session, file) {
+		return
+	}
+
+	if file.Type != "file" {
+		httputil.NewError(c, http.StatusBadRequest, errors.New("only files can be previewed"))
+		return
+	}
+	if file.Encryption == EncryptionClient {
+		httputil.NewError(c, http.StatusConflict, ErrPreviewEncrypted)
+		return
+	}
+	if !previewable(file.Name, file.MimeType) {
+		httputil.NewError(c, http.StatusUnsupportedMediaType, ErrPreviewBinary)
+		return
+	}
+
+	res := &schemas.TextPreview{Offset: query.Offset, Size: file.Size, Encoding: query.Encoding}
+
+	if file.Size == 0 && query.Offset == 0 {
+		if res.Encoding == "" {
+			res.Encoding = EncodingUTF8
+		}
+		c.JSON(http.StatusOK, res)
+		return
+	}
+
+	if query.Offset >= file.Size {
+		c.Header("Content-Range", fmt.Sprintf("bytes */%d", file.Size))
+		httputil.NewError(c, http.StatusRequestedRangeNotSatisfiable, errors.New("Requested Range Not Satisfiable"))
+		return
+	}
+
+	end := min(query.Offset+query.Bytes, file.Size) - 1
+
+	data, err := fs.readRange(c, session, file, query.Offset, end)
+	if err != nil {
+		httputil.NewError(c, 0, err)
+		return
+	}
+
+	window, err := decodeText(data, query.Offset, end == file.Size-1, query.Encoding, query.Lines)
+	if err != nil {
+		httputil.NewError(c, http.StatusUnsupportedMediaType, err)
+		return
+	}
+
+	res.Text = window.text
+	res.Encoding = window.encoding
+	res.Lines = window.lines
+	if next := query.Offset + int64(window.consumed); next < file.Size {
+		res.NextOffset = next
+		res.Truncated = true
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// readRange reads the plaintext bytes start..end of file into memory.
+func (fs *FileService) readRange(ctx context.Context, session *models.Session, file *schemas.FileOutFull,
+	start, end int64) ([]byte, error) {
+	if file.InlineData != nil {
+		var key string
+		if file.Encrypted {
+			var err error
+			if key, err = encryptionKey(fs.db, &fs.cnf.TG, session.UserId, file.KeyVersion); err != nil {
+				return nil, err
+			}
+		}
+		data, err := openInline(key, file.InlineData, file.Encrypted)
+		if err != nil {
+			return nil, err
+		}
+		if end >= int64(len(data)) {
+			return nil, fmt.Errorf("inline data of %s is truncated", file.Id)
+		}
+		return data[start : end+1], nil
+	}
+
+	spec, middlewares, _, err := fs.streamClient(session, file)
+	if err != nil {
+		return nil, err
+	}
+	keys := keyResolver(fs.db, &fs.cnf.TG, session.UserId)
+
+	var buf bytes.Buffer
+	err = fs.clients.Run(ctx, spec, func(ctx context.Context, client *telegram.Client) error {
+		buf.Reset()
+		api := tgc.WithMiddlewares(client, middlewares...)
+		parts, err := getParts(ctx, api, fs.cache, file)
+		if err != nil {
+			return err
+		}
+		lr, err := reader.NewLinearReader(ctx, api, fs.cache, file, parts, start, end, &fs.cnf.TG, keys, 0)
+		if err != nil {
+			return err
+		}
+		defer lr.Close()
+		_, err = io.CopyN(&buf, lr, end-start+1)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// previewable reports whether a file may hold text: its declared or extension
+// mime type is a text type, or neither is known and its content decides.
+func previewable(name, mimeType string) bool {
+	known := false
+	for _, candidate := range []string{mimeType, mime.TypeByExtension(filepath.Ext(name))} {
+		if candidate == "" || candidate == "application/octet-stream" {
+			continue
+		}
+		if policy.MatchMime(previewMimeTypes, candidate) {
+			return true
+		}
+		known = true
+	}
+	return !known
+}
+
+type textWindow struct {
+	text     string
+	encoding string
+	consumed int
+	lines    int
+}
+
+// decodeText decodes data read at offset of a file, eof telling whether it
+// runs to the end of the file. An empty encoding is detected. Characters cut
+// by either edge of the window are dropped, and a window cut short ends after
+// its last complete line when it has one. At most maxLines lines are kept,
+// zero keeps all. Consumed counts the bytes of data the text covers, the next
+// window starts after them.
+func decodeText(data []byte, offset int64, eof bool, encoding string, maxLines int) (*textWindow, error) {
+	start := 0
+	if offset == 0 {
+		if bom, n := byteOrderMark(data); n > 0 && (encoding == "" || encoding == bom) {
+			encoding, start = bom, n
+		}
+	}
+	if encoding == "" {
+		if encoding = sniffEncoding(data, offset, eof); encoding == "" {
+			return nil, ErrPreviewBinary
+		}
+	}
+
+	switch encoding {
+	case EncodingUTF8:
+		for offset > 0 && start < min(len(data), 3) && data[start]&0xC0 == 0x80 {
+			start++
+		}
+	case EncodingUTF16LE, EncodingUTF16BE:
+		if offset%2 == 1 {
+			start++
+		}
+		if offset > 0 && start+1 < len(data) {
+			if r := decodeUnit(data[start:], encoding); r >= 0xDC00 && r <= 0xDFFF {
+				start += 2
+			}
+		}
+	}
+
+	var b strings.Builder
+	pos := start
+	lineEnd, lineText, lines := 0, 0, 0
+	capped := false
+	for pos < len(data) {
+		r, size := nextRune(data[pos:], encoding, eof)
+		if size == 0 {
+			break
+		}
+		if r == 0 {
+			return nil, ErrPreviewBinary
+		}
+		b.WriteRune(r)
+		pos += size
+		if r == '\n' {
+			lines++
+			lineEnd, lineText = pos, b.Len()
+			if maxLines > 0 && lines == maxLines {
+				capped = true
+				break
+			}
+		}
+	}
+
+	text := b.String()
+	if !capped && !(eof && pos == len(data)) && lineEnd > 0 {
+		text, pos = text[:lineText], lineEnd
+	}
+
+	window := &textWindow{text: text, encoding: encoding, consumed: pos, lines: strings.Count(text, "\n")}
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		window.lines++
+	}
+	return window, nil
+}
+
+// byteOrderMark returns the encoding a byte order mark at the start of data
+// names and its length.
+func byteOrderMark(data []byte) (string, int) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return EncodingUTF8, 3
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return EncodingUTF16LE, 2
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return EncodingUTF16BE, 2
+	}
+	return "", 0
+}
+
+// sniffEncoding guesses the encoding of data without a byte order mark. Text
+// in UTF-16 has zero bytes in every other position, any other zero byte
+// means binary content. Bytes that are not UTF-8 are read as Latin-1.
+func sniffEncoding(data []byte, offset int64, eof bool) string {
+	sample := data[:min(len(data), 1024)]
+	var even, odd int
+	for i, c := range sample {
+		if c != 0 {
+			continue
+		}
+		if (int64(i)+offset)%2 == 0 {
+			even++
+		} else {
+			odd++
+		}
+	}
+	half := len(sample) / 2
+	switch {
+	case half > 0 && odd > half*2/5 && even < half/10:
+		return EncodingUTF16LE
+	case half > 0 && even > half*2/5 && odd < half/10:
+		return EncodingUTF16BE
+	case even+odd > 0:
+		return ""
+	case validUTF8Window(data, offset > 0, !eof):
+		return EncodingUTF8
+	}
+	return EncodingLatin1
+}
+
+// validUTF8Window reports whether data is UTF-8 but for characters cut by
+// the edges of the window that are cut.
+func validUTF8Window(data []byte, cutStart, cutEnd bool) bool {
+	for i := 0; cutStart && i < 3 && len(data) > 0 && data[0]&0xC0 == 0x80; i++ {
+		data = data[1:]
+	}
+	for i := len(data) - 1; cutEnd && i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				data = data[:i]
+			}
+			break
+		}
+	}
+	return utf8.Valid(data)
+}
+
+// nextRune decodes the first character of p. An incomplete character before
+// the end of the file returns a zero size.
+func nextRune(p []byte, encoding string, eof bool) (rune, int) {
+	switch encoding {
+	case EncodingLatin1:
+		return rune(p[0]), 1
+	case EncodingUTF16LE, EncodingUTF16BE:
+		if len(p) < 2 {
+			return incomplete(p, eof)
+		}
+		r := decodeUnit(p, encoding)
+		if !utf16.IsSurrogate(r) {
+			return r, 2
+		}
+		if r >= 0xDC00 {
+			return utf8.RuneError, 2
+		}
+		if len(p) < 4 {
+			return incomplete(p, eof)
+		}
+		low := decodeUnit(p[2:], encoding)
+		if r = utf16.DecodeRune(r, low); r == utf8.RuneError {
+			return r, 2
+		}
+		return r, 4
+	}
+	if !utf8.FullRune(p) {
+		return incomplete(p, eof)
+	}
+	return utf8.DecodeRune(p)
+}
+
+func incomplete(p []byte, eof bool) (rune, int) {
+	if !eof {
+		return 0, 0
+	}
+	return utf8.RuneError, len(p)
+}
+
+// decodeUnit decodes the UTF-16 code unit at the start of p.
+func decodeUnit(p []byte, encoding string) rune {
+	if encoding == EncodingUTF16BE {
+		return rune(p[0])<<8 | rune(p[1])
+	}
+	return rune(p[1])<<8 | rune(p[0])
+}
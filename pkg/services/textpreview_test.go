@@ -0,0 +1,74 @@
+package services
+
+import (
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func utf16le(s string) []byte {
+	var out []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		out = append(out, byte(u), byte(u>>8))
+	}
+	return out
+}
+
+func TestDecodeTextUTF8(t *testing.T) {
+	data := []byte("first\nsecond é\nthird")
+
+	window, err := decodeText(data, 0, true, "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, EncodingUTF8, window.encoding)
+	assert.Equal(t, string(data), window.text)
+	assert.Equal(t, 3, window.lines)
+	assert.Equal(t, len(data), window.consumed)
+
+	// A window cut short ends after its last complete line.
+	window, err = decodeText(data[:17], 0, false, "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, "first\nsecond é\n", window.text)
+	assert.Equal(t, 16, window.consumed)
+
+	window, err = decodeText(data, 0, true, "", 1)
+	require.NoError(t, err)
+	assert.Equal(t, "first\n", window.text)
+	assert.Equal(t, 6, window.consumed)
+
+	// A window starting inside a character skips it.
+	window, err = decodeText(data[14:], 14, true, EncodingUTF8, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "\nthird", window.text)
+}
+
+func TestDecodeTextEncodings(t *testing.T) {
+	data := append([]byte{0xFF, 0xFE}, utf16le("hé 😀\n")...)
+	window, err := decodeText(data, 0, true, "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, EncodingUTF16LE, window.encoding)
+	assert.Equal(t, "hé 😀\n", window.text)
+
+	window, err = decodeText(utf16le("plain text here"), 0, true, "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, EncodingUTF16LE, window.encoding)
+	assert.Equal(t, "plain text here", window.text)
+
+	window, err = decodeText([]byte("caf\xe9"), 0, true, "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, EncodingLatin1, window.encoding)
+	assert.Equal(t, "café", window.text)
+
+	_, err = decodeText([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), 0, true, "", 0)
+	assert.ErrorIs(t, err, ErrPreviewBinary)
+}
+
+func TestPreviewable(t *testing.T) {
+	assert.True(t, previewable("main.go", "text/x-go"))
+	assert.True(t, previewable("data.json", ""))
+	assert.True(t, previewable("notes", ""))
+	assert.True(t, previewable("notes", "application/octet-stream"))
+	assert.False(t, previewable("photo.png", "image/png"))
+	assert.False(t, previewable("movie.mkv", ""))
+}
@@ -0,0 +1,462 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/category"
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/internal/utils"
+	"github.com/tgdrive/teldrive/pkg/mapper"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrImportChat     = errors.New("invalid source chat")
+	ErrImportNoMedia  = errors.New("message has no document to import")
+	ErrImportMissing  = errors.New("message not found")
+	ErrImportVerify   = errors.New("forwarded messages do not match the source messages")
+	ErrImportJoinSize = errors.New("joined documents must have the same size, only the last may be smaller")
+	errImportNotFound = errors.New("source chat not found")
+)
+
+// albumWindow is how far around a message its album siblings are looked for;
+// Telegram albums hold at most ten messages.
+const albumWindow = 9
+
+type importChat struct {
+	self     bool
+	username string
+	channel  int64
+	chat     int64
+}
+
+// parseImportChat accepts "me", a username with or without "@", a t.me link,
+// a bot API style id ("-100..." for channels, "-..." for basic groups) or a
+// bare channel id.
+func parseImportChat(chat string) (importChat, error) {
+	chat = strings.TrimSpace(chat)
+	for _, prefix := range []string{"https://", "http://"} {
+		chat = strings.TrimPrefix(chat, prefix)
+	}
+	chat = strings.TrimPrefix(chat, "t.me/")
+	chat = strings.TrimPrefix(chat, "@")
+	chat = strings.TrimSuffix(chat, "/")
+
+	switch {
+	case chat == "":
+		return importChat{}, ErrImportChat
+	case strings.EqualFold(chat, "me") || strings.EqualFold(chat, "self"):
+		return importChat{self: true}, nil
+	}
+
+	if id, err := strconv.ParseInt(chat, 10, 64); err == nil {
+		switch {
+		case strings.HasPrefix(chat, "-100"):
+			id, _ = strconv.ParseInt(chat[4:], 10, 64)
+			if id > 0 {
+				return importChat{channel: id}, nil
+			}
+		case id < 0:
+			return importChat{chat: -id}, nil
+		case id > 0:
+			return importChat{channel: id}, nil
+		}
+		return importChat{}, ErrImportChat
+	}
+
+	if strings.ContainsAny(chat, "/?# ") {
+		return importChat{}, ErrImportChat
+	}
+	return importChat{username: chat}, nil
+}
+
+func resolveImportPeer(ctx context.Context, api *tg.Client, chat importChat) (tg.InputPeerClass, error) {
+	switch {
+	case chat.self:
+		return &tg.InputPeerSelf{}, nil
+	case chat.channel != 0:
+		channel, err := tgc.GetChannelById(ctx, api, chat.channel)
+		if err != nil {
+			return nil, err
+		}
+		return &tg.InputPeerChannel{ChannelID: channel.ChannelID, AccessHash: channel.AccessHash}, nil
+	case chat.chat != 0:
+		return &tg.InputPeerChat{ChatID: chat.chat}, nil
+	}
+
+	resolved, err := api.ContactsResolveUsername(ctx, chat.username)
+	if err != nil {
+		return nil, err
+	}
+	switch peer := resolved.Peer.(type) {
+	case *tg.PeerUser:
+		for _, user := range resolved.Users {
+			if u, ok := user.(*tg.User); ok && u.ID == peer.UserID {
+				return u.AsInputPeer(), nil
+			}
+		}
+	case *tg.PeerChannel:
+		for _, c := range resolved.Chats {
+			if channel, ok := c.(*tg.Channel); ok && channel.ID == peer.ChannelID {
+				return channel.AsInputPeer(), nil
+			}
+		}
+	case *tg.PeerChat:
+		return &tg.InputPeerChat{ChatID: peer.ChatID}, nil
+	}
+	return nil, errImportNotFound
+}
+
+func sourceMessages(ctx context.Context, api *tg.Client, peer tg.InputPeerClass, ids []int) ([]tg.MessageClass, error) {
+	input := make([]tg.InputMessageClass, len(ids))
+	for i, id := range ids {
+		input[i] = &tg.InputMessageID{ID: id}
+	}
+
+	var (
+		res tg.MessagesMessagesClass
+		err error
+	)
+	if channel, ok := peer.(*tg.InputPeerChannel); ok {
+		res, err = api.ChannelsGetMessages(ctx, &tg.ChannelsGetMessagesRequest{
+			Channel: &tg.InputChannel{ChannelID: channel.ChannelID, AccessHash: channel.AccessHash},
+			ID:      input,
+		})
+	} else {
+		res, err = api.MessagesGetMessages(ctx, input)
+	}
+	if err != nil {
+		return nil, err
+	}
+	modified, ok := res.AsModified()
+	if !ok {
+		return nil, ErrImportMissing
+	}
+	return modified.GetMessages(), nil
+}
+
+// albumCandidates returns the requested ids plus the neighbours that may
+// belong to the same album.
+func albumCandidates(ids []int) []int {
+	seen := make(map[int]bool)
+	res := []int{}
+	for _, id := range ids {
+		for candidate := max(id-albumWindow, 1); candidate <= id+albumWindow; candidate++ {
+			if !seen[candidate] {
+				seen[candidate] = true
+				res = append(res, candidate)
+			}
+		}
+	}
+	slices.Sort(res)
+	return res
+}
+
+// pickImportMessages keeps the requested messages and, with album set, every
+// message sharing an album with one of them, ordered by id.
+func pickImportMessages(messages []tg.MessageClass, ids []int, album bool) ([]*tg.Message, error) {
+	byId := make(map[int]*tg.Message, len(messages))
+	for _, message := range messages {
+		if msg, ok := message.(*tg.Message); ok {
+			byId[msg.ID] = msg
+		}
+	}
+
+	groups := make(map[int64]bool)
+	picked := make(map[int]bool)
+	for _, id := range ids {
+		msg, ok := byId[id]
+		if !ok {
+			return nil, fmt.Errorf("%w: %d", ErrImportMissing, id)
+		}
+		picked[id] = true
+		if album && msg.GroupedID != 0 {
+			groups[msg.GroupedID] = true
+		}
+	}
+	if len(groups) > 0 {
+		for id, msg := range byId {
+			if groups[msg.GroupedID] {
+				picked[id] = true
+			}
+		}
+	}
+
+	res := make([]*tg.Message, 0, len(picked))
+	for id := range picked {
+		res = append(res, byId[id])
+	}
+	slices.SortFunc(res, func(a, b *tg.Message) int { return a.ID - b.ID })
+	return res, nil
+}
+
+type importDocument struct {
+	name     string
+	mimeType string
+	size     int64
+}
+
+// importDocumentOf extracts the file behind a media message, keeping the
+// original file name and mime type. Media without a file name, such as
+// round videos, are named after the message.
+func importDocumentOf(msg *tg.Message) (*importDocument, error) {
+	media, ok := msg.Media.(*tg.MessageMediaDocument)
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrImportNoMedia, msg.ID)
+	}
+	document, ok := media.Document.(*tg.Document)
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrImportNoMedia, msg.ID)
+	}
+	doc := &importDocument{mimeType: document.MimeType, size: document.Size}
+	for _, attr := range document.Attributes {
+		if name, ok := attr.(*tg.DocumentAttributeFilename); ok {
+			doc.name = strings.TrimSpace(strings.ReplaceAll(name.FileName, "/", "_"))
+		}
+	}
+	if doc.name == "" {
+		doc.name = fmt.Sprintf("telegram_%d", msg.ID)
+		if exts, _ := mime.ExtensionsByType(doc.mimeType); len(exts) > 0 {
+			doc.name += exts[0]
+		}
+	}
+	if doc.mimeType == "" {
+		doc.mimeType = "application/octet-stream"
+	}
+	return doc, nil
+}
+
+// importFiles lays the documents out as file rows. Joined documents become the
+// parts of a single file in message order, so they have to be of one size
+// like the parts of any file.
+func importFiles(docs []*importDocument, join bool, name string) []models.File {
+	if !join {
+		files := make([]models.File, len(docs))
+		for i, doc := range docs {
+			files[i] = models.File{Name: doc.name, MimeType: doc.mimeType, Size: utils.Int64Pointer(doc.size)}
+		}
+		return files
+	}
+	var size int64
+	for _, doc := range docs {
+		size += doc.size
+	}
+	mimeType := docs[0].mimeType
+	if byExt := mime.TypeByExtension(extOf(name)); byExt != "" {
+		mimeType = byExt
+	}
+	return []models.File{{Name: name, MimeType: mimeType, Size: &size}}
+}
+
+func extOf(name string) string {
+	if i := strings.LastIndex(name, "."); i > 0 {
+		return name[i:]
+	}
+	return ""
+}
+
+// ImportFromTelegram forwards media messages from a chat the user can read
+// into a storage channel and creates files pointing at the copies. The copies
+// are checked against the source documents before any row is written, and
+// are deleted again when the import fails.
+func (fs *FileService) ImportFromTelegram(c *gin.Context, userId int64, payload *schemas.TelegramImport) (*schemas.TelegramImportOut, *types.AppError) {
+	chat, err := parseImportChat(payload.Chat)
+	if err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+
+	parent, err := fs.getFileFromPath(strings.TrimSpace(payload.Path), userId)
+	if err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusNotFound}
+	}
+
+	// Imported content is stored as Telegram has it, so it is never encrypted.
+	channelId, _, err := resolveUploadSettings(fs.db, fs.cache, userId, parent.Id, "", payload.ChannelID,
+		utils.BoolPointer(false), nil)
+	if err != nil {
+		return nil, uploadSettingsError(err)
+	}
+
+	_, session := auth.GetUser(c)
+
+	var (
+		out    = &schemas.TelegramImportOut{Files: []schemas.FileOut{}}
+		appErr *types.AppError
+	)
+
+	err = fs.clients.Run(c, fs.clients.UserSpec(session), func(ctx context.Context, client *telegram.Client) error {
+		peer, err := resolveImportPeer(ctx, client.API(), chat)
+		if err != nil {
+			if errors.Is(err, errImportNotFound) || errors.Is(err, tgc.ErrInValidChannelID) {
+				appErr = &types.AppError{Error: errImportNotFound, Code: http.StatusNotFound}
+				return nil
+			}
+			return err
+		}
+
+		ids := payload.MessageIDs
+		if payload.Album {
+			ids = albumCandidates(ids)
+		}
+		messages, err := sourceMessages(ctx, client.API(), peer, ids)
+		if err != nil {
+			return err
+		}
+		picked, err := pickImportMessages(messages, payload.MessageIDs, payload.Album)
+		if err != nil {
+			appErr = &types.AppError{Error: err, Code: http.StatusNotFound}
+			return nil
+		}
+
+		docs := make([]*importDocument, len(picked))
+		msgIds := make([]int, len(picked))
+		for i, msg := range picked {
+			if docs[i], err = importDocumentOf(msg); err != nil {
+				appErr = &types.AppError{Error: err, Code: http.StatusBadRequest}
+				return nil
+			}
+			msgIds[i] = msg.ID
+		}
+
+		if payload.Join {
+			sizes := make([]int64, len(docs))
+			for i, doc := range docs {
+				sizes[i] = doc.size
+			}
+			if checkAppendSizes(nil, sizes) != nil {
+				appErr = &types.AppError{Error: ErrImportJoinSize, Code: http.StatusBadRequest}
+				return nil
+			}
+		}
+
+		files := importFiles(docs, payload.Join, payload.Name)
+		for _, file := range files {
+			if fs.cnf != nil {
+				if err := checkFileType(fs.db, fs.cache, &fs.cnf.TG, userId, file.Name, file.MimeType); err != nil {
+					appErr = &types.AppError{Error: err, Code: http.StatusUnsupportedMediaType}
+					return nil
+				}
+				parts := 1
+				if payload.Join {
+					parts = len(docs)
+				}
+				if err := checkUploadLimits(&fs.cnf.TG, 0, *file.Size, parts); err != nil {
+					appErr = &types.AppError{Error: err, Code: http.StatusRequestEntityTooLarge}
+					return nil
+				}
+			}
+		}
+
+		if err := checkEntryRoom(fs.db, fs.cache, fs.cnf, userId, int64(len(files)), 0); err != nil {
+			appErr = entryLimitAppError(err)
+			return nil
+		}
+
+		target, err := tgc.GetChannelById(ctx, client.API(), channelId)
+		if err != nil {
+			return err
+		}
+
+		// Albums can take the forward past the ids requested, it goes out in
+		// batches Telegram accepts.
+		newIds, err := forwardMessages(ctx, client.API(), peer, target, msgIds)
+		if err != nil {
+			return err
+		}
+
+		copies, err := tgc.GetMessages(ctx, client.API(), newIds, target.ChannelID)
+		if err == nil {
+			var sizes []int64
+			if sizes, err = documentSizes(copies); err == nil && len(sizes) != len(docs) {
+				err = ErrImportVerify
+			}
+			for i := 0; err == nil && i < len(sizes); i++ {
+				if sizes[i] != docs[i].size {
+					err = ErrImportVerify
+				}
+			}
+		}
+		if err != nil {
+			tgc.DeleteMessages(ctx, client.API(), target.ChannelID, newIds)
+			if errors.Is(err, ErrImportVerify) || errors.Is(err, ErrRelocateMissing) {
+				appErr = &types.AppError{Error: ErrImportVerify, Code: http.StatusBadGateway}
+				return nil
+			}
+			return err
+		}
+
+		for i := range files {
+			file := &files[i]
+			file.Type = "file"
+			file.UserID = userId
+			file.Status = "active"
+			file.Category = string(category.GetCategory(file.Name))
+			file.ParentID = sql.NullString{String: parent.Id, Valid: true}
+			file.ChannelID = &target.ChannelID
+			if payload.Join {
+				parts := make([]schemas.Part, len(newIds))
+				for j, id := range newIds {
+					parts[j] = schemas.Part{ID: int64(id)}
+				}
+				file.Parts = datatypes.NewJSONSlice(parts)
+			} else {
+				file.Parts = datatypes.NewJSONSlice([]schemas.Part{{ID: int64(newIds[i])}})
+			}
+		}
+
+		err = fs.db.Transaction(func(tx *gorm.DB) error {
+			for i := range files {
+				if payload.Conflict != "" {
+					if _, err := resolveNameConflict(tx, &files[i], payload.Conflict); err != nil {
+						return err
+					}
+				}
+				if err := tx.Create(&files[i]).Error; err != nil {
+					return err
+				}
+			}
+			return enforceEntryLimits(tx, fs.cache, fs.cnf, userId, "file")
+		})
+		if err != nil {
+			tgc.DeleteMessages(ctx, client.API(), target.ChannelID, newIds)
+			if database.IsKeyConflictErr(err) || errors.Is(err, database.ErrKeyConflict) {
+				appErr = &types.AppError{Error: database.ErrKeyConflict, Code: http.StatusConflict}
+				return nil
+			}
+			if isEntryLimitErr(err) {
+				appErr = entryLimitAppError(err)
+				return nil
+			}
+			return err
+		}
+
+		for _, file := range files {
+			out.Files = append(out.Files, *mapper.ToFileOut(file))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	if appErr != nil {
+		return nil, appErr
+	}
+	return out, nil
+}
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/gotd/td/tg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseImportChat(t *testing.T) {
+	cases := map[string]importChat{
+		"me":                     {self: true},
+		"@somechannel":           {username: "somechannel"},
+		"https://t.me/somechan/": {username: "somechan"},
+		"-1001234":               {channel: 1234},
+		"1234":                   {channel: 1234},
+		"-42":                    {chat: 42},
+	}
+	for input, want := range cases {
+		got, err := parseImportChat(input)
+		require.NoError(t, err, input)
+		assert.Equal(t, want, got, input)
+	}
+
+	for _, input := range []string{"", "@", "t.me/a/b", "-100", "0"} {
+		_, err := parseImportChat(input)
+		assert.ErrorIs(t, err, ErrImportChat, input)
+	}
+}
+
+func documentMessage(id int, grouped int64, name string, size int64) *tg.Message {
+	attrs := []tg.DocumentAttributeClass{}
+	if name != "" {
+		attrs = append(attrs, &tg.DocumentAttributeFilename{FileName: name})
+	}
+	return &tg.Message{ID: id, GroupedID: grouped, Media: &tg.MessageMediaDocument{
+		Document: &tg.Document{MimeType: "video/mp4", Size: size, Attributes: attrs}}}
+}
+
+func TestPickImportMessages(t *testing.T) {
+	messages := []tg.MessageClass{
+		documentMessage(3, 7, "c.mp4", 1),
+		documentMessage(1, 7, "a.mp4", 1),
+		documentMessage(2, 7, "b.mp4", 1),
+		documentMessage(4, 0, "d.mp4", 1),
+		&tg.MessageEmpty{ID: 5},
+	}
+
+	picked, err := pickImportMessages(messages, []int{2}, false)
+	require.NoError(t, err)
+	assert.Len(t, picked, 1)
+
+	picked, err = pickImportMessages(messages, []int{2}, true)
+	require.NoError(t, err)
+	ids := []int{}
+	for _, msg := range picked {
+		ids = append(ids, msg.ID)
+	}
+	assert.Equal(t, []int{1, 2, 3}, ids)
+
+	_, err = pickImportMessages(messages, []int{5}, true)
+	assert.ErrorIs(t, err, ErrImportMissing)
+
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}, albumCandidates([]int{3}))
+}
+
+func TestImportDocument(t *testing.T) {
+	doc, err := importDocumentOf(documentMessage(9, 0, "a/b.mp4", 5))
+	require.NoError(t, err)
+	assert.Equal(t, "a_b.mp4", doc.name)
+	assert.Equal(t, int64(5), doc.size)
+
+	doc, err = importDocumentOf(documentMessage(9, 0, "", 5))
+	require.NoError(t, err)
+	assert.Contains(t, doc.name, "telegram_9")
+
+	_, err = importDocumentOf(&tg.Message{ID: 1, Media: &tg.MessageMediaPhoto{}})
+	assert.ErrorIs(t, err, ErrImportNoMedia)
+
+	docs := []*importDocument{{name: "x.7z.001", mimeType: "application/octet-stream", size: 3},
+		{name: "x.7z.002", mimeType: "application/octet-stream", size: 4}}
+	files := importFiles(docs, false, "")
+	assert.Len(t, files, 2)
+	files = importFiles(docs, true, "x.zip")
+	require.Len(t, files, 1)
+	assert.Equal(t, int64(7), *files[0].Size)
+	assert.Equal(t, "x.zip", files[0].Name)
+}
@@ -0,0 +1,137 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+)
+
+const defaultTicketExpiry = time.Hour
+
+var ErrTicketQuotaExceeded = errors.New("upload ticket quota exceeded")
+
+// ticketQuota reserves ticket bytes for parts still in flight so concurrent
+// parts cannot together overrun a ticket's size limit.
+type ticketQuota struct {
+	mu       sync.Mutex
+	reserved map[string]int64
+}
+
+func (q *ticketQuota) reserve(uploadId string, used, size, limit int64) (func(), bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if used+q.reserved[uploadId]+size > limit {
+		return nil, false
+	}
+	if q.reserved == nil {
+		q.reserved = make(map[string]int64)
+	}
+	q.reserved[uploadId] += size
+	return func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if q.reserved[uploadId] -= size; q.reserved[uploadId] <= 0 {
+			delete(q.reserved, uploadId)
+		}
+	}, true
+}
+
+// IssueUploadTicket mints a signed ticket letting its holder upload parts of a
+// single upload into payload.Path without the session cookie.
+func (us *UploadService) IssueUploadTicket(c *gin.Context, payload *schemas.UploadTicketIn) (*schemas.UploadTicketOut, *types.AppError) {
+	val, _ := c.Get("jwtUser")
+	claims := val.(*types.JWTClaims)
+	userId, _ := auth.GetUser(c)
+
+	now := time.Now()
+	expiresAt := now.Add(defaultTicketExpiry)
+	if payload.ExpiresAt != nil {
+		expiresAt = *payload.ExpiresAt
+	}
+	if !expiresAt.After(now) {
+		return nil, &types.AppError{Error: errors.New("expiresAt must be in the future"), Code: http.StatusBadRequest}
+	}
+	if limit := us.cnf.Uploads.TicketMaxExpiry; limit > 0 && expiresAt.Sub(now) > limit {
+		return nil, &types.AppError{Error: fmt.Errorf("ticket lifetime exceeds limit of %s", limit), Code: http.StatusBadRequest}
+	}
+
+	if err := checkUploadLimits(us.cnf, payload.MaxPartSize, payload.MaxSize, payload.MaxParts); err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+
+	if payload.ChannelID != 0 {
+		if err := checkChannelAccess(us.db, us.cache, userId, payload.ChannelID); err != nil {
+			return nil, channelAccessError(err)
+		}
+	}
+
+	ticket := &auth.UploadTicket{
+		UserId:      userId,
+		SessionHash: claims.Hash,
+		UploadId:    uuid.NewString(),
+		Path:        payload.Path,
+		ChannelID:   payload.ChannelID,
+		MaxSize:     payload.MaxSize,
+		MaxPartSize: payload.MaxPartSize,
+		MaxParts:    payload.MaxParts,
+		ExpiresAt:   expiresAt.Unix(),
+	}
+
+	token, err := auth.SignTicket(us.ticketSecret, ticket)
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	return &schemas.UploadTicketOut{
+		Ticket:    token,
+		UploadId:  ticket.UploadId,
+		UploadURL: fmt.Sprintf("%s/api/uploads/%s?ticket=%s", requestBaseURL(c), ticket.UploadId, url.QueryEscape(token)),
+		ExpiresAt: time.Unix(ticket.ExpiresAt, 0).UTC(),
+	}, nil
+}
+
+// applyTicket pins the upload destination to the ticket and enforces its
+// limits on the incoming part. The returned release func must be called once
+// the part is stored or has failed.
+func (us *UploadService) applyTicket(ticket *auth.UploadTicket, query *schemas.UploadQuery, size int64) (func(), *types.AppError) {
+	if (query.Path != "" && query.Path != ticket.Path) || query.ParentID != "" ||
+		(query.ChannelID != 0 && query.ChannelID != ticket.ChannelID) {
+		return nil, &types.AppError{Error: errors.New("destination not allowed by upload ticket"), Code: http.StatusForbidden}
+	}
+	query.Path = ticket.Path
+	query.ChannelID = ticket.ChannelID
+
+	if size < 0 {
+		return nil, &types.AppError{Error: errors.New("content length required"), Code: http.StatusLengthRequired}
+	}
+	if ticket.MaxPartSize > 0 && size > ticket.MaxPartSize {
+		return nil, &types.AppError{Error: fmt.Errorf("part size exceeds ticket limit of %d bytes", ticket.MaxPartSize),
+			Code: http.StatusRequestEntityTooLarge}
+	}
+	if ticket.MaxParts > 0 && query.PartNo > ticket.MaxParts {
+		return nil, &types.AppError{Error: fmt.Errorf("part count exceeds ticket limit of %d", ticket.MaxParts),
+			Code: http.StatusRequestEntityTooLarge}
+	}
+
+	var used int64
+	if err := us.db.Model(&models.Upload{}).Where("upload_id = ?", ticket.UploadId).
+		Where("user_id = ?", ticket.UserId).Select("coalesce(sum(greatest(size, original_size)), 0)").Scan(&used).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	release, ok := us.tickets.reserve(ticket.UploadId, used, size, ticket.MaxSize)
+	if !ok {
+		return nil, &types.AppError{Error: ErrTicketQuotaExceeded, Code: http.StatusRequestEntityTooLarge}
+	}
+	return release, nil
+}
@@ -0,0 +1,29 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTicketQuota(t *testing.T) {
+	var q ticketQuota
+
+	release, ok := q.reserve("up", 0, 60, 100)
+	assert.True(t, ok)
+
+	_, ok = q.reserve("up", 0, 50, 100)
+	assert.False(t, ok, "in-flight parts count against the quota")
+
+	_, ok = q.reserve("up", 50, 10, 100)
+	assert.False(t, ok, "stored parts count against the quota")
+
+	_, ok = q.reserve("other", 0, 100, 100)
+	assert.True(t, ok)
+
+	release()
+	assert.NotContains(t, q.reserved, "up")
+
+	_, ok = q.reserve("up", 0, 100, 100)
+	assert.True(t, ok)
+}
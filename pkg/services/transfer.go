@@ -0,0 +1,387 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gotd/td/telegram"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/policy"
+	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrTransferRoot        = errors.New("the root folder cannot be transferred")
+	ErrTransferSelf        = errors.New("files are already owned by this user")
+	ErrTransferUser        = errors.New("target user not found")
+	ErrTransferForbidden   = errors.New("target user is not allowed to own files")
+	ErrTransferEncrypted   = errors.New("encrypted files cannot be transferred, their keys belong to the owner")
+	ErrTransferDestination = errors.New("transfer destination is not a folder of the target user")
+)
+
+// TransferInbox is the folder of the receiving user transfers land in.
+const TransferInbox = "/Inbox"
+
+// TransferFiles hands files and folders, along with everything below them,
+// over to another user. The messages backing the files are forwarded into the
+// receiving user's default channel first, so their bots can read them, and
+// the entries are then moved into the receiving user's inbox. The original
+// messages are deleted once the move has been committed.
+func (fs *FileService) TransferFiles(c *gin.Context, userId int64, payload *schemas.FileTransfer) (*schemas.FileTransferOut, *types.AppError) {
+	target, err := fs.transferTarget(userId, payload.User)
+	if err != nil {
+		return nil, transferError(err)
+	}
+
+	dest := TransferInbox
+
+	result := &schemas.OperationResult{Files: []schemas.AffectedFile{}}
+
+	items, err := loadPreviewItems(fs.db, userId, payload.Files, result)
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	for _, item := range items {
+		if item.ParentID == nil {
+			return nil, transferError(ErrTransferRoot)
+		}
+	}
+
+	conflicts, err := transferConflicts(fs.db, target.UserId, dest, items)
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	result.Conflicts = append(result.Conflicts, conflicts...)
+	if len(result.Conflicts) > 0 {
+		return nil, operationError(&OperationError{result: result})
+	}
+
+	var entries []models.File
+	if err := fs.db.Raw(`WITH RECURSIVE tree AS (
+		SELECT * FROM teldrive.files WHERE id IN ? AND user_id = ? AND status = 'active'
+		UNION ALL
+		SELECT f.* FROM teldrive.files f JOIN tree ON f.parent_id = tree.id
+		WHERE f.user_id = ? AND f.status = 'active'
+	) SELECT * FROM tree`, payload.Files, userId, userId).Scan(&entries).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	transfer := &models.FileTransfer{FromUserId: userId, ToUserId: target.UserId,
+		Files: datatypes.NewJSONSlice(payload.Files), Destination: dest}
+
+	var (
+		stored         []*models.File
+		files, folders int64
+	)
+	ids := make([]string, 0, len(entries))
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Encrypted {
+			return nil, transferError(ErrTransferEncrypted)
+		}
+		ids = append(ids, entry.Id)
+		transfer.Entries++
+		if entry.Type != "file" {
+			folders++
+			continue
+		}
+		files++
+		if entry.Size != nil {
+			transfer.Bytes += *entry.Size
+		}
+		transfer.Parts += len(entry.Parts)
+		if entry.ChannelID != nil && len(entry.Parts) > 0 {
+			stored = append(stored, entry)
+		}
+	}
+
+	if err := fs.checkTransferLimits(target.UserId, entries, files, folders); err != nil {
+		return nil, transferError(err)
+	}
+
+	var shares []string
+
+	commit := func(moved []transferredFile) error {
+		return fs.db.Transaction(func(tx *gorm.DB) error {
+			inbox, err := createDirectories(tx, fs.cache, fs.cnf, target.UserId, dest)
+			if err != nil {
+				return err
+			}
+			if len(inbox) == 0 {
+				return ErrTransferDestination
+			}
+			if shares, err = detachShares(tx, userId, payload.Files, true); err != nil {
+				return err
+			}
+			for _, m := range moved {
+				if err := tx.Model(&models.File{}).Where("id = ?", m.file.Id).
+					Updates(map[string]any{
+						"channel_id": m.channelId,
+						"parts":      datatypes.NewJSONSlice(m.parts),
+					}).Error; err != nil {
+					return err
+				}
+			}
+			// Owner and parent change in one statement, the change log then sees
+			// the previous parent of every entry below the transferred ones
+			// already owned by the receiving user.
+			if err := tx.Exec(`UPDATE teldrive.files SET user_id = @to,
+				parent_id = CASE WHEN id = ANY(@top::uuid[]) THEN @dest::uuid ELSE parent_id END
+				WHERE id = ANY(@ids::uuid[])`,
+				map[string]any{"to": target.UserId, "top": payload.Files, "dest": inbox[0].Id, "ids": ids}).Error; err != nil {
+				return err
+			}
+			if err := enforceEntryLimits(tx, fs.cache, fs.cnf, target.UserId, "file", "folder"); err != nil {
+				return err
+			}
+			return tx.Create(transfer).Error
+		})
+	}
+
+	if len(stored) > 0 {
+		err = fs.transferParts(c, userId, target.UserId, stored, commit)
+	} else {
+		err = commit(nil)
+	}
+	if err != nil {
+		return nil, transferError(err)
+	}
+
+	for i := range entries {
+		fs.clearFileCache(&entries[i])
+	}
+	fs.clearShareCache(shares)
+
+	logging.FromContext(c).Infow("files transferred", "transferId", transfer.Id, "from", userId,
+		"to", target.UserId, "destination", dest, "entries", transfer.Entries, "bytes", transfer.Bytes)
+
+	return toFileTransferOut(transfer), nil
+}
+
+// checkTransferLimits refuses a transfer the receiving user could not have
+// uploaded themselves: entries past their limits, files of a type or size
+// their limits do not allow.
+func (fs *FileService) checkTransferLimits(targetId int64, entries []models.File, files, folders int64) error {
+	if err := checkEntryRoom(fs.db, fs.cache, fs.cnf, targetId, files, folders); err != nil {
+		return err
+	}
+	if fs.cnf == nil {
+		return nil
+	}
+	for _, entry := range entries {
+		if entry.Type != "file" {
+			continue
+		}
+		if err := checkFileType(fs.db, fs.cache, &fs.cnf.TG, targetId, entry.Name, entry.MimeType); err != nil {
+			return err
+		}
+		var size int64
+		if entry.Size != nil {
+			size = *entry.Size
+		}
+		if err := checkUploadLimits(&fs.cnf.TG, 0, size, len(entry.Parts)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transferTarget looks up the receiving user by user id or username and
+// checks that they may sign in, and so own files.
+func (fs *FileService) transferTarget(userId int64, name string) (*models.User, error) {
+	name = strings.TrimPrefix(strings.TrimSpace(name), "@")
+
+	query := fs.db.Model(&models.User{})
+	if id, err := strconv.ParseInt(name, 10, 64); err == nil {
+		query = query.Where("user_id = ?", id)
+	} else {
+		query = query.Where("lower(user_name) = lower(?)", name)
+	}
+
+	var users []models.User
+	if err := query.Limit(1).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, ErrTransferUser
+	}
+
+	target := &users[0]
+	if target.UserId == userId {
+		return nil, ErrTransferSelf
+	}
+	if fs.cnf != nil && !checkUserIsAllowed(fs.cnf.JWT.AllowedUsers, fs.cnf.JWT.DeniedUsers, target.UserId, target.UserName) {
+		return nil, ErrTransferForbidden
+	}
+	return target, nil
+}
+
+// transferConflicts checks dest in the tree of the receiving user: it has to
+// be a folder or not exist yet, and must not hold entries named like the
+// transferred ones.
+func transferConflicts(tx *gorm.DB, userId int64, dest string, items []previewItem) ([]schemas.OperationConflict, error) {
+	conflicts := batchCollisions(items)
+
+	var folder []previewItem
+	if err := tx.Raw("select id, name, type from teldrive.get_file_from_path(?, ?, ?)", dest, userId, false).
+		Scan(&folder).Error; err != nil {
+		return nil, err
+	}
+	if len(folder) == 0 {
+		return conflicts, nil
+	}
+	if folder[0].Type != "folder" {
+		return append(conflicts, schemas.OperationConflict{Name: dest, Reason: ErrTransferDestination.Error()}), nil
+	}
+
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		names = append(names, item.Name)
+	}
+
+	var existing []previewItem
+	if err := tx.Model(&models.File{}).Select("id", "name", "type", "size").
+		Where("parent_id = ?", folder[0].Id).Where("user_id = ?", userId).Where("status = ?", "active").
+		Where("name IN ?", names).Scan(&existing).Error; err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		for _, other := range existing {
+			if collides(item, other) {
+				conflicts = append(conflicts, schemas.OperationConflict{Id: item.Id, Name: item.Name,
+					Reason: "destination already contains " + item.Name})
+				break
+			}
+		}
+	}
+	return conflicts, nil
+}
+
+// transferredFile is a file whose messages were forwarded into the channel
+// of the receiving user.
+type transferredFile struct {
+	file      *models.File
+	channelId int64
+	parts     []schemas.Part
+	newIds    []int
+}
+
+// transferParts forwards the messages of files into the default channel of the
+// receiving user and hands the copies to commit. Only the sender's own
+// session may see both channels. The copies are deleted when commit fails,
+// otherwise the originals and their replicas, which stay in the sender's
+// channels, are deleted and the message counts of the channels follow.
+func (fs *FileService) transferParts(c *gin.Context, userId, targetId int64, files []*models.File,
+	commit func([]transferredFile) error) error {
+	channelId, err := getDefaultChannel(fs.db, fs.cache, targetId)
+	if err != nil {
+		return err
+	}
+
+	_, session := auth.GetUser(c)
+
+	logger := logging.FromContext(c)
+
+	return fs.clients.Run(c, fs.clients.UserSpec(session), func(ctx context.Context, client *telegram.Client) error {
+		target, err := tgc.GetChannelById(ctx, client.API(), channelId)
+		if err != nil {
+			return fmt.Errorf("channel of the target user is not accessible: %w", err)
+		}
+
+		var moved []transferredFile
+		discard := func() {
+			for _, m := range moved {
+				tgc.DeleteMessages(ctx, client.API(), channelId, m.newIds)
+			}
+		}
+
+		for _, file := range files {
+			if *file.ChannelID == channelId {
+				continue
+			}
+			_, newIds, err := forwardParts(ctx, client, target, file)
+			if err != nil {
+				discard()
+				return fmt.Errorf("%s: %w", file.Name, err)
+			}
+			parts := make([]schemas.Part, len(file.Parts))
+			for i, part := range file.Parts {
+				part.ID = int64(newIds[i])
+				part.Replicas = nil
+				parts[i] = part
+			}
+			moved = append(moved, transferredFile{file: file, channelId: channelId, parts: parts, newIds: newIds})
+		}
+
+		if err := commit(moved); err != nil {
+			discard()
+			return err
+		}
+
+		for _, m := range moved {
+			stale := map[int64][]int{}
+			for _, part := range m.file.Parts {
+				stale[*m.file.ChannelID] = append(stale[*m.file.ChannelID], int(part.ID))
+				for _, replica := range part.Replicas {
+					stale[replica.ChannelID] = append(stale[replica.ChannelID], int(replica.ID))
+				}
+			}
+			for channel, ids := range stale {
+				if err := tgc.DeleteMessages(ctx, client.API(), channel, ids); err != nil {
+					logger.Warnw("failed to delete transferred messages", "fileId", m.file.Id, "channelId", channel, "err", err)
+				}
+				adjustChannelUsage(fs.db, userId, channel, -len(ids))
+			}
+			adjustChannelUsage(fs.db, targetId, channelId, len(m.newIds))
+		}
+		return nil
+	})
+}
+
+// adjustChannelUsage changes the message count least-full placement compares
+// by delta, without going below zero.
+func adjustChannelUsage(db *gorm.DB, userId, channelId int64, delta int) error {
+	return db.Model(&models.Channel{}).Where("channel_id = ?", channelId).Where("user_id = ?", userId).
+		Update("messages", gorm.Expr("GREATEST(messages + ?, 0)", delta)).Error
+}
+
+func transferError(err error) *types.AppError {
+	var (
+		limitErr  *LimitError
+		violation *policy.Violation
+	)
+	switch {
+	case errors.Is(err, ErrTransferUser):
+		return &types.AppError{Error: err, Code: http.StatusNotFound}
+	case errors.Is(err, ErrTransferForbidden), isEntryLimitErr(err):
+		return &types.AppError{Error: err, Code: http.StatusForbidden}
+	case errors.As(err, &limitErr):
+		return &types.AppError{Error: err, Code: http.StatusRequestEntityTooLarge}
+	case errors.As(err, &violation):
+		return &types.AppError{Error: err, Code: http.StatusUnsupportedMediaType}
+	case errors.Is(err, ErrTransferSelf), errors.Is(err, ErrTransferRoot):
+		return &types.AppError{Error: err, Code: http.StatusBadRequest}
+	case errors.Is(err, ErrTransferEncrypted), errors.Is(err, ErrTransferDestination),
+		errors.Is(err, ErrDefaultChannelNotSet):
+		return &types.AppError{Error: err, Code: http.StatusConflict}
+	}
+	return &types.AppError{Error: err}
+}
+
+func toFileTransferOut(transfer *models.FileTransfer) *schemas.FileTransferOut {
+	return &schemas.FileTransferOut{Id: transfer.Id, UserId: transfer.ToUserId, Destination: transfer.Destination,
+		Files: transfer.Files, Entries: transfer.Entries, Parts: transfer.Parts, Bytes: transfer.Bytes,
+		CreatedAt: transfer.CreatedAt}
+}
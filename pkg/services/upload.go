@@ -1,6 +1,7 @@
 package services
 
 import (
+	"bufio"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
@@ -8,18 +9,26 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/tgdrive/teldrive/internal/auth"
 	"github.com/tgdrive/teldrive/internal/cache"
+	"github.com/tgdrive/teldrive/internal/compress"
 	"github.com/tgdrive/teldrive/internal/crypt"
 	"github.com/tgdrive/teldrive/internal/kv"
 	"github.com/tgdrive/teldrive/internal/logging"
+	"github.com/tgdrive/teldrive/internal/policy"
 	"github.com/tgdrive/teldrive/internal/pool"
 	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/check"
 	"github.com/tgdrive/teldrive/pkg/mapper"
 	"github.com/tgdrive/teldrive/pkg/schemas"
 
@@ -30,64 +39,131 @@ import (
 	"github.com/gotd/td/telegram/message"
 	"github.com/gotd/td/telegram/uploader"
 	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
 	"github.com/tgdrive/teldrive/internal/config"
 	"github.com/tgdrive/teldrive/pkg/models"
 	"gorm.io/gorm"
 )
 
-const saltLength = 32
+const (
+	saltLength = 32
+
+	defaultMultipartPartSize        = 500 * 1024 * 1024
+	defaultPremiumMultipartPartSize = 1000 * 1024 * 1024
+)
 
 type UploadService struct {
-	db     *gorm.DB
-	worker *tgc.BotWorker
-	cnf    *config.TGConfig
-	kv     kv.KV
-	cache  cache.Cacher
+	db      *gorm.DB
+	worker  *tgc.BotWorker
+	cnf     *config.TGConfig
+	kv      kv.KV
+	cache   cache.Cacher
+	clients *tgc.Manager
+	fs      *FileService
+
+	ticketSecret string
+	tickets      ticketQuota
+	reservations ticketQuota
 }
 
-func NewUploadService(db *gorm.DB, cnf *config.Config, worker *tgc.BotWorker, kv kv.KV, cache cache.Cacher) *UploadService {
-	return &UploadService{db: db, worker: worker, cnf: &cnf.TG, kv: kv, cache: cache}
+func NewUploadService(db *gorm.DB, cnf *config.Config, worker *tgc.BotWorker, kv kv.KV, cache cache.Cacher,
+	clients *tgc.Manager, fs *FileService) *UploadService {
+	return &UploadService{db: db, worker: worker, cnf: &cnf.TG, kv: kv, cache: cache, clients: clients, fs: fs,
+		ticketSecret: auth.TicketSecret(cnf.JWT.Secret, cnf.TG.Uploads.TicketSalt)}
 }
 
 func (us *UploadService) GetUploadFileById(c *gin.Context) (*schemas.UploadOut, *types.AppError) {
 	uploadId := c.Param("id")
+	userId, _ := auth.GetUser(c)
 	parts := []schemas.UploadPartOut{}
 	if err := us.db.Model(&models.Upload{}).Order("part_no").Where("upload_id = ?", uploadId).
-		Where("created_at < ?", time.Now().UTC().Add(us.cnf.Uploads.Retention)).
+		Where("user_id = ?", userId).
+		Scopes(check.LiveUploads(us.cnf.Uploads.Retention, time.Now().UTC())).
 		Find(&parts).Error; err != nil {
 		return nil, &types.AppError{Error: err}
 	}
 
-	return &schemas.UploadOut{Parts: parts}, nil
+	out := &schemas.UploadOut{Parts: parts}
+	reserved, err := findUploadSession(us.db, userId, uploadId)
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	if reserved != nil {
+		_, uploaded, err := uploadedBytes(us.db, userId, uploadId)
+		if err != nil {
+			return nil, &types.AppError{Error: err}
+		}
+		out.Session = toUploadSessionOut(reserved, len(parts), uploaded)
+	}
+	return out, nil
 }
 
+// DeleteUploadFile aborts an upload, deleting the messages of the parts sent
+// so far. Parts whose messages could not be deleted are kept for the upload
+// cleanup to retry once they are past retention.
 func (us *UploadService) DeleteUploadFile(c *gin.Context) (*schemas.Message, *types.AppError) {
 	uploadId := c.Param("id")
-	if err := us.db.Where("upload_id = ?", uploadId).Delete(&models.Upload{}).Error; err != nil {
+	userId, session := auth.GetUser(c)
+
+	var parts []models.Upload
+	if err := us.db.Where("upload_id = ?", uploadId).Where("user_id = ?", userId).
+		Find(&parts).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	purge := true
+	if messages := uploadMessages(parts); len(messages) > 0 {
+		err := us.clients.Run(c, us.clients.UserSpec(session), func(ctx context.Context, client *telegram.Client) error {
+			deleted, err := tgc.DeleteChannelMessages(ctx, client.API(), messages, tgc.DeleteOptionsFor(us.cnf))
+			logging.FromContext(c).Debugw("deleted aborted upload parts", "uploadId", uploadId, "messages", deleted)
+			return err
+		})
+		if err != nil {
+			logging.FromContext(c).Warnw("failed to delete aborted upload parts", "uploadId", uploadId, "err", err)
+			purge = false
+		}
+	}
+
+	if purge {
+		if err := us.db.Where("upload_id = ?", uploadId).Where("user_id = ?", userId).
+			Delete(&models.Upload{}).Error; err != nil {
+			return nil, &types.AppError{Error: err}
+		}
+	}
+	if err := us.db.Where("upload_id = ? AND user_id = ?", uploadId, userId).
+		Delete(&models.UploadSession{}).Error; err != nil {
 		return nil, &types.AppError{Error: err}
 	}
+	finishUploadProgress(us.cache, userId, uploadId, ProgressAborted, "")
 	return &schemas.Message{Message: "upload deleted"}, nil
 }
 
+// GetUploadStats buckets uploads by day in the user's preferred timezone,
+// UTC unless set in their settings.
 func (us *UploadService) GetUploadStats(userId int64, days int) ([]schemas.UploadStats, *types.AppError) {
+	timezone := "UTC"
+	if tz := getUserSettings(us.db, us.cache, userId).Timezone; tz != nil {
+		timezone = *tz
+	}
 	var stats []schemas.UploadStats
 	err := us.db.Raw(`
+    WITH today AS (SELECT (now() AT TIME ZONE @tz)::date AS day)
     SELECT 
         dates.upload_date::date AS upload_date,
         COALESCE(SUM(files.size), 0)::bigint AS total_uploaded
     FROM 
-        generate_series(CURRENT_DATE - INTERVAL '1 day' * @days, CURRENT_DATE, '1 day') AS dates(upload_date)
+        today, generate_series(today.day - INTERVAL '1 day' * @days, today.day, '1 day') AS dates(upload_date)
     LEFT JOIN 
         teldrive.files AS files
     ON 
-        dates.upload_date = DATE_TRUNC('day', files.created_at)
+        dates.upload_date = DATE_TRUNC('day', files.created_at AT TIME ZONE 'UTC' AT TIME ZONE @tz)
     WHERE 
-	    dates.upload_date >= CURRENT_DATE - INTERVAL '1 day' * @days and (files.type='file' or files.type is null) and (files.user_id=@userId or files.user_id is null)
+	    dates.upload_date >= today.day - INTERVAL '1 day' * @days and (files.type='file' or files.type is null) and (files.user_id=@userId or files.user_id is null)
     GROUP BY 
         dates.upload_date
     ORDER BY 
         dates.upload_date
-  `, sql.Named("days", days-1), sql.Named("userId", userId)).Scan(&stats).Error
+  `, sql.Named("days", days-1), sql.Named("userId", userId), sql.Named("tz", timezone)).Scan(&stats).Error
 
 	if err != nil {
 		return nil, &types.AppError{Error: err}
@@ -102,173 +178,319 @@ func (us *UploadService) UploadFile(c *gin.Context) (*schemas.UploadPartOut, *ty
 		uploadQuery schemas.UploadQuery
 		channelId   int64
 		err         error
-		client      *telegram.Client
-		middlewares []telegram.Middleware
-		token       string
-		index       int
-		channelUser string
-		out         *schemas.UploadPartOut
 	)
 
 	if err := c.ShouldBindQuery(&uploadQuery); err != nil {
 		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
 	}
 
-	if uploadQuery.Encrypted && us.cnf.Uploads.EncryptionKey == "" {
-		return nil, &types.AppError{Error: errors.New("encryption key not found"),
-			Code: http.StatusBadRequest}
-	}
-
 	userId, session := auth.GetUser(c)
 
 	uploadId := c.Param("id")
 
+	if uploadQuery.AssignPartNo {
+		if uploadQuery.PartNo, err = reservePartNo(us.db, userId, uploadId); err != nil {
+			return nil, &types.AppError{Error: err}
+		}
+		c.Header(PartNoHeader, strconv.Itoa(uploadQuery.PartNo))
+	}
+
+	if c.Request.ContentLength < 0 {
+		// A chunked body has no length up front, the part is spooled to learn
+		// it before the limit checks and the upload that need it.
+		spool, size, err := spoolBody(c.Request.Body, us.cnf.Uploads.MaxPartSize)
+		if err != nil {
+			return nil, &types.AppError{Error: err}
+		}
+		defer spool.Close()
+		c.Request.Body = spool
+		c.Request.ContentLength = size
+	}
+
+	reserved, err := findUploadSession(us.db, userId, uploadId)
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	if reserved != nil {
+		release, err := us.admitSessionPart(reserved, &uploadQuery, c.Request.ContentLength)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	if ticket, ok := auth.GetUploadTicket(c); ok {
+		release, err := us.applyTicket(ticket, &uploadQuery, c.Request.ContentLength)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	if err := checkUploadLimits(us.cnf, c.Request.ContentLength, 0, uploadQuery.PartNo); err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusRequestEntityTooLarge}
+	}
+
 	fileStream := c.Request.Body
 
+	if us.cnf.Uploads.MaxPartSize > 0 {
+		fileStream = http.MaxBytesReader(c.Writer, fileStream, us.cnf.Uploads.MaxPartSize)
+	}
+
 	fileSize := c.Request.ContentLength
 
 	defer fileStream.Close()
 
-	if uploadQuery.ChannelID == 0 {
-		channelId, err = getDefaultChannel(us.db, us.cache, userId)
-		if err != nil {
-			return nil, &types.AppError{Error: err}
+	var sniffed string
+	if uploadQuery.PartNo == 1 {
+		buffered := bufio.NewReaderSize(fileStream, policy.SniffLength)
+		if head, _ := buffered.Peek(policy.SniffLength); len(head) > 0 {
+			sniffed = policy.Sniff(head)
 		}
-	} else {
-		channelId = uploadQuery.ChannelID
+		fileStream = io.NopCloser(buffered)
 	}
 
-	tokens, err := getBotsToken(us.db, us.cache, userId, channelId)
+	if err := checkFileType(us.db, us.cache, us.cnf, userId, uploadQuery.FileName, sniffed); err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusUnsupportedMediaType}
+	}
 
+	channelId, encrypted, client, encryptionRule, err := us.partSettings(userId, uploadId, reserved, &uploadQuery)
+	if err != nil {
+		return nil, uploadSettingsError(err)
+	}
+
+	if inlineEligible(us.cnf.Uploads.InlineThreshold, fileSize, uploadQuery.PartNo,
+		uploadQuery.TotalParts, uploadQuery.TotalSize) {
+		return us.uploadInline(c, userId, channelId, encrypted, encryptionRule, &uploadQuery, fileStream, fileSize, sniffed)
+	}
+
+	channels, err := uploadChannels(us.db, us.cache, userId, uploadId, reserved, channelId)
 	if err != nil {
 		return nil, &types.AppError{Error: err}
 	}
 
-	if len(tokens) == 0 {
-		client, err = tgc.AuthClient(c, us.cnf, session)
-		if err != nil {
+	var spool *spoolFile
+	if len(channels) > 1 {
+		// A part that fails over is sent again, so it is kept until it is
+		// stored somewhere.
+		if spool, fileSize, err = spoolPart(fileStream, fileSize); err != nil {
 			return nil, &types.AppError{Error: err}
 		}
-		channelUser = strconv.FormatInt(userId, 10)
-	} else {
-		us.worker.Set(tokens, channelId)
-		token, index = us.worker.Next(channelId)
-		client, err = tgc.BotClient(c, us.kv, us.cnf, token)
+		defer spool.Close()
+	}
 
-		if err != nil {
-			return nil, &types.AppError{Error: err}
+	var (
+		out    *schemas.UploadPartOut
+		appErr *types.AppError
+	)
+	for i, target := range channels {
+		if spool != nil {
+			if _, err := spool.Seek(0, io.SeekStart); err != nil {
+				return nil, &types.AppError{Error: err}
+			}
+			fileStream = io.NopCloser(spool)
+		}
+		out, appErr = us.sendUploadPart(c, userId, session, uploadId, target, &uploadQuery, fileStream, fileSize,
+			sniffed, encrypted, client, encryptionRule)
+		if appErr == nil || i == len(channels)-1 || !channelFailover(appErr.Error) {
+			break
 		}
+		logging.FromContext(c).Warnw("failing over to next channel", "uploadId", uploadId,
+			"chunkNo", uploadQuery.PartNo, "channelId", target, "next", channels[i+1], "err", appErr.Error)
+	}
+	if appErr != nil {
+		return nil, appErr
+	}
+	out.FailedOver = out.ChannelID != channels[0]
+	return out, nil
+}
 
-		channelUser = strings.Split(token, ":")[0]
+// sendUploadPart sends a part to channelId, mirrors it to the replica
+// channels and stores it with the upload.
+func (us *UploadService) sendUploadPart(c *gin.Context, userId int64, session, uploadId string, channelId int64,
+	uploadQuery *schemas.UploadQuery, fileStream io.ReadCloser, fileSize int64, sniffed string,
+	encrypted, client bool, encryptionRule string) (*schemas.UploadPartOut, *types.AppError) {
+	var (
+		spec        tgc.ClientSpec
+		middlewares []telegram.Middleware
+		token       string
+		index       int
+		channelUser string
+		out         *schemas.UploadPartOut
+	)
+
+	replicaChannels, err := resolveReplicaChannels(us.db, us.cache, userId, uploadQuery.ParentID, uploadQuery.Path,
+		uploadQuery.ReplicaChannels, channelId)
+	if err != nil {
+		return nil, uploadSettingsError(err)
+	}
+
+	var capture *textCapture
+	if uploadQuery.PartNo == 1 && uploadQuery.TotalParts <= 1 &&
+		indexable(us.cnf, uploadQuery.FileName, "", sniffed, max(fileSize, uploadQuery.TotalSize), encrypted || client) {
+		capture = &textCapture{max: us.cnf.Uploads.Index.MaxSize}
+		fileStream = io.NopCloser(io.TeeReader(fileStream, capture))
+	}
+
+	spec, token, index, channelUser, err = us.getUploadClient(userId, session, channelId)
+
+	if err != nil {
+		return nil, &types.AppError{Error: err}
 	}
 
-	middlewares = tgc.Middlewares(us.cnf, us.cnf.Uploads.MaxRetries)
+	premium := token == "" && isPremium(us.db, us.cache, userId)
+	if err := checkTelegramPartSize(us.cnf, fileSize, encrypted, premium); err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusRequestEntityTooLarge}
+	}
 
-	uploadPool := pool.NewPool(client, int64(us.cnf.PoolSize), middlewares...)
+	var (
+		keyVersion int
+		key        string
+	)
+	if encrypted {
+		if keyVersion, key, err = uploadKey(us.db, us.cnf, userId); err != nil {
+			return nil, &types.AppError{Error: err}
+		}
+	}
 
-	defer uploadPool.Close()
+	middlewares = us.clients.Middlewares(spec, tgc.OpUpload,
+		getRateLimit(us.db, us.cache, us.cnf, userId, token),
+		getCaller(us.db, us.cache, us.cnf, userId))
 
-	logger := logging.FromContext(c)
+	logger := logging.FromContext(c).With("uploadId", uploadId)
 
 	logger.Debugw("uploading chunk", "fileName", uploadQuery.FileName,
 		"partName", uploadQuery.PartName,
 		"bot", channelUser, "botNo", index,
 		"chunkNo", uploadQuery.PartNo, "partSize", fileSize)
 
-	err = tgc.RunWithAuth(c, client, token, func(ctx context.Context) error {
+	err = us.clients.Run(c, spec, func(ctx context.Context, tc *telegram.Client) error {
+
+		uploadPool := pool.NewPool(tc, int64(us.cnf.PoolSize), middlewares...)
 
-		channel, err := tgc.GetChannelById(ctx, client.API(), channelId)
+		defer uploadPool.Close()
+
+		channel, err := us.inputChannel(ctx, tc, userId, channelUser, channelId)
 
 		if err != nil {
 			return err
 		}
 
-		var salt string
+		var (
+			salt         string
+			originalSize int64
+			compression  = uploadQuery.Compression
+		)
+
+		if compression != "" {
+			buffered := bufio.NewReaderSize(fileStream, compress.SampleSize)
+			sample, _ := buffered.Peek(compress.SampleSize)
+			if compress.IsCompressible(sample) {
+				spool, read, written, err := compressPart(compression, buffered)
+				if err != nil {
+					return err
+				}
+				defer spool.Close()
+				fileStream = spool
+				originalSize = read
+				fileSize = written
+			} else {
+				compression = ""
+				fileStream = io.NopCloser(buffered)
+			}
+		}
 
-		if uploadQuery.Encrypted {
-			//gen random Salt
-			salt, _ = generateRandomSalt()
-			cipher, _ := crypt.NewCipher(us.cnf.Uploads.EncryptionKey, salt)
+		if encrypted {
+			if fileStream, salt, err = encryptPart(key, fileStream); err != nil {
+				return err
+			}
 			fileSize = crypt.EncryptedSize(fileSize)
-			fileStream, _ = cipher.EncryptData(fileStream)
 		}
 
 		client := uploadPool.Default(ctx)
 
-		u := uploader.NewUploader(client).WithThreads(us.cnf.Uploads.Threads).WithPartSize(512 * 1024)
-
-		upload, err := u.Upload(ctx, uploader.NewUpload(uploadQuery.PartName, fileStream, fileSize))
+		message, channel, err := us.sendPart(ctx, client, channel,
+			us.refreshChannel(tc, userId, channelUser, channelId), uploadQuery.PartName, fileStream, fileSize)
 
 		if err != nil {
 			return err
 		}
 
-		document := message.UploadedDocument(upload).Filename(uploadQuery.PartName).ForceFile(true)
-
-		sender := message.NewSender(client)
-
-		target := sender.To(&tg.InputPeerChannel{ChannelID: channel.ChannelID,
-			AccessHash: channel.AccessHash})
-
-		res, err := target.Media(ctx, document)
+		replicas, err := us.mirrorPart(ctx, tc, client, userId, channelUser, message, replicaChannels)
 
 		if err != nil {
+			deleteMessages(ctx, client, channel, []int{message.ID})
 			return err
 		}
 
-		updates := res.(*tg.Updates)
-
-		var message *tg.Message
-
-		for _, update := range updates.Updates {
-			channelMsg, ok := update.(*tg.UpdateNewChannelMessage)
-			if ok {
-				message = channelMsg.Message.(*tg.Message)
-				break
-			}
+		partUpload := &models.Upload{
+			Name:         uploadQuery.PartName,
+			UploadId:     uploadId,
+			PartId:       message.ID,
+			ChannelID:    channelId,
+			Size:         fileSize,
+			PartNo:       uploadQuery.PartNo,
+			UserId:       userId,
+			Encrypted:    encrypted,
+			Salt:         salt,
+			Compression:  compression,
+			OriginalSize: originalSize,
+			Content:      capture.Text(),
+			Replicas:     replicas,
+			KeyVersion:   keyVersion,
 		}
-
-		if message.ID == 0 {
-			return fmt.Errorf("upload failed")
+		if sniffed != "" {
+			partUpload.MimeType = &sniffed
 		}
 
-		partUpload := &models.Upload{
-			Name:      uploadQuery.PartName,
-			UploadId:  uploadId,
-			PartId:    message.ID,
-			ChannelID: channelId,
-			Size:      fileSize,
-			PartNo:    uploadQuery.PartNo,
-			UserId:    userId,
-			Encrypted: uploadQuery.Encrypted,
-			Salt:      salt,
-		}
-
-		if err := us.db.Create(partUpload).Error; err != nil {
-			if message.ID != 0 {
-				client.ChannelsDeleteMessages(ctx, &tg.ChannelsDeleteMessagesRequest{Channel: channel, ID: []int{message.ID}})
-			}
+		replaced, err := commitSentPart(us.db, partUpload,
+			func() ([]tg.MessageClass, error) {
+				res, err := client.ChannelsGetMessages(ctx, &tg.ChannelsGetMessagesRequest{Channel: channel,
+					ID: []tg.InputMessageClass{&tg.InputMessageID{ID: message.ID}}})
+				if err != nil {
+					return nil, err
+				}
+				messages, ok := res.(*tg.MessagesChannelMessages)
+				if !ok {
+					return nil, tgc.ErrInvalidChannelMessages
+				}
+				return messages.Messages, nil
+			},
+			func() {
+				deleteMessages(ctx, client, channel, []int{message.ID})
+				deleteReplicas(ctx, client, []schemas.Part{{Replicas: replicas}})
+			})
+		if err != nil {
 			return err
 		}
 
-		//verify if the part is uploaded
-		msgs, _ := client.ChannelsGetMessages(ctx,
-			&tg.ChannelsGetMessagesRequest{Channel: channel, ID: []tg.InputMessageClass{&tg.InputMessageID{ID: message.ID}}})
+		if err := recordChannelUsage(us.db, userId, channelId, replicas); err != nil {
+			logger.Warnw("failed to record channel usage", "channelId", channelId, "err", err)
+		}
 
-		if msgs != nil && len(msgs.(*tg.MessagesChannelMessages).Messages) == 0 {
-			return errors.New("upload failed")
+		if err := deleteReplacedParts(ctx, client, replaced); err != nil {
+			logger.Warnw("failed to delete replaced part", "chunkNo", uploadQuery.PartNo, "err", err)
 		}
 
 		out = mapper.ToUploadOut(partUpload)
+		out.EncryptionRule = encryptionRule
+
+		us.publishPartProgress(userId, partUpload, uploadQuery)
 
 		return nil
 	})
 
 	if err != nil {
+		invalidateInputChannel(us.cache, userId, channelUser, channelId, err)
 		logger.Debugw("upload failed", "fileName", uploadQuery.FileName,
 			"partName", uploadQuery.PartName,
 			"chunkNo", uploadQuery.PartNo)
-		return nil, &types.AppError{Error: err}
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, &types.AppError{Error: checkUploadLimits(us.cnf, maxBytesErr.Limit+1, 0, 0),
+				Code: http.StatusRequestEntityTooLarge}
+		}
+		return nil, telegramError(err)
 	}
 	logger.Debugw("upload finished", "fileName", uploadQuery.FileName,
 		"partName", uploadQuery.PartName,
@@ -277,6 +499,653 @@ func (us *UploadService) UploadFile(c *gin.Context) (*schemas.UploadPartOut, *ty
 
 }
 
+// placement returns the channel picker of the user's placement strategy for
+// an upload, nil when uploads go to the default channel.
+func (us *UploadService) placement(userId int64, uploadId string) func() (int64, error) {
+	strategy := uploadStrategy(us.db, us.cache, us.cnf, userId)
+	if strategy == PlacementDefault {
+		return nil
+	}
+	return func() (int64, error) {
+		return placeUpload(us.db, us.cache, userId, uploadId, strategy)
+	}
+}
+
+// partSettings resolves the channel and encryption of a part, as settled by
+// the upload's session when it has one.
+func (us *UploadService) partSettings(userId int64, uploadId string, reserved *models.UploadSession,
+	query *schemas.UploadQuery) (channelId int64, encrypted, client bool, encryptionRule string, err error) {
+	if reserved != nil {
+		return reserved.ChannelID, reserved.Encryption == EncryptionServer,
+			reserved.Encryption == EncryptionClient, "", nil
+	}
+
+	requested, client, err := encryptionMode(query.Encryption, query.Encrypted)
+	if err != nil {
+		return 0, false, false, "", err
+	}
+
+	channelId, encrypted, err = resolveUploadSettings(us.db, us.cache, userId, query.ParentID,
+		query.Path, query.ChannelID, requested, us.placement(userId, uploadId))
+	if err != nil {
+		return 0, false, false, "", err
+	}
+
+	// Client encrypted parts are stored as they are sent, the encryption
+	// rules have nothing left to decide.
+	if !client {
+		encrypted, encryptionRule, err = applyEncryptionPolicy(us.db, us.cnf, query.FileName, "",
+			query.ParentID, query.Path, encrypted, requested != nil)
+		if err != nil {
+			return 0, false, false, "", err
+		}
+	}
+	return channelId, encrypted, client, encryptionRule, nil
+}
+
+// uploadInline stores a file small enough for the database as the only part
+// of its upload, skipping Telegram entirely.
+func (us *UploadService) uploadInline(c *gin.Context, userId, channelId int64, encrypted bool, encryptionRule string,
+	uploadQuery *schemas.UploadQuery, fileStream io.Reader, fileSize int64, sniffed string) (*schemas.UploadPartOut, *types.AppError) {
+	data, err := io.ReadAll(io.LimitReader(fileStream, fileSize+1))
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	if int64(len(data)) != fileSize {
+		return nil, &types.AppError{Error: errors.New("request body does not match content length"), Code: http.StatusBadRequest}
+	}
+
+	var (
+		keyVersion int
+		key        string
+	)
+	if encrypted {
+		if keyVersion, key, err = uploadKey(us.db, us.cnf, userId); err != nil {
+			return nil, &types.AppError{Error: err}
+		}
+	}
+
+	sealed, err := sealInline(key, data, encrypted)
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	partUpload := &models.Upload{
+		Name:       uploadQuery.PartName,
+		UploadId:   c.Param("id"),
+		ChannelID:  channelId,
+		Size:       fileSize,
+		PartNo:     uploadQuery.PartNo,
+		UserId:     userId,
+		Encrypted:  encrypted,
+		InlineData: sealed,
+		KeyVersion: keyVersion,
+	}
+	if indexable(us.cnf, uploadQuery.FileName, "", sniffed, fileSize, encrypted) {
+		partUpload.Content = indexText(data)
+	}
+	if sniffed != "" {
+		partUpload.MimeType = &sniffed
+	}
+
+	replaced, err := insertUploadPart(us.db, partUpload)
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	// A retried part only moves inline when its size changed, the part it
+	// replaces may still have a message.
+	if len(replacedMessages(replaced)) > 0 {
+		_, session := auth.GetUser(c)
+		err := us.clients.Run(c, us.clients.UserSpec(session), func(ctx context.Context, tc *telegram.Client) error {
+			return deleteReplacedParts(ctx, tc.API(), replaced)
+		})
+		if err != nil {
+			logging.FromContext(c).Warnw("failed to delete replaced part", "uploadId", partUpload.UploadId,
+				"chunkNo", partUpload.PartNo, "err", err)
+		}
+	}
+
+	out := mapper.ToUploadOut(partUpload)
+	out.EncryptionRule = encryptionRule
+
+	us.publishPartProgress(userId, partUpload, uploadQuery)
+
+	return out, nil
+}
+
+// UploadMultipart accepts a whole file as multipart/form-data, splits it into
+// parts on the fly and creates the file once every part is stored.
+func (us *UploadService) UploadMultipart(c *gin.Context) (*schemas.FileOut, *types.AppError) {
+	var uploadQuery schemas.MultipartUploadQuery
+
+	if err := c.ShouldBindQuery(&uploadQuery); err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+
+	if err := checkUploadLimits(us.cnf, uploadQuery.PartSize, c.Request.ContentLength, 0); err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusRequestEntityTooLarge}
+	}
+
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+
+	var filePart *multipart.Part
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+		}
+		if part.FileName() != "" {
+			filePart = part
+			break
+		}
+		part.Close()
+	}
+
+	if filePart == nil {
+		return nil, &types.AppError{Error: errors.New("no file in request"), Code: http.StatusBadRequest}
+	}
+	defer filePart.Close()
+
+	fileName := uploadQuery.Name
+	if fileName == "" {
+		fileName = filepath.Base(filePart.FileName())
+	}
+
+	userId, session := auth.GetUser(c)
+
+	return us.uploadStream(c, userId, session, &uploadQuery, fileName, filePart.Header.Get("Content-Type"), filePart)
+}
+
+// uploadStream splits r into parts on the fly, stores them and creates the
+// file fileName in the query's path. contentType is the type the client
+// declared for the content, if any.
+func (us *UploadService) uploadStream(c *gin.Context, userId int64, session string,
+	uploadQuery *schemas.MultipartUploadQuery, fileName, contentType string, r io.Reader) (*schemas.FileOut, *types.AppError) {
+	threshold := us.cnf.Uploads.InlineThreshold
+	body := bufio.NewReaderSize(r, max(policy.SniffLength, int(threshold)+1))
+	var sniffed string
+	if head, _ := body.Peek(policy.SniffLength); len(head) > 0 {
+		sniffed = policy.Sniff(head)
+	}
+
+	mimeType := detectMimeType(us.cnf, contentType, fileName, sniffed)
+
+	if err := checkFileType(us.db, us.cache, us.cnf, userId, fileName, mimeType, sniffed); err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusUnsupportedMediaType}
+	}
+
+	requested, client, err := encryptionMode(uploadQuery.Encryption, uploadQuery.Encrypted)
+	if err != nil {
+		return nil, uploadSettingsError(err)
+	}
+
+	channelId, encrypted, err := resolveUploadSettings(us.db, us.cache, userId, "",
+		uploadQuery.Path, uploadQuery.ChannelID, requested, nil)
+	if err != nil {
+		return nil, uploadSettingsError(err)
+	}
+
+	if !client {
+		encrypted, _, err = applyEncryptionPolicy(us.db, us.cnf, fileName, mimeType, "", uploadQuery.Path,
+			encrypted, requested != nil)
+		if err != nil {
+			return nil, uploadSettingsError(err)
+		}
+	}
+
+	if threshold > 0 {
+		// A body that ends within the threshold is stored in the database.
+		if head, _ := body.Peek(int(threshold) + 1); len(head) > 0 && int64(len(head)) <= threshold {
+			return us.fs.CreateFile(c, userId, &schemas.FileIn{
+				Name:       fileName,
+				Type:       "file",
+				MimeType:   mimeType,
+				ChannelID:  channelId,
+				Path:       uploadQuery.Path,
+				Encrypted:  &encrypted,
+				Encryption: encryptionOf(encrypted, client),
+				Conflict:   uploadQuery.Conflict,
+				Data:       head,
+			})
+		}
+	}
+
+	spec, token, _, channelUser, err := us.getUploadClient(userId, session, channelId)
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	premium := token == "" && isPremium(us.db, us.cache, userId)
+	partSize := multipartPartSize(us.cnf, uploadQuery.PartSize, premium)
+	if err := checkTelegramPartSize(us.cnf, partSize, encrypted, premium); err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusRequestEntityTooLarge}
+	}
+
+	var (
+		keyVersion int
+		key        string
+	)
+	if encrypted {
+		if keyVersion, key, err = uploadKey(us.db, us.cnf, userId); err != nil {
+			return nil, &types.AppError{Error: err}
+		}
+	}
+
+	middlewares := us.clients.Middlewares(spec, tgc.OpUpload,
+		getRateLimit(us.db, us.cache, us.cnf, userId, token),
+		getCaller(us.db, us.cache, us.cnf, userId))
+
+	logger := logging.FromContext(c).With("fileName", fileName)
+
+	var (
+		parts     []schemas.Part
+		totalSize int64
+	)
+
+	replicaChannels, err := resolveReplicaChannels(us.db, us.cache, userId, "", uploadQuery.Path, uploadQuery.ReplicaChannels, channelId)
+	if err != nil {
+		return nil, uploadSettingsError(err)
+	}
+
+	var (
+		src     io.Reader = body
+		capture *textCapture
+	)
+	if indexable(us.cnf, fileName, mimeType, sniffed, -1, encrypted || client) {
+		capture = &textCapture{max: us.cnf.Uploads.Index.MaxSize}
+		src = io.TeeReader(body, capture)
+	}
+
+	err = us.clients.Run(c, spec, func(ctx context.Context, tc *telegram.Client) error {
+
+		uploadPool := pool.NewPool(tc, int64(us.cnf.PoolSize), middlewares...)
+
+		defer uploadPool.Close()
+
+		channel, err := us.inputChannel(ctx, tc, userId, channelUser, channelId)
+
+		if err != nil {
+			return err
+		}
+
+		client := uploadPool.Default(ctx)
+
+		uploaded := []int{}
+		cleanup := func(ctx context.Context, client *tg.Client, channel *tg.InputChannel, ids []int) {
+			if err := deleteMessages(ctx, client, channel, ids); err != nil {
+				logger.Warnw("failed to delete uploaded parts", "err", err)
+			}
+			if err := deleteReplicas(ctx, client, parts); err != nil {
+				logger.Warnw("failed to delete part replicas", "err", err)
+			}
+		}
+
+		for partNo := 1; ; partNo++ {
+			spool, size, err := spoolPart(src, partSize)
+			if err != nil {
+				cleanup(ctx, client, channel, uploaded)
+				return err
+			}
+			if size == 0 {
+				spool.Close()
+				break
+			}
+
+			if err := checkUploadLimits(us.cnf, 0, totalSize+size, partNo); err != nil {
+				spool.Close()
+				cleanup(ctx, client, channel, uploaded)
+				return err
+			}
+
+			var (
+				stream io.Reader = spool
+				salt   string
+			)
+			storedSize := size
+
+			if encrypted {
+				if stream, salt, err = encryptPart(key, spool); err != nil {
+					spool.Close()
+					cleanup(ctx, client, channel, uploaded)
+					return err
+				}
+				storedSize = crypt.EncryptedSize(size)
+			}
+
+			partName := fileName
+			if size == partSize || partNo > 1 {
+				partName = fmt.Sprintf("%s.part.%03d", fileName, partNo)
+			}
+
+			logger.Debugw("uploading chunk", "partName", partName, "chunkNo", partNo, "partSize", storedSize)
+
+			var msg *tg.Message
+			msg, channel, err = us.sendPart(ctx, client, channel,
+				us.refreshChannel(tc, userId, channelUser, channelId), partName, stream, storedSize)
+			spool.Close()
+			if err != nil {
+				cleanup(ctx, client, channel, uploaded)
+				return err
+			}
+
+			uploaded = append(uploaded, msg.ID)
+
+			replicas, err := us.mirrorPart(ctx, tc, client, userId, channelUser, msg, replicaChannels)
+			if err != nil {
+				cleanup(ctx, client, channel, uploaded)
+				return err
+			}
+			parts = append(parts, schemas.Part{ID: int64(msg.ID), Salt: salt, Replicas: replicas, KeyVersion: keyVersion})
+			totalSize += size
+
+			if size < partSize {
+				break
+			}
+		}
+
+		if len(parts) == 0 {
+			return errors.New("empty file")
+		}
+		return nil
+	})
+
+	if err != nil {
+		invalidateInputChannel(us.cache, userId, channelUser, channelId, err)
+		logger.Debugw("upload failed", "err", err)
+		var limitErr *LimitError
+		if errors.As(err, &limitErr) {
+			return nil, &types.AppError{Error: err, Code: http.StatusRequestEntityTooLarge}
+		}
+		return nil, telegramError(err)
+	}
+
+	fileIn := &schemas.FileIn{
+		Name:       fileName,
+		Type:       "file",
+		Parts:      parts,
+		MimeType:   mimeType,
+		ChannelID:  channelId,
+		Path:       uploadQuery.Path,
+		Size:       totalSize,
+		Encrypted:  &encrypted,
+		Encryption: encryptionOf(encrypted, client),
+		Conflict:   uploadQuery.Conflict,
+		Content:    capture.Text(),
+	}
+
+	res, appErr := us.fs.CreateFile(c, userId, fileIn)
+	if appErr != nil {
+		ids := make([]int, 0, len(parts))
+		for _, part := range parts {
+			ids = append(ids, int(part.ID))
+		}
+		us.clients.Run(c, spec, func(ctx context.Context, client *telegram.Client) error {
+			channel, err := us.inputChannel(ctx, client, userId, channelUser, channelId)
+			if err != nil {
+				return err
+			}
+			if err := deleteMessages(ctx, client.API(), channel, ids); err != nil {
+				logger.Warnw("failed to delete uploaded parts", "err", err)
+			}
+			return deleteReplicas(ctx, client.API(), parts)
+		})
+		return nil, appErr
+	}
+
+	logger.Debugw("upload finished", "parts", len(parts), "size", totalSize)
+
+	return res, nil
+}
+
+// multipartPartSize is the size a multipart upload is split into, larger for
+// premium accounts so a file takes fewer messages.
+func multipartPartSize(cnf *config.TGConfig, requested int64, premium bool) int64 {
+	if requested > 0 {
+		return requested
+	}
+	partSize := int64(defaultMultipartPartSize)
+	if premium {
+		partSize = defaultPremiumMultipartPartSize
+	}
+	if cnf.Uploads.MaxPartSize > 0 {
+		partSize = min(partSize, cnf.Uploads.MaxPartSize)
+	}
+	return partSize
+}
+
+func (us *UploadService) GetLimits() *schemas.UploadLimits {
+	limits := uploadLimits(us.cnf)
+	return &limits
+}
+
+// getUploadClient picks a bot client for the channel when bots are configured
+// and falls back to the user's own session otherwise.
+func (us *UploadService) getUploadClient(userId int64, session string, channelId int64) (spec tgc.ClientSpec, token string, index int, channelUser string, err error) {
+	tokens, err := getRoleBots(us.db, us.cache, userId, channelId, BotRoleUpload)
+
+	if err != nil {
+		return spec, "", 0, "", err
+	}
+
+	if len(tokens) == 0 {
+		spec = us.clients.UserSpec(session)
+		channelUser = strconv.FormatInt(userId, 10)
+	} else {
+		key := tgc.BotPoolKey(channelId, BotRoleUpload)
+		us.worker.Set(tokens, key)
+		token, index = us.worker.Next(key)
+		spec = us.clients.BotSpec(userId, token)
+		channelUser = strings.Split(token, ":")[0]
+	}
+	return spec, token, index, channelUser, nil
+}
+
+// telegramError reports a failed Telegram call. Flood waits the waiter gave
+// up on are rate limits the client has to back off from.
+func telegramError(err error) *types.AppError {
+	if _, ok := tgerr.AsFloodWait(err); ok {
+		return &types.AppError{Error: err, Code: http.StatusTooManyRequests}
+	}
+	return &types.AppError{Error: err}
+}
+
+func uploadSettingsError(err error) *types.AppError {
+	if errors.Is(err, ErrDefaultChannelNotSet) || errors.Is(err, ErrEncryptionKeyMissing) ||
+		errors.Is(err, ErrTooManyReplicas) || errors.Is(err, ErrEncryptionMode) || errors.Is(err, ErrEncryptionRule) {
+		return &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+	if errors.Is(err, ErrChannelForbidden) {
+		return &types.AppError{Error: err, Code: http.StatusForbidden}
+	}
+	return &types.AppError{Error: err}
+}
+
+// inputChannel resolves the upload channel through the per-account cache.
+func (us *UploadService) inputChannel(ctx context.Context, client *telegram.Client, userId int64, account string, channelId int64) (*tg.InputChannel, error) {
+	return getInputChannel(ctx, us.cache, userId, account, channelId, func(ctx context.Context) (*tg.InputChannel, error) {
+		return tgc.GetChannelById(ctx, client.API(), channelId)
+	})
+}
+
+// refreshChannel resolves the upload channel again, bypassing the cached
+// access hash.
+func (us *UploadService) refreshChannel(client *telegram.Client, userId int64, account string,
+	channelId int64) func(ctx context.Context) (*tg.InputChannel, error) {
+	return func(ctx context.Context) (*tg.InputChannel, error) {
+		us.cache.Delete(inputChannelKey(userId, account, channelId))
+		return us.inputChannel(ctx, client, userId, account, channelId)
+	}
+}
+
+// sendPart uploads stream as a document to channel and returns the posted
+// message with the channel it was posted to. When Telegram refuses a stale
+// access hash the channel is refreshed and the post retried once, reusing
+// the content already uploaded.
+func (us *UploadService) sendPart(ctx context.Context, client *tg.Client, channel *tg.InputChannel,
+	refresh func(ctx context.Context) (*tg.InputChannel, error), name string, stream io.Reader,
+	size int64) (*tg.Message, *tg.InputChannel, error) {
+
+	u := uploader.NewUploader(client).WithThreads(us.cnf.Uploads.Threads).WithPartSize(512 * 1024)
+
+	upload, err := u.Upload(ctx, uploader.NewUpload(name, stream, size))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	document := message.UploadedDocument(upload).Filename(name).ForceFile(true)
+
+	sender := message.NewSender(client)
+
+	target := sender.To(&tg.InputPeerChannel{ChannelID: channel.ChannelID,
+		AccessHash: channel.AccessHash})
+
+	res, err := target.Media(ctx, document)
+
+	if tgc.InvalidChannel(err) && refresh != nil {
+		if channel, err = refresh(ctx); err == nil {
+			res, err = sender.To(&tg.InputPeerChannel{ChannelID: channel.ChannelID,
+				AccessHash: channel.AccessHash}).Media(ctx, document)
+		}
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	updates := res.(*tg.Updates)
+
+	var msg *tg.Message
+
+	for _, update := range updates.Updates {
+		channelMsg, ok := update.(*tg.UpdateNewChannelMessage)
+		if ok {
+			msg = channelMsg.Message.(*tg.Message)
+			break
+		}
+	}
+
+	if msg == nil || msg.ID == 0 {
+		return nil, nil, fmt.Errorf("upload failed")
+	}
+	return msg, channel, nil
+}
+
+type spoolFile struct {
+	*os.File
+}
+
+func (f *spoolFile) Close() error {
+	f.File.Close()
+	return os.Remove(f.Name())
+}
+
+// spoolPart copies at most n bytes of src into a temporary file so that each
+// part can be sent with a known size without holding it in memory.
+func spoolPart(src io.Reader, n int64) (*spoolFile, int64, error) {
+	tmp, err := os.CreateTemp("", "teldrive-part-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	spool := &spoolFile{File: tmp}
+
+	size, err := io.CopyN(spool, src, n)
+	if err != nil && err != io.EOF {
+		spool.Close()
+		return nil, 0, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		spool.Close()
+		return nil, 0, err
+	}
+	return spool, size, nil
+}
+
+// spoolBody copies a body of unknown length into a temporary file to learn
+// its size. With a limit, reading stops one byte past it so an oversized body
+// is rejected by the limit checks without being stored whole.
+func spoolBody(body io.Reader, limit int64) (*spoolFile, int64, error) {
+	n := int64(math.MaxInt64)
+	if limit > 0 {
+		n = limit + 1
+	}
+	return spoolPart(body, n)
+}
+
+// deleteMessages drops messages of a failed upload in batches no larger than
+// Telegram accepts. Every batch is attempted; the first error is returned.
+func deleteMessages(ctx context.Context, client *tg.Client, channel *tg.InputChannel, ids []int) error {
+	var firstErr error
+	for start := 0; start < len(ids); start += tgc.MaxDeleteBatch {
+		batch := ids[start:min(start+tgc.MaxDeleteBatch, len(ids))]
+		_, err := client.ChannelsDeleteMessages(ctx, &tg.ChannelsDeleteMessagesRequest{Channel: channel, ID: batch})
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// encryptPart wraps src in a cipher keyed with key and a fresh salt, which is
+// returned for the part record.
+func encryptPart(key string, src io.Reader) (io.ReadCloser, string, error) {
+	salt, err := generateRandomSalt()
+	if err != nil {
+		return nil, "", err
+	}
+	cipher, err := crypt.NewCipher(key, salt)
+	if err != nil {
+		return nil, "", err
+	}
+	stream, err := cipher.EncryptData(src)
+	if err != nil {
+		return nil, "", err
+	}
+	return stream, salt, nil
+}
+
+// compressPart compresses src into a temporary file so the compressed size is
+// known before the part is handed to the uploader.
+func compressPart(codec string, src io.Reader) (*spoolFile, int64, int64, error) {
+	tmp, err := os.CreateTemp("", "teldrive-part-*")
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	spool := &spoolFile{File: tmp}
+
+	w, err := compress.NewWriter(codec, spool)
+	if err != nil {
+		spool.Close()
+		return nil, 0, 0, err
+	}
+	read, err := io.Copy(w, src)
+	if err != nil {
+		spool.Close()
+		return nil, 0, 0, err
+	}
+	if err := w.Close(); err != nil {
+		spool.Close()
+		return nil, 0, 0, err
+	}
+	written, err := spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		spool.Close()
+		return nil, 0, 0, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		spool.Close()
+		return nil, 0, 0, err
+	}
+	return spool, read, written, nil
+}
+
 func generateRandomSalt() (string, error) {
 	randomBytes := make([]byte, saltLength)
 	_, err := rand.Read(randomBytes)
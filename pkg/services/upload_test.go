@@ -1,12 +1,26 @@
 package services
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/tgdrive/teldrive/internal/config"
 	"github.com/tgdrive/teldrive/internal/database"
 
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"github.com/tgdrive/teldrive/pkg/check"
 	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
 	"gorm.io/gorm"
 )
 
@@ -18,13 +32,219 @@ type UploadServiceSuite struct {
 
 func (s *UploadServiceSuite) SetupSuite() {
 	s.db = database.NewTestDatabase(s.T(), false)
-	s.srv = NewUploadService(s.db, nil, nil, nil, nil)
+	s.srv = NewUploadService(s.db, &config.Config{}, nil, nil, nil, nil, nil)
 }
 
 func (s *UploadServiceSuite) SetupTest() {
-	s.srv.db.Where("id is not NULL").Delete(&models.Upload{})
+	s.srv.db.Where("upload_id is not NULL").Delete(&models.Upload{})
 }
 
 func TestUploadSuite(t *testing.T) {
 	suite.Run(t, new(UploadServiceSuite))
 }
+
+func (s *UploadServiceSuite) TestRetriedPartReplaces() {
+	first := &models.Upload{UploadId: "up", UserId: 1, Name: "a.part.001", PartNo: 1, PartId: 10, ChannelID: 1, Size: 5}
+	replaced, err := insertUploadPart(s.db, first)
+	s.NoError(err)
+	s.Empty(replaced)
+
+	retried := &models.Upload{UploadId: "up", UserId: 1, Name: "a.part.001", PartNo: 1, PartId: 11, ChannelID: 1, Size: 5}
+	replaced, err = insertUploadPart(s.db, retried)
+	s.NoError(err)
+	s.Len(replaced, 1)
+	s.Equal(10, replaced[0].PartId)
+	s.Equal(map[int64][]int{1: {10}}, replacedMessages(replaced))
+
+	var parts []models.Upload
+	s.NoError(s.db.Where("upload_id = ?", "up").Find(&parts).Error)
+	s.Len(parts, 1)
+	s.Equal(11, parts[0].PartId)
+}
+
+func (s *UploadServiceSuite) TestReservePartNo() {
+	// Numbers follow the order requests arrive in, whichever part is stored
+	// first.
+	first, err := reservePartNo(s.db, 1, "numbered")
+	s.NoError(err)
+	second, err := reservePartNo(s.db, 1, "numbered")
+	s.NoError(err)
+	s.Equal(1, first)
+	s.Equal(2, second)
+
+	_, err = insertUploadPart(s.db, &models.Upload{UploadId: "numbered", UserId: 1, PartNo: second, PartId: 11, ChannelID: 1, Size: 5})
+	s.NoError(err)
+	_, err = insertUploadPart(s.db, &models.Upload{UploadId: "numbered", UserId: 1, PartNo: first, PartId: 10, ChannelID: 1, Size: 5})
+	s.NoError(err)
+
+	third, err := reservePartNo(s.db, 1, "numbered")
+	s.NoError(err)
+	s.Equal(3, third)
+
+	// Once the parts are gone the upload id starts over.
+	s.NoError(s.db.Where("upload_id = ?", "numbered").Delete(&models.Upload{}).Error)
+	again, err := reservePartNo(s.db, 1, "numbered")
+	s.NoError(err)
+	s.Equal(1, again)
+	s.db.Where("upload_id = ?", "numbered").Delete(&models.UploadPartNumber{})
+}
+
+func (s *UploadServiceSuite) TestUploadRetention() {
+	s.db.Save(&models.User{UserId: 1, Name: "retention", UserName: "retention"})
+	s.db.Where("upload_id = ?", "slow").Delete(&models.UploadRetention{})
+	cnf := s.srv.cnf
+	defer func(retention, max time.Duration) {
+		cnf.Uploads.Retention, cnf.Uploads.MaxRetention = retention, max
+	}(cnf.Uploads.Retention, cnf.Uploads.MaxRetention)
+	cnf.Uploads.Retention, cnf.Uploads.MaxRetention = time.Hour, 48*time.Hour
+
+	now := time.Now().UTC()
+	old := &models.Upload{UploadId: "slow", UserId: 1, Name: "a.part.001", PartNo: 1, PartId: 20, ChannelID: 1,
+		Size: 5, CreatedAt: now.Add(-2 * time.Hour)}
+	s.NoError(s.db.Create(old).Error)
+
+	expired := func() int64 {
+		var n int64
+		s.NoError(s.db.Model(&models.Upload{}).Where("upload_id = ?", "slow").
+			Scopes(check.ExpiredUploads(cnf.Uploads.Retention, time.Now().UTC())).Count(&n).Error)
+		return n
+	}
+	s.Equal(int64(1), expired())
+
+	_, err := s.srv.GetUploadRetention(2, "slow")
+	s.Equal(http.StatusNotFound, err.Code)
+
+	past := now.Add(-time.Minute)
+	_, err = s.srv.SetUploadRetention(1, "slow", &schemas.UploadRetentionIn{ExpiresAt: &past})
+	s.Equal(http.StatusBadRequest, err.Code)
+	tooLong := now.Add(72 * time.Hour)
+	_, err = s.srv.SetUploadRetention(1, "slow", &schemas.UploadRetentionIn{ExpiresAt: &tooLong})
+	s.Equal(http.StatusBadRequest, err.Code)
+
+	until := now.Add(24 * time.Hour)
+	res, err := s.srv.SetUploadRetention(1, "slow", &schemas.UploadRetentionIn{ExpiresAt: &until})
+	s.Nil(err)
+	s.WithinDuration(until, *res.ExpiresAt, time.Second)
+	s.WithinDuration(until, *res.PartsExpireAt, time.Second)
+	s.Equal(int64(0), expired())
+
+	var live int64
+	s.NoError(s.db.Model(&models.Upload{}).Where("upload_id = ?", "slow").
+		Scopes(check.LiveUploads(cnf.Uploads.Retention, time.Now().UTC())).Count(&live).Error)
+	s.Equal(int64(1), live)
+
+	res, err = s.srv.SetUploadRetention(1, "slow", &schemas.UploadRetentionIn{})
+	s.Nil(err)
+	s.Nil(res.ExpiresAt)
+	s.Equal(int64(1), expired())
+}
+
+func (s *UploadServiceSuite) TestCommitSentPart() {
+	part := &models.Upload{UploadId: "up", UserId: 1, Name: "a.part.001", PartNo: 1, PartId: 10, ChannelID: 1,
+		Size: 5, Salt: "salt", Encrypted: true}
+	fetch := func() ([]tg.MessageClass, error) {
+		return []tg.MessageClass{&tg.Message{ID: 10, Media: &tg.MessageMediaDocument{Document: &tg.Document{Size: 5}}}}, nil
+	}
+	_, err := commitSentPart(s.db, part, fetch, func() { s.Fail("verified part discarded") })
+	s.NoError(err)
+
+	var parts []models.Upload
+	s.NoError(s.db.Where("upload_id = ?", "up").Find(&parts).Error)
+	s.Len(parts, 1)
+	s.Equal("salt", parts[0].Salt)
+
+	// A part that fails verification leaves no row behind.
+	failed := &models.Upload{UploadId: "up", UserId: 1, Name: "a.part.002", PartNo: 2, PartId: 11, ChannelID: 1,
+		Size: 5, Salt: "other", Encrypted: true}
+	_, err = commitSentPart(s.db, failed, fetch, func() {})
+	s.Error(err)
+	s.NoError(s.db.Where("upload_id = ?", "up").Find(&parts).Error)
+	s.Len(parts, 1)
+}
+
+func TestSpoolChunkedBody(t *testing.T) {
+	data := bytes.Repeat([]byte("teldrive"), 4096)
+
+	type result struct {
+		chunked bool
+		length  int64
+		size    int64
+		data    []byte
+		removed bool
+	}
+	spooled := make(chan result, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := result{chunked: len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked", length: r.ContentLength}
+		spool, size, err := spoolBody(r.Body, int64(len(data)))
+		if err == nil {
+			res.size = size
+			res.data, _ = io.ReadAll(spool)
+			spool.Close()
+			_, err = os.Stat(spool.Name())
+			res.removed = errors.Is(err, os.ErrNotExist)
+		}
+		spooled <- res
+	}))
+	defer srv.Close()
+
+	// A reader of unknown length makes the client send the body chunked.
+	res, err := http.Post(srv.URL, "application/octet-stream", io.MultiReader(bytes.NewReader(data)))
+	require.NoError(t, err)
+	res.Body.Close()
+
+	got := <-spooled
+	assert.True(t, got.chunked)
+	assert.Equal(t, int64(-1), got.length)
+	assert.Equal(t, int64(len(data)), got.size)
+	assert.Equal(t, data, got.data)
+	assert.True(t, got.removed)
+}
+
+func TestSpoolBodyLimit(t *testing.T) {
+	cnf := &config.TGConfig{}
+	cnf.Uploads.MaxPartSize = 10
+
+	spool, size, err := spoolBody(bytes.NewReader(make([]byte, 100)), cnf.Uploads.MaxPartSize)
+	require.NoError(t, err)
+	defer spool.Close()
+	assert.Equal(t, int64(11), size)
+	assert.Error(t, checkUploadLimits(cnf, size, 0, 1))
+
+	spool, size, err = spoolBody(bytes.NewReader(make([]byte, 10)), cnf.Uploads.MaxPartSize)
+	require.NoError(t, err)
+	defer spool.Close()
+	assert.Equal(t, int64(10), size)
+	assert.NoError(t, checkUploadLimits(cnf, size, 0, 1))
+
+	spool, size, err = spoolBody(bytes.NewReader(make([]byte, 100)), 0)
+	require.NoError(t, err)
+	defer spool.Close()
+	assert.Equal(t, int64(100), size)
+}
+
+func TestPartsRetention(t *testing.T) {
+	oldest := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	res := partsRetention("up", time.Hour, nil, nil)
+	assert.Equal(t, "1h0m0s", res.Retention)
+	assert.Nil(t, res.PartsExpireAt)
+
+	res = partsRetention("up", time.Hour, &oldest, nil)
+	assert.Equal(t, oldest.Add(time.Hour), *res.PartsExpireAt)
+
+	later := oldest.Add(24 * time.Hour)
+	res = partsRetention("up", time.Hour, &oldest, &later)
+	assert.Equal(t, later, *res.PartsExpireAt)
+	assert.Equal(t, &later, res.ExpiresAt)
+
+	sooner := oldest.Add(time.Minute)
+	res = partsRetention("up", time.Hour, &oldest, &sooner)
+	assert.Equal(t, oldest.Add(time.Hour), *res.PartsExpireAt)
+}
+
+func TestChannelFailover(t *testing.T) {
+	assert.True(t, channelFailover(tgerr.New(403, "CHAT_WRITE_FORBIDDEN")))
+	assert.True(t, channelFailover(errors.Join(errors.New("send part"), tgerr.New(400, "CHANNEL_PRIVATE"))))
+	assert.False(t, channelFailover(tgerr.New(420, "FLOOD_WAIT_30")))
+	assert.False(t, channelFailover(errors.New("connection reset")))
+}
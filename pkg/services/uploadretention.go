@@ -0,0 +1,121 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrRetentionInPast = errors.New("expiresAt must be in the future")
+
+// GetUploadRetention reports until when the parts of an upload are kept.
+func (us *UploadService) GetUploadRetention(userId int64, uploadId string) (*schemas.UploadRetention, *types.AppError) {
+	oldest, err := us.uploadOwned(userId, uploadId)
+	if err != nil {
+		return nil, err
+	}
+	return us.uploadRetention(userId, uploadId, oldest)
+}
+
+// SetUploadRetention keeps the parts of an upload until payload.ExpiresAt,
+// when they would be reaped sooner, so a slow upload is not cleaned up while
+// it runs. The extension is bounded by the max retention, and a null
+// ExpiresAt goes back to the configured retention. A reserved session of the
+// upload lives as long as its parts.
+func (us *UploadService) SetUploadRetention(userId int64, uploadId string,
+	payload *schemas.UploadRetentionIn) (*schemas.UploadRetention, *types.AppError) {
+	oldest, appErr := us.uploadOwned(userId, uploadId)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	if payload.ExpiresAt == nil {
+		if err := us.db.Where("upload_id = ? AND user_id = ?", uploadId, userId).
+			Delete(&models.UploadRetention{}).Error; err != nil {
+			return nil, &types.AppError{Error: err}
+		}
+		return us.uploadRetention(userId, uploadId, oldest)
+	}
+
+	now := time.Now().UTC()
+	expiresAt := payload.ExpiresAt.UTC()
+	if !expiresAt.After(now) {
+		return nil, &types.AppError{Error: ErrRetentionInPast, Code: http.StatusBadRequest}
+	}
+	if limit := us.cnf.Uploads.MaxRetention; limit > 0 && expiresAt.Sub(now) > limit {
+		return nil, &types.AppError{Error: fmt.Errorf("retention exceeds limit of %s", limit), Code: http.StatusBadRequest}
+	}
+
+	err := us.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "upload_id"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{"expires_at": expiresAt}),
+		}).Create(&models.UploadRetention{UploadId: uploadId, UserId: userId, ExpiresAt: expiresAt}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.UploadSession{}).Where("upload_id = ? AND user_id = ?", uploadId, userId).
+			Where("expires_at > ? AND expires_at < ?", now, expiresAt).Update("expires_at", expiresAt).Error
+	})
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	return us.uploadRetention(userId, uploadId, oldest)
+}
+
+// uploadOwned returns when the oldest stored part of an upload of the user was
+// created, failing with not found when the user has neither parts nor a live
+// session of it.
+func (us *UploadService) uploadOwned(userId int64, uploadId string) (*time.Time, *types.AppError) {
+	var oldest sql.NullTime
+	if err := us.db.Model(&models.Upload{}).Select("min(created_at)").
+		Where("upload_id = ? AND user_id = ?", uploadId, userId).Scan(&oldest).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	if oldest.Valid {
+		return &oldest.Time, nil
+	}
+	reserved, err := findUploadSession(us.db, userId, uploadId)
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	if reserved == nil {
+		return nil, &types.AppError{Error: database.ErrNotFound, Code: http.StatusNotFound}
+	}
+	return nil, nil
+}
+
+func (us *UploadService) uploadRetention(userId int64, uploadId string, oldest *time.Time) (*schemas.UploadRetention, *types.AppError) {
+	var retentions []models.UploadRetention
+	if err := us.db.Where("upload_id = ? AND user_id = ?", uploadId, userId).Limit(1).
+		Find(&retentions).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	var extended *time.Time
+	if len(retentions) > 0 {
+		extended = &retentions[0].ExpiresAt
+	}
+	return partsRetention(uploadId, us.cnf.Uploads.Retention, oldest, extended), nil
+}
+
+// partsRetention works out when the oldest part of an upload is reaped: once
+// it is older than the retention and the extension, if any, ran out.
+func partsRetention(uploadId string, retention time.Duration, oldest, extended *time.Time) *schemas.UploadRetention {
+	res := &schemas.UploadRetention{UploadId: uploadId, Retention: retention.String(), ExpiresAt: extended}
+	if oldest != nil {
+		expiresAt := oldest.UTC().Add(retention)
+		if extended != nil && extended.After(expiresAt) {
+			expiresAt = *extended
+		}
+		res.PartsExpireAt = &expiresAt
+	}
+	return res
+}
@@ -0,0 +1,283 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/crypt"
+	"github.com/tgdrive/teldrive/internal/database"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrUploadSessionConflict = errors.New("upload session already exists with other parameters")
+	ErrUploadSessionMismatch = errors.New("upload does not match its session")
+	ErrUploadSessionExceeded = errors.New("upload exceeds the size reserved by its session")
+)
+
+// findUploadSession returns the live session of an upload, nil when it was
+// started without one.
+func findUploadSession(db *gorm.DB, userId int64, uploadId string) (*models.UploadSession, error) {
+	var sessions []models.UploadSession
+	if err := db.Where("upload_id = ? AND user_id = ? AND expires_at > ?", uploadId, userId, time.Now().UTC()).
+		Limit(1).Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return nil, nil
+	}
+	return &sessions[0], nil
+}
+
+// uploadLogicalSize is the number of bytes a stored part holds for the file,
+// before compression and server side encryption.
+func uploadLogicalSize(upload *models.Upload) int64 {
+	switch {
+	case upload.Compression != "":
+		return upload.OriginalSize
+	case upload.Encrypted && upload.InlineData == nil:
+		if size, err := crypt.DecryptedSize(upload.Size); err == nil {
+			return size
+		}
+	}
+	return upload.Size
+}
+
+// uploadsLogicalSize is the size of the file made of uploads as clients see
+// it, the size stored for the file.
+func uploadsLogicalSize(uploads []models.Upload) int64 {
+	var total int64
+	for i := range uploads {
+		total += uploadLogicalSize(&uploads[i])
+	}
+	return total
+}
+
+func uploadedBytes(db *gorm.DB, userId int64, uploadId string) (int, int64, error) {
+	var uploads []models.Upload
+	if err := db.Select("size", "original_size", "encrypted", "compression", "inline_data").
+		Where("upload_id = ? AND user_id = ?", uploadId, userId).Find(&uploads).Error; err != nil {
+		return 0, 0, err
+	}
+	return len(uploads), uploadsLogicalSize(uploads), nil
+}
+
+func toUploadSessionOut(reserved *models.UploadSession, parts int, uploaded int64) *schemas.UploadSessionOut {
+	return &schemas.UploadSessionOut{
+		UploadId:   reserved.UploadId,
+		Name:       reserved.Name,
+		Path:       reserved.Path,
+		ParentID:   reserved.ParentID,
+		ChannelID:  reserved.ChannelID,
+		Encryption: reserved.Encryption,
+		TotalSize:  reserved.TotalSize,
+		TotalParts: reserved.TotalParts,
+		Parts:      parts,
+		Uploaded:   uploaded,
+		CreatedAt:  reserved.CreatedAt,
+		ExpiresAt:  reserved.ExpiresAt,
+	}
+}
+
+func sameUploadSession(reserved *models.UploadSession, payload *schemas.UploadSessionIn) bool {
+	intValue := func(v *int) int {
+		if v == nil {
+			return 0
+		}
+		return *v
+	}
+	sizeValue := func(v *int64) int64 {
+		if v == nil {
+			return 0
+		}
+		return *v
+	}
+	return reserved.Name == payload.Name && reserved.Path == payload.Path && reserved.ParentID == payload.ParentID &&
+		(payload.ChannelID == 0 || payload.ChannelID == reserved.ChannelID) &&
+		sizeValue(reserved.TotalSize) == payload.TotalSize && intValue(reserved.TotalParts) == payload.TotalParts
+}
+
+// CreateUploadSession resolves the channel and encryption of an upload once,
+// before any part is sent, and reserves its declared size and part count.
+// The returned flag is false when the session already existed.
+func (us *UploadService) CreateUploadSession(c *gin.Context, payload *schemas.UploadSessionIn) (*schemas.UploadSessionOut, bool, *types.AppError) {
+	userId, _ := auth.GetUser(c)
+
+	if payload.UploadId != "" {
+		existing, err := findUploadSession(us.db, userId, payload.UploadId)
+		if err != nil {
+			return nil, false, &types.AppError{Error: err}
+		}
+		if existing != nil {
+			if !sameUploadSession(existing, payload) {
+				return nil, false, &types.AppError{Error: ErrUploadSessionConflict, Code: http.StatusConflict}
+			}
+			parts, uploaded, err := uploadedBytes(us.db, userId, existing.UploadId)
+			if err != nil {
+				return nil, false, &types.AppError{Error: err}
+			}
+			return toUploadSessionOut(existing, parts, uploaded), false, nil
+		}
+	}
+
+	if err := checkFileType(us.db, us.cache, us.cnf, userId, payload.Name); err != nil {
+		return nil, false, &types.AppError{Error: err, Code: http.StatusUnsupportedMediaType}
+	}
+	if err := checkUploadLimits(us.cnf, 0, payload.TotalSize, payload.TotalParts); err != nil {
+		return nil, false, &types.AppError{Error: err, Code: http.StatusRequestEntityTooLarge}
+	}
+
+	requested, client, err := encryptionMode(payload.Encryption, payload.Encrypted)
+	if err != nil {
+		return nil, false, uploadSettingsError(err)
+	}
+	channelId, encrypted, err := resolveUploadSettings(us.db, us.cache, userId, payload.ParentID, payload.Path,
+		payload.ChannelID, requested, us.placement(userId, payload.UploadId))
+	if err != nil {
+		return nil, false, uploadSettingsError(err)
+	}
+	if !client {
+		if encrypted, _, err = applyEncryptionPolicy(us.db, us.cnf, payload.Name, "", payload.ParentID,
+			payload.Path, encrypted, requested != nil); err != nil {
+			return nil, false, uploadSettingsError(err)
+		}
+	}
+
+	now := time.Now().UTC()
+	reserved := &models.UploadSession{
+		UploadId:   payload.UploadId,
+		UserId:     userId,
+		Name:       payload.Name,
+		Path:       payload.Path,
+		ParentID:   payload.ParentID,
+		ChannelID:  channelId,
+		Encryption: encryptionOf(encrypted, client),
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(us.cnf.Uploads.Retention),
+	}
+	if reserved.UploadId == "" {
+		reserved.UploadId = uuid.NewString()
+	}
+	if payload.TotalSize > 0 {
+		reserved.TotalSize = &payload.TotalSize
+	}
+	if payload.TotalParts > 0 {
+		reserved.TotalParts = &payload.TotalParts
+	}
+
+	// A session that expired is replaced, its parts stay with the upload id.
+	if err := us.db.Where("upload_id = ? AND user_id = ? AND expires_at <= ?", reserved.UploadId, userId, now).
+		Delete(&models.UploadSession{}).Error; err != nil {
+		return nil, false, &types.AppError{Error: err}
+	}
+	if err := us.db.Create(reserved).Error; err != nil {
+		if database.IsKeyConflictErr(err) {
+			return nil, false, &types.AppError{Error: ErrUploadSessionConflict, Code: http.StatusConflict}
+		}
+		return nil, false, &types.AppError{Error: err}
+	}
+
+	parts, uploaded, err := uploadedBytes(us.db, userId, reserved.UploadId)
+	if err != nil {
+		return nil, false, &types.AppError{Error: err}
+	}
+	return toUploadSessionOut(reserved, parts, uploaded), true, nil
+}
+
+// checkSessionPart checks a part against the session of its upload and pins
+// the query to the session's file name, destination, channel and totals.
+func checkSessionPart(reserved *models.UploadSession, query *schemas.UploadQuery) error {
+	switch {
+	case query.FileName != reserved.Name,
+		query.ChannelID != 0 && query.ChannelID != reserved.ChannelID,
+		query.Path != "" && query.Path != reserved.Path,
+		query.ParentID != "" && query.ParentID != reserved.ParentID,
+		query.Encryption != "" && query.Encryption != reserved.Encryption,
+		query.Encrypted != nil && *query.Encrypted != (reserved.Encryption == EncryptionServer):
+		return ErrUploadSessionMismatch
+	case reserved.TotalParts != nil && query.PartNo > *reserved.TotalParts:
+		return fmt.Errorf("%w: part %d of %d", ErrUploadSessionExceeded, query.PartNo, *reserved.TotalParts)
+	}
+	query.Path = reserved.Path
+	query.ParentID = reserved.ParentID
+	query.ChannelID = reserved.ChannelID
+	if reserved.TotalParts != nil && query.TotalParts == 0 {
+		query.TotalParts = *reserved.TotalParts
+	}
+	if reserved.TotalSize != nil && query.TotalSize == 0 {
+		query.TotalSize = *reserved.TotalSize
+	}
+	return nil
+}
+
+// admitSessionPart reserves the size of a part within the session's total
+// until the part is stored.
+func (us *UploadService) admitSessionPart(reserved *models.UploadSession, query *schemas.UploadQuery,
+	size int64) (func(), *types.AppError) {
+	if err := checkSessionPart(reserved, query); err != nil {
+		if errors.Is(err, ErrUploadSessionExceeded) {
+			return nil, &types.AppError{Error: err, Code: http.StatusRequestEntityTooLarge}
+		}
+		return nil, &types.AppError{Error: err, Code: http.StatusConflict}
+	}
+	if reserved.TotalSize == nil {
+		return func() {}, nil
+	}
+	if size < 0 {
+		return nil, &types.AppError{Error: errors.New("content length required"), Code: http.StatusLengthRequired}
+	}
+	_, used, err := uploadedBytes(us.db, reserved.UserId, reserved.UploadId)
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	release, ok := us.reservations.reserve(reserved.UploadId, used, size, *reserved.TotalSize)
+	if !ok {
+		return nil, &types.AppError{Error: ErrUploadSessionExceeded, Code: http.StatusRequestEntityTooLarge}
+	}
+	return release, nil
+}
+
+// pinUploadSession makes a file created from an upload with a session use the
+// channel and encryption the session settled, rejecting any other.
+func pinUploadSession(db *gorm.DB, userId int64, fileIn *schemas.FileIn) (*models.UploadSession, *types.AppError) {
+	reserved, err := findUploadSession(db, userId, fileIn.UploadId)
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	if reserved == nil {
+		return nil, nil
+	}
+	server := reserved.Encryption == EncryptionServer
+	if fileIn.Name != reserved.Name ||
+		(fileIn.ChannelID != 0 && fileIn.ChannelID != reserved.ChannelID) ||
+		(reserved.Path != "" && fileIn.ParentID == "" && fileIn.Path != reserved.Path) ||
+		(reserved.ParentID != "" && fileIn.ParentID != "" && fileIn.ParentID != reserved.ParentID) ||
+		(fileIn.Encryption != "" && fileIn.Encryption != reserved.Encryption) ||
+		(fileIn.Encrypted != nil && *fileIn.Encrypted != server) {
+		return nil, &types.AppError{Error: ErrUploadSessionMismatch, Code: http.StatusConflict}
+	}
+	fileIn.ChannelID = reserved.ChannelID
+	fileIn.Encrypted = &server
+	fileIn.Encryption = reserved.Encryption
+	return reserved, nil
+}
+
+// checkSessionTotals compares the assembled file with the totals its session
+// declared.
+func checkSessionTotals(reserved *models.UploadSession, size int64, parts int) error {
+	if reserved.TotalSize != nil && size != *reserved.TotalSize {
+		return fmt.Errorf("%w: size %d, reserved %d", ErrUploadSessionMismatch, size, *reserved.TotalSize)
+	}
+	if reserved.TotalParts != nil && parts != *reserved.TotalParts {
+		return fmt.Errorf("%w: %d parts, reserved %d", ErrUploadSessionMismatch, parts, *reserved.TotalParts)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/internal/crypt"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+)
+
+func TestCheckSessionPart(t *testing.T) {
+	size, parts := int64(100), 2
+	reserved := &models.UploadSession{Name: "a.bin", Path: "/docs", ChannelID: 7, Encryption: EncryptionServer,
+		TotalSize: &size, TotalParts: &parts}
+
+	query := schemas.UploadQuery{FileName: "a.bin", PartNo: 1}
+	assert.NoError(t, checkSessionPart(reserved, &query))
+	assert.Equal(t, "/docs", query.Path)
+	assert.Equal(t, int64(7), query.ChannelID)
+	assert.Equal(t, 2, query.TotalParts)
+	assert.Equal(t, int64(100), query.TotalSize)
+
+	plain := false
+	for _, query := range []schemas.UploadQuery{
+		{FileName: "b.bin", PartNo: 1},
+		{FileName: "a.bin", PartNo: 1, ChannelID: 8},
+		{FileName: "a.bin", PartNo: 1, Path: "/other"},
+		{FileName: "a.bin", PartNo: 1, Encryption: EncryptionClient},
+		{FileName: "a.bin", PartNo: 1, Encrypted: &plain},
+	} {
+		assert.ErrorIs(t, checkSessionPart(reserved, &query), ErrUploadSessionMismatch)
+	}
+
+	query = schemas.UploadQuery{FileName: "a.bin", PartNo: 3}
+	assert.ErrorIs(t, checkSessionPart(reserved, &query), ErrUploadSessionExceeded)
+}
+
+func TestCheckSessionTotals(t *testing.T) {
+	size, parts := int64(100), 2
+	reserved := &models.UploadSession{TotalSize: &size, TotalParts: &parts}
+
+	assert.NoError(t, checkSessionTotals(reserved, 100, 2))
+	assert.ErrorIs(t, checkSessionTotals(reserved, 99, 2), ErrUploadSessionMismatch)
+	assert.ErrorIs(t, checkSessionTotals(reserved, 100, 3), ErrUploadSessionMismatch)
+	assert.NoError(t, checkSessionTotals(&models.UploadSession{}, 5, 1))
+}
+
+func TestUploadsLogicalSize(t *testing.T) {
+	uploads := []models.Upload{
+		{Size: crypt.EncryptedSize(1 << 20), Encrypted: true},
+		{Size: crypt.EncryptedSize(1000), Encrypted: true},
+		{Size: 300, Compression: "zstd", OriginalSize: 900},
+		{Size: 500},
+	}
+	assert.Equal(t, int64(1<<20+1000+900+500), uploadsLogicalSize(uploads))
+}
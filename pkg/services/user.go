@@ -21,6 +21,7 @@ import (
 	"github.com/tgdrive/teldrive/internal/config"
 	"github.com/tgdrive/teldrive/internal/kv"
 	"github.com/tgdrive/teldrive/internal/tgc"
+	"github.com/tgdrive/teldrive/pkg/httputil"
 	"github.com/tgdrive/teldrive/pkg/models"
 	"github.com/tgdrive/teldrive/pkg/schemas"
 	"github.com/tgdrive/teldrive/pkg/types"
@@ -31,27 +32,25 @@ import (
 	"gorm.io/gorm/clause"
 )
 
+// channelMessageWarnLimit is the message count after which a channel is flagged
+// as nearly full so users can add another channel before uploads start failing.
+const channelMessageWarnLimit = 900000
+
 type UserService struct {
-	db    *gorm.DB
-	cnf   *config.Config
-	kv    kv.KV
-	cache cache.Cacher
+	db      *gorm.DB
+	cnf     *config.Config
+	kv      kv.KV
+	cache   cache.Cacher
+	clients *tgc.Manager
 }
 
-func NewUserService(db *gorm.DB, cnf *config.Config, kv kv.KV, cache cache.Cacher) *UserService {
-	return &UserService{db: db, cnf: cnf, kv: kv, cache: cache}
+func NewUserService(db *gorm.DB, cnf *config.Config, kv kv.KV, cache cache.Cacher, clients *tgc.Manager) *UserService {
+	return &UserService{db: db, cnf: cnf, kv: kv, cache: cache, clients: clients}
 }
 func (us *UserService) GetProfilePhoto(c *gin.Context) {
 	_, session := auth.GetUser(c)
 
-	client, err := tgc.AuthClient(c, &us.cnf.TG, session)
-
-	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
-		return
-	}
-
-	err = tgc.RunWithAuth(c, client, "", func(ctx context.Context) error {
+	err := us.clients.Run(c, us.clients.UserSpec(session), func(ctx context.Context, client *telegram.Client) error {
 		self, err := client.Self(c)
 		if err != nil {
 			return err
@@ -78,7 +77,7 @@ func (us *UserService) GetProfilePhoto(c *gin.Context) {
 		return nil
 	})
 	if err != nil {
-		c.AbortWithError(http.StatusNotFound, err)
+		httputil.NewError(c, http.StatusNotFound, err)
 		return
 	}
 }
@@ -97,7 +96,178 @@ func (us *UserService) GetStats(c *gin.Context) (*schemas.AccountStats, *types.A
 	if err != nil {
 		return nil, &types.AppError{Error: err, Code: http.StatusInternalServerError}
 	}
-	return &schemas.AccountStats{Bots: tokens, ChannelID: channelId}, nil
+	stats := &schemas.AccountStats{Bots: tokens, ChannelID: channelId}
+	if err := accountEntries(us.db, us.cache, us.cnf, userID, stats); err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	return stats, nil
+}
+
+func (us *UserService) GetTelegramStatus(c *gin.Context) (*schemas.TelegramStatus, *types.AppError) {
+	userId, session := auth.GetUser(c)
+
+	status := &schemas.TelegramStatus{}
+
+	key := fmt.Sprintf("users:tgstatus:%d", userId)
+
+	if err := us.cache.Get(key, status); err == nil {
+		return status, nil
+	}
+
+	var channels []models.Channel
+
+	if err := us.db.Where("user_id = ?", userId).Order("channel_name").Find(&channels).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	status.Channels = []schemas.ChannelStatus{}
+
+	limit := getRateLimit(us.db, us.cache, &us.cnf.TG, userId, "")
+	status.RateLimit = schemas.RateLimit{Rate: limit.Rate, Burst: limit.Burst}
+
+	var bots []models.Bot
+
+	if err := us.db.Where("user_id = ?", userId).Order("channel_id, bot_user_name").Find(&bots).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	status.Bots = []schemas.BotStatus{}
+	for i := range bots {
+		status.Bots = append(status.Bots, toBotStatus(&us.cnf.TG, &bots[i]))
+	}
+
+	err := us.clients.Run(c, us.clients.UserSpec(session), func(ctx context.Context, client *telegram.Client) error {
+		self, err := client.Self(ctx)
+		if err != nil {
+			return err
+		}
+		status.IsPremium = self.Premium
+		status.Restricted = self.Restricted
+		for _, reason := range self.RestrictionReason {
+			status.RestrictionReason = append(status.RestrictionReason, reason.Text)
+		}
+
+		for _, channel := range channels {
+			channelStatus := schemas.ChannelStatus{ChannelID: channel.ChannelID,
+				ChannelName: channel.ChannelName, Selected: channel.Selected}
+
+			inputChannel, err := tgc.GetChannelById(ctx, client.API(), channel.ChannelID)
+			if err != nil {
+				if _, ok := tgerr.AsFloodWait(err); ok {
+					return err
+				}
+				channelStatus.Warning = "channel is not accessible"
+				status.Channels = append(status.Channels, channelStatus)
+				continue
+			}
+			channelStatus.Accessible = true
+
+			history, err := client.API().MessagesGetHistory(ctx, &tg.MessagesGetHistoryRequest{
+				Peer:  &tg.InputPeerChannel{ChannelID: inputChannel.ChannelID, AccessHash: inputChannel.AccessHash},
+				Limit: 1,
+			})
+			if err != nil {
+				return err
+			}
+			if messages, ok := history.(*tg.MessagesChannelMessages); ok {
+				channelStatus.MessageCount = messages.Count
+				// Deleted messages only show up in Telegram's count, it
+				// corrects the usage tracked for least-full placement.
+				us.db.Model(&models.Channel{}).Where("channel_id = ?", channel.ChannelID).Where("user_id = ?", userId).
+					Update("messages", messages.Count)
+			}
+			if channelStatus.MessageCount >= channelMessageWarnLimit {
+				channelStatus.Warning = "channel is nearly full, add another channel"
+			}
+			status.Channels = append(status.Channels, channelStatus)
+		}
+		return nil
+	})
+
+	if err != nil {
+		d, ok := tgerr.AsFloodWait(err)
+		if !ok {
+			return nil, &types.AppError{Error: err}
+		}
+		status.FloodWait = int(d.Seconds())
+	}
+
+	// Parts go through the account itself only when the selected channel has
+	// no upload bots, bots never get premium limits.
+	premiumUploads := status.IsPremium
+	for _, channel := range channels {
+		if channel.Selected && premiumUploads {
+			tokens, err := getRoleBots(us.db, us.cache, userId, channel.ChannelID, BotRoleUpload)
+			if err != nil {
+				return nil, &types.AppError{Error: err}
+			}
+			premiumUploads = len(tokens) == 0
+		}
+	}
+	status.UploadLimits = effectiveUploadLimits(&us.cnf.TG, premiumUploads)
+
+	if status.Restricted {
+		status.Warnings = append(status.Warnings, "account is restricted by telegram")
+	}
+	if status.FloodWait > 0 {
+		status.Warnings = append(status.Warnings, fmt.Sprintf("account is flood waited for %d seconds", status.FloodWait))
+	}
+	for _, channel := range status.Channels {
+		if channel.Warning != "" {
+			status.Warnings = append(status.Warnings, fmt.Sprintf("%s: %s", channel.ChannelName, channel.Warning))
+		}
+	}
+	for _, bot := range status.Bots {
+		if bot.ValidationError != "" {
+			status.Warnings = append(status.Warnings, fmt.Sprintf("@%s: %s", bot.BotUserName, bot.ValidationError))
+		}
+	}
+
+	us.cache.Set(key, status, time.Minute)
+
+	return status, nil
+}
+
+// UpdateRateLimit stores the rate limit for the user's session or for one of
+// their bots. Omitted values fall back to the configured defaults.
+func (us *UserService) UpdateRateLimit(c *gin.Context) (*schemas.Message, *types.AppError) {
+	userId, _ := auth.GetUser(c)
+
+	var payload schemas.RateLimitUpdate
+
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+
+	if err := tgc.ValidateRateLimit(&us.cnf.TG, payload.Rate, payload.Burst); err != nil {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
+
+	values := map[string]any{"rate": payload.Rate, "rate_burst": payload.Burst}
+
+	var (
+		chain *gorm.DB
+		key   string
+	)
+
+	if payload.BotID == 0 {
+		chain = us.db.Model(&models.User{}).Where("user_id = ?", userId).Updates(values)
+		key = fmt.Sprintf("users:ratelimit:%d", userId)
+	} else {
+		chain = us.db.Model(&models.Bot{}).Where("user_id = ? AND bot_id = ?", userId, payload.BotID).Updates(values)
+		key = fmt.Sprintf("bots:ratelimit:%d:%d", userId, payload.BotID)
+	}
+
+	if chain.Error != nil {
+		return nil, &types.AppError{Error: chain.Error}
+	}
+	if chain.RowsAffected == 0 {
+		return nil, &types.AppError{Error: errors.New("bot not found"), Code: http.StatusNotFound}
+	}
+
+	us.cache.Delete(key, fmt.Sprintf("users:tgstatus:%d", userId))
+
+	return &schemas.Message{Message: "rate limit updated"}, nil
 }
 
 func (us *UserService) UpdateChannel(c *gin.Context) (*schemas.Message, *types.AppError) {
@@ -124,21 +294,20 @@ func (us *UserService) UpdateChannel(c *gin.Context) (*schemas.Message, *types.A
 		Where("user_id = ?", userId).Update("selected", false)
 
 	key := fmt.Sprintf("users:channel:%d", userId)
-	us.cache.Set(key, payload.ChannelID, 0)
+	channelGroup.Forget(key)
+	us.cache.Delete(key)
 	return &schemas.Message{Message: "channel updated"}, nil
 }
 
 func (us *UserService) ListSessions(c *gin.Context) ([]schemas.SessionOut, *types.AppError) {
 	userId, userSession := auth.GetUser(c)
 
-	client, _ := tgc.AuthClient(c, &us.cnf.TG, userSession)
-
 	var (
 		auth *tg.AccountAuthorizations
 		err  error
 	)
 
-	err = client.Run(c, func(ctx context.Context) error {
+	err = us.clients.Run(c, us.clients.UserSpec(userSession), func(ctx context.Context, client *telegram.Client) error {
 		auth, err = client.API().AccountGetAuthorizations(c)
 		if err != nil {
 			return err
@@ -192,15 +361,16 @@ func (us *UserService) RemoveSession(c *gin.Context) (*schemas.Message, *types.A
 		return nil, &types.AppError{Error: err}
 	}
 
-	client, _ := tgc.AuthClient(c, &us.cnf.TG, session.Session)
+	spec := us.clients.UserSpec(session.Session)
 
-	client.Run(c, func(ctx context.Context) error {
+	us.clients.Run(c, spec, func(ctx context.Context, client *telegram.Client) error {
 		_, err := client.API().AuthLogOut(c)
 		if err != nil {
 			return err
 		}
 		return nil
 	})
+	us.clients.Evict(spec.Key)
 
 	us.db.Where("user_id = ?", userId).Where("hash = ?", session.Hash).Delete(&models.Session{})
 
@@ -209,11 +379,10 @@ func (us *UserService) RemoveSession(c *gin.Context) (*schemas.Message, *types.A
 
 func (us *UserService) ListChannels(c *gin.Context) ([]schemas.Channel, *types.AppError) {
 	_, session := auth.GetUser(c)
-	client, _ := tgc.AuthClient(c, &us.cnf.TG, session)
 
 	channels := make(map[int64]*schemas.Channel)
 
-	client.Run(c, func(ctx context.Context) error {
+	us.clients.Run(c, us.clients.UserSpec(session), func(ctx context.Context, client *telegram.Client) error {
 
 		dialogs, _ := query.GetDialogs(client.API()).BatchSize(100).Collect(ctx)
 
@@ -245,25 +414,30 @@ func (us *UserService) ListChannels(c *gin.Context) ([]schemas.Channel, *types.A
 
 func (us *UserService) AddBots(c *gin.Context) (*schemas.Message, *types.AppError) {
 	userId, session := auth.GetUser(c)
-	client, _ := tgc.AuthClient(c, &us.cnf.TG, session)
 
-	var botsTokens []string
+	var bots []schemas.BotIn
 
-	if err := c.ShouldBindJSON(&botsTokens); err != nil {
+	if err := c.ShouldBindJSON(&bots); err != nil {
 		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
 	}
 
-	if len(botsTokens) == 0 {
+	if len(bots) == 0 {
 		return &schemas.Message{Message: "no bots to add"}, nil
 	}
 
+	for _, bot := range bots {
+		if _, err := tgc.NewAppCredentials(bot.AppId, bot.AppHash); err != nil {
+			return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+		}
+	}
+
 	channelId, err := getDefaultChannel(us.db, us.cache, userId)
 
 	if err != nil {
 		return nil, &types.AppError{Error: err, Code: http.StatusInternalServerError}
 	}
 
-	return us.addBots(c, client, userId, channelId, botsTokens)
+	return us.addBots(c, session, userId, channelId, defaultBotPool, bots)
 
 }
 
@@ -277,22 +451,40 @@ func (us *UserService) RemoveBots(c *gin.Context) (*schemas.Message, *types.AppE
 		return nil, &types.AppError{Error: err, Code: http.StatusInternalServerError}
 	}
 
+	var tokens []string
+
+	us.db.Model(&models.Bot{}).Where("user_id = ?", userID).Where("channel_id = ?", channelId).
+		Pluck("token", &tokens)
+
 	if err := us.db.Where("user_id = ?", userID).Where("channel_id = ?", channelId).
 		Delete(&models.Bot{}).Error; err != nil {
 		return nil, &types.AppError{Error: err, Code: http.StatusInternalServerError}
 	}
 
-	us.cache.Delete(fmt.Sprintf("users:bots:%d:%d", userID, channelId))
+	// A bot can still serve the user's other channels; keep its session then.
+	for _, token := range tokens {
+		var remaining int64
+		us.db.Model(&models.Bot{}).Where("user_id = ? AND token = ?", userID, token).Count(&remaining)
+		if remaining == 0 {
+			us.kv.Delete(tgc.BotSessionKey(userID, token))
+			us.clients.Evict(tgc.BotSessionKey(userID, token))
+		}
+	}
+
+	clearBotsCache(us.cache, userID, channelId)
 
 	return &schemas.Message{Message: "bots deleted"}, nil
 
 }
 
-func (us *UserService) addBots(c context.Context, client *telegram.Client, userId int64, channelId int64, botsTokens []string) (*schemas.Message, *types.AppError) {
+func (us *UserService) addBots(c context.Context, session string, userId int64, channelId int64, pool string,
+	bots []schemas.BotIn) (*schemas.Message, *types.AppError) {
 
 	botInfoMap := make(map[string]*types.BotInfo)
 
-	err := tgc.RunWithAuth(c, client, "", func(ctx context.Context) error {
+	var problems map[int64]string
+
+	err := us.clients.Run(c, us.clients.UserSpec(session), func(ctx context.Context, client *telegram.Client) error {
 
 		channel, err := tgc.GetChannelById(ctx, client.API(), channelId)
 
@@ -306,10 +498,14 @@ func (us *UserService) addBots(c context.Context, client *telegram.Client, userI
 
 		mapMu := sync.Mutex{}
 
-		for _, token := range botsTokens {
+		for _, bot := range bots {
 			g.Go(func() error {
-				info, err := tgc.GetBotInfo(c, us.kv, &us.cnf.TG, token)
+				creds, _ := tgc.NewAppCredentials(bot.AppId, bot.AppHash)
+				info, err := tgc.GetBotInfo(c, us.kv, tgc.WithApp(&us.cnf.TG, creds), userId, bot.Token)
 				if err != nil {
+					if tgc.IsAppRejected(err) {
+						return tgc.ErrAppRejected
+					}
 					return err
 				}
 				botPeerClass, err := peer.DefaultResolver(client.API()).ResolveDomain(ctx, info.UserName)
@@ -319,7 +515,7 @@ func (us *UserService) addBots(c context.Context, client *telegram.Client, userI
 				botPeer := botPeerClass.(*tg.InputPeerUser)
 				info.AccessHash = botPeer.AccessHash
 				mapMu.Lock()
-				botInfoMap[token] = info
+				botInfoMap[bot.Token] = info
 				mapMu.Unlock()
 				return nil
 			})
@@ -328,7 +524,7 @@ func (us *UserService) addBots(c context.Context, client *telegram.Client, userI
 		if err = g.Wait(); err != nil {
 			return err
 		}
-		if len(botsTokens) == len(botInfoMap) {
+		if len(bots) == len(botInfoMap) {
 			users := []tg.InputUser{}
 			for _, info := range botInfoMap {
 				users = append(users, tg.InputUser{UserID: info.Id, AccessHash: info.AccessHash})
@@ -356,30 +552,57 @@ func (us *UserService) addBots(c context.Context, client *telegram.Client, userI
 					return err
 				}
 			}
+			if us.cnf.TG.ValidateBots {
+				if problems, err = checkBotRights(ctx, client.API(), channel, users); err != nil {
+					return err
+				}
+			}
 		} else {
 			return errors.New("failed to fetch bots")
 		}
 		return nil
 	})
 
+	if errors.Is(err, tgc.ErrAppRejected) {
+		return nil, &types.AppError{Error: err, Code: http.StatusBadRequest}
+	}
 	if err != nil {
 		return nil, &types.AppError{Error: err, Code: http.StatusInternalServerError}
 	}
 
 	payload := []models.Bot{}
 
-	for _, info := range botInfoMap {
+	for _, bot := range bots {
+		info := botInfoMap[bot.Token]
 		payload = append(payload, models.Bot{UserID: userId, Token: info.Token, BotID: info.Id,
-			BotUserName: info.UserName, ChannelID: channelId,
+			BotUserName: info.UserName, ChannelID: channelId, AppId: bot.AppId, AppHash: bot.AppHash,
+			Pool: pool,
 		})
 	}
 
-	us.cache.Delete(fmt.Sprintf("users:bots:%d:%d", userId, channelId))
+	clearBotsCache(us.cache, userId, channelId)
 
-	if err := us.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&payload).Error; err != nil {
+	if err := us.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "token"}, {Name: "channel_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"pool"}),
+	}).Create(&payload).Error; err != nil {
 		return nil, &types.AppError{Error: err, Code: http.StatusInternalServerError}
 	}
 
+	for _, bot := range bots {
+		us.cache.Delete(botAppKey(bot.Token))
+	}
+
+	if problems != nil {
+		if err := saveBotValidation(us.db, userId, channelId, payload, problems); err != nil {
+			return nil, &types.AppError{Error: err}
+		}
+		us.cache.Delete(fmt.Sprintf("users:tgstatus:%d", userId))
+		if len(problems) > 0 {
+			return &schemas.Message{Message: fmt.Sprintf("bots added, %d lack rights in the channel", len(problems))}, nil
+		}
+	}
+
 	return &schemas.Message{Message: "bots added"}, nil
 
 }
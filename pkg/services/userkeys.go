@@ -0,0 +1,272 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tgdrive/teldrive/internal/auth"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/internal/reader"
+	"github.com/tgdrive/teldrive/pkg/models"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+	"github.com/tgdrive/teldrive/pkg/types"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrUserKeysDisabled = errors.New("per user encryption keys are not enabled")
+	ErrUserKeyNotFound  = errors.New("encryption key version not found")
+	ErrForeignUserKey   = errors.New("file is encrypted with another user's key")
+	ErrKeyUnavailable   = errors.New("file is encrypted but no usable key is configured")
+)
+
+// deriveUserKey returns the key of one version of a user's keys. The secret
+// stored for the version is useless without the configured encryption key, so
+// a leaked database alone exposes no key.
+func deriveUserKey(master string, userId int64, version int, secret string) string {
+	mac := hmac.New(sha256.New, []byte(master))
+	fmt.Fprintf(mac, "teldrive-user-key:%d:%d:%s", userId, version, secret)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// encryptionKey returns the key data of the user encrypted under version was
+// sealed with. Version 0 is the global uploads key.
+func encryptionKey(db *gorm.DB, cnf *config.TGConfig, userId int64, version int) (string, error) {
+	if cnf.Uploads.EncryptionKey == "" {
+		return "", ErrEncryptionKeyMissing
+	}
+	if version == 0 {
+		return cnf.Uploads.EncryptionKey, nil
+	}
+	var keys []models.UserKey
+	if err := db.Where("user_id = ?", userId).Where("version = ?", version).Find(&keys).Error; err != nil {
+		return "", err
+	}
+	if len(keys) == 0 {
+		return "", fmt.Errorf("%w: %d", ErrUserKeyNotFound, version)
+	}
+	return deriveUserKey(cnf.Uploads.EncryptionKey, userId, version, keys[0].Secret), nil
+}
+
+func latestKeyVersion(db *gorm.DB, userId int64) (int, error) {
+	var version int
+	err := db.Model(&models.UserKey{}).Select("coalesce(max(version), 0)").
+		Where("user_id = ?", userId).Scan(&version).Error
+	return version, err
+}
+
+// createUserKey stores a random secret as version of the user's keys. A
+// version created concurrently is kept.
+func createUserKey(db *gorm.DB, userId int64, version int) error {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&models.UserKey{UserId: userId, Version: version, Secret: hex.EncodeToString(secret)}).Error
+}
+
+// currentKeyVersion returns the key version new encrypted uploads of the user
+// are sealed with, creating the first version of their key when needed.
+func currentKeyVersion(db *gorm.DB, cnf *config.TGConfig, userId int64) (int, error) {
+	if !cnf.Uploads.UserKeys {
+		return 0, nil
+	}
+	version, err := latestKeyVersion(db, userId)
+	if err != nil || version > 0 {
+		return version, err
+	}
+	if err := createUserKey(db, userId, 1); err != nil {
+		return 0, err
+	}
+	return latestKeyVersion(db, userId)
+}
+
+// uploadKey returns the version and key encrypted uploads of the user use.
+func uploadKey(db *gorm.DB, cnf *config.TGConfig, userId int64) (int, string, error) {
+	version, err := currentKeyVersion(db, cnf, userId)
+	if err != nil {
+		return 0, "", err
+	}
+	key, err := encryptionKey(db, cnf, userId, version)
+	if err != nil {
+		return 0, "", err
+	}
+	return version, key, nil
+}
+
+// keyResolver looks up the keys of a file owner, each version once.
+func keyResolver(db *gorm.DB, cnf *config.TGConfig, userId int64) reader.KeyFunc {
+	var (
+		mu   sync.Mutex
+		keys = map[int]string{}
+	)
+	return func(version int) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if key, ok := keys[version]; ok {
+			return key, nil
+		}
+		key, err := encryptionKey(db, cnf, userId, version)
+		if err != nil {
+			return "", err
+		}
+		keys[version] = key
+		return key, nil
+	}
+}
+
+// checkFileKeys resolves every key version the data of an encrypted file was
+// sealed with, so a missing or misconfigured key fails a request before any
+// byte is served instead of part way through the stream.
+func checkFileKeys(keys reader.KeyFunc, file *schemas.FileOutFull) error {
+	if !file.Encrypted {
+		return nil
+	}
+	versions := map[int]bool{}
+	if file.InlineData != nil {
+		versions[file.KeyVersion] = true
+	}
+	for _, part := range file.Parts {
+		versions[part.KeyVersion] = true
+	}
+	for version := range versions {
+		if _, err := keys(version); err != nil {
+			return fmt.Errorf("%w: %w", ErrKeyUnavailable, err)
+		}
+	}
+	return nil
+}
+
+// CheckEncryptionKey looks for encrypted files when no encryption key is
+// configured, as none of them can be served. Depending on the missing key
+// setting this is logged or stops the server from starting.
+func CheckEncryptionKey(db *gorm.DB, cnf *config.Config, logger *zap.SugaredLogger) error {
+	if cnf.TG.Uploads.EncryptionKey != "" {
+		return nil
+	}
+	var count int64
+	if err := db.Model(&models.File{}).Where("encrypted = ?", true).
+		Where("status = ?", "active").Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+	if cnf.TG.Uploads.MissingKey == "fail" {
+		return fmt.Errorf("%d encrypted files exist but no encryption key is configured", count)
+	}
+	logger.Warnw("encrypted files exist but no encryption key is configured, they cannot be served", "files", count)
+	return nil
+}
+
+// usesUserKey reports whether any data of file is sealed with a per user key.
+func usesUserKey(file *schemas.FileOutFull) bool {
+	if !file.Encrypted {
+		return false
+	}
+	if file.KeyVersion > 0 {
+		return true
+	}
+	for _, part := range file.Parts {
+		if part.KeyVersion > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// RotateKey starts a new version of the user's key. Later uploads are sealed
+// with it, files encrypted before keep the version they were sealed with.
+func (us *UserService) RotateKey(c *gin.Context) (*schemas.UserKeyOut, *types.AppError) {
+	userId, _ := auth.GetUser(c)
+
+	if !us.cnf.TG.Uploads.UserKeys {
+		return nil, &types.AppError{Error: ErrUserKeysDisabled, Code: http.StatusBadRequest}
+	}
+
+	var version int
+	err := us.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("select pg_advisory_xact_lock(hashtext(?))", fmt.Sprintf("user_keys:%d", userId)).Error; err != nil {
+			return err
+		}
+		latest, err := latestKeyVersion(tx, userId)
+		if err != nil {
+			return err
+		}
+		version = latest + 1
+		return createUserKey(tx, userId, version)
+	})
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	return &schemas.UserKeyOut{Version: version}, nil
+}
+
+// MigrateKeys reseals the user's encrypted inline files under their current
+// key. Parts stored in Telegram cannot be re-encrypted in place, they stay
+// readable with the key that sealed them and are counted as remaining.
+func (us *UserService) MigrateKeys(c *gin.Context) (*schemas.KeyMigrationOut, *types.AppError) {
+	userId, _ := auth.GetUser(c)
+
+	cnf := &us.cnf.TG
+	if !cnf.Uploads.UserKeys {
+		return nil, &types.AppError{Error: ErrUserKeysDisabled, Code: http.StatusBadRequest}
+	}
+
+	version, key, err := uploadKey(us.db, cnf, userId)
+	if err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	var files []models.File
+	if err := us.db.Select("id", "inline_data", "key_version").Where("user_id = ?", userId).
+		Where("encrypted = ?", true).Where("inline_data IS NOT NULL").Where("key_version <> ?", version).
+		Find(&files).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+
+	out := &schemas.KeyMigrationOut{Version: version}
+	keys := keyResolver(us.db, cnf, userId)
+
+	for _, file := range files {
+		old, err := keys(file.KeyVersion)
+		if err != nil {
+			return nil, &types.AppError{Error: err}
+		}
+		data, err := openInline(old, file.InlineData, true)
+		if err != nil {
+			return nil, &types.AppError{Error: fmt.Errorf("file %s: %w", file.Id, err)}
+		}
+		sealed, err := sealInline(key, data, true)
+		if err != nil {
+			return nil, &types.AppError{Error: err}
+		}
+		res := us.db.Model(&models.File{}).Where("id = ?", file.Id).Where("key_version = ?", file.KeyVersion).
+			Updates(map[string]any{"inline_data": sealed, "key_version": version})
+		if res.Error != nil {
+			return nil, &types.AppError{Error: res.Error}
+		}
+		if res.RowsAffected > 0 {
+			out.Rekeyed++
+			us.cache.Delete(fmt.Sprintf("files:%s", file.Id))
+		}
+	}
+
+	if err := us.db.Model(&models.File{}).Where("user_id = ?", userId).Where("encrypted = ?", true).
+		Where("inline_data IS NULL").Where("jsonb_typeof(parts) = 'array'").
+		Where("EXISTS (SELECT 1 FROM jsonb_array_elements(parts) part WHERE coalesce((part->>'keyVersion')::int, 0) <> ?)", version).
+		Count(&out.Remaining).Error; err != nil {
+		return nil, &types.AppError{Error: err}
+	}
+	return out, nil
+}
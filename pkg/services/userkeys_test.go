@@ -0,0 +1,78 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tgdrive/teldrive/internal/config"
+	"github.com/tgdrive/teldrive/pkg/schemas"
+)
+
+func TestDeriveUserKey(t *testing.T) {
+	key := deriveUserKey("master", 1, 1, "secret")
+	assert.Equal(t, key, deriveUserKey("master", 1, 1, "secret"))
+	assert.NotEqual(t, key, deriveUserKey("master", 2, 1, "secret"))
+	assert.NotEqual(t, key, deriveUserKey("master", 1, 2, "secret"))
+	assert.NotEqual(t, key, deriveUserKey("other", 1, 1, "secret"))
+
+	sealed, err := sealInline(key, []byte("hello"), true)
+	assert.NoError(t, err)
+	data, _ := openInline("master", sealed, true)
+	assert.NotEqual(t, "hello", string(data))
+	data, err = openInline(key, sealed, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestLegacyKeyVersion(t *testing.T) {
+	cnf := &config.TGConfig{}
+	_, err := encryptionKey(nil, cnf, 1, 0)
+	assert.ErrorIs(t, err, ErrEncryptionKeyMissing)
+
+	cnf.Uploads.EncryptionKey = "master"
+	key, err := encryptionKey(nil, cnf, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "master", key)
+
+	version, err := currentKeyVersion(nil, cnf, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, version)
+}
+
+func TestUsesUserKey(t *testing.T) {
+	file := &schemas.FileOutFull{FileOut: &schemas.FileOut{Encrypted: true},
+		Parts: []schemas.Part{{ID: 1}, {ID: 2}}}
+	assert.False(t, usesUserKey(file))
+	file.Parts[1].KeyVersion = 1
+	assert.True(t, usesUserKey(file))
+	file.Encrypted = false
+	assert.False(t, usesUserKey(file))
+}
+
+func TestCheckFileKeys(t *testing.T) {
+	var asked []int
+	keys := func(version int) (string, error) {
+		asked = append(asked, version)
+		if version > 1 {
+			return "", ErrUserKeyNotFound
+		}
+		return "key", nil
+	}
+
+	plain := &schemas.FileOutFull{FileOut: &schemas.FileOut{}, Parts: []schemas.Part{{KeyVersion: 5}}}
+	assert.NoError(t, checkFileKeys(keys, plain))
+	assert.Empty(t, asked)
+
+	file := &schemas.FileOutFull{FileOut: &schemas.FileOut{Encrypted: true},
+		Parts: []schemas.Part{{KeyVersion: 1}, {KeyVersion: 1}}}
+	assert.NoError(t, checkFileKeys(keys, file))
+	assert.Equal(t, []int{1}, asked)
+
+	file.Parts = append(file.Parts, schemas.Part{KeyVersion: 2})
+	err := checkFileKeys(keys, file)
+	assert.ErrorIs(t, err, ErrKeyUnavailable)
+	assert.ErrorIs(t, err, ErrUserKeyNotFound)
+
+	missing := keyResolver(nil, &config.TGConfig{}, 1)
+	assert.ErrorIs(t, checkFileKeys(missing, file), ErrEncryptionKeyMissing)
+}
@@ -3,6 +3,7 @@ package types
 import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gotd/td/session"
+	"github.com/tgdrive/teldrive/pkg/schemas"
 )
 
 type AppError struct {
@@ -10,11 +11,22 @@ type AppError struct {
 	Code  int
 }
 
+// DetailedError is an error that carries structured data returned to clients
+// next to the message.
+type DetailedError interface {
+	error
+	Details() any
+}
+
 type Part struct {
 	DecryptedSize int64
 	Size          int64
 	Salt          string
 	ID            int64
+	Compression   string
+	OriginalSize  int64
+	Replicas      []schemas.Replica
+	KeyVersion    int
 }
 
 type JWTClaims struct {